@@ -0,0 +1,110 @@
+// Package accesslog writes one line per request in common log format, JSON
+// or a custom template.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Entry struct represents a served request
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Client     string    `json:"client,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Duration   float64   `json:"duration_ms"`
+	Upstream   float64   `json:"upstream_ms"`
+	Route      string    `json:"route,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	// Decision is what the balancer did with the request, e.g. proxied or rate_limited
+	Decision string `json:"decision,omitempty"`
+	// RejectReason is why a refused request did not reach a node
+	RejectReason string `json:"reject_reason,omitempty"`
+	UserAgent    string `json:"user_agent,omitempty"`
+}
+
+// Logger writes entries to an output. It is safe for concurrent use.
+type Logger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	format   string
+	template *template.Template
+}
+
+// New returns a logger writing to out in format: common, json, or a Go
+// template over Entry such as
+//
+//	{{.Time.Format "2006-01-02T15:04:05Z07:00"}} {{.Method}} {{.URI}} {{.Status}} {{.Node}}
+func New(out io.Writer, format string) (*Logger, error) {
+	l := &Logger{out: out, format: format}
+	switch format {
+	case "common", "json":
+	default:
+		if !strings.Contains(format, "{{") {
+			return nil, fmt.Errorf("unknown access log format %q, expected common, json or a template", format)
+		}
+		t, err := template.New("access").Parse(format)
+		if err != nil {
+			return nil, err
+		}
+		l.template = t
+	}
+	return l, nil
+}
+
+// Log writes an entry
+func (l *Logger) Log(e Entry) {
+	var line bytes.Buffer
+	switch {
+	case l.template != nil:
+		if err := l.template.Execute(&line, e); err != nil {
+			fmt.Fprintf(&line, "access log template: %v", err)
+		}
+		line.WriteByte('\n')
+	case l.format == "json":
+		json.NewEncoder(&line).Encode(e)
+	default:
+		common(&line, e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line.Bytes())
+}
+
+// common writes the common log format followed by the balancer's fields:
+//
+//	host - user [time] "request" status bytes node upstream_ms decision
+func common(w io.Writer, e Entry) {
+	fmt.Fprintf(w, "%s - %s [%s] \"%s %s %s\" %d %d %s %.1f %s\n",
+		host(e.RemoteAddr), dash(e.Client), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto, e.Status, e.BytesOut,
+		dash(e.Node), e.Upstream, dash(e.Decision))
+}
+
+func host(addr string) string {
+	if i := strings.LastIndexByte(addr, ':'); i > 0 {
+		return strings.Trim(addr[:i], "[]")
+	}
+	return addr
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "_")
+}
@@ -0,0 +1,87 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	entry := Entry{
+		Time:       time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		RemoteAddr: "[::1]:52000",
+		Client:     "team a",
+		Method:     "POST",
+		URI:        "/request?x=1",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		BytesOut:   42,
+		Upstream:   12.34,
+		Node:       "node-1",
+		Decision:   "proxied",
+	}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"common", `::1 - team_a [01/Mar/2024:12:30:00 +0000] "POST /request?x=1 HTTP/1.1" 200 42 node-1 12.3 proxied` + "\n"},
+		{"{{.Method}} {{.Status}} {{.Node}}", "POST 200 node-1\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		l, err := New(&out, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Log(entry)
+		if out.String() != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.format, out.String(), tt.expected)
+		}
+	}
+
+	var out bytes.Buffer
+	l, err := New(&out, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Entry{Method: "GET", Status: 429, Decision: "rate_limited"})
+	var logged map[string]any
+	if err := json.Unmarshal(out.Bytes(), &logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged["status"] != float64(429) || logged["decision"] != "rate_limited" || logged["node"] != nil {
+		t.Errorf("got %v, expected the status and decision without a node", logged)
+	}
+
+	for _, format := range []string{"apache", "{{.Method"} {
+		if _, err := New(&out, format); err == nil {
+			t.Errorf("format %q was accepted", format)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every line pushes the file past 10 bytes, so each one rotates it
+	for name, expected := range map[string]string{"access.log": "fourth\n", "access.log.1": "third\n", "access.log.2": "second\n"} {
+		if data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name)); err != nil || string(data) != expected {
+			t.Errorf("%s holds %q, %v, expected %q", name, data, err, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more than 2 backups were kept")
+	}
+}
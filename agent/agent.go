@@ -0,0 +1,294 @@
+// Package agent lets backend services join the balancer's node pool
+// themselves: an Agent registers the node, reports its live capacity in
+// heartbeats and hands on the drain notifications the balancer sends over a
+// control channel. It only depends on the standard library.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node struct represents how the node registers with the balancer; the
+// fields match the node settings of the admin API
+type Node struct {
+	NodeID        string `json:"node_id"`
+	Address       string `json:"address"`
+	RPMLimit      int    `json:"rpm_limit"`
+	BPMLimit      int    `json:"bpm_limit"`
+	Limits        string `json:"limits,omitempty"`
+	Group         string `json:"group,omitempty"`
+	Pool          string `json:"pool,omitempty"`
+	MaxConcurrent int    `json:"max_concurrent,omitempty"`
+}
+
+// Capacity struct represents what a heartbeat reports. Non-zero limits ask
+// the balancer to replace the node's limits with them.
+type Capacity struct {
+	// InFlight is how many requests the node is serving
+	InFlight int `json:"in_flight"`
+	// Load is the share of its capacity the node is using, from 0 to 1
+	Load     float64 `json:"load"`
+	RPMLimit int     `json:"rpm_limit,omitempty"`
+	BPMLimit int     `json:"bpm_limit,omitempty"`
+	Limits   string  `json:"limits,omitempty"`
+}
+
+// Notification struct represents a message from the balancer. Type is drain
+// once the balancer stopped sending the node new requests.
+type Notification struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Config struct represents how an Agent reaches the balancer
+type Config struct {
+	// URL is the base URL of the balancer, e.g. http://lb:8080
+	URL string
+	// Token is an admin API token with the operator role, if the admin API
+	// is protected
+	Token string
+	// Node is registered when the agent starts; NodeID is required
+	Node Node
+	// Interval is how often heartbeats are sent, 10s by default
+	Interval time.Duration
+	// Capacity reports the node's capacity for each heartbeat; heartbeats
+	// carry no load without it
+	Capacity func() Capacity
+	// OnDrain is called once when the balancer drains the node
+	OnDrain func(Notification)
+	// Deregister removes the node from the pool when Run's context is done
+	Deregister bool
+	// Client sends the requests, with a 10s timeout by default
+	Client *http.Client
+}
+
+// Agent keeps a node registered with the balancer
+type Agent struct {
+	config  Config
+	base    string
+	client  *http.Client
+	once    sync.Once
+	drained chan struct{}
+}
+
+// New returns an agent for config; Run starts it
+func New(config Config) (*Agent, error) {
+	if config.Node.NodeID == "" {
+		return nil, errors.New("agent: node ID is required")
+	}
+	if _, err := url.Parse(config.URL); err != nil || config.URL == "" {
+		return nil, fmt.Errorf("agent: invalid balancer URL %q", config.URL)
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Agent{
+		config:  config,
+		base:    strings.TrimSuffix(config.URL, "/") + "/admin/agents/" + url.PathEscape(config.Node.NodeID),
+		client:  client,
+		drained: make(chan struct{}),
+	}, nil
+}
+
+// Run registers the node, retrying until the balancer accepts it, and then
+// sends heartbeats and listens for notifications. It returns nil once the
+// node is drained, or the context's error when it is done first.
+func (a *Agent) Run(ctx context.Context) error {
+	if err := a.register(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.listen(ctx)
+
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.drained:
+			return nil
+		case <-ctx.Done():
+			if a.config.Deregister {
+				a.deregister()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+			a.heartbeat(ctx)
+		}
+	}
+}
+
+// Drained is closed once the balancer drained the node
+func (a *Agent) Drained() <-chan struct{} {
+	return a.drained
+}
+
+// register registers the node, backing off between failed attempts. A node
+// the balancer refuses is not retried.
+func (a *Agent) register(ctx context.Context) error {
+	for backoff := time.Second; ; backoff = min(2*backoff, 30*time.Second) {
+		status, err := a.do(ctx, http.MethodPut, "", a.config.Node, nil)
+		switch {
+		case err == nil && status == http.StatusOK:
+			return nil
+		case status == http.StatusBadRequest || status == http.StatusUnauthorized || status == http.StatusForbidden:
+			return fmt.Errorf("agent: registering node %s: status %d", a.config.Node.NodeID, status)
+		case err == nil:
+			err = fmt.Errorf("status %d", status)
+		}
+		log.Printf("agent: registering node %s: %v", a.config.Node.NodeID, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (a *Agent) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := a.do(ctx, http.MethodDelete, "", nil, nil); err != nil {
+		log.Printf("agent: deregistering node %s: %v", a.config.Node.NodeID, err)
+	}
+}
+
+// heartbeat reports the node's capacity, registering the node again if the
+// balancer no longer knows it and draining it if the balancer removed it
+func (a *Agent) heartbeat(ctx context.Context) {
+	var capacity Capacity
+	if a.config.Capacity != nil {
+		capacity = a.config.Capacity()
+	}
+	var n Notification
+	status, err := a.do(ctx, http.MethodPost, "/heartbeat", capacity, &n)
+	switch {
+	case err != nil:
+		log.Printf("agent: sending heartbeat of node %s: %v", a.config.Node.NodeID, err)
+	case status == http.StatusGone:
+		a.drain(n)
+	case status == http.StatusNotFound:
+		// The balancer lost the node, e.g. it was restarted with a memory store
+		if err := a.register(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("agent: registering node %s: %v", a.config.Node.NodeID, err)
+		}
+	case status != http.StatusOK:
+		log.Printf("agent: sending heartbeat of node %s: status %d", a.config.Node.NodeID, status)
+	}
+}
+
+// listen holds the control channel open, reconnecting when it breaks
+func (a *Agent) listen(ctx context.Context) {
+	// The control channel stays open, so it must not time out
+	client := *a.client
+	client.Timeout = 0
+	for backoff := time.Second; ctx.Err() == nil; backoff = min(2*backoff, 30*time.Second) {
+		err := a.stream(ctx, &client, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("agent: control channel of node %s: %v", a.config.Node.NodeID, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// stream reads notifications from one connection of the control channel,
+// calling connected once it is open
+func (a *Agent) stream(ctx context.Context, client *http.Client, connected func()) error {
+	req, err := a.request(ctx, http.MethodGet, "/events", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	connected()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var n Notification
+		if err := decoder.Decode(&n); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("closed by the balancer")
+			}
+			return err
+		}
+		if n.Type == "drain" {
+			a.drain(n)
+		}
+	}
+}
+
+func (a *Agent) drain(n Notification) {
+	a.once.Do(func() {
+		log.Printf("agent: node %s drained: %s", a.config.Node.NodeID, n.Reason)
+		if a.config.OnDrain != nil {
+			a.config.OnDrain(n)
+		}
+		close(a.drained)
+	})
+}
+
+func (a *Agent) request(ctx context.Context, method, path string, body any) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.base+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.config.Token)
+	}
+	return req, nil
+}
+
+// do sends body as JSON to the agent endpoint path, decoding the response
+// into out if it is JSON, and returns the response status
+func (a *Agent) do(ctx context.Context, method, path string, body, out any) (int, error) {
+	req, err := a.request(ctx, method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
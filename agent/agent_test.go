@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/api"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// newBalancer starts the API of a balancer with an empty pool
+func newBalancer(t *testing.T) (*httptest.Server, *balancer.LoadBalancer) {
+	t.Helper()
+	lb := balancer.New(store.NewMemoryStore())
+	server := httptest.NewServer(api.NewServer(lb, proxy.New(nil), api.Config{}).Handler())
+	t.Cleanup(server.Close)
+	return server, lb
+}
+
+// await polls cond until it holds, failing with msg after a few seconds
+func await(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	for range 500 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no node ID", config: Config{URL: "http://lb:8080"}},
+		{name: "no URL", config: Config{Node: Node{NodeID: "node-1"}}},
+		{name: "invalid URL", config: Config{URL: "http://lb:port", Node: Node{NodeID: "node-1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("the config was accepted")
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	server, lb := newBalancer(t)
+	drained := make(chan Notification, 1)
+	a, err := New(Config{
+		URL:      server.URL,
+		Node:     Node{NodeID: "node-1", Address: "http://node-1:8080", Limits: "10 req/min"},
+		Interval: 20 * time.Millisecond,
+		Capacity: func() Capacity { return Capacity{InFlight: 1, Load: 0.5, Limits: "20 req/min"} },
+		OnDrain:  func(n Notification) { drained <- n },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+
+	// Heartbeats replace the limits the node registered with
+	await(t, "the node did not get the limits of its heartbeats", func() bool {
+		node, ok := lb.Node("node-1")
+		return ok && node.Limits == "20 req/min"
+	})
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/admin/nodes/node-1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case n := <-drained:
+		if n.Type != "drain" || n.Reason != "removed" {
+			t.Errorf("got notification %+v, expected a drain for removed", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent was not told to drain")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v once drained", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once drained")
+	}
+	select {
+	case <-a.Drained():
+	default:
+		t.Error("Drained is not closed")
+	}
+}
+
+func TestRunDeregister(t *testing.T) {
+	server, lb := newBalancer(t)
+	a, err := New(Config{URL: server.URL, Node: Node{NodeID: "node-1", Limits: "10 req/min"}, Deregister: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	await(t, "the node was not registered", func() bool {
+		_, ok := lb.Node("node-1")
+		return ok
+	})
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, expected the context's error", err)
+	}
+	if _, ok := lb.Node("node-1"); ok {
+		t.Error("the node is still in the pool")
+	}
+}
+
+func TestRunRefused(t *testing.T) {
+	server, _ := newBalancer(t)
+	a, err := New(Config{URL: server.URL, Node: Node{NodeID: "node-1", Limits: "10 req/fortnight"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Run(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected the node refused without retries", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Package analytics exports sampled usage events with pseudonymous client
+// identifiers, so usage can be analysed without handing out raw identifiers.
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Event struct represents one exported request. Client is a keyed hash of
+// the client identifier that changes every rotation period, and SampleWeight
+// is how many requests the event stands for.
+type Event struct {
+	Time         time.Time `json:"time"`
+	Node         string    `json:"node"`
+	Operation    string    `json:"operation"`
+	Client       string    `json:"client,omitempty"`
+	KeyPeriod    time.Time `json:"key_period"`
+	BPM          int       `json:"bpm"`
+	Status       int       `json:"status"`
+	SampleWeight float64   `json:"sample_weight"`
+}
+
+// Options struct represents how events are sampled and pseudonymised
+type Options struct {
+	// SampleRate is the share of requests exported, in (0, 1]
+	SampleRate float64
+	// Rotation is how long a client keeps the same hash
+	Rotation time.Duration
+}
+
+// Exporter writes events as JSON lines in the background. Events are dropped
+// rather than slowing requests down when the writer falls behind.
+type Exporter struct {
+	options Options
+	secret  []byte
+	events  chan Event
+	done    chan struct{}
+}
+
+// NewExporter returns an exporter writing to w. The hashing secret is random
+// and never leaves the process, so hashes cannot be reversed from outside by
+// trying identifiers.
+func NewExporter(w io.Writer, options Options) (*Exporter, error) {
+	if options.SampleRate <= 0 || options.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not in (0, 1]", options.SampleRate)
+	}
+	if options.Rotation <= 0 {
+		return nil, fmt.Errorf("rotation period must be positive")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{options: options, secret: secret, events: make(chan Event, 1024), done: make(chan struct{})}
+	go e.run(json.NewEncoder(w))
+	return e, nil
+}
+
+func (e *Exporter) run(encoder *json.Encoder) {
+	defer close(e.done)
+	for event := range e.events {
+		if err := encoder.Encode(event); err != nil {
+			log.Printf("exporting usage event: %v", err)
+		}
+	}
+}
+
+// Record exports a sampled share of requests. clientID is hashed before it
+// leaves Record; an empty clientID is exported without a client. Record is
+// safe to call on a nil exporter.
+func (e *Exporter) Record(event Event, clientID string) {
+	if e == nil || mathrand.Float64() >= e.options.SampleRate {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.KeyPeriod = event.Time.Truncate(e.options.Rotation)
+	if clientID != "" {
+		event.Client = e.hash(event.KeyPeriod, clientID)
+	}
+	event.SampleWeight = math.Round(1/e.options.SampleRate*1000) / 1000
+
+	select {
+	case e.events <- event:
+	default:
+		metrics.AnalyticsEventsDropped.Inc()
+	}
+}
+
+// hash derives the key of a rotation period from the secret and uses it to
+// hash clientID, so hashes of different periods cannot be linked
+func (e *Exporter) hash(period time.Time, clientID string) string {
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], uint64(period.Unix()))
+	keyMAC := hmac.New(sha256.New, e.secret)
+	keyMAC.Write(epoch[:])
+
+	mac := hmac.New(sha256.New, keyMAC.Sum(nil))
+	mac.Write([]byte(clientID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Close writes the pending events and stops the exporter
+func (e *Exporter) Close() {
+	close(e.events)
+	<-e.done
+}
@@ -0,0 +1,75 @@
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewExporter(t *testing.T) {
+	for _, options := range []Options{{SampleRate: 0, Rotation: time.Hour}, {SampleRate: 1.5, Rotation: time.Hour}, {SampleRate: 1}} {
+		if _, err := NewExporter(&bytes.Buffer{}, options); err == nil {
+			t.Errorf("%+v was accepted", options)
+		}
+	}
+	var e *Exporter
+	e.Record(Event{Node: "node-1"}, "client-a")
+}
+
+func TestRecord(t *testing.T) {
+	var out bytes.Buffer
+	e, err := NewExporter(&out, Options{SampleRate: 1, Rotation: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	e.Record(Event{Time: period.Add(10 * time.Minute), Node: "node-1", Status: 200}, "client-a")
+	e.Record(Event{Time: period.Add(50 * time.Minute), Node: "node-1", Status: 200}, "client-a")
+	e.Record(Event{Time: period.Add(70 * time.Minute), Node: "node-1", Status: 200}, "client-a")
+	e.Record(Event{Time: period.Add(10 * time.Minute), Node: "node-2", Status: 429}, "")
+	e.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, expected every one at a sample rate of 1", len(events))
+	}
+	// Hashes hold within a rotation period and change with the next
+	if events[0].Client == "" || events[0].Client == "client-a" || events[0].Client != events[1].Client {
+		t.Errorf("got clients %q and %q, expected the same hash within a period", events[0].Client, events[1].Client)
+	}
+	if events[2].Client == events[0].Client || !events[2].KeyPeriod.Equal(period.Add(time.Hour)) {
+		t.Errorf("got %+v, expected a new hash for the next period", events[2])
+	}
+	if events[3].Client != "" || events[3].SampleWeight != 1 {
+		t.Errorf("got %+v, expected no client and a weight of 1", events[3])
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var out bytes.Buffer
+	e, err := NewExporter(&out, Options{SampleRate: 0.25, Rotation: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 1000 {
+		e.Record(Event{Node: "node-1"}, "client-a")
+	}
+	e.Close()
+	lines := bytes.Count(out.Bytes(), []byte("\n"))
+	if lines < 150 || lines > 350 {
+		t.Errorf("exported %d of 1000 events, expected about 250", lines)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"sample_weight":4`)) {
+		t.Errorf("got %.100s, expected events to stand for 4 requests", out.String())
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/accesslog"
+)
+
+// countingWriter counts the status and body bytes written to a response. It
+// unwraps to the underlying writer so streaming responses can still flush.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	cw.bytes += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// countingReader counts the request body bytes read by the handler
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// logAccess writes an access log entry once the request is served. It must
+// run inside withRoutingInfo.
+func (s *Server) logAccess(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.AccessLog == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		cw := &countingWriter{ResponseWriter: w}
+		cr := &countingReader{ReadCloser: r.Body}
+		r.Body = cr
+		next(cw, r)
+
+		info := routingInfoFrom(r)
+		s.config.AccessLog.Log(accesslog.Entry{
+			Time:         started,
+			RemoteAddr:   r.RemoteAddr,
+			Client:       info.Client,
+			Tenant:       info.Tenant,
+			Method:       r.Method,
+			URI:          r.URL.RequestURI(),
+			Proto:        r.Proto,
+			Status:       cw.status,
+			BytesIn:      cr.bytes,
+			BytesOut:     cw.bytes,
+			Duration:     milliseconds(time.Since(started)),
+			Upstream:     milliseconds(info.Upstream),
+			Route:        info.Route,
+			Node:         info.Node,
+			Decision:     info.Decision,
+			RejectReason: info.RejectReason,
+			UserAgent:    r.UserAgent(),
+		})
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
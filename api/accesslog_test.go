@@ -0,0 +1,29 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/accesslog"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestLogAccess(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := accesslog.New(&out, "{{.Method}} {{.URI}} {{.Status}} {{.BytesIn}} {{.Route}} {{.Node}} {{.Decision}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := newTestServer(t, Config{AccessLog: logger}, []store.NodeLimits{{NodeID: "node-1", Limits: "1 req/min"}})
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request?x=1", strings.NewReader(`{"bpm": 1}`)))
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != "POST /request?x=1 200 10 /request node-1 simulated" || lines[1] != "POST /request?x=1 429 10 /request  rate_limited" {
+		t.Errorf("logged %q, expected a served request and a refused one", lines)
+	}
+}
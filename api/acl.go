@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// rejectAccessDenied is the reject reason of requests from a client IP the
+// access lists refuse
+const rejectAccessDenied = "access_denied"
+
+// ParsePrefixes parses CIDRs such as 10.0.0.0/8, or single IPs standing for
+// themselves
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ValidateAccessList checks the entries of an access list
+func ValidateAccessList(list store.AccessList) error {
+	if len(list.Allow) == 0 && len(list.Deny) == 0 {
+		return fmt.Errorf("access list %s: allow or deny is required", list.ID)
+	}
+	if _, err := ParsePrefixes(list.Allow); err != nil {
+		return fmt.Errorf("access list %s: allow: %w", list.ID, err)
+	}
+	if _, err := ParsePrefixes(list.Deny); err != nil {
+		return fmt.Errorf("access list %s: deny: %w", list.ID, err)
+	}
+	return nil
+}
+
+// containsAddr reports whether one of prefixes contains addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessList is a store.AccessList with its entries parsed
+type accessList struct {
+	store.AccessList
+	allow, deny []netip.Prefix
+}
+
+// aclSet holds the IP access lists of the routes
+type aclSet struct {
+	mu    sync.RWMutex
+	lists []accessList
+}
+
+func (as *aclSet) set(lists []store.AccessList) {
+	parsed := make([]accessList, 0, len(lists))
+	for _, list := range lists {
+		allow, err := ParsePrefixes(list.Allow)
+		if err == nil {
+			var deny []netip.Prefix
+			if deny, err = ParsePrefixes(list.Deny); err == nil {
+				parsed = append(parsed, accessList{AccessList: list, allow: allow, deny: deny})
+				continue
+			}
+		}
+		log.Printf("access list %s: ignoring it: %v", list.ID, err)
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].ID < parsed[j].ID })
+	as.mu.Lock()
+	as.lists = parsed
+	as.mu.Unlock()
+}
+
+func (as *aclSet) list() []store.AccessList {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	lists := make([]store.AccessList, 0, len(as.lists))
+	for _, list := range as.lists {
+		lists = append(lists, list.AccessList)
+	}
+	return lists
+}
+
+// allows reports whether the lists of route let addr in: no list denies it
+// and, if any of them allows some addresses, one allows it
+func (as *aclSet) allows(route string, addr netip.Addr) bool {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	restricted, allowed := false, false
+	for _, list := range as.lists {
+		if len(list.Routes) > 0 && !slices.Contains(list.Routes, route) {
+			continue
+		}
+		if containsAddr(list.deny, addr) {
+			return false
+		}
+		if len(list.allow) > 0 {
+			restricted = true
+			allowed = allowed || containsAddr(list.allow, addr)
+		}
+	}
+	return !restricted || allowed
+}
+
+// LoadAccessLists reads the IP access lists from the store
+func (s *Server) LoadAccessLists(ctx context.Context) error {
+	if s.config.AccessLists == nil {
+		return nil
+	}
+	lists, err := s.config.AccessLists.AccessLists(ctx)
+	if err != nil {
+		return err
+	}
+	s.acls.set(lists)
+	return nil
+}
+
+// clientIP returns the IP of the client that sent r: the peer, unless it is
+// one of Config.TrustedProxies, in which case the last address of
+// X-Forwarded-For that is not a trusted proxy
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if len(s.config.TrustedProxies) == 0 {
+		return ip
+	}
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(hop))
+		}
+	}
+	// Walk back from the peer for as long as the hops are trusted proxies
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !containsAddr(s.config.TrustedProxies, addr) {
+			return ip
+		}
+		ip = forwarded[i]
+	}
+	return ip
+}
+
+// checkAccess refuses requests from client IPs the access lists of their
+// route do not let in with 403. It must run inside withRoutingInfo.
+func (s *Server) checkAccess(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.AccessLists == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := routingInfoFrom(r)
+		ip := s.clientIP(r)
+		addr, err := netip.ParseAddr(ip)
+		if err == nil && s.acls.allows(info.Route, addr) {
+			next(w, r)
+			return
+		}
+		s.debugf(r, "client IP %s is not allowed on %s", ip, info.Route)
+		info.Decision = "forbidden"
+		countRejection(w, r, rejectAccessDenied)
+		if isGRPC(r, nil) {
+			grpcError(w, grpcPermissionDenied, "client IP not allowed")
+			return
+		}
+		http.Error(w, "Your IP address is not allowed.", http.StatusForbidden)
+	}
+}
+
+// handleAccessLists lists the IP access lists
+func (s *Server) handleAccessLists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.acls.list())
+}
+
+// handleAccessList adds or replaces an IP access list on PUT and removes it
+// on DELETE
+func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
+	if s.config.AccessLists == nil {
+		http.Error(w, "The store cannot keep access lists.", http.StatusNotImplemented)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		ok, err := s.config.AccessLists.DeleteAccessList(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown access list %s", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("deleted access list %s", id)
+	} else {
+		var list store.AccessList
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list.ID = id
+		if err := ValidateAccessList(list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.config.AccessLists.SaveAccessList(r.Context(), list); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("saved access list %s", id)
+	}
+
+	if err := s.LoadAccessLists(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.handleAccessLists(w, r)
+}
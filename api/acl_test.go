@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestAccessListsAllow(t *testing.T) {
+	acls := &aclSet{}
+	acls.set([]store.AccessList{
+		{ID: "office", Routes: []string{"/admin"}, Allow: []string{"10.0.0.0/8", "192.168.1.7"}},
+		{ID: "abuse", Deny: []string{"10.6.6.0/24", "2001:db8::/32"}},
+		{ID: "broken", Allow: []string{"not an ip"}},
+	})
+	tests := []struct {
+		route    string
+		ip       string
+		expected bool
+	}{
+		{route: "/admin", ip: "10.1.2.3", expected: true},
+		{route: "/admin", ip: "192.168.1.7", expected: true},
+		{route: "/admin", ip: "::ffff:192.168.1.7", expected: true},
+		{route: "/admin", ip: "192.168.1.8"},
+		{route: "/admin", ip: "10.6.6.1"},
+		{route: "/request", ip: "192.168.1.8", expected: true},
+		{route: "/request", ip: "10.6.6.1"},
+		{route: "/request", ip: "2001:db8::1"},
+		{route: "/request", ip: "2001:db9::1", expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route+" "+tt.ip, func(t *testing.T) {
+			if got := acls.allows(tt.route, netip.MustParseAddr(tt.ip)); got != tt.expected {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+	if lists := acls.list(); len(lists) != 2 || lists[0].ID != "abuse" {
+		t.Errorf("got lists %+v, expected the valid ones by ID", lists)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.1.2.3/8", " 192.168.1.7 ", "::ffff:10.0.0.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.7/32", "10.0.0.1/32", "2001:db8::/32"}
+	for i, prefix := range prefixes {
+		if prefix.String() != expected[i] {
+			t.Errorf("got %s, expected %s", prefix, expected[i])
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err := ParsePrefixes([]string{invalid}); err == nil {
+			t.Errorf("%q did not fail", invalid)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   []string
+		peer      string
+		forwarded []string
+		expected  string
+	}{
+		{name: "no trusted proxies", peer: "10.0.0.1:1234", forwarded: []string{"1.2.3.4"}, expected: "10.0.0.1"},
+		{name: "untrusted peer", trusted: []string{"10.0.0.0/8"}, peer: "172.16.0.1:1234", forwarded: []string{"1.2.3.4"}, expected: "172.16.0.1"},
+		{name: "trusted peer", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", forwarded: []string{"1.2.3.4"}, expected: "1.2.3.4"},
+		{name: "spoofed hops", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", forwarded: []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, expected: "1.2.3.4"},
+		{name: "only proxies", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", forwarded: []string{"10.0.0.2"}, expected: "10.0.0.2"},
+		{name: "no header", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", expected: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParsePrefixes(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{config: Config{TrustedProxies: trusted}}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := s.clientIP(r); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(store.NodeLimits{NodeID: "node-1", Limits: "100 req/min"})
+	if err := s.SaveAccessList(ctx, store.AccessList{ID: "partners", Routes: []string{"/request"}, Allow: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	lb := balancer.New(s)
+	if err := lb.LoadNodes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := ParsePrefixes([]string{"10.0.0.0/8"})
+	server := NewServer(lb, proxy.New(nil), Config{AccessLists: s, TrustedProxies: trusted})
+	if err := server.LoadAccessLists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	handler := server.Handler()
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded string
+		status    int
+	}{
+		{name: "allowed", peer: "203.0.113.9:1234", status: http.StatusOK},
+		{name: "allowed through a trusted proxy", peer: "10.0.0.1:1234", forwarded: "203.0.113.9", status: http.StatusOK},
+		{name: "not allowed", peer: "198.51.100.1:1234", status: http.StatusForbidden},
+		{name: "forwarded by an untrusted peer", peer: "198.51.100.1:1234", forwarded: "203.0.113.9", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+			r.RemoteAddr = tt.peer
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+)
+
+// requireAdminRole protects the admin API: reads need the viewer role and
+// every other method the operator role. Without an authorizer the admin API
+// is open.
+func (s *Server) requireAdminRole(next http.Handler) http.Handler {
+	if s.config.AdminAuth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := auth.RoleOperator
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = auth.RoleViewer
+		}
+
+		role, err := s.config.AdminAuth.Authorize(r, need)
+		switch {
+		case errors.Is(err, auth.ErrForbidden):
+			log.Printf("denying %s %s to %s token", r.Method, r.URL.Path, role)
+			http.Error(w, "The "+need.String()+" role is required.", http.StatusForbidden)
+			return
+		case err != nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="poc_loadbalancer admin"`)
+			http.Error(w, "Admin authentication required.", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestAdminRoles(t *testing.T) {
+	config := Config{AdminAuth: auth.NewAdminAuthorizer(map[string]auth.Role{"view-token": auth.RoleViewer, "operate-token": auth.RoleOperator})}
+	handler, _ := newTestServer(t, config, nil)
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{name: "anonymous", method: http.MethodGet, status: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodGet, token: "guess", status: http.StatusUnauthorized},
+		{name: "viewer reads", method: http.MethodGet, token: "view-token", status: http.StatusOK},
+		{name: "viewer writes", method: http.MethodDelete, token: "view-token", status: http.StatusForbidden},
+		{name: "operator writes", method: http.MethodDelete, token: "operate-token", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin/degradation", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminLockout(t *testing.T) {
+	guard := &AdminGuard{MaxFailures: 3, Lockout: time.Minute, MaxLockout: 5 * time.Minute}
+	for failures, expected := range map[int64]time.Duration{1: 0, 2: 0, 3: time.Minute, 4: 2 * time.Minute, 5: 4 * time.Minute, 6: 5 * time.Minute, 20: 5 * time.Minute} {
+		if got := guard.lockout(failures); got != expected {
+			t.Errorf("%d failures lock out for %v, expected %v", failures, got, expected)
+		}
+	}
+}
+
+func TestAdminGuard(t *testing.T) {
+	request := func(handler http.Handler, ip, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/degradation", nil)
+		r.RemoteAddr = ip + ":1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("rate limit", func(t *testing.T) {
+		config := Config{AdminGuard: &AdminGuard{Counters: store.NewMemoryStore(), RateLimit: 2}}
+		handler, _ := newTestServer(t, config, nil)
+		for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			if w := request(handler, "10.0.0.1", ""); w.Code != expected {
+				t.Fatalf("request %d got %d, expected %d", i+1, w.Code, expected)
+			}
+		}
+		if w := request(handler, "10.0.0.2", ""); w.Code != http.StatusOK {
+			t.Errorf("another client got %d, expected its own limit", w.Code)
+		}
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		config := Config{
+			AdminAuth:  auth.NewAdminAuthorizer(map[string]auth.Role{"view-token": auth.RoleViewer}),
+			AdminGuard: &AdminGuard{Counters: store.NewMemoryStore(), MaxFailures: 2, Lockout: time.Minute, MaxLockout: time.Hour},
+		}
+		handler, _ := newTestServer(t, config, nil)
+		// A success in between forgets the failures before it
+		for i, token := range []string{"guess", "view-token", "guess", "guess"} {
+			if w := request(handler, "10.0.0.1", token); w.Code == http.StatusTooManyRequests {
+				t.Fatalf("request %d was locked out", i+1)
+			}
+		}
+		w := request(handler, "10.0.0.1", "view-token")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("got %d, expected the client locked out even with a valid token", w.Code)
+		}
+		if w := request(handler, "10.0.0.2", "view-token"); w.Code != http.StatusOK {
+			t.Errorf("another client got %d, expected it let through", w.Code)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// AdminGuard struct represents the limits protecting the admin API from
+// floods and token guessing. They are counted per client IP in a store
+// shared by the replicas, so a client gains nothing by switching replicas.
+type AdminGuard struct {
+	Counters store.Counters
+	// RateLimit is how many admin requests a client IP may make per minute;
+	// zero means no limit
+	RateLimit int
+	// MaxFailures failed authentications in a row lock a client IP out for
+	// Lockout, doubled by every further failure up to MaxLockout; zero turns
+	// the lockout off. Failures are forgotten MaxLockout after the last one.
+	MaxFailures int
+	Lockout     time.Duration
+	MaxLockout  time.Duration
+}
+
+// lockout returns how long the given count of failures in a row locks a
+// client out, zero below MaxFailures
+func (g *AdminGuard) lockout(failures int64) time.Duration {
+	if g.MaxFailures <= 0 || failures < int64(g.MaxFailures) {
+		return 0
+	}
+	delay := g.Lockout
+	for i := int64(g.MaxFailures); i < failures && delay < g.MaxLockout; i++ {
+		delay *= 2
+	}
+	return min(delay, g.MaxLockout)
+}
+
+// guardAdmin refuses with 429 the admin requests of client IPs that are
+// locked out or over the admin rate limit, and counts the failed
+// authentications of the ones it lets through. It must run outside
+// requireAdminRole. Requests are let through when the store fails, so an
+// unreachable store does not lock operators out.
+func (s *Server) guardAdmin(next http.Handler) http.Handler {
+	guard := s.config.AdminGuard
+	if guard == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		lockKey, failuresKey := "admin-lockout:"+ip, "admin-failures:"+ip
+		now := time.Now()
+
+		if _, until, err := guard.Counters.Counter(r.Context(), lockKey); err != nil {
+			log.Printf("reading admin lockout: %v", err)
+		} else if !until.IsZero() {
+			metrics.AdminRejections.WithLabelValues("locked_out").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(until.Sub(now)))))
+			http.Error(w, "Too many failed authentications. Retry later.", http.StatusTooManyRequests)
+			return
+		}
+		if guard.RateLimit > 0 {
+			window := now.Truncate(time.Minute)
+			key := "admin-rate:" + ip + ":" + strconv.FormatInt(window.Unix(), 10)
+			hits, err := guard.Counters.IncrementCounter(r.Context(), key, window.Add(time.Minute))
+			if err != nil {
+				log.Printf("counting admin requests: %v", err)
+			} else if hits > int64(guard.RateLimit) {
+				metrics.AdminRejections.WithLabelValues("rate_limited").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(window.Add(time.Minute).Sub(now)))))
+				http.Error(w, "Too many admin requests. Retry later.", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if s.config.AdminAuth == nil || guard.MaxFailures <= 0 {
+			return
+		}
+		// The request context may be done once the response is written
+		ctx := context.WithoutCancel(r.Context())
+		if cw.status != http.StatusUnauthorized {
+			if err := guard.Counters.DeleteCounter(ctx, failuresKey); err != nil {
+				log.Printf("resetting admin failures: %v", err)
+			}
+			return
+		}
+		failures, err := guard.Counters.IncrementCounter(ctx, failuresKey, now.Add(guard.MaxLockout))
+		if err != nil {
+			log.Printf("counting admin failures: %v", err)
+			return
+		}
+		if delay := guard.lockout(failures); delay > 0 {
+			if _, err := guard.Counters.IncrementCounter(ctx, lockKey, now.Add(delay)); err != nil {
+				log.Printf("locking out %s: %v", ip, err)
+				return
+			}
+			log.Printf("locked %s out of the admin API for %s after %d failed authentications", ip, delay, failures)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// agentPingInterval is how often an idle control channel carries a ping, so
+// agents and proxies in between can tell it is alive
+const agentPingInterval = 15 * time.Second
+
+// Notification types sent to node agents over their control channel
+const (
+	// NotifyPing keeps the control channel alive
+	NotifyPing = "ping"
+	// NotifyDrain tells the node that the balancer stopped sending it new
+	// requests, so it can finish the ones in flight and shut down
+	NotifyDrain = "drain"
+)
+
+// agentNotification struct represents a message to a node agent, written as
+// one JSON line on its control channel
+type agentNotification struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// agentHeartbeat struct represents the live capacity a node agent reports.
+// Non-zero limits replace the node's limits.
+type agentHeartbeat struct {
+	InFlight int     `json:"in_flight"`
+	Load     float64 `json:"load"`
+	RPMLimit int     `json:"rpm_limit,omitempty"`
+	BPMLimit int     `json:"bpm_limit,omitempty"`
+	Limits   string  `json:"limits,omitempty"`
+}
+
+// agentState struct represents what this replica knows of a node's agent
+type agentState struct {
+	NodeID        string    `json:"node_id"`
+	Registered    time.Time `json:"registered"`
+	LastHeartbeat time.Time `json:"last_heartbeat,omitzero"`
+	InFlight      int       `json:"in_flight"`
+	Load          float64   `json:"load"`
+	Connected     bool      `json:"connected"`
+}
+
+// agentRegistry tracks the node agents talking to this replica and their
+// control channels
+type agentRegistry struct {
+	mu        sync.Mutex
+	agents    map[string]*agentState
+	listeners map[string]map[chan agentNotification]struct{}
+	// drained holds why nodes were removed from the pool until their agent
+	// registers them again, for agents that missed the notification
+	drained map[string]string
+}
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{
+		agents:    map[string]*agentState{},
+		listeners: map[string]map[chan agentNotification]struct{}{},
+		drained:   map[string]string{},
+	}
+}
+
+// notify sends n to every control channel of the node's agent
+func (a *agentRegistry) notify(nodeID string, n agentNotification) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ch := range a.listeners[nodeID] {
+		select {
+		case ch <- n:
+		default:
+			// The agent is not reading; its next heartbeat tells it
+		}
+	}
+}
+
+// forget drops the agent of a node removed from the pool, telling it to drain
+func (a *agentRegistry) forget(nodeID, reason string) {
+	a.notify(nodeID, agentNotification{Type: NotifyDrain, Reason: reason})
+	a.mu.Lock()
+	delete(a.agents, nodeID)
+	a.drained[nodeID] = reason
+	a.mu.Unlock()
+	metrics.NodeAgentLoad.DeleteLabelValues(nodeID)
+}
+
+// handleAgents lists the node agents registered with this replica
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	s.agents.mu.Lock()
+	agents := make([]agentState, 0, len(s.agents.agents))
+	for id, agent := range s.agents.agents {
+		state := *agent
+		state.Connected = len(s.agents.listeners[id]) > 0
+		agents = append(agents, state)
+	}
+	s.agents.mu.Unlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].NodeID < agents[j].NodeID })
+	writeJSON(w, http.StatusOK, agents)
+}
+
+// handleAgent registers a node on behalf of its agent on PUT, adding or
+// replacing it like PUT /admin/nodes/{id}, and deregisters it on DELETE,
+// removing the node from the pool
+func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if r.Method == http.MethodDelete {
+		if _, err := s.lb.Store().DeleteNodeLimits(r.Context(), id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.agents.forget(id, "deregistered")
+		if err := s.reloadNodes(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var node store.NodeLimits
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	node.NodeID = id
+	if err := balancer.ValidateNode(node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.saveNode(r.Context(), node); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.agents.mu.Lock()
+	s.agents.agents[id] = &agentState{NodeID: id, Registered: time.Now()}
+	delete(s.agents.drained, id)
+	s.agents.mu.Unlock()
+	log.Printf("node %s registered by its agent at %s", id, node.Address)
+	writeJSON(w, http.StatusOK, node)
+}
+
+// handleAgentHeartbeat records the live capacity of a node, applying the
+// limits the node asks for. Nodes removed from the pool get a 410 with the
+// reason, which tells the agent to drain; other unknown nodes get a 404,
+// which tells it to register again.
+func (s *Server) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var heartbeat agentHeartbeat
+	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	node, ok := s.lb.Node(id)
+	if !ok {
+		s.agents.mu.Lock()
+		reason, drained := s.agents.drained[id]
+		s.agents.mu.Unlock()
+		if drained {
+			writeJSON(w, http.StatusGone, agentNotification{Type: NotifyDrain, Reason: reason})
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unknown node %s", id), http.StatusNotFound)
+		return
+	}
+
+	desired := node
+	if heartbeat.RPMLimit > 0 {
+		desired.RPMLimit = heartbeat.RPMLimit
+	}
+	if heartbeat.BPMLimit > 0 {
+		desired.BPMLimit = heartbeat.BPMLimit
+	}
+	if heartbeat.Limits != "" {
+		desired.Limits = heartbeat.Limits
+	}
+	if desired.RPMLimit != node.RPMLimit || desired.BPMLimit != node.BPMLimit || desired.Limits != node.Limits {
+		if err := balancer.ValidateNode(desired); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.saveNode(r.Context(), desired); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("node %s asked for new limits: %d rpm, %d bpm, %q", id, desired.RPMLimit, desired.BPMLimit, desired.Limits)
+	}
+
+	s.agents.mu.Lock()
+	agent, ok := s.agents.agents[id]
+	if !ok {
+		// Registered with another replica, or before a restart
+		agent = &agentState{NodeID: id, Registered: time.Now()}
+		s.agents.agents[id] = agent
+	}
+	agent.LastHeartbeat, agent.InFlight, agent.Load = time.Now(), heartbeat.InFlight, heartbeat.Load
+	s.agents.mu.Unlock()
+	metrics.NodeAgentLoad.WithLabelValues(id).Set(heartbeat.Load)
+	writeJSON(w, http.StatusOK, desired)
+}
+
+// handleAgentEvents holds the control channel of a node's agent open,
+// streaming notifications as JSON lines until the agent disconnects
+func (s *Server) handleAgentEvents(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := s.lb.Node(id); !ok {
+		http.Error(w, fmt.Sprintf("Unknown node %s", id), http.StatusNotFound)
+		return
+	}
+	// The channel outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	ch := make(chan agentNotification, 8)
+	s.agents.mu.Lock()
+	if s.agents.listeners[id] == nil {
+		s.agents.listeners[id] = map[chan agentNotification]struct{}{}
+	}
+	s.agents.listeners[id][ch] = struct{}{}
+	s.agents.mu.Unlock()
+	defer func() {
+		s.agents.mu.Lock()
+		delete(s.agents.listeners[id], ch)
+		if len(s.agents.listeners[id]) == 0 {
+			delete(s.agents.listeners, id)
+		}
+		s.agents.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	encoder := json.NewEncoder(w)
+	ping := time.NewTicker(agentPingInterval)
+	defer ping.Stop()
+	for {
+		var n agentNotification
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			n = agentNotification{Type: NotifyPing}
+		case n = <-ch:
+		}
+		if err := encoder.Encode(n); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// saveNode stores a validated node and reloads the pool
+func (s *Server) saveNode(ctx context.Context, node store.NodeLimits) error {
+	if err := s.lb.Store().SaveNodeLimits(ctx, node); err != nil {
+		return err
+	}
+	return s.reloadNodes(ctx)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/analytics"
+)
+
+// exportUsage hands a served request to the analytics exporter, if any
+func (s *Server) exportUsage(r *http.Request, node, operation string, bpm, status int) {
+	if s.config.Analytics == nil {
+		return
+	}
+	event := analytics.Event{Node: node, Operation: operation, BPM: bpm, Status: status}
+	s.config.Analytics.Record(event, s.clientID(r))
+}
+
+// clientID identifies the client of r by its authenticated identity or the
+// configured header, falling back to its IP
+func (s *Server) clientID(r *http.Request) string {
+	if client := routingInfoFrom(r).Client; client != "" {
+		return client
+	}
+	if s.config.ClientHeader != "" {
+		if id := r.Header.Get(s.config.ClientHeader); id != "" {
+			return id
+		}
+	}
+	return s.clientIP(r)
+}
+
+// remoteIP returns the IP of the peer that sent r
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,759 @@
+// Package api serves the balancer's HTTP endpoints.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/accesslog"
+	"github.com/jiwooo-kim/poc_loadbalancer/analytics"
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/cache"
+	"github.com/jiwooo-kim/poc_loadbalancer/calendar"
+	"github.com/jiwooo-kim/poc_loadbalancer/clientlimit"
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/shield"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Request struct represents the structure of incoming requests
+type Request struct {
+	BPM int `json:"bpm"`
+}
+
+// Config struct represents the per-route settings of the API, keyed by route path
+type Config struct {
+	RequestSchemas  map[string]*jsonschema.Schema
+	ResponseSchemas map[string]*jsonschema.Schema
+	// AffinityHeader names the request header whose value pins clients to a node
+	AffinityHeader string
+	// ZoneHeader names the request header naming the zone whose nodes the
+	// request prefers, see balancer.LoadBalancer.SetLocality
+	ZoneHeader string
+	// PriorityHeader names the request header carrying the request's
+	// priority class, which overrides the route's
+	PriorityHeader string
+	// BackgroundWorkers run the work requests leave behind, such as
+	// mirrored copies, with up to BackgroundQueue tasks waiting for them;
+	// BackgroundOverflow says what happens to work beyond that
+	BackgroundWorkers  int
+	BackgroundQueue    int
+	BackgroundOverflow string
+	// Cache holds the responses of the routes in CacheTTLs, if set
+	Cache           *cache.Cache
+	CacheTTLs       map[string]time.Duration
+	CacheKeyHeaders []string
+	// GRPC proxies gRPC calls on any path; the listener must accept h2c
+	GRPC bool
+	// Routes holds the declarative settings of each route
+	Routes map[string]RouteConfig
+	// Retry is when and how often failed requests are retried on other
+	// nodes, unless their route or the node that failed them overrides it
+	Retry balancer.RetryPolicy
+	// RetryAccounting decides which attempts count against node limits
+	RetryAccounting balancer.Accounting
+	// RequestTimeout bounds how long a proxied HTTP request may take end to
+	// end, retries included; zero means no limit
+	RequestTimeout time.Duration
+	// MirrorTimeout bounds how long a mirrored copy of a request may take
+	MirrorTimeout time.Duration
+	// Analytics exports sampled usage events, if set
+	Analytics *analytics.Exporter
+	// ServedBy adds an X-Served-By header with the serving node to responses
+	ServedBy bool
+	// RateLimitHeaders adds X-RateLimit-* headers to successful responses;
+	// rejected requests always carry them
+	RateLimitHeaders bool
+	// RateLimitHeaderStyle is x, ietf or both, see ValidateRateLimitHeaders;
+	// routes may override it
+	RateLimitHeaderStyle string
+	// Auth authenticates clients of the proxied routes, if set
+	Auth *auth.Authenticator
+	// AccessLog logs every proxied request, if set
+	AccessLog *accesslog.Logger
+	// AdminAuth protects the admin API, which is open without it
+	AdminAuth *auth.AdminAuthorizer
+	// AdminGuard rate limits the admin API and locks out clients guessing
+	// admin tokens, if set
+	AdminGuard *AdminGuard
+	// ErrorPages replaces the responses of the balancer's own errors, keyed
+	// by condition, see LoadErrorPages
+	ErrorPages map[string]*ErrorPage
+	// MaxResponseBytes bounds the size of response bodies relayed to
+	// clients; routes may override it and zero means no limit
+	MaxResponseBytes int64
+	// ResponseOverflow is what is done with responses over the size limit,
+	// see ResponseOverflowStream; routes may override it
+	ResponseOverflow string
+	// MaxRequestBytes bounds the size of request bodies, larger ones are
+	// refused with 413; routes may override it and zero means no limit
+	MaxRequestBytes int64
+	// Compression compresses responses toward the clients accepting gzip or
+	// br, if set; compressed request bodies are decompressed either way
+	Compression *Compression
+	// BPMAccounting is what the bpm of requests is taken from: declared,
+	// uncompressed or wire, see ValidateBPMAccounting
+	BPMAccounting string
+	// TraceBuffer is how many execution traces of fan-out and pipeline
+	// requests are kept for GET /admin/traces/{id}; zero turns tracing off
+	TraceBuffer int
+	// DiscoveredNodes is set when the node pool comes from discovery rather
+	// than the store, so node changes through the admin API wait for the
+	// next refresh
+	DiscoveredNodes bool
+	// ClientHeader names the request header identifying clients in usage
+	// events and client limits; the client IP is used without it
+	ClientHeader string
+	// ClientLimiter limits the request rate of each client, if set
+	ClientLimiter clientlimit.Limiter
+	// Queue holds the requests submitted with Prefer: respond-async until
+	// RunQueueWorkers forwards them; async submission is off without it
+	Queue store.Queue
+	// AsyncMaxAttempts is how many failed attempts make a queued request dead
+	AsyncMaxAttempts int
+	// AsyncVisibility is how long a worker holds a queued request before
+	// another may claim it
+	AsyncVisibility time.Duration
+	// Maintenance keeps the maintenance windows of nodes, which cannot be
+	// changed through the admin API without it
+	Maintenance store.Maintenance
+	// Tenants keeps the tenants; requests belong to no tenant without it
+	Tenants store.Tenants
+	// TenantHeader names the request header naming the tenant of requests
+	// whose client is not mapped to one. It is ignored when Auth is set, so
+	// clients cannot pick another client's tenant.
+	TenantHeader string
+	// TenantQuotas counts the requests of tenants against their quotas,
+	// which are not enforced without it
+	TenantQuotas store.Counters
+	// Shield bans the source IPs sending requests too fast, if set
+	Shield *shield.Shield
+	// AccessLists keeps the IP access lists of the routes, which are open
+	// to every client IP without it
+	AccessLists store.AccessLists
+	// TrustedProxies are the proxies in front of the balancer whose
+	// X-Forwarded-For header is believed, see clientIP
+	TrustedProxies []netip.Prefix
+	// Events receives the requests refused at a limit and streams the
+	// balancer's events to GET /admin/events subscribers, if set
+	Events *eventbus.Bus
+	// RejectLog records the requests refused without reaching a node, if set
+	RejectLog store.RejectLog
+	// Outcomes records the status, latency and bytes of every request
+	// forwarded by /request and the proxy prefix, if set
+	Outcomes store.Outcomes
+	// Hooks are the extensions run on the proxied requests, see Hook
+	Hooks []Hook
+	// Reports keeps the hourly and daily usage summaries listed by GET
+	// /admin/reports, if set
+	Reports store.Reports
+	// Idempotency keeps the idempotency keys of the routes with
+	// RouteConfig.Idempotency, which forward every request without it
+	Idempotency store.Idempotency
+	// AuditLog records AuditSampleRate of the proxied requests in full,
+	// with their first AuditBodyBytes of body, if set
+	AuditLog        store.AuditLog
+	AuditSampleRate float64
+	AuditBodyBytes  int
+	// RejectDigestClaims lets one replica publish the reject digests of a
+	// day, see RunRejectDigests; every replica does without it
+	RejectDigestClaims store.Counters
+	// Calendar holds the scheduled events with traffic plans, if any
+	Calendar *calendar.Calendar
+	// Degradation is when the balancer degrades on its own, see
+	// RunDegradation
+	Degradation DegradationPolicy
+	// Diagnostics serves goroutine dumps on the admin API, see
+	// handleGoroutines; pprof and expvar have a listener of their own
+	Diagnostics bool
+	// FaultInjection lets fault rules set through the admin API delay,
+	// fail or drop requests, see injectFaults; it is meant for testing
+	// clients against the balancer, not for production traffic
+	FaultInjection bool
+	// ProxyPrefix forwards requests of any method and path under it to the
+	// nodes, see handleProxy; requests of the balancer's own endpoints are
+	// not. Empty only serves POST /request.
+	ProxyPrefix string
+	// DevMode describes the routing decision of every proxied request in
+	// the X-LB-Decision response header; it exposes the node pool and
+	// quotas to clients, so it is meant for local development only
+	DevMode bool
+	// NodePinning lets requests name the node they go to in the
+	// X-Debug-Target-Node header, bypassing selection, when they carry
+	// PinningSecret or an operator admin token in X-Debug-Token
+	NodePinning   bool
+	PinningSecret string
+	// MaxBatch is how many sub-requests POST /batch takes at most; zero
+	// leaves the endpoint out
+	MaxBatch int
+}
+
+// route struct represents an endpoint proxied to the nodes
+type route struct {
+	path    string
+	methods []string
+	handler http.HandlerFunc
+	// async routes accept Prefer: respond-async, see acceptAsync
+	async bool
+	// prefix routes serve every path under path, after every other route
+	prefix bool
+}
+
+// Server serves client traffic through the load balancer
+type Server struct {
+	lb     *balancer.LoadBalancer
+	proxy  *proxy.Proxy
+	config Config
+	rules  ruleSet
+	// routeTable holds the routes of a control plane, see SetRouteTable
+	routeTable routeTable
+	traces     *traceBuffer
+	// preview is the candidate configuration requests are also evaluated
+	// against, nil when there is none
+	preview atomic.Pointer[preview]
+	agents  *agentRegistry
+	// background runs the work requests leave behind, see Close
+	background *backgroundPool
+	// debug holds the clients whose requests are logged verbosely
+	debug *debugTargets
+	// tenants holds the tenants requests belong to, see isolateTenants
+	tenants *tenantSet
+	// acls holds the IP access lists of the routes, see checkAccess
+	acls *aclSet
+	// faults holds the fault rules, see injectFaults
+	faults faultSet
+	// degradation holds the level requests are served at, see degrade
+	degradation *degradation
+	// coalescing holds the GET requests identical ones wait for, see coalesce
+	coalescing *coalescer
+	// blueGreen holds the live pools of the blue/green routes, see
+	// handleBlueGreen
+	blueGreen *blueGreen
+}
+
+// NewServer returns a server routing requests with lb and forwarding them with p
+func NewServer(lb *balancer.LoadBalancer, p *proxy.Proxy, config Config) *Server {
+	s := &Server{lb: lb, proxy: p, config: config, agents: newAgentRegistry(), debug: newDebugTargets(), tenants: &tenantSet{}, acls: &aclSet{}, degradation: newDegradation(), coalescing: newCoalescer(), blueGreen: newBlueGreen(config.Routes)}
+	s.background = newBackgroundPool(config.BackgroundWorkers, config.BackgroundQueue, config.BackgroundOverflow)
+	if config.TraceBuffer > 0 {
+		s.traces = newTraceBuffer(config.TraceBuffer)
+	}
+	return s
+}
+
+// Handler returns the router serving all endpoints
+func (s *Server) Handler() http.Handler {
+	// Initialize router
+	router := mux.NewRouter()
+
+	if s.config.GRPC {
+		router.MatcherFunc(isGRPC).HandlerFunc(withRoutingInfo("grpc", s.logAccess(s.logRejections(s.protect(s.checkAccess(s.authenticate(s.debugLog(s.limitClients(s.handleGRPC)))))))))
+	}
+
+	// Define routes
+	routes := []route{
+		{path: "/request", methods: []string{"POST"}, handler: s.handleRequest, async: true},
+	}
+	if s.config.MaxBatch > 0 {
+		routes = append(routes, route{path: "/batch", methods: []string{"POST"}, handler: s.handleBatch})
+	}
+	routes = s.pipelineRoutes(s.fanOutRoutes(routes))
+	if s.config.ProxyPrefix != "" {
+		routes = append(routes, route{path: s.config.ProxyPrefix, handler: s.handleProxy, prefix: true})
+	}
+	var prefixRoutes []route
+	for _, rt := range routes {
+		path, handler := rt.path, rt.handler
+		handler = s.coalesce(path, handler)
+		if ttl, ok := s.config.CacheTTLs[path]; ok && s.config.Cache != nil {
+			handler = s.cacheResponses(path, ttl, handler)
+		}
+		if schema, ok := s.config.ResponseSchemas[path]; ok {
+			handler = validateResponse(schema, handler)
+		}
+		if rt.async {
+			handler = s.acceptAsync(handler)
+		}
+		if schema, ok := s.config.RequestSchemas[path]; ok {
+			handler = validateBody(schema, handler)
+		}
+		handler = s.deduplicate(path, handler)
+		handler = s.degrade(path, s.injectFaults(path, s.checkRequest(path, handler)))
+		handler = s.logAccess(s.auditRequests(s.logRejections(s.protect(s.compress(s.devMode(s.checkAccess(s.authenticate(s.debugLog(s.runRequestHooks(s.pinNode(s.limitClients(s.isolateTenants(withTimeout(s.requestTimeout(path), handler))))))))))))))
+		if rt.prefix {
+			rt.handler = handler
+			prefixRoutes = append(prefixRoutes, rt)
+			continue
+		}
+		muxRoute := router.HandleFunc(path, withRoutingInfo(path, handler)).Methods(rt.methods...)
+		if match := s.config.Routes[path].match; match != nil {
+			muxRoute.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool { return match.Match(req) })
+		}
+	}
+	router.HandleFunc("/limits", withRoutingInfo("/limits", s.authenticate(s.handleLimits))).Methods("GET")
+	router.HandleFunc("/rejections", withRoutingInfo("/rejections", s.authenticate(s.handleClientRejections))).Methods("GET")
+	if s.config.Queue != nil {
+		router.HandleFunc("/jobs/{id}", withRoutingInfo("/jobs/{id}", s.authenticate(s.handleJob))).Methods("GET")
+	}
+
+	// The status page holds no data, so browsers may load it without the
+	// admin token it then sends to /admin/status
+	router.HandleFunc("/admin/dashboard", s.handleDashboard).Methods("GET")
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.guardAdmin, s.requireAdminRole)
+	admin.HandleFunc("/acl", s.handleAccessLists).Methods("GET")
+	admin.HandleFunc("/acl/{id}", s.handleAccessList).Methods("PUT", "DELETE")
+	admin.HandleFunc("/agents", s.handleAgents).Methods("GET")
+	admin.HandleFunc("/agents/{id}", s.handleAgent).Methods("PUT", "DELETE")
+	admin.HandleFunc("/agents/{id}/heartbeat", s.handleAgentHeartbeat).Methods("POST")
+	admin.HandleFunc("/agents/{id}/events", s.handleAgentEvents).Methods("GET")
+	admin.HandleFunc("/audit", s.handleAudit).Methods("GET")
+	admin.HandleFunc("/bans", s.handleBans).Methods("GET")
+	admin.HandleFunc("/blue-green", s.handleBlueGreen).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/bans/{ip}", s.handleBan).Methods("PUT", "DELETE")
+	admin.HandleFunc("/cache/invalidate", s.handleCacheInvalidate).Methods("POST")
+	admin.HandleFunc("/debug", s.handleDebug).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/degradation", s.handleDegradation).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/events", s.handleEventStream).Methods("GET").HeadersRegexp("Accept", "text/event-stream")
+	admin.HandleFunc("/events", s.handleEvents).Methods("GET")
+	admin.HandleFunc("/explain", s.handleExplain).Methods("POST")
+	admin.HandleFunc("/faults", s.handleFaults).Methods("GET")
+	admin.HandleFunc("/faults/{id}", s.handleFault).Methods("PUT", "DELETE")
+	admin.HandleFunc("/goroutines", s.handleGoroutines).Methods("GET")
+	admin.HandleFunc("/groups/weights", s.handleGroupWeights).Methods("GET", "PUT")
+	admin.HandleFunc("/limits/global", s.handleGlobalLimits).Methods("GET", "PUT")
+	admin.HandleFunc("/maintenance", s.handleMaintenanceWindows).Methods("GET")
+	admin.HandleFunc("/maintenance/{id}", s.handleMaintenanceWindow).Methods("PUT", "DELETE")
+	admin.HandleFunc("/nodes", s.handleNodes).Methods("GET")
+	admin.HandleFunc("/nodes/{id}", s.handleNode).Methods("PUT", "DELETE")
+	admin.HandleFunc("/nodes/{id}/drain", s.handleNodeDrain).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/nodes/{id}/connections", s.handleNodeConnections).Methods("GET")
+	admin.HandleFunc("/nodes/{id}/egress", s.handleNodeEgress).Methods("GET")
+	admin.HandleFunc("/nodes/{id}/health", s.handleNodeHealth).Methods("GET")
+	admin.HandleFunc("/nodes/{id}/quota", s.handleNodeQuota).Methods("GET")
+	admin.HandleFunc("/nodes/{id}/simulate-failure", s.handleSimulateFailure).Methods("POST")
+	admin.HandleFunc("/outcomes", s.handleOutcomes).Methods("GET")
+	admin.HandleFunc("/preview", s.handlePreview).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/regions/usage", s.handleRegionUsage).Methods("GET")
+	admin.HandleFunc("/rejections", s.handleRejections).Methods("GET")
+	admin.HandleFunc("/reports", s.handleReports).Methods("GET")
+	admin.HandleFunc("/rejections/digests", s.handleRejectDigests).Methods("GET")
+	admin.HandleFunc("/rules", s.handleRoutingRules).Methods("GET")
+	admin.HandleFunc("/status", s.handleStatus).Methods("GET")
+	admin.HandleFunc("/tenants", s.handleTenants).Methods("GET")
+	admin.HandleFunc("/tenants/{id}", s.handleTenant).Methods("PUT", "DELETE")
+	admin.HandleFunc("/traces", s.handleTraces).Methods("GET")
+	admin.HandleFunc("/traces/{id}", s.handleTrace).Methods("GET")
+	admin.HandleFunc("/rules/{id}", s.handleRoutingRule).Methods("PUT", "DELETE")
+
+	router.HandleFunc("/healthz", s.handleHealthz).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", s.handleReadyz).Methods("GET", "HEAD")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// Prefix routes come last, so the balancer's own endpoints take precedence
+	for _, rt := range prefixRoutes {
+		muxRoute := router.PathPrefix(rt.path).HandlerFunc(withRoutingInfo(rt.path, rt.handler))
+		if match := s.config.Routes[rt.path].match; match != nil {
+			muxRoute.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool { return match.Match(req) })
+		}
+	}
+	return router
+}
+
+// withTimeout cancels the request context after d, so selection, store
+// queries and the upstream request all stop once it runs out
+func withTimeout(d time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if d <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// balancerRequest describes r to the balancer for node selection
+func (s *Server) balancerRequest(r *http.Request, operation string) balancer.Request {
+	rc := s.config.Routes[routingInfoFrom(r).Route]
+	group := s.rules.group(r)
+	if group == "" {
+		group = rc.group(r)
+	}
+	if group == "" {
+		group = s.blueGreenGroup(r)
+	}
+	if group == "" {
+		group = s.routeTable.group(r)
+	}
+	req := balancer.Request{Operation: operation, Group: group, Priority: s.priority(r), Tenant: routingInfoFrom(r).Tenant, Tokens: rc.Tokens, Node: routingInfoFrom(r).Pinned}
+	if s.config.AffinityHeader != "" {
+		req.AffinityKey = r.Header.Get(s.config.AffinityHeader)
+	}
+	if s.config.ZoneHeader != "" {
+		req.Zone = r.Header.Get(s.config.ZoneHeader)
+	}
+	s.explain(r, req)
+	return req
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	info := routingInfoFrom(r)
+	request, err := decodeRequest(body)
+	if err != nil {
+		info.Decision = "invalid"
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.BPM = s.requestBPM(r, request, body)
+	s.forward(w, r, body, request.BPM, request)
+}
+
+// forward sends a request accounted with bpm to a node, retrying it on
+// others as its retry policy says, and relays the answer. A nil body streams
+// the request's own body to a single node, which is not retried; other
+// requests are mirrored once the first node accepts them. described is what
+// the forwarding log line shows of the request.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, body []byte, bpm int, described any) {
+	info := routingInfoFrom(r)
+	target := s.balancerRequest(r, r.Method+" "+info.Route)
+	attempts := s.lb.NewAttempts(s.config.RetryAccounting, target.Operation, bpm)
+
+	var resp *http.Response
+	var selectedNode string
+	// exhausted is set when every node that could take the request failed it
+	exhausted := false
+	// release gives back the concurrency slot of the node last sent the request
+	release := func() {}
+	defer func() { release() }()
+	// Only the first selection is compared with the preview configuration
+	comparePreview := s.startPreview(r, target)
+	for attempt := 0; ; attempt++ {
+		selecting := time.Now()
+		nextNode, err := s.lb.SelectNode(r.Context(), target)
+		info.timePhase(phaseSelection, selecting)
+		if err == nil && comparePreview != nil {
+			comparePreview(nextNode)
+			comparePreview = nil
+		}
+		if err != nil {
+			log.Printf("selecting node: %v", err)
+			if attempt == 0 {
+				info.Decision = "error"
+				countRejection(w, r, balancer.RejectStore)
+				s.writeError(w, r, ConditionStoreUnavailable, http.StatusInternalServerError, "Rate limit state is unavailable.")
+				return
+			}
+			break
+		}
+		s.debugf(r, "attempt %d selected node %q, excluding %v", attempt+1, nextNode, target.Exclude)
+		if nextNode == "" {
+			if attempt == 0 {
+				s.rejectNoNode(w, r, target)
+				return
+			}
+			// No node left to retry on, answer with the last failure
+			exhausted = true
+			break
+		}
+		if s.selectionHooksRefuse(r, nextNode) {
+			target.Exclude = append(target.Exclude, nextNode)
+			attempt--
+			continue
+		}
+		slot, ok := s.lb.AcquireTokens(nextNode, target.Tokens)
+		if !ok {
+			// Other requests hold the node's capacity tokens, try the next
+			// one without using up a retry
+			s.debugf(r, "node %s has no capacity tokens left", nextNode)
+			target.Exclude = append(target.Exclude, nextNode)
+			attempt--
+			continue
+		}
+		// Update BPM in the store
+		claiming := time.Now()
+		err = attempts.Start(r.Context(), nextNode)
+		info.timePhase(phaseLimits, claiming)
+		if errors.Is(err, balancer.ErrOverLimit) {
+			// Another replica took the node's last quota, try the next one
+			// without using up a retry
+			s.debugf(r, "node %s is over its limits in the store", nextNode)
+			slot()
+			target.Exclude = append(target.Exclude, nextNode)
+			attempt--
+			continue
+		} else if err != nil {
+			log.Printf("recording request for node %s: %v", nextNode, err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+		release()
+		release = slot
+		selectedNode = nextNode
+		if attempt == 0 && body != nil {
+			s.mirror(r, body, target.Operation, bpm)
+		}
+
+		node, _ := s.lb.Node(selectedNode)
+		s.debugf(r, "forwarding to node %s (%s): %+v", selectedNode, node.Address, described)
+
+		if node.Address == "" {
+			// Nodes without an address only simulate forwarding
+			if err := s.succeeded(r, attempts, selectedNode); err != nil {
+				log.Printf("recording request for node %s: %v", selectedNode, err)
+			}
+			if s.servedBy(info.Route) {
+				w.Header().Set(servedByHeader, selectedNode)
+			}
+			s.reportRateLimit(w.Header(), r, selectedNode)
+			info.Node, info.Decision = selectedNode, "simulated"
+			response := map[string]string{"status": "success", "message": fmt.Sprintf("Request forwarded to node %s", selectedNode)}
+			json.NewEncoder(w).Encode(response)
+			s.exportUsage(r, selectedNode, target.Operation, bpm, http.StatusOK)
+			return
+		}
+
+		started := time.Now()
+		if hedge := s.config.Routes[info.Route].Hedge; hedge != nil && body != nil {
+			selectedNode, resp, release = s.hedge(r, body, hedge.delay, selectedNode, release, &target, attempts)
+		} else {
+			resp = s.send(r, body, selectedNode, node, s.config.Routes[info.Route].chain())
+		}
+		info.Upstream += time.Since(started)
+		if r.Context().Err() != nil {
+			// The client went away or the request timed out; neither is the node's fault
+			break
+		}
+		if resp == nil {
+			s.debugf(r, "node %s is unreachable", selectedNode)
+		} else {
+			s.debugf(r, "node %s answered %d in %s", selectedNode, resp.StatusCode, time.Since(started))
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		policy := s.retryPolicy(info.Route, selectedNode)
+		if body == nil || attempt >= policy.Attempts || !policy.Retries(status) {
+			break
+		}
+		target.Exclude = append(target.Exclude, selectedNode)
+		if backoff := policy.Wait(attempt + 1); backoff > 0 {
+			s.debugf(r, "waiting %s before retrying", backoff)
+			if !wait(r, backoff) {
+				break
+			}
+		}
+	}
+
+	sent := int64(len(body))
+	if body == nil {
+		sent = max(r.ContentLength, 0)
+	}
+	if resp == nil && selectedNode != "" {
+		s.recordOutcome(r, selectedNode, target.Operation, 0, sent, 0)
+	}
+	if resp == nil && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		info.Node, info.Decision = selectedNode, "timeout"
+		s.writeError(w, r, ConditionTimeout, http.StatusGatewayTimeout, fmt.Sprintf("Node %s did not answer in time.", selectedNode))
+		return
+	}
+	if resp == nil && !exhausted && r.Context().Err() == nil {
+		// Out of retries; the request is unavailable rather than failed by
+		// one node if no untried node is left either
+		selecting := time.Now()
+		if next, err := s.lb.SelectNode(r.Context(), target); err == nil && next == "" {
+			exhausted = true
+		}
+		info.timePhase(phaseSelection, selecting)
+	}
+	if resp == nil && exhausted {
+		info.Node, info.Decision = selectedNode, "unreachable"
+		s.writeError(w, r, ConditionUnavailable, http.StatusServiceUnavailable, "No node could be reached.")
+		return
+	}
+	if resp == nil {
+		info.Node, info.Decision = selectedNode, "unreachable"
+		s.writeError(w, r, ConditionUnreachable, http.StatusBadGateway, fmt.Sprintf("Node %s is unreachable.", selectedNode))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 500 {
+		if err := s.succeeded(r, attempts, selectedNode); err != nil {
+			log.Printf("recording request for node %s: %v", selectedNode, err)
+		}
+	}
+
+	if s.servedBy(info.Route) {
+		resp.Header.Set(servedByHeader, selectedNode)
+	} else {
+		resp.Header.Del(servedByHeader)
+	}
+	if resp.StatusCode < 400 {
+		s.reportRateLimit(resp.Header, r, selectedNode)
+	}
+
+	info.Node = selectedNode
+	info.Proxied = true
+	info.Decision = "proxied"
+	s.runResponseHooks(r, selectedNode, resp)
+	if s.config.Outcomes != nil {
+		counted := &countingWriter{ResponseWriter: w}
+		s.relay(counted, r, resp)
+		s.recordOutcome(r, selectedNode, target.Operation, resp.StatusCode, sent, counted.bytes)
+	} else {
+		s.relay(w, r, resp)
+	}
+	s.exportUsage(r, selectedNode, target.Operation, bpm, resp.StatusCode)
+}
+
+// succeeded accounts a request nodeID answered successfully
+func (s *Server) succeeded(r *http.Request, attempts *balancer.Attempts, nodeID string) error {
+	defer routingInfoFrom(r).timePhase(phaseLimits, time.Now())
+	return attempts.Succeeded(r.Context(), nodeID)
+}
+
+// retryable reports whether a forwarding attempt failed in a way another node
+// may not: the node was unreachable (resp is nil) or answered with a gateway error
+func retryable(resp *http.Response) bool {
+	if resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// handleNodeQuota reports the usage of every limit window of a node
+func (s *Server) handleNodeQuota(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	quota, ok, err := s.lb.Quota(r.Context(), nodeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quota)
+}
+
+// handleNodeEgress reports the bytes written to a node's connections and
+// how they compare with its egress cap
+func (s *Server) handleNodeEgress(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	node, ok := s.lb.Node(nodeID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+	usage, ok := s.proxy.EgressUsage(nodeID)
+	if !ok {
+		usage = proxy.EgressUsage{Node: nodeID, Limit: node.EgressLimit}
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// handleNodeConnections reports how the requests sent to a node used its
+// keep-alive connections, 404 unless -connection-accounting is on
+func (s *Server) handleNodeConnections(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	if _, ok := s.lb.Node(nodeID); !ok {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+	usage, ok := s.proxy.ConnectionUsage(nodeID)
+	if !ok && !s.proxy.CountsConnections() {
+		http.Error(w, "Connection accounting is off.", http.StatusNotFound)
+		return
+	}
+	if !ok {
+		usage = proxy.ConnectionUsage{Node: nodeID}
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// handleNodeHealth reports the health state and recent transitions of a node
+func (s *Server) handleNodeHealth(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	if _, ok := s.lb.Node(nodeID); !ok {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.lb.HealthHistory(nodeID))
+}
+
+// handleSimulateFailure makes the balancer treat a node as failed for the
+// given number of minutes; zero minutes ends the simulation
+func (s *Server) handleSimulateFailure(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	var simulation struct {
+		Minutes float64 `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&simulation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if simulation.Minutes < 0 {
+		http.Error(w, "minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+	if !s.lb.SimulateFailure(nodeID, time.Duration(simulation.Minutes*float64(time.Minute))) {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+
+	response := map[string]any{"node_id": nodeID, "failed": false}
+	if until, ok := s.lb.FailedUntil(nodeID); ok {
+		log.Printf("simulating failure of node %s until %s", nodeID, until.Format(time.RFC3339))
+		response["failed"] = true
+		response["failed_until"] = until
+	} else {
+		log.Printf("ended simulated failure of node %s", nodeID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGroupWeights reports or, on PUT, replaces the traffic split between node groups
+func (s *Server) handleGroupWeights(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.lb.SetGroupWeights(weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.lb.GroupWeights())
+}
@@ -0,0 +1,468 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// newTestServer returns a server over a memory store holding nodes and
+// records
+func newTestServer(t *testing.T, config Config, nodes []store.NodeLimits, records ...store.Record) (http.Handler, *store.MemoryStore) {
+	t.Helper()
+	s := store.NewMemoryStore(nodes...)
+	if err := s.RecordRequests(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	lb := balancer.New(s)
+	if err := lb.LoadNodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(lb, proxy.New(nil), config).Handler(), s
+}
+
+// newBackend starts a node answering every request with status and its
+// own name
+func newBackend(t *testing.T, name string, status int) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// loadRoutes returns the route settings of the JSON object routes, as
+// LoadRouteConfig reads them
+func loadRoutes(t *testing.T, routes string) map[string]RouteConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadRouteConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// counterValue returns the value of the counter name with labels from the
+// default registry, zero when it was never incremented
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// histogramCount returns how many observations the histogram name with
+// labels from the default registry holds
+func histogramCount(t *testing.T, name string, labels map[string]string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestHandleRequest(t *testing.T) {
+	ok := newBackend(t, "ok", http.StatusOK)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	full := []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second), BPM: 1}}
+
+	tests := []struct {
+		name     string
+		config   Config
+		nodes    []store.NodeLimits
+		records  []store.Record
+		body     string
+		status   int
+		servedBy string
+		reason   string
+		response string
+	}{
+		{
+			name:     "forwarded to the node",
+			config:   Config{ServedBy: true},
+			nodes:    []store.NodeLimits{{NodeID: "node-1", Address: ok.URL, Limits: "10 req/min"}},
+			body:     `{"bpm": 1}`,
+			status:   http.StatusOK,
+			servedBy: "node-1",
+			response: "ok",
+		},
+		{
+			name:     "simulated without an address",
+			config:   Config{ServedBy: true},
+			nodes:    []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}},
+			body:     `{"bpm": 1}`,
+			status:   http.StatusOK,
+			servedBy: "node-1",
+			response: `"status":"success"`,
+		},
+		{
+			name:     "retried on another node",
+			config:   Config{ServedBy: true, Retry: balancer.RetryPolicy{Attempts: 1, On: balancer.DefaultRetryOn}},
+			nodes:    []store.NodeLimits{{NodeID: "node-1", Address: closed.URL, Limits: "10 req/min"}, {NodeID: "node-2", Address: ok.URL, Limits: "1 req/min"}},
+			records:  []store.Record{{NodeID: "node-2", Operation: "POST /request", Timestamp: time.Now().Add(-2 * time.Minute)}},
+			body:     `{"bpm": 1}`,
+			status:   http.StatusOK,
+			servedBy: "node-2",
+			response: "ok",
+		},
+		{
+			name:   "invalid JSON",
+			nodes:  []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}},
+			body:   `{"bpm": `,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "node at its request limit",
+			nodes:   []store.NodeLimits{{NodeID: "node-1", Limits: "1 req/min"}},
+			records: full,
+			body:    `{"bpm": 1}`,
+			status:  http.StatusTooManyRequests,
+			reason:  balancer.RejectNodeRequests,
+		},
+		{
+			name:    "node at its byte limit",
+			nodes:   []store.NodeLimits{{NodeID: "node-1", RPMLimit: 10, BPMLimit: 5}},
+			records: []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second), BPM: 5}},
+			body:    `{"bpm": 1}`,
+			status:  http.StatusTooManyRequests,
+			reason:  balancer.RejectNodeBytes,
+		},
+		{
+			name:   "no nodes",
+			body:   `{"bpm": 1}`,
+			status: http.StatusServiceUnavailable,
+			reason: balancer.RejectNoNodes,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestServer(t, tt.config, tt.nodes, tt.records...)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(tt.body)))
+
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if got := w.Header().Get(servedByHeader); got != tt.servedBy {
+				t.Errorf("served by %q, expected %q", got, tt.servedBy)
+			}
+			if got := w.Header().Get(rejectReasonHeader); got != tt.reason {
+				t.Errorf("reject reason %q, expected %q", got, tt.reason)
+			}
+			if !strings.Contains(w.Body.String(), tt.response) {
+				t.Errorf("got body %q, expected it to contain %q", w.Body.String(), tt.response)
+			}
+			if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("rate limited response has no Retry-After")
+			}
+		})
+	}
+}
+
+func TestHandleRequestAccounting(t *testing.T) {
+	handler, s := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "2 req/min"}})
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, status := range expected {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 3}`)))
+		if w.Code != status {
+			t.Fatalf("request %d: got %d, expected %d", i+1, w.Code, status)
+		}
+	}
+	usage, _ := s.Usage(context.Background(), time.Now().Add(-time.Minute))
+	if got := usage["node-1"]; got.Requests != 2 || got.BPM != 6 {
+		t.Errorf("recorded %+v, expected the 2 accepted requests of 3 bpm", got)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// Both nodes answer after the timeout; the one tried first is not to
+	// blame, so the request is not retried on the other
+	var calls atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	config := Config{RequestTimeout: 50 * time.Millisecond, Retry: balancer.RetryPolicy{Attempts: 1, On: balancer.DefaultRetryOn}}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{
+		{NodeID: "node-1", Address: slow.URL, Limits: "100 req/min"},
+		{NodeID: "node-2", Address: slow.URL, Limits: "100 req/min"},
+	})
+
+	started := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, expected 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(started); elapsed >= time.Second {
+		t.Errorf("answered after %s, expected the request timeout", elapsed)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("the nodes got %d calls, expected 1", got)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  []store.Record
+		status   int
+		mirrored int
+	}{
+		{name: "accepted requests are mirrored", status: http.StatusOK, mirrored: 1},
+		{
+			name:    "rejected requests are not",
+			records: []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}},
+			status:  http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mirrored atomic.Int32
+			shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mirrored.Add(1)
+			}))
+			defer shadow.Close()
+			s := store.NewMemoryStore(store.NodeLimits{NodeID: "node-1", Limits: "1 req/min"}, store.NodeLimits{NodeID: "shadow-1", Address: shadow.URL, Limits: "10 req/min", Group: "shadow"})
+			s.RecordRequests(context.Background(), tt.records)
+			lb := balancer.New(s)
+			if err := lb.LoadNodes(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := lb.SetMirror("shadow", 100); err != nil {
+				t.Fatal(err)
+			}
+			server := NewServer(lb, proxy.New(nil), Config{MirrorTimeout: time.Second})
+
+			w := httptest.NewRecorder()
+			server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d, expected %d", w.Code, tt.status)
+			}
+			// Closing waits for the background work, the mirrored copy included
+			if err := server.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := int(mirrored.Load()); got != tt.mirrored {
+				t.Errorf("shadow node got %d copies, expected %d", got, tt.mirrored)
+			}
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		calls  int
+	}{
+		{name: "shared", header: http.Header{"Cache-Control": {"max-age=60"}}, calls: 1},
+		{name: "cookie", header: http.Header{"Set-Cookie": {"session=1"}}, calls: 2},
+		{name: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}, calls: 2},
+		{name: "no-store", header: http.Header{"Cache-Control": {"no-store"}}, calls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				time.Sleep(100 * time.Millisecond)
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				io.WriteString(w, "resource")
+			}))
+			defer backend.Close()
+			config := Config{ProxyPrefix: "/api/", Routes: map[string]RouteConfig{"/api/": {Coalesce: true}}}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			var wg sync.WaitGroup
+			for i := range 2 {
+				// The second request arrives while the first is in flight
+				time.Sleep(time.Duration(i) * 20 * time.Millisecond)
+				wg.Go(func() {
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/resource", nil))
+					if w.Code != http.StatusOK || w.Body.String() != "resource" {
+						t.Errorf("got %d %q", w.Code, w.Body.String())
+					}
+				})
+			}
+			wg.Wait()
+			if got := int(calls.Load()); got != tt.calls {
+				t.Errorf("node got %d calls, expected %d", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}}, store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	var response struct {
+		Policies []limitPolicy `json:"policies"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Policies) != 1 {
+		t.Fatalf("got policies %+v, expected one", response.Policies)
+	}
+	if policy := response.Policies[0]; policy.Quota != 10 || policy.Window != 60 || policy.Used != 1 || policy.Remaining != 9 {
+		t.Errorf("got %+v, expected 1 of 10 requests a minute used", policy)
+	}
+}
+
+func TestHandleNode(t *testing.T) {
+	handler, s := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		nodes  []string
+	}{
+		{name: "add", method: http.MethodPut, path: "/admin/nodes/node-2", body: `{"rpm_limit": 5, "bpm_limit": 100}`, status: http.StatusOK, nodes: []string{"node-1", "node-2"}},
+		{name: "invalid limits", method: http.MethodPut, path: "/admin/nodes/node-3", body: `{"limits": "5 req/fortnight"}`, status: http.StatusBadRequest, nodes: []string{"node-1", "node-2"}},
+		{name: "invalid JSON", method: http.MethodPut, path: "/admin/nodes/node-3", body: `{`, status: http.StatusBadRequest, nodes: []string{"node-1", "node-2"}},
+		{name: "remove", method: http.MethodDelete, path: "/admin/nodes/node-1", status: http.StatusOK, nodes: []string{"node-2"}},
+		{name: "remove unknown", method: http.MethodDelete, path: "/admin/nodes/node-1", status: http.StatusNotFound, nodes: []string{"node-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/nodes", nil))
+			var nodes []store.NodeLimits
+			if err := json.NewDecoder(w.Body).Decode(&nodes); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, node := range nodes {
+				ids = append(ids, node.NodeID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.nodes, ",") {
+				t.Errorf("pool is %v, expected %v", ids, tt.nodes)
+			}
+			stored, _ := s.NodeLimits(context.Background())
+			if len(stored) != len(tt.nodes) {
+				t.Errorf("store holds %d nodes, expected %d", len(stored), len(tt.nodes))
+			}
+		})
+	}
+}
+
+func TestSimulateFailure(t *testing.T) {
+	handler, s := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "100 req/min"}, {NodeID: "node-2", Limits: "100 req/min"}})
+	simulate := func(nodeID, body string) (int, map[string]any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/nodes/"+nodeID+"/simulate-failure", strings.NewReader(body)))
+		var response map[string]any
+		json.NewDecoder(w.Body).Decode(&response)
+		return w.Code, response
+	}
+
+	if status, response := simulate("node-1", `{"minutes": 1}`); status != http.StatusOK || response["failed"] != true || response["failed_until"] == nil {
+		t.Fatalf("got %d %v, expected node-1 failed", status, response)
+	}
+	for range 10 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %q", w.Code, w.Body.String())
+		}
+	}
+	usage, _ := s.Usage(context.Background(), time.Now().Add(-time.Minute))
+	if usage["node-1"].Requests != 0 || usage["node-2"].Requests != 10 {
+		t.Errorf("got usage %+v, expected every request on node-2", usage)
+	}
+
+	if status, response := simulate("node-1", `{"minutes": 0}`); status != http.StatusOK || response["failed"] != false {
+		t.Errorf("got %d %v, expected the failure ended", status, response)
+	}
+	if status, _ := simulate("node-3", `{"minutes": 1}`); status != http.StatusNotFound {
+		t.Errorf("got %d for an unknown node, expected 404", status)
+	}
+	if status, _ := simulate("node-1", `{"minutes": -1}`); status != http.StatusBadRequest {
+		t.Errorf("got %d for negative minutes, expected 400", status)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d, expected 200", w.Code)
+	}
+}
@@ -0,0 +1,366 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Headers of queued requests
+const (
+	// jobIDHeader carries the job ID to the node, so nodes can recognise a
+	// job delivered again after a worker lost it
+	jobIDHeader = "X-Job-ID"
+	// jobAttemptHeader carries the attempt number to the node
+	jobAttemptHeader = "X-Job-Attempt"
+)
+
+// credentialHeaders are not stored with queued requests; the client was
+// authenticated when the request was queued
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-API-Key"}
+
+// asyncRequest struct represents a queued request, stored as the job payload
+type asyncRequest struct {
+	Route      string      `json:"route"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Host       string      `json:"host"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	RemoteAddr string      `json:"remote_addr"`
+	Client     string      `json:"client,omitempty"`
+	// Deadline is when the route's timeout runs out for the client, if the
+	// route has one
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// expired reports whether the request's deadline has passed
+func (request asyncRequest) expired() bool {
+	return !request.Deadline.IsZero() && !time.Now().Before(request.Deadline)
+}
+
+// jobResult struct represents the response to a queued request, stored as
+// the job result
+type jobResult struct {
+	Status int             `json:"status"`
+	Header http.Header     `json:"header"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// Text holds bodies that are not JSON
+	Text string `json:"text,omitempty"`
+}
+
+// prefersAsync reports whether the client asked for the request to be
+// queued with Prefer: respond-async
+func prefersAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptAsync queues the requests of route that ask for it with Prefer:
+// respond-async, answering 202 with the job to poll in Location instead of
+// waiting for a node. Other requests go to next.
+func (s *Server) acceptAsync(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.Queue == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !prefersAsync(r) {
+			next(w, r)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		info := routingInfoFrom(r)
+		if _, err := decodeRequest(body); err != nil {
+			info.Decision = "invalid"
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		header := r.Header.Clone()
+		for _, name := range append(credentialHeaders, "Prefer") {
+			header.Del(name)
+		}
+		request := asyncRequest{
+			Route:      info.Route,
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			Host:       r.Host,
+			Header:     header,
+			Body:       body,
+			RemoteAddr: r.RemoteAddr,
+			Client:     info.Client,
+		}
+		if s.config.Routes[info.Route].timeout > 0 {
+			// withTimeout set the deadline from the route's timeout
+			request.Deadline, _ = r.Context().Deadline()
+		}
+		payload, err := json.Marshal(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		job := store.Job{ID: store.NewJobID(), Payload: payload, MaxAttempts: s.config.AsyncMaxAttempts}
+		if err := s.config.Queue.EnqueueJob(r.Context(), job); err != nil {
+			log.Printf("queueing request: %v", err)
+			info.Decision = "error"
+			s.writeError(w, r, ConditionStoreUnavailable, http.StatusInternalServerError, "The request could not be queued.")
+			return
+		}
+		metrics.AsyncJobs.WithLabelValues("queued").Inc()
+		info.Decision = "queued"
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.Header().Set("Preference-Applied", "respond-async")
+		writeJSON(w, http.StatusAccepted, map[string]string{"job_id": job.ID, "status": store.JobPending})
+	}
+}
+
+// handleJob reports the state of a queued request and, once it is done, the
+// node's response. With authentication on, clients only see their own jobs.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok, err := s.config.Queue.Job(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var request asyncRequest
+	if ok {
+		json.Unmarshal(job.Payload, &request)
+	}
+	if !ok || s.config.Auth != nil && request.Client != routingInfoFrom(r).Client {
+		http.Error(w, fmt.Sprintf("Unknown job %s", id), http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		store.Job
+		Result *jobResult `json:"result,omitempty"`
+	}{Job: job}
+	if job.Status == store.JobDone {
+		response.Result = &jobResult{}
+		if err := json.Unmarshal(job.Result, response.Result); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RunQueueWorkers forwards queued requests with the given number of workers
+// until ctx is done, polling the queue every poll while it is empty. Workers
+// of every replica may share the queue: each job is held by one worker at a
+// time, for the visibility timeout. A worker that stops mid-job leaves it to
+// be claimed again once the timeout passes.
+func (s *Server) RunQueueWorkers(ctx context.Context, workers int, poll time.Duration) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				job, ok, err := s.config.Queue.ClaimJob(ctx, s.config.AsyncVisibility)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("claiming queued request: %v", err)
+				}
+				if err != nil || !ok {
+					select {
+					case <-ctx.Done():
+					case <-time.After(poll):
+					}
+					continue
+				}
+				s.runJob(ctx, job)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// runJob forwards a claimed job through the same selection, limits and
+// retries as a synchronous request. The attempt is cut off before the lease
+// runs out, so no other worker can claim the job while it is still being
+// forwarded, and at the deadline of the route's timeout, so the time the
+// job spent in the queue comes out of the time left to forward it. A job
+// past its deadline is done with a 504. Attempts the balancer rejects, e.g. because every node is at
+// its limits, are retried without using up an attempt; attempts failed by a
+// node count towards MaxAttempts.
+func (s *Server) runJob(ctx context.Context, job store.Job) {
+	queue := s.config.Queue
+	var request asyncRequest
+	if err := json.Unmarshal(job.Payload, &request); err != nil {
+		s.failJob(ctx, job, fmt.Sprintf("decoding queued request: %v", err))
+		return
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, s.config.AsyncVisibility*9/10)
+	defer cancel()
+	if !request.Deadline.IsZero() {
+		attemptCtx, cancel = context.WithDeadline(attemptCtx, request.Deadline)
+		defer cancel()
+	}
+	info := &routingInfo{Route: request.Route, Client: request.Client}
+	if job.Attempts == 1 {
+		// Later attempts wait for their backoff on purpose
+		info.timePhase(phaseQueue, job.Created)
+	}
+	r, err := http.NewRequestWithContext(context.WithValue(attemptCtx, routingInfoKey{}, info), request.Method, request.URI, bytes.NewReader(request.Body))
+	if err != nil {
+		s.failJob(ctx, job, fmt.Sprintf("rebuilding queued request: %v", err))
+		return
+	}
+	if request.Header != nil {
+		r.Header = request.Header
+	}
+	r.Header.Set(jobIDHeader, job.ID)
+	r.Header.Set(jobAttemptHeader, strconv.Itoa(job.Attempts))
+	r.Host, r.RemoteAddr = request.Host, request.RemoteAddr
+
+	w := &jobRecorder{header: http.Header{}}
+	if request.expired() {
+		info.Decision = "timeout"
+		s.writeError(w, r, ConditionTimeout, http.StatusGatewayTimeout, "The request waited in the queue past the route's timeout.")
+	} else {
+		s.handleRequest(w, r)
+	}
+	observePhases(info)
+	if ctx.Err() != nil {
+		// Shutting down: hand the job to another worker right away
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := queue.RetryJob(ctx, job.ID, job.Lease, 0); err != nil {
+			log.Printf("releasing queued request %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	status := w.statusCode()
+	switch {
+	case request.expired() && (info.RejectReason != "" || status >= 500):
+		// No time is left for another attempt, the failure is the result
+		s.completeJob(ctx, job, w, "expired")
+	case info.RejectReason != "":
+		// No node took the request, which is no fault of the request
+		ok, err := queue.RetryJob(ctx, job.ID, job.Lease, retryAfter(w.header))
+		s.countJob("retried", ok, err, job)
+	case status >= 500:
+		s.failJob(ctx, job, fmt.Sprintf("%s (%d)", info.Decision, status))
+	default:
+		s.completeJob(ctx, job, w, "completed")
+	}
+}
+
+// completeJob stores the recorded response as the result of job, counted
+// as result
+func (s *Server) completeJob(ctx context.Context, job store.Job, w *jobRecorder, result string) {
+	response := jobResult{Status: w.statusCode(), Header: w.resultHeader()}
+	if body := w.body.Bytes(); json.Valid(body) {
+		response.Body = body
+	} else {
+		response.Text = string(body)
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		s.failJob(ctx, job, fmt.Sprintf("encoding result: %v", err))
+		return
+	}
+	ok, err := s.config.Queue.CompleteJob(ctx, job.ID, job.Lease, data)
+	s.countJob(result, ok, err, job)
+}
+
+// failJob records a failed attempt of job, backing off exponentially
+// before the next one
+func (s *Server) failJob(ctx context.Context, job store.Job, reason string) {
+	delay := time.Second << min(job.Attempts-1, 10)
+	updated, ok, err := s.config.Queue.FailJob(ctx, job.ID, job.Lease, reason, min(delay, time.Minute))
+	result := "failed"
+	if updated.Status == store.JobDead {
+		log.Printf("queued request %s is dead after %d attempts: %s", job.ID, updated.Attempts, reason)
+		result = "dead"
+	}
+	s.countJob(result, ok, err, job)
+}
+
+// countJob counts the outcome of an attempt once the queue stored it
+func (s *Server) countJob(result string, ok bool, err error, job store.Job) {
+	switch {
+	case err != nil:
+		log.Printf("updating queued request %s: %v", job.ID, err)
+	case !ok:
+		log.Printf("lost the lease on queued request %s", job.ID)
+		metrics.AsyncJobs.WithLabelValues("lease_lost").Inc()
+	default:
+		metrics.AsyncJobs.WithLabelValues(result).Inc()
+	}
+}
+
+// retryAfter returns how long a response asks to wait before trying again,
+// at least a second
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jobRecorder buffers the response to a queued request
+type jobRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *jobRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *jobRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *jobRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// resultHeader returns the response header with trailers merged in
+func (w *jobRecorder) resultHeader() http.Header {
+	header := http.Header{}
+	for name, values := range w.header {
+		if name == "Trailer" {
+			continue
+		}
+		name, _ = strings.CutPrefix(name, http.TrailerPrefix)
+		header[name] = values
+	}
+	return header
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// auditLogTimeout bounds the recording of an audit sample
+const auditLogTimeout = 5 * time.Second
+
+// auditRequests records a sample of the requests, with their headers, the
+// start of their body, node and outcome, in the audit log, in the
+// background. It must run inside withRoutingInfo.
+func (s *Server) auditRequests(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.AuditLog == nil || s.config.AuditSampleRate <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= s.config.AuditSampleRate {
+			next(w, r)
+			return
+		}
+		started := time.Now()
+		header := r.Header.Clone()
+		for _, name := range redactedHeaders {
+			if header.Get(name) != "" {
+				header.Set(name, "[redacted]")
+			}
+		}
+		// The start of the body is read up front, so it is sampled even
+		// when the request is refused before it is read
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(s.config.AuditBodyBytes)+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		truncated := len(body) > s.config.AuditBodyBytes
+		if truncated {
+			body = body[:s.config.AuditBodyBytes]
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		next(cw, r)
+
+		info := routingInfoFrom(r)
+		sample := store.AuditSample{
+			Time:          started,
+			Client:        s.clientID(r),
+			Route:         info.Route,
+			Method:        r.Method,
+			URI:           r.URL.RequestURI(),
+			Header:        header,
+			Body:          string(body),
+			BodyTruncated: truncated || err != nil,
+			Node:          info.Node,
+			Decision:      info.Decision,
+			RejectReason:  info.RejectReason,
+			Status:        cw.status,
+			Seconds:       time.Since(started).Seconds(),
+		}
+		s.background.submit("audit_log", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), auditLogTimeout)
+			defer cancel()
+			if err := s.config.AuditLog.RecordAuditSample(ctx, sample); err != nil {
+				log.Printf("recording audit sample: %v", err)
+			}
+		})
+	}
+}
+
+// readCloser reads from a reader and closes with a closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// handleAudit lists the latest audit samples within ?since= (1h) and at
+// most ?limit= (100), of ?route=, ?node= and ?client= when they are set
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if s.config.AuditLog == nil {
+		http.Error(w, "The audit log is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	since, limit := time.Hour, 100
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	filter := store.AuditFilter{Since: time.Now().Add(-since), Route: query.Get("route"), Node: query.Get("node"), Client: query.Get("client")}
+	samples, err := s.config.AuditLog.AuditSamples(r.Context(), filter, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
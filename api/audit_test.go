@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestAuditRequests(t *testing.T) {
+	backend := stageBackend(t, "ok", http.StatusOK)
+	auditLog, err := store.NewAuditFile(filepath.Join(t.TempDir(), "audit.jsonl"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	config := Config{AuditLog: auditLog, AuditSampleRate: 1, AuditBodyBytes: 5, BackgroundQueue: 10}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "10 req/min"}})
+
+	r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"bpm": 1} ok` {
+		t.Fatalf("got %d %q, expected the whole body proxied", w.Code, w.Body.String())
+	}
+
+	// Samples are recorded in the background
+	var samples []store.AuditSample
+	for deadline := time.Now().Add(5 * time.Second); len(samples) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit?node=node-1", nil))
+		json.NewDecoder(w.Body).Decode(&samples)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, expected 1", len(samples))
+	}
+	sample := samples[0]
+	if sample.Route != "/request" || sample.Node != "node-1" || sample.Status != http.StatusOK {
+		t.Errorf("got %+v, expected POST /request served by node-1", sample)
+	}
+	if sample.Body != `{"bpm` || !sample.BodyTruncated {
+		t.Errorf("got body %q truncated %t, expected it cut to 5 bytes", sample.Body, sample.BodyTruncated)
+	}
+	if got := http.Header(sample.Header).Get("Authorization"); got != "[redacted]" {
+		t.Errorf("got Authorization %q, expected it redacted", got)
+	}
+
+	for _, target := range []string{"/admin/audit?since=-1h", "/admin/audit?limit=0", "/admin/audit?limit=1001"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got %d for %s, expected 400", w.Code, target)
+		}
+	}
+	handler, _ = newTestServer(t, Config{}, nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("got %d without an audit log, expected 501", w.Code)
+	}
+}
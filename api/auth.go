@@ -0,0 +1,36 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// grpcUnauthenticated is the gRPC status of calls without valid credentials
+const grpcUnauthenticated = 16
+
+// authenticate rejects requests without valid credentials with 401, and
+// attaches the client identity of the others to their routingInfo
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.Auth == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		identity, err := s.config.Auth.Authenticate(r)
+		routingInfoFrom(r).timePhase(phaseAuth, started)
+		if err != nil {
+			log.Printf("rejecting unauthenticated request from %s: %v", r.RemoteAddr, err)
+			routingInfoFrom(r).Decision = "unauthenticated"
+			if isGRPC(r, nil) {
+				grpcError(w, grpcUnauthenticated, "unauthenticated")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="poc_loadbalancer"`)
+			http.Error(w, "Authentication required.", http.StatusUnauthorized)
+			return
+		}
+		routingInfoFrom(r).Client = identity.Client
+		next(w, r)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// What happens to background work when every worker is busy and the queue
+// is full
+const (
+	// OverflowDrop drops the work, e.g. a mirrored copy is not sent
+	OverflowDrop = "drop"
+	// OverflowInline does the work on the request's goroutine, slowing the
+	// request down instead
+	OverflowInline = "inline"
+)
+
+// ValidateBackgroundOverflow checks an overflow policy
+func ValidateBackgroundOverflow(policy string) error {
+	switch policy {
+	case OverflowDrop, OverflowInline:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q, expected drop or inline", policy)
+}
+
+// backgroundPool runs the work requests leave behind, such as mirrored
+// copies and their records, on a fixed number of workers, so a slow store
+// or node cannot pile up goroutines
+type backgroundPool struct {
+	tasks    chan backgroundTask
+	overflow string
+	wg       sync.WaitGroup
+
+	// mu guards closed, so no task is sent once tasks is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// backgroundTask struct represents queued work of a kind, e.g. mirror
+type backgroundTask struct {
+	kind string
+	run  func()
+}
+
+func newBackgroundPool(workers, queue int, overflow string) *backgroundPool {
+	p := &backgroundPool{tasks: make(chan backgroundTask, max(queue, 0)), overflow: overflow}
+	for range max(workers, 1) {
+		p.wg.Go(func() {
+			for task := range p.tasks {
+				metrics.BackgroundQueued.Dec()
+				task.run()
+				metrics.BackgroundTasks.WithLabelValues(task.kind, "done").Inc()
+			}
+		})
+	}
+	return p
+}
+
+// submit hands run to a worker. When all are busy and the queue is full it
+// follows the overflow policy, reporting false if run was dropped.
+func (p *backgroundPool) submit(kind string, run func()) bool {
+	p.mu.RLock()
+	closed, queued := p.closed, false
+	if !closed {
+		// Counted before the send, so a worker never takes it below zero
+		metrics.BackgroundQueued.Inc()
+		select {
+		case p.tasks <- backgroundTask{kind: kind, run: run}:
+			queued = true
+		default:
+			metrics.BackgroundQueued.Dec()
+		}
+	}
+	p.mu.RUnlock()
+	switch {
+	case queued:
+		return true
+	case p.overflow == OverflowInline && !closed:
+		run()
+		metrics.BackgroundTasks.WithLabelValues(kind, "inline").Inc()
+		return true
+	}
+	metrics.BackgroundTasks.WithLabelValues(kind, "dropped").Inc()
+	return false
+}
+
+// close stops accepting work and waits until the queued work is done or ctx
+// is done
+func (p *backgroundPool) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting background work and waits for the queued work, such
+// as mirrored requests, until it is done or ctx is done
+func (s *Server) Close(ctx context.Context) error {
+	return s.background.close(ctx)
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundPool(t *testing.T) {
+	tests := []struct {
+		overflow string
+		// accepted is whether the task beyond the queue is run
+		accepted bool
+	}{
+		{overflow: OverflowDrop},
+		{overflow: OverflowInline, accepted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			p := newBackgroundPool(1, 1, tt.overflow)
+			var ran atomic.Int32
+			started, release := make(chan struct{}), make(chan struct{})
+			// The only worker is kept busy and the queue filled
+			p.submit("test", func() {
+				close(started)
+				<-release
+				ran.Add(1)
+			})
+			<-started
+			if !p.submit("test", func() { ran.Add(1) }) {
+				t.Fatal("a task was dropped with room in the queue")
+			}
+			if got := p.submit("test", func() { ran.Add(1) }); got != tt.accepted {
+				t.Errorf("got %v for a task beyond the queue, expected %v", got, tt.accepted)
+			}
+			close(release)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := p.close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			expected := int32(2)
+			if tt.accepted {
+				expected = 3
+			}
+			if got := ran.Load(); got != expected {
+				t.Errorf("ran %d tasks, expected %d", got, expected)
+			}
+			if p.submit("test", func() { ran.Add(1) }) {
+				t.Error("a task was accepted after closing")
+			}
+		})
+	}
+}
+
+func TestBackgroundPoolCloseTimeout(t *testing.T) {
+	p := newBackgroundPool(1, 1, OverflowDrop)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	p.submit("test", func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.close(ctx); err == nil {
+		t.Error("closing returned before the task was done")
+	}
+}
+
+func TestValidateBackgroundOverflow(t *testing.T) {
+	for _, policy := range []string{OverflowDrop, OverflowInline} {
+		if err := ValidateBackgroundOverflow(policy); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+	}
+	if err := ValidateBackgroundOverflow("block"); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// capacityRemainingHeader is how nodes report how many more requests they
+// can take right now
+const capacityRemainingHeader = "X-Capacity-Remaining"
+
+// observeBackpressure hands the backpressure signals of a node's response,
+// received latency after it was sent, to the balancer: a 503 or 429 with
+// Retry-After, or else with a rate limit reset, and otherwise
+// X-Capacity-Remaining or the remaining requests of the node's rate limit
+// until it resets. The response also feeds the node's adaptive limits.
+func (s *Server) observeBackpressure(nodeID string, resp *http.Response, latency time.Duration) {
+	if resp == nil {
+		return
+	}
+	now := time.Now()
+	reset := parseRateLimitReset(headerOf(resp.Header, "RateLimit-Reset", "X-RateLimit-Reset"), now)
+	var signal balancer.Backpressure
+	name := "capacity"
+	if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests {
+		signal.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		name = "retry_after"
+		if signal.RetryAfter == 0 && reset > 0 {
+			signal.RetryAfter, name = reset, "ratelimit_reset"
+		}
+	}
+	s.lb.ObserveLoad(nodeID, balancer.LoadSignal{Status: resp.StatusCode, RetryAfter: signal.RetryAfter > 0, Latency: latency})
+	if signal.RetryAfter == 0 {
+		if remaining, err := strconv.Atoi(resp.Header.Get(capacityRemainingHeader)); err == nil {
+			signal.Remaining, signal.HasRemaining, name = remaining, true, "capacity"
+		} else if remaining, err := strconv.Atoi(headerOf(resp.Header, "RateLimit-Remaining", "X-RateLimit-Remaining")); err == nil {
+			signal.Remaining, signal.HasRemaining, signal.ResetAfter, name = remaining, true, reset, "ratelimit"
+		} else {
+			return
+		}
+	}
+	if s.lb.ObserveBackpressure(nodeID, signal) {
+		metrics.BackpressureSignals.WithLabelValues(nodeID, name).Inc()
+	}
+}
+
+// headerOf returns the first of names h has a value for
+func headerOf(h http.Header, names ...string) string {
+	for _, name := range names {
+		if value := h.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// unixTimeCutoff tells rate limit resets given as a Unix time, as GitHub's
+// X-RateLimit-Reset, from those given in seconds from now
+const unixTimeCutoff = 1_000_000_000
+
+// parseRateLimitReset returns the wait until a rate limit resets, given in
+// seconds or as a Unix time, and zero when there is none
+func parseRateLimitReset(value string, now time.Time) time.Duration {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	if seconds < unixTimeCutoff {
+		return time.Duration(seconds) * time.Second
+	}
+	if t := time.Unix(seconds, 0); t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// parseRetryAfter returns the wait a Retry-After value asks for, given in
+// seconds or as an HTTP date, and zero when there is none
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitReset(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"soon", 0},
+		{"0", 0},
+		{"-5", 0},
+		{"30", 30 * time.Second},
+		{"1700000060", time.Minute},
+		{"1699999990", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRateLimitReset(tt.value, now); got != tt.expected {
+			t.Errorf("parseRateLimitReset(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"later", 0},
+		{"-1", 0},
+		{"120", 2 * time.Minute},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestHeaderOf(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-RateLimit-Remaining", "3")
+	if got := headerOf(h, "RateLimit-Remaining", "X-RateLimit-Remaining"); got != "3" {
+		t.Errorf("got %q, expected the legacy header's 3", got)
+	}
+	h.Set("RateLimit-Remaining", "5")
+	if got := headerOf(h, "RateLimit-Remaining", "X-RateLimit-Remaining"); got != "5" {
+		t.Errorf("got %q, expected the standard header's 5 first", got)
+	}
+}
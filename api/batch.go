@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// batchRoute is the route sub-requests of a batch are served as
+const batchRoute = "/request"
+
+// batchRequest struct represents the body of POST /batch: request bodies
+// as POST /request takes them
+type batchRequest struct {
+	Requests []json.RawMessage `json:"requests"`
+}
+
+// batchResponse struct represents the answer to one sub-request of a batch
+type batchResponse struct {
+	Status   int         `json:"status"`
+	Node     string      `json:"node,omitempty"`
+	Decision string      `json:"decision,omitempty"`
+	Header   http.Header `json:"headers,omitempty"`
+	// Body is the response body as is when it is JSON, as a string otherwise
+	Body any `json:"body,omitempty"`
+}
+
+// handleBatch serves every sub-request of the body like POST /request,
+// concurrently: each is sent to a node of its own, retried and accounted
+// against the node and client limits by itself. The answers come back in
+// the order of the sub-requests, each with its status, node and body; the
+// batch itself is answered 200 unless it is invalid.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	info := routingInfoFrom(r)
+	var batch batchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		info.Decision = "invalid"
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Requests) == 0 || len(batch.Requests) > s.config.MaxBatch {
+		info.Decision = "invalid"
+		http.Error(w, fmt.Sprintf("A batch holds 1 to %d requests.", s.config.MaxBatch), http.StatusBadRequest)
+		return
+	}
+
+	responses := make([]batchResponse, len(batch.Requests))
+	var wg sync.WaitGroup
+	for i, request := range batch.Requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The batch took the client's token for the first sub-request
+			responses[i] = s.serveSubrequest(r, request, i > 0)
+		}()
+	}
+	wg.Wait()
+
+	info.Decision = "batch"
+	writeJSON(w, http.StatusOK, map[string]any{"responses": responses})
+}
+
+// serveSubrequest serves one sub-request of the batch r like POST /request,
+// taking a token of the client's rate limit first if takeToken is set
+func (s *Server) serveSubrequest(r *http.Request, body []byte, takeToken bool) batchResponse {
+	outer := routingInfoFrom(r)
+	info := &routingInfo{Route: batchRoute, Client: outer.Client, Tenant: outer.Tenant, Pinned: outer.Pinned, DebugID: outer.DebugID}
+	sub, err := http.NewRequestWithContext(context.WithValue(r.Context(), routingInfoKey{}, info), http.MethodPost, batchRoute, bytes.NewReader(body))
+	if err != nil {
+		return batchResponse{Status: http.StatusInternalServerError, Body: err.Error()}
+	}
+	sub.Header = r.Header.Clone()
+	sub.Header.Del("Content-Length")
+	sub.Header.Del("Content-Encoding")
+	sub.ContentLength = int64(len(body))
+	sub.Host, sub.RemoteAddr, sub.TLS = r.Host, r.RemoteAddr, r.TLS
+
+	rec := &jobRecorder{header: http.Header{}}
+	if !takeToken || s.takeClientToken(rec, sub) {
+		s.handleRequest(rec, sub)
+	}
+	metrics.BatchSubrequests.WithLabelValues(info.Decision).Inc()
+	return recordedResponse(rec, info)
+}
+
+// recordedResponse turns the recorded answer to a sub-request into its
+// entry of the batch response
+func recordedResponse(rec *jobRecorder, info *routingInfo) batchResponse {
+	response := batchResponse{Status: rec.statusCode(), Node: info.Node, Decision: info.Decision, Header: rec.resultHeader()}
+	response.Header.Del("Content-Length")
+	switch body := rec.body.Bytes(); {
+	case len(body) == 0:
+	case json.Valid(body):
+		response.Body = json.RawMessage(body)
+	default:
+		response.Body = string(body)
+	}
+	return response
+}
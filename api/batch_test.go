@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestBatch(t *testing.T) {
+	backend := newBackend(t, "node-1", http.StatusOK)
+	handler, _ := newTestServer(t, Config{MaxBatch: 3}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "2 req/min"}})
+	batch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+		return w
+	}
+
+	for _, body := range []string{`{"requests": []}`, `{"requests": [{}, {}, {}, {}]}`, `{"requests": {}}`} {
+		if w := batch(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d, expected 400", body, w.Code)
+		}
+	}
+
+	// Every sub-request is served and accounted by itself, so the node's
+	// limit lets two of three through
+	w := batch(`{"requests": [{"bpm": 1}, {"bpm": 1}, {"bpm": 1}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q, expected 200", w.Code, w.Body.String())
+	}
+	var answer struct {
+		Responses []batchResponse `json:"responses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Responses) != 3 {
+		t.Fatalf("got %d responses, expected 3", len(answer.Responses))
+	}
+	served := 0
+	for _, response := range answer.Responses {
+		if response.Status != http.StatusOK {
+			continue
+		}
+		served++
+		if response.Node != "node-1" || response.Body != "node-1" {
+			t.Errorf("got %+v, expected the answer of node-1", response)
+		}
+	}
+	if served != 2 {
+		t.Errorf("served %d sub-requests, expected 2", served)
+	}
+
+	disabled, _ := newTestServer(t, Config{}, nil)
+	w = httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"requests": [{}]}`)))
+	if w.Code == http.StatusOK {
+		t.Error("POST /batch was served without MaxBatch")
+	}
+}
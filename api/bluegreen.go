@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+)
+
+// The two pools of a blue/green route
+const (
+	poolBlue  = "blue"
+	poolGreen = "green"
+)
+
+// maxBake bounds the bake period of a blue/green switch
+const maxBake = 24 * time.Hour
+
+// BlueGreen struct represents the two node groups a route's requests go to
+// one of at a time; PUT /admin/blue-green switches between them
+type BlueGreen struct {
+	Blue  string `json:"blue"`
+	Green string `json:"green"`
+	// Live is the pool, blue or green, serving the route at start; blue
+	// when empty
+	Live string `json:"live,omitempty"`
+}
+
+func (bg *BlueGreen) compile() error {
+	if bg.Blue == "" || bg.Green == "" || bg.Blue == bg.Green {
+		return fmt.Errorf("blue_green needs two different groups, blue and green")
+	}
+	if bg.Live != "" && bg.Live != poolBlue && bg.Live != poolGreen {
+		return fmt.Errorf("blue_green live must be %s or %s", poolBlue, poolGreen)
+	}
+	return nil
+}
+
+// group returns the node group of pool
+func (bg *BlueGreen) group(pool string) string {
+	if pool == poolGreen {
+		return bg.Green
+	}
+	return bg.Blue
+}
+
+// blueGreenState struct represents which pool of a blue/green route is live,
+// and the switch to the other one while it bakes
+type blueGreenState struct {
+	Route string    `json:"route"`
+	Live  string    `json:"live"`
+	Group string    `json:"group"`
+	Since time.Time `json:"since"`
+	// Target is the pool being switched to, Percent of the requests going
+	// to it until BakeUntil, when it goes live; empty when no switch bakes
+	Target    string    `json:"target,omitempty"`
+	Percent   float64   `json:"percent,omitempty"`
+	BakeUntil time.Time `json:"bake_until,omitzero"`
+}
+
+// blueGreen holds the live pools of the blue/green routes
+type blueGreen struct {
+	mu     sync.Mutex
+	routes map[string]*blueGreenState
+}
+
+// newBlueGreen starts every blue/green route of routes on its live pool
+func newBlueGreen(routes map[string]RouteConfig) *blueGreen {
+	bg := &blueGreen{routes: map[string]*blueGreenState{}}
+	now := time.Now()
+	for route, rc := range routes {
+		if rc.BlueGreen == nil {
+			continue
+		}
+		live := rc.BlueGreen.Live
+		if live == "" {
+			live = poolBlue
+		}
+		bg.routes[route] = &blueGreenState{Route: route, Live: live, Since: now}
+	}
+	return bg
+}
+
+// settle makes the target of a switch whose bake ended live. The caller
+// holds bg.mu.
+func (state *blueGreenState) settle(now time.Time) bool {
+	if state.Target == "" || now.Before(state.BakeUntil) {
+		return false
+	}
+	state.Live, state.Since = state.Target, state.BakeUntil
+	state.Target, state.Percent, state.BakeUntil = "", 0, time.Time{}
+	return true
+}
+
+// pool returns the pool a request of route goes to, empty for routes that
+// are not blue/green
+func (bg *blueGreen) pool(route string) string {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	state, ok := bg.routes[route]
+	if !ok {
+		return ""
+	}
+	if state.settle(time.Now()) {
+		log.Printf("route %s: %s pool is live after its bake", route, state.Live)
+	}
+	if state.Target != "" && rand.Float64()*100 < state.Percent {
+		return state.Target
+	}
+	return state.Live
+}
+
+// blueGreenGroup returns the node group of the live pool of the route of r,
+// or of the pool it switches to for its share of the requests while a
+// switch bakes; empty for routes that are not blue/green
+func (s *Server) blueGreenGroup(r *http.Request) string {
+	route := routingInfoFrom(r).Route
+	rc := s.config.Routes[route]
+	if rc.BlueGreen == nil {
+		return ""
+	}
+	return rc.BlueGreen.group(s.blueGreen.pool(route))
+}
+
+// blueGreenStatus returns the state of every blue/green route, ordered by
+// route
+func (s *Server) blueGreenStatus() []blueGreenState {
+	s.blueGreen.mu.Lock()
+	defer s.blueGreen.mu.Unlock()
+	now := time.Now()
+	states := make([]blueGreenState, 0, len(s.blueGreen.routes))
+	for route, state := range s.blueGreen.routes {
+		state.settle(now)
+		status := *state
+		status.Group = s.config.Routes[route].BlueGreen.group(state.Live)
+		states = append(states, status)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Route < states[j].Route })
+	return states
+}
+
+// handleBlueGreen reports which pool of each blue/green route is live. PUT
+// with ?route= switches the route to the pool of the body at once, or with
+// bake_minutes sends percent of its requests there first and the rest once
+// the bake is over. DELETE with ?route= calls off the switch baking.
+func (s *Server) handleBlueGreen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		route := r.URL.Query().Get("route")
+		s.blueGreen.mu.Lock()
+		state, ok := s.blueGreen.routes[route]
+		s.blueGreen.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("route %q is not a blue/green route", route), http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Live        string  `json:"live"`
+			BakeMinutes float64 `json:"bake_minutes"`
+			Percent     float64 `json:"percent"`
+		}
+		var bake time.Duration
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			bake = time.Duration(body.BakeMinutes * float64(time.Minute))
+			switch {
+			case body.Live != poolBlue && body.Live != poolGreen:
+				http.Error(w, fmt.Sprintf("live must be %s or %s", poolBlue, poolGreen), http.StatusBadRequest)
+				return
+			case bake < 0 || bake > maxBake:
+				http.Error(w, fmt.Sprintf("bake_minutes must not be negative and at most %.0f", maxBake.Minutes()), http.StatusBadRequest)
+				return
+			case bake > 0 && (body.Percent <= 0 || body.Percent > 100):
+				http.Error(w, "percent must be above 0 and at most 100 with bake_minutes", http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.blueGreen.mu.Lock()
+		now := time.Now()
+		state.settle(now)
+		from := state.Live
+		switch {
+		case r.Method == http.MethodDelete:
+			state.Target, state.Percent, state.BakeUntil = "", 0, time.Time{}
+		case body.Live == state.Live:
+			// Switching to the live pool calls off a switch baking
+			state.Target, state.Percent, state.BakeUntil = "", 0, time.Time{}
+		case bake > 0:
+			state.Target, state.Percent, state.BakeUntil = body.Live, body.Percent, now.Add(bake)
+		default:
+			state.Live, state.Since = body.Live, now
+			state.Target, state.Percent, state.BakeUntil = "", 0, time.Time{}
+		}
+		changed := *state
+		s.blueGreen.mu.Unlock()
+
+		if changed.Target != "" {
+			log.Printf("route %s: %s pool baking at %.0f%% until %s", route, changed.Target, changed.Percent, changed.BakeUntil.Format(time.RFC3339))
+		} else {
+			log.Printf("route %s: %s pool live, was %s", route, changed.Live, from)
+		}
+		s.config.Events.Publish(eventbus.Event{Type: eventbus.BlueGreenSwitched, Details: map[string]any{
+			"route":      route,
+			"from":       from,
+			"live":       changed.Live,
+			"target":     changed.Target,
+			"percent":    changed.Percent,
+			"bake_until": changed.BakeUntil,
+		}})
+	}
+	writeJSON(w, http.StatusOK, s.blueGreenStatus())
+}
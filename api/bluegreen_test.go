@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestBlueGreen(t *testing.T) {
+	blue, green := newBackend(t, "blue", http.StatusOK), newBackend(t, "green", http.StatusOK)
+	s := store.NewMemoryStore(
+		store.NodeLimits{NodeID: "node-blue", Address: blue.URL, Group: "pool-a", Limits: "10000 req/min"},
+		store.NodeLimits{NodeID: "node-green", Address: green.URL, Group: "pool-b", Limits: "10000 req/min"},
+	)
+	lb := balancer.New(s)
+	if err := lb.LoadNodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(lb, proxy.New(nil), Config{
+		ProxyPrefix: "/api/",
+		Routes:      loadRoutes(t, `{"/api/": {"blue_green": {"blue": "pool-a", "green": "pool-b"}}}`),
+	})
+	handler := server.Handler()
+
+	// served counts the pools serving n requests
+	served := func(n int) map[string]int {
+		pools := map[string]int{}
+		for range n {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/resource", nil))
+			pools[w.Body.String()]++
+		}
+		return pools
+	}
+	admin := func(method, route, body string) (int, []blueGreenState) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/admin/blue-green?route="+route, strings.NewReader(body)))
+		var states []blueGreenState
+		json.Unmarshal(w.Body.Bytes(), &states)
+		return w.Code, states
+	}
+
+	if pools := served(20); pools["blue"] != 20 {
+		t.Fatalf("served %v, expected blue only", pools)
+	}
+
+	if status, states := admin(http.MethodPut, "/api/", `{"live": "green"}`); status != http.StatusOK || states[0].Live != poolGreen || states[0].Group != "pool-b" {
+		t.Fatalf("switch got %d %+v", status, states)
+	}
+	if pools := served(20); pools["green"] != 20 {
+		t.Fatalf("served %v after the switch, expected green only", pools)
+	}
+
+	status, states := admin(http.MethodPut, "/api/", `{"live": "blue", "bake_minutes": 10, "percent": 50}`)
+	if status != http.StatusOK || states[0].Live != poolGreen || states[0].Target != poolBlue || states[0].Percent != 50 {
+		t.Fatalf("baking switch got %d %+v", status, states)
+	}
+	if pools := served(200); pools["blue"] == 0 || pools["green"] == 0 {
+		t.Fatalf("served %v while baking, expected both", pools)
+	}
+	if status, states := admin(http.MethodDelete, "/api/", ""); status != http.StatusOK || states[0].Live != poolGreen || states[0].Target != "" {
+		t.Fatalf("calling off the switch got %d %+v", status, states)
+	}
+
+	admin(http.MethodPut, "/api/", `{"live": "blue", "bake_minutes": 10, "percent": 1}`)
+	server.blueGreen.mu.Lock()
+	server.blueGreen.routes["/api/"].BakeUntil = time.Now().Add(-time.Second)
+	server.blueGreen.mu.Unlock()
+	if pools := served(20); pools["blue"] != 20 {
+		t.Fatalf("served %v after the bake, expected blue only", pools)
+	}
+	if _, states := admin(http.MethodGet, "", ""); states[0].Live != poolBlue || states[0].Target != "" {
+		t.Errorf("got %+v after the bake, expected blue live", states)
+	}
+}
+
+func TestBlueGreenSwitchErrors(t *testing.T) {
+	handler, _ := newTestServer(t, Config{
+		ProxyPrefix: "/api/",
+		Routes:      loadRoutes(t, `{"/api/": {"blue_green": {"blue": "pool-a", "green": "pool-b"}}}`),
+	}, []store.NodeLimits{{NodeID: "node-1", Group: "pool-a", Limits: "100 req/min"}})
+	tests := []struct {
+		name   string
+		route  string
+		body   string
+		status int
+	}{
+		{name: "unknown route", route: "/request", body: `{"live": "green"}`, status: http.StatusNotFound},
+		{name: "unknown pool", route: "/api/", body: `{"live": "purple"}`, status: http.StatusBadRequest},
+		{name: "bake without percent", route: "/api/", body: `{"live": "green", "bake_minutes": 5}`, status: http.StatusBadRequest},
+		{name: "percent over 100", route: "/api/", body: `{"live": "green", "bake_minutes": 5, "percent": 150}`, status: http.StatusBadRequest},
+		{name: "bake too long", route: "/api/", body: `{"live": "green", "bake_minutes": 100000, "percent": 10}`, status: http.StatusBadRequest},
+		{name: "invalid body", route: "/api/", body: `live=green`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/blue-green?route="+tt.route, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestBlueGreenCompile(t *testing.T) {
+	for _, bg := range []BlueGreen{{Blue: "a"}, {Blue: "a", Green: "a"}, {Blue: "a", Green: "b", Live: "red"}} {
+		if err := bg.compile(); err == nil {
+			t.Errorf("%+v did not fail", bg)
+		}
+	}
+	bg := BlueGreen{Blue: "a", Green: "b", Live: poolGreen}
+	if err := bg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if state := newBlueGreen(map[string]RouteConfig{"/api/": {BlueGreen: &bg}}).routes["/api/"]; state.Live != poolGreen {
+		t.Errorf("route starts on %s, expected green", state.Live)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/cache"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// cacheKey is the request path and query followed by the values of the
+// configured key headers, and by the client when clients authenticate, so
+// invalidating a path prefix drops all its variants
+func (s *Server) cacheKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range s.config.CacheKeyHeaders {
+		key.WriteByte(0)
+		key.WriteString(r.Header.Get(name))
+	}
+	if s.config.Auth != nil {
+		key.WriteByte(0)
+		key.WriteString(routingInfoFrom(r).Client)
+	}
+	return key.String()
+}
+
+// credentialed reports whether r carries credentials the balancer does not
+// check itself, which only responses marked public may be shared across,
+// see RFC 9111 section 3.5
+func (s *Server) credentialed(r *http.Request) bool {
+	return s.config.Auth == nil && (r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "")
+}
+
+// public reports whether the node marks a response as public
+func public(header http.Header) bool {
+	return strings.Contains(header.Get("Cache-Control"), "public")
+}
+
+// cacheResponses serves GET requests on route from the cache. Hits bypass node
+// selection entirely and are not counted against any limit; successful
+// proxied responses are stored for ttl unless they are personal. Requests
+// with credentials the balancer does not check only share public responses,
+// and requests pinned to a node, see pinNode, bypass the cache.
+func (s *Server) cacheResponses(route string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || routingInfoFrom(r).Pinned != "" {
+			next(w, r)
+			return
+		}
+
+		key := s.cacheKey(r)
+		credentialed := s.credentialed(r)
+		if entry, ok := s.config.Cache.Get(key); ok && (!credentialed || public(entry.Header)) {
+			metrics.CacheRequests.WithLabelValues(route, "hit").Inc()
+			routingInfoFrom(r).Decision = "cache_hit"
+			for name, values := range entry.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.Status)
+			w.Write(entry.Body)
+			return
+		}
+		metrics.CacheRequests.WithLabelValues(route, "miss").Inc()
+		if s.degradation.current() >= 2 {
+			s.rejectDegraded(w, r, "The service is degraded to cached responses.")
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if !routingInfoFrom(r).Proxied || rec.status != http.StatusOK || personal(rec.Header()) ||
+			credentialed && !public(rec.Header()) {
+			return
+		}
+		header := rec.Header().Clone()
+		header.Del("X-Cache")
+		s.config.Cache.Set(key, &cache.Entry{
+			Status:  rec.status,
+			Header:  header,
+			Body:    rec.body.Bytes(),
+			Expires: time.Now().Add(ttl),
+		})
+	}
+}
+
+// handleCacheInvalidate drops cached responses whose path starts with the
+// prefix query parameter, or all of them without one
+func (s *Server) handleCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	if s.config.Cache == nil {
+		http.Error(w, "Response caching is disabled.", http.StatusNotFound)
+		return
+	}
+	dropped := s.config.Cache.Invalidate(r.URL.Query().Get("prefix"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "invalidated": dropped})
+}
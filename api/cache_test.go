@@ -0,0 +1,178 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/cache"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestCacheResponses(t *testing.T) {
+	apiKeys := auth.New(auth.Config{APIKeys: map[string]string{"key-a": "client-a", "key-b": "client-b"}})
+	tests := []struct {
+		name     string
+		auth     *auth.Authenticator
+		response http.Header
+		// requests holds the headers of the requests sent one after another
+		requests []http.Header
+		calls    int
+	}{
+		{
+			name:     "shared",
+			requests: []http.Header{{}, {}},
+			calls:    1,
+		},
+		{
+			name:     "cookie set",
+			response: http.Header{"Set-Cookie": {"session=1"}},
+			requests: []http.Header{{}, {}},
+			calls:    2,
+		},
+		{
+			name:     "private",
+			response: http.Header{"Cache-Control": {"private"}},
+			requests: []http.Header{{}, {}},
+			calls:    2,
+		},
+		{
+			name:     "same authenticated client",
+			auth:     apiKeys,
+			requests: []http.Header{{"X-Api-Key": {"key-a"}}, {"X-Api-Key": {"key-a"}}},
+			calls:    1,
+		},
+		{
+			name:     "other authenticated client",
+			auth:     apiKeys,
+			requests: []http.Header{{"X-Api-Key": {"key-a"}}, {"X-Api-Key": {"key-b"}}},
+			calls:    2,
+		},
+		{
+			name:     "authorization without auth",
+			requests: []http.Header{{"Authorization": {"Bearer a"}}, {"Authorization": {"Bearer b"}}},
+			calls:    2,
+		},
+		{
+			name:     "cookie without auth",
+			requests: []http.Header{{}, {"Cookie": {"session=b"}}},
+			calls:    2,
+		},
+		{
+			name:     "public response to authorization without auth",
+			response: http.Header{"Cache-Control": {"public, max-age=60"}},
+			requests: []http.Header{{"Authorization": {"Bearer a"}}, {"Authorization": {"Bearer b"}}},
+			calls:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				for name, values := range tt.response {
+					w.Header()[name] = values
+				}
+				io.WriteString(w, "resource")
+			}))
+			defer backend.Close()
+			config := Config{ProxyPrefix: "/api/", Cache: cache.New(1 << 20), CacheTTLs: map[string]time.Duration{"/api/": time.Minute}, Auth: tt.auth}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			for _, header := range tt.requests {
+				r := httptest.NewRequest(http.MethodGet, "/api/resource", nil)
+				r.Header = header
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK || w.Body.String() != "resource" {
+					t.Fatalf("got %d %q", w.Code, w.Body.String())
+				}
+			}
+			if got := int(calls.Load()); got != tt.calls {
+				t.Errorf("node got %d calls, expected %d", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestPinnedRequestsBypassCacheAndCoalescing(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	defer once.Do(func() { close(release) })
+	called := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-release
+		io.WriteString(w, "node-1")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "node-2")
+	}))
+	defer fast.Close()
+
+	config := Config{
+		ProxyPrefix:   "/api/",
+		Routes:        map[string]RouteConfig{"/api/": {Coalesce: true}},
+		Cache:         cache.New(1 << 20),
+		CacheTTLs:     map[string]time.Duration{"/api/": time.Minute},
+		NodePinning:   true,
+		PinningSecret: "secret",
+	}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{
+		{NodeID: "node-1", Address: slow.URL, Limits: "100 req/min"},
+		{NodeID: "node-2", Address: fast.URL, Limits: "100 req/min"},
+	})
+	get := func(node string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/resource", nil)
+		if node != "" {
+			r.Header.Set(pinHeader, node)
+			r.Header.Set(pinTokenHeader, "secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A request pinned to node-2 is not coalesced with one in flight on node-1
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- get("node-1") }()
+	<-called
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- get("node-2") }()
+	select {
+	case w := <-second:
+		if w.Body.String() != "node-2" {
+			t.Errorf("request pinned to node-2 got %d %q", w.Code, w.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("request pinned to node-2 waited for the one in flight on node-1")
+		once.Do(func() { close(release) })
+		<-second
+	}
+	once.Do(func() { close(release) })
+	if w := <-first; w.Body.String() != "node-1" {
+		t.Errorf("request pinned to node-1 got %d %q", w.Code, w.Body.String())
+	}
+
+	// Nor is it answered from the cache, or cached for others
+	if w := get(""); w.Code != http.StatusOK || w.Header().Get("X-Cache") == "HIT" {
+		t.Fatalf("first unpinned request got %d, X-Cache %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	if w := get(""); w.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("second unpinned request was not served from the cache")
+	}
+	for _, node := range []string{"node-1", "node-2"} {
+		if w := get(node); w.Body.String() != node || w.Header().Get("X-Cache") == "HIT" {
+			t.Errorf("request pinned to %s got %q, X-Cache %q", node, w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+}
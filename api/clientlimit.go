@@ -0,0 +1,56 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rejectClientLimit is the reject reason of requests over their client's rate
+const rejectClientLimit = "client_limit"
+
+// limitClients refuses the requests of clients that used up their token
+// bucket with 429, telling them when to retry. Requests are let through
+// when the limiter fails, so an unreachable Redis does not take the
+// balancer down. It must run inside authenticate, so the client is known.
+func (s *Server) limitClients(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.ClientLimiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.takeClientToken(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// takeClientToken takes a token of the client's bucket for r, answering
+// it like limitClients and returning false when none is left
+func (s *Server) takeClientToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.ClientLimiter == nil {
+		return true
+	}
+	info := routingInfoFrom(r)
+	started := time.Now()
+	decision, err := s.config.ClientLimiter.Take(r.Context(), s.clientID(r))
+	info.timePhase(phaseLimits, started)
+	if err != nil {
+		log.Printf("taking client token: %v", err)
+		return true
+	}
+	if decision.Allowed {
+		return true
+	}
+
+	s.debugf(r, "client is out of tokens, retry in %s", decision.RetryAfter)
+	info.Decision = "rate_limited"
+	countRejection(w, r, rejectClientLimit)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(decision.RetryAfter))))
+	if isGRPC(r, nil) {
+		grpcError(w, grpcResourceExhausted, "client rate limit exceeded")
+		return false
+	}
+	s.writeError(w, r, ConditionRateLimited, http.StatusTooManyRequests, "Your client is over its rate limit. Retry later.")
+	return false
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// coalescedCall struct represents a GET request served for every identical
+// request arriving while it is in flight
+type coalescedCall struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	// shared is false when the request gave up before it was served, so the
+	// requests waiting on it must be served on their own
+	shared bool
+}
+
+// coalescer holds the GET requests in flight on routes with
+// RouteConfig.Coalesce, by route and cache key
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: map[string]*coalescedCall{}}
+}
+
+// coalesce serves identical GET requests on route arriving while one of
+// them is in flight with that one's response, so a burst of them makes one
+// call to the nodes. Requests are identical when their cache keys are, see
+// cacheKey, which tells clients apart when they authenticate; each waits
+// no longer than its own timeout. Responses meant for one client only, see
+// personal, are not shared, and requests pinned to a node, see pinNode,
+// are never coalesced.
+func (s *Server) coalesce(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.Routes[route].Coalesce {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || routingInfoFrom(r).Pinned != "" {
+			next(w, r)
+			return
+		}
+		key := route + "\x00" + s.cacheKey(r)
+		c := s.coalescing
+		c.mu.Lock()
+		if call, ok := c.calls[key]; ok {
+			c.mu.Unlock()
+			s.awaitCoalesced(w, r, route, call, next)
+			return
+		}
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mu.Unlock()
+		metrics.CoalescedRequests.WithLabelValues(route, "leader").Inc()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(call.done)
+		}()
+		next(rec, r)
+		if r.Context().Err() != nil {
+			return
+		}
+		if personal(rec.Header()) {
+			return
+		}
+		call.status, call.header, call.body, call.shared = rec.status, rec.Header().Clone(), rec.body.Bytes(), true
+		if call.status == 0 {
+			call.status = http.StatusOK
+		}
+	}
+}
+
+// personal reports whether a response is meant for its own client only: it
+// sets a cookie or the node marks it private or not to be stored
+func personal(header http.Header) bool {
+	cacheControl := header.Get("Cache-Control")
+	return header.Get("Set-Cookie") != "" || strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store")
+}
+
+// awaitCoalesced answers r with the response of call once it is served, or
+// serves r on its own when call gave up first
+func (s *Server) awaitCoalesced(w http.ResponseWriter, r *http.Request, route string, call *coalescedCall, next http.HandlerFunc) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		routingInfoFrom(r).Decision = "timeout"
+		s.writeError(w, r, ConditionTimeout, http.StatusGatewayTimeout, "The request timed out waiting for an identical one.")
+		return
+	}
+	if !call.shared {
+		next(w, r)
+		return
+	}
+	metrics.CoalescedRequests.WithLabelValues(route, "follower").Inc()
+	routingInfoFrom(r).Decision = "coalesced"
+	for name, values := range call.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Coalesced", "true")
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// What the bpm of proxied requests is taken from
+const (
+	// BPMDeclared takes the bpm field of the request body
+	BPMDeclared = "declared"
+	// BPMUncompressed takes the size of the request body once decompressed
+	BPMUncompressed = "uncompressed"
+	// BPMWire takes the size of the request body as the client sent it,
+	// compressed or not
+	BPMWire = "wire"
+)
+
+// ValidateBPMAccounting checks what the bpm of requests is taken from
+func ValidateBPMAccounting(accounting string) error {
+	switch accounting {
+	case BPMDeclared, BPMUncompressed, BPMWire:
+		return nil
+	}
+	return fmt.Errorf("unknown bpm accounting %q, expected declared, uncompressed or wire", accounting)
+}
+
+// Compression struct represents how responses are compressed toward the
+// clients accepting it
+type Compression struct {
+	// MinBytes is the size below which responses are sent as they are, as
+	// compressing them saves too little
+	MinBytes int
+	// ContentTypes are the media types compressed, a trailing * matching any
+	// subtype, e.g. text/*; responses of any type are compressed when empty
+	ContentTypes []string
+}
+
+// compresses reports whether responses with the Content-Type header are
+// compressed
+func (c *Compression) compresses(header string) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, contentType := range c.ContentTypes {
+		if prefix, ok := strings.CutSuffix(contentType, "*"); ok && strings.HasPrefix(mediaType, prefix) || contentType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// compress decompresses request bodies sent with Content-Encoding gzip or br
+// and, with Config.Compression set, compresses the responses of clients
+// accepting it. It must run inside logAccess, which counts the bytes on the
+// wire, and outside checkRequest, so size limits apply to decompressed bodies.
+func (s *Server) compress(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.decompressBody(w, r) {
+			return
+		}
+		encoding := ""
+		if s.config.Compression != nil && r.Method != http.MethodHead {
+			encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+		if encoding == "" {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, compression: s.config.Compression, encoding: encoding}
+		defer cw.close()
+		next(cw, r)
+	}
+}
+
+// decompressBody replaces the body of a request sent with Content-Encoding
+// gzip or br with its decompressed form, answering 415 for other encodings
+// and 400 for bodies that are not what their encoding says. It counts the
+// bytes received in routingInfo.wire either way.
+func (s *Server) decompressBody(w http.ResponseWriter, r *http.Request) bool {
+	info := routingInfoFrom(r)
+	wire := &countingReader{ReadCloser: r.Body}
+	info.wire = wire
+	r.Body = wire
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	var body io.Reader
+	switch encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(wire)
+		if err != nil {
+			info.Decision = "invalid"
+			http.Error(w, fmt.Sprintf("Request body is not gzip: %v", err), http.StatusBadRequest)
+			return false
+		}
+		body = zr
+	case "br":
+		body = brotli.NewReader(wire)
+	default:
+		info.Decision = "invalid"
+		w.Header().Set("Accept-Encoding", "gzip, br")
+		http.Error(w, fmt.Sprintf("Content-Encoding %s is not supported.", encoding), http.StatusUnsupportedMediaType)
+		return false
+	}
+	metrics.DecompressedRequests.WithLabelValues(encoding).Inc()
+	r.Body = decompressedBody{Reader: body, Closer: wire}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
+
+// decompressedBody reads a request body through its decoder and closes the
+// body itself
+type decompressedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// negotiateEncoding returns the encoding responses to a client with the
+// Accept-Encoding header are compressed with, br over gzip, or none
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[coding] = q > 0
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if ok, listed := accepted[encoding]; ok || !listed && accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses a response once it is known to be worth it:
+// its type is compressed, it is not encoded already and it reaches the
+// minimum size. It holds the body back until then, sending it as it is when
+// the response ends or is flushed first.
+type compressWriter struct {
+	http.ResponseWriter
+	compression *Compression
+	encoding    string
+	status      int
+	buffered    []byte
+	// decided is set once the headers are sent, compressing with encoder or not
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if !cw.eligible() {
+		cw.start(false)
+		return
+	}
+	if length, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil && length < cw.compression.MinBytes {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	if cw.decided {
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buffered = append(cw.buffered, b...)
+	if len(cw.buffered) < cw.compression.MinBytes {
+		return len(b), nil
+	}
+	if err := cw.start(true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush sends what is held back, so streamed responses are only compressed
+// when their first flush reaches the minimum size
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.start(false)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// eligible reports whether the response may be compressed going by its
+// status and headers
+func (cw *compressWriter) eligible() bool {
+	if cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return cw.compression.compresses(header.Get("Content-Type"))
+}
+
+// start sends the headers and what is held back, compressed or not
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if cw.eligible() {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		metrics.CompressedResponses.WithLabelValues(cw.encoding).Inc()
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buffered := cw.buffered
+	cw.buffered = nil
+	if !compress {
+		_, err := cw.ResponseWriter.Write(buffered)
+		return err
+	}
+	if cw.encoding == "br" {
+		cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+	}
+	_, err := cw.encoder.Write(buffered)
+	return err
+}
+
+// close sends a response that ended below the minimum size as it is, and
+// finishes the compressed stream otherwise
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// Nothing was written, the server answers 200 itself
+			return
+		}
+		cw.start(false)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+}
+
+// requestBPM returns the bpm a request with the decoded body is accounted
+// with, see Config.BPMAccounting
+func (s *Server) requestBPM(r *http.Request, request Request, body []byte) int {
+	switch s.config.BPMAccounting {
+	case BPMUncompressed:
+		return len(body)
+	case BPMWire:
+		if wire := routingInfoFrom(r).wire; wire != nil {
+			return int(wire.bytes)
+		}
+		return len(body)
+	}
+	return request.BPM
+}
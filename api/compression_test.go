@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{header: "", expected: ""},
+		{header: "gzip", expected: "gzip"},
+		{header: "gzip, deflate, br", expected: "br"},
+		{header: "GZIP", expected: "gzip"},
+		{header: "br;q=0, gzip;q=0.5", expected: "gzip"},
+		{header: "br;q=0, gzip;q=0", expected: ""},
+		{header: "*", expected: "br"},
+		{header: "br;q=0, *", expected: "gzip"},
+		{header: "*;q=0", expected: ""},
+		{header: "deflate, identity", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := negotiateEncoding(tt.header); got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	large := strings.Repeat("compressible ", 100)
+	tests := []struct {
+		name     string
+		accept   string
+		header   http.Header
+		body     string
+		encoding string
+		etag     string
+	}{
+		{name: "gzip", accept: "gzip", header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, body: large, encoding: "gzip"},
+		{name: "br over gzip", accept: "gzip, br", header: http.Header{"Content-Type": {"application/json"}}, body: large, encoding: "br"},
+		{name: "not accepted", header: http.Header{"Content-Type": {"text/plain"}}, body: large},
+		{name: "below the minimum size", accept: "gzip", header: http.Header{"Content-Type": {"text/plain"}}, body: "small"},
+		{name: "type not compressed", accept: "gzip", header: http.Header{"Content-Type": {"image/png"}}, body: large},
+		{name: "no-transform", accept: "gzip", header: http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"no-transform"}}, body: large},
+		{name: "strong etag weakened", accept: "gzip", header: http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}}, body: large, encoding: "gzip", etag: `W/"v1"`},
+		{name: "etag kept", accept: "gzip", header: http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}}, body: "small", etag: `"v1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				io.WriteString(w, tt.body)
+			}))
+			defer backend.Close()
+			config := Config{ProxyPrefix: "/api/", Compression: &Compression{MinBytes: 100, ContentTypes: []string{"text/*", "application/json"}}}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			r := httptest.NewRequest(http.MethodGet, "/api/resource", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("got Content-Encoding %q, expected %q", got, tt.encoding)
+			}
+			if got := w.Header().Get("Etag"); got != tt.etag {
+				t.Errorf("got ETag %q, expected %q", got, tt.etag)
+			}
+
+			var body io.Reader = w.Body
+			switch tt.encoding {
+			case "gzip":
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			case "br":
+				body = brotli.NewReader(body)
+			}
+			decoded, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != tt.body {
+				t.Errorf("got a body of %d bytes, expected %d", len(decoded), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestDecompressRequestBody(t *testing.T) {
+	payload := `{"bpm": 1, "note": "compressed"}`
+	gzipped := &bytes.Buffer{}
+	zw := gzip.NewWriter(gzipped)
+	io.WriteString(zw, payload)
+	zw.Close()
+	brotlied := &bytes.Buffer{}
+	bw := brotli.NewWriter(brotlied)
+	io.WriteString(bw, payload)
+	bw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{name: "identity", body: []byte(payload), status: http.StatusOK},
+		{name: "gzip", encoding: "gzip", body: gzipped.Bytes(), status: http.StatusOK},
+		{name: "br", encoding: "br", body: brotlied.Bytes(), status: http.StatusOK},
+		{name: "not gzip", encoding: "gzip", body: []byte(payload), status: http.StatusBadRequest},
+		{name: "unsupported", encoding: "deflate", body: []byte(payload), status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				received = r.Header.Get("Content-Encoding") + string(data)
+			}))
+			defer backend.Close()
+			handler, _ := newTestServer(t, Config{ProxyPrefix: "/api/"}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			r := httptest.NewRequest(http.MethodPost, "/api/resource", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status == http.StatusOK && received != payload {
+				t.Errorf("node received %q", received)
+			}
+			if tt.status == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Encoding") != "gzip, br" {
+				t.Errorf("got Accept-Encoding %q", w.Header().Get("Accept-Encoding"))
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDebugDuration bounds how long debug logging stays on for a client, so
+// a forgotten target cannot flood the logs for good
+const maxDebugDuration = 24 * time.Hour
+
+// redactedHeaders are not written to debug logs or audit samples
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Cookie", pinTokenHeader}
+
+// debugTarget struct represents a client whose requests are logged verbosely
+// until it expires, identified by its client name or its IP
+type debugTarget struct {
+	// Client is the authenticated client, e.g. an API key's client name, or
+	// the value of the client header
+	Client string `json:"client,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	// SampleRate is the share of the client's requests that are logged
+	SampleRate float64   `json:"sample_rate"`
+	Until      time.Time `json:"until"`
+}
+
+func (t debugTarget) key() string {
+	if t.Client != "" {
+		return "client:" + t.Client
+	}
+	return "ip:" + t.IP
+}
+
+// debugTargets holds the clients debug logging is on for
+type debugTargets struct {
+	mu      sync.RWMutex
+	targets map[string]debugTarget
+}
+
+func newDebugTargets() *debugTargets {
+	return &debugTargets{targets: map[string]debugTarget{}}
+}
+
+func (d *debugTargets) set(t debugTarget) {
+	d.mu.Lock()
+	d.targets[t.key()] = t
+	d.mu.Unlock()
+}
+
+func (d *debugTargets) remove(t debugTarget) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.targets[t.key()]; !ok {
+		return false
+	}
+	delete(d.targets, t.key())
+	return true
+}
+
+// list returns the targets that have not expired, dropping the others
+func (d *debugTargets) list(now time.Time) []debugTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	targets := []debugTarget{}
+	for key, t := range d.targets {
+		if !now.Before(t.Until) {
+			delete(d.targets, key)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].key() < targets[j].key() })
+	return targets
+}
+
+// sampled reports whether a request of client from ip is logged: either
+// matches an unexpired target and the request falls within its sample rate
+func (d *debugTargets) sampled(client, ip string, now time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.targets) == 0 {
+		return false
+	}
+	for _, key := range []string{"client:" + client, "ip:" + ip} {
+		if t, ok := d.targets[key]; ok && now.Before(t.Until) && rand.Float64() < t.SampleRate {
+			return true
+		}
+	}
+	return false
+}
+
+// debugLog logs the sampled requests of the clients debug logging is on for:
+// their headers, the balancer's decisions on the way and the response. It
+// must run inside authenticate, so the client is known.
+func (s *Server) debugLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := routingInfoFrom(r)
+		client := info.Client
+		if client == "" && s.config.ClientHeader != "" {
+			client = r.Header.Get(s.config.ClientHeader)
+		}
+		if !s.debug.sampled(client, s.clientIP(r), time.Now()) {
+			next(w, r)
+			return
+		}
+
+		info.DebugID = requestID(r)
+		started := time.Now()
+		headers := r.Header.Clone()
+		for _, name := range redactedHeaders {
+			if headers.Get(name) != "" {
+				headers.Set(name, "[redacted]")
+			}
+		}
+		s.debugf(r, "%s %s from %s client %q, headers %v", r.Method, r.URL.RequestURI(), r.RemoteAddr, client, headers)
+		cw := &countingWriter{ResponseWriter: w}
+		next(cw, r)
+		s.debugf(r, "answered %d with %d bytes in %s: decision %s, node %q, reject reason %q, upstream %s",
+			cw.status, cw.bytes, time.Since(started), info.Decision, info.Node, info.RejectReason, info.Upstream)
+	}
+}
+
+// debugf logs a step of a request debug logging sampled, and records it for
+// the devDecisionHeader header in developer mode. It is a no-op for every
+// other request.
+func (s *Server) debugf(r *http.Request, format string, args ...any) {
+	info := routingInfoFrom(r)
+	if info.DebugID == "" && !info.dev {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	if info.dev {
+		info.steps = append(info.steps, message)
+	}
+	if info.DebugID != "" {
+		log.Printf("debug [%s] %s", info.DebugID, message)
+	}
+}
+
+// handleDebug lists the clients debug logging is on for, turns it on for one
+// on PUT for the given minutes, and off on DELETE with ?client= or ?ip=
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Client     string   `json:"client"`
+			IP         string   `json:"ip"`
+			Minutes    float64  `json:"minutes"`
+			SampleRate *float64 `json:"sample_rate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (body.Client == "") == (body.IP == "") {
+			http.Error(w, "exactly one of client and ip is required", http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(body.Minutes * float64(time.Minute))
+		if duration <= 0 || duration > maxDebugDuration {
+			http.Error(w, fmt.Sprintf("minutes must be above 0 and at most %.0f", maxDebugDuration.Minutes()), http.StatusBadRequest)
+			return
+		}
+		target := debugTarget{Client: body.Client, IP: body.IP, SampleRate: 1, Until: time.Now().Add(duration)}
+		if body.SampleRate != nil {
+			if *body.SampleRate <= 0 || *body.SampleRate > 1 {
+				http.Error(w, "sample_rate must be above 0 and at most 1", http.StatusBadRequest)
+				return
+			}
+			target.SampleRate = *body.SampleRate
+		}
+		s.debug.set(target)
+		log.Printf("debug logging %s at a sample rate of %g until %s", target.key(), target.SampleRate, target.Until.Format(time.RFC3339))
+	case http.MethodDelete:
+		target := debugTarget{Client: r.URL.Query().Get("client"), IP: r.URL.Query().Get("ip")}
+		if (target.Client == "") == (target.IP == "") {
+			http.Error(w, "exactly one of ?client= and ?ip= is required", http.StatusBadRequest)
+			return
+		}
+		if !s.debug.remove(target) {
+			http.Error(w, fmt.Sprintf("Debug logging is off for %s", strings.Replace(target.key(), ":", " ", 1)), http.StatusNotFound)
+			return
+		}
+		log.Printf("stopped debug logging %s", target.key())
+	}
+	writeJSON(w, http.StatusOK, s.debug.list(time.Now()))
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestDebugTargets(t *testing.T) {
+	now := time.Now()
+	d := newDebugTargets()
+	d.set(debugTarget{Client: "alice", SampleRate: 1, Until: now.Add(time.Minute)})
+	d.set(debugTarget{IP: "10.0.0.1", SampleRate: 1, Until: now.Add(time.Minute)})
+	d.set(debugTarget{Client: "bob", SampleRate: 1, Until: now.Add(-time.Second)})
+
+	tests := []struct {
+		client, ip string
+		expected   bool
+	}{
+		{client: "alice", ip: "10.0.0.2", expected: true},
+		{client: "carol", ip: "10.0.0.1", expected: true},
+		{client: "bob", ip: "10.0.0.2"},
+		{ip: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		if got := d.sampled(tt.client, tt.ip, now); got != tt.expected {
+			t.Errorf("sampled(%q, %q) = %v, expected %v", tt.client, tt.ip, got, tt.expected)
+		}
+	}
+
+	targets := d.list(now)
+	if len(targets) != 2 || targets[0].Client != "alice" || targets[1].IP != "10.0.0.1" {
+		t.Errorf("got %+v, expected alice and 10.0.0.1 without the expired bob", targets)
+	}
+	if d.remove(debugTarget{Client: "bob"}) {
+		t.Error("removed the expired target a second time")
+	}
+}
+
+func TestHandleDebug(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	handler, _ := newTestServer(t, Config{ClientHeader: "X-Client"}, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}})
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	for _, body := range []string{
+		`{"minutes": 5}`,
+		`{"client": "alice", "ip": "10.0.0.1", "minutes": 5}`,
+		`{"client": "alice", "minutes": 0}`,
+		`{"client": "alice", "minutes": 2000}`,
+		`{"client": "alice", "minutes": 5, "sample_rate": 1.5}`,
+	} {
+		if w := serve(http.MethodPut, "/admin/debug", body); w.Code != http.StatusBadRequest {
+			t.Errorf("got %d for %s, expected 400", w.Code, body)
+		}
+	}
+	w := serve(http.MethodPut, "/admin/debug", `{"client": "alice", "minutes": 5}`)
+	var targets []debugTarget
+	if err := json.NewDecoder(w.Body).Decode(&targets); err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Client != "alice" || targets[0].SampleRate != 1 {
+		t.Fatalf("got %+v, expected alice at every request", targets)
+	}
+
+	for _, client := range []string{"alice", "bob"} {
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+		r.Header.Set("X-Client", client)
+		r.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if !strings.Contains(logs.String(), `client "alice"`) || strings.Contains(logs.String(), `client "bob"`) {
+		t.Errorf("got logs %q, expected the request of alice only", logs.String())
+	}
+	if strings.Contains(logs.String(), "secret") || !strings.Contains(logs.String(), "[redacted]") {
+		t.Errorf("got logs %q, expected the Authorization header redacted", logs.String())
+	}
+
+	if w := serve(http.MethodDelete, "/admin/debug?client=alice", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d stopping debug logging, expected 200", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/admin/debug?client=alice", ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d stopping it again, expected 404", w.Code)
+	}
+}
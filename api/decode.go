@@ -0,0 +1,291 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// decodeRequest decodes a request body like json.Unmarshal into a Request,
+// without allocating for the bodies clients send: an object whose bpm is an
+// integer. Anything else, including every invalid body, goes through
+// encoding/json, so results and errors are the same as before.
+func decodeRequest(body []byte) (Request, error) {
+	if request, ok := scanRequest(body); ok {
+		return request, nil
+	}
+	var request Request
+	err := json.Unmarshal(body, &request)
+	return request, err
+}
+
+// scanRequest decodes body if it is a valid JSON object with plain ASCII
+// keys and an integer or null bpm, reporting false for anything else
+func scanRequest(body []byte) (Request, bool) {
+	var request Request
+	s := jsonScanner{data: body}
+	s.space()
+	if !s.consume('{') {
+		return request, false
+	}
+	s.space()
+	if s.consume('}') {
+		return request, s.end()
+	}
+	for {
+		key, ok := s.key()
+		if !ok {
+			return request, false
+		}
+		s.space()
+		if !s.consume(':') {
+			return request, false
+		}
+		s.space()
+		if isBPM(key) {
+			// Later keys win, like in encoding/json
+			if s.literal("null") {
+				// null leaves the field alone
+			} else if bpm, ok := s.integer(); ok {
+				request.BPM = bpm
+			} else {
+				return request, false
+			}
+		} else if !s.skipValue(0) {
+			return request, false
+		}
+		s.space()
+		if s.consume('}') {
+			return request, s.end()
+		}
+		if !s.consume(',') {
+			return request, false
+		}
+		s.space()
+	}
+}
+
+// isBPM reports whether an ASCII key matches the bpm field, which
+// encoding/json does case-insensitively
+func isBPM(key []byte) bool {
+	return len(key) == 3 && key[0]|0x20 == 'b' && key[1]|0x20 == 'p' && key[2]|0x20 == 'm'
+}
+
+// maxScanDepth bounds the nesting scanRequest skips over; deeper bodies go
+// through encoding/json
+const maxScanDepth = 64
+
+// jsonScanner walks a JSON document without building values
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *jsonScanner) space() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *jsonScanner) consume(c byte) bool {
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// end reports whether only whitespace is left
+func (s *jsonScanner) end() bool {
+	s.space()
+	return s.pos == len(s.data)
+}
+
+func (s *jsonScanner) literal(word string) bool {
+	if len(s.data)-s.pos < len(word) || string(s.data[s.pos:s.pos+len(word)]) != word {
+		return false
+	}
+	s.pos += len(word)
+	return true
+}
+
+// key returns a string without escapes or non-ASCII bytes, which could
+// match a field in ways only encoding/json gets right
+func (s *jsonScanner) key() ([]byte, bool) {
+	if !s.consume('"') {
+		return nil, false
+	}
+	start := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return s.data[start : s.pos-1], true
+		case c == '\\' || c < 0x20 || c >= 0x80:
+			return nil, false
+		}
+		s.pos++
+	}
+	return nil, false
+}
+
+// integer parses a number without fraction or exponent that fits an int
+func (s *jsonScanner) integer() (int, bool) {
+	negative := s.consume('-')
+	start := s.pos
+	n := 0
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		digit := int(s.data[s.pos] - '0')
+		if n > (math.MaxInt-digit)/10 {
+			return 0, false
+		}
+		n = n*10 + digit
+		s.pos++
+	}
+	digits := s.pos - start
+	if digits == 0 || digits > 1 && s.data[start] == '0' {
+		return 0, false
+	}
+	if s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '.', 'e', 'E':
+			return 0, false
+		}
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+// skipValue moves past any valid JSON value
+func (s *jsonScanner) skipValue(depth int) bool {
+	if s.pos >= len(s.data) || depth > maxScanDepth {
+		return false
+	}
+	switch c := s.data[s.pos]; {
+	case c == '"':
+		return s.skipString()
+	case c == '{':
+		return s.skipContainer('}', depth, true)
+	case c == '[':
+		return s.skipContainer(']', depth, false)
+	case c == '-' || c >= '0' && c <= '9':
+		return s.skipNumber()
+	case c == 't':
+		return s.literal("true")
+	case c == 'f':
+		return s.literal("false")
+	case c == 'n':
+		return s.literal("null")
+	}
+	return false
+}
+
+// skipContainer moves past an object or array, whose opening byte is next
+func (s *jsonScanner) skipContainer(closing byte, depth int, object bool) bool {
+	s.pos++
+	s.space()
+	if s.consume(closing) {
+		return true
+	}
+	for {
+		if object {
+			if s.pos >= len(s.data) || s.data[s.pos] != '"' || !s.skipString() {
+				return false
+			}
+			s.space()
+			if !s.consume(':') {
+				return false
+			}
+			s.space()
+		}
+		if !s.skipValue(depth + 1) {
+			return false
+		}
+		s.space()
+		if s.consume(closing) {
+			return true
+		}
+		if !s.consume(',') {
+			return false
+		}
+		s.space()
+	}
+}
+
+// skipString moves past a string, whose opening quote is next. Strings with
+// invalid UTF-8 are valid JSON, which encoding/json accepts as well.
+func (s *jsonScanner) skipString() bool {
+	s.pos++
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return true
+		case c < 0x20:
+			return false
+		case c == '\\':
+			if s.pos+1 >= len(s.data) {
+				return false
+			}
+			switch s.data[s.pos+1] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				s.pos += 2
+			case 'u':
+				if len(s.data)-s.pos < 6 || !isHex(s.data[s.pos+2:s.pos+6]) {
+					return false
+				}
+				s.pos += 6
+			default:
+				return false
+			}
+		default:
+			s.pos++
+		}
+	}
+	return false
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// skipNumber moves past a number in the JSON grammar
+func (s *jsonScanner) skipNumber() bool {
+	s.consume('-')
+	digits := func() int {
+		start := s.pos
+		for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+			s.pos++
+		}
+		return s.pos - start
+	}
+	start := s.pos
+	if n := digits(); n == 0 || n > 1 && s.data[start] == '0' {
+		return false
+	}
+	if s.consume('.') && digits() == 0 {
+		return false
+	}
+	if s.consume('e') || s.consume('E') {
+		if !s.consume('+') {
+			s.consume('-')
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var decodeSeeds = []string{
+	`{"bpm": 1024}`,
+	`{"bpm":-3,"client":"a","tags":["x",{"y":null}],"ok":true}`,
+	`{"BPM": 1, "bpm": 2}`,
+	`{"bpm": null}`,
+	`{"bpm": 1.5}`,
+	`{"bpm": 1e3}`,
+	`{"bpm": 99999999999999999999}`,
+	`{"bpm": "1"}`,
+	`{"bpm": 7}`,
+	`{"note": "café \"quoted\""}`,
+	`{}`,
+	` { "bpm" : 01 } `,
+	`{"bpm": 1,}`,
+	`{"bpm": 1} x`,
+	`[1]`,
+	`null`,
+	``,
+}
+
+// FuzzDecodeRequest checks that decodeRequest decodes every body like
+// json.Unmarshal, succeeding and failing on the same ones
+func FuzzDecodeRequest(f *testing.F) {
+	for _, seed := range decodeSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		got, err := decodeRequest(body)
+		var expected Request
+		expectedErr := json.Unmarshal(body, &expected)
+		if (err != nil) != (expectedErr != nil) {
+			t.Fatalf("decodeRequest(%q) returned error %v, json.Unmarshal %v", body, err, expectedErr)
+		}
+		if err == nil && got != expected {
+			t.Fatalf("decodeRequest(%q) = %+v, json.Unmarshal %+v", body, got, expected)
+		}
+	})
+}
+
+func BenchmarkDecodeRequest(b *testing.B) {
+	bodies := []struct {
+		name string
+		body []byte
+	}{
+		{"bpm", []byte(`{"bpm": 1024}`)},
+		{"extra fields", []byte(`{"bpm": 1024, "client": "svc-a", "tags": ["x", "y"], "meta": {"retry": false}}`)},
+		{"escaped key", []byte(`{"bp\u006d": 1024}`)},
+	}
+	for _, bb := range bodies {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := decodeRequest(bb.body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Degradation levels, from full service to the most degraded
+const (
+	// LevelFull serves every request
+	LevelFull = "full"
+	// LevelShedLow refuses the requests of the shed priority classes
+	LevelShedLow = "shed_low"
+	// LevelCachedOnly also refuses every request the response cache cannot
+	// answer
+	LevelCachedOnly = "cached_only"
+	// LevelStatic answers every proxied request with the degraded fallback
+	LevelStatic = "static"
+)
+
+// degradationLevels lists the levels in order, their index being how
+// degraded they are
+var degradationLevels = []string{LevelFull, LevelShedLow, LevelCachedOnly, LevelStatic}
+
+// degradationLevelHeader tells clients the balancer is degraded
+const degradationLevelHeader = "X-Degradation-Level"
+
+// maxDegradationOverride bounds how long a manual level may be held, so a
+// forgotten override does not degrade the service for good
+const maxDegradationOverride = 7 * 24 * time.Hour
+
+// DegradationPolicy struct represents when the balancer degrades on its own.
+// Healthy and Utilization hold a threshold for each level past full, in
+// order: a level is entered once the share of nodes up falls to its Healthy
+// threshold or the mean utilization of the nodes up rises to its Utilization
+// threshold. Levels without a threshold are only entered manually.
+type DegradationPolicy struct {
+	Healthy     []float64
+	Utilization []float64
+	// Interval is how often the fleet is looked at
+	Interval time.Duration
+	// Hold is how long the fleet must call for a lower level before the
+	// balancer steps down to it; higher levels are entered at once
+	Hold time.Duration
+	// Shed are the priority classes refused from shed_low on
+	Shed []string
+}
+
+// ValidateDegradationPolicy checks that there is at most one threshold per
+// level, that they lie between 0 and 1, and that each level is entered
+// after the one before it
+func ValidateDegradationPolicy(policy DegradationPolicy) error {
+	for name, thresholds := range map[string][]float64{"healthy": policy.Healthy, "utilization": policy.Utilization} {
+		if len(thresholds) > len(degradationLevels)-1 {
+			return fmt.Errorf("%s: at most %d thresholds, one for each of %v", name, len(degradationLevels)-1, degradationLevels[1:])
+		}
+		for i, threshold := range thresholds {
+			if threshold < 0 || threshold > 1 {
+				return fmt.Errorf("%s: threshold of %s must be between 0 and 1", name, degradationLevels[i+1])
+			}
+			if i == 0 {
+				continue
+			}
+			if name == "healthy" && threshold > thresholds[i-1] || name == "utilization" && threshold < thresholds[i-1] {
+				return fmt.Errorf("%s: threshold of %s must not be reached before the one of %s", name, degradationLevels[i+1], degradationLevels[i])
+			}
+		}
+	}
+	if policy.Interval <= 0 || policy.Hold < 0 {
+		return fmt.Errorf("interval must be positive and hold must not be negative")
+	}
+	return nil
+}
+
+// level returns the level signals call for
+func (p DegradationPolicy) level(signals degradationSignals) int {
+	level := 0
+	for i, threshold := range p.Healthy {
+		if signals.Healthy <= threshold {
+			level = max(level, i+1)
+		}
+	}
+	for i, threshold := range p.Utilization {
+		if signals.Utilization >= threshold {
+			level = max(level, i+1)
+		}
+	}
+	return level
+}
+
+// degradationSignals struct represents the state of the fleet levels are
+// chosen by
+type degradationSignals struct {
+	Time time.Time `json:"time"`
+	// Healthy is the share of nodes up, not counting standby and mirror
+	// nodes, which take no traffic by design
+	Healthy float64 `json:"healthy"`
+	// Utilization is the mean utilization of the nodes up, 1 when none is
+	Utilization float64 `json:"utilization"`
+}
+
+func fleetSignals(nodes []balancer.NodeStatus, now time.Time) degradationSignals {
+	signals := degradationSignals{Time: now, Utilization: 1}
+	var serving, up int
+	var utilization float64
+	for _, node := range nodes {
+		if node.State == balancer.StateStandby || node.State == balancer.StateMirror {
+			continue
+		}
+		serving++
+		if node.State == balancer.StateUp {
+			up++
+			utilization += node.Utilization
+		}
+	}
+	if serving > 0 {
+		signals.Healthy = float64(up) / float64(serving)
+	}
+	if up > 0 {
+		signals.Utilization = utilization / float64(up)
+	}
+	return signals
+}
+
+// degradationOverride struct represents a level set through the admin API
+type degradationOverride struct {
+	Level  string `json:"level"`
+	Reason string `json:"reason,omitempty"`
+	// Until is when the override ends, zero when it holds until removed
+	Until time.Time `json:"until,omitzero"`
+}
+
+func (o *degradationOverride) expired(now time.Time) bool {
+	return o != nil && !o.Until.IsZero() && !now.Before(o.Until)
+}
+
+// degradationStatus struct represents the level of the balancer and why
+type degradationStatus struct {
+	Level string    `json:"level"`
+	Since time.Time `json:"since"`
+	// Automatic is the level the fleet calls for, which applies without
+	// an override
+	Automatic string               `json:"automatic"`
+	Override  *degradationOverride `json:"override,omitempty"`
+	Signals   degradationSignals   `json:"signals"`
+}
+
+// degradation holds the level the balancer serves at
+type degradation struct {
+	mu        sync.Mutex
+	level     int
+	since     time.Time
+	automatic int
+	// lower is when the fleet first called for a level below automatic,
+	// zero while it does not
+	lower    time.Time
+	override *degradationOverride
+	signals  degradationSignals
+}
+
+func newDegradation() *degradation {
+	return &degradation{since: time.Now()}
+}
+
+func (d *degradation) current() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.level
+}
+
+func (d *degradation) status() degradationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return degradationStatus{Level: degradationLevels[d.level], Since: d.since, Automatic: degradationLevels[d.automatic], Override: d.override, Signals: d.signals}
+}
+
+// observe records the level the fleet calls for, stepping down to a lower
+// one only once it has been called for during hold
+func (d *degradation) observe(signals degradationSignals, target int, hold time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.signals = signals
+	switch {
+	case target >= d.automatic:
+		d.automatic = target
+		d.lower = time.Time{}
+	case d.lower.IsZero():
+		d.lower = signals.Time
+		fallthrough
+	default:
+		if signals.Time.Sub(d.lower) >= hold {
+			d.automatic = target
+			d.lower = time.Time{}
+		}
+	}
+}
+
+// apply sets the level to the override, or the automatic level without one,
+// returning the level it was at and whether it changed
+func (d *degradation) apply(now time.Time) (from, to int, changed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.override.expired(now) {
+		d.override = nil
+	}
+	from, to = d.level, d.automatic
+	if d.override != nil {
+		to = slices.Index(degradationLevels, d.override.Level)
+	}
+	if from == to {
+		return from, to, false
+	}
+	d.level, d.since = to, now
+	return from, to, true
+}
+
+func (d *degradation) setOverride(override *degradationOverride) {
+	d.mu.Lock()
+	d.override = override
+	d.mu.Unlock()
+}
+
+// RunDegradation looks at the health and utilization of the fleet every
+// Config.Degradation.Interval and moves to the level they call for, or the
+// one set through the admin API, until ctx is done
+func (s *Server) RunDegradation(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Degradation.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			nodes, err := s.lb.Status(ctx)
+			if err != nil {
+				log.Printf("reading the fleet for degradation: %v", err)
+				continue
+			}
+			signals := fleetSignals(nodes, now)
+			s.degradation.observe(signals, s.config.Degradation.level(signals), s.config.Degradation.Hold)
+			s.updateDegradation(now, "automatic")
+		}
+	}
+}
+
+// updateDegradation applies the current override or automatic level,
+// recording the transition if there is one
+func (s *Server) updateDegradation(now time.Time, reason string) {
+	from, to, changed := s.degradation.apply(now)
+	if !changed {
+		return
+	}
+	status := s.degradation.status()
+	if status.Override != nil {
+		reason = "override"
+		if status.Override.Reason != "" {
+			reason += ": " + status.Override.Reason
+		}
+	}
+	log.Printf("degradation level %s -> %s (%s, %.0f%% of nodes up at %.0f%% utilization)", degradationLevels[from], degradationLevels[to], reason, status.Signals.Healthy*100, status.Signals.Utilization*100)
+	metrics.DegradationLevel.Set(float64(to))
+	metrics.DegradationTransitions.WithLabelValues(degradationLevels[from], degradationLevels[to]).Inc()
+	s.config.Events.Publish(eventbus.Event{Type: eventbus.DegradationChanged, Reason: reason, Details: map[string]any{
+		"from":        degradationLevels[from],
+		"to":          degradationLevels[to],
+		"healthy":     status.Signals.Healthy,
+		"utilization": status.Signals.Utilization,
+	}})
+}
+
+// degrade answers the requests of route the current level refuses with the
+// degraded fallback: every request at static, those the cache cannot answer
+// at cached_only, and those of the shed priority classes from shed_low on.
+// Requests let through while degraded carry the level in a response header.
+func (s *Server) degrade(route string, next http.HandlerFunc) http.HandlerFunc {
+	_, cached := s.config.CacheTTLs[route]
+	cached = cached && s.config.Cache != nil
+	return func(w http.ResponseWriter, r *http.Request) {
+		level := s.degradation.current()
+		if level == 0 {
+			next(w, r)
+			return
+		}
+		w.Header().Set(degradationLevelHeader, degradationLevels[level])
+		switch {
+		case level >= 3:
+			s.rejectDegraded(w, r, "The service is degraded to static responses.")
+		case level >= 2 && (r.Method != http.MethodGet || !cached):
+			s.rejectDegraded(w, r, "The service is degraded to cached responses.")
+		case slices.Contains(s.config.Degradation.Shed, s.priority(r)):
+			s.rejectDegraded(w, r, "The service is degraded and sheds low priority requests.")
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// rejectDegraded answers r with the degraded fallback, 503 unless an error
+// page is configured for it
+func (s *Server) rejectDegraded(w http.ResponseWriter, r *http.Request, message string) {
+	routingInfoFrom(r).Decision = "degraded"
+	countRejection(w, r, "degraded")
+	if s.config.Degradation.Hold > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(s.config.Degradation.Hold)))
+	}
+	s.writeError(w, r, ConditionDegraded, http.StatusServiceUnavailable, message)
+}
+
+// handleDegradation reports the degradation level. PUT holds a level for
+// ?minutes= or until DELETE hands the level back to the fleet's signals.
+func (s *Server) handleDegradation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Level   string  `json:"level"`
+			Minutes float64 `json:"minutes"`
+			Reason  string  `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(degradationLevels, body.Level) {
+			http.Error(w, fmt.Sprintf("level must be one of %v", degradationLevels), http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(body.Minutes * float64(time.Minute))
+		if duration < 0 || duration > maxDegradationOverride {
+			http.Error(w, fmt.Sprintf("minutes must not be negative and at most %.0f", maxDegradationOverride.Minutes()), http.StatusBadRequest)
+			return
+		}
+		override := &degradationOverride{Level: body.Level, Reason: body.Reason}
+		if duration > 0 {
+			override.Until = time.Now().Add(duration)
+		}
+		s.degradation.setOverride(override)
+		s.updateDegradation(time.Now(), "override")
+	case http.MethodDelete:
+		s.degradation.setOverride(nil)
+		s.updateDegradation(time.Now(), "override removed")
+	}
+	writeJSON(w, http.StatusOK, s.degradation.status())
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestValidateDegradationPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy DegradationPolicy
+		valid  bool
+	}{
+		{name: "valid", policy: DegradationPolicy{Healthy: []float64{0.8, 0.5, 0.2}, Utilization: []float64{0.9, 0.95}, Interval: time.Second}, valid: true},
+		{name: "manual only", policy: DegradationPolicy{Interval: time.Second}, valid: true},
+		{name: "too many thresholds", policy: DegradationPolicy{Healthy: []float64{0.8, 0.6, 0.4, 0.2}, Interval: time.Second}},
+		{name: "out of range", policy: DegradationPolicy{Utilization: []float64{1.5}, Interval: time.Second}},
+		{name: "healthy rising", policy: DegradationPolicy{Healthy: []float64{0.5, 0.8}, Interval: time.Second}},
+		{name: "utilization falling", policy: DegradationPolicy{Utilization: []float64{0.9, 0.8}, Interval: time.Second}},
+		{name: "no interval", policy: DegradationPolicy{}},
+		{name: "negative hold", policy: DegradationPolicy{Interval: time.Second, Hold: -time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateDegradationPolicy(tt.policy); (err == nil) != tt.valid {
+				t.Errorf("got %v, expected valid to be %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestDegradationSignals(t *testing.T) {
+	nodes := []balancer.NodeStatus{
+		{NodeID: "a", State: balancer.StateUp, Utilization: 0.9},
+		{NodeID: "b", State: balancer.StateUp, Utilization: 0.7},
+		{NodeID: "c", State: balancer.StateUnhealthy},
+		{NodeID: "d", State: balancer.StateDraining},
+		{NodeID: "e", State: balancer.StateStandby},
+		{NodeID: "f", State: balancer.StateMirror},
+	}
+	signals := fleetSignals(nodes, time.Now())
+	if signals.Healthy != 0.5 || signals.Utilization != 0.8 {
+		t.Errorf("got %+v, expected half the nodes up at 0.8 utilization", signals)
+	}
+	if signals := fleetSignals(nil, time.Now()); signals.Healthy != 0 || signals.Utilization != 1 {
+		t.Errorf("got %+v without nodes, expected none up and full utilization", signals)
+	}
+
+	policy := DegradationPolicy{Healthy: []float64{0.8, 0.5, 0.2}, Utilization: []float64{0.9, 0.95}}
+	tests := []struct {
+		healthy, utilization float64
+		expected             string
+	}{
+		{1, 0.5, LevelFull},
+		{0.8, 0.5, LevelShedLow},
+		{1, 0.92, LevelShedLow},
+		{0.5, 0.92, LevelCachedOnly},
+		{1, 0.95, LevelCachedOnly},
+		{0.1, 1, LevelStatic},
+	}
+	for _, tt := range tests {
+		if got := degradationLevels[policy.level(degradationSignals{Healthy: tt.healthy, Utilization: tt.utilization})]; got != tt.expected {
+			t.Errorf("got %s at %g healthy and %g utilization, expected %s", got, tt.healthy, tt.utilization, tt.expected)
+		}
+	}
+}
+
+func TestDegradationHold(t *testing.T) {
+	d := newDegradation()
+	now := time.Now()
+	observe := func(after time.Duration, target int) string {
+		d.observe(degradationSignals{Time: now.Add(after)}, target, time.Minute)
+		d.apply(now.Add(after))
+		return d.status().Level
+	}
+	if level := observe(0, 2); level != LevelCachedOnly {
+		t.Fatalf("got %s, expected cached_only at once", level)
+	}
+	// Lower levels are stepped down to once called for during the hold
+	if level := observe(time.Second, 0); level != LevelCachedOnly {
+		t.Fatalf("got %s, expected cached_only held", level)
+	}
+	if level := observe(30*time.Second, 1); level != LevelCachedOnly {
+		t.Fatalf("got %s, expected cached_only held", level)
+	}
+	if level := observe(61*time.Second, 0); level != LevelFull {
+		t.Fatalf("got %s after the hold, expected full", level)
+	}
+	// Calling for the level again restarts the hold
+	observe(62*time.Second, 1)
+	observe(63*time.Second, 0)
+	observe(64*time.Second, 1)
+	if level := observe(65*time.Second, 0); level != LevelShedLow {
+		t.Errorf("got %s, expected shed_low held", level)
+	}
+}
+
+func TestDegradationOverride(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "100 req/min"}})
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+		return w
+	}
+	override := func(method, body string) (int, degradationStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/admin/degradation", strings.NewReader(body)))
+		var status degradationStatus
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, status
+	}
+
+	for _, body := range []string{`{"level": "down"}`, `{"level": "static", "minutes": -1}`, `{"level": "static", "minutes": 20000}`} {
+		if code, _ := override(http.MethodPut, body); code != http.StatusBadRequest {
+			t.Errorf("setting %s got %d, expected 400", body, code)
+		}
+	}
+
+	code, status := override(http.MethodPut, `{"level": "cached_only", "minutes": 10, "reason": "incident"}`)
+	if code != http.StatusOK || status.Level != LevelCachedOnly || status.Automatic != LevelFull || status.Override == nil || status.Override.Until.IsZero() {
+		t.Fatalf("got %d %+v, expected cached_only held for 10 minutes", code, status)
+	}
+	if w := request(); w.Code != http.StatusServiceUnavailable || w.Header().Get(degradationLevelHeader) != LevelCachedOnly {
+		t.Errorf("got %d at %q, expected an uncached request refused", w.Code, w.Header().Get(degradationLevelHeader))
+	}
+
+	if code, status := override(http.MethodDelete, ""); code != http.StatusOK || status.Level != LevelFull || status.Override != nil {
+		t.Fatalf("got %d %+v, expected the level back to full", code, status)
+	}
+	if w := request(); w.Code != http.StatusOK || w.Header().Get(degradationLevelHeader) != "" {
+		t.Errorf("got %d at %q, expected the request served in full", w.Code, w.Header().Get(degradationLevelHeader))
+	}
+
+	// An expired override hands the level back to the fleet
+	d := newDegradation()
+	d.setOverride(&degradationOverride{Level: LevelStatic, Until: time.Now().Add(time.Minute)})
+	d.apply(time.Now())
+	if _, to, _ := d.apply(time.Now().Add(2 * time.Minute)); to != 0 || d.status().Override != nil {
+		t.Errorf("got level %d, expected the expired override dropped", to)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+)
+
+// devDecisionHeader carries the routing decision of every response in
+// developer mode
+const devDecisionHeader = "X-LB-Decision"
+
+// devDecision struct represents what the balancer did with a request and
+// why, as sent to clients in developer mode
+type devDecision struct {
+	Route        string `json:"route"`
+	Decision     string `json:"decision,omitempty"`
+	Node         string `json:"node,omitempty"`
+	RejectReason string `json:"reject_reason,omitempty"`
+	Client       string `json:"client,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+	// Steps are the attempts of the request, as debug logging has them
+	Steps []string `json:"steps,omitempty"`
+	// Selection is how node selection saw the request before its first attempt
+	Selection *balancer.Decision `json:"selection,omitempty"`
+	// Trace is the execution trace of fan-out and pipeline requests
+	Trace           *executionTrace `json:"trace,omitempty"`
+	UpstreamSeconds float64         `json:"upstream_seconds"`
+}
+
+// devMode adds the devDecisionHeader header to responses when
+// Config.DevMode is on. It must run inside withRoutingInfo.
+func (s *Server) devMode(next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.DevMode {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		routingInfoFrom(r).dev = true
+		next(&devWriter{ResponseWriter: w, r: r}, r)
+	}
+}
+
+// explain records how node selection sees target for developer mode, and is
+// a no-op for requests outside it
+func (s *Server) explain(r *http.Request, target balancer.Request) {
+	info := routingInfoFrom(r)
+	if !info.dev || info.selection != nil {
+		return
+	}
+	decision, err := s.lb.Explain(r.Context(), target)
+	if err != nil {
+		log.Printf("explaining selection: %v", err)
+		return
+	}
+	info.selection = &decision
+}
+
+// devWriter sets the devDecisionHeader header from the routing info just
+// before the response headers are sent
+type devWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	written bool
+}
+
+func (dw *devWriter) WriteHeader(status int) {
+	if !dw.written && status >= 200 {
+		dw.written = true
+		info := routingInfoFrom(dw.r)
+		data, err := json.Marshal(devDecision{
+			Route:           info.Route,
+			Decision:        info.Decision,
+			Node:            info.Node,
+			RejectReason:    info.RejectReason,
+			Client:          info.Client,
+			Tenant:          info.Tenant,
+			Steps:           info.steps,
+			Selection:       info.selection,
+			Trace:           info.Trace,
+			UpstreamSeconds: info.Upstream.Seconds(),
+		})
+		if err == nil {
+			dw.Header().Set(devDecisionHeader, string(data))
+		}
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *devWriter) Write(b []byte) (int, error) {
+	if !dw.written {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(b)
+}
+
+func (dw *devWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
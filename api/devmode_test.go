@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestDevMode(t *testing.T) {
+	backend := newBackend(t, "ok", http.StatusOK)
+	full := store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}
+	tests := []struct {
+		name     string
+		records  []store.Record
+		status   int
+		decision string
+		node     string
+		reason   string
+	}{
+		{name: "proxied", status: http.StatusOK, decision: "proxied", node: "node-1"},
+		{name: "rate limited", records: []store.Record{full}, status: http.StatusTooManyRequests, decision: "rate_limited", reason: balancer.RejectNodeRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestServer(t, Config{DevMode: true}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "1 req/min"}}, tt.records...)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			var decision devDecision
+			if err := json.Unmarshal([]byte(w.Header().Get(devDecisionHeader)), &decision); err != nil {
+				t.Fatal(err)
+			}
+			if decision.Route != "/request" || decision.Decision != tt.decision || decision.Node != tt.node || decision.RejectReason != tt.reason {
+				t.Errorf("got %+v, expected %s on %q rejected for %q", decision, tt.decision, tt.node, tt.reason)
+			}
+			if decision.Selection == nil || len(decision.Selection.Nodes) != 1 {
+				t.Fatalf("got selection %+v, expected node-1 described", decision.Selection)
+			}
+			if available := slices.Contains(decision.Selection.Available, "node-1"); available != (tt.records == nil) {
+				t.Errorf("got available nodes %v, expected node-1 only while it has room", decision.Selection.Available)
+			}
+		})
+	}
+
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "1 req/min"}})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+	if got := w.Header().Get(devDecisionHeader); got != "" {
+		t.Errorf("got %s outside developer mode", got)
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/template"
+)
+
+// Conditions the balancer answers with an error of its own, each with a
+// response that can be replaced through ErrorPages
+const (
+	// ConditionRateLimited means every node that could serve the request is
+	// at its limits (429)
+	ConditionRateLimited = "rate_limited"
+	// ConditionUnavailable means no node is healthy or reachable (503)
+	ConditionUnavailable = "unavailable"
+	// ConditionUnreachable means the selected node could not be reached or
+	// answered with a gateway error (502)
+	ConditionUnreachable = "unreachable"
+	// ConditionTimeout means the request ran out of time (504)
+	ConditionTimeout = "timeout"
+	// ConditionStoreUnavailable means the rate limit state could not be read (500)
+	ConditionStoreUnavailable = "store_unavailable"
+	// ConditionResponseTooLarge means the node's response exceeds the route's
+	// size limit (502)
+	ConditionResponseTooLarge = "response_too_large"
+	// ConditionDegraded means the degradation level refuses the request,
+	// the fallback served instead of the nodes' response (503)
+	ConditionDegraded = "degraded"
+)
+
+var conditions = []string{ConditionRateLimited, ConditionUnavailable, ConditionUnreachable, ConditionTimeout, ConditionStoreUnavailable, ConditionResponseTooLarge, ConditionDegraded}
+
+// ErrorPage struct represents a custom error response. Body is a Go template
+// over errorPageData, e.g.
+//
+//	{"error": "{{.Condition}}", "reason": "{{.Reason}}", "retry_after": {{.RetryAfter}}}
+type ErrorPage struct {
+	// ContentType defaults to application/json
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+
+	template *template.Template
+}
+
+// errorPageData struct represents what an error page template can show
+type errorPageData struct {
+	Condition string
+	Status    int
+	Message   string
+	// Reason is the reject reason, if the request was rejected
+	Reason string
+	Route  string
+	Node   string
+	// RetryAfter is the Retry-After value in seconds, zero when unset
+	RetryAfter int
+}
+
+// LoadErrorPages reads a JSON object mapping conditions to their error pages, e.g.
+//
+//	{"rate_limited": {"body": "{\"error\": \"slow down\", \"retry_after\": {{.RetryAfter}}}"},
+//	 "unavailable": {"content_type": "text/html", "body": "<h1>Back soon</h1>"}}
+func LoadErrorPages(path string) (map[string]*ErrorPage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pages map[string]*ErrorPage
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return nil, err
+	}
+	for condition, page := range pages {
+		known := false
+		for _, c := range conditions {
+			known = known || c == condition
+		}
+		if !known {
+			return nil, fmt.Errorf("error page %s: unknown condition, expected one of %v", condition, conditions)
+		}
+		if page == nil {
+			return nil, fmt.Errorf("error page %s: missing body", condition)
+		}
+		if page.template, err = template.New(condition).Parse(page.Body); err != nil {
+			return nil, fmt.Errorf("error page %s: %w", condition, err)
+		}
+		if page.ContentType == "" {
+			page.ContentType = "application/json"
+		}
+	}
+	return pages, nil
+}
+
+// writeError answers with status and the error page of condition, or with
+// message as plain text when the condition has none. Decision and reject
+// reason headers are expected to be set already.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, condition string, status int, message string) {
+	info := routingInfoFrom(r)
+	page, ok := s.config.ErrorPages[condition]
+	if !ok {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := errorPageData{Condition: condition, Status: status, Message: message, Reason: info.RejectReason, Route: info.Route, Node: info.Node}
+	fmt.Sscan(w.Header().Get("Retry-After"), &data.RetryAfter)
+	var body bytes.Buffer
+	if err := page.template.Execute(&body, data); err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", page.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
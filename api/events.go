@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/calendar"
+)
+
+// handleEvents lists the calendar events and the traffic plan applying now
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Plan   calendar.Plan    `json:"plan"`
+		Events []calendar.Event `json:"events"`
+	}{Plan: calendar.Plan{Events: []string{}}, Events: []calendar.Event{}}
+	if s.config.Calendar != nil {
+		response.Plan = s.config.Calendar.Plan(time.Now())
+		response.Events = s.config.Calendar.Events()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+)
+
+// explainRequest struct represents the synthetic request POST /admin/explain
+// dry-runs node selection for
+type explainRequest struct {
+	// Method defaults to POST
+	Method string `json:"method"`
+	// Route is the route the request is served by, /request by default
+	Route string `json:"route"`
+	// Path is the request path routing rules see, the route by default
+	Path string `json:"path"`
+	// Operation overrides the operation limits are looked up by, such as
+	// the full method name of a gRPC call; "<method> <route>" by default
+	Operation string            `json:"operation"`
+	Headers   map[string]string `json:"headers"`
+	// Tenant is the tenant the request's API key belongs to, if any
+	Tenant string `json:"tenant"`
+	// Node pins the request to a node, as X-Debug-Target-Node does
+	Node string `json:"node"`
+	// Exclude lists nodes left out, like the ones a retried request failed on
+	Exclude []string `json:"exclude"`
+}
+
+// explainResponse struct represents the decision trace of a dry run
+type explainResponse struct {
+	Route       string `json:"route"`
+	Operation   string `json:"operation"`
+	Group       string `json:"group,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	AffinityKey string `json:"affinity_key,omitempty"`
+	// Selection lists every node with why it could not take the request,
+	// its windows cut to the request's share, and the node picked
+	Selection balancer.Decision `json:"selection"`
+	// RejectReason is why the request would be refused when no node is picked
+	RejectReason string `json:"reject_reason,omitempty"`
+}
+
+// handleExplain runs node selection for the synthetic request in the body
+// the way a proxied request goes through it, routing rules and route
+// groups included, and reports the decision trace without forwarding or
+// accounting anything
+func (s *Server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	var req explainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodPost
+	}
+	if req.Route == "" {
+		req.Route = "/request"
+	}
+	if req.Path == "" {
+		req.Path = req.Route
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+	if req.Operation == "" {
+		req.Operation = req.Method + " " + req.Route
+	}
+	if req.Node != "" {
+		if _, ok := s.lb.Node(req.Node); !ok {
+			http.Error(w, "Unknown node "+req.Node+".", http.StatusNotFound)
+			return
+		}
+	}
+
+	info := &routingInfo{Route: req.Route, Tenant: req.Tenant, Pinned: req.Node}
+	synthetic, err := http.NewRequestWithContext(context.WithValue(r.Context(), routingInfoKey{}, info), req.Method, req.Path, http.NoBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for name, value := range req.Headers {
+		synthetic.Header.Set(name, value)
+	}
+	target := s.balancerRequest(synthetic, req.Operation)
+	target.Exclude = append(target.Exclude, req.Exclude...)
+
+	decision, err := s.lb.DryRun(r.Context(), target)
+	if err != nil {
+		log.Printf("explaining selection: %v", err)
+		http.Error(w, "Rate limit state is unavailable.", http.StatusInternalServerError)
+		return
+	}
+	explained := explainResponse{
+		Route:       req.Route,
+		Operation:   target.Operation,
+		Group:       target.Group,
+		Priority:    target.Priority,
+		Tenant:      target.Tenant,
+		Zone:        target.Zone,
+		AffinityKey: target.AffinityKey,
+		Selection:   decision,
+	}
+	if decision.Selected == "" {
+		explained.RejectReason = s.lb.RejectReason(r.Context(), target)
+	}
+	writeJSON(w, http.StatusOK, explained)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestExplain(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "1 req/min"},
+		{NodeID: "node-2", Limits: "100 req/min"},
+		{NodeID: "node-3", Limits: "100 req/min"},
+	}, store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)})
+	explain := func(body string) (int, explainResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/explain", strings.NewReader(body)))
+		var explained explainResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &explained); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, explained
+	}
+	reasons := func(decision balancer.Decision) map[string][]string {
+		byNode := map[string][]string{}
+		for _, nd := range decision.Nodes {
+			byNode[nd.NodeID] = nd.Reasons
+		}
+		return byNode
+	}
+
+	code, explained := explain(`{"exclude": ["node-3"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("got %d, expected 200", code)
+	}
+	if explained.Route != "/request" || explained.Operation != "POST /request" {
+		t.Errorf("explained %s %s, expected the defaults POST /request", explained.Route, explained.Operation)
+	}
+	byNode := reasons(explained.Selection)
+	if !slices.Equal(byNode["node-1"], []string{balancer.RejectNodeRequests}) || byNode["node-2"] != nil || !slices.Equal(byNode["node-3"], []string{"excluded"}) {
+		t.Errorf("got reasons %v, expected node-1 full and node-3 excluded", byNode)
+	}
+	if explained.Selection.Selected != "node-2" || explained.Selection.SelectedBy != "random" {
+		t.Errorf("selected %q by %q, expected node-2 at random", explained.Selection.Selected, explained.Selection.SelectedBy)
+	}
+
+	// Pinned requests name their node even when it is full
+	if _, explained := explain(`{"node": "node-1"}`); explained.Selection.Selected != "node-1" || explained.Selection.SelectedBy != "pinned" {
+		t.Errorf("selected %q by %q, expected the pinned node-1", explained.Selection.Selected, explained.Selection.SelectedBy)
+	}
+	if _, explained := explain(`{"exclude": ["node-2", "node-3"]}`); explained.Selection.Selected != "" || explained.RejectReason != balancer.RejectNodeRequests {
+		t.Errorf("selected %q, rejected for %q, expected no node for node_requests", explained.Selection.Selected, explained.RejectReason)
+	}
+
+	for body, status := range map[string]int{
+		`{"node": "node-9"}`:   http.StatusNotFound,
+		`{"path": "request"}`:  http.StatusBadRequest,
+		`{"exclude": "node-1"`: http.StatusBadRequest,
+	} {
+		if code, _ := explain(body); code != status {
+			t.Errorf("%s got %d, expected %d", body, code, status)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+)
+
+// Merge policies of fan-out routes
+const (
+	// MergeCollect answers with every node's response, see fanOutResult
+	MergeCollect = "collect"
+	// MergeConcat concatenates the JSON arrays the nodes answer with, or the
+	// arrays under Field when it is set
+	MergeConcat = "concat"
+	// MergeObject merges the JSON objects the nodes answer with, key by key,
+	// in node ID order so later nodes win
+	MergeObject = "merge"
+	// MergeFirst answers with the first successful response and cancels the rest
+	MergeFirst = "first"
+)
+
+// FanOut struct represents a route that sends each request to several nodes
+// in parallel and merges their answers. Every node is accounted like a
+// request of its own, so nodes at their limits are left out.
+type FanOut struct {
+	// Group restricts the fan-out to the nodes of one group
+	Group string `json:"group,omitempty"`
+	// MaxNodes caps how many nodes are asked; zero asks every available node
+	MaxNodes int `json:"max_nodes,omitempty"`
+	// Merge is collect, concat, merge or first; collect by default
+	Merge string `json:"merge,omitempty"`
+	// Field names the array merged by concat within object responses
+	Field string `json:"field,omitempty"`
+	// MinSuccesses is how many nodes must answer with 2xx for the request to
+	// succeed, one by default
+	MinSuccesses int `json:"min_successes,omitempty"`
+	// Timeout bounds each node's answer, as a Go duration
+	Timeout string `json:"timeout,omitempty"`
+	// Methods are the HTTP methods of the route, POST by default
+	Methods []string `json:"methods,omitempty"`
+
+	timeout time.Duration
+}
+
+// compile checks the settings and fills in the defaults
+func (f *FanOut) compile() error {
+	switch f.Merge {
+	case "":
+		f.Merge = MergeCollect
+	case MergeCollect, MergeConcat, MergeObject, MergeFirst:
+	default:
+		return fmt.Errorf("fan_out: unknown merge policy %q, expected collect, concat, merge or first", f.Merge)
+	}
+	if f.MinSuccesses <= 0 {
+		f.MinSuccesses = 1
+	}
+	if f.MaxNodes < 0 {
+		return errors.New("fan_out: max_nodes must not be negative")
+	}
+	if f.MaxNodes > 0 && f.MinSuccesses > f.MaxNodes {
+		return fmt.Errorf("fan_out: min_successes %d exceeds max_nodes %d", f.MinSuccesses, f.MaxNodes)
+	}
+	if f.Timeout != "" {
+		d, err := time.ParseDuration(f.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("fan_out: invalid timeout %q", f.Timeout)
+		}
+		f.timeout = d
+	}
+	if len(f.Methods) == 0 {
+		f.Methods = []string{http.MethodPost}
+	}
+	return nil
+}
+
+// fanOutRoutes serves the routes configured with a fan-out by handleFanOut,
+// replacing built-in routes of the same path
+func (s *Server) fanOutRoutes(routes []route) []route {
+	paths := make([]string, 0, len(s.config.Routes))
+	for path, rc := range s.config.Routes {
+		if rc.FanOut != nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		rt := route{path: path, methods: s.config.Routes[path].FanOut.Methods, handler: s.traceExecution(s.handleFanOut)}
+		if i := slices.IndexFunc(routes, func(r route) bool { return r.path == path }); i >= 0 {
+			routes[i] = rt
+		} else {
+			routes = append(routes, rt)
+		}
+	}
+	return routes
+}
+
+// fanOutResult struct represents the answer of one node to a fan-out request
+type fanOutResult struct {
+	Node   string          `json:"node"`
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+
+	latency time.Duration
+}
+
+func (res fanOutResult) succeeded() bool {
+	return res.Status >= 200 && res.Status < 300
+}
+
+// handleFanOut sends the request to the available nodes of the route's
+// fan-out and answers with their merged responses
+func (s *Server) handleFanOut(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	info := routingInfoFrom(r)
+	request, err := decodeRequest(body)
+	if err != nil {
+		info.Decision = "invalid"
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.BPM = s.requestBPM(r, request, body)
+
+	fanOut := s.config.Routes[info.Route].FanOut
+	target := s.balancerRequest(r, r.Method+" "+info.Route)
+	if fanOut.Group != "" {
+		target.Group = fanOut.Group
+	}
+	selecting := time.Now()
+	nodes, err := s.lb.AvailableNodes(r.Context(), target)
+	info.timePhase(phaseSelection, selecting)
+	if err != nil {
+		log.Printf("selecting nodes: %v", err)
+		info.Decision = "error"
+		countRejection(w, r, balancer.RejectStore)
+		s.writeError(w, r, ConditionStoreUnavailable, http.StatusInternalServerError, "Rate limit state is unavailable.")
+		return
+	}
+	sort.Strings(nodes)
+
+	// Reserve the nodes up front, so each one is accounted like a request of its own
+	claiming := time.Now()
+	var selected []string
+	for _, nodeID := range nodes {
+		if fanOut.MaxNodes > 0 && len(selected) == fanOut.MaxNodes {
+			break
+		}
+		if node, _ := s.lb.Node(nodeID); node.Address == "" {
+			continue
+		}
+		release, ok := s.lb.AcquireTokens(nodeID, target.Tokens)
+		if !ok {
+			continue
+		}
+		defer release()
+		if err := s.lb.ReserveRequest(r.Context(), nodeID, target.Operation, request.BPM); errors.Is(err, balancer.ErrOverLimit) {
+			release()
+			continue
+		} else if err != nil {
+			log.Printf("recording request for node %s: %v", nodeID, err)
+		}
+		selected = append(selected, nodeID)
+	}
+	info.timePhase(phaseLimits, claiming)
+	if len(selected) < fanOut.MinSuccesses {
+		s.rejectNoNode(w, r, target)
+		return
+	}
+
+	started := time.Now()
+	results := s.fanOut(r, body, fanOut, selected)
+	info.Upstream = time.Since(started)
+
+	succeeded := []string{}
+	for _, res := range results {
+		if res.succeeded() {
+			succeeded = append(succeeded, res.Node)
+		}
+	}
+	info.Node = strings.Join(selected, ",")
+	if s.servedBy(info.Route) {
+		w.Header().Set(servedByHeader, strings.Join(succeeded, ","))
+	}
+	if len(succeeded) < fanOut.MinSuccesses {
+		info.Decision = "unreachable"
+		writeJSON(w, http.StatusBadGateway, map[string]any{"error": fmt.Sprintf("%d of %d nodes answered successfully, %d required", len(succeeded), len(selected), fanOut.MinSuccesses), "responses": results})
+		return
+	}
+
+	merged, err := mergeResponses(fanOut, results)
+	if err != nil {
+		info.Decision = "unmergeable"
+		writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error(), "responses": results})
+		return
+	}
+	if max := s.maxResponseBytes(info.Route); max > 0 && int64(len(merged)) > max {
+		info.Decision = "response_too_large"
+		s.writeError(w, r, ConditionResponseTooLarge, http.StatusBadGateway, fmt.Sprintf("The merged response exceeds %d bytes.", max))
+		return
+	}
+	info.Proxied = true
+	info.Decision = "fanned_out"
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(merged)
+	for _, nodeID := range succeeded {
+		s.exportUsage(r, nodeID, target.Operation, request.BPM, http.StatusOK)
+	}
+}
+
+// fanOut forwards the request to every node in parallel and returns their
+// results in node order. With the first merge policy the remaining requests
+// are cancelled once a node answered successfully.
+func (s *Server) fanOut(r *http.Request, body []byte, fanOut *FanOut, nodeIDs []string) []fanOutResult {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	chain := s.config.Routes[routingInfoFrom(r).Route].chain()
+	max := s.maxResponseBytes(routingInfoFrom(r).Route)
+
+	results := make([]fanOutResult, len(nodeIDs))
+	var wg sync.WaitGroup
+	for i, nodeID := range nodeIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodeCtx := ctx
+			if fanOut.timeout > 0 {
+				var nodeCancel context.CancelFunc
+				nodeCtx, nodeCancel = context.WithTimeout(ctx, fanOut.timeout)
+				defer nodeCancel()
+			}
+
+			node, _ := s.lb.Node(nodeID)
+			res := fanOutResult{Node: nodeID}
+			started := time.Now()
+			resp, err := s.proxy.Forward(nodeID, node.Pool, node.Address, r.WithContext(nodeCtx), body, chain)
+			if err == nil {
+				var data []byte
+				data, err = proxy.ReadLimited(resp.Body, max)
+				resp.Body.Close()
+				res.Status = resp.StatusCode
+				s.observeBackpressure(nodeID, resp, time.Since(started))
+				if json.Valid(data) {
+					res.Body = data
+				} else if len(data) > 0 {
+					res.Body, _ = json.Marshal(string(data))
+				}
+			}
+			res.latency = time.Since(started)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			step := traceStep{Node: nodeID, Status: res.Status, Latency: milliseconds(res.latency), Outcome: "succeeded", Error: res.Error}
+			if !res.succeeded() {
+				step.Outcome = "failed"
+			}
+			routingInfoFrom(r).Trace.add(step)
+			if ctx.Err() == nil {
+				// Requests cancelled by the first policy say nothing about the node
+				s.lb.ObserveResponse(nodeID, res.latency, res.Status == 0 || res.Status >= 500)
+			}
+			results[i] = res
+			if fanOut.Merge == MergeFirst && res.succeeded() {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// mergeResponses combines the successful results according to the merge policy
+func mergeResponses(fanOut *FanOut, results []fanOutResult) ([]byte, error) {
+	switch fanOut.Merge {
+	case MergeFirst:
+		// The fastest success, not the first in node order
+		var first *fanOutResult
+		for i, res := range results {
+			if res.succeeded() && (first == nil || res.latency < first.latency) {
+				first = &results[i]
+			}
+		}
+		return first.Body, nil
+	case MergeConcat:
+		items := []json.RawMessage{}
+		for _, res := range results {
+			if !res.succeeded() {
+				continue
+			}
+			data := res.Body
+			if fanOut.Field != "" {
+				var object map[string]json.RawMessage
+				if err := json.Unmarshal(res.Body, &object); err != nil {
+					return nil, fmt.Errorf("node %s: expected a JSON object: %w", res.Node, err)
+				}
+				data = object[fanOut.Field]
+				if data == nil {
+					continue
+				}
+			}
+			var nodeItems []json.RawMessage
+			if err := json.Unmarshal(data, &nodeItems); err != nil {
+				return nil, fmt.Errorf("node %s: expected a JSON array: %w", res.Node, err)
+			}
+			items = append(items, nodeItems...)
+		}
+		if fanOut.Field != "" {
+			return json.Marshal(map[string]any{fanOut.Field: items})
+		}
+		return json.Marshal(items)
+	case MergeObject:
+		merged := map[string]json.RawMessage{}
+		for _, res := range results {
+			if !res.succeeded() {
+				continue
+			}
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(res.Body, &object); err != nil {
+				return nil, fmt.Errorf("node %s: expected a JSON object: %w", res.Node, err)
+			}
+			for key, value := range object {
+				merged[key] = value
+			}
+		}
+		return json.Marshal(merged)
+	}
+	return json.Marshal(map[string]any{"responses": results})
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestMergeResponses(t *testing.T) {
+	results := []fanOutResult{
+		{Node: "a", Status: 200, Body: json.RawMessage(`{"items": [1, 2], "from": "a"}`), latency: 30 * time.Millisecond},
+		{Node: "b", Status: 200, Body: json.RawMessage(`{"items": [3], "from": "b"}`), latency: 10 * time.Millisecond},
+		{Node: "c", Status: 500, Body: json.RawMessage(`{"items": [4]}`), latency: time.Millisecond},
+	}
+	tests := []struct {
+		fanOut   FanOut
+		expected string
+	}{
+		{FanOut{Merge: MergeFirst}, `{"items": [3], "from": "b"}`},
+		{FanOut{Merge: MergeConcat, Field: "items"}, `{"items":[1,2,3]}`},
+		{FanOut{Merge: MergeObject}, `{"from":"b","items":[3]}`},
+	}
+	for _, tt := range tests {
+		got, err := mergeResponses(&tt.fanOut, results)
+		if err != nil || string(got) != tt.expected {
+			t.Errorf("%s: got %s, %v, expected %s", tt.fanOut.Merge, got, err, tt.expected)
+		}
+	}
+	if _, err := mergeResponses(&FanOut{Merge: MergeConcat}, results); err == nil {
+		t.Error("concat merged objects without a field")
+	}
+}
+
+func TestFanOutConfig(t *testing.T) {
+	for _, fanOut := range []string{
+		`{"merge": "sum"}`,
+		`{"max_nodes": -1}`,
+		`{"max_nodes": 1, "min_successes": 2}`,
+		`{"timeout": "soon"}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		if err := os.WriteFile(path, []byte(`{"/search": {"fan_out": `+fanOut+`}}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRouteConfig(path); err == nil {
+			t.Errorf("%s was accepted", fanOut)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	items := func(name string, status int) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(status)
+			io.WriteString(w, `["`+name+`"]`)
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+	nodes := []store.NodeLimits{
+		{NodeID: "node-1", Address: items("node-1", http.StatusOK).URL, Limits: "100 req/min"},
+		{NodeID: "node-2", Address: items("node-2", http.StatusOK).URL, Limits: "100 req/min"},
+		{NodeID: "node-3", Address: items("node-3", http.StatusInternalServerError).URL, Limits: "100 req/min"},
+		{NodeID: "node-4", Address: items("node-4", http.StatusOK).URL, Limits: "1 req/min"},
+		{NodeID: "node-5", Limits: "100 req/min"},
+	}
+	tests := []struct {
+		name     string
+		fanOut   string
+		status   int
+		expected string
+	}{
+		// node-4 is full and node-5 is simulated, so neither is asked
+		{name: "concat", fanOut: `{"merge": "concat"}`, status: http.StatusOK, expected: `["node-1","node-2"]`},
+		{name: "max nodes", fanOut: `{"merge": "concat", "max_nodes": 1}`, status: http.StatusOK, expected: `["node-1"]`},
+		{name: "too few successes", fanOut: `{"merge": "concat", "min_successes": 3}`, status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Routes: loadRoutes(t, `{"/search": {"fan_out": `+tt.fanOut+`}}`)}
+			handler, _ := newTestServer(t, config, nodes, store.Record{NodeID: "node-4", Operation: "POST /search", Timestamp: time.Now().Add(-time.Second)})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.expected != "" && w.Body.String() != tt.expected {
+				t.Errorf("got %s, expected %s", w.Body.String(), tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// faultHeader marks the responses of requests a fault was injected into
+const faultHeader = "X-Fault-Injected"
+
+// faultRule struct represents faults injected into the requests of a route,
+// or of any route when Route is empty. Rules without a Node apply before a
+// node is selected, toward the client: the response is delayed, answered
+// with AbortStatus or its connection dropped. Rules with a Node apply to the
+// requests sent to that node, as if it was slow, answered AbortStatus or
+// dropped the connection, so retries and hedging kick in.
+type faultRule struct {
+	ID    string `json:"id"`
+	Route string `json:"route,omitempty"`
+	Node  string `json:"node,omitempty"`
+	// DelayProbability of the requests wait Delay, a Go duration, first
+	DelayProbability float64 `json:"delay_probability,omitempty"`
+	Delay            string  `json:"delay,omitempty"`
+	// AbortProbability of the requests are answered AbortStatus (503)
+	AbortProbability float64 `json:"abort_probability,omitempty"`
+	AbortStatus      int     `json:"abort_status,omitempty"`
+	// DropProbability of the requests have their connection dropped
+	DropProbability float64 `json:"drop_probability,omitempty"`
+	// Until is when the rule ends, zero when it holds until deleted
+	Until time.Time `json:"until,omitzero"`
+
+	delay time.Duration
+}
+
+// validate checks the probabilities and parses Delay
+func (f *faultRule) validate() error {
+	for name, p := range map[string]float64{"delay_probability": f.DelayProbability, "abort_probability": f.AbortProbability, "drop_probability": f.DropProbability} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+	if f.DelayProbability > 0 {
+		var err error
+		if f.delay, err = time.ParseDuration(f.Delay); err != nil || f.delay <= 0 {
+			return fmt.Errorf("delay must be a positive duration such as 500ms")
+		}
+	}
+	if f.AbortStatus == 0 {
+		f.AbortStatus = http.StatusServiceUnavailable
+	}
+	if f.AbortStatus < 400 || f.AbortStatus > 599 {
+		return fmt.Errorf("abort_status must be an error status")
+	}
+	return nil
+}
+
+// roll returns whether to delay a request and the fault to inject into it
+// then, abort, drop or "" for none
+func (f *faultRule) roll() (delay bool, fault string) {
+	delay = rand.Float64() < f.DelayProbability
+	switch {
+	case rand.Float64() < f.DropProbability:
+		fault = "drop"
+	case rand.Float64() < f.AbortProbability:
+		fault = "abort"
+	}
+	return delay, fault
+}
+
+// faultSet holds the fault rules set through the admin API
+type faultSet struct {
+	mu    sync.Mutex
+	rules map[string]faultRule
+}
+
+func (fs *faultSet) set(rule faultRule) {
+	fs.mu.Lock()
+	if fs.rules == nil {
+		fs.rules = map[string]faultRule{}
+	}
+	fs.rules[rule.ID] = rule
+	fs.mu.Unlock()
+}
+
+func (fs *faultSet) remove(id string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.rules[id]; !ok {
+		return false
+	}
+	delete(fs.rules, id)
+	return true
+}
+
+// list returns the rules that have not expired, dropping the others
+func (fs *faultSet) list(now time.Time) []faultRule {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	rules := []faultRule{}
+	for id, rule := range fs.rules {
+		if !rule.Until.IsZero() && !now.Before(rule.Until) {
+			delete(fs.rules, id)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// match returns the first rule, by ID, for requests of route sent to node,
+// or before selection when node is empty
+func (fs *faultSet) match(route, node string, now time.Time) (faultRule, bool) {
+	for _, rule := range fs.list(now) {
+		if rule.Node == node && (rule.Route == "" || rule.Route == route) {
+			return rule, true
+		}
+	}
+	return faultRule{}, false
+}
+
+// injectFaults injects the faults of the rules without a node into the
+// requests of route, before they reach node selection
+func (s *Server) injectFaults(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.FaultInjection {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := s.faults.match(route, "", time.Now())
+		if !ok {
+			next(w, r)
+			return
+		}
+		delay, fault := rule.roll()
+		if delay {
+			metrics.FaultsInjected.WithLabelValues(route, "", "delay").Inc()
+			w.Header().Add(faultHeader, "delay")
+			wait(r, rule.delay)
+		}
+		switch fault {
+		case "drop":
+			metrics.FaultsInjected.WithLabelValues(route, "", "drop").Inc()
+			routingInfoFrom(r).Decision = "fault_injected"
+			// Aborts the response and closes the connection, or resets the
+			// stream of HTTP/2 clients
+			panic(http.ErrAbortHandler)
+		case "abort":
+			metrics.FaultsInjected.WithLabelValues(route, "", "abort").Inc()
+			routingInfoFrom(r).Decision = "fault_injected"
+			w.Header().Add(faultHeader, "abort")
+			http.Error(w, fmt.Sprintf("Fault injected by rule %s.", rule.ID), rule.AbortStatus)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// wait waits d, reporting false if the request ended first
+func wait(r *http.Request, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// nodeFault injects the faults of the rules for nodeID into a request of
+// route sent to it. It returns whether one answered in place of the node,
+// and that answer, nil for a dropped connection.
+func (s *Server) nodeFault(r *http.Request, route, nodeID string) (bool, *http.Response) {
+	if !s.config.FaultInjection {
+		return false, nil
+	}
+	rule, ok := s.faults.match(route, nodeID, time.Now())
+	if !ok {
+		return false, nil
+	}
+	delay, fault := rule.roll()
+	if delay {
+		metrics.FaultsInjected.WithLabelValues(route, nodeID, "delay").Inc()
+		if !wait(r, rule.delay) {
+			return true, nil
+		}
+	}
+	switch fault {
+	case "drop":
+		metrics.FaultsInjected.WithLabelValues(route, nodeID, "drop").Inc()
+		log.Printf("node %s is unreachable: fault injected by rule %s", nodeID, rule.ID)
+		return true, nil
+	case "abort":
+		metrics.FaultsInjected.WithLabelValues(route, nodeID, "abort").Inc()
+		message := fmt.Sprintf("Fault injected by rule %s.\n", rule.ID)
+		return true, &http.Response{
+			StatusCode:    rule.AbortStatus,
+			Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}, faultHeader: {"abort"}},
+			Body:          io.NopCloser(strings.NewReader(message)),
+			ContentLength: int64(len(message)),
+		}
+	}
+	return false, nil
+}
+
+// handleFaults lists the fault rules
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if !s.config.FaultInjection {
+		http.Error(w, "Fault injection is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.faults.list(time.Now()))
+}
+
+// handleFault sets a fault rule, for the minutes of the body or until it is
+// deleted, or deletes it
+func (s *Server) handleFault(w http.ResponseWriter, r *http.Request) {
+	if !s.config.FaultInjection {
+		http.Error(w, "Fault injection is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if r.Method == http.MethodDelete {
+		if !s.faults.remove(id) {
+			http.Error(w, fmt.Sprintf("Unknown fault rule %s", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("deleted fault rule %s", id)
+		s.handleFaults(w, r)
+		return
+	}
+
+	var body struct {
+		faultRule
+		Minutes float64 `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule := body.faultRule
+	rule.ID = id
+	if err := rule.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Minutes < 0 {
+		http.Error(w, "minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+	rule.Until = time.Time{}
+	if body.Minutes > 0 {
+		rule.Until = time.Now().Add(time.Duration(body.Minutes * float64(time.Minute)))
+	}
+	if rule.Node != "" {
+		if _, ok := s.lb.Node(rule.Node); !ok {
+			http.Error(w, fmt.Sprintf("Unknown node %s", rule.Node), http.StatusNotFound)
+			return
+		}
+	}
+	s.faults.set(rule)
+	log.Printf("set fault rule %s: route %q, node %q, delay %s at %g, abort %d at %g, drop at %g", id, rule.Route, rule.Node, rule.delay, rule.DelayProbability, rule.AbortStatus, rule.AbortProbability, rule.DropProbability)
+	s.handleFaults(w, r)
+}
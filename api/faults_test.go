@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestFaultRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    faultRule
+		wantErr bool
+	}{
+		{name: "abort", rule: faultRule{AbortProbability: 1}},
+		{name: "delay", rule: faultRule{DelayProbability: 0.5, Delay: "200ms"}},
+		{name: "probability above 1", rule: faultRule{DropProbability: 1.5}, wantErr: true},
+		{name: "negative probability", rule: faultRule{AbortProbability: -0.1}, wantErr: true},
+		{name: "delay without a duration", rule: faultRule{DelayProbability: 1}, wantErr: true},
+		{name: "negative delay", rule: faultRule{DelayProbability: 1, Delay: "-1s"}, wantErr: true},
+		{name: "success status", rule: faultRule{AbortProbability: 1, AbortStatus: http.StatusOK}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+			if err == nil && tt.rule.AbortStatus != http.StatusServiceUnavailable {
+				t.Errorf("got abort status %d, expected 503 by default", tt.rule.AbortStatus)
+			}
+		})
+	}
+}
+
+func TestFaultSetExpiry(t *testing.T) {
+	now := time.Now()
+	var fs faultSet
+	fs.set(faultRule{ID: "b", Node: "node-1"})
+	fs.set(faultRule{ID: "a", Route: "/other", Node: "node-1"})
+	fs.set(faultRule{ID: "expired", Until: now})
+	if rule, ok := fs.match("/request", "node-1", now); !ok || rule.ID != "b" {
+		t.Errorf("got %+v, %v, expected rule b", rule, ok)
+	}
+	if _, ok := fs.match("/request", "", now); ok {
+		t.Error("an expired rule matched")
+	}
+	if rules := fs.list(now); len(rules) != 2 || rules[0].ID != "a" {
+		t.Errorf("got rules %+v, expected a and b", rules)
+	}
+}
+
+func TestInjectFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		status int
+		fault  string
+		calls  int
+		slow   bool
+	}{
+		{name: "abort before selection", rule: `{"route": "/request", "abort_probability": 1, "abort_status": 502}`, status: http.StatusBadGateway, fault: "abort"},
+		{name: "other route", rule: `{"route": "/other", "abort_probability": 1}`, status: http.StatusOK, calls: 1},
+		{name: "delay before selection", rule: `{"delay_probability": 1, "delay": "100ms"}`, status: http.StatusOK, fault: "delay", calls: 1, slow: true},
+		{name: "node answers in place", rule: `{"node": "node-1", "abort_probability": 1}`, status: http.StatusServiceUnavailable, fault: "abort"},
+		{name: "node delayed", rule: `{"node": "node-1", "delay_probability": 1, "delay": "100ms"}`, status: http.StatusOK, calls: 1, slow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+			}))
+			defer backend.Close()
+			handler, _ := newTestServer(t, Config{FaultInjection: true}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/faults/chaos", strings.NewReader(tt.rule)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("setting the rule got %d %q", w.Code, w.Body.String())
+			}
+
+			started := time.Now()
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if got := w.Header().Get(faultHeader); got != tt.fault {
+				t.Errorf("got %s %q, expected %q", faultHeader, got, tt.fault)
+			}
+			if got := int(calls.Load()); got != tt.calls {
+				t.Errorf("node got %d calls, expected %d", got, tt.calls)
+			}
+			if slow := time.Since(started) >= 100*time.Millisecond; slow != tt.slow {
+				t.Errorf("answered after %s, expected a delay: %v", time.Since(started), tt.slow)
+			}
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/faults/chaos", nil))
+			if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+				t.Fatalf("deleting the rule got %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFaultAdmin(t *testing.T) {
+	handler, _ := newTestServer(t, Config{FaultInjection: true}, []store.NodeLimits{{NodeID: "node-1", Limits: "100 req/min"}})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "unknown node", method: http.MethodPut, path: "/admin/faults/a", body: `{"node": "node-9", "abort_probability": 1}`, status: http.StatusNotFound},
+		{name: "invalid rule", method: http.MethodPut, path: "/admin/faults/a", body: `{"abort_probability": 2}`, status: http.StatusBadRequest},
+		{name: "negative minutes", method: http.MethodPut, path: "/admin/faults/a", body: `{"abort_probability": 1, "minutes": -1}`, status: http.StatusBadRequest},
+		{name: "unknown rule", method: http.MethodDelete, path: "/admin/faults/a", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+
+	disabled, _ := newTestServer(t, Config{}, nil)
+	w := httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/faults/a", strings.NewReader(`{"abort_probability": 1}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("got %d with fault injection off, expected 501", w.Code)
+	}
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+	"runtime/pprof"
+)
+
+// handleGoroutines dumps the stacks of every goroutine as text, one by one
+// with how long each has been blocked, or grouped by identical stacks with
+// ?grouped=true
+func (s *Server) handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Diagnostics {
+		http.Error(w, "Diagnostics are not enabled.", http.StatusNotImplemented)
+		return
+	}
+	debug := 2
+	if r.URL.Query().Get("grouped") == "true" {
+		debug = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, debug)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// grpcError answers a gRPC call without reaching a backend. gRPC clients read
+// the outcome from the grpc-status trailer, not from the HTTP status.
+func grpcError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// isGRPC matches gRPC calls, whatever their path
+func isGRPC(r *http.Request, _ *mux.RouteMatch) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// gRPC status codes used by the balancer
+const (
+	grpcUnavailable       = 14
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcPermissionDenied  = 7
+)
+
+// handleGRPC proxies a gRPC call to a selected node. The call is accounted
+// once it is over, with the message payload bytes in both directions as its
+// BPM, since the size of a stream is unknown up front.
+func (s *Server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path
+	info := routingInfoFrom(r)
+	target := s.balancerRequest(r, method)
+	selecting := time.Now()
+	selectedNode, err := s.lb.SelectNode(r.Context(), target)
+	info.timePhase(phaseSelection, selecting)
+	if err != nil {
+		log.Printf("selecting node: %v", err)
+		info.Decision = "error"
+		countRejection(w, r, balancer.RejectStore)
+		grpcError(w, grpcInternal, "rate limit state is unavailable")
+		return
+	}
+	if selectedNode == "" {
+		limiting := time.Now()
+		reason := s.lb.RejectReason(r.Context(), target)
+		info.timePhase(phaseLimits, limiting)
+		countRejection(w, r, reason)
+		if reason == balancer.RejectNoNodes {
+			info.Decision = "unavailable"
+			grpcError(w, grpcUnavailable, "no node is available to serve the call")
+			return
+		}
+		info.Decision = "rate_limited"
+		grpcError(w, grpcResourceExhausted, "all nodes are currently at rate limit: "+reason)
+		return
+	}
+	node, _ := s.lb.Node(selectedNode)
+	if node.Address == "" {
+		info.Node, info.Decision = selectedNode, "unreachable"
+		grpcError(w, grpcUnavailable, "node "+selectedNode+" has no address")
+		return
+	}
+
+	release, ok := s.lb.AcquireTokens(selectedNode, target.Tokens)
+	if !ok {
+		// The node's capacity tokens went to other calls since selection,
+		// or the node asked for no more requests
+		reason := balancer.RejectConcurrency
+		if _, throttled := s.lb.Throttled(selectedNode); throttled {
+			reason = balancer.RejectBackpressure
+		}
+		countRejection(w, r, reason)
+		info.Node, info.Decision = selectedNode, "rate_limited"
+		grpcError(w, grpcResourceExhausted, "all nodes are currently at rate limit: "+reason)
+		return
+	}
+	defer release()
+
+	info.Node = selectedNode
+	info.Proxied = true
+	info.Decision = "proxied"
+	started := time.Now()
+	sent, received, err := s.proxy.ForwardGRPC(w, r, node.Address)
+	info.Upstream = time.Since(started)
+	if err != nil {
+		// ForwardGRPC answered the call with UNAVAILABLE already
+		log.Printf("forwarding gRPC call to node %s: %v", selectedNode, err)
+		info.Decision = "unreachable"
+		return
+	}
+
+	metrics.GRPCMessages.WithLabelValues(method, "sent").Add(float64(sent.Messages))
+	metrics.GRPCMessages.WithLabelValues(method, "received").Add(float64(received.Messages))
+	metrics.GRPCMessageBytes.WithLabelValues(method, "sent").Add(float64(sent.Bytes))
+	metrics.GRPCMessageBytes.WithLabelValues(method, "received").Add(float64(received.Bytes))
+
+	bpm := int(sent.Bytes + received.Bytes)
+	limiting := time.Now()
+	if err := s.lb.RecordRequest(context.WithoutCancel(r.Context()), selectedNode, method, bpm); err != nil {
+		log.Printf("recording request for node %s: %v", selectedNode, err)
+	}
+	info.timePhase(phaseLimits, limiting)
+	s.exportUsage(r, selectedNode, method, bpm, http.StatusOK)
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Hedge struct represents the hedging of a route's requests: when the node
+// has not answered within Delay, the request is sent to a second node as
+// well and whichever answers first is used. Both nodes may act on the
+// request, so only routes whose requests are idempotent should hedge.
+type Hedge struct {
+	// Delay is how long the first node has to answer, as a Go duration
+	Delay string `json:"delay"`
+
+	delay time.Duration
+}
+
+// compile checks the settings
+func (h *Hedge) compile() error {
+	d, err := time.ParseDuration(h.Delay)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("hedge: invalid delay %q", h.Delay)
+	}
+	h.delay = d
+	return nil
+}
+
+// hedgeAnswer struct represents how a node answered a hedged request; the
+// node's concurrency slot and request context are held until it is used or
+// discarded
+type hedgeAnswer struct {
+	nodeID  string
+	resp    *http.Response
+	release func()
+	cancel  context.CancelFunc
+}
+
+// discard closes an answer that is not used
+func (a hedgeAnswer) discard() {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+	a.release()
+}
+
+// send forwards the request to a node and tells the balancer how it
+// answered, returning nil if the node could not be reached or did not answer
+// within its timeout. A nil body streams the request's own body. Requests
+// cancelled before the node answered say nothing about it and are not
+// observed.
+func (s *Server) send(r *http.Request, body []byte, nodeID string, node store.NodeLimits, chain proxy.Chain) *http.Response {
+	if injected, resp := s.nodeFault(r, routingInfoFrom(r).Route, nodeID); injected {
+		// Injected faults are not held against the node
+		return resp
+	}
+	forwarded, cancel := r, context.CancelFunc(func() {})
+	if timeout, _ := time.ParseDuration(node.Timeout); timeout > 0 {
+		ctx, cancelTimeout := context.WithTimeout(r.Context(), timeout)
+		forwarded, cancel = r.WithContext(ctx), cancelTimeout
+	}
+	started := time.Now()
+	var resp *http.Response
+	var err error
+	if body == nil {
+		resp, err = s.proxy.ForwardStream(nodeID, node.Pool, node.Address, forwarded, chain)
+	} else {
+		resp, err = s.proxy.Forward(nodeID, node.Pool, node.Address, forwarded, body, chain)
+	}
+	if resp == nil {
+		cancel()
+	} else {
+		resp.Body = cancelOnClose{resp.Body, cancel}
+	}
+	if r.Context().Err() != nil {
+		return resp
+	}
+	if err != nil {
+		log.Printf("node %s is unreachable: %v", nodeID, err)
+	}
+	latency := time.Since(started)
+	s.lb.ObserveResponse(nodeID, latency, resp == nil || resp.StatusCode >= 500)
+	s.observeBackpressure(nodeID, resp, latency)
+	return resp
+}
+
+// hedge sends the request to nodeID and, if it has not answered within
+// delay, to a second node as well. The first answer another node could not
+// do better on is used and the other request is cancelled; when both fail
+// the last failure is used. It returns the node whose answer is used, that
+// answer and the release of the node's concurrency slot, taking over
+// release, the slot of nodeID. The nodes are excluded from target once a
+// second one is asked.
+func (s *Server) hedge(r *http.Request, body []byte, delay time.Duration, nodeID string, release func(), target *balancer.Request, attempts *balancer.Attempts) (string, *http.Response, func()) {
+	chain := s.config.Routes[routingInfoFrom(r).Route].chain()
+	answers := make(chan hedgeAnswer, 2)
+	inflight := map[string]context.CancelFunc{}
+	forward := func(nodeID string, node store.NodeLimits, release func()) {
+		ctx, cancel := context.WithCancel(r.Context())
+		inflight[nodeID] = cancel
+		go func() {
+			resp := s.send(r.WithContext(ctx), body, nodeID, node, chain)
+			answers <- hedgeAnswer{nodeID: nodeID, resp: resp, release: release, cancel: cancel}
+		}()
+	}
+	node, _ := s.lb.Node(nodeID)
+	forward(nodeID, node, release)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedgeNode := ""
+	for {
+		select {
+		case <-timer.C:
+			var ok bool
+			if hedgeNode, ok = s.startHedge(r, nodeID, target, attempts, forward); !ok {
+				metrics.HedgedRequests.WithLabelValues("no_node").Inc()
+			}
+		case answer := <-answers:
+			delete(inflight, answer.nodeID)
+			if retryable(answer.resp) && r.Context().Err() == nil && len(inflight) > 0 {
+				// The other node may still answer
+				answer.discard()
+				continue
+			}
+			for _, cancel := range inflight {
+				cancel()
+			}
+			if pending := len(inflight); pending > 0 {
+				go func() {
+					for range pending {
+						(<-answers).discard()
+					}
+				}()
+			}
+			if hedgeNode != "" {
+				outcome := "lost"
+				if answer.nodeID == hedgeNode {
+					outcome = "won"
+				}
+				metrics.HedgedRequests.WithLabelValues(outcome).Inc()
+			}
+			if answer.resp == nil {
+				answer.cancel()
+			} else {
+				answer.resp.Body = cancelOnClose{answer.resp.Body, answer.cancel}
+			}
+			return answer.nodeID, answer.resp, answer.release
+		}
+	}
+}
+
+// startHedge picks a second node for a request nodeID is slow to answer,
+// claims it like any other attempt and forwards the request to it
+func (s *Server) startHedge(r *http.Request, nodeID string, target *balancer.Request, attempts *balancer.Attempts, forward func(string, store.NodeLimits, func())) (string, bool) {
+	info := routingInfoFrom(r)
+	target.Exclude = append(target.Exclude, nodeID)
+	selecting := time.Now()
+	hedgeNode, err := s.lb.SelectNode(r.Context(), *target)
+	info.timePhase(phaseSelection, selecting)
+	if err != nil {
+		log.Printf("selecting hedge node: %v", err)
+		return "", false
+	}
+	if hedgeNode == "" {
+		return "", false
+	}
+	target.Exclude = append(target.Exclude, hedgeNode)
+	node, _ := s.lb.Node(hedgeNode)
+	if node.Address == "" {
+		// Nodes without an address only simulate forwarding
+		return "", false
+	}
+	slot, ok := s.lb.AcquireTokens(hedgeNode, target.Tokens)
+	if !ok {
+		return "", false
+	}
+	claiming := time.Now()
+	err = attempts.Start(r.Context(), hedgeNode)
+	info.timePhase(phaseLimits, claiming)
+	if errors.Is(err, balancer.ErrOverLimit) {
+		slot()
+		return "", false
+	} else if err != nil {
+		log.Printf("recording request for node %s: %v", hedgeNode, err)
+	}
+	forward(hedgeNode, node, slot)
+	return hedgeNode, true
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestHedge(t *testing.T) {
+	// answer is how a node answers the nth call to any node
+	type answer struct {
+		delay  time.Duration
+		status int
+	}
+	slow := answer{delay: 2 * time.Second, status: http.StatusOK}
+	fast := answer{status: http.StatusOK}
+	tests := []struct {
+		name    string
+		hedge   bool
+		answers []answer
+		status  int
+		calls   int
+		// hedged is whether the response comes from the second call
+		hedged bool
+	}{
+		{name: "first answers in time", hedge: true, answers: []answer{fast, fast}, status: http.StatusOK, calls: 1},
+		{name: "hedge answers first", hedge: true, answers: []answer{slow, fast}, status: http.StatusOK, calls: 2, hedged: true},
+		{name: "first fails after the hedge started", hedge: true, answers: []answer{{delay: 200 * time.Millisecond, status: http.StatusServiceUnavailable}, {delay: 300 * time.Millisecond, status: http.StatusOK}}, status: http.StatusOK, calls: 2, hedged: true},
+		{name: "client errors are final", hedge: true, answers: []answer{{delay: 200 * time.Millisecond, status: http.StatusNotFound}, slow}, status: http.StatusNotFound, calls: 2},
+		{name: "not hedged", answers: []answer{{delay: 200 * time.Millisecond, status: http.StatusOK}, fast}, status: http.StatusOK, calls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := int(calls.Add(1))
+				answer := tt.answers[min(call, len(tt.answers))-1]
+				select {
+				case <-time.After(answer.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(answer.status)
+				fmt.Fprintf(w, "call %d", call)
+			})
+			nodes := []store.NodeLimits{}
+			for _, name := range []string{"node-1", "node-2"} {
+				backend := httptest.NewServer(handler)
+				defer backend.Close()
+				nodes = append(nodes, store.NodeLimits{NodeID: name, Address: backend.URL, Limits: "100 req/min"})
+			}
+			routes := `{"/api/": {}}`
+			if tt.hedge {
+				// Long enough that a cold first call still answers in time
+				routes = `{"/api/": {"hedge": {"delay": "100ms"}}}`
+			}
+			config := Config{ProxyPrefix: "/api/", Routes: loadRoutes(t, routes)}
+			server, _ := newTestServer(t, config, nodes)
+
+			started := time.Now()
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/quote", nil))
+			if elapsed := time.Since(started); elapsed >= slow.delay {
+				t.Errorf("answered after %s, waiting for the slow node", elapsed)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, body, tt.status)
+			}
+			if hedged := string(body) == "call 2"; hedged != tt.hedged {
+				t.Errorf("got %q, expected the hedged answer: %v", body, tt.hedged)
+			}
+			if got := int(calls.Load()); got != tt.calls {
+				t.Errorf("nodes got %d calls, expected %d", got, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Hook is implemented by extensions of a Server embedded as a library, to
+// run custom logic such as authentication or accounting on the proxied
+// requests without changing the routing core. Hooks run in the order they
+// are registered, see Config.Hooks and Server.Use, and must be safe for
+// concurrent use. HookFuncs implements only the hooks it is given.
+type Hook interface {
+	// OnRequest is called with every request of the HTTP routes once it is
+	// authenticated, before the client's rate limit and node selection. An
+	// error refuses the request, see HookError.
+	OnRequest(r *http.Request) error
+	// OnSelect is called with each node selected for a request of /request
+	// or the proxy prefix, before the node is accounted and sent it. An
+	// error passes the node over for the next one, without using a retry.
+	OnSelect(r *http.Request, nodeID string) error
+	// OnResponse is called with the answer of the node a request of
+	// /request or the proxy prefix was forwarded to, before it is relayed.
+	// It may change the status and headers, and replace the body.
+	OnResponse(r *http.Request, nodeID string, resp *http.Response)
+}
+
+// HookError is returned by OnRequest to answer the refused request with
+// Status and Message; other errors answer it with a 403 and their text
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// HookFuncs implements Hook with the functions that are set
+type HookFuncs struct {
+	Request  func(r *http.Request) error
+	Select   func(r *http.Request, nodeID string) error
+	Response func(r *http.Request, nodeID string, resp *http.Response)
+}
+
+func (h HookFuncs) OnRequest(r *http.Request) error {
+	if h.Request == nil {
+		return nil
+	}
+	return h.Request(r)
+}
+
+func (h HookFuncs) OnSelect(r *http.Request, nodeID string) error {
+	if h.Select == nil {
+		return nil
+	}
+	return h.Select(r, nodeID)
+}
+
+func (h HookFuncs) OnResponse(r *http.Request, nodeID string, resp *http.Response) {
+	if h.Response != nil {
+		h.Response(r, nodeID, resp)
+	}
+}
+
+// Use registers a hook after those of Config.Hooks. It must be called
+// before Handler.
+func (s *Server) Use(hook Hook) {
+	s.config.Hooks = append(s.config.Hooks, hook)
+}
+
+// runRequestHooks calls the OnRequest hooks with every request, answering
+// it when one of them refuses it. It must run inside withRoutingInfo.
+func (s *Server) runRequestHooks(next http.HandlerFunc) http.HandlerFunc {
+	if len(s.config.Hooks) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, hook := range s.config.Hooks {
+			err := hook.OnRequest(r)
+			if err == nil {
+				continue
+			}
+			info := routingInfoFrom(r)
+			info.Decision = "refused_by_hook"
+			var hookErr *HookError
+			if errors.As(err, &hookErr) && hookErr.Status != 0 {
+				http.Error(w, hookErr.Message, hookErr.Status)
+				return
+			}
+			log.Printf("hook refused a request of %s: %v", info.Route, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// selectionHooksRefuse reports whether one of the OnSelect hooks refuses
+// to send r to nodeID
+func (s *Server) selectionHooksRefuse(r *http.Request, nodeID string) bool {
+	for _, hook := range s.config.Hooks {
+		if err := hook.OnSelect(r, nodeID); err != nil {
+			s.debugf(r, "hook passed node %s over: %v", nodeID, err)
+			return true
+		}
+	}
+	return false
+}
+
+// runResponseHooks calls the OnResponse hooks with the answer of nodeID
+func (s *Server) runResponseHooks(r *http.Request, nodeID string, resp *http.Response) {
+	for _, hook := range s.config.Hooks {
+		hook.OnResponse(r, nodeID, resp)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestHooks(t *testing.T) {
+	nodes := []store.NodeLimits{
+		{NodeID: "node-1", Address: newBackend(t, "one", http.StatusOK).URL, Limits: "10 req/min"},
+		{NodeID: "node-2", Address: newBackend(t, "two", http.StatusOK).URL, Limits: "10 req/min"},
+	}
+	refuse := HookFuncs{Request: func(r *http.Request) error {
+		switch r.Header.Get("X-Refuse") {
+		case "status":
+			return &HookError{Status: http.StatusUnauthorized, Message: "no key"}
+		case "error":
+			return errors.New("blocked")
+		}
+		return nil
+	}}
+	skipNode1 := HookFuncs{Select: func(r *http.Request, nodeID string) error {
+		if nodeID == "node-1" {
+			return errors.New("skipped")
+		}
+		return nil
+	}}
+	var answered []string
+	tag := HookFuncs{Response: func(r *http.Request, nodeID string, resp *http.Response) {
+		answered = append(answered, nodeID)
+		resp.Header.Set("X-Hooked", nodeID)
+	}}
+
+	lb := balancer.New(store.NewMemoryStore(nodes...))
+	if err := lb.LoadNodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(lb, proxy.New(nil), Config{Hooks: []Hook{refuse, skipNode1}})
+	s.Use(tag)
+	handler := s.Handler()
+
+	tests := []struct {
+		refuse string
+		status int
+		body   string
+	}{
+		{refuse: "status", status: http.StatusUnauthorized, body: "no key\n"},
+		{refuse: "error", status: http.StatusForbidden, body: "blocked\n"},
+		{status: http.StatusOK, body: "two"},
+		{status: http.StatusOK, body: "two"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+		r.Header.Set("X-Refuse", tt.refuse)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("got %d %q, expected %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+		}
+		if tt.status == http.StatusOK && w.Header().Get("X-Hooked") != "node-2" {
+			t.Errorf("got X-Hooked %q, expected the response hook to run", w.Header().Get("X-Hooked"))
+		}
+	}
+	if len(answered) != 2 {
+		t.Errorf("response hook saw %v, expected the 2 proxied requests", answered)
+	}
+}
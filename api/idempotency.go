@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// idempotencyKeyHeader is how clients name the request their retries repeat
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyBytes bounds the keys clients may send
+const maxIdempotencyKeyBytes = 255
+
+// maxIdempotentBodyBytes bounds the responses kept for replay; the keys of
+// larger ones are released, so their retries are forwarded again
+const maxIdempotentBodyBytes = 4 << 20
+
+// idempotencyClaimTTL is how long the first request of a key holds it on
+// routes without a timeout, so a replica dying mid-request does not block
+// the key until its responses would expire
+const idempotencyClaimTTL = 5 * time.Minute
+
+// idempotencyTimeout bounds storing the outcome of a request
+const idempotencyTimeout = 5 * time.Second
+
+// idempotencyFingerprint identifies a request by its method, path, query and
+// body, so a key reused for a different request is noticed
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayable reports whether a response to the first request of a key is
+// kept for its retries: failures the retry may not run into again are not
+func replayable(status int) bool {
+	return status < 500 && status != http.StatusTooManyRequests && status != http.StatusRequestTimeout
+}
+
+// deduplicate answers the retries of requests on route carrying an
+// Idempotency-Key with the response of the first request with that key
+// from the same client, instead of forwarding them again. The key is held
+// while the first request is served, retries arriving meanwhile are
+// answered 409, and a key reused for a different request 422. Responses the
+// retry might not get again, 5xx, 408 and 429, release the key.
+func (s *Server) deduplicate(route string, next http.HandlerFunc) http.HandlerFunc {
+	ttl := s.config.Routes[route].idempotency
+	if ttl <= 0 || s.config.Idempotency == nil {
+		return next
+	}
+	claimTTL := min(ttl, idempotencyClaimTTL)
+	if timeout := s.requestTimeout(route); timeout > 0 {
+		claimTTL = min(ttl, timeout+time.Minute)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		info := routingInfoFrom(r)
+		if len(key) > maxIdempotencyKeyBytes {
+			info.Decision = "invalid"
+			http.Error(w, fmt.Sprintf("%s must be at most %d bytes.", idempotencyKeyHeader, maxIdempotencyKeyBytes), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				info.Decision = "request_too_large"
+				http.Error(w, fmt.Sprintf("Request body is larger than %d bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			info.Decision = "invalid"
+			http.Error(w, "Failed to read request body.", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		storeKey := route + "\x00" + s.clientID(r) + "\x00" + key
+		fingerprint := idempotencyFingerprint(r, body)
+		record, claimed, err := s.config.Idempotency.ClaimIdempotencyKey(r.Context(), storeKey, fingerprint, time.Now().Add(claimTTL))
+		if err != nil {
+			log.Printf("claiming idempotency key: %v", err)
+			info.Decision = "error"
+			s.writeError(w, r, ConditionStoreUnavailable, http.StatusInternalServerError, "Idempotency state is unavailable.")
+			return
+		}
+		if !claimed {
+			s.answerDuplicate(w, r, route, fingerprint, record)
+			return
+		}
+		metrics.IdempotentRequests.WithLabelValues(route, "first").Inc()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), idempotencyTimeout)
+		defer cancel()
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if !replayable(status) || rec.body.Len() > maxIdempotentBodyBytes || r.Context().Err() != nil {
+			if err := s.config.Idempotency.ReleaseIdempotencyKey(ctx, storeKey); err != nil {
+				log.Printf("releasing idempotency key: %v", err)
+			}
+			return
+		}
+		response := store.IdempotentResponse{Status: status, Header: rec.Header().Clone(), Body: rec.body.Bytes()}
+		if err := s.config.Idempotency.CompleteIdempotencyKey(ctx, storeKey, response, time.Now().Add(ttl)); err != nil {
+			log.Printf("storing idempotent response: %v", err)
+		}
+	}
+}
+
+// answerDuplicate answers a request whose key another request claimed,
+// with that request's response once it has one
+func (s *Server) answerDuplicate(w http.ResponseWriter, r *http.Request, route, fingerprint string, record store.IdempotencyRecord) {
+	info := routingInfoFrom(r)
+	switch {
+	case record.Fingerprint != fingerprint:
+		metrics.IdempotentRequests.WithLabelValues(route, "mismatch").Inc()
+		info.Decision = "idempotency_mismatch"
+		http.Error(w, idempotencyKeyHeader+" was already used for a different request.", http.StatusUnprocessableEntity)
+	case record.Response == nil:
+		metrics.IdempotentRequests.WithLabelValues(route, "in_flight").Inc()
+		info.Decision = "idempotency_in_flight"
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "A request with this "+idempotencyKeyHeader+" is still being served.", http.StatusConflict)
+	default:
+		metrics.IdempotentRequests.WithLabelValues(route, "replayed").Inc()
+		info.Decision = "idempotent_replay"
+		for name, values := range record.Response.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(record.Response.Status)
+		w.Write(record.Response.Body)
+	}
+}
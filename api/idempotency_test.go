@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestDeduplicate(t *testing.T) {
+	// send holds the requests of a test, sent one after another
+	type send struct {
+		key    string
+		client string
+		body   string
+		// status is what the node answers with
+		status int
+		// expected is the status the client gets and replayed whether it
+		// is a replay
+		expected int
+		replayed bool
+	}
+	tests := []struct {
+		name     string
+		requests []send
+		calls    int
+	}{
+		{
+			name:     "replayed",
+			requests: []send{{key: "k", body: "a", expected: http.StatusCreated}, {key: "k", body: "a", expected: http.StatusCreated, replayed: true}},
+			calls:    1,
+		},
+		{
+			name:     "without a key",
+			requests: []send{{body: "a", expected: http.StatusCreated}, {body: "a", expected: http.StatusCreated}},
+			calls:    2,
+		},
+		{
+			name:     "different request",
+			requests: []send{{key: "k", body: "a", expected: http.StatusCreated}, {key: "k", body: "b", expected: http.StatusUnprocessableEntity}},
+			calls:    1,
+		},
+		{
+			name:     "other client",
+			requests: []send{{key: "k", client: "a", body: "a", expected: http.StatusCreated}, {key: "k", client: "b", body: "a", expected: http.StatusCreated}},
+			calls:    2,
+		},
+		{
+			name: "failure released",
+			requests: []send{
+				{key: "k", body: "a", status: http.StatusServiceUnavailable, expected: http.StatusServiceUnavailable},
+				{key: "k", body: "a", expected: http.StatusCreated},
+				{key: "k", body: "a", expected: http.StatusCreated, replayed: true},
+			},
+			calls: 2,
+		},
+		{
+			name:     "client error replayed",
+			requests: []send{{key: "k", body: "a", status: http.StatusBadRequest, expected: http.StatusBadRequest}, {key: "k", body: "a", expected: http.StatusBadRequest, replayed: true}},
+			calls:    1,
+		},
+		{
+			name:     "key too long",
+			requests: []send{{key: strings.Repeat("k", maxIdempotencyKeyBytes+1), body: "a", expected: http.StatusBadRequest}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := calls.Add(1)
+				status, _ := strconv.Atoi(r.Header.Get("X-Status"))
+				w.WriteHeader(max(status, http.StatusCreated))
+				fmt.Fprintf(w, "call %d", call)
+			}))
+			defer backend.Close()
+			config := Config{
+				ProxyPrefix:  "/api/",
+				Routes:       loadRoutes(t, `{"/api/": {"idempotency": "1h"}}`),
+				Idempotency:  store.NewMemoryStore(),
+				ClientHeader: "X-Client",
+			}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+
+			first := ""
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set(idempotencyKeyHeader, req.key)
+				}
+				if req.client != "" {
+					r.Header.Set("X-Client", req.client)
+				}
+				if req.status != 0 {
+					r.Header.Set("X-Status", strconv.Itoa(req.status))
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != req.expected {
+					t.Fatalf("request %d got %d %q, expected %d", i+1, w.Code, w.Body.String(), req.expected)
+				}
+				replayed := w.Header().Get("Idempotent-Replayed") == "true"
+				if replayed != req.replayed {
+					t.Errorf("request %d replayed: %v, expected %v", i+1, replayed, req.replayed)
+				}
+				if replayed && w.Body.String() != first {
+					t.Errorf("request %d replayed %q, expected %q", i+1, w.Body.String(), first)
+				}
+				if !replayed {
+					first = w.Body.String()
+				}
+			}
+			if got := int(calls.Load()); got != tt.calls {
+				t.Errorf("node got %d calls, expected %d", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestDeduplicateInFlight(t *testing.T) {
+	release := make(chan struct{})
+	called := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+	}))
+	defer backend.Close()
+	config := Config{ProxyPrefix: "/api/", Routes: loadRoutes(t, `{"/api/": {"idempotency": "1h"}}`), Idempotency: store.NewMemoryStore()}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min"}})
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader("a"))
+		r.Header.Set(idempotencyKeyHeader, "k")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- post() }()
+	<-called
+	w := post()
+	close(release)
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("retry during the first request got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("first request got %d", w.Code)
+	}
+}
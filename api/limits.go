@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// limitPolicy struct represents a window in the terms of the IETF RateLimit
+// header fields draft: quota q per window w seconds in quota unit qu, with r
+// remaining and t seconds until capacity frees up
+type limitPolicy struct {
+	Name      string `json:"name"`
+	Quota     int    `json:"q"`
+	Window    int    `json:"w"`
+	QuotaUnit string `json:"qu"`
+	Remaining int    `json:"r"`
+	Reset     int    `json:"t"`
+	Used      int    `json:"used"`
+}
+
+// handleLimits describes the limits the calling client is subject to: the
+// windows of the nodes it may be routed to, summed across them
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	target := s.balancerRequest(r, "")
+	windows, err := s.lb.PoolWindows(r.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	policies := make([]limitPolicy, 0, len(windows))
+	for _, window := range windows {
+		unit := "requests"
+		if window.Unit == "bytes" {
+			unit = "content-bytes"
+		}
+		policies = append(policies, limitPolicy{
+			Name:      fmt.Sprintf("%s-%ds", window.Unit, seconds(window.Period)),
+			Quota:     window.Limit,
+			Window:    seconds(window.Period),
+			QuotaUnit: unit,
+			Remaining: window.Remaining,
+			Reset:     seconds(window.Reset),
+			Used:      window.Used,
+		})
+	}
+
+	response := map[string]any{"policies": policies}
+	if client := routingInfoFrom(r).Client; client != "" {
+		response["client"] = client
+	}
+	if target.Group != "" {
+		response["group"] = target.Group
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGlobalLimits reports the global limits across all nodes and their
+// usage. PUT replaces them with the limit expression in the body, e.g.
+// {"limits": "5000 req/min"}, where an empty expression removes them.
+func (s *Server) handleGlobalLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var body struct {
+			Limits string `json:"limits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.lb.SetGlobalLimits(body.Limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	quota, limited, err := s.lb.GlobalQuota(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !limited {
+		writeJSON(w, http.StatusOK, map[string]any{"limits": ""})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"limits":             s.lb.GlobalLimits(),
+		"windows":            quota.Windows,
+		"remaining_requests": quota.RemainingRequests,
+		"remaining_bytes":    quota.RemainingBytes,
+	})
+}
+
+// handleRegionUsage reports the global limit usage of this region and of the
+// other regions replicated to it, for balancers of other regions to fetch
+func (s *Server) handleRegionUsage(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.lb.RegionSnapshots(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
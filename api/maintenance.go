@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// handleMaintenanceWindows lists the maintenance windows, whether they are
+// open and when they open next
+func (s *Server) handleMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.lb.MaintenanceStatus())
+}
+
+// handleMaintenanceWindow adds or replaces a maintenance window on PUT and
+// removes it on DELETE. A window is refused with 409 when, with the others,
+// it would take every node of a group out of selection at once.
+func (s *Server) handleMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	if s.config.Maintenance == nil {
+		http.Error(w, "The store cannot keep maintenance windows.", http.StatusNotImplemented)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		ok, err := s.config.Maintenance.DeleteMaintenanceWindow(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown maintenance window %s", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("deleted maintenance window %s", id)
+	} else {
+		var window store.MaintenanceWindow
+		if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		window.ID = id
+		if err := balancer.ValidateMaintenanceWindow(window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		windows, err := s.config.Maintenance.MaintenanceWindows(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		others := []store.MaintenanceWindow{window}
+		for _, other := range windows {
+			if other.ID != id {
+				others = append(others, other)
+			}
+		}
+		if err := s.lb.ValidateMaintenance(others, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := s.config.Maintenance.SaveMaintenanceWindow(r.Context(), window); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("saved maintenance window %s of node %s: %q for %s", id, window.NodeID, window.Schedule, window.Duration)
+	}
+
+	windows, err := s.config.Maintenance.MaintenanceWindows(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.lb.SetMaintenanceWindows(windows)
+	s.handleMaintenanceWindows(w, r)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// mirror sends a copy of a request a node accepted to a shadow node if the
+// balancer picks one. The shadow node is picked and sent the copy on the
+// background workers and its response is discarded, so the client never
+// waits for or sees the shadow node.
+func (s *Server) mirror(r *http.Request, body []byte, operation string, bpm int) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.config.MirrorTimeout)
+	mirrored := r.Clone(ctx)
+	chain := s.config.Routes[routingInfoFrom(r).Route].chain()
+
+	queued := s.background.submit("mirror", func() {
+		defer cancel()
+		shadowNode, err := s.lb.MirrorNode(ctx)
+		if errors.Is(err, balancer.ErrExtraLoadCapped) {
+			metrics.ExtraLoadCapped.WithLabelValues("mirror").Inc()
+			return
+		}
+		if err != nil {
+			log.Printf("selecting mirror node: %v", err)
+			return
+		}
+		if shadowNode == "" {
+			return
+		}
+		node, ok := s.lb.Node(shadowNode)
+		if !ok || node.Address == "" {
+			return
+		}
+		release, ok := s.lb.Acquire(shadowNode)
+		if !ok {
+			return
+		}
+		defer release()
+		if err := s.lb.RecordRequest(ctx, shadowNode, operation, bpm); err != nil {
+			log.Printf("recording mirrored request for node %s: %v", shadowNode, err)
+		}
+
+		resp, err := s.proxy.Forward(shadowNode, node.Pool, node.Address, mirrored, body, chain)
+		if err != nil {
+			metrics.MirroredRequests.WithLabelValues(shadowNode, "error").Inc()
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		metrics.MirroredRequests.WithLabelValues(shadowNode, statusClass(resp.StatusCode)).Inc()
+	})
+	if !queued {
+		cancel()
+		metrics.MirroredRequests.WithLabelValues("", "dropped").Inc()
+	}
+}
+
+// statusClass turns a status code into a low-cardinality label such as 2xx
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
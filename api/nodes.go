@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// handleNodes lists the node pool ordered by node ID
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	pool := s.lb.Nodes()
+	nodes := make([]store.NodeLimits, 0, len(pool))
+	for _, node := range pool {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
+
+// handleNode adds or replaces a node in the store on PUT and removes it on
+// DELETE. The pool is reloaded right away unless nodes are discovered, in
+// which case the change applies from the next discovery refresh.
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		ok, err := s.lb.Store().DeleteNodeLimits(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown node %s", id), http.StatusNotFound)
+			return
+		}
+		s.agents.forget(id, "removed")
+	} else {
+		var node store.NodeLimits
+		if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node.NodeID = id
+		if err := balancer.ValidateNode(node); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.lb.Store().SaveNodeLimits(r.Context(), node); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.reloadNodes(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.handleNodes(w, r)
+}
+
+// reloadNodes reloads the pool from the store after a node change, unless
+// nodes are discovered
+func (s *Server) reloadNodes(ctx context.Context) error {
+	if s.config.DiscoveredNodes {
+		return nil
+	}
+	return s.lb.LoadNodes(ctx)
+}
+
+// handleNodeDrain reports how far a node is drained, starts draining it on
+// PUT, optionally keeping its sticky clients with {"keep_sticky": true}, and
+// stops draining it on DELETE
+func (s *Server) handleNodeDrain(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			KeepSticky bool `json:"keep_sticky"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !s.lb.Drain(nodeID, body.KeepSticky) {
+			http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+			return
+		}
+		log.Printf("draining node %s", nodeID)
+	case http.MethodDelete:
+		if !s.lb.Undrain(nodeID) {
+			http.Error(w, fmt.Sprintf("Node %s is not draining", nodeID), http.StatusNotFound)
+			return
+		}
+		log.Printf("stopped draining node %s", nodeID)
+	}
+	status := s.lb.DrainStatus(nodeID)
+	if _, ok := s.lb.Node(nodeID); !ok && !status.Draining {
+		http.Error(w, fmt.Sprintf("Unknown node %s", nodeID), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// outcomeTimeout bounds recording an outcome in the background
+const outcomeTimeout = 5 * time.Second
+
+// recordOutcome records how nodeID answered r in the background: status,
+// zero when it did not, the time the nodes took and the body bytes sent and
+// received
+func (s *Server) recordOutcome(r *http.Request, nodeID, operation string, status int, sent, received int64) {
+	if s.config.Outcomes == nil {
+		return
+	}
+	outcome := store.Outcome{
+		Time:          time.Now(),
+		NodeID:        nodeID,
+		Operation:     operation,
+		Status:        status,
+		LatencyMS:     routingInfoFrom(r).Upstream.Milliseconds(),
+		BytesSent:     sent,
+		BytesReceived: received,
+	}
+	s.background.submit("outcome", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), outcomeTimeout)
+		defer cancel()
+		if err := s.config.Outcomes.RecordOutcome(ctx, outcome); err != nil {
+			log.Printf("recording outcome: %v", err)
+		}
+	})
+}
+
+// handleOutcomes lists the latest request outcomes, of ?node= when it is
+// set, with ?status= when it is set (a status such as 503, a class such as
+// 5xx, or 0 for nodes that did not answer), within ?since= (1h) and ?until=
+// (now) ago and at most ?limit= (100)
+func (s *Server) handleOutcomes(w http.ResponseWriter, r *http.Request) {
+	if s.config.Outcomes == nil {
+		http.Error(w, "Outcome recording is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	since, until, limit := time.Hour, time.Duration(0), 100
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		var err error
+		if until, err = time.ParseDuration(value); err != nil || until < 0 || until >= since {
+			http.Error(w, "until must be a duration from 0 up to since", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	filter := store.OutcomeFilter{NodeID: query.Get("node"), Since: now.Add(-since), Until: now.Add(-until)}
+	if value := query.Get("status"); value != "" {
+		var err error
+		if filter.MinStatus, filter.MaxStatus, err = parseStatusFilter(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	outcomes, err := s.config.Outcomes.Outcomes(r.Context(), filter, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, outcomes)
+}
+
+// parseStatusFilter parses a status such as 503, a class such as 5xx, or 0,
+// into the range of statuses it stands for. No status is below 100, so 0
+// stands for 0 to 99.
+func parseStatusFilter(value string) (int, int, error) {
+	if value == "0" {
+		return 0, 99, nil
+	}
+	if class, ok := strings.CutSuffix(strings.ToLower(value), "xx"); ok {
+		if digit, err := strconv.Atoi(class); err == nil && digit >= 1 && digit <= 5 {
+			return digit * 100, digit*100 + 99, nil
+		}
+	} else if status, err := strconv.Atoi(value); err == nil && status >= 100 && status <= 599 {
+		return status, status, nil
+	}
+	return 0, 0, fmt.Errorf("status must be a status such as 503, a class such as 5xx, or 0, got %q", value)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestParseStatusFilter(t *testing.T) {
+	tests := []struct {
+		value     string
+		low, high int
+		wantErr   bool
+	}{
+		{value: "0", low: 0, high: 99},
+		{value: "503", low: 503, high: 503},
+		{value: "5xx", low: 500, high: 599},
+		{value: "2XX", low: 200, high: 299},
+		{value: "6xx", wantErr: true},
+		{value: "99", wantErr: true},
+		{value: "ok", wantErr: true},
+	}
+	for _, tt := range tests {
+		low, high, err := parseStatusFilter(tt.value)
+		if (err != nil) != tt.wantErr || low != tt.low || high != tt.high {
+			t.Errorf("parseStatusFilter(%q) = %d, %d, %v, expected %d, %d", tt.value, low, high, err, tt.low, tt.high)
+		}
+	}
+}
+
+func TestRecordOutcome(t *testing.T) {
+	outcomes := store.NewMemoryStore()
+	nodes := []store.NodeLimits{{NodeID: "node-1", Address: stageBackend(t, "ok", http.StatusServiceUnavailable).URL, Limits: "10 req/min"}}
+	handler, _ := newTestServer(t, Config{Outcomes: outcomes, BackgroundQueue: 10}, nodes)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, target, strings.NewReader(`{"bpm": 1}`))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve(http.MethodPost, "/request"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, expected the node's 503", w.Code)
+	}
+
+	// Outcomes are recorded in the background
+	var listed []store.Outcome
+	for deadline := time.Now().Add(5 * time.Second); len(listed) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		json.NewDecoder(serve(http.MethodGet, "/admin/outcomes?node=node-1&status=5xx").Body).Decode(&listed)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("got %+v, expected the outcome of the request", listed)
+	}
+	// The node echoes the body and its name
+	expected := store.Outcome{NodeID: "node-1", Operation: "POST /request", Status: http.StatusServiceUnavailable, BytesSent: 10, BytesReceived: 13}
+	if outcome := listed[0]; outcome.NodeID != expected.NodeID || outcome.Operation != expected.Operation || outcome.Status != expected.Status ||
+		outcome.BytesSent != expected.BytesSent || outcome.BytesReceived != expected.BytesReceived {
+		t.Errorf("got %+v, expected %+v", outcome, expected)
+	}
+	json.NewDecoder(serve(http.MethodGet, "/admin/outcomes?status=2xx").Body).Decode(&listed)
+	if len(listed) != 0 {
+		t.Errorf("got %+v, expected no successful outcomes", listed)
+	}
+
+	for _, target := range []string{"/admin/outcomes?since=-1h", "/admin/outcomes?until=2h", "/admin/outcomes?limit=0", "/admin/outcomes?status=ok"} {
+		if w := serve(http.MethodGet, target); w.Code != http.StatusBadRequest {
+			t.Errorf("got %d for %s, expected 400", w.Code, target)
+		}
+	}
+}
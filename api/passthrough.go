@@ -0,0 +1,24 @@
+package api
+
+import (
+	"net/http"
+)
+
+// handleProxy forwards a request of any method and path under
+// Config.ProxyPrefix to a node as it came, query string included. Bodies
+// are streamed to the node as they arrive, so requests with one go to a
+// single node and are not retried or mirrored; requests without a body, and
+// every request while the proxy signs them, are buffered and retried like
+// those of POST /request. Requests are accounted with their body size.
+func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	described := r.Method + " " + r.URL.RequestURI()
+	if r.ContentLength != 0 && !s.proxy.Signs() {
+		s.forward(w, r, nil, max(int(r.ContentLength), 0), described)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.forward(w, r, body, len(body), described)
+}
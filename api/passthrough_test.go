@@ -0,0 +1,57 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestHandleProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+	}))
+	defer backend.Close()
+	handler, _ := newTestServer(t, Config{ProxyPrefix: "/v1/"}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "10 req/min"}})
+
+	tests := []struct {
+		method   string
+		target   string
+		body     string
+		status   int
+		expected string
+	}{
+		{method: http.MethodGet, target: "/v1/items?page=2", status: http.StatusOK, expected: "GET /v1/items?page=2 "},
+		{method: http.MethodPut, target: "/v1/items/2", body: "streamed", status: http.StatusOK, expected: "PUT /v1/items/2 streamed"},
+		{method: http.MethodDelete, target: "/v1/items/2", status: http.StatusOK, expected: "DELETE /v1/items/2 "},
+		{method: http.MethodGet, target: "/v2/items", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, body))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.expected != "" && w.Body.String() != tt.expected {
+				t.Errorf("got %q, expected %q", w.Body.String(), tt.expected)
+			}
+		})
+	}
+
+	// The balancer's own endpoints are not forwarded
+	handler, _ = newTestServer(t, Config{ProxyPrefix: "/"}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "10 req/min"}})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if strings.HasPrefix(w.Body.String(), "GET /healthz") {
+		t.Errorf("got %q, expected /healthz served by the balancer", w.Body.String())
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// phase is a step on a request's way through the balancer whose time is
+// measured, so slow requests can be attributed to the subsystem at fault
+type phase int
+
+const (
+	// phaseAuth is authenticating the client
+	phaseAuth phase = iota
+	// phaseLimits is claiming node quota and concurrency slots and
+	// computing rate limit state, e.g. for rejections
+	phaseLimits
+	// phaseSelection is picking nodes, including reading their usage
+	phaseSelection
+	// phaseQueue is how long an async request waited to be claimed
+	phaseQueue
+	// phaseProxy is how long the nodes took to answer, see routingInfo.Upstream
+	phaseProxy
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"auth", "limits", "selection", "queue", "proxy"}
+
+// phaseTimes struct represents the time a request spent in each phase it went through
+type phaseTimes struct {
+	durations [phaseCount]time.Duration
+	// entered has bit p set once the request went through phase p
+	entered uint
+}
+
+// timePhase adds the time since started to a phase of the request, across
+// attempts; use it as defer info.timePhase(p, time.Now()) to time a function
+func (info *routingInfo) timePhase(p phase, started time.Time) {
+	info.phases.durations[p] += time.Since(started)
+	info.phases.entered |= 1 << p
+}
+
+// observePhases exports the time the request spent in each phase it went
+// through, once it is served
+func observePhases(info *routingInfo) {
+	if info.Upstream > 0 {
+		info.phases.durations[phaseProxy] = info.Upstream
+		info.phases.entered |= 1 << phaseProxy
+	}
+	for p := range phaseCount {
+		if info.phases.entered&(1<<p) != 0 {
+			metrics.PhaseDuration.WithLabelValues(info.Route, phaseNames[p]).Observe(info.phases.durations[p].Seconds())
+		}
+	}
+}
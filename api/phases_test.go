@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestObservePhases(t *testing.T) {
+	backend := newBackend(t, "ok", http.StatusOK)
+	tests := []struct {
+		name    string
+		records []store.Record
+		// observed are the phases the request goes through
+		observed []string
+		skipped  []string
+	}{
+		{
+			name:     "proxied",
+			observed: []string{"selection", "proxy"},
+			skipped:  []string{"auth", "queue"},
+		},
+		{
+			name:     "rate limited",
+			records:  []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}},
+			observed: []string{"selection", "limits"},
+			skipped:  []string{"proxy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := func() map[string]uint64 {
+				counts := map[string]uint64{}
+				for _, phase := range phaseNames {
+					counts[phase] = histogramCount(t, "lb_phase_duration_seconds", map[string]string{"route": "/request", "phase": phase})
+				}
+				return counts
+			}
+			before := counts()
+			handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "1 req/min"}}, tt.records...)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			after := counts()
+			for _, phase := range tt.observed {
+				if got := after[phase] - before[phase]; got != 1 {
+					t.Errorf("observed %s %d times, expected once", phase, got)
+				}
+			}
+			for _, phase := range tt.skipped {
+				if got := after[phase] - before[phase]; got != 0 {
+					t.Errorf("observed %s %d times, expected it skipped", phase, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+const (
+	// pinHeader names the node a request is pinned to, see pinNode
+	pinHeader = "X-Debug-Target-Node"
+	// pinTokenHeader carries the token allowing a request to be pinned:
+	// Config.PinningSecret or an operator admin token
+	pinTokenHeader = "X-Debug-Token"
+)
+
+// pinNode sends requests naming a node in pinHeader to that node, bypassing
+// selection, when Config.NodePinning is on and they carry a valid token in
+// pinTokenHeader. Requests to unknown nodes are answered with a 404 and
+// those without a valid token with a 403. Neither header reaches the node.
+// It must run inside withRoutingInfo.
+func (s *Server) pinNode(next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.NodePinning {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodeID, token := r.Header.Get(pinHeader), r.Header.Get(pinTokenHeader)
+		r.Header.Del(pinHeader)
+		r.Header.Del(pinTokenHeader)
+		if nodeID == "" {
+			next(w, r)
+			return
+		}
+		info := routingInfoFrom(r)
+		if !s.pinningAllowed(token) {
+			log.Printf("refusing to pin a request of %s to node %s without a valid debug token", info.Route, nodeID)
+			info.Decision = "forbidden"
+			http.Error(w, "Pinning a request to a node needs a valid "+pinTokenHeader+".", http.StatusForbidden)
+			return
+		}
+		if _, ok := s.lb.Node(nodeID); !ok {
+			info.Decision = "invalid"
+			http.Error(w, "Unknown node "+nodeID+".", http.StatusNotFound)
+			return
+		}
+		info.Pinned = nodeID
+		metrics.PinnedRequests.WithLabelValues(nodeID).Inc()
+		next(w, r)
+	}
+}
+
+// pinningAllowed reports whether token is the pinning secret or an operator
+// admin token
+func (s *Server) pinningAllowed(token string) bool {
+	if token == "" {
+		return false
+	}
+	if s.config.PinningSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.PinningSecret)) == 1 {
+		return true
+	}
+	if s.config.AdminAuth != nil {
+		_, err := s.config.AdminAuth.AuthorizeToken(token, auth.RoleOperator)
+		return err == nil
+	}
+	return false
+}
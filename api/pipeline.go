@@ -0,0 +1,523 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+)
+
+// Failure policies of pipeline stages
+const (
+	// FailAbort answers with the failure of the stage and runs no later stage
+	FailAbort = "abort"
+	// FailSkip passes the stage's input on to the next stage as if the stage
+	// had returned it
+	FailSkip = "skip"
+)
+
+// Pipeline struct represents a route whose requests pass through an ordered
+// chain of node groups, each stage sending its response body on to the next
+// one as the request body. The client gets the response of the last stage.
+// Every stage is accounted with the BPM of the client's request.
+type Pipeline struct {
+	Stages []*PipelineStage `json:"stages"`
+	// Methods are the HTTP methods of the route, POST by default
+	Methods []string `json:"methods,omitempty"`
+}
+
+// PipelineStage struct represents one step of a pipeline
+type PipelineStage struct {
+	// Name identifies the stage in errors, metrics and its operation
+	// "<method> <route>#<name>"
+	Name string `json:"name"`
+	// Group is the node group serving the stage
+	Group string `json:"group"`
+	// Path is requested on the nodes instead of the route path, if set
+	Path string `json:"path,omitempty"`
+	// Limits is a limit expression applied per node to the stage's
+	// operation, see balancer.ParseLimits
+	Limits string `json:"limits,omitempty"`
+	// Timeout bounds each attempt of the stage, as a Go duration
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how many other nodes of the group a failed stage is retried on
+	Retries int `json:"retries,omitempty"`
+	// OnFailure is abort or skip, abort by default
+	OnFailure string `json:"on_failure,omitempty"`
+	// Compensate undoes the stage's side effects when a later stage aborts
+	// the pipeline, if set
+	Compensate *Compensation `json:"compensate,omitempty"`
+
+	timeout time.Duration
+}
+
+// Compensation struct represents the call that rolls a completed stage back.
+// It is sent to the node that served the stage, or another node of its group
+// when that one left the pool.
+type Compensation struct {
+	// Path is requested on the node, e.g. /orders/cancel
+	Path string `json:"path"`
+	// Method defaults to POST
+	Method string `json:"method,omitempty"`
+	// Body is the stage's response, the default, or request
+	Body string `json:"body,omitempty"`
+	// Timeout bounds each attempt, 10s by default
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how many more times a failed compensation is attempted
+	Retries int `json:"retries,omitempty"`
+
+	timeout time.Duration
+}
+
+// compile checks the compensation and fills in the defaults
+func (c *Compensation) compile() error {
+	if c.Path == "" {
+		return errors.New("compensate: missing path")
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	switch c.Body {
+	case "":
+		c.Body = "response"
+	case "response", "request":
+	default:
+		return fmt.Errorf("compensate: unknown body %q, expected response or request", c.Body)
+	}
+	c.timeout = 10 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("compensate: invalid timeout %q", c.Timeout)
+		}
+		c.timeout = d
+	}
+	if c.Retries < 0 {
+		return errors.New("compensate: retries must not be negative")
+	}
+	return nil
+}
+
+// compile checks the stages and fills in the defaults
+func (p *Pipeline) compile() error {
+	if len(p.Stages) == 0 {
+		return errors.New("pipeline: no stages")
+	}
+	names := map[string]bool{}
+	for i, stage := range p.Stages {
+		if stage == nil || stage.Name == "" {
+			return fmt.Errorf("pipeline: stage %d has no name", i)
+		}
+		if names[stage.Name] {
+			return fmt.Errorf("pipeline: duplicate stage %s", stage.Name)
+		}
+		names[stage.Name] = true
+		if stage.Group == "" {
+			return fmt.Errorf("pipeline stage %s: missing group", stage.Name)
+		}
+		if stage.Limits != "" {
+			if _, err := balancer.ParseLimits(stage.Limits); err != nil {
+				return fmt.Errorf("pipeline stage %s: %w", stage.Name, err)
+			}
+		}
+		if stage.Timeout != "" {
+			d, err := time.ParseDuration(stage.Timeout)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("pipeline stage %s: invalid timeout %q", stage.Name, stage.Timeout)
+			}
+			stage.timeout = d
+		}
+		if stage.Retries < 0 {
+			return fmt.Errorf("pipeline stage %s: retries must not be negative", stage.Name)
+		}
+		switch stage.OnFailure {
+		case "":
+			stage.OnFailure = FailAbort
+		case FailAbort, FailSkip:
+		default:
+			return fmt.Errorf("pipeline stage %s: unknown failure policy %q, expected abort or skip", stage.Name, stage.OnFailure)
+		}
+		if stage.Compensate != nil {
+			if err := stage.Compensate.compile(); err != nil {
+				return fmt.Errorf("pipeline stage %s: %w", stage.Name, err)
+			}
+		}
+	}
+	if p.Stages[len(p.Stages)-1].OnFailure == FailSkip {
+		return fmt.Errorf("pipeline stage %s: the last stage cannot be skipped", p.Stages[len(p.Stages)-1].Name)
+	}
+	if len(p.Methods) == 0 {
+		p.Methods = []string{http.MethodPost}
+	}
+	return nil
+}
+
+// stageOperation is the operation a stage's requests are limited and accounted as
+func stageOperation(method, route, stage string) string {
+	return method + " " + route + "#" + stage
+}
+
+// PipelineOperationLimits returns the limits of every pipeline stage keyed
+// by operation, for balancer.SetOperationLimits
+func PipelineOperationLimits(routes map[string]RouteConfig) map[string]string {
+	limits := map[string]string{}
+	for route, rc := range routes {
+		if rc.Pipeline == nil {
+			continue
+		}
+		for _, stage := range rc.Pipeline.Stages {
+			if stage.Limits == "" {
+				continue
+			}
+			for _, method := range rc.Pipeline.Methods {
+				limits[stageOperation(method, route, stage.Name)] = stage.Limits
+			}
+		}
+	}
+	return limits
+}
+
+// pipelineRoutes serves the routes configured with a pipeline by
+// handlePipeline, replacing built-in routes of the same path
+func (s *Server) pipelineRoutes(routes []route) []route {
+	paths := make([]string, 0, len(s.config.Routes))
+	for path, rc := range s.config.Routes {
+		if rc.Pipeline != nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		rt := route{path: path, methods: s.config.Routes[path].Pipeline.Methods, handler: s.traceExecution(s.handlePipeline)}
+		if i := slices.IndexFunc(routes, func(r route) bool { return r.path == path }); i >= 0 {
+			routes[i] = rt
+		} else {
+			routes = append(routes, rt)
+		}
+	}
+	return routes
+}
+
+// stageResult struct represents how one stage of a pipeline went
+type stageResult struct {
+	Stage   string
+	Node    string
+	Status  int
+	Latency time.Duration
+	Err     error
+}
+
+// handlePipeline runs the request through the stages of the route's pipeline
+func (s *Server) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	info := routingInfoFrom(r)
+	request, err := decodeRequest(body)
+	if err != nil {
+		info.Decision = "invalid"
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.BPM = s.requestBPM(r, request, body)
+
+	pipeline := s.config.Routes[info.Route].Pipeline
+	header := r.Header.Clone()
+	var resp *http.Response
+	var completed []completedStage
+	for i, stage := range pipeline.Stages {
+		last := i == len(pipeline.Stages)-1
+		stageReq := r.Clone(r.Context())
+		stageReq.Header = header
+		if stage.Path != "" {
+			stageReq.URL.Path, stageReq.URL.RawPath = stage.Path, ""
+		}
+
+		var result stageResult
+		resp, result = s.runStage(stageReq, body, request.BPM, info.Route, stage)
+		info.Upstream += result.Latency
+		info.Node = result.Node
+		if result.Err == nil && resp.StatusCode < 300 {
+			if last {
+				info.Trace.add(result.step("succeeded"))
+				break
+			}
+			next, err := proxy.ReadLimited(resp.Body, s.maxResponseBytes(info.Route))
+			resp.Body.Close()
+			if err == nil {
+				info.Trace.add(result.step("succeeded"))
+				completed = append(completed, completedStage{stage: stage, node: result.Node, request: body, response: next, header: header.Clone()})
+				body = next
+				header.Set("Content-Type", resp.Header.Get("Content-Type"))
+				continue
+			}
+			result.Err = fmt.Errorf("reading response: %w", err)
+			resp = nil
+		}
+		outcome := "failed"
+		if stage.OnFailure == FailSkip {
+			outcome = "skipped"
+		}
+		info.Trace.add(result.step(outcome))
+
+		if stage.OnFailure == FailSkip {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			log.Printf("pipeline %s: skipping failed stage %s: %s", info.Route, stage.Name, result.describe())
+			continue
+		}
+		if compensated := s.compensate(r, info.Route, stage.Name, request.BPM, completed); len(compensated) > 0 {
+			w.Header().Set("X-Pipeline-Compensated", strings.Join(compensated, ","))
+		}
+		s.failPipeline(w, r, stage, resp, result)
+		return
+	}
+	defer resp.Body.Close()
+
+	info.Proxied = true
+	info.Decision = "proxied"
+	if s.servedBy(info.Route) {
+		resp.Header.Set(servedByHeader, info.Node)
+	} else {
+		resp.Header.Del(servedByHeader)
+	}
+	s.relay(w, r, resp)
+}
+
+// runStage sends the request to a node of the stage's group, retrying on
+// other nodes like handleRequest. A nil response comes with an error in the result.
+func (s *Server) runStage(r *http.Request, body []byte, bpm int, route string, stage *PipelineStage) (*http.Response, stageResult) {
+	result := stageResult{Stage: stage.Name}
+	target := balancer.Request{Operation: stageOperation(r.Method, route, stage.Name), Group: stage.Group, Tenant: routingInfoFrom(r).Tenant}
+	chain := s.config.Routes[route].chain()
+
+	info := routingInfoFrom(r)
+	var resp *http.Response
+	for attempt := 0; attempt <= stage.Retries; attempt++ {
+		selecting := time.Now()
+		nodeID, err := s.lb.SelectNode(r.Context(), target)
+		info.timePhase(phaseSelection, selecting)
+		if err != nil {
+			result.Err = err
+			break
+		}
+		if nodeID == "" {
+			if resp == nil {
+				result.Err = errNoStageNode
+			}
+			break
+		}
+		release, ok := s.lb.Acquire(nodeID)
+		if !ok {
+			target.Exclude = append(target.Exclude, nodeID)
+			attempt--
+			continue
+		}
+		claiming := time.Now()
+		err = s.lb.ReserveRequest(r.Context(), nodeID, target.Operation, bpm)
+		info.timePhase(phaseLimits, claiming)
+		if errors.Is(err, balancer.ErrOverLimit) {
+			release()
+			target.Exclude = append(target.Exclude, nodeID)
+			attempt--
+			continue
+		} else if err != nil {
+			log.Printf("recording request for node %s: %v", nodeID, err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+
+		node, _ := s.lb.Node(nodeID)
+		ctx, cancelCtx := r.Context(), context.CancelFunc(func() {})
+		if stage.timeout > 0 {
+			ctx, cancelCtx = context.WithTimeout(ctx, stage.timeout)
+		}
+		// Closing the response ends the stage timeout and frees the node's slot
+		cancel := func() {
+			cancelCtx()
+			release()
+		}
+		started := time.Now()
+		resp, err = s.proxy.Forward(nodeID, node.Pool, node.Address, r.WithContext(ctx), body, chain)
+		latency := time.Since(started)
+		result.Node, result.Latency, result.Err = nodeID, result.Latency+latency, err
+		if resp != nil {
+			result.Status = resp.StatusCode
+			resp.Body = cancelOnClose{resp.Body, cancel}
+		} else {
+			cancel()
+		}
+		s.lb.ObserveResponse(nodeID, latency, resp == nil || resp.StatusCode >= 500)
+		s.observeBackpressure(nodeID, resp, latency)
+		if r.Context().Err() != nil || !retryable(resp) {
+			break
+		}
+		target.Exclude = append(target.Exclude, nodeID)
+	}
+	if resp == nil && result.Err == nil {
+		result.Err = errNoStageNode
+	}
+	return resp, result
+}
+
+// errNoStageNode means no node of a stage's group could take the request
+var errNoStageNode = errors.New("no node of the stage's group is available")
+
+// step turns the result into a trace step
+func (res stageResult) step(outcome string) traceStep {
+	step := traceStep{Stage: res.Stage, Node: res.Node, Status: res.Status, Latency: milliseconds(res.Latency), Outcome: outcome}
+	if res.Err != nil {
+		step.Error = res.Err.Error()
+	}
+	return step
+}
+
+func (res stageResult) describe() string {
+	if res.Err != nil {
+		return res.Err.Error()
+	}
+	return fmt.Sprintf("node %s answered %d", res.Node, res.Status)
+}
+
+// failPipeline answers with the failure of stage: a node's error response
+// is relayed as is, otherwise the balancer answers like for a plain request
+func (s *Server) failPipeline(w http.ResponseWriter, r *http.Request, stage *PipelineStage, resp *http.Response, result stageResult) {
+	info := routingInfoFrom(r)
+	w.Header().Set("X-Pipeline-Failed-Stage", stage.Name)
+	switch {
+	case resp != nil:
+		defer resp.Body.Close()
+		info.Node = result.Node
+		info.Proxied = true
+		info.Decision = "proxied"
+		s.relay(w, r, resp)
+	case errors.Is(result.Err, errNoStageNode):
+		target := balancer.Request{Operation: stageOperation(r.Method, info.Route, stage.Name), Group: stage.Group, Tenant: info.Tenant}
+		s.rejectNoNode(w, r, target)
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded), errors.Is(result.Err, context.DeadlineExceeded):
+		info.Decision = "timeout"
+		s.writeError(w, r, ConditionTimeout, http.StatusGatewayTimeout, fmt.Sprintf("Pipeline stage %s did not answer in time.", stage.Name))
+	default:
+		info.Decision = "unreachable"
+		log.Printf("pipeline %s: stage %s failed: %s", info.Route, stage.Name, result.describe())
+		s.writeError(w, r, ConditionUnreachable, http.StatusBadGateway, fmt.Sprintf("Pipeline stage %s failed.", stage.Name))
+	}
+}
+
+// cancelOnClose releases the context of a response, such as a stage's
+// timeout, once its body is read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// completedStage struct represents a stage that succeeded, with what is
+// needed to compensate it
+type completedStage struct {
+	stage    *PipelineStage
+	node     string
+	request  []byte
+	response []byte
+	header   http.Header
+}
+
+// compensate rolls back the completed stages with a compensation, latest
+// first, before the failure of failedStage is answered. It runs to the end
+// even if the client goes away, and returns the stages rolled back.
+func (s *Server) compensate(r *http.Request, route, failedStage string, bpm int, completed []completedStage) []string {
+	ctx := context.WithoutCancel(r.Context())
+	var compensated []string
+	for i := len(completed) - 1; i >= 0; i-- {
+		done := completed[i]
+		c := done.stage.Compensate
+		if c == nil {
+			continue
+		}
+
+		body := done.response
+		if c.Body == "request" {
+			body = done.request
+		}
+		req := r.Clone(ctx)
+		req.Method, req.Header = c.Method, done.header.Clone()
+		req.Header.Set("X-Pipeline-Compensation", failedStage)
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = c.Path, "", ""
+
+		result := "failed"
+		step := traceStep{Stage: done.stage.Name, Outcome: "compensation_failed"}
+		started := time.Now()
+		for attempt := 0; attempt <= c.Retries; attempt++ {
+			step.Node, step.Status = "", 0
+			err := s.compensateOnce(req, route, done, body, bpm, &step)
+			if err != nil {
+				step.Error = err.Error()
+				log.Printf("pipeline %s: compensating stage %s: %v", route, done.stage.Name, err)
+				continue
+			}
+			result, step.Outcome, step.Error = "succeeded", "compensated", ""
+			compensated = append(compensated, done.stage.Name)
+			break
+		}
+		step.Latency = milliseconds(time.Since(started))
+		routingInfoFrom(r).Trace.add(step)
+		metrics.PipelineCompensations.WithLabelValues(route, done.stage.Name, result).Inc()
+	}
+	return compensated
+}
+
+// compensateOnce sends one compensation request, accounted like a request of the stage
+func (s *Server) compensateOnce(r *http.Request, route string, done completedStage, body []byte, bpm int, step *traceStep) error {
+	nodeID := done.node
+	node, ok := s.lb.Node(nodeID)
+	if !ok {
+		var err error
+		nodeID, err = s.lb.SelectNode(r.Context(), balancer.Request{Group: done.stage.Group, Tenant: routingInfoFrom(r).Tenant})
+		if err != nil {
+			return err
+		}
+		if nodeID == "" {
+			return errNoStageNode
+		}
+		node, _ = s.lb.Node(nodeID)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), done.stage.Compensate.timeout)
+	defer cancel()
+	operation := stageOperation(r.Method, route, done.stage.Name)
+	if err := s.lb.RecordRequest(ctx, nodeID, operation, bpm); err != nil {
+		log.Printf("recording request for node %s: %v", nodeID, err)
+	}
+	step.Node = nodeID
+	resp, err := s.proxy.Forward(nodeID, node.Pool, node.Address, r.WithContext(ctx), body, s.config.Routes[route].chain())
+	if err != nil {
+		return err
+	}
+	step.Status = resp.StatusCode
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("node %s answered %d", nodeID, resp.StatusCode)
+	}
+	return nil
+}
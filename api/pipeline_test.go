@@ -0,0 +1,135 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// stageBackend starts a node answering requests with status and the body
+// they carried followed by name
+func stageBackend(t *testing.T, name string, status int) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write(body)
+		io.WriteString(w, " "+name)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestPipelineConfig(t *testing.T) {
+	for _, pipeline := range []string{
+		`{"stages": []}`,
+		`{"stages": [{"group": "a"}]}`,
+		`{"stages": [{"name": "a"}]}`,
+		`{"stages": [{"name": "a", "group": "a"}, {"name": "a", "group": "b"}]}`,
+		`{"stages": [{"name": "a", "group": "a", "limits": "lots"}]}`,
+		`{"stages": [{"name": "a", "group": "a", "on_failure": "retry"}]}`,
+		`{"stages": [{"name": "a", "group": "a", "on_failure": "skip"}]}`,
+		`{"stages": [{"name": "a", "group": "a", "compensate": {}}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		if err := os.WriteFile(path, []byte(`{"/orders": {"pipeline": `+pipeline+`}}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRouteConfig(path); err == nil {
+			t.Errorf("%s was accepted", pipeline)
+		}
+	}
+
+	routes := loadRoutes(t, `{"/orders": {"pipeline": {"methods": ["PUT"], "stages": [{"name": "a", "group": "a", "limits": "5 req/min"}, {"name": "b", "group": "b"}]}}}`)
+	if limits := PipelineOperationLimits(routes); len(limits) != 1 || limits["PUT /orders#a"] != "5 req/min" {
+		t.Errorf("got %v, expected the limits of stage a", limits)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	validate := stageBackend(t, "validated", http.StatusOK)
+	enrich := stageBackend(t, "enriched", http.StatusOK)
+	failing := stageBackend(t, "failed", http.StatusInternalServerError)
+	nodes := []store.NodeLimits{
+		{NodeID: "validate-1", Group: "validate", Address: validate.URL, Limits: "100 req/min"},
+		{NodeID: "enrich-1", Group: "enrich", Address: enrich.URL, Limits: "100 req/min"},
+		{NodeID: "failing-1", Group: "failing", Address: failing.URL, Limits: "100 req/min"},
+	}
+	tests := []struct {
+		name        string
+		stages      string
+		status      int
+		expected    string
+		failedStage string
+	}{
+		{name: "chained", stages: `[{"name": "validate", "group": "validate"}, {"name": "enrich", "group": "enrich"}]`, status: http.StatusOK, expected: `{"bpm": 1} validated enriched`},
+		{name: "skipped", stages: `[{"name": "check", "group": "failing", "on_failure": "skip"}, {"name": "enrich", "group": "enrich"}]`, status: http.StatusOK, expected: `{"bpm": 1} enriched`},
+		{name: "aborted", stages: `[{"name": "validate", "group": "validate"}, {"name": "check", "group": "failing"}, {"name": "enrich", "group": "enrich"}]`, status: http.StatusInternalServerError, expected: `{"bpm": 1} validated failed`, failedStage: "check"},
+		{name: "no node", stages: `[{"name": "validate", "group": "missing"}]`, status: http.StatusServiceUnavailable, failedStage: "validate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Routes: loadRoutes(t, `{"/orders": {"pipeline": {"stages": `+tt.stages+`}}}`)}
+			handler, _ := newTestServer(t, config, nodes)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.expected != "" && w.Body.String() != tt.expected {
+				t.Errorf("got %q, expected %q", w.Body.String(), tt.expected)
+			}
+			if got := w.Header().Get("X-Pipeline-Failed-Stage"); got != tt.failedStage {
+				t.Errorf("got failed stage %q, expected %q", got, tt.failedStage)
+			}
+		})
+	}
+}
+
+func TestPipelineCompensation(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	reserve := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Pipeline-Compensation")+" "+string(body))
+		mu.Unlock()
+		io.WriteString(w, "reserved")
+	}))
+	defer reserve.Close()
+	charge := stageBackend(t, "charged", http.StatusOK)
+	ship := stageBackend(t, "failed", http.StatusBadGateway)
+	nodes := []store.NodeLimits{
+		{NodeID: "reserve-1", Group: "reserve", Address: reserve.URL, Limits: "100 req/min"},
+		{NodeID: "charge-1", Group: "charge", Address: charge.URL, Limits: "100 req/min"},
+		{NodeID: "ship-1", Group: "ship", Address: ship.URL, Limits: "100 req/min"},
+	}
+	config := Config{Routes: loadRoutes(t, `{"/orders": {"pipeline": {"stages": [
+		{"name": "reserve", "group": "reserve", "compensate": {"path": "/release", "method": "DELETE", "body": "request"}},
+		{"name": "charge", "group": "charge"},
+		{"name": "ship", "group": "ship"}
+	]}}}`)}
+	handler, _ := newTestServer(t, config, nodes)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"bpm": 1}`)))
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Pipeline-Failed-Stage") != "ship" {
+		t.Fatalf("got %d from stage %q, expected ship's 502", w.Code, w.Header().Get("X-Pipeline-Failed-Stage"))
+	}
+	if got := w.Header().Get("X-Pipeline-Compensated"); got != "reserve" {
+		t.Errorf("compensated %q, expected reserve only", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{`POST /orders  {"bpm": 1}`, `DELETE /release ship {"bpm": 1}`}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("reserve got %q, expected %q", calls, expected)
+	}
+}
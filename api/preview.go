@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Outcomes of evaluating a request against the preview configuration
+const (
+	// PreviewSame means both configurations decided alike
+	PreviewSame = "same"
+	// PreviewDifferentNode means the candidate would accept the request but
+	// not on the node the live configuration picked
+	PreviewDifferentNode = "different_node"
+	// PreviewRejectedByCandidate means the live configuration accepted the
+	// request and the candidate would have rejected it
+	PreviewRejectedByCandidate = "rejected_by_candidate"
+	// PreviewAcceptedByCandidate means the live configuration rejected the
+	// request and the candidate would have accepted it
+	PreviewAcceptedByCandidate = "accepted_by_candidate"
+)
+
+// previewTimeout bounds the evaluation of one request against the preview
+const previewTimeout = 2 * time.Second
+
+// preview struct represents a candidate configuration every request is
+// evaluated against, next to the live one
+type preview struct {
+	lb     *balancer.LoadBalancer
+	config balancer.CandidateConfig
+	since  time.Time
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// LoadPreviewConfig reads a candidate configuration from a JSON file, e.g.
+//
+//	{"nodes": [{"node_id": "node-1", "address": "localhost:9001", "limits": "200 req/min"}],
+//	 "operation_limits": {"POST /request": "50 req/s"}}
+func LoadPreviewConfig(path string) (balancer.CandidateConfig, error) {
+	var config balancer.CandidateConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// SetPreview starts evaluating every request against config in addition to
+// the live configuration, resetting the divergence counts
+func (s *Server) SetPreview(config balancer.CandidateConfig) error {
+	candidate, err := s.lb.Candidate(config)
+	if err != nil {
+		return err
+	}
+	s.preview.Store(&preview{lb: candidate, config: config, since: time.Now(), counts: map[string]int{}})
+	return nil
+}
+
+// startPreview starts evaluating the request against the preview
+// configuration, if there is one, alongside the live node selection. The
+// returned function compares the candidate's decision with liveNode, the
+// node the live configuration picked or empty if it rejected the request,
+// and must be called before the request is recorded so that both see the
+// same usage. It is nil without a preview.
+func (s *Server) startPreview(r *http.Request, target balancer.Request) func(liveNode string) {
+	p := s.preview.Load()
+	if p == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), previewTimeout)
+	// The candidate runs no health checks, so it follows the live ones
+	target.Exclude = append(slices.Clone(target.Exclude), s.lb.DownNodes()...)
+	type result struct {
+		available []string
+		err       error
+	}
+	results := make(chan result, 1)
+	go func() {
+		defer cancel()
+		available, err := p.lb.AvailableNodes(ctx, target)
+		results <- result{available, err}
+	}()
+
+	return func(liveNode string) {
+		res := <-results
+		if res.err != nil {
+			log.Printf("evaluating preview configuration: %v", res.err)
+			return
+		}
+		outcome := PreviewSame
+		switch {
+		case liveNode == "" && len(res.available) > 0:
+			outcome = PreviewAcceptedByCandidate
+		case liveNode != "" && len(res.available) == 0:
+			outcome = PreviewRejectedByCandidate
+		case liveNode != "" && !slices.Contains(res.available, liveNode):
+			outcome = PreviewDifferentNode
+		}
+		metrics.PreviewEvaluations.WithLabelValues(outcome).Inc()
+		p.mu.Lock()
+		p.counts[outcome]++
+		p.mu.Unlock()
+	}
+}
+
+// handlePreview reports how the preview configuration diverges from the
+// live one. PUT starts a preview of the candidate configuration in the body,
+// DELETE stops it.
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var config balancer.CandidateConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetPreview(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		s.preview.Store(nil)
+	}
+
+	p := s.preview.Load()
+	if p == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+	p.mu.Lock()
+	counts := map[string]int{PreviewSame: 0, PreviewDifferentNode: 0, PreviewRejectedByCandidate: 0, PreviewAcceptedByCandidate: 0}
+	evaluated := 0
+	for outcome, n := range p.counts {
+		counts[outcome] = n
+		evaluated += n
+	}
+	p.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":    true,
+		"since":     p.since,
+		"evaluated": evaluated,
+		"outcomes":  counts,
+		"config":    p.config,
+	})
+}
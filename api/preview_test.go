@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestPreview(t *testing.T) {
+	full := store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}
+	tests := []struct {
+		name      string
+		limits    string
+		candidate string
+		outcome   string
+	}{
+		{name: "same", limits: "10 req/min", candidate: `{"nodes": [{"node_id": "node-1", "limits": "20 req/min"}]}`, outcome: PreviewSame},
+		{name: "different node", limits: "10 req/min", candidate: `{"nodes": [{"node_id": "node-2", "limits": "20 req/min"}]}`, outcome: PreviewDifferentNode},
+		{name: "rejected by the candidate", limits: "10 req/min", candidate: `{"nodes": [{"node_id": "node-1", "limits": "1 req/min"}]}`, outcome: PreviewRejectedByCandidate},
+		{name: "accepted by the candidate", limits: "1 req/min", candidate: `{"nodes": [{"node_id": "node-1", "limits": "10 req/min"}]}`, outcome: PreviewAcceptedByCandidate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: tt.limits}}, full)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/preview", strings.NewReader(tt.candidate)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/preview", nil))
+			var report struct {
+				Active    bool           `json:"active"`
+				Evaluated int            `json:"evaluated"`
+				Outcomes  map[string]int `json:"outcomes"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if !report.Active || report.Evaluated != 1 || report.Outcomes[tt.outcome] != 1 {
+				t.Errorf("got %+v, expected one %s", report, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestPreviewAdmin(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/preview", strings.NewReader(`{"nodes": [{"node_id": "node-1", "limits": "10 req/fortnight"}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for invalid limits, expected 400", w.Code)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/admin/preview", strings.NewReader(`{}`)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/preview", nil))
+	var report map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report["active"] != false {
+		t.Errorf("got %v, expected the preview stopped", report)
+	}
+}
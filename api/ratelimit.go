@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Rate limit header styles: the legacy X-RateLimit-* headers, the
+// RateLimit-* fields of the IETF draft, or both
+const (
+	RateLimitHeadersLegacy = "x"
+	RateLimitHeadersIETF   = "ietf"
+	RateLimitHeadersBoth   = "both"
+)
+
+// ValidateRateLimitHeaders checks a rate limit header style
+func ValidateRateLimitHeaders(style string) error {
+	switch style {
+	case RateLimitHeadersLegacy, RateLimitHeadersIETF, RateLimitHeadersBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown rate limit header style %q, expected x, ietf or both", style)
+}
+
+// rateLimitStyle returns the header style of route
+func (s *Server) rateLimitStyle(route string) string {
+	if rc, ok := s.config.Routes[route]; ok && rc.RateLimitHeaders != "" {
+		return rc.RateLimitHeaders
+	}
+	if s.config.RateLimitHeaderStyle == "" {
+		return RateLimitHeadersLegacy
+	}
+	return s.config.RateLimitHeaderStyle
+}
+
+// setRateLimitHeaders reports limit in the headers of style, with the reset
+// in seconds from now
+func setRateLimitHeaders(header http.Header, limit balancer.RateLimit, style string) {
+	prefixes := []string{"X-RateLimit-"}
+	switch style {
+	case RateLimitHeadersIETF:
+		prefixes = []string{"RateLimit-"}
+	case RateLimitHeadersBoth:
+		prefixes = []string{"X-RateLimit-", "RateLimit-"}
+	}
+	for _, prefix := range prefixes {
+		header.Set(prefix+"Limit", strconv.Itoa(limit.Limit))
+		header.Set(prefix+"Remaining", strconv.Itoa(limit.Remaining))
+		header.Set(prefix+"Reset", strconv.Itoa(seconds(limit.Reset)))
+	}
+}
+
+// seconds rounds d up to whole seconds, so clients never retry too early
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rejectReasonHeader tells clients why the balancer refused a request
+const rejectReasonHeader = "X-Reject-Reason"
+
+// countRejection records why a request was refused in its routingInfo,
+// the response headers and the rejection metrics
+func countRejection(w http.ResponseWriter, r *http.Request, reason string) {
+	info := routingInfoFrom(r)
+	info.RejectReason = reason
+	w.Header().Set(rejectReasonHeader, reason)
+	metrics.RejectedRequests.WithLabelValues(info.Route, reason).Inc()
+}
+
+// rejectNoNode answers a request no node can take. When the nodes or the
+// global limits are at their limits it is 429, telling the client why and
+// when capacity frees up; when no node is up to serve the request at all it is 503, as
+// waiting for a window to reset would not help.
+func (s *Server) rejectNoNode(w http.ResponseWriter, r *http.Request, target balancer.Request) {
+	info := routingInfoFrom(r)
+	limiting := time.Now()
+	reason := s.lb.RejectReason(r.Context(), target)
+	countRejection(w, r, reason)
+	switch reason {
+	case balancer.RejectNodeRequests, balancer.RejectNodeBytes, balancer.RejectOperation, balancer.RejectGlobal:
+		s.config.Events.Publish(eventbus.Event{Type: eventbus.RateLimitSaturated, Reason: reason, Details: map[string]any{"route": info.Route}})
+	}
+	if reason == balancer.RejectNoNodes {
+		info.timePhase(phaseLimits, limiting)
+		info.Decision = "unavailable"
+		s.writeError(w, r, ConditionUnavailable, http.StatusServiceUnavailable, "No node is available to serve the request.")
+		return
+	}
+
+	info.Decision = "rate_limited"
+	message := "All nodes are currently at rate limit. Retry later."
+	var limit balancer.RateLimit
+	var err error
+	if reason == balancer.RejectGlobal {
+		message = "The balancer is at its global rate limit. Retry later."
+		limit, err = s.lb.GlobalRateLimit(r.Context(), target)
+	} else {
+		limit, err = s.lb.PoolRateLimit(r.Context(), target)
+	}
+	info.timePhase(phaseLimits, limiting)
+	if err != nil {
+		log.Printf("computing rate limit state: %v", err)
+	} else {
+		setRateLimitHeaders(w.Header(), limit, s.rateLimitStyle(info.Route))
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(limit.Reset))))
+	}
+	s.writeError(w, r, ConditionRateLimited, http.StatusTooManyRequests, message)
+}
+
+// reportRateLimit adds the rate limit state of the serving node to a
+// successful response, if enabled
+func (s *Server) reportRateLimit(header http.Header, r *http.Request, nodeID string) {
+	if !s.config.RateLimitHeaders {
+		return
+	}
+	defer routingInfoFrom(r).timePhase(phaseLimits, time.Now())
+	limit, ok, err := s.lb.NodeRateLimit(r.Context(), nodeID)
+	if err != nil {
+		log.Printf("computing rate limit state of node %s: %v", nodeID, err)
+		return
+	}
+	if ok {
+		setRateLimitHeaders(header, limit, s.rateLimitStyle(routingInfoFrom(r).Route))
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		legacy bool
+		ietf   bool
+	}{
+		{name: "off", config: Config{}},
+		{name: "default style", config: Config{RateLimitHeaders: true}, legacy: true},
+		{name: "ietf", config: Config{RateLimitHeaders: true, RateLimitHeaderStyle: RateLimitHeadersIETF}, ietf: true},
+		{name: "both", config: Config{RateLimitHeaders: true, RateLimitHeaderStyle: RateLimitHeadersBoth}, legacy: true, ietf: true},
+		{
+			name:   "route style",
+			config: Config{RateLimitHeaders: true, Routes: loadRoutes(t, `{"/request": {"ratelimit_headers": "ietf"}}`)},
+			ietf:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestServer(t, tt.config, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+			for prefix, expected := range map[string]bool{"X-RateLimit-": tt.legacy, "RateLimit-": tt.ietf} {
+				if !expected {
+					if got := w.Header().Get(prefix + "Limit"); got != "" {
+						t.Errorf("got %sLimit %q, expected none", prefix, got)
+					}
+					continue
+				}
+				// The request itself already counts
+				if limit, remaining := w.Header().Get(prefix+"Limit"), w.Header().Get(prefix+"Remaining"); limit != "10" || remaining != "9" {
+					t.Errorf("got %sLimit %q and Remaining %q, expected 10 and 9", prefix, limit, remaining)
+				}
+				if reset, err := strconv.Atoi(w.Header().Get(prefix + "Reset")); err != nil || reset < 1 || reset > 60 {
+					t.Errorf("got %sReset %q, expected at most a minute", prefix, w.Header().Get(prefix+"Reset"))
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitedHeaders(t *testing.T) {
+	// The node took its only request of the minute 10 seconds ago
+	handler, _ := newTestServer(t, Config{RateLimitHeaderStyle: RateLimitHeadersBoth}, []store.NodeLimits{{NodeID: "node-1", Limits: "1 req/min"}},
+		store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-10 * time.Second)})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		if limit, remaining := w.Header().Get(prefix+"Limit"), w.Header().Get(prefix+"Remaining"); limit != "1" || remaining != "0" {
+			t.Errorf("got %sLimit %q and Remaining %q, expected 1 and 0", prefix, limit, remaining)
+		}
+		if reset, err := strconv.Atoi(w.Header().Get(prefix + "Reset")); err != nil || reset < 45 || reset > 50 {
+			t.Errorf("got %sReset %q, expected the window to free up in 50 seconds", prefix, w.Header().Get(prefix+"Reset"))
+		}
+	}
+	if got := w.Header().Get("Retry-After"); got != w.Header().Get("X-RateLimit-Reset") {
+		t.Errorf("got Retry-After %q, expected the reset", got)
+	}
+}
+
+func TestCountRejection(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   []store.NodeLimits
+		records []store.Record
+		reason  string
+	}{
+		{
+			name:    "request limit",
+			nodes:   []store.NodeLimits{{NodeID: "node-1", Limits: "1 req/min"}},
+			records: []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}},
+			reason:  balancer.RejectNodeRequests,
+		},
+		{
+			name:    "operation limit",
+			nodes:   []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min", OperationLimits: map[string]string{"POST /request": "1 req/min"}}},
+			records: []store.Record{{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)}},
+			reason:  balancer.RejectOperation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := map[string]string{"route": "/request", "reason": tt.reason}
+			before := counterValue(t, "lb_rejected_requests_total", labels)
+			handler, _ := newTestServer(t, Config{}, tt.nodes, tt.records...)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get(rejectReasonHeader); got != tt.reason {
+				t.Errorf("reject reason %q, expected %q", got, tt.reason)
+			}
+			if got := counterValue(t, "lb_rejected_requests_total", labels) - before; got != 1 {
+				t.Errorf("counted %v rejections, expected 1", got)
+			}
+		})
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected int
+	}{
+		{d: 0, expected: 0},
+		{d: time.Millisecond, expected: 1},
+		{d: time.Second, expected: 1},
+		{d: 1500 * time.Millisecond, expected: 2},
+	}
+	for _, tt := range tests {
+		if got := seconds(tt.d); got != tt.expected {
+			t.Errorf("seconds(%s) = %d, expected %d", tt.d, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// readinessTimeout bounds the store check of /readyz
+const readinessTimeout = 2 * time.Second
+
+// handleHealthz reports that the balancer is alive; it answers as soon as the server is up
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the balancer can serve traffic: its store is
+// reachable and at least one node is up. It answers 503 otherwise, so
+// orchestrators hold traffic back.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	checks["store"] = "ok"
+	if pinger, ok := s.lb.Store().(store.Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := pinger.Ping(ctx)
+		cancel()
+		if err != nil {
+			checks["store"] = err.Error()
+			ready = false
+		}
+	}
+
+	up, total := len(s.lb.UpNodes()), len(s.lb.Nodes())
+	checks["nodes"] = fmt.Sprintf("%d of %d up", up, total)
+	if up == 0 {
+		ready = false
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
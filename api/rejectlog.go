@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// digestDay is the layout of the days of reject digests
+const digestDay = "2006-01-02"
+
+// digestDelay is how long after midnight UTC the digests of the previous
+// day are published, leaving time for the last rejections to be recorded
+const digestDelay = 5 * time.Minute
+
+// rejectLogTimeout bounds the recording of a rejection
+const rejectLogTimeout = 5 * time.Second
+
+// digestLine struct represents the rejections of a client on a route for a
+// reason
+type digestLine struct {
+	Route  string `json:"route"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// rejectDigest struct represents the requests of a client refused during a
+// day (UTC), the lines with the most rejections first
+type rejectDigest struct {
+	Client  string       `json:"client"`
+	Day     string       `json:"day"`
+	Total   int          `json:"total"`
+	Lines   []digestLine `json:"lines"`
+	Message string       `json:"message"`
+}
+
+// thousands formats n with commas between groups of three digits
+func thousands(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// rejectDigests returns the digests of day, of client when it is set, the
+// clients with the most rejections first
+func (s *Server) rejectDigests(ctx context.Context, client string, day time.Time) ([]rejectDigest, error) {
+	counts, err := s.config.RejectLog.RejectionCounts(ctx, client, day, day.Add(24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	byClient := map[string]*rejectDigest{}
+	for _, count := range counts {
+		digest, ok := byClient[count.Client]
+		if !ok {
+			digest = &rejectDigest{Client: count.Client, Day: day.Format(digestDay)}
+			byClient[count.Client] = digest
+		}
+		digest.Total += count.Count
+		digest.Lines = append(digest.Lines, digestLine{Route: count.Route, Reason: count.Reason, Count: count.Count})
+	}
+
+	digests := make([]rejectDigest, 0, len(byClient))
+	for _, digest := range byClient {
+		sort.Slice(digest.Lines, func(i, j int) bool { return digest.Lines[i].Count > digest.Lines[j].Count })
+		top := digest.Lines[0]
+		digest.Message = fmt.Sprintf("You were throttled %s times on %s, %s of them on %s (%s).",
+			thousands(digest.Total), digest.Day, thousands(top.Count), top.Route, top.Reason)
+		digests = append(digests, *digest)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Total > digests[j].Total })
+	return digests, nil
+}
+
+// logRejections records the requests refused without reaching a node in
+// the reject log, in the background. It must run inside withRoutingInfo.
+func (s *Server) logRejections(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.RejectLog == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r)
+		info := routingInfoFrom(r)
+		if info.RejectReason == "" {
+			return
+		}
+		rejection := store.Rejection{Time: time.Now(), Client: s.clientID(r), Route: info.Route, Reason: info.RejectReason}
+		s.background.submit("reject_log", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), rejectLogTimeout)
+			defer cancel()
+			if err := s.config.RejectLog.RecordRejection(ctx, rejection); err != nil {
+				log.Printf("recording rejection: %v", err)
+			}
+		})
+	}
+}
+
+// RunRejectDigests publishes a reject_digest event for every client with
+// requests refused the day before, shortly after every midnight UTC, until
+// ctx is done. With Config.RejectDigestClaims only one replica publishes the
+// digests of a day.
+func (s *Server) RunRejectDigests(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24*time.Hour + digestDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		day := next.Truncate(24 * time.Hour).Add(-24 * time.Hour)
+		if err := s.publishRejectDigests(ctx, day); err != nil {
+			log.Printf("publishing the reject digests of %s: %v", day.Format(digestDay), err)
+		}
+	}
+}
+
+func (s *Server) publishRejectDigests(ctx context.Context, day time.Time) error {
+	if claims := s.config.RejectDigestClaims; claims != nil {
+		n, err := claims.IncrementCounter(ctx, "reject_digests:"+day.Format(digestDay), day.Add(72*time.Hour))
+		if err != nil {
+			return err
+		}
+		if n > 1 {
+			// Another replica publishes them
+			return nil
+		}
+	}
+	digests, err := s.rejectDigests(ctx, "", day)
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		s.config.Events.Publish(eventbus.Event{Type: eventbus.RejectDigest, Details: map[string]any{"digest": digest}})
+	}
+	log.Printf("published the reject digests of %d clients for %s", len(digests), day.Format(digestDay))
+	return nil
+}
+
+// parseDigestDay parses the ?day= of digest requests, yesterday (UTC) when
+// it is missing
+func parseDigestDay(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("day")
+	if value == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour), nil
+	}
+	day, err := time.Parse(digestDay, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("day must look like %s", digestDay)
+	}
+	return day, nil
+}
+
+// handleClientRejections reports how often the calling client was refused
+// on a ?day= (yesterday), per route and reason
+func (s *Server) handleClientRejections(w http.ResponseWriter, r *http.Request) {
+	if s.config.RejectLog == nil {
+		http.Error(w, "The reject log is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	day, err := parseDigestDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client := s.clientID(r)
+	digests, err := s.rejectDigests(r.Context(), client, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(digests) == 0 {
+		digests = append(digests, rejectDigest{Client: client, Day: day.Format(digestDay), Lines: []digestLine{}})
+	}
+	writeJSON(w, http.StatusOK, digests[0])
+}
+
+// handleRejections lists the latest rejections, of ?client= when it is set,
+// within ?since= (1h) and at most ?limit= (100)
+func (s *Server) handleRejections(w http.ResponseWriter, r *http.Request) {
+	if s.config.RejectLog == nil {
+		http.Error(w, "The reject log is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	since, limit := time.Hour, 100
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	rejections, err := s.config.RejectLog.Rejections(r.Context(), query.Get("client"), time.Now().Add(-since), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rejections)
+}
+
+// handleRejectDigests returns the digests of every client refused on a
+// ?day= (yesterday)
+func (s *Server) handleRejectDigests(w http.ResponseWriter, r *http.Request) {
+	if s.config.RejectLog == nil {
+		http.Error(w, "The reject log is not enabled.", http.StatusNotImplemented)
+		return
+	}
+	day, err := parseDigestDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	digests, err := s.rejectDigests(r.Context(), "", day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, digests)
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestThousands(t *testing.T) {
+	tests := []struct {
+		n        int
+		expected string
+	}{
+		{n: 0, expected: "0"},
+		{n: 999, expected: "999"},
+		{n: 1000, expected: "1,000"},
+		{n: 12345678, expected: "12,345,678"},
+	}
+	for _, tt := range tests {
+		if got := thousands(tt.n); got != tt.expected {
+			t.Errorf("thousands(%d) = %q, expected %q", tt.n, got, tt.expected)
+		}
+	}
+}
+
+func TestRejectLog(t *testing.T) {
+	ctx := context.Background()
+	rejectLog := store.NewMemoryStore()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if err := rejectLog.RecordRejection(ctx, store.Rejection{Time: time.Now(), Client: "bob", Route: "/request", Reason: balancer.RejectNodeBytes}); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{ClientHeader: "X-Client", RejectLog: rejectLog, BackgroundQueue: 10}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Limits: "1 req/min"}},
+		store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)})
+	serve := func(target, client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if target == "/request" {
+			r = httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"bpm": 1}`))
+		}
+		r.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for range 3 {
+		if w := serve("/request", "alice"); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("got %d, expected 429", w.Code)
+		}
+	}
+	// Rejections are recorded in the background
+	var rejections []store.Rejection
+	for deadline := time.Now().Add(5 * time.Second); len(rejections) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		json.NewDecoder(serve("/admin/rejections?client=alice", "").Body).Decode(&rejections)
+	}
+	if len(rejections) != 3 || rejections[0].Reason != balancer.RejectNodeRequests || rejections[0].Route != "/request" {
+		t.Fatalf("got %+v, expected the 3 rejections of alice", rejections)
+	}
+
+	var digest rejectDigest
+	if err := json.NewDecoder(serve("/rejections?day="+today.Format(digestDay), "alice").Body).Decode(&digest); err != nil {
+		t.Fatal(err)
+	}
+	expected := "You were throttled 3 times on " + today.Format(digestDay) + ", 3 of them on /request (node_requests)."
+	if digest.Client != "alice" || digest.Total != 3 || digest.Message != expected {
+		t.Errorf("got %+v, expected %q", digest, expected)
+	}
+
+	var digests []rejectDigest
+	if err := json.NewDecoder(serve("/admin/rejections/digests?day="+today.Format(digestDay), "").Body).Decode(&digests); err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 || digests[0].Client != "alice" || digests[1].Client != "bob" {
+		t.Errorf("got %+v, expected alice then bob", digests)
+	}
+	for _, target := range []string{"/admin/rejections?since=-1h", "/admin/rejections?limit=0", "/admin/rejections/digests?day=yesterday"} {
+		if w := serve(target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("got %d for %s, expected 400", w.Code, target)
+		}
+	}
+}
+
+func TestPublishRejectDigests(t *testing.T) {
+	ctx := context.Background()
+	rejectLog := store.NewMemoryStore()
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, client := range []string{"alice", "bob"} {
+		if err := rejectLog.RecordRejection(ctx, store.Rejection{Time: day.Add(time.Hour), Client: client, Route: "/request", Reason: balancer.RejectNodeRequests}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := eventbus.New(eventbus.Options{Buffer: 10})
+	published, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	// Replicas share the claims, so only the first publishes
+	claims := store.NewMemoryStore()
+	for range 2 {
+		s := NewServer(balancer.New(store.NewMemoryStore()), proxy.New(nil), Config{RejectLog: rejectLog, RejectDigestClaims: claims, Events: events})
+		if err := s.publishRejectDigests(ctx, day); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(published) != 2 {
+		t.Fatalf("published %d events, expected a digest for alice and bob", len(published))
+	}
+	if event := <-published; event.Type != eventbus.RejectDigest {
+		t.Errorf("published %s, expected %s", event.Type, eventbus.RejectDigest)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// handleReports lists the usage summaries of ?period= (hour) per node, of
+// ?node= when it is set, starting within ?since= (24h for hourly summaries,
+// 30 days for daily ones)
+func (s *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	if s.config.Reports == nil {
+		http.Error(w, "Usage reports are not enabled.", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = store.ReportHourly
+	}
+	if err := store.ValidateReportPeriod(period); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since := 24 * time.Hour
+	if period == store.ReportDaily {
+		since = 30 * 24 * time.Hour
+	}
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	// The summary of the period since falls into is listed too
+	start := now.Add(-since).Truncate(time.Hour)
+	if period == store.ReportDaily {
+		start = start.Truncate(24 * time.Hour)
+	}
+	summaries, err := s.config.Reports.UsageSummaries(r.Context(), period, query.Get("node"), start, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestReports(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	hour := time.Now().UTC().Truncate(time.Hour)
+	if err := s.SaveUsageSummaries(ctx, []store.UsageSummary{
+		{Period: store.ReportHourly, Start: hour, NodeID: "node-1", Requests: 2, BPM: 5},
+		{Period: store.ReportHourly, Start: hour, NodeID: "node-2", Requests: 1, BPM: 1},
+		{Period: store.ReportHourly, Start: hour.Add(-48 * time.Hour), NodeID: "node-1", Requests: 7},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewServer(balancer.New(s), proxy.New(nil), Config{Reports: s}).Handler()
+
+	tests := []struct {
+		query    string
+		status   int
+		requests []int
+	}{
+		{query: "", status: http.StatusOK, requests: []int{2, 1}},
+		{query: "?node=node-1", status: http.StatusOK, requests: []int{2}},
+		{query: "?node=node-1&since=72h", status: http.StatusOK, requests: []int{7, 2}},
+		{query: "?period=day", status: http.StatusOK, requests: []int{}},
+		{query: "?period=week", status: http.StatusBadRequest},
+		{query: "?since=-1h", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/reports"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var summaries []store.UsageSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+				t.Fatal(err)
+			}
+			requests := []int{}
+			for _, summary := range summaries {
+				requests = append(requests, summary.Requests)
+			}
+			if !slices.Equal(requests, tt.requests) {
+				t.Errorf("got requests %v, expected %v", requests, tt.requests)
+			}
+		})
+	}
+
+	disabled, _ := newTestServer(t, Config{}, nil)
+	w := httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/reports", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("got %d without reports, expected 501", w.Code)
+	}
+}
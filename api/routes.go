@@ -0,0 +1,396 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/rulexpr"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// RouteConfig struct represents the declarative settings of a route
+type RouteConfig struct {
+	// Transforms are applied in order to requests to and responses from the nodes
+	Transforms []*proxy.Rules `json:"transforms,omitempty"`
+	// ServedBy overrides Config.ServedBy for the route
+	ServedBy *bool `json:"served_by,omitempty"`
+	// RateLimitHeaders overrides Config.RateLimitHeaderStyle for the route
+	RateLimitHeaders string `json:"ratelimit_headers,omitempty"`
+	// FanOut makes the route send each request to several nodes, see FanOut
+	FanOut *FanOut `json:"fan_out,omitempty"`
+	// Pipeline makes the route pass each request through a chain of node
+	// groups, see Pipeline
+	Pipeline *Pipeline `json:"pipeline,omitempty"`
+	// MaxResponseBytes overrides Config.MaxResponseBytes for the route
+	MaxResponseBytes *int64 `json:"max_response_bytes,omitempty"`
+	// ResponseOverflow overrides Config.ResponseOverflow for the route
+	ResponseOverflow string `json:"response_overflow,omitempty"`
+	// MaxRequestBytes overrides Config.MaxRequestBytes for the route
+	MaxRequestBytes *int64 `json:"max_request_bytes,omitempty"`
+	// ContentTypes are the media types the route accepts request bodies
+	// in, such as application/json; any is accepted when empty, unless the
+	// route has a request schema, which needs application/json
+	ContentTypes []string `json:"content_types,omitempty"`
+	// Priority is the priority class of the route's requests that name none
+	// in Config.PriorityHeader
+	Priority string `json:"priority,omitempty"`
+	// Hedge sends requests the node is slow to answer to a second node as
+	// well, see Hedge
+	Hedge *Hedge `json:"hedge,omitempty"`
+	// Match is a rule expression requests must satisfy to be served by the
+	// route, see package rulexpr; other requests are answered with a 404
+	Match string `json:"match,omitempty"`
+	// Groups pick the node group of the route's requests matched by no A/B
+	// routing rule: the first whose expression the request satisfies wins
+	Groups []GroupRule `json:"groups,omitempty"`
+	// Timeout overrides Config.RequestTimeout for the route, as a Go
+	// duration. Unlike it, it also bounds requests queued with Prefer:
+	// respond-async, the time they waited in the queue included.
+	Timeout string `json:"timeout,omitempty"`
+	// Retry overrides Config.Retry for the route, field by field
+	Retry *store.RetryPolicy `json:"retry,omitempty"`
+	// Tokens is how many of its node's capacity tokens, see
+	// store.NodeLimits.MaxConcurrent, each request of the route holds until
+	// it completes; one when zero. Give streaming and long-poll routes more,
+	// so a node is not oversubscribed with requests that stay open. On nodes
+	// with fewer, requests hold all of them.
+	Tokens int `json:"tokens,omitempty"`
+	// Idempotency is how long, as a Go duration, the response to a request
+	// carrying an Idempotency-Key is replayed to the client's retries with
+	// the same key, see Config.Idempotency; empty forwards the retries
+	Idempotency string `json:"idempotency,omitempty"`
+	// Coalesce serves identical GET requests arriving while one of them is
+	// in flight with its response, see Server.coalesce
+	Coalesce bool `json:"coalesce,omitempty"`
+	// BlueGreen sends the route's requests matched by no A/B routing rule
+	// or group rule to one of two node groups, see BlueGreen
+	BlueGreen *BlueGreen `json:"blue_green,omitempty"`
+
+	match       *rulexpr.Expr
+	timeout     time.Duration
+	idempotency time.Duration
+}
+
+// GroupRule struct represents a node group selected by a rule expression
+type GroupRule struct {
+	When  string `json:"when"`
+	Group string `json:"group"`
+
+	when *rulexpr.Expr
+}
+
+// compile parses the rule expressions, timeout and idempotency of rc
+func (rc *RouteConfig) compile() error {
+	if rc.Timeout != "" {
+		d, err := time.ParseDuration(rc.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", rc.Timeout)
+		}
+		rc.timeout = d
+	}
+	if _, err := (balancer.RetryPolicy{}).Override(rc.Retry); err != nil {
+		return err
+	}
+	if rc.Tokens < 0 {
+		return fmt.Errorf("tokens must not be negative")
+	}
+	if rc.Idempotency != "" {
+		d, err := time.ParseDuration(rc.Idempotency)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid idempotency %q", rc.Idempotency)
+		}
+		rc.idempotency = d
+	}
+	if rc.Match != "" {
+		expr, err := rulexpr.Parse(rc.Match)
+		if err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+		rc.match = expr
+	}
+	for i := range rc.Groups {
+		if err := rc.Groups[i].compile(); err != nil {
+			return fmt.Errorf("groups[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// compile parses the expression of the rule
+func (g *GroupRule) compile() error {
+	if g.Group == "" {
+		return fmt.Errorf("group is required")
+	}
+	expr, err := rulexpr.Parse(g.When)
+	if err != nil {
+		return err
+	}
+	g.when = expr
+	return nil
+}
+
+// group returns the node group of the first of rc.Groups matching r, if any
+func (rc RouteConfig) group(r *http.Request) string {
+	return matchGroup(rc.Groups, r)
+}
+
+// matchGroup returns the node group of the first of rules matching r, if any
+func matchGroup(rules []GroupRule, r *http.Request) string {
+	for _, rule := range rules {
+		if rule.when.Match(r) {
+			return rule.Group
+		}
+	}
+	return ""
+}
+
+// LoadRouteConfig reads a JSON object mapping route paths to their settings, e.g.
+//
+//	{"/request": {"transforms": [{"request_headers": {"set": {"X-Api-Version": "2"}},
+//	                             "path": {"match": "^/request$", "replace": "/v2/request"}}]},
+//	 "/search": {"fan_out": {"merge": "concat", "field": "hits", "timeout": "2s"}},
+//	 "/quote": {"hedge": {"delay": "50ms"}, "retry": {"attempts": 2, "on": ["5xx"], "backoff": "20ms"}},
+//	 "/request": {"match": "header(\"x-region\") == \"eu\" || !has_header(\"x-region\")",
+//	              "groups": [{"when": "cookie(\"beta\") == \"1\"", "group": "canary"}]}}
+//
+// Routes with a fan_out or pipeline are served even when the balancer has
+// no built-in route of that path.
+func LoadRouteConfig(path string) (map[string]RouteConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes map[string]RouteConfig
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, err
+	}
+	for route, rc := range routes {
+		if rc.MaxResponseBytes != nil && *rc.MaxResponseBytes < 0 {
+			return nil, fmt.Errorf("route %s: max_response_bytes must not be negative", route)
+		}
+		if rc.ResponseOverflow != "" {
+			if err := ValidateResponseOverflow(rc.ResponseOverflow); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if rc.MaxRequestBytes != nil && *rc.MaxRequestBytes < 0 {
+			return nil, fmt.Errorf("route %s: max_request_bytes must not be negative", route)
+		}
+		for _, contentType := range rc.ContentTypes {
+			if _, _, err := mime.ParseMediaType(contentType); err != nil {
+				return nil, fmt.Errorf("route %s: content type %q: %w", route, contentType, err)
+			}
+		}
+		if rc.RateLimitHeaders != "" {
+			if err := ValidateRateLimitHeaders(rc.RateLimitHeaders); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if rc.BlueGreen != nil {
+			if err := rc.BlueGreen.compile(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if rc.FanOut != nil {
+			if err := rc.FanOut.compile(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if rc.Pipeline != nil {
+			if rc.FanOut != nil {
+				return nil, fmt.Errorf("route %s: fan_out and pipeline are mutually exclusive", route)
+			}
+			if err := rc.Pipeline.compile(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if rc.Hedge != nil {
+			if rc.FanOut != nil || rc.Pipeline != nil {
+				return nil, fmt.Errorf("route %s: fan_out and pipeline routes do not hedge", route)
+			}
+			if err := rc.Hedge.compile(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		for _, rules := range rc.Transforms {
+			if err := rules.Compile(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route, err)
+			}
+		}
+		if err := rc.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route, err)
+		}
+		routes[route] = rc
+	}
+	return routes, nil
+}
+
+// chain returns the transformers of rc in order
+func (rc RouteConfig) chain() proxy.Chain {
+	chain := make(proxy.Chain, 0, len(rc.Transforms))
+	for _, rules := range rc.Transforms {
+		chain = append(chain, rules)
+	}
+	return chain
+}
+
+// servedByHeader names the node that served a response
+const servedByHeader = "X-Served-By"
+
+// servedBy reports whether responses of route carry the serving node; when
+// they do not, the header is stripped from node responses as well
+func (s *Server) servedBy(route string) bool {
+	if rc, ok := s.config.Routes[route]; ok && rc.ServedBy != nil {
+		return *rc.ServedBy
+	}
+	return s.config.ServedBy
+}
+
+// priority returns the priority class of a request: the one its
+// PriorityHeader names, else its route's
+func (s *Server) priority(r *http.Request) string {
+	if s.config.PriorityHeader != "" {
+		if class := r.Header.Get(s.config.PriorityHeader); class != "" {
+			return strings.ToLower(class)
+		}
+	}
+	return s.config.Routes[routingInfoFrom(r).Route].Priority
+}
+
+// retryPolicy returns the retry policy of the requests of route that nodeID
+// failed: the node's overriding the route's overriding Config.Retry
+func (s *Server) retryPolicy(route, nodeID string) balancer.RetryPolicy {
+	policy, _ := s.config.Retry.Override(s.config.Routes[route].Retry)
+	if node, ok := s.lb.Node(nodeID); ok {
+		policy, _ = policy.Override(node.Retry)
+	}
+	return policy
+}
+
+// requestTimeout returns how long requests of route may take end to end,
+// zero if they are unbounded
+func (s *Server) requestTimeout(route string) time.Duration {
+	if rc, ok := s.config.Routes[route]; ok && rc.timeout > 0 {
+		return rc.timeout
+	}
+	return s.config.RequestTimeout
+}
+
+// maxResponseBytes returns the size limit of responses of route, zero if
+// they are unbounded
+func (s *Server) maxResponseBytes(route string) int64 {
+	if rc, ok := s.config.Routes[route]; ok && rc.MaxResponseBytes != nil {
+		return *rc.MaxResponseBytes
+	}
+	return s.config.MaxResponseBytes
+}
+
+// What is done with responses over the size limit of their route
+const (
+	// ResponseOverflowStream answers responses whose Content-Length is over
+	// the limit with a 502 and cuts streamed ones short with an error trailer
+	ResponseOverflowStream = "stream"
+	// ResponseOverflowError reads responses up to the limit before relaying
+	// them, answering any that goes over it with a 502
+	ResponseOverflowError = "error"
+	// ResponseOverflowTruncate relays every response up to the limit, cut
+	// short ones flagged with a header or an error trailer
+	ResponseOverflowTruncate = "truncate"
+)
+
+// ValidateResponseOverflow checks what is done with responses over the size limit
+func ValidateResponseOverflow(overflow string) error {
+	switch overflow {
+	case ResponseOverflowStream, ResponseOverflowError, ResponseOverflowTruncate:
+		return nil
+	}
+	return fmt.Errorf("unknown response overflow %q, expected stream, error or truncate", overflow)
+}
+
+// responseOverflow returns what is done with responses of route over its
+// size limit
+func (s *Server) responseOverflow(route string) string {
+	if rc, ok := s.config.Routes[route]; ok && rc.ResponseOverflow != "" {
+		return rc.ResponseOverflow
+	}
+	if s.config.ResponseOverflow != "" {
+		return s.config.ResponseOverflow
+	}
+	return ResponseOverflowStream
+}
+
+// maxRequestBytes returns the size limit of request bodies of route, zero if
+// they are unbounded
+func (s *Server) maxRequestBytes(route string) int64 {
+	if rc, ok := s.config.Routes[route]; ok && rc.MaxRequestBytes != nil {
+		return *rc.MaxRequestBytes
+	}
+	return s.config.MaxRequestBytes
+}
+
+// relay copies the node's response to the client within the route's size
+// limit, handling responses over it as the route's response overflow says.
+// Whether the response kept within the limit feeds the node's outlier
+// detection.
+func (s *Server) relay(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	info := routingInfoFrom(r)
+	max := s.maxResponseBytes(info.Route)
+	if max <= 0 {
+		if err := proxy.Relay(w, resp); err != nil {
+			log.Printf("relaying response from node %s: %v", info.Node, err)
+		}
+		return
+	}
+	overflow := s.responseOverflow(info.Route)
+	// refused tells responses found over the limit before anything was relayed
+	var err error
+	refused := false
+	switch {
+	case overflow == ResponseOverflowTruncate:
+		err = proxy.RelayTruncated(w, resp, max)
+	case resp.ContentLength > max:
+		err, refused = proxy.ErrResponseTooLarge, true
+	case overflow == ResponseOverflowError:
+		// A body going over the limit is not read any further; the rest of
+		// it is dropped with the connection
+		var body []byte
+		if body, err = proxy.ReadLimited(resp.Body, max); err == nil {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			err = proxy.Relay(w, resp)
+		} else if errors.Is(err, proxy.ErrResponseTooLarge) {
+			refused = true
+		} else {
+			info.Proxied, info.Decision = false, "unreachable"
+			s.writeError(w, r, ConditionUnreachable, http.StatusBadGateway, fmt.Sprintf("Node %s broke off its response.", info.Node))
+		}
+	default:
+		err = proxy.RelayLimited(w, resp, max)
+	}
+	oversized := errors.Is(err, proxy.ErrResponseTooLarge)
+	s.lb.ObserveResponseSize(info.Node, oversized)
+	switch {
+	case oversized:
+		info.Decision = "response_too_large"
+		metrics.OversizedResponses.WithLabelValues(info.Node, info.Route, overflow).Inc()
+		if refused {
+			info.Proxied = false
+			s.writeError(w, r, ConditionResponseTooLarge, http.StatusBadGateway, fmt.Sprintf("The response of node %s exceeds %d bytes.", info.Node, max))
+			return
+		}
+		log.Printf("response from node %s truncated at %d bytes", info.Node, max)
+	case err != nil:
+		log.Printf("relaying response from node %s: %v", info.Node, err)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestRetryOverrides(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		// nodeRetry overrides the policy of either node
+		nodeRetry *store.RetryPolicy
+		status    int
+	}{
+		{name: "500 is not a gateway error", routes: `{}`, status: http.StatusInternalServerError},
+		{name: "route retries 5xx", routes: `{"/request": {"retry": {"on": ["5xx"]}}}`, status: http.StatusOK},
+		{name: "route without retries", routes: `{"/request": {"retry": {"attempts": 0, "on": ["5xx"]}}}`, status: http.StatusInternalServerError},
+		{name: "failing node without retries", routes: `{"/request": {"retry": {"on": ["5xx"]}}}`, nodeRetry: &store.RetryPolicy{Attempts: new(int)}, status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Retry:  balancer.RetryPolicy{Attempts: 1, On: balancer.DefaultRetryOn},
+				Routes: loadRoutes(t, tt.routes),
+			}
+			// Whichever node is tried first fails
+			var calls atomic.Int32
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer backend.Close()
+			handler, _ := newTestServer(t, config, []store.NodeLimits{
+				{NodeID: "node-1", Address: backend.URL, Limits: "100 req/min", Retry: tt.nodeRetry},
+				{NodeID: "node-2", Address: backend.URL, Limits: "100 req/min", Retry: tt.nodeRetry},
+			})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	config := Config{RequestTimeout: time.Minute, Routes: loadRoutes(t, `{"/request": {"timeout": "50ms"}}`)}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: slow.URL, Limits: "100 req/min"}})
+
+	started := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, expected 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(started); elapsed >= time.Second {
+		t.Errorf("answered after %s, expected the route timeout", elapsed)
+	}
+}
+
+func TestResponseLimitConfig(t *testing.T) {
+	for _, routes := range []string{
+		`{"/request": {"max_response_bytes": -1}}`,
+		`{"/request": {"response_overflow": "drop"}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		if err := os.WriteFile(path, []byte(routes), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRouteConfig(path); err == nil {
+			t.Errorf("%s was accepted", routes)
+		}
+	}
+}
+
+func TestResponseOverflow(t *testing.T) {
+	body := strings.Repeat("x", 20)
+	sized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer sized.Close()
+	streamed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.Write([]byte(body))
+	}))
+	defer streamed.Close()
+
+	tests := []struct {
+		name     string
+		routes   string
+		backend  *httptest.Server
+		status   int
+		expected string
+		// truncated is whether the response is flagged truncated up front
+		truncated bool
+	}{
+		{name: "stream sized", routes: `{}`, backend: sized, status: http.StatusBadGateway},
+		{name: "stream streamed", routes: `{}`, backend: streamed, status: http.StatusOK, expected: body[:10]},
+		{name: "error sized", routes: `{"/request": {"response_overflow": "error"}}`, backend: sized, status: http.StatusBadGateway},
+		{name: "error streamed", routes: `{"/request": {"response_overflow": "error"}}`, backend: streamed, status: http.StatusBadGateway},
+		{name: "truncate sized", routes: `{"/request": {"response_overflow": "truncate"}}`, backend: sized, status: http.StatusOK, expected: body[:10], truncated: true},
+		{name: "truncate streamed", routes: `{"/request": {"response_overflow": "truncate"}}`, backend: streamed, status: http.StatusOK, expected: body[:10]},
+		{name: "route limit", routes: `{"/request": {"max_response_bytes": 100, "response_overflow": "error"}}`, backend: sized, status: http.StatusOK, expected: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{MaxResponseBytes: 10, Routes: loadRoutes(t, tt.routes)}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: tt.backend.URL, Limits: "100 req/min"}})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tt.expected {
+				t.Errorf("relayed %q, expected %q", w.Body.String(), tt.expected)
+			}
+			if truncated := w.Header().Get(proxy.ResponseTruncatedHeader) != ""; truncated != tt.truncated {
+				t.Errorf("got the truncated header %v, expected %v", truncated, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	// The node names itself, as some nodes do
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(servedByHeader, "backend")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		servedBy bool
+		routes   string
+		expected string
+	}{
+		{name: "flag on", servedBy: true, routes: `{}`, expected: "node-1"},
+		{name: "flag off", routes: `{}`},
+		{name: "hidden by the route", servedBy: true, routes: `{"/request": {"served_by": false}}`},
+		{name: "shown by the route", routes: `{"/request": {"served_by": true}}`, expected: "node-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{ServedBy: tt.servedBy, Routes: loadRoutes(t, tt.routes)}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Address: backend.URL, Limits: "10 req/min"}})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get(servedByHeader); got != tt.expected {
+				t.Errorf("served by %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"runtime/pprof"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+)
+
+// routingInfo collects what happened to a request on its way through the
+// balancer, so middleware wrapping the handler can report on it
+type routingInfo struct {
+	Route string
+	Node  string
+	// Client is the authenticated client identity, if authentication is on
+	Client string
+	// Tenant is the tenant the request belongs to, see isolateTenants
+	Tenant string
+	// Proxied is set once the response being written comes from a backend node
+	Proxied bool
+	// Upstream is how long the nodes took to answer, across attempts
+	Upstream time.Duration
+	// Decision is what the balancer did with the request, e.g. proxied or rate_limited
+	Decision string
+	// RejectReason is why the request was refused without reaching a node, if it was
+	RejectReason string
+	// Trace records the steps of fan-out and pipeline requests, if tracing is on
+	Trace *executionTrace
+	// Pinned is the node the request is pinned to, see pinNode
+	Pinned string
+	// DebugID tags the debug log lines of requests debug logging sampled, see debugLog
+	DebugID string
+	// dev is set in developer mode, where steps and selection are collected
+	// for the devDecisionHeader header, see devMode
+	dev       bool
+	steps     []string
+	selection *balancer.Decision
+	// wire counts the request body bytes received, before decompression,
+	// see decompressBody
+	wire *countingReader
+	// phases is the time spent in each routing phase, see timePhase
+	phases phaseTimes
+}
+
+type routingInfoKey struct{}
+
+// withRoutingInfo attaches an empty routingInfo for route to the request
+// context, and exports the time spent in each phase once the request is served.
+// The request's goroutine carries the route as a pprof label, so CPU profiles
+// tell the routes apart.
+func withRoutingInfo(route string, next http.HandlerFunc) http.HandlerFunc {
+	labels := pprof.Labels("route", route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := &routingInfo{Route: route}
+		pprof.Do(context.WithValue(r.Context(), routingInfoKey{}, info), labels, func(ctx context.Context) {
+			next(w, r.WithContext(ctx))
+		})
+		observePhases(info)
+		observeTenant(info)
+	}
+}
+
+// routingInfoFrom returns the request's routingInfo, or a throwaway one when
+// the handler runs without withRoutingInfo
+func routingInfoFrom(r *http.Request) *routingInfo {
+	if info, ok := r.Context().Value(routingInfoKey{}).(*routingInfo); ok {
+		return info
+	}
+	return &routingInfo{}
+}
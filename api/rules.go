@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// ruleSet holds the A/B routing rules in evaluation order
+type ruleSet struct {
+	mu    sync.RWMutex
+	rules []store.RoutingRule
+}
+
+func (rs *ruleSet) set(rules []store.RoutingRule) {
+	sorted := append([]store.RoutingRule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority < sorted[j].Priority
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	rs.mu.Lock()
+	rs.rules = sorted
+	rs.mu.Unlock()
+}
+
+func (rs *ruleSet) list() []store.RoutingRule {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return append([]store.RoutingRule{}, rs.rules...)
+}
+
+// group returns the node group of the first rule matching r, if any
+func (rs *ruleSet) group(r *http.Request) string {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	for _, rule := range rs.rules {
+		if matchesRule(rule, r) {
+			return rule.Group
+		}
+	}
+	return ""
+}
+
+// routeTable holds the routes received from a control plane, see
+// SetRouteTable
+type routeTable struct {
+	mu    sync.RWMutex
+	rules []GroupRule
+}
+
+// group returns the node group of the first route matching r, if any
+func (rt *routeTable) group(r *http.Request) string {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return matchGroup(rt.rules, r)
+}
+
+// SetRouteTable replaces the routes received from a control plane such as
+// an xDS server. They pick the group of requests that neither an A/B
+// routing rule nor the groups of their route match.
+func (s *Server) SetRouteTable(rules []GroupRule) error {
+	rules = append([]GroupRule(nil), rules...)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("route %d: %w", i+1, err)
+		}
+	}
+	s.routeTable.mu.Lock()
+	s.routeTable.rules = rules
+	s.routeTable.mu.Unlock()
+	return nil
+}
+
+func matchesRule(rule store.RoutingRule, r *http.Request) bool {
+	switch rule.Attribute {
+	case "header":
+		return r.Header.Get(rule.Name) == rule.Value
+	case "cookie":
+		cookie, err := r.Cookie(rule.Name)
+		return err == nil && cookie.Value == rule.Value
+	case "query":
+		return r.URL.Query().Get(rule.Name) == rule.Value
+	}
+	return false
+}
+
+func validateRule(rule store.RoutingRule) error {
+	switch rule.Attribute {
+	case "header", "cookie", "query":
+	default:
+		return fmt.Errorf("attribute must be header, cookie or query, got %q", rule.Attribute)
+	}
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if rule.Group == "" {
+		return fmt.Errorf("group is required")
+	}
+	return nil
+}
+
+// LoadRoutingRules reads the A/B routing rules from the store
+func (s *Server) LoadRoutingRules(ctx context.Context) error {
+	rules, err := s.lb.Store().RoutingRules(ctx)
+	if err != nil {
+		return err
+	}
+	s.rules.set(rules)
+	return nil
+}
+
+// handleRoutingRules lists the A/B routing rules in evaluation order
+func (s *Server) handleRoutingRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.rules.list())
+}
+
+// handleRoutingRule adds or replaces a routing rule on PUT and removes it on DELETE
+func (s *Server) handleRoutingRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		ok, err := s.lb.Store().DeleteRoutingRule(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown rule %s", id), http.StatusNotFound)
+			return
+		}
+	} else {
+		var rule store.RoutingRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule.ID = id
+		if err := validateRule(rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.lb.Store().SaveRoutingRule(r.Context(), rule); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.LoadRoutingRules(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.handleRoutingRules(w, r)
+}
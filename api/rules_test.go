@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestMatchesRule(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/resource?variant=b", nil)
+	r.Header.Set("X-Variant", "b")
+	r.AddCookie(&http.Cookie{Name: "cohort", Value: "beta"})
+	tests := []struct {
+		rule     store.RoutingRule
+		expected bool
+	}{
+		{rule: store.RoutingRule{Attribute: "header", Name: "x-variant", Value: "b"}, expected: true},
+		{rule: store.RoutingRule{Attribute: "header", Name: "X-Variant", Value: "a"}},
+		{rule: store.RoutingRule{Attribute: "header", Name: "X-Missing", Value: ""}, expected: true},
+		{rule: store.RoutingRule{Attribute: "cookie", Name: "cohort", Value: "beta"}, expected: true},
+		{rule: store.RoutingRule{Attribute: "cookie", Name: "missing", Value: ""}},
+		{rule: store.RoutingRule{Attribute: "query", Name: "variant", Value: "b"}, expected: true},
+		{rule: store.RoutingRule{Attribute: "query", Name: "Variant", Value: "b"}},
+		{rule: store.RoutingRule{Attribute: "path", Name: "/api/resource", Value: "b"}},
+	}
+	for _, tt := range tests {
+		if got := matchesRule(tt.rule, r); got != tt.expected {
+			t.Errorf("%+v: got %v, expected %v", tt.rule, got, tt.expected)
+		}
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	handler, _ := newTestServer(t, Config{ServedBy: true}, []store.NodeLimits{
+		{NodeID: "node-a", Limits: "100 req/min", Group: "a"},
+		{NodeID: "node-b", Limits: "100 req/min", Group: "b"},
+	})
+	put := func(id, rule string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/rules/"+id, strings.NewReader(rule)))
+		return w
+	}
+	servedBy := func(variant string) string {
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+		if variant != "" {
+			r.Header.Set("X-Variant", variant)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %q", w.Code, w.Body.String())
+		}
+		return w.Header().Get(servedByHeader)
+	}
+
+	if w := put("to-b", `{"attribute": "header", "name": "X-Variant", "value": "b", "group": "b", "priority": 2}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if w := put("to-a", `{"attribute": "header", "name": "X-Variant", "value": "b", "group": "a", "priority": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	var rules []store.RoutingRule
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/rules", nil))
+	if err := json.NewDecoder(w.Body).Decode(&rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].ID != "to-a" {
+		t.Fatalf("got rules %+v, expected to-a evaluated first", rules)
+	}
+	// The rule of the lowest priority wins
+	for range 5 {
+		if got := servedBy("b"); got != "node-a" {
+			t.Fatalf("served by %s, expected node-a", got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/rules/to-a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	for range 5 {
+		if got := servedBy("b"); got != "node-b" {
+			t.Fatalf("served by %s, expected node-b", got)
+		}
+	}
+	// Requests no rule matches may go to either group
+	served := map[string]bool{}
+	for range 20 {
+		served[servedBy("")] = true
+	}
+	if !served["node-a"] || !served["node-b"] {
+		t.Errorf("unmatched requests were served by %v, expected both nodes", served)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/rules/to-a", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleting an unknown rule got %d", w.Code)
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	valid := store.RoutingRule{Attribute: "cookie", Name: "cohort", Value: "beta", Group: "beta"}
+	if err := validateRule(valid); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(rule *store.RoutingRule)
+	}{
+		{name: "unknown attribute", change: func(rule *store.RoutingRule) { rule.Attribute = "path" }},
+		{name: "no name", change: func(rule *store.RoutingRule) { rule.Name = "" }},
+		{name: "no group", change: func(rule *store.RoutingRule) { rule.Group = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := valid
+			tt.change(&rule)
+			if err := validateRule(rule); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRouteExpressions(t *testing.T) {
+	routes := loadRoutes(t, `{"/request": {
+		"match": "header(\"x-region\") == \"eu\" || !has_header(\"x-region\")",
+		"groups": [{"when": "cookie(\"beta\") == \"1\"", "group": "b"}, {"when": "has_header(\"x-region\")", "group": "a"}]}}`)
+	handler, _ := newTestServer(t, Config{ServedBy: true, Routes: routes}, []store.NodeLimits{
+		{NodeID: "node-a", Limits: "100 req/min", Group: "a"},
+		{NodeID: "node-b", Limits: "100 req/min", Group: "b"},
+	})
+	tests := []struct {
+		name     string
+		region   string
+		beta     bool
+		status   int
+		servedBy string
+	}{
+		{name: "matching region", region: "eu", status: http.StatusOK, servedBy: "node-a"},
+		{name: "first group wins", region: "eu", beta: true, status: http.StatusOK, servedBy: "node-b"},
+		{name: "no region", beta: true, status: http.StatusOK, servedBy: "node-b"},
+		{name: "other region", region: "us", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 3 {
+				r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+				if tt.region != "" {
+					r.Header.Set("X-Region", tt.region)
+				}
+				if tt.beta {
+					r.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != tt.status {
+					t.Fatalf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+				}
+				if got := w.Header().Get(servedByHeader); got != tt.servedBy {
+					t.Fatalf("served by %q, expected %q", got, tt.servedBy)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteExpressionErrors(t *testing.T) {
+	for _, routes := range []string{
+		`{"/request": {"match": "header(\"x-region\") =="}}`,
+		`{"/request": {"groups": [{"when": "nope(\"x\")", "group": "a"}]}}`,
+		`{"/request": {"groups": [{"when": "has_header(\"x\")"}]}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		if err := os.WriteFile(path, []byte(routes), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRouteConfig(path); err == nil {
+			t.Errorf("%s: expected an error", routes)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rejectBanned is the reject reason of requests from a banned source IP
+const rejectBanned = "ip_banned"
+
+// protect refuses the requests of banned source IPs with 429, counting the
+// others toward their IP's request rate, see shield.Shield. It must run
+// inside withRoutingInfo.
+func (s *Server) protect(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.Shield == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		ok, retryAfter := s.config.Shield.Request(ip, time.Now())
+		if ok {
+			next(w, r)
+			return
+		}
+		info := routingInfoFrom(r)
+		info.Decision = "banned"
+		countRejection(w, r, rejectBanned)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(retryAfter))))
+		if isGRPC(r, nil) {
+			grpcError(w, grpcResourceExhausted, "source IP banned")
+			return
+		}
+		http.Error(w, "Too many requests from your IP address. Retry later.", http.StatusTooManyRequests)
+	}
+}
+
+// handleBans lists the banned source IPs
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	if s.config.Shield == nil {
+		http.Error(w, "The shield is off.", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.config.Shield.Bans(time.Now()))
+}
+
+// handleBan bans a source IP on PUT for the given minutes and lifts its ban
+// on DELETE
+func (s *Server) handleBan(w http.ResponseWriter, r *http.Request) {
+	if s.config.Shield == nil {
+		http.Error(w, "The shield is off.", http.StatusNotImplemented)
+		return
+	}
+	ip := mux.Vars(r)["ip"]
+	if _, err := netip.ParseAddr(ip); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid IP %s", ip), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if !s.config.Shield.Unban(ip, time.Now()) {
+			http.Error(w, fmt.Sprintf("IP %s is not banned", ip), http.StatusNotFound)
+			return
+		}
+		log.Printf("lifted the ban of %s", ip)
+	} else {
+		var body struct {
+			Minutes float64 `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Minutes <= 0 {
+			http.Error(w, "minutes must be above 0", http.StatusBadRequest)
+			return
+		}
+		ban := s.config.Shield.Ban(ip, time.Duration(body.Minutes*float64(time.Minute)), time.Now())
+		log.Printf("banned %s until %s", ip, ban.Until.Format(time.RFC3339))
+	}
+	s.handleBans(w, r)
+}
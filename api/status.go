@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+)
+
+// dashboardPage is the status page served on /admin/dashboard, which polls
+// /admin/status
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// statusInterval is how often GET /admin/status streams a snapshot by default
+const statusInterval = 2 * time.Second
+
+// poolStatus struct represents the status of the balancer and its nodes
+type poolStatus struct {
+	Time  time.Time             `json:"time"`
+	Nodes []balancer.NodeStatus `json:"nodes"`
+	// Global is the state of the global limits, if any
+	Global      *balancer.Quota   `json:"global,omitempty"`
+	Degradation degradationStatus `json:"degradation"`
+	// CostTiers sums up the nodes by cost, when they have one
+	CostTiers []balancer.CostTier `json:"cost_tiers,omitempty"`
+}
+
+func (s *Server) status(ctx context.Context) (poolStatus, error) {
+	nodes, err := s.lb.Status(ctx)
+	if err != nil {
+		return poolStatus{}, err
+	}
+	status := poolStatus{Time: time.Now(), Nodes: nodes, Degradation: s.degradation.status()}
+	if tiers := balancer.CostTiers(nodes); len(tiers) > 1 || len(tiers) == 1 && tiers[0].Cost != 0 {
+		status.CostTiers = tiers
+	}
+	global, ok, err := s.lb.GlobalQuota(ctx)
+	if err != nil {
+		return poolStatus{}, err
+	}
+	if ok {
+		status.Global = &global
+	}
+	return status, nil
+}
+
+// handleStatus reports the state, limit windows, in-flight requests and
+// error rate of every node. Requests accepting text/event-stream get a new
+// snapshot every ?interval= (2s) as server-sent events instead.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		status, err := s.status(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	interval := statusInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < time.Second {
+			http.Error(w, "interval must be a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+	}
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := s.status(r.Context())
+		if err == nil {
+			data, _ := json.Marshal(status)
+			_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		} else {
+			_, err = fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+		}
+		if err != nil || rc.Flush() != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleDashboard serves the status page
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestHandleStatus(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{
+		{NodeID: "node-2", Limits: "10 req/min"},
+		{NodeID: "node-1", Limits: "1 req/min"},
+	}, store.Record{NodeID: "node-1", Operation: "POST /request", Timestamp: time.Now().Add(-time.Second)})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	var status poolStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Nodes) != 2 || status.Nodes[0].NodeID != "node-1" || status.Nodes[1].NodeID != "node-2" {
+		t.Fatalf("got nodes %+v, expected node-1 and node-2 in order", status.Nodes)
+	}
+	if node := status.Nodes[0]; node.State != balancer.StateUp || node.Utilization != 1 {
+		t.Errorf("got %+v, expected node-1 up at its limit", node)
+	}
+	if node := status.Nodes[1]; node.State != balancer.StateUp || node.Utilization != 0 {
+		t.Errorf("got %+v, expected node-2 up and idle", node)
+	}
+	if status.Global != nil || status.CostTiers != nil {
+		t.Errorf("got global %+v and cost tiers %+v without either configured", status.Global, status.CostTiers)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/dashboard", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("got %d %s for the dashboard, expected an HTML page", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestStreamStatus(t *testing.T) {
+	handler, _ := newTestServer(t, Config{}, []store.NodeLimits{{NodeID: "node-1", Limits: "10 req/min"}})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, interval := range []string{"fast", "10ms"} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/status?interval="+interval, nil)
+		r.Header.Set("Accept", "text/event-stream")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got %d for interval %s, expected 400", w.Code, interval)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/admin/status", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got content type %q, expected an event stream", got)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() || scanner.Text() != "event: status" || !scanner.Scan() {
+		t.Fatalf("got %q, expected a status event", scanner.Text())
+	}
+	var status poolStatus
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Nodes) != 1 || status.Nodes[0].NodeID != "node-1" {
+		t.Errorf("got nodes %+v, expected node-1", status.Nodes)
+	}
+}
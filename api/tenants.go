@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// rejectTenantQuota is the reject reason of requests over their tenant's quota
+const rejectTenantQuota = "tenant_quota"
+
+// tenantSet holds the tenants, the clients mapped to them and their quotas
+type tenantSet struct {
+	mu       sync.RWMutex
+	tenants  map[string]store.Tenant
+	byClient map[string]string
+	quotas   map[string][]balancer.Window
+}
+
+func (ts *tenantSet) set(tenants []store.Tenant) {
+	byID := make(map[string]store.Tenant, len(tenants))
+	byClient := map[string]string{}
+	quotas := map[string][]balancer.Window{}
+	for _, tenant := range tenants {
+		byID[tenant.ID] = tenant
+		for _, client := range tenant.Clients {
+			byClient[client] = tenant.ID
+		}
+		if tenant.Quota == "" {
+			continue
+		}
+		windows, err := balancer.ParseLimits(tenant.Quota)
+		if err != nil {
+			log.Printf("tenant %s: ignoring quota: %v", tenant.ID, err)
+			continue
+		}
+		quotas[tenant.ID] = windows
+	}
+	ts.mu.Lock()
+	ts.tenants, ts.byClient, ts.quotas = byID, byClient, quotas
+	ts.mu.Unlock()
+}
+
+func (ts *tenantSet) list() []store.Tenant {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	tenants := make([]store.Tenant, 0, len(ts.tenants))
+	for _, tenant := range ts.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
+
+// resolve returns the tenant of a request from client, or else from header,
+// the value of the tenant header; known is false for a tenant that does not
+// exist
+func (ts *tenantSet) resolve(client, header string) (tenant string, known bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if tenant, ok := ts.byClient[client]; ok && client != "" {
+		return tenant, true
+	}
+	if header == "" {
+		return "", true
+	}
+	_, ok := ts.tenants[header]
+	return header, ok
+}
+
+func (ts *tenantSet) quota(tenant string) []balancer.Window {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.quotas[tenant]
+}
+
+// LoadTenants reads the tenants from the store and restricts the node pools
+// of their requests
+func (s *Server) LoadTenants(ctx context.Context) error {
+	if s.config.Tenants == nil {
+		return nil
+	}
+	tenants, err := s.config.Tenants.Tenants(ctx)
+	if err != nil {
+		return err
+	}
+	s.tenants.set(tenants)
+	s.lb.SetTenants(tenants)
+	return nil
+}
+
+// isolateTenants attaches the tenant of a request to its routingInfo: the
+// tenant of its authenticated client, or else, when requests are not
+// authenticated, the one named in the tenant header. Requests naming an unknown tenant get 403, and requests over their
+// tenant's quota 429. Quotas are counted in fixed windows in the store, and
+// requests are let through when it fails. It must run inside authenticate,
+// so the client is known.
+func (s *Server) isolateTenants(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.Tenants == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := routingInfoFrom(r)
+		header := ""
+		if s.config.TenantHeader != "" && s.config.Auth == nil {
+			header = r.Header.Get(s.config.TenantHeader)
+		}
+		tenant, known := s.tenants.resolve(info.Client, header)
+		if !known {
+			info.Decision = "unknown_tenant"
+			if isGRPC(r, nil) {
+				grpcError(w, grpcPermissionDenied, "unknown tenant")
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unknown tenant %s", tenant), http.StatusForbidden)
+			return
+		}
+		info.Tenant = tenant
+
+		quota := s.tenants.quota(tenant)
+		if len(quota) == 0 || s.config.TenantQuotas == nil {
+			next(w, r)
+			return
+		}
+		started := time.Now()
+		retryAfter, err := s.countTenantRequest(r.Context(), tenant, quota, started)
+		info.timePhase(phaseLimits, started)
+		if err != nil {
+			log.Printf("counting tenant requests: %v", err)
+		}
+		if retryAfter <= 0 {
+			next(w, r)
+			return
+		}
+
+		s.debugf(r, "tenant %s is over its quota, retry in %s", tenant, retryAfter)
+		info.Decision = "rate_limited"
+		countRejection(w, r, rejectTenantQuota)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(retryAfter))))
+		if isGRPC(r, nil) {
+			grpcError(w, grpcResourceExhausted, "tenant quota exceeded")
+			return
+		}
+		s.writeError(w, r, ConditionRateLimited, http.StatusTooManyRequests, "Your tenant is over its quota. Retry later.")
+	}
+}
+
+// countTenantRequest counts a request of tenant in the current fixed window
+// of every period of its quota, returning how long until the latest window
+// it went over ends, or zero when it is within its quota
+func (s *Server) countTenantRequest(ctx context.Context, tenant string, quota []balancer.Window, now time.Time) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, window := range quota {
+		start := now.Truncate(window.Period)
+		key := fmt.Sprintf("tenant:%s:%d:%d", tenant, int64(window.Period/time.Second), start.Unix())
+		count, err := s.config.TenantQuotas.IncrementCounter(ctx, key, start.Add(window.Period))
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(window.Limit) {
+			retryAfter = max(retryAfter, start.Add(window.Period).Sub(now))
+		}
+	}
+	return retryAfter, nil
+}
+
+// observeTenant counts the request of a tenant by decision
+func observeTenant(info *routingInfo) {
+	if info.Tenant != "" {
+		metrics.TenantRequests.WithLabelValues(info.Tenant, info.Decision).Inc()
+	}
+}
+
+// handleTenants lists the tenants
+func (s *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.tenants.list())
+}
+
+// handleTenant adds or replaces a tenant on PUT and removes it on DELETE
+func (s *Server) handleTenant(w http.ResponseWriter, r *http.Request) {
+	if s.config.Tenants == nil {
+		http.Error(w, "The store cannot keep tenants.", http.StatusNotImplemented)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		ok, err := s.config.Tenants.DeleteTenant(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown tenant %s", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("deleted tenant %s", id)
+	} else {
+		var tenant store.Tenant
+		if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tenant.ID = id
+		if err := balancer.ValidateTenant(tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, other := range s.tenants.list() {
+			for _, client := range tenant.Clients {
+				if other.ID != id && slices.Contains(other.Clients, client) {
+					http.Error(w, fmt.Sprintf("Client %s already belongs to tenant %s", client, other.ID), http.StatusConflict)
+					return
+				}
+			}
+		}
+		if err := s.config.Tenants.SaveTenant(r.Context(), tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("saved tenant %s", id)
+	}
+
+	if err := s.LoadTenants(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.handleTenants(w, r)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestIsolateTenants(t *testing.T) {
+	apiKeys := auth.New(auth.Config{APIKeys: map[string]string{"key-a": "client-a", "key-b": "client-b"}})
+	tests := []struct {
+		name   string
+		auth   *auth.Authenticator
+		header http.Header
+		// status is 429 for requests of the tenant acme, which has no quota
+		// left, 403 for unknown tenants and 200 for requests of no tenant
+		status int
+	}{
+		{name: "no tenant", header: http.Header{}, status: http.StatusOK},
+		{name: "tenant header", header: http.Header{"X-Tenant": {"acme"}}, status: http.StatusTooManyRequests},
+		{name: "unknown tenant header", header: http.Header{"X-Tenant": {"other"}}, status: http.StatusForbidden},
+		{name: "mapped client", auth: apiKeys, header: http.Header{"X-Api-Key": {"key-a"}}, status: http.StatusTooManyRequests},
+		{name: "mapped client naming another tenant", auth: apiKeys, header: http.Header{"X-Api-Key": {"key-a"}, "X-Tenant": {"other"}}, status: http.StatusTooManyRequests},
+		{name: "unmapped client naming a tenant", auth: apiKeys, header: http.Header{"X-Api-Key": {"key-b"}, "X-Tenant": {"acme"}}, status: http.StatusOK},
+		{name: "unmapped client naming an unknown tenant", auth: apiKeys, header: http.Header{"X-Api-Key": {"key-b"}, "X-Tenant": {"other"}}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemoryStore(store.NodeLimits{NodeID: "node-1", Limits: "100 req/min"})
+			if err := s.SaveTenant(ctx, store.Tenant{ID: "acme", Quota: "0 req/min", Clients: []string{"client-a"}}); err != nil {
+				t.Fatal(err)
+			}
+			lb := balancer.New(s)
+			if err := lb.LoadNodes(ctx); err != nil {
+				t.Fatal(err)
+			}
+			server := NewServer(lb, proxy.New(nil), Config{Auth: tt.auth, Tenants: s, TenantHeader: "X-Tenant", TenantQuotas: s})
+			if err := server.LoadTenants(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			server.Handler().ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(store.NodeLimits{NodeID: "node-1", Limits: "100 req/min"})
+	for _, tenant := range []store.Tenant{{ID: "acme", Quota: "2 req/h"}, {ID: "globex", Quota: "5 req/h"}} {
+		if err := s.SaveTenant(ctx, tenant); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lb := balancer.New(s)
+	if err := lb.LoadNodes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(lb, proxy.New(nil), Config{Tenants: s, TenantHeader: "X-Tenant", TenantQuotas: s})
+	if err := server.LoadTenants(ctx); err != nil {
+		t.Fatal(err)
+	}
+	handler := server.Handler()
+	send := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`))
+		r.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := range 2 {
+		if w := send("acme"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within the quota got %d %q", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := send("acme")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the quota got %d %q", w.Code, w.Body.String())
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 3600 {
+		t.Errorf("got Retry-After %q, expected the end of the hour", w.Header().Get("Retry-After"))
+	}
+	if w := send("globex"); w.Code != http.StatusOK {
+		t.Errorf("another tenant got %d", w.Code)
+	}
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Headers of execution traces
+const (
+	requestIDHeader = "X-Request-ID"
+	// traceRequestHeader asks for the compact trace in traceHeader
+	traceRequestHeader = "X-Trace"
+	traceHeader        = "X-Execution-Trace"
+)
+
+// executionTrace struct represents how a fan-out or pipeline request was
+// executed, step by step
+type executionTrace struct {
+	RequestID string      `json:"request_id"`
+	Route     string      `json:"route"`
+	Method    string      `json:"method"`
+	Started   time.Time   `json:"started"`
+	Duration  float64     `json:"duration_ms"`
+	Status    int         `json:"status"`
+	Steps     []traceStep `json:"steps"`
+
+	mu sync.Mutex
+}
+
+// traceStep struct represents one call to a node: a pipeline stage, its
+// compensation or one node of a fan-out
+type traceStep struct {
+	Stage   string  `json:"stage,omitempty"`
+	Node    string  `json:"node,omitempty"`
+	Status  int     `json:"status,omitempty"`
+	Latency float64 `json:"latency_ms"`
+	// Outcome is succeeded, failed, skipped, compensated or compensation_failed
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// add appends a step; it is a no-op on a nil trace, so handlers need not
+// check whether tracing is on
+func (t *executionTrace) add(step traceStep) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.Steps = append(t.Steps, step)
+	t.mu.Unlock()
+}
+
+// compact renders the steps as stage=node:status:latency pairs
+func (t *executionTrace) compact() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.Steps))
+	for _, step := range t.Steps {
+		name := step.Stage
+		if name == "" {
+			name = step.Node
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s:%d:%s:%.0fms", name, step.Node, step.Status, step.Outcome, step.Latency))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// traceBuffer keeps the most recent traces by request ID
+type traceBuffer struct {
+	mu     sync.Mutex
+	max    int
+	order  []string
+	traces map[string]*executionTrace
+}
+
+func newTraceBuffer(max int) *traceBuffer {
+	return &traceBuffer{max: max, traces: map[string]*executionTrace{}}
+}
+
+func (b *traceBuffer) add(t *executionTrace) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.traces[t.RequestID]; !ok {
+		b.order = append(b.order, t.RequestID)
+	}
+	b.traces[t.RequestID] = t
+	for len(b.order) > b.max {
+		delete(b.traces, b.order[0])
+		b.order = b.order[1:]
+	}
+}
+
+func (b *traceBuffer) get(id string) (*executionTrace, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.traces[id]
+	return t, ok
+}
+
+// recent returns the request IDs of the buffered traces, newest first
+func (b *traceBuffer) recent() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, len(b.order))
+	for i, id := range b.order {
+		ids[len(ids)-1-i] = id
+	}
+	return ids
+}
+
+// requestID returns the client's X-Request-ID or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceExecution records the execution trace of a composite route. The
+// request ID is echoed in X-Request-ID, and clients sending X-Trace get the
+// compact trace in X-Execution-Trace. It must run inside withRoutingInfo.
+func (s *Server) traceExecution(next http.HandlerFunc) http.HandlerFunc {
+	if s.traces == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := routingInfoFrom(r)
+		trace := &executionTrace{RequestID: requestID(r), Route: info.Route, Method: r.Method, Started: time.Now(), Steps: []traceStep{}}
+		info.Trace = trace
+		r.Header.Set(requestIDHeader, trace.RequestID)
+		w.Header().Set(requestIDHeader, trace.RequestID)
+
+		tw := &traceWriter{ResponseWriter: w, trace: trace, compact: r.Header.Get(traceRequestHeader) != ""}
+		next(tw, r)
+
+		trace.mu.Lock()
+		trace.Duration = milliseconds(time.Since(trace.Started))
+		trace.Status = tw.status
+		trace.mu.Unlock()
+		s.traces.add(trace)
+	}
+}
+
+// traceWriter adds the compact trace to the response headers once the
+// handler writes them, by which time every step has run
+type traceWriter struct {
+	http.ResponseWriter
+	trace   *executionTrace
+	compact bool
+	status  int
+}
+
+func (tw *traceWriter) WriteHeader(status int) {
+	if tw.status == 0 {
+		tw.status = status
+		if tw.compact {
+			tw.Header().Set(traceHeader, tw.trace.compact())
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *traceWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *traceWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// handleTraces lists the request IDs of the buffered traces, newest first
+func (s *Server) handleTraces(w http.ResponseWriter, r *http.Request) {
+	ids := []string{}
+	if s.traces != nil {
+		ids = s.traces.recent()
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
+
+// handleTrace returns the execution trace of one request
+func (s *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if s.traces == nil {
+		http.Error(w, "Execution traces are disabled.", http.StatusNotFound)
+		return
+	}
+	trace, ok := s.traces.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown request %s", id), http.StatusNotFound)
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	writeJSON(w, http.StatusOK, trace)
+}
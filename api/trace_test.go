@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestTraceBuffer(t *testing.T) {
+	b := newTraceBuffer(2)
+	for _, id := range []string{"a", "b", "c"} {
+		b.add(&executionTrace{RequestID: id})
+	}
+	if _, ok := b.get("a"); ok {
+		t.Error("the oldest trace was kept beyond the buffer")
+	}
+	if got := b.recent(); !slices.Equal(got, []string{"c", "b"}) {
+		t.Errorf("got %v, expected c then b", got)
+	}
+}
+
+func TestTraceExecution(t *testing.T) {
+	failing := stageBackend(t, "failed", http.StatusInternalServerError)
+	enrich := stageBackend(t, "enriched", http.StatusOK)
+	config := Config{
+		TraceBuffer: 10,
+		Routes:      loadRoutes(t, `{"/orders": {"pipeline": {"stages": [{"name": "check", "group": "failing", "on_failure": "skip"}, {"name": "enrich", "group": "enrich"}]}}}`),
+	}
+	handler, _ := newTestServer(t, config, []store.NodeLimits{
+		{NodeID: "failing-1", Group: "failing", Address: failing.URL, Limits: "100 req/min"},
+		{NodeID: "enrich-1", Group: "enrich", Address: enrich.URL, Limits: "100 req/min"},
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"bpm": 1}`))
+	r.Header.Set(requestIDHeader, "order-1")
+	r.Header.Set(traceRequestHeader, "1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(requestIDHeader); got != "order-1" {
+		t.Errorf("got request ID %q, expected the client's", got)
+	}
+	compact := w.Header().Get(traceHeader)
+	if !strings.HasPrefix(compact, "check=failing-1:500:skipped:") || !strings.Contains(compact, ", enrich=enrich-1:200:succeeded:") {
+		t.Errorf("got trace %q, expected check skipped then enrich", compact)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/traces", nil))
+	var ids []string
+	if err := json.NewDecoder(w.Body).Decode(&ids); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"order-1"}) {
+		t.Errorf("got traces %v, expected order-1", ids)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/traces/order-1", nil))
+	var trace executionTrace
+	if err := json.NewDecoder(w.Body).Decode(&trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.Route != "/orders" || trace.Status != http.StatusOK || len(trace.Steps) != 2 || trace.Steps[1].Outcome != "succeeded" {
+		t.Errorf("got %s answering %d with steps %+v, expected the two steps of /orders", trace.Route, trace.Status, trace.Steps)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/traces/order-2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown request, expected 404", w.Code)
+	}
+}
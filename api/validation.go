@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// CompileSchemas compiles the schema file attached to each route
+func CompileSchemas(files map[string]string) (map[string]*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	schemas := make(map[string]*jsonschema.Schema, len(files))
+	for route, file := range files {
+		schema, err := compiler.Compile(file)
+		if err != nil {
+			return nil, fmt.Errorf("schema for route %s: %w", route, err)
+		}
+		schemas[route] = schema
+	}
+	return schemas, nil
+}
+
+// readBody reads the request body, answering 413 when it goes over the
+// route's size limit and 400 when it cannot be read
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		routingInfoFrom(r).Decision = "request_too_large"
+		http.Error(w, fmt.Sprintf("Request body is larger than %d bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// checkRequest refuses requests whose body is over the route's size limit
+// with 413 and whose Content-Type the route does not accept with 415, before
+// the body is read. Bodies of unknown length are cut off at the limit as
+// they are read, see readBody.
+func (s *Server) checkRequest(route string, next http.HandlerFunc) http.HandlerFunc {
+	limit := s.maxRequestBytes(route)
+	contentTypes := s.config.Routes[route].ContentTypes
+	if _, ok := s.config.RequestSchemas[route]; ok && len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	if limit <= 0 && len(contentTypes) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := routingInfoFrom(r)
+		if limit > 0 && r.ContentLength > limit {
+			info.Decision = "request_too_large"
+			http.Error(w, fmt.Sprintf("Request body is larger than %d bytes.", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if len(contentTypes) > 0 && r.ContentLength != 0 && !acceptsContentType(contentTypes, r.Header.Get("Content-Type")) {
+			info.Decision = "invalid"
+			http.Error(w, fmt.Sprintf("Content-Type must be one of %s.", strings.Join(contentTypes, ", ")), http.StatusUnsupportedMediaType)
+			return
+		}
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// acceptsContentType reports whether the media type of header, parameters
+// such as charset aside, is one of contentTypes
+func acceptsContentType(contentTypes []string, header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, contentType := range contentTypes {
+		if accepted, _, _ := mime.ParseMediaType(contentType); accepted == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBody rejects requests whose body does not match the schema with 422
+// before the request reaches node selection, so malformed traffic never
+// consumes backend quota.
+func validateBody(schema *jsonschema.Schema, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := schema.Validate(document); err != nil {
+			response := map[string]interface{}{"status": "error", "message": "Request body does not match the route schema"}
+			if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+				response["errors"] = validationErr.BasicOutput().Errors
+			} else {
+				response["errors"] = []string{err.Error()}
+			}
+			routingInfoFrom(r).Decision = "invalid"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// responseRecorder passes a response through to the client while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// validateResponse checks proxied backend responses against the schema. Clients
+// always get the response unchanged; violations are only logged and counted so
+// backend regressions show up without breaking traffic.
+func validateResponse(schema *jsonschema.Schema, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		info := routingInfoFrom(r)
+		if !info.Proxied {
+			return
+		}
+
+		var document interface{}
+		err := json.Unmarshal(rec.body.Bytes(), &document)
+		if err == nil {
+			err = schema.Validate(document)
+		}
+		if err != nil {
+			metrics.ResponseContractViolations.WithLabelValues(info.Route, info.Node).Inc()
+			log.Printf("warning: response from node %s on %s (status %d) violates the response schema: %v", info.Node, info.Route, rec.status, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestCheckRequest(t *testing.T) {
+	large := `{"bpm": 1, "note": "` + strings.Repeat("x", 200) + `"}`
+	tests := []struct {
+		name        string
+		routes      string
+		body        string
+		contentType string
+		status      int
+	}{
+		{name: "within limit", routes: `{}`, body: `{"bpm": 1}`, status: http.StatusOK},
+		{name: "too large", routes: `{}`, body: large, status: http.StatusRequestEntityTooLarge},
+		{name: "route limit", routes: `{"/request": {"max_request_bytes": 1000}}`, body: large, status: http.StatusOK},
+		{name: "route unbounded", routes: `{"/request": {"max_request_bytes": 0}}`, body: large, status: http.StatusOK},
+		{name: "content type", routes: `{"/request": {"content_types": ["application/json"]}}`, body: `{"bpm": 1}`, contentType: "application/json; charset=utf-8", status: http.StatusOK},
+		{name: "wrong content type", routes: `{"/request": {"content_types": ["application/json"]}}`, body: `{"bpm": 1}`, contentType: "text/plain", status: http.StatusUnsupportedMediaType},
+		{name: "missing content type", routes: `{"/request": {"content_types": ["application/json"]}}`, body: `{"bpm": 1}`, status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{MaxRequestBytes: 100, Routes: loadRoutes(t, tt.routes)}
+			handler, _ := newTestServer(t, config, []store.NodeLimits{{NodeID: "node-1", Limits: "100 req/min"}})
+			req := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestRequestLimitConfig(t *testing.T) {
+	for _, routes := range []string{
+		`{"/request": {"max_request_bytes": -1}}`,
+		`{"/request": {"content_types": ["json;;"]}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		if err := os.WriteFile(path, []byte(routes), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRouteConfig(path); err == nil {
+			t.Errorf("%s was accepted", routes)
+		}
+	}
+}
+
+// writeSchema writes a JSON schema to a file and compiles it for route
+func writeSchema(t *testing.T, route, schema string) map[string]*jsonschema.Schema {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := CompileSchemas(map[string]string{route: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schemas
+}
+
+func TestRequestSchema(t *testing.T) {
+	schemas := writeSchema(t, "/request", `{"type": "object", "required": ["bpm"], "properties": {"bpm": {"type": "integer", "minimum": 1}}}`)
+	handler, s := newTestServer(t, Config{RequestSchemas: schemas}, []store.NodeLimits{{NodeID: "node-1", Limits: "100 req/min"}})
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		status      int
+	}{
+		{name: "valid", body: `{"bpm": 2}`, contentType: "application/json", status: http.StatusOK},
+		{name: "invalid", body: `{"bpm": 0}`, contentType: "application/json", status: http.StatusUnprocessableEntity},
+		{name: "missing field", body: `{}`, contentType: "application/json", status: http.StatusUnprocessableEntity},
+		{name: "not JSON", body: `bpm=2`, contentType: "application/json", status: http.StatusBadRequest},
+		{name: "not a JSON content type", body: `{"bpm": 2}`, contentType: "text/plain", status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("got %d %q, expected %d", w.Code, w.Body.String(), tt.status)
+			}
+			if w.Code == http.StatusUnprocessableEntity && !strings.Contains(w.Body.String(), `"errors"`) {
+				t.Errorf("got %s, expected the schema errors", w.Body.String())
+			}
+		})
+	}
+	// Only the valid request reached a node
+	usage, err := s.Usage(context.Background(), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["node-1"].Requests != 1 {
+		t.Errorf("got %d requests on node-1, expected 1", usage["node-1"].Requests)
+	}
+}
+
+func TestResponseSchema(t *testing.T) {
+	schemas := writeSchema(t, "/request", `{"type": "object", "required": ["id"]}`)
+	tests := []struct {
+		name      string
+		response  string
+		violation bool
+	}{
+		{name: "valid", response: `{"id": 1}`},
+		{name: "missing field", response: `{"name": "x"}`, violation: true},
+		{name: "not JSON", response: `ok`, violation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.response)
+			}))
+			defer backend.Close()
+			nodeID := "node-" + strings.ReplaceAll(tt.name, " ", "-")
+			handler, _ := newTestServer(t, Config{ResponseSchemas: schemas}, []store.NodeLimits{{NodeID: nodeID, Address: backend.URL, Limits: "100 req/min"}})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(`{"bpm": 1}`)))
+			// The client gets the response whatever the schema says
+			if w.Code != http.StatusOK || w.Body.String() != tt.response {
+				t.Errorf("got %d %q, expected the node's response", w.Code, w.Body.String())
+			}
+			violations := counterValue(t, "lb_response_contract_violations_total", map[string]string{"route": "/request", "node": nodeID})
+			if (violations == 1) != tt.violation {
+				t.Errorf("counted %g violations, expected one: %t", violations, tt.violation)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Role is what an admin token may do
+type Role int
+
+const (
+	// RoleViewer may read the admin API
+	RoleViewer Role = iota + 1
+	// RoleOperator may change the balancer's state as well
+	RoleOperator
+)
+
+// ParseRole parses viewer or operator
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	}
+	return 0, fmt.Errorf("unknown role %q, expected viewer or operator", s)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	}
+	return "none"
+}
+
+// ErrForbidden is returned for valid admin tokens lacking the required role
+var ErrForbidden = errors.New("insufficient role")
+
+// AdminAuthorizer checks the bearer tokens of admin API requests
+type AdminAuthorizer struct {
+	tokens map[[sha256.Size]byte]Role
+}
+
+// NewAdminAuthorizer returns an authorizer granting each token its role
+func NewAdminAuthorizer(tokens map[string]Role) *AdminAuthorizer {
+	a := &AdminAuthorizer{tokens: make(map[[sha256.Size]byte]Role, len(tokens))}
+	for token, role := range tokens {
+		a.tokens[sha256.Sum256([]byte(token))] = role
+	}
+	return a
+}
+
+// Authorize returns ErrUnauthenticated for requests without a known token
+// and ErrForbidden for tokens whose role is below need
+func (a *AdminAuthorizer) Authorize(r *http.Request, need Role) (Role, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return 0, ErrUnauthenticated
+	}
+	return a.AuthorizeToken(token, need)
+}
+
+// AuthorizeToken checks an admin token given some other way than as the
+// bearer token, like Authorize
+func (a *AdminAuthorizer) AuthorizeToken(token string, need Role) (Role, error) {
+	if token == "" {
+		return 0, ErrUnauthenticated
+	}
+	role, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return 0, ErrUnauthenticated
+	}
+	if role < need {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
+
+// ReadAdminTokensFile reads a JSON object mapping admin tokens to roles, e.g.
+//
+//	{"9c1e...": "viewer", "b07d...": "operator"}
+func ReadAdminTokensFile(path string) (map[string]Role, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]Role, len(names))
+	for token, name := range names {
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, err
+		}
+		tokens[token] = role
+	}
+	return tokens, nil
+}
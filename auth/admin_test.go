@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminAuthorizer(t *testing.T) {
+	a := NewAdminAuthorizer(map[string]Role{"view-token": RoleViewer, "operate-token": RoleOperator})
+	tests := []struct {
+		name          string
+		authorization string
+		need          Role
+		err           error
+	}{
+		{name: "viewer reads", authorization: "Bearer view-token", need: RoleViewer},
+		{name: "viewer writes", authorization: "Bearer view-token", need: RoleOperator, err: ErrForbidden},
+		{name: "operator writes", authorization: "Bearer operate-token", need: RoleOperator},
+		{name: "unknown token", authorization: "Bearer guess", need: RoleViewer, err: ErrUnauthenticated},
+		{name: "empty token", authorization: "Bearer ", need: RoleViewer, err: ErrUnauthenticated},
+		{name: "not a bearer token", authorization: "view-token", need: RoleViewer, err: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/nodes", nil)
+			r.Header.Set("Authorization", tt.authorization)
+			if _, err := a.Authorize(r, tt.need); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadAdminTokensFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "tokens.json")
+	if err := os.WriteFile(valid, []byte(`{"a": "viewer", "b": "operator"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ReadAdminTokensFile(valid)
+	if err != nil || len(tokens) != 2 || tokens["a"] != RoleViewer || tokens["b"] != RoleOperator {
+		t.Errorf("got %v, %v, expected a viewer and an operator", tokens, err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"a": "admin"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadAdminTokensFile(invalid); err == nil {
+		t.Error("an unknown role was accepted")
+	}
+}
@@ -0,0 +1,85 @@
+// Package auth authenticates clients with static API keys or JWTs.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrUnauthenticated is returned for requests without any credentials
+var ErrUnauthenticated = errors.New("no credentials")
+
+// Identity struct represents an authenticated client
+type Identity struct {
+	// Client is the name of the API key's client or the JWT subject
+	Client string
+	// Method is api-key or jwt
+	Method string
+}
+
+// Config struct represents the accepted credentials. Either may be empty.
+type Config struct {
+	// APIKeys maps API keys, sent in the X-API-Key header, to client names
+	APIKeys map[string]string
+	// JWT validates bearer tokens in the Authorization header, if set
+	JWT *JWTValidator
+}
+
+// Authenticator checks the credentials of incoming requests
+type Authenticator struct {
+	// apiKeys is keyed by the SHA-256 of each key, so lookups do not leak key prefixes through timing
+	apiKeys map[[sha256.Size]byte]string
+	jwt     *JWTValidator
+}
+
+// New returns an authenticator accepting the credentials of config
+func New(config Config) *Authenticator {
+	a := &Authenticator{apiKeys: make(map[[sha256.Size]byte]string, len(config.APIKeys)), jwt: config.JWT}
+	for key, client := range config.APIKeys {
+		a.apiKeys[sha256.Sum256([]byte(key))] = client
+	}
+	return a
+}
+
+// Authenticate returns the identity of the client sending r
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		client, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return Identity{}, errors.New("unknown API key")
+		}
+		return Identity{Client: client, Method: "api-key"}, nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	if a.jwt == nil {
+		return Identity{}, errors.New("bearer tokens are not accepted")
+	}
+	claims, err := a.jwt.Validate(r.Context(), token)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Client: claims.Subject, Method: "jwt"}, nil
+}
+
+// ReadAPIKeysFile reads a JSON object mapping API keys to client names, e.g.
+//
+//	{"3f9a...": "billing-service"}
+func ReadAPIKeysFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
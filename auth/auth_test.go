@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	j := newJWKS(t)
+	tests := []struct {
+		name   string
+		jwt    bool
+		header http.Header
+		client string
+		method string
+		err    error
+	}{
+		{name: "api key", header: http.Header{"X-Api-Key": {"key-a"}}, client: "client-a", method: "api-key"},
+		{name: "unknown api key", header: http.Header{"X-Api-Key": {"key-b"}}},
+		{name: "no credentials", header: http.Header{}, err: ErrUnauthenticated},
+		{name: "not a bearer token", header: http.Header{"Authorization": {"Basic a2V5"}}, err: ErrUnauthenticated},
+		{name: "bearer without jwt", header: http.Header{"Authorization": {"Bearer " + j.sign(t, "ES256", "key-1", validClaims())}}},
+		{name: "bearer", jwt: true, header: http.Header{"Authorization": {"Bearer " + j.sign(t, "ES256", "key-1", validClaims())}}, client: "client-a", method: "jwt"},
+		{name: "api key before bearer", jwt: true, header: http.Header{"X-Api-Key": {"key-a"}, "Authorization": {"Bearer invalid"}}, client: "client-a", method: "api-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{APIKeys: map[string]string{"key-a": "client-a"}}
+			if tt.jwt {
+				config.JWT = NewJWTValidator("issuer", "lb", j.server.URL)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			identity, err := New(config).Authenticate(r)
+			if tt.client == "" {
+				if err == nil {
+					t.Errorf("authenticated %+v", identity)
+				} else if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("got %v, expected %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || identity != (Identity{Client: tt.client, Method: tt.method}) {
+				t.Errorf("got %+v, %v, expected %s by %s", identity, err, tt.client, tt.method)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Claims struct represents the registered claims the validator checks
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// audience accepts the aud claim as a single string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// jwksRefreshInterval is how often the key set is fetched again
+const jwksRefreshInterval = time.Hour
+
+// jwksMinRefresh is the minimum time between fetch attempts, whether they
+// failed or were triggered by unknown key IDs
+const jwksMinRefresh = time.Minute
+
+// JWTValidator validates RS256 and ES256 tokens signed by the keys published
+// at a JWKS URL
+type JWTValidator struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	client   *http.Client
+
+	fetches singleflight.Group
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// NewJWTValidator returns a validator accepting tokens of issuer for
+// audience; an empty audience is not checked
+func NewJWTValidator(issuer, audience, jwksURL string) *JWTValidator {
+	return &JWTValidator{
+		issuer:   issuer,
+		audience: audience,
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Validate checks the signature and claims of token
+func (v *JWTValidator) Validate(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("token signature: %w", err)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verify(header.Alg, key, digest[:], signature); err != nil {
+		return Claims{}, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("token claims: %w", err)
+	}
+	return claims, v.checkClaims(claims, time.Now())
+}
+
+func (v *JWTValidator) checkClaims(claims Claims, now time.Time) error {
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+	if v.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == v.audience {
+				return nil
+			}
+		}
+		return errors.New("token not issued for this audience")
+	}
+	return nil
+}
+
+func verify(alg string, key crypto.PublicKey, digest, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("token algorithm %q does not match its key", alg)
+}
+
+// key returns the public key with ID kid, fetching the key set again when it
+// is stale or does not know kid. A known key is returned at once and a stale
+// set is refreshed in the background; only an unknown kid waits for the
+// fetch.
+func (v *JWTValidator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) >= jwksRefreshInterval
+	throttled := time.Since(v.attemptedAt) < jwksMinRefresh
+	v.mu.Unlock()
+
+	if ok {
+		if stale && !throttled {
+			// Keep using the known key while the set is fetched again
+			v.fetches.DoChan("jwks", v.refresh)
+		}
+		return key, nil
+	}
+	if throttled {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+
+	select {
+	case res := <-v.fetches.DoChan("jwks", v.refresh):
+		if res.Err != nil {
+			return nil, fmt.Errorf("fetching token keys: %w", res.Err)
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	v.mu.Lock()
+	key, ok = v.keys[kid]
+	v.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set and records the attempt, failed or not. It
+// does not use a request's context so that one cancelled request does not
+// fail the fetch for every request waiting on it.
+func (v *JWTValidator) refresh() (any, error) {
+	keys, err := v.fetchKeys(context.Background())
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.attemptedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetchedAt = keys, v.attemptedAt
+	return nil, nil
+}
+
+func (v *JWTValidator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwks struct represents a JWKS endpoint publishing one ES256 key
+type jwks struct {
+	key    *ecdsa.PrivateKey
+	server *httptest.Server
+	// fetches counts the requests to the endpoint
+	fetches atomic.Int32
+	// handle, if set, answers the requests after the first
+	handle atomic.Pointer[http.HandlerFunc]
+}
+
+func newJWKS(t *testing.T) *jwks {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &jwks{key: key}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if j.fetches.Add(1) > 1 {
+			if handle := j.handle.Load(); handle != nil {
+				(*handle)(w, r)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	}))
+	t.Cleanup(j.server.Close)
+	return j
+}
+
+func (j *jwks) fail(handle http.HandlerFunc) {
+	j.handle.Store(&handle)
+}
+
+// sign returns an ES256 token carrying claims, signed by the endpoint's key
+func (j *jwks) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, j.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// resign returns token with the signature of other
+func resign(token, other string) string {
+	return token[:strings.LastIndex(token, ".")] + other[strings.LastIndex(other, "."):]
+}
+
+func validClaims() map[string]any {
+	return map[string]any{"sub": "client-a", "iss": "issuer", "aud": "lb", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestValidate(t *testing.T) {
+	j := newJWKS(t)
+	with := func(name string, value any) map[string]any {
+		claims := validClaims()
+		claims[name] = value
+		return claims
+	}
+	tests := []struct {
+		name   string
+		token  string
+		client string
+	}{
+		{name: "valid", token: j.sign(t, "ES256", "key-1", validClaims()), client: "client-a"},
+		{name: "audience array", token: j.sign(t, "ES256", "key-1", with("aud", []string{"other", "lb"})), client: "client-a"},
+		{name: "expired", token: j.sign(t, "ES256", "key-1", with("exp", time.Now().Add(-time.Minute).Unix()))},
+		{name: "no expiry", token: j.sign(t, "ES256", "key-1", with("exp", 0))},
+		{name: "not valid yet", token: j.sign(t, "ES256", "key-1", with("nbf", time.Now().Add(time.Hour).Unix()))},
+		{name: "wrong issuer", token: j.sign(t, "ES256", "key-1", with("iss", "other"))},
+		{name: "wrong audience", token: j.sign(t, "ES256", "key-1", with("aud", "other"))},
+		{name: "unknown key", token: j.sign(t, "ES256", "key-2", validClaims())},
+		{name: "algorithm of another key type", token: j.sign(t, "RS256", "key-1", validClaims())},
+		{name: "bad signature", token: resign(j.sign(t, "ES256", "key-1", validClaims()), j.sign(t, "ES256", "key-1", with("sub", "client-b")))},
+		{name: "malformed", token: "a.b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewJWTValidator("issuer", "lb", j.server.URL)
+			claims, err := v.Validate(context.Background(), tt.token)
+			if tt.client == "" {
+				if err == nil {
+					t.Errorf("accepted the token of %q", claims.Subject)
+				}
+				return
+			}
+			if err != nil || claims.Subject != tt.client {
+				t.Errorf("got %q, %v, expected %q", claims.Subject, err, tt.client)
+			}
+		})
+	}
+}
+
+func TestKnownKeyDuringOutage(t *testing.T) {
+	j := newJWKS(t)
+	v := NewJWTValidator("issuer", "lb", j.server.URL)
+	token := j.sign(t, "ES256", "key-1", validClaims())
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	outage := time.Now()
+	j.fail(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	v.mu.Lock()
+	v.fetchedAt = v.fetchedAt.Add(-2 * jwksRefreshInterval)
+	v.attemptedAt = v.fetchedAt
+	v.mu.Unlock()
+
+	for range 20 {
+		if _, err := v.Validate(context.Background(), token); err != nil {
+			t.Fatalf("known key rejected during the outage: %v", err)
+		}
+	}
+	// Wait for the background refresh to record its failed attempt
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		v.mu.Lock()
+		attempted := v.attemptedAt.After(outage)
+		v.mu.Unlock()
+		if attempted {
+			break
+		}
+	}
+	for range 20 {
+		if _, err := v.Validate(context.Background(), token); err != nil {
+			t.Fatalf("known key rejected during the outage: %v", err)
+		}
+	}
+	if got := j.fetches.Load(); got != 2 {
+		t.Errorf("endpoint fetched %d times, expected one fetch and one failed attempt", got)
+	}
+}
+
+func TestSlowFetchDoesNotBlockKnownKeys(t *testing.T) {
+	j := newJWKS(t)
+	v := NewJWTValidator("issuer", "lb", j.server.URL)
+	token := j.sign(t, "ES256", "key-1", validClaims())
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	j.fail(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	})
+	v.mu.Lock()
+	v.fetchedAt = v.fetchedAt.Add(-2 * jwksRefreshInterval)
+	v.attemptedAt = v.fetchedAt
+	v.mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		for range 5 {
+			if _, err := v.Validate(context.Background(), token); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("validation waited for the key set fetch")
+	}
+}
+
+func TestUnknownKeyDoesNotWaitForever(t *testing.T) {
+	j := newJWKS(t)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	j.fail(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	})
+	v := NewJWTValidator("issuer", "lb", j.server.URL)
+	if _, err := v.Validate(context.Background(), j.sign(t, "ES256", "key-1", validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next fetch for an unknown key is throttled until jwksMinRefresh
+	// has passed, then bounded by the request's context
+	if _, err := v.Validate(context.Background(), j.sign(t, "ES256", "key-2", validClaims())); err == nil {
+		t.Fatal("accepted an unknown key")
+	}
+	if got := j.fetches.Load(); got != 1 {
+		t.Errorf("endpoint fetched %d times within jwksMinRefresh", got)
+	}
+	v.mu.Lock()
+	v.attemptedAt = v.attemptedAt.Add(-jwksMinRefresh)
+	v.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := v.Validate(ctx, j.sign(t, "ES256", "key-2", validClaims())); err != context.DeadlineExceeded {
+		t.Errorf("got %v, expected the request's deadline", err)
+	}
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Accounting selects how a request that is retried or hedged across several
+// nodes is counted against their limits
+type Accounting int
+
+const (
+	// AccountPerAttempt counts the request once against every node it was sent to
+	AccountPerAttempt Accounting = iota
+	// AccountOnce counts the request a single time, against the first node it was sent to
+	AccountOnce
+	// AccountSuccess counts the request only against the node that answered
+	// successfully, and not at all when every attempt failed
+	AccountSuccess
+)
+
+// ParseAccounting parses attempt, once or success
+func ParseAccounting(s string) (Accounting, error) {
+	switch s {
+	case "attempt", "":
+		return AccountPerAttempt, nil
+	case "once":
+		return AccountOnce, nil
+	case "success":
+		return AccountSuccess, nil
+	}
+	return 0, fmt.Errorf("unknown accounting %q, expected attempt, once or success", s)
+}
+
+// Attempts accounts the attempts of one request according to its policy
+type Attempts struct {
+	lb        *LoadBalancer
+	policy    Accounting
+	operation string
+	bpm       int
+	recorded  bool
+}
+
+// NewAttempts starts accounting a request of the given operation and BPM
+func (lb *LoadBalancer) NewAttempts(policy Accounting, operation string, bpm int) *Attempts {
+	return &Attempts{lb: lb, policy: policy, operation: operation, bpm: bpm}
+}
+
+// Start is called right before the request is sent to a node. Counting up
+// front keeps concurrent requests from overshooting the node's limits. With
+// shared limits it returns ErrOverLimit when the node must not be sent the
+// request after all.
+func (a *Attempts) Start(ctx context.Context, nodeID string) error {
+	switch a.policy {
+	case AccountPerAttempt:
+		return a.reserve(ctx, nodeID)
+	case AccountOnce:
+		if !a.recorded {
+			return a.reserve(ctx, nodeID)
+		}
+	}
+	return nil
+}
+
+// Succeeded is called once a node answered the request successfully
+func (a *Attempts) Succeeded(ctx context.Context, nodeID string) error {
+	if a.policy == AccountSuccess {
+		return a.record(ctx, nodeID)
+	}
+	return nil
+}
+
+func (a *Attempts) record(ctx context.Context, nodeID string) error {
+	a.recorded = true
+	return a.lb.RecordRequest(ctx, nodeID, a.operation, a.bpm)
+}
+
+func (a *Attempts) reserve(ctx context.Context, nodeID string) error {
+	if err := a.lb.ReserveRequest(ctx, nodeID, a.operation, a.bpm); err != nil {
+		return err
+	}
+	a.recorded = true
+	return nil
+}
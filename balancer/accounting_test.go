@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestParseAccounting(t *testing.T) {
+	for s, expected := range map[string]Accounting{"": AccountPerAttempt, "attempt": AccountPerAttempt, "once": AccountOnce, "success": AccountSuccess} {
+		if got, err := ParseAccounting(s); err != nil || got != expected {
+			t.Errorf("ParseAccounting(%q) = %v, %v, expected %v", s, got, err, expected)
+		}
+	}
+	if _, err := ParseAccounting("never"); err == nil {
+		t.Error("an unknown accounting was accepted")
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Accounting
+		expected map[string]int
+	}{
+		{name: "per attempt", policy: AccountPerAttempt, expected: map[string]int{"a": 1, "b": 1}},
+		{name: "once", policy: AccountOnce, expected: map[string]int{"a": 1}},
+		{name: "success", policy: AccountSuccess, expected: map[string]int{"b": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, s := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "10 req/min"}, {NodeID: "b", Limits: "10 req/min"}})
+			ctx := context.Background()
+			// The request fails on a, is retried on b and succeeds there
+			attempts := lb.NewAttempts(tt.policy, "POST /request", 2)
+			for _, nodeID := range []string{"a", "b"} {
+				if err := attempts.Start(ctx, nodeID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := attempts.Succeeded(ctx, "b"); err != nil {
+				t.Fatal(err)
+			}
+
+			usage, err := s.Usage(ctx, time.Now().Add(-time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]int{}
+			for nodeID, u := range usage {
+				if u.Requests > 0 {
+					got[nodeID] = u.Requests
+				}
+				if u.BPM != 2*u.Requests {
+					t.Errorf("got %d bpm for %d requests on %s, expected 2 each", u.BPM, u.Requests, nodeID)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("counted %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
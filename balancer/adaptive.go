@@ -0,0 +1,138 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// adaptiveBaselineAlpha is the weight of the newest unstressed latency in a
+// node's baseline, lower than ewmaAlpha so a slow drift does not become the
+// new normal before it is noticed
+const adaptiveBaselineAlpha = 0.05
+
+// AdaptiveLimits struct represents how the limits of nodes follow their
+// responses. A node answering 429 or 503, asking to retry later, or taking
+// longer than LatencyInflation times its usual latency is under stress: its
+// limits are cut by Decrease, at most once per Interval and never below
+// Floor of its configured limits. Every Interval without stress gives back
+// Increase of its configured limits until it has all of them again. A zero
+// Decrease turns adaptive limits off; a zero LatencyInflation ignores
+// latency.
+type AdaptiveLimits struct {
+	// Decrease is the share of its current limits a node keeps under stress
+	Decrease float64
+	// Increase is the share of its configured limits a node gets back every
+	// Interval without stress
+	Increase float64
+	Interval time.Duration
+	// Floor is the smallest share of its configured limits a node keeps
+	Floor            float64
+	LatencyInflation float64
+}
+
+// LoadSignal struct represents what a node's response says about its load
+type LoadSignal struct {
+	// Status is the response status, zero when the node could not be reached
+	Status int
+	// RetryAfter is whether the node asked to retry later
+	RetryAfter bool
+	Latency    time.Duration
+}
+
+// adaptiveState struct represents the limits of a node cut by stress: factor
+// of its configured limits as of changed, recovering from there on
+type adaptiveState struct {
+	factor  float64
+	changed time.Time
+	// baseline is the moving average of the node's unstressed latencies
+	baseline float64 // seconds
+}
+
+// adaptive holds the adaptive limits of every node, see SetAdaptiveLimits
+type adaptive struct {
+	mu     sync.Mutex
+	policy AdaptiveLimits
+	nodes  map[string]*adaptiveState
+}
+
+// SetAdaptiveLimits changes how node limits follow the nodes' responses; a
+// zero Decrease turns adaptive limits off and gives every node its
+// configured limits back
+func (lb *LoadBalancer) SetAdaptiveLimits(policy AdaptiveLimits) {
+	a := &lb.adaptive
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = policy
+	if policy.Decrease <= 0 {
+		for id := range a.nodes {
+			metrics.AdaptiveLimitFactor.DeleteLabelValues(id)
+		}
+		clear(a.nodes)
+	}
+}
+
+// ObserveLoad feeds a node's response into its adaptive limits, cutting them
+// when the response shows the node under stress
+func (lb *LoadBalancer) ObserveLoad(nodeID string, signal LoadSignal) {
+	a := &lb.adaptive
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	policy := a.policy
+	if policy.Decrease <= 0 || signal.Status == 0 {
+		return
+	}
+	now := time.Now()
+	state, ok := a.nodes[nodeID]
+	if !ok {
+		state = &adaptiveState{factor: 1, changed: now}
+		a.nodes[nodeID] = state
+	}
+
+	latency := signal.Latency.Seconds()
+	inflated := policy.LatencyInflation > 0 && state.baseline > 0 && latency > policy.LatencyInflation*state.baseline
+	stressed := signal.RetryAfter || signal.Status == http.StatusTooManyRequests || signal.Status == http.StatusServiceUnavailable || inflated
+	if !stressed {
+		if state.baseline == 0 {
+			state.baseline = latency
+		} else {
+			state.baseline += adaptiveBaselineAlpha * (latency - state.baseline)
+		}
+		return
+	}
+
+	if state.factor < 1 && now.Sub(state.changed) < policy.Interval {
+		// Cut once per Interval: the responses of requests sent before the
+		// last cut say little about the limits since
+		return
+	}
+	state.factor, state.changed = max(a.factor(state, now)*policy.Decrease, policy.Floor), now
+	metrics.AdaptiveLimitFactor.WithLabelValues(nodeID).Set(state.factor)
+}
+
+// factor returns the share of its configured limits the node of state gets
+// at now, its last cut plus what it recovered since. The caller holds a.mu.
+func (a *adaptive) factor(state *adaptiveState, now time.Time) float64 {
+	if a.policy.Interval <= 0 {
+		return state.factor
+	}
+	intervals := float64(now.Sub(state.changed) / a.policy.Interval)
+	return min(state.factor+intervals*a.policy.Increase, 1)
+}
+
+// LimitFactor returns the share of its configured limits a node gets under
+// adaptive limits, 1 when they are not cut
+func (lb *LoadBalancer) LimitFactor(nodeID string) float64 {
+	a := &lb.adaptive
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	state, ok := a.nodes[nodeID]
+	if !ok {
+		return 1
+	}
+	factor := a.factor(state, time.Now())
+	metrics.AdaptiveLimitFactor.WithLabelValues(nodeID).Set(factor)
+	return factor
+}
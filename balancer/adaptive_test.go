@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestAdaptiveLimits(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "100 req/min"}})
+	lb.SetAdaptiveLimits(AdaptiveLimits{Decrease: 0.5, Increase: 0.1, Interval: time.Hour, Floor: 0.25, LatencyInflation: 3})
+	factor := func() float64 {
+		t.Helper()
+		return math.Round(lb.LimitFactor("a")*100) / 100
+	}
+
+	lb.ObserveLoad("a", LoadSignal{Status: http.StatusOK, Latency: 10 * time.Millisecond})
+	lb.ObserveLoad("a", LoadSignal{Status: 0})
+	if got := factor(); got != 1 {
+		t.Fatalf("got a factor of %g without stress", got)
+	}
+	lb.ObserveLoad("a", LoadSignal{Status: http.StatusServiceUnavailable})
+	if got := factor(); got != 0.5 {
+		t.Fatalf("got a factor of %g after a 503, expected 0.5", got)
+	}
+	quota, _, err := lb.Quota(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Windows[0].Limit != 50 {
+		t.Errorf("got a limit of %d, expected the configured 100 cut to 50", quota.Windows[0].Limit)
+	}
+
+	// Responses to requests sent before the cut do not cut again
+	lb.ObserveLoad("a", LoadSignal{Status: http.StatusTooManyRequests})
+	if got := factor(); got != 0.5 {
+		t.Fatalf("got a factor of %g, expected one cut per interval", got)
+	}
+
+	// An interval later the node recovered Increase, and a latency over
+	// LatencyInflation times its baseline cuts from there
+	state := lb.adaptive.nodes["a"]
+	state.changed = state.changed.Add(-time.Hour)
+	if got := factor(); got != 0.6 {
+		t.Fatalf("got a factor of %g an interval later, expected 0.6", got)
+	}
+	lb.ObserveLoad("a", LoadSignal{Status: http.StatusOK, Latency: 50 * time.Millisecond})
+	if got := factor(); got != 0.3 {
+		t.Fatalf("got a factor of %g after a slow answer, expected 0.3", got)
+	}
+	state.changed = state.changed.Add(-time.Hour)
+	lb.ObserveLoad("a", LoadSignal{Status: http.StatusOK, RetryAfter: true})
+	if got := factor(); got != 0.25 {
+		t.Fatalf("got a factor of %g, expected the floor", got)
+	}
+
+	state.changed = state.changed.Add(-20 * time.Hour)
+	if got := factor(); got != 1 {
+		t.Errorf("got a factor of %g long after the last cut, expected all limits back", got)
+	}
+	lb.SetAdaptiveLimits(AdaptiveLimits{})
+	if _, ok := lb.adaptive.nodes["a"]; ok {
+		t.Error("turning adaptive limits off kept the node's state")
+	}
+}
@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// selectSticky picks the node the request's affinity key sticks to. An
+// over-limit sticky node may borrow unused quota from the peers of its pool up
+// to its BorrowPercent; once that is exhausted, or when the node is at the
+// limit of the request's operation or the share of the request's priority
+// class, the request falls back to random selection.
+func (lb *LoadBalancer) selectSticky(ctx context.Context, req Request) (string, error) {
+	share := lb.share(req)
+	if ok, err := lb.globalAvailable(ctx, share); err != nil || !ok {
+		return "", err
+	}
+	sticky := lb.stickyNode(req.AffinityKey, req.Group)
+	if sticky == "" {
+		return "", nil
+	}
+	lb.mu.RLock()
+	down := lb.downFor(sticky, true) || lb.saturated(sticky, req.tokens()) || lb.throttled(sticky) || !lb.tenantAllows(req, sticky)
+	lb.mu.RUnlock()
+	if req.excluded(sticky) || down {
+		return lb.selectRandom(ctx, req)
+	}
+
+	operationOK, err := lb.operationAvailable(ctx, req.Operation, []string{sticky})
+	if err != nil {
+		return "", err
+	}
+	if len(operationOK) == 0 {
+		return lb.selectRandom(ctx, req)
+	}
+
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return "", err
+	}
+	if quotas[sticky].scaled(share).available() {
+		return sticky, nil
+	}
+
+	// Only requests that may fill the windows entirely borrow beyond them
+	node, _ := lb.Node(sticky)
+	if share >= 1 && lb.canBorrow(node, quotas) {
+		metrics.QuotaBorrowed.WithLabelValues(node.NodeID, node.Pool).Inc()
+		return sticky, nil
+	}
+	return lb.selectRandom(ctx, req)
+}
+
+// stickyNode maps key to a node with rendezvous hashing, so keys only move
+// when their node leaves the pool. Without a fixed group and with a traffic
+// split the key is first hashed onto a group, so a client stays in the same
+// group as well.
+func (lb *LoadBalancer) stickyNode(key, group string) string {
+	lb.mu.RLock()
+	nodeIDs := make([]string, 0, len(lb.nodes))
+	for nodeID, node := range lb.nodes {
+		if !lb.inMirrorGroup(nodeID) && (group == "" || node.Group == group) {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	lb.mu.RUnlock()
+
+	if group == "" {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		roll := float64(h.Sum64()%10000) / 10000
+		nodeIDs = lb.splitByGroup(nodeIDs, roll)
+	}
+
+	var best string
+	var bestScore uint64
+	for _, nodeID := range nodeIDs {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(nodeID))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = nodeID, score
+		}
+	}
+	return best
+}
+
+// canBorrow reports whether an over-limit node may take one more request on
+// borrowed quota. In every window it is over, its overage must stay below
+// BorrowPercent of its own limit and below what its pool peers leave unused,
+// after subtracting what other nodes of the pool already borrowed.
+func (lb *LoadBalancer) canBorrow(node store.NodeLimits, quotas map[string]Quota) bool {
+	if node.Pool == "" || node.BorrowPercent <= 0 {
+		return false
+	}
+
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	// The pool may have changed since quotas were computed; skip windows that no longer line up
+	own := quotas[node.NodeID]
+	for i, window := range lb.windows[node.NodeID] {
+		if i >= len(own.Windows) {
+			return false
+		}
+		used := own.Windows[i].Used
+		if used < window.Limit {
+			continue
+		}
+
+		spare := 0
+		for peerID, peer := range lb.nodes {
+			if peerID == node.NodeID || peer.Pool != node.Pool {
+				continue
+			}
+			for j, peerWindow := range lb.windows[peerID] {
+				if peerWindow.Period != window.Period || peerWindow.Bytes != window.Bytes || j >= len(quotas[peerID].Windows) {
+					continue
+				}
+				peerUsage := quotas[peerID].Windows[j]
+				// Quota already lent to this peer's borrowing is no longer spare
+				spare += peerUsage.Remaining - max(0, peerUsage.Used-peerWindow.Limit)
+			}
+		}
+
+		overage := used - window.Limit
+		if overage >= window.Limit*node.BorrowPercent/100 || overage >= spare {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestCanBorrow(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     int
+		peerUsed int
+		pool     string
+		expected bool
+	}{
+		{name: "overage below the borrow percent", used: 14, expected: true},
+		{name: "overage at the borrow percent", used: 15},
+		{name: "overage at the spare quota", used: 12, peerUsed: 8},
+		{name: "overage below the spare quota", used: 11, peerUsed: 8, expected: true},
+		// The peer is over its own limit and borrowing, so it has nothing to lend
+		{name: "peer borrowing", used: 11, peerUsed: 12},
+		{name: "no pool", used: 11, pool: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := "pool-1"
+			if tt.pool == "-" {
+				pool = ""
+			}
+			nodes := []store.NodeLimits{
+				{NodeID: "node-a", Limits: "10 req/min", Pool: pool, BorrowPercent: 50},
+				{NodeID: "node-b", Limits: "10 req/min", Pool: pool, BorrowPercent: 50},
+			}
+			lb, _ := newTestBalancer(t, nodes, append(recent("node-a", tt.used, 0), recent("node-b", tt.peerUsed, 0)...)...)
+			quotas, err := lb.quotas(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lb.canBorrow(nodes[0], quotas); got != tt.expected {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStickyBorrowing(t *testing.T) {
+	nodes := []store.NodeLimits{
+		{NodeID: "node-a", Limits: "10 req/min", Pool: "pool-1", BorrowPercent: 20},
+		{NodeID: "node-b", Limits: "10 req/min", Pool: "pool-1"},
+	}
+	lb, _ := newTestBalancer(t, nodes, recent("node-a", 10, 0)...)
+	key := ""
+	for _, candidate := range []string{"client-1", "client-2", "client-3", "client-4", "client-5"} {
+		if lb.stickyNode(candidate, "") == "node-a" {
+			key = candidate
+			break
+		}
+	}
+	if key == "" {
+		t.Fatal("no key sticks to node-a")
+	}
+
+	// node-a is at its limit, but may borrow 2 of the requests node-b leaves unused
+	ctx := context.Background()
+	for i, expected := range []string{"node-a", "node-a", "node-b"} {
+		nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request", AffinityKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeID != expected {
+			t.Fatalf("request %d went to %q, expected %s", i+1, nodeID, expected)
+		}
+		if err := lb.RecordRequest(ctx, nodeID, "POST /request", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
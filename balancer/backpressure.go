@@ -0,0 +1,128 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// capacityReportTTL is how long a node's report of its remaining capacity
+// holds when the node sends no newer one
+const capacityReportTTL = 10 * time.Second
+
+// Backpressure struct represents what a node's response says about its
+// capacity: a 503 or 429 asking to retry after RetryAfter, or the number of
+// requests it can still take if HasRemaining, until ResetAfter passes
+type Backpressure struct {
+	RetryAfter   time.Duration
+	Remaining    int
+	HasRemaining bool
+	// ResetAfter is when the node's rate limit window resets, zero holding
+	// Remaining for capacityReportTTL
+	ResetAfter time.Duration
+}
+
+// throttle struct represents the limit a node set on itself: at most
+// remaining more requests until the limit ends. A paused node asked for no
+// requests at all until then.
+type throttle struct {
+	remaining int
+	until     time.Time
+	paused    bool
+}
+
+// backpressure holds the limits nodes set on themselves, see ObserveBackpressure
+type backpressure struct {
+	mu sync.Mutex
+	// max caps how long a node may hold off requests; zero ignores nodes' signals
+	max       time.Duration
+	throttles map[string]throttle
+}
+
+// SetBackpressure makes the balancer honour nodes' backpressure signals for
+// up to limit at a time; zero ignores them
+func (lb *LoadBalancer) SetBackpressure(limit time.Duration) {
+	lb.backpressure.mu.Lock()
+	defer lb.backpressure.mu.Unlock()
+	lb.backpressure.max = limit
+	if limit <= 0 {
+		clear(lb.backpressure.throttles)
+	}
+}
+
+// ObserveBackpressure tightens a node's limits after a response: a node that
+// asked to retry later gets no request until then, and a node that reported
+// its remaining capacity gets no more than that many until it reports again
+// or its window resets, capacityReportTTL when it said nothing of that. A
+// node with no capacity remaining is left out of selection until then. It
+// reports whether the signal was honoured.
+func (lb *LoadBalancer) ObserveBackpressure(nodeID string, signal Backpressure) bool {
+	bp := &lb.backpressure
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.max <= 0 {
+		return false
+	}
+	now := time.Now()
+	switch {
+	case signal.RetryAfter > 0:
+		bp.throttles[nodeID] = throttle{until: now.Add(min(signal.RetryAfter, bp.max)), paused: true}
+	case signal.HasRemaining:
+		if current := bp.throttles[nodeID]; current.paused && now.Before(current.until) {
+			// A node that asked to retry later keeps the requests off until then
+			return true
+		}
+		ttl := capacityReportTTL
+		if signal.ResetAfter > 0 {
+			ttl = signal.ResetAfter
+		}
+		bp.throttles[nodeID] = throttle{remaining: max(signal.Remaining, 0), until: now.Add(min(ttl, bp.max))}
+	default:
+		return false
+	}
+	return true
+}
+
+// Throttled returns when the limit a node set on itself ends, if the node
+// can take no more requests until then
+func (lb *LoadBalancer) Throttled(nodeID string) (time.Time, bool) {
+	bp := &lb.backpressure
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.exhausted(nodeID, time.Now())
+}
+
+// throttled reports whether a node can take no more requests by the limit it
+// set on itself
+func (lb *LoadBalancer) throttled(nodeID string) bool {
+	_, ok := lb.Throttled(nodeID)
+	return ok
+}
+
+// exhausted returns the end of a node's exhausted throttle, dropping expired
+// ones. The caller holds mu.
+func (bp *backpressure) exhausted(nodeID string, now time.Time) (time.Time, bool) {
+	t, ok := bp.throttles[nodeID]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(t.until) {
+		delete(bp.throttles, nodeID)
+		return time.Time{}, false
+	}
+	return t.until, t.remaining <= 0
+}
+
+// take spends one request of a node's throttle, reporting false when the
+// node can take no more
+func (bp *backpressure) take(nodeID string) bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if _, exhausted := bp.exhausted(nodeID, time.Now()); exhausted {
+		return false
+	}
+	if t, ok := bp.throttles[nodeID]; ok {
+		t.remaining--
+		bp.throttles[nodeID] = t
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestBackpressure(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a", Limits: "100 req/min"},
+		{NodeID: "b", Limits: "100 req/min"},
+	})
+	ctx := context.Background()
+	selected := func() map[string]bool {
+		t.Helper()
+		nodeIDs, err := lb.AvailableNodes(ctx, Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := map[string]bool{}
+		for _, nodeID := range nodeIDs {
+			set[nodeID] = true
+		}
+		return set
+	}
+
+	if lb.ObserveBackpressure("a", Backpressure{RetryAfter: time.Minute}) {
+		t.Fatal("a signal was honoured with backpressure off")
+	}
+	lb.SetBackpressure(10 * time.Second)
+	if lb.ObserveBackpressure("a", Backpressure{}) {
+		t.Error("an empty signal was honoured")
+	}
+
+	// A node asking to retry later is left out until then, for no longer than the cap
+	start := time.Now()
+	if !lb.ObserveBackpressure("a", Backpressure{RetryAfter: time.Minute}) {
+		t.Fatal("a Retry-After was not honoured")
+	}
+	until, ok := lb.Throttled("a")
+	if !ok || until.Sub(start) > 11*time.Second {
+		t.Fatalf("got a throttle until %v (%v), expected it capped at 10s", until, ok)
+	}
+	if nodes := selected(); nodes["a"] || !nodes["b"] {
+		t.Errorf("selected %v while a asked to retry later", nodes)
+	}
+	// A capacity report does not lift the pause
+	lb.ObserveBackpressure("a", Backpressure{Remaining: 5, HasRemaining: true})
+	if _, ok := lb.Throttled("a"); !ok {
+		t.Error("a capacity report lifted the pause")
+	}
+
+	// A node reporting capacity takes that many requests more
+	if !lb.ObserveBackpressure("b", Backpressure{Remaining: 2, HasRemaining: true}) {
+		t.Fatal("a capacity report was not honoured")
+	}
+	for i := range 3 {
+		release, ok := lb.Acquire("b")
+		if expected := i < 2; ok != expected {
+			t.Fatalf("request %d acquired %v, expected %v", i+1, ok, expected)
+		}
+		if ok {
+			release()
+		}
+	}
+	if nodes := selected(); nodes["b"] {
+		t.Error("b was selected with no capacity left")
+	}
+
+	lb.SetBackpressure(0)
+	if nodes := selected(); !nodes["a"] || !nodes["b"] {
+		t.Errorf("selected %v, expected turning backpressure off to clear the throttles", nodes)
+	}
+}
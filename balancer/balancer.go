@@ -0,0 +1,448 @@
+// Package balancer selects the node each request is forwarded to while keeping
+// every node within its rate limits.
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/health"
+	"github.com/jiwooo-kim/poc_loadbalancer/replication"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Request struct represents what the balancer knows about a request when
+// selecting its node
+type Request struct {
+	// AffinityKey keeps requests sharing it on the same node, if set
+	AffinityKey string
+	// Operation is the gRPC full method name or "<HTTP method> <route>"
+	Operation string
+	// Group restricts selection to the nodes of one group, bypassing the
+	// traffic split, e.g. when a routing rule matched the request
+	Group string
+	// Exclude lists nodes that must not be selected, e.g. ones that already failed the request
+	Exclude []string
+	// Priority is the request's priority class, DefaultPriority when empty,
+	// see SetPriorities
+	Priority string
+	// Tenant restricts selection to the node pool of a tenant, see SetTenants
+	Tenant string
+	// Zone is the zone whose nodes the request prefers, the balancer's
+	// own when empty, see SetLocality
+	Zone string
+	// Tokens is how many of its node's capacity tokens the request holds
+	// while served, one when zero, see AcquireTokens
+	Tokens int
+	// Node pins the request to one node, which is selected whatever its
+	// state or load as long as it is not excluded
+	Node string
+}
+
+func (req Request) excluded(nodeID string) bool {
+	for _, id := range req.Exclude {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a node of group may serve the request
+func (req Request) allows(group string) bool {
+	return req.Group == "" || req.Group == group
+}
+
+// LoadBalancer struct represents the load balancer
+type LoadBalancer struct {
+	store store.Store
+
+	mu           sync.RWMutex
+	nodes        map[string]store.NodeLimits
+	windows      map[string][]Window
+	groupWeights map[string]int
+	// tenants holds the node pools of tenants, see SetTenants
+	tenants map[string]tenantPool
+
+	mirrorGroup   string
+	mirrorPercent float64
+	// extraLoad caps mirrored requests relative to live traffic, see SetExtraLoadCap
+	extraLoad extraLoadGuard
+
+	strategy Strategy
+	scores   scoreboard
+
+	// sharedLimits admits requests atomically in the store, see SetSharedLimits
+	sharedLimits bool
+
+	// inflight counts the requests of nodes with MaxConcurrent, see Acquire
+	inflight inflight
+
+	// failedUntil holds the end of each simulated node failure, see SimulateFailure
+	failedUntil map[string]time.Time
+	probes      map[string]*health.Probe
+	// random is the source of selection's random choices, see SetSeed
+	random selectionRandom
+
+	// drains holds the nodes taking no new requests, see Drain
+	drains map[string]drain
+	// maintenance takes nodes out of selection on a schedule, see SetMaintenanceWindows
+	maintenance maintenance
+	// limitFactors scale node limits and activeStandby holds the standby
+	// nodes taking traffic, see SetLimitFactors and ActivateStandby
+	limitFactors  map[string]float64
+	activeStandby map[string]bool
+	// failover lets the standby nodes take traffic while too few primary
+	// nodes are up, see SetFailoverPolicy
+	failover failover
+
+	// healthMu guards health and flapPolicy and is never held while acquiring mu
+	healthMu   sync.Mutex
+	health     map[string]*healthState
+	flapPolicy FlapPolicy
+
+	// operationWindows holds the limits of each operation per node, see SetOperationLimits
+	operationLimits  map[string][]Window
+	operationWindows map[string]map[string][]Window
+
+	// globalWindows cap the requests of all nodes together, see SetGlobalLimits
+	globalLimits  string
+	globalWindows []Window
+
+	// priorities holds the share of the windows each priority class may fill, see SetPriorities
+	priorities map[string]float64
+
+	// slowStart ramps up the traffic of new and recovered nodes, see SetSlowStart
+	slowStart slowStart
+
+	// outliers ejects misbehaving nodes from selection, see SetOutlierPolicy
+	outliers outliers
+	// adaptive cuts the limits of nodes under stress, see SetAdaptiveLimits
+	adaptive adaptive
+
+	// backpressure holds the limits nodes set on themselves, see ObserveBackpressure
+	backpressure backpressure
+
+	// regions holds the global limit usage of other regions, see SetRegion
+	regions regions
+
+	// locality is where the balancer runs, see SetLocality
+	locality locality
+
+	// storeTimes times the store calls of the request path, see StoreLatencies
+	storeTimes storeTimes
+
+	// events receives the health, ejection and pool changes, see SetEventBus.
+	// It is read without mu, by health checks holding healthMu.
+	events atomic.Pointer[eventbus.Bus]
+}
+
+// New returns a load balancer with an empty node pool that accounts requests in s
+func New(s store.Store) *LoadBalancer {
+	return &LoadBalancer{
+		store:            s,
+		nodes:            map[string]store.NodeLimits{},
+		windows:          map[string][]Window{},
+		operationWindows: map[string]map[string][]Window{},
+		failedUntil:      map[string]time.Time{},
+		drains:           map[string]drain{},
+		probes:           map[string]*health.Probe{},
+		health:           map[string]*healthState{},
+		scores:           scoreboard{scores: map[string]nodeScore{}},
+		extraLoad:        extraLoadGuard{percent: 100},
+		inflight:         inflight{counts: map[string]int{}, tokens: map[string]int{}, clamped: map[string]bool{}},
+		backpressure:     backpressure{throttles: map[string]throttle{}},
+		slowStart:        slowStart{since: map[string]time.Time{}},
+		outliers:         outliers{nodes: map[string]*outlierState{}},
+		adaptive:         adaptive{nodes: map[string]*adaptiveState{}},
+		regions:          regions{known: map[string]replication.Snapshot{}},
+	}
+}
+
+// SetEventBus publishes the health transitions, ejections and node pool
+// changes of the balancer on bus
+func (lb *LoadBalancer) SetEventBus(bus *eventbus.Bus) {
+	lb.events.Store(bus)
+}
+
+// Store returns the store the load balancer accounts requests in
+func (lb *LoadBalancer) Store() store.Store {
+	return lb.store
+}
+
+// SetNodes replaces the node pool. A node with an invalid limit expression is
+// only limited by its RPM/BPM limits. The pool is copied, so the caller may
+// go on changing nodes while requests are selected.
+func (lb *LoadBalancer) SetNodes(nodes map[string]store.NodeLimits) {
+	nodes = maps.Clone(nodes)
+	windows := make(map[string][]Window, len(nodes))
+	for id, node := range nodes {
+		w, err := nodeWindows(node)
+		if err != nil {
+			log.Printf("node %s: %v", id, err)
+			node.Limits = ""
+			w, _ = nodeWindows(node)
+		}
+		windows[id] = w
+	}
+	probes := nodeProbes(nodes)
+
+	lb.mu.Lock()
+	if len(lb.nodes) > 0 {
+		// Nodes joining a running pool warm up; the first pool starts at full weight
+		now := time.Now()
+		for id := range nodes {
+			if _, ok := lb.nodes[id]; !ok {
+				lb.warmUp(id, now)
+			}
+		}
+	}
+	if !reflect.DeepEqual(lb.nodes, nodes) {
+		lb.events.Load().Publish(eventbus.Event{Type: eventbus.ConfigReloaded, Details: map[string]any{"nodes": len(nodes)}})
+	}
+	lb.nodes = nodes
+	lb.windows = scaleNodeWindows(windows, lb.limitFactors)
+	lb.operationWindows = resolveOperationWindows(nodes, lb.operationLimits)
+	lb.probes = probes
+	lb.mu.Unlock()
+}
+
+// ValidateNode checks the limit expressions, health check, timeout and retry
+// policy of a node, which SetNodes and the proxy would otherwise ignore
+func ValidateNode(node store.NodeLimits) error {
+	if node.NodeID == "" {
+		return errors.New("missing node_id")
+	}
+	if node.RPMLimit < 0 || node.BPMLimit < 0 || node.MaxConcurrent < 0 || node.EgressLimit < 0 {
+		return fmt.Errorf("node %s: limits must not be negative", node.NodeID)
+	}
+	if node.RolloverPercent < 0 || node.RolloverPercent > 100 || node.BurstCapPercent < 0 {
+		return fmt.Errorf("node %s: rollover_percent must be between 0 and 100 and burst_cap_percent not negative", node.NodeID)
+	}
+	if node.Limits != "" {
+		if _, err := ParseLimits(node.Limits); err != nil {
+			return fmt.Errorf("node %s: %w", node.NodeID, err)
+		}
+	}
+	for operation, expr := range node.OperationLimits {
+		if _, err := ParseLimits(expr); err != nil {
+			return fmt.Errorf("node %s operation %s: %w", node.NodeID, operation, err)
+		}
+	}
+	if node.HealthCheck != nil {
+		if _, err := health.NewProbe(*node.HealthCheck); err != nil {
+			return fmt.Errorf("node %s: %w", node.NodeID, err)
+		}
+	}
+	if node.Timeout != "" {
+		if d, err := time.ParseDuration(node.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("node %s: invalid timeout %q", node.NodeID, node.Timeout)
+		}
+	}
+	if _, err := (RetryPolicy{}).Override(node.Retry); err != nil {
+		return fmt.Errorf("node %s: %w", node.NodeID, err)
+	}
+	return nil
+}
+
+// LoadNodes replaces the node pool with the nodes configured in the store
+func (lb *LoadBalancer) LoadNodes(ctx context.Context) error {
+	nodes, err := lb.store.NodeLimits(ctx)
+	if err != nil {
+		return err
+	}
+	lb.SetNodes(nodes)
+	return nil
+}
+
+// Node returns the limits of a node in the pool
+func (lb *LoadBalancer) Node(nodeID string) (store.NodeLimits, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	node, ok := lb.nodes[nodeID]
+	return node, ok
+}
+
+// Nodes returns a copy of the node pool
+func (lb *LoadBalancer) Nodes() map[string]store.NodeLimits {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	nodes := make(map[string]store.NodeLimits, len(lb.nodes))
+	for id, node := range lb.nodes {
+		nodes[id] = node
+	}
+	return nodes
+}
+
+// LongestWindow returns the longest period any node, operation or the
+// global limits are limited over, which request records must be kept for at least
+func (lb *LoadBalancer) LongestWindow() time.Duration {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	var longest time.Duration
+	for _, windows := range lb.windows {
+		for _, w := range windows {
+			longest = max(longest, w.Period)
+			if w.Rollover > 0 {
+				// Burst credit is computed from the previous period
+				longest = max(longest, 2*w.Period)
+			}
+		}
+	}
+	for _, operations := range lb.operationWindows {
+		for _, windows := range operations {
+			for _, w := range windows {
+				longest = max(longest, w.Period)
+			}
+		}
+	}
+	for _, w := range lb.globalWindows {
+		longest = max(longest, w.Period)
+	}
+	return longest
+}
+
+// quotas returns the window state of the given nodes, or of every node when nodeIDs is empty
+func (lb *LoadBalancer) quotas(ctx context.Context, nodeIDs ...string) (map[string]Quota, error) {
+	lb.mu.RLock()
+	windows := make(map[string][]Window, len(lb.windows))
+	if len(nodeIDs) == 0 {
+		for id, w := range lb.windows {
+			windows[id] = w
+		}
+	}
+	for _, id := range nodeIDs {
+		if w, ok := lb.windows[id]; ok {
+			windows[id] = w
+		}
+	}
+	lb.mu.RUnlock()
+
+	// One usage query per distinct period across all nodes, and per twice
+	// the period of windows with burst credit, see burstCredit
+	now := time.Now()
+	usage := map[time.Duration]map[string]store.Usage{}
+	for _, nodeWindows := range windows {
+		for _, window := range nodeWindows {
+			periods := []time.Duration{window.Period}
+			if window.Rollover > 0 {
+				periods = append(periods, 2*window.Period)
+			}
+			for _, period := range periods {
+				if _, ok := usage[period]; ok {
+					continue
+				}
+				started := time.Now()
+				u, err := lb.store.Usage(ctx, now.Add(-period))
+				lb.storeTimes.observe("usage", started, err)
+				if err != nil {
+					return nil, err
+				}
+				usage[period] = u
+			}
+		}
+	}
+
+	quotas := make(map[string]Quota, len(windows))
+	for id, nodeWindows := range windows {
+		quotas[id] = newQuota(id, nodeWindows, usage).scaled(lb.LimitFactor(id))
+	}
+	return quotas, nil
+}
+
+// Quota returns the state of every limit window of a node
+func (lb *LoadBalancer) Quota(ctx context.Context, nodeID string) (Quota, bool, error) {
+	quotas, err := lb.quotas(ctx, nodeID)
+	if err != nil {
+		return Quota{}, false, err
+	}
+	quota, ok := quotas[nodeID]
+	if node, _ := lb.Node(nodeID); node.MaxConcurrent > 0 {
+		quota.InFlight, quota.MaxConcurrent = lb.HeldTokens(nodeID), node.MaxConcurrent
+	}
+	quota.ThrottledUntil, _ = lb.Throttled(nodeID)
+	return quota, ok, nil
+}
+
+// AvailableNodes returns the nodes that are below their limits in every
+// window, cut to the share of the request's priority class, and below the
+// limits of the request's operation, within the request's group and the node
+// pool of its tenant. Nodes failing their health checks, in a simulated
+// failure, serving MaxConcurrent requests, draining, in maintenance or
+// holding off requests by backpressure are never available, and no node is
+// while the global limits are reached.
+func (lb *LoadBalancer) AvailableNodes(ctx context.Context, req Request) ([]string, error) {
+	share := lb.share(req)
+	if ok, err := lb.globalAvailable(ctx, share); err != nil || !ok {
+		return []string{}, err
+	}
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes without any recent request are available as well
+	availableNodes := []string{}
+	lb.mu.RLock()
+	for nodeID, quota := range quotas {
+		if quota.scaled(share).available() && !req.excluded(nodeID) && req.allows(lb.nodes[nodeID].Group) && lb.tenantAllows(req, nodeID) && !lb.inMirrorGroup(nodeID) && !lb.down(nodeID) && !lb.saturated(nodeID, req.tokens()) && !lb.throttled(nodeID) {
+			availableNodes = append(availableNodes, nodeID)
+		}
+	}
+	lb.mu.RUnlock()
+	return lb.operationAvailable(ctx, req.Operation, lb.stableOrder(availableNodes))
+}
+
+// SelectNode picks the node for a request: the node it is pinned to, the
+// sticky node of its affinity key if it has one, otherwise one of the available nodes within the
+// request's group or the group chosen by the traffic split, by strategy. It returns an empty node ID when
+// every node is at its limit.
+func (lb *LoadBalancer) SelectNode(ctx context.Context, req Request) (string, error) {
+	if req.Node != "" {
+		return lb.selectPinned(req), nil
+	}
+	if req.AffinityKey != "" {
+		return lb.selectSticky(ctx, req)
+	}
+	return lb.selectRandom(ctx, req)
+}
+
+// selectPinned returns the node the request is pinned to, or no node when
+// it is unknown or excluded
+func (lb *LoadBalancer) selectPinned(req Request) string {
+	lb.mu.RLock()
+	_, ok := lb.nodes[req.Node]
+	lb.mu.RUnlock()
+	if !ok || req.excluded(req.Node) {
+		return ""
+	}
+	return req.Node
+}
+
+func (lb *LoadBalancer) selectRandom(ctx context.Context, req Request) (string, error) {
+	availableNodes, err := lb.AvailableNodes(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if req.Group == "" {
+		availableNodes = lb.splitByGroup(availableNodes, lb.float64())
+	}
+	return lb.pick(lb.preferLocal(req, availableNodes)), nil
+}
+
+// RecordRequest accounts a request forwarded to a node against the limits of
+// the node and of the operation
+func (lb *LoadBalancer) RecordRequest(ctx context.Context, nodeID, operation string, bpm int) error {
+	started := time.Now()
+	err := lb.store.RecordRequest(ctx, store.Record{NodeID: nodeID, Operation: operation, Timestamp: started, BPM: bpm})
+	lb.storeTimes.observe("record", started, err)
+	return err
+}
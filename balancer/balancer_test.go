@@ -0,0 +1,375 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// newTestBalancer returns a balancer over a memory store holding nodes and
+// records
+func newTestBalancer(t *testing.T, nodes []store.NodeLimits, records ...store.Record) (*LoadBalancer, *store.MemoryStore) {
+	t.Helper()
+	s := store.NewMemoryStore(nodes...)
+	if err := s.RecordRequests(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	lb := New(s)
+	if err := lb.LoadNodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return lb, s
+}
+
+// recent returns n records of a node within the last minute
+func recent(nodeID string, n, bpm int) []store.Record {
+	records := make([]store.Record, n)
+	for i := range records {
+		records[i] = store.Record{NodeID: nodeID, Operation: "POST /request", Timestamp: time.Now().Add(-time.Duration(i+1) * time.Second), BPM: bpm}
+	}
+	return records
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []Window
+		wantErr  bool
+	}{
+		{expr: "10 req/s", expected: []Window{{Limit: 10, Period: time.Second}}},
+		{expr: "100 req/min AND 50k req/day", expected: []Window{{Limit: 100, Period: time.Minute}, {Limit: 50000, Period: 24 * time.Hour}}},
+		{expr: "2m bytes/h", expected: []Window{{Limit: 2000000, Bytes: true, Period: time.Hour}}},
+		{expr: "1.5k req/90s", expected: []Window{{Limit: 1500, Period: 90 * time.Second}}},
+		{expr: "max 100 req/s AND 3000 req/min AND 50k req/day", expected: []Window{{Limit: 100, Period: time.Second}, {Limit: 3000, Period: time.Minute}, {Limit: 50000, Period: 24 * time.Hour}}},
+		{expr: "MAX 10 req/s and 2m bytes/h", expected: []Window{{Limit: 10, Period: time.Second}, {Limit: 2000000, Bytes: true, Period: time.Hour}}},
+		{expr: "10 req", wantErr: true},
+		{expr: "max", wantErr: true},
+		{expr: "max max 10 req/s", wantErr: true},
+		{expr: "10 req/s AND AND 10 req/min", wantErr: true},
+		{expr: "10 reqs/min", wantErr: true},
+		{expr: "-1 req/min", wantErr: true},
+		{expr: "10 req/fortnight", wantErr: true},
+		{expr: "10 req/min AND", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			windows, err := ParseLimits(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, expected an error", windows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(windows, tt.expected) {
+				t.Errorf("got %v, expected %v", windows, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNodeWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     store.NodeLimits
+		expected []Window
+	}{
+		{
+			name:     "rpm and bpm",
+			node:     store.NodeLimits{RPMLimit: 10, BPMLimit: 1000},
+			expected: []Window{{Limit: 10, Period: time.Minute}, {Limit: 1000, Bytes: true, Period: time.Minute}},
+		},
+		{
+			name:     "expression only",
+			node:     store.NodeLimits{Limits: "5 req/s"},
+			expected: []Window{{Limit: 5, Period: time.Second}},
+		},
+		{
+			name:     "expression and rpm",
+			node:     store.NodeLimits{Limits: "5 req/s", RPMLimit: 100},
+			expected: []Window{{Limit: 5, Period: time.Second}, {Limit: 100, Period: time.Minute}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := nodeWindows(tt.node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(windows, tt.expected) {
+				t.Errorf("got %v, expected %v", windows, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    store.NodeLimits
+		wantErr bool
+	}{
+		{name: "valid", node: store.NodeLimits{NodeID: "n", RPMLimit: 10, BPMLimit: 100, Limits: "5 req/s"}},
+		{name: "missing id", node: store.NodeLimits{RPMLimit: 10}, wantErr: true},
+		{name: "negative limit", node: store.NodeLimits{NodeID: "n", RPMLimit: -1}, wantErr: true},
+		{name: "invalid expression", node: store.NodeLimits{NodeID: "n", Limits: "lots"}, wantErr: true},
+		{name: "invalid operation limit", node: store.NodeLimits{NodeID: "n", OperationLimits: map[string]string{"GET /a": "x"}}, wantErr: true},
+		{name: "rollover over 100", node: store.NodeLimits{NodeID: "n", RolloverPercent: 101}, wantErr: true},
+		{name: "invalid timeout", node: store.NodeLimits{NodeID: "n", Timeout: "soon"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateNode(tt.node); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   []store.NodeLimits
+		records []store.Record
+		req     Request
+		// oneOf lists the nodes that may be selected, none when empty
+		oneOf  []string
+		reject string
+	}{
+		{
+			name:  "any node under its limits",
+			nodes: []store.NodeLimits{{NodeID: "a", RPMLimit: 10, BPMLimit: 1000}, {NodeID: "b", RPMLimit: 10, BPMLimit: 1000}},
+			oneOf: []string{"a", "b"},
+		},
+		{
+			name:    "node at its request limit is skipped",
+			nodes:   []store.NodeLimits{{NodeID: "a", RPMLimit: 2, BPMLimit: 1000}, {NodeID: "b", RPMLimit: 2, BPMLimit: 1000}},
+			records: recent("a", 2, 1),
+			oneOf:   []string{"b"},
+		},
+		{
+			name:    "every node at its request limit",
+			nodes:   []store.NodeLimits{{NodeID: "a", RPMLimit: 1, BPMLimit: 1000}, {NodeID: "b", RPMLimit: 1, BPMLimit: 1000}},
+			records: append(recent("a", 1, 1), recent("b", 1, 1)...),
+			reject:  RejectNodeRequests,
+		},
+		{
+			name:    "every node at its byte limit",
+			nodes:   []store.NodeLimits{{NodeID: "a", RPMLimit: 100, BPMLimit: 10}},
+			records: recent("a", 1, 10),
+			reject:  RejectNodeBytes,
+		},
+		{
+			name:   "a zero bpm limit closes the node",
+			nodes:  []store.NodeLimits{{NodeID: "a", RPMLimit: 100}},
+			reject: RejectNodeBytes,
+		},
+		{
+			name:  "excluded node",
+			nodes: []store.NodeLimits{{NodeID: "a", RPMLimit: 10, BPMLimit: 1000}, {NodeID: "b", RPMLimit: 10, BPMLimit: 1000}},
+			req:   Request{Exclude: []string{"a"}},
+			oneOf: []string{"b"},
+		},
+		{
+			name:  "group",
+			nodes: []store.NodeLimits{{NodeID: "a", Group: "stable", Limits: "10 req/min"}, {NodeID: "b", Group: "canary", Limits: "10 req/min"}},
+			req:   Request{Group: "canary"},
+			oneOf: []string{"b"},
+		},
+		{
+			name:    "pinned node whatever its load",
+			nodes:   []store.NodeLimits{{NodeID: "a", Limits: "1 req/min"}, {NodeID: "b", Limits: "1 req/min"}},
+			records: recent("a", 1, 0),
+			req:     Request{Node: "a"},
+			oneOf:   []string{"a"},
+		},
+		{
+			name:  "pinned to an unknown node",
+			nodes: []store.NodeLimits{{NodeID: "a", Limits: "1 req/min"}},
+			req:   Request{Node: "z"},
+		},
+		{
+			name:    "operation limit",
+			nodes:   []store.NodeLimits{{NodeID: "a", Limits: "10 req/min", OperationLimits: map[string]string{"POST /request": "1 req/min"}}},
+			records: recent("a", 1, 0),
+			req:     Request{Operation: "POST /request"},
+			reject:  RejectOperation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, _ := newTestBalancer(t, tt.nodes, tt.records...)
+			ctx := context.Background()
+			// Random selection, so try a few times
+			for range 20 {
+				nodeID, err := lb.SelectNode(ctx, tt.req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tt.oneOf) == 0 {
+					if nodeID != "" {
+						t.Fatalf("selected %s, expected no node", nodeID)
+					}
+					continue
+				}
+				if !slices.Contains(tt.oneOf, nodeID) {
+					t.Fatalf("selected %q, expected one of %v", nodeID, tt.oneOf)
+				}
+			}
+			if tt.reject != "" {
+				if reason := lb.RejectReason(ctx, tt.req); reason != tt.reject {
+					t.Errorf("rejected for %s, expected %s", reason, tt.reject)
+				}
+			}
+		})
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	tests := []struct {
+		policy string
+		// attempts are the nodes the request is sent to, the last one
+		// answering successfully when succeeded is set
+		attempts  []string
+		succeeded bool
+		expected  map[string]int
+	}{
+		{policy: "attempt", attempts: []string{"a", "b"}, succeeded: true, expected: map[string]int{"a": 1, "b": 1}},
+		{policy: "once", attempts: []string{"a", "b"}, succeeded: true, expected: map[string]int{"a": 1}},
+		{policy: "success", attempts: []string{"a", "b"}, succeeded: true, expected: map[string]int{"b": 1}},
+		{policy: "success", attempts: []string{"a", "b"}, expected: map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy, err := ParseAccounting(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb, s := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "10 req/min"}, {NodeID: "b", Limits: "10 req/min"}})
+			ctx := context.Background()
+			attempts := lb.NewAttempts(policy, "POST /request", 5)
+			for _, nodeID := range tt.attempts {
+				if err := attempts.Start(ctx, nodeID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.succeeded {
+				if err := attempts.Succeeded(ctx, tt.attempts[len(tt.attempts)-1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			usage, _ := s.Usage(ctx, time.Now().Add(-time.Minute))
+			if len(usage) != len(tt.expected) {
+				t.Fatalf("recorded %+v, expected %v", usage, tt.expected)
+			}
+			for nodeID, n := range tt.expected {
+				if usage[nodeID].Requests != n || usage[nodeID].BPM != 5*n {
+					t.Errorf("%s: recorded %+v, expected %d requests", nodeID, usage[nodeID], n)
+				}
+			}
+		})
+	}
+	if _, err := ParseAccounting("twice"); err == nil {
+		t.Error("expected an error for an unknown accounting")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", RPMLimit: 10, BPMLimit: 100}}, recent("a", 3, 20)...)
+	quota, ok, err := lb.Quota(context.Background(), "a")
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if quota.RemainingRequests != 7 || quota.RemainingBytes != 40 {
+		t.Errorf("got %d requests and %d bytes remaining, expected 7 and 40", quota.RemainingRequests, quota.RemainingBytes)
+	}
+	if len(quota.Windows) != 2 || quota.Windows[0].Used != 3 || quota.Windows[1].Used != 60 {
+		t.Errorf("got windows %+v", quota.Windows)
+	}
+	if quota.Windows[0].ResetAt.IsZero() {
+		t.Error("a window with requests has no reset time")
+	}
+	if _, ok, _ := lb.Quota(context.Background(), "unknown"); ok {
+		t.Error("got a quota for an unknown node")
+	}
+}
+
+func TestBurstCredit(t *testing.T) {
+	// previous returns n records of a node in the minute before the last one
+	previous := func(nodeID string, n int) []store.Record {
+		records := make([]store.Record, n)
+		for i := range records {
+			records[i] = store.Record{NodeID: nodeID, Operation: "POST /request", Timestamp: time.Now().Add(-time.Duration(61+i) * time.Second)}
+		}
+		return records
+	}
+	tests := []struct {
+		name     string
+		node     store.NodeLimits
+		records  []store.Record
+		credit   int
+		expected int
+	}{
+		{name: "no rollover", node: store.NodeLimits{NodeID: "a", Limits: "10 req/min"}, records: previous("a", 2), expected: 10},
+		{name: "rollover", node: store.NodeLimits{NodeID: "a", Limits: "10 req/min", RolloverPercent: 50}, records: previous("a", 2), credit: 4, expected: 14},
+		{name: "capped", node: store.NodeLimits{NodeID: "a", Limits: "10 req/min", RolloverPercent: 50, BurstCapPercent: 30}, records: previous("a", 2), credit: 3, expected: 13},
+		{name: "nothing left over", node: store.NodeLimits{NodeID: "a", Limits: "10 req/min", RolloverPercent: 50}, records: previous("a", 10), expected: 10},
+		{
+			name:     "current minute not rolled over",
+			node:     store.NodeLimits{NodeID: "a", Limits: "10 req/min", RolloverPercent: 100},
+			records:  append(previous("a", 6), recent("a", 5, 0)...),
+			credit:   4,
+			expected: 9,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, _ := newTestBalancer(t, []store.NodeLimits{tt.node}, tt.records...)
+			quota, _, err := lb.Quota(context.Background(), "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if window := quota.Windows[0]; window.Credit != tt.credit || window.Limit != 10+tt.credit {
+				t.Errorf("got %+v, expected a credit of %d", window, tt.credit)
+			}
+			if quota.RemainingRequests != tt.expected {
+				t.Errorf("got %d requests remaining, expected %d", quota.RemainingRequests, tt.expected)
+			}
+		})
+	}
+
+	lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "10 req/min", RolloverPercent: 50}})
+	if got := lb.LongestWindow(); got != 2*time.Minute {
+		t.Errorf("records are kept for %s, expected the previous minute as well", got)
+	}
+}
+
+func TestSelectionAccountsAgainstLimits(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "3 req/min"}, {NodeID: "b", Limits: "2 req/min"}})
+	ctx := context.Background()
+	served := map[string]int{}
+	for {
+		nodeID, err := lb.SelectNode(ctx, Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeID == "" {
+			break
+		}
+		if err := lb.NewAttempts(AccountPerAttempt, "", 0).Start(ctx, nodeID); err != nil {
+			t.Fatal(err)
+		}
+		served[nodeID]++
+		if served["a"]+served["b"] > 5 {
+			t.Fatalf("served %v, over the pool's limits", served)
+		}
+	}
+	if served["a"] != 3 || served["b"] != 2 {
+		t.Errorf("served %v, expected a 3 and b 2", served)
+	}
+}
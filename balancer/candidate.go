@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// CandidateConfig struct represents a configuration change to try out
+// before applying it. Fields left out keep the live settings.
+type CandidateConfig struct {
+	// Nodes replaces the node pool
+	Nodes []store.NodeLimits `json:"nodes,omitempty"`
+	// OperationLimits replaces the limits set with SetOperationLimits
+	OperationLimits map[string]string `json:"operation_limits,omitempty"`
+	// GroupWeights replaces the traffic split between node groups
+	GroupWeights map[string]int `json:"group_weights,omitempty"`
+}
+
+// Candidate returns a load balancer with the settings of lb changed by
+// config, reading usage from the same store. It is meant for evaluation
+// only and runs no health checks, so callers exclude the nodes DownNodes of
+// lb returns instead.
+func (lb *LoadBalancer) Candidate(config CandidateConfig) (*LoadBalancer, error) {
+	c := New(lb.store)
+
+	nodes := lb.Nodes()
+	if config.Nodes != nil {
+		nodes = make(map[string]store.NodeLimits, len(config.Nodes))
+		for _, node := range config.Nodes {
+			if err := ValidateNode(node); err != nil {
+				return nil, err
+			}
+			nodes[node.NodeID] = node
+		}
+	}
+
+	lb.mu.RLock()
+	c.strategy = lb.strategy
+	c.mirrorGroup = lb.mirrorGroup
+	c.groupWeights = lb.groupWeights
+	c.tenants = lb.tenants
+	c.limitFactors, c.activeStandby = lb.limitFactors, lb.activeStandby
+	c.failover.active.Store(lb.failover.active.Load())
+	c.operationLimits = lb.operationLimits
+	c.globalLimits, c.globalWindows = lb.globalLimits, lb.globalWindows
+	c.priorities = lb.priorities
+	c.locality = lb.locality
+	lb.mu.RUnlock()
+	c.SetSeed(lb.Seed())
+
+	c.SetNodes(nodes)
+	if config.OperationLimits != nil {
+		if err := c.SetOperationLimits(config.OperationLimits); err != nil {
+			return nil, err
+		}
+	}
+	if config.GroupWeights != nil {
+		if err := c.SetGroupWeights(config.GroupWeights); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
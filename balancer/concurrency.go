@@ -0,0 +1,117 @@
+package balancer
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// inflight counts the requests each node is serving right now, and the
+// capacity tokens they hold
+type inflight struct {
+	mu     sync.Mutex
+	counts map[string]int
+	tokens map[string]int
+	// clamped holds the node and token counts clampTokens logged already
+	clamped map[string]bool
+}
+
+// clampTokens returns the tokens a request asking for tokens holds on a
+// node with limit capacity tokens: no more than limit, so a route holding
+// more tokens than a node has can still be served on it once the node is
+// idle. The first clamp of every node and token count is logged. The caller
+// holds lb.inflight.mu.
+func (lb *LoadBalancer) clampTokens(nodeID string, tokens, limit int) int {
+	if limit <= 0 || tokens <= limit {
+		return tokens
+	}
+	key := fmt.Sprintf("%s/%d", nodeID, tokens)
+	if !lb.inflight.clamped[key] {
+		lb.inflight.clamped[key] = true
+		log.Printf("node %s: requests holding %d capacity tokens hold its max_concurrent of %d instead", nodeID, tokens, limit)
+	}
+	return limit
+}
+
+// tokens returns how many capacity tokens the request holds on its node
+// while it is served, at least one
+func (req Request) tokens() int {
+	return max(req.Tokens, 1)
+}
+
+// saturated reports whether a node lacks the tokens free to take a request
+// holding tokens of them. The caller holds lb.mu.
+func (lb *LoadBalancer) saturated(nodeID string, tokens int) bool {
+	limit := lb.nodes[nodeID].MaxConcurrent
+	if limit <= 0 {
+		return false
+	}
+	lb.inflight.mu.Lock()
+	defer lb.inflight.mu.Unlock()
+	return lb.inflight.tokens[nodeID]+lb.clampTokens(nodeID, max(tokens, 1), limit) > limit
+}
+
+// Acquire takes one of a node's concurrency slots before a request is sent
+// to it, see AcquireTokens
+func (lb *LoadBalancer) Acquire(nodeID string) (release func(), ok bool) {
+	return lb.AcquireTokens(nodeID, 1)
+}
+
+// AcquireTokens takes tokens of a node's MaxConcurrent capacity tokens
+// before a request is sent to it, reporting false when fewer are free. The
+// request holds them for its whole lifetime, so a stream or long poll keeps
+// its share of the node until it ends rather than only counting once in the
+// rate windows. The returned function gives the tokens back and must be
+// called once the response has been read; it is safe to call more than once.
+// Nodes without MaxConcurrent always have tokens, unless they asked for no
+// more requests, see ObserveBackpressure; their tokens are still counted,
+// see InFlight and HeldTokens.
+func (lb *LoadBalancer) AcquireTokens(nodeID string, tokens int) (release func(), ok bool) {
+	tokens = max(tokens, 1)
+	lb.mu.RLock()
+	limit := lb.nodes[nodeID].MaxConcurrent
+	lb.mu.RUnlock()
+
+	lb.inflight.mu.Lock()
+	defer lb.inflight.mu.Unlock()
+	tokens = lb.clampTokens(nodeID, tokens, limit)
+	if (limit > 0 && lb.inflight.tokens[nodeID]+tokens > limit) || !lb.backpressure.take(nodeID) {
+		return nil, false
+	}
+	lb.inflight.counts[nodeID]++
+	lb.inflight.tokens[nodeID] += tokens
+	acquired := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			metrics.TokenSeconds.WithLabelValues(nodeID).Add(float64(tokens) * time.Since(acquired).Seconds())
+			lb.inflight.mu.Lock()
+			lb.inflight.counts[nodeID]--
+			lb.inflight.tokens[nodeID] -= tokens
+			if lb.inflight.counts[nodeID] == 0 {
+				delete(lb.inflight.counts, nodeID)
+				delete(lb.inflight.tokens, nodeID)
+			}
+			lb.inflight.mu.Unlock()
+		})
+	}, true
+}
+
+// InFlight returns how many requests a node is serving, holding the tokens
+// taken with Acquire or AcquireTokens
+func (lb *LoadBalancer) InFlight(nodeID string) int {
+	lb.inflight.mu.Lock()
+	defer lb.inflight.mu.Unlock()
+	return lb.inflight.counts[nodeID]
+}
+
+// HeldTokens returns how many of a node's capacity tokens the requests it
+// serves hold, counted against its MaxConcurrent
+func (lb *LoadBalancer) HeldTokens(nodeID string) int {
+	lb.inflight.mu.Lock()
+	defer lb.inflight.mu.Unlock()
+	return lb.inflight.tokens[nodeID]
+}
@@ -0,0 +1,113 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// TestReconfigureWhileSelecting changes the pool, the priority shares and
+// the event bus while requests are being routed. It finds nothing without
+// -race.
+func TestReconfigureWhileSelecting(t *testing.T) {
+	nodes := []store.NodeLimits{
+		{NodeID: "node-1", Limits: "1000 req/min", MaxConcurrent: 4},
+		{NodeID: "node-2", Limits: "1000 req/min", MaxConcurrent: 4},
+	}
+	lb, _ := newTestBalancer(t, nodes)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for range 50 {
+				nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request", Priority: "low", Tokens: 1 + i%2})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if nodeID == "" {
+					continue
+				}
+				if release, ok := lb.AcquireTokens(nodeID, 1+i%2); ok {
+					release()
+				}
+			}
+		})
+	}
+	wg.Go(func() {
+		for i := range 50 {
+			pool := map[string]store.NodeLimits{}
+			for _, node := range nodes[:1+i%2] {
+				pool[node.NodeID] = node
+			}
+			lb.SetNodes(pool)
+		}
+	})
+	wg.Go(func() {
+		for i := range 50 {
+			lb.SetPriorities(map[string]float64{"low": float64(50+i) / 100})
+		}
+	})
+	wg.Go(func() {
+		for range 50 {
+			bus := eventbus.New(eventbus.Options{Buffer: 1})
+			lb.SetEventBus(bus)
+			lb.SetEventBus(nil)
+			bus.Close()
+		}
+	})
+	wg.Wait()
+
+	for _, node := range nodes {
+		if n := lb.InFlight(node.NodeID); n != 0 {
+			t.Errorf("%d requests still in flight on %s after every release", n, node.NodeID)
+		}
+	}
+}
+
+func TestAcquireTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		held     int
+		tokens   int
+		acquired bool
+	}{
+		{name: "free tokens", held: 1, tokens: 2, acquired: true},
+		{name: "too few free tokens", held: 3, tokens: 2},
+		{name: "more tokens than the node has on an idle node", tokens: 10, acquired: true},
+		{name: "more tokens than the node has on a busy node", held: 1, tokens: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "node-1", Limits: "1000 req/min", MaxConcurrent: 4}})
+			if tt.held > 0 {
+				release, ok := lb.AcquireTokens("node-1", tt.held)
+				if !ok {
+					t.Fatalf("could not hold %d tokens", tt.held)
+				}
+				defer release()
+			}
+			selected, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request", Tokens: tt.tokens})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (selected == "node-1") != tt.acquired {
+				t.Errorf("selected %q, expected the node selected: %v", selected, tt.acquired)
+			}
+			release, ok := lb.AcquireTokens("node-1", tt.tokens)
+			if ok != tt.acquired {
+				t.Fatalf("acquired %v, expected %v", ok, tt.acquired)
+			}
+			if ok {
+				if held := lb.HeldTokens("node-1"); held != min(tt.held+tt.tokens, 4) {
+					t.Errorf("node holds %d tokens, expected %d", held, min(tt.held+tt.tokens, 4))
+				}
+				release()
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"sort"
+)
+
+// cheapest returns the nodes of nodeIDs with the lowest cost. lb.mu must be
+// held.
+func (lb *LoadBalancer) cheapest(nodeIDs []string) []string {
+	var cheapest []string
+	lowest := 0.0
+	for _, nodeID := range nodeIDs {
+		cost := lb.nodes[nodeID].Cost
+		switch {
+		case len(cheapest) == 0 || cost < lowest:
+			cheapest, lowest = []string{nodeID}, cost
+		case cost == lowest:
+			cheapest = append(cheapest, nodeID)
+		}
+	}
+	return cheapest
+}
+
+// CostTier struct represents the nodes sharing a cost
+type CostTier struct {
+	Cost  float64 `json:"cost"`
+	Nodes int     `json:"nodes"`
+	// Up counts the nodes in selection, see NodeStatus.State
+	Up int `json:"up"`
+	// Utilization is the mean utilization of the nodes up, 1 when none is
+	Utilization float64 `json:"utilization"`
+}
+
+// CostTiers sums up the status of nodes by cost, the cheapest tier first.
+// Mirror and standby nodes take no traffic and are left out.
+func CostTiers(nodes []NodeStatus) []CostTier {
+	byCost := map[float64]*CostTier{}
+	for _, node := range nodes {
+		if node.State == StateMirror || node.State == StateStandby {
+			continue
+		}
+		tier, ok := byCost[node.Cost]
+		if !ok {
+			tier = &CostTier{Cost: node.Cost}
+			byCost[node.Cost] = tier
+		}
+		tier.Nodes++
+		if node.State == StateUp {
+			tier.Up++
+			tier.Utilization += node.Utilization
+		}
+	}
+	tiers := make([]CostTier, 0, len(byCost))
+	for _, tier := range byCost {
+		if tier.Up > 0 {
+			tier.Utilization /= float64(tier.Up)
+		} else {
+			tier.Utilization = 1
+		}
+		tiers = append(tiers, *tier)
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Cost < tiers[j].Cost })
+	return tiers
+}
@@ -0,0 +1,55 @@
+package balancer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestCostStrategy(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "spot-1", Limits: "2 req/min", Cost: 1},
+		{NodeID: "spot-2", Limits: "1 req/min", Cost: 1},
+		{NodeID: "reserved-1", Limits: "100 req/min", Cost: 3},
+		{NodeID: "on-demand-1", Limits: "100 req/min", Cost: 10},
+	})
+	lb.SetStrategy(StrategyCost)
+	ctx := context.Background()
+	served := map[string]int{}
+	for range 5 {
+		nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[nodeID]++
+		if err := lb.RecordRequest(ctx, nodeID, "POST /request", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The cheap nodes fill up before the next tier gets a request
+	if expected := map[string]int{"spot-1": 2, "spot-2": 1, "reserved-1": 2}; !reflect.DeepEqual(served, expected) {
+		t.Errorf("served %v, expected %v", served, expected)
+	}
+}
+
+func TestCostTiers(t *testing.T) {
+	nodes := []NodeStatus{
+		{NodeID: "a", Cost: 3, State: StateUp, Utilization: 0.5},
+		{NodeID: "b", Cost: 1, State: StateUp, Utilization: 0.2},
+		{NodeID: "c", Cost: 1, State: StateUp, Utilization: 0.6},
+		{NodeID: "d", Cost: 1, State: StateDraining},
+		{NodeID: "e", Cost: 5, State: StateDraining},
+		{NodeID: "f", Cost: 0, State: StateMirror},
+		{NodeID: "g", Cost: 0, State: StateStandby},
+	}
+	expected := []CostTier{
+		{Cost: 1, Nodes: 3, Up: 2, Utilization: 0.4},
+		{Cost: 3, Nodes: 1, Up: 1, Utilization: 0.5},
+		{Cost: 5, Nodes: 1, Utilization: 1},
+	}
+	if got := CostTiers(nodes); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
@@ -0,0 +1,96 @@
+package balancer
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Random is a source of the random choices of node selection, see
+// SetRandom. *rand.Rand implements it; it need not be safe for concurrent
+// use, as selection draws from it one request at a time.
+type Random interface {
+	// Float64 returns a number in [0, 1)
+	Float64() float64
+	// Intn returns a number in [0, n)
+	Intn(n int) int
+}
+
+// selectionRandom holds the random source of node selection, see SetSeed
+type selectionRandom struct {
+	mu sync.Mutex
+	// rng is nil unless selection is deterministic, in which case it is
+	// the only source of its random choices
+	rng  Random
+	seed int64
+}
+
+// SetSeed makes node selection reproducible, for test environments and
+// replaying traffic while debugging: the candidates of every choice are
+// ordered by node ID, and every random choice, of the traffic split, the
+// strategy and mirroring, draws from one source seeded with seed. The same
+// requests against nodes in the same state are then routed the same way.
+// Seed zero goes back to random selection.
+func (lb *LoadBalancer) SetSeed(seed int64) {
+	var rng Random
+	if seed != 0 {
+		rng = rand.New(rand.NewSource(seed))
+	}
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	lb.random.rng, lb.random.seed = rng, seed
+}
+
+// SetRandom makes selection deterministic like SetSeed, drawing its random
+// choices from r instead of a seeded source, so a test can script them, e.g.
+// always draw 0 to take the first candidate of every choice. Nil goes back
+// to random selection.
+func (lb *LoadBalancer) SetRandom(r Random) {
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	lb.random.rng, lb.random.seed = r, 0
+}
+
+// Seed returns the seed of selection, zero unless SetSeed made it
+// deterministic
+func (lb *LoadBalancer) Seed() int64 {
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	return lb.random.seed
+}
+
+// deterministic reports whether selection is seeded, see SetSeed
+func (lb *LoadBalancer) deterministic() bool {
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	return lb.random.rng != nil
+}
+
+// float64 returns a number in [0, 1) from the selection's random source
+func (lb *LoadBalancer) float64() float64 {
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	if lb.random.rng == nil {
+		return rand.Float64()
+	}
+	return lb.random.rng.Float64()
+}
+
+// intn returns a number in [0, n) from the selection's random source
+func (lb *LoadBalancer) intn(n int) int {
+	lb.random.mu.Lock()
+	defer lb.random.mu.Unlock()
+	if lb.random.rng == nil {
+		return rand.Intn(n)
+	}
+	return lb.random.rng.Intn(n)
+}
+
+// stableOrder sorts nodeIDs, gathered from maps in random order, when
+// selection is deterministic
+func (lb *LoadBalancer) stableOrder(nodeIDs []string) []string {
+	if lb.deterministic() {
+		sort.Strings(nodeIDs)
+	}
+	return nodeIDs
+}
@@ -0,0 +1,91 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// scripted struct represents a Random drawing a fixed sequence of Intn
+// results and always 0 from Float64
+type scripted struct {
+	picks []int
+}
+
+func (s *scripted) Float64() float64 { return 0 }
+
+func (s *scripted) Intn(n int) int {
+	pick := s.picks[0]
+	s.picks = s.picks[1:]
+	return pick % n
+}
+
+var determinismNodes = []store.NodeLimits{
+	{NodeID: "node-3", Limits: "1000 req/min"},
+	{NodeID: "node-1", Limits: "1000 req/min"},
+	{NodeID: "node-2", Limits: "1000 req/min"},
+}
+
+// selections returns the nodes picked for n requests
+func selections(t *testing.T, lb *LoadBalancer, n int) []string {
+	t.Helper()
+	var picked []string
+	for range n {
+		nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, nodeID)
+	}
+	return picked
+}
+
+func TestSetSeed(t *testing.T) {
+	tests := []struct {
+		name   string
+		seeds  [2]int64
+		repeat bool
+	}{
+		{name: "same seed", seeds: [2]int64{42, 42}, repeat: true},
+		{name: "other seed", seeds: [2]int64{42, 43}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs [2][]string
+			for i, seed := range tt.seeds {
+				lb, _ := newTestBalancer(t, determinismNodes)
+				lb.SetSeed(seed)
+				if got := lb.Seed(); got != seed {
+					t.Fatalf("seed is %d, expected %d", got, seed)
+				}
+				runs[i] = selections(t, lb, 20)
+			}
+			if repeat := slices.Equal(runs[0], runs[1]); repeat != tt.repeat {
+				t.Errorf("got %v and %v, expected the same sequence: %v", runs[0], runs[1], tt.repeat)
+			}
+		})
+	}
+}
+
+func TestSetRandom(t *testing.T) {
+	tests := []struct {
+		picks    []int
+		expected []string
+	}{
+		{picks: []int{0, 0, 0}, expected: []string{"node-1", "node-1", "node-1"}},
+		{picks: []int{2, 0, 1}, expected: []string{"node-3", "node-1", "node-2"}},
+	}
+	for _, tt := range tests {
+		lb, _ := newTestBalancer(t, determinismNodes)
+		lb.SetSeed(7)
+		lb.SetRandom(&scripted{picks: tt.picks})
+		if seed := lb.Seed(); seed != 0 {
+			t.Errorf("seed is %d after SetRandom, expected 0", seed)
+		}
+		if got := selections(t, lb, len(tt.picks)); !slices.Equal(got, tt.expected) {
+			t.Errorf("picks %v selected %v, expected %v", tt.picks, got, tt.expected)
+		}
+	}
+}
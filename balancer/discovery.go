@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/discovery"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// RunDiscovery keeps the node pool in sync with the discoverer, either by
+// watching it or by polling it every interval. Discovered nodes take their
+// limits from the store and fall back to defaults, and their group from the
+// discoverer when it reports one; nodes that disappear from discovery are
+// removed.
+func (lb *LoadBalancer) RunDiscovery(ctx context.Context, d discovery.Discoverer, interval time.Duration, defaults store.NodeLimits) {
+	watcher, watching := d.(discovery.Watcher)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if watching {
+			err = watcher.Watch(ctx, func(nodes []discovery.Node) {
+				if err := lb.applyDiscovered(ctx, nodes, defaults); err != nil {
+					log.Printf("node discovery failed: %v", err)
+				}
+			})
+		} else {
+			err = lb.refreshNodes(ctx, d, defaults)
+		}
+		if err != nil {
+			// Keep serving with the last known pool
+			log.Printf("node discovery failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *LoadBalancer) refreshNodes(ctx context.Context, d discovery.Discoverer, defaults store.NodeLimits) error {
+	discovered, err := d.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	return lb.applyDiscovered(ctx, discovered, defaults)
+}
+
+// applyDiscovered replaces the node pool with the discovered nodes merged with their configured limits
+func (lb *LoadBalancer) applyDiscovered(ctx context.Context, discovered []discovery.Node, defaults store.NodeLimits) error {
+	configured, err := lb.store.NodeLimits(ctx)
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]store.NodeLimits, len(discovered))
+	for _, node := range discovered {
+		limits, ok := configured[node.NodeID]
+		if !ok {
+			limits = defaults
+			limits.NodeID = node.NodeID
+		}
+		limits.Address = node.Address
+		if node.Group != "" {
+			limits.Group = node.Group
+		}
+		nodes[node.NodeID] = limits
+	}
+	lb.SetNodes(nodes)
+	return nil
+}
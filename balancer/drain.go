@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"time"
+)
+
+// drain struct represents a node taking no new requests
+type drain struct {
+	since time.Time
+	// keepSticky lets the affinity keys sticking to the node stay on it
+	keepSticky bool
+}
+
+// DrainStatus struct represents how far a node is drained
+type DrainStatus struct {
+	NodeID     string    `json:"node_id"`
+	Draining   bool      `json:"draining"`
+	Since      time.Time `json:"since,omitzero"`
+	KeepSticky bool      `json:"keep_sticky,omitempty"`
+	// InFlight is how many requests and streams of this balancer the node
+	// is still serving
+	InFlight int `json:"in_flight"`
+	// Drained is set once a draining node serves nothing anymore and may be
+	// taken down
+	Drained bool `json:"drained"`
+}
+
+// Drain stops selecting a node for new requests while those in flight
+// finish; with keepSticky, requests whose affinity key sticks to the node
+// are still sent to it. It reports false for nodes not in the pool.
+func (lb *LoadBalancer) Drain(nodeID string, keepSticky bool) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if _, ok := lb.nodes[nodeID]; !ok {
+		return false
+	}
+	since := time.Now()
+	if d, ok := lb.drains[nodeID]; ok {
+		since = d.since
+	}
+	lb.drains[nodeID] = drain{since: since, keepSticky: keepSticky}
+	return true
+}
+
+// Undrain lets a node take new requests again, reporting whether it was draining
+func (lb *LoadBalancer) Undrain(nodeID string) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if _, ok := lb.drains[nodeID]; !ok {
+		return false
+	}
+	delete(lb.drains, nodeID)
+	return true
+}
+
+// DrainStatus reports whether a node is draining and what it still serves
+func (lb *LoadBalancer) DrainStatus(nodeID string) DrainStatus {
+	lb.mu.RLock()
+	d, draining := lb.drains[nodeID]
+	lb.mu.RUnlock()
+	status := DrainStatus{NodeID: nodeID, Draining: draining, InFlight: lb.InFlight(nodeID)}
+	if draining {
+		status.Since, status.KeepSticky = d.since, d.keepSticky
+		status.Drained = status.InFlight == 0
+	}
+	return status
+}
+
+// draining reports whether a node takes no new requests, for a request
+// whose affinity key sticks to it when sticky is set. The caller holds lb.mu.
+func (lb *LoadBalancer) draining(nodeID string, sticky bool) bool {
+	d, ok := lb.drains[nodeID]
+	return ok && !(sticky && d.keepSticky)
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestDrain(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "100 req/min"},
+		{NodeID: "node-2", Limits: "100 req/min"},
+	})
+	ctx := context.Background()
+	key := ""
+	for _, candidate := range []string{"client-1", "client-2", "client-3", "client-4", "client-5"} {
+		if lb.stickyNode(candidate, "") == "node-1" {
+			key = candidate
+			break
+		}
+	}
+	if key == "" {
+		t.Fatal("no key sticks to node-1")
+	}
+	selected := func(affinityKey string) map[string]bool {
+		t.Helper()
+		nodeIDs := map[string]bool{}
+		for range 20 {
+			nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request", AffinityKey: affinityKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodeIDs[nodeID] = true
+		}
+		return nodeIDs
+	}
+
+	release, ok := lb.Acquire("node-1")
+	if !ok {
+		t.Fatal("could not acquire node-1")
+	}
+	if !lb.Drain("node-1", true) {
+		t.Fatal("node-1 is not in the pool")
+	}
+	if got := selected(""); got["node-1"] {
+		t.Errorf("new requests went to %v, expected node-1 left out", got)
+	}
+	if got := selected(key); !got["node-1"] || len(got) != 1 {
+		t.Errorf("sticky requests went to %v, expected node-1 kept", got)
+	}
+	if status := lb.DrainStatus("node-1"); !status.Draining || !status.KeepSticky || status.InFlight != 1 || status.Drained {
+		t.Errorf("got %+v, expected node-1 draining one request", status)
+	}
+
+	// Draining again keeps when it started
+	since := lb.DrainStatus("node-1").Since
+	lb.Drain("node-1", false)
+	if got := selected(key); got["node-1"] {
+		t.Errorf("sticky requests went to %v, expected node-1 left out", got)
+	}
+	release()
+	if status := lb.DrainStatus("node-1"); !status.Since.Equal(since) || status.KeepSticky || !status.Drained {
+		t.Errorf("got %+v, expected node-1 drained since %s", status, since)
+	}
+
+	if !lb.Undrain("node-1") || lb.Undrain("node-1") {
+		t.Error("Undrain did not report node-1 draining once")
+	}
+	if got := selected(""); !got["node-1"] {
+		t.Errorf("new requests went to %v after undraining node-1", got)
+	}
+	if lb.Drain("node-9", false) {
+		t.Error("drained a node not in the pool")
+	}
+}
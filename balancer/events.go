@@ -0,0 +1,75 @@
+package balancer
+
+import (
+	"fmt"
+)
+
+// SetLimitFactors multiplies the limits of nodes by node ID, "*" standing
+// for every node without a factor of its own, e.g. to raise them for a
+// sales event. Nil restores the configured limits.
+func (lb *LoadBalancer) SetLimitFactors(factors map[string]float64) error {
+	copied := make(map[string]float64, len(factors))
+	for nodeID, factor := range factors {
+		if factor <= 0 {
+			return fmt.Errorf("node %s: limit factor must be positive", nodeID)
+		}
+		copied[nodeID] = factor
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	windows := make(map[string][]Window, len(lb.nodes))
+	for id, node := range lb.nodes {
+		w, err := nodeWindows(node)
+		if err != nil {
+			node.Limits = ""
+			w, _ = nodeWindows(node)
+		}
+		windows[id] = w
+	}
+	lb.limitFactors = copied
+	lb.windows = scaleNodeWindows(windows, copied)
+	return nil
+}
+
+// scaleNodeWindows multiplies the limits of the windows of each node by its
+// factor
+func scaleNodeWindows(windows map[string][]Window, factors map[string]float64) map[string][]Window {
+	if len(factors) == 0 {
+		return windows
+	}
+	for id, nodeWindows := range windows {
+		factor, ok := factors[id]
+		if !ok {
+			factor, ok = factors["*"]
+		}
+		if !ok || factor == 1 {
+			continue
+		}
+		scaled := make([]Window, len(nodeWindows))
+		for i, window := range nodeWindows {
+			window.Limit = int(float64(window.Limit) * factor)
+			scaled[i] = window
+		}
+		windows[id] = scaled
+	}
+	return windows
+}
+
+// ActivateStandby lets the given standby nodes take traffic, and keeps every
+// other standby node out of selection
+func (lb *LoadBalancer) ActivateStandby(nodeIDs []string) {
+	active := make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		active[nodeID] = true
+	}
+	lb.mu.Lock()
+	lb.activeStandby = active
+	lb.mu.Unlock()
+}
+
+// onStandby reports whether a node is a standby node neither an event nor
+// a failover activated. The caller holds lb.mu.
+func (lb *LoadBalancer) onStandby(nodeID string) bool {
+	return lb.nodes[nodeID].Standby && !lb.activeStandby[nodeID] && !lb.failover.active.Load()
+}
@@ -0,0 +1,189 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"sort"
+)
+
+// NodeDecision struct represents how node selection sees one node for a
+// request
+type NodeDecision struct {
+	NodeID string `json:"node_id"`
+	Group  string `json:"group,omitempty"`
+	// Available is set when the node may take the request; Reasons says why
+	// not otherwise, e.g. node_requests or draining
+	Available bool     `json:"available"`
+	Reasons   []string `json:"reasons,omitempty"`
+	// Windows are the node's limit windows cut to the request's share
+	Windows []WindowUsage `json:"windows"`
+	// Score is the node's latency score, its EWMA latency in seconds inflated
+	// by its error rate, zero before it answered a request
+	Score float64 `json:"score,omitempty"`
+	// Warmth is the share of its full weight the node gets while it warms up
+	Warmth float64 `json:"warmth"`
+}
+
+// Decision struct represents the inputs of node selection for a request:
+// every node with what keeps it from the request, and the quota math behind
+type Decision struct {
+	Strategy string `json:"strategy"`
+	// Share is the share of every window the request's priority class may fill
+	Share float64 `json:"share"`
+	// GlobalAvailable is unset when the global limits leave no room
+	GlobalAvailable bool           `json:"global_available"`
+	Nodes           []NodeDecision `json:"nodes"`
+	// Available are the nodes the request may go to, before the traffic split
+	Available []string `json:"available"`
+	// Selected is the node a dry run would pick, see DryRun, and SelectedBy
+	// how: pinned, affinity or the strategy
+	Selected   string `json:"selected,omitempty"`
+	SelectedBy string `json:"selected_by,omitempty"`
+	// Locality is which nodes the locality preference kept for the dry
+	// run's pick: zone, region or spillover
+	Locality string `json:"locality,omitempty"`
+}
+
+// Explain describes how SelectNode sees req, for developer mode: it reads the
+// same state but accounts nothing, so it may differ from a selection racing
+// other requests
+func (lb *LoadBalancer) Explain(ctx context.Context, req Request) (Decision, error) {
+	share := lb.share(req)
+	global, err := lb.globalAvailable(ctx, share)
+	if err != nil {
+		return Decision{}, err
+	}
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	decision := Decision{Strategy: "random", Share: share, GlobalAvailable: global, Nodes: []NodeDecision{}, Available: []string{}}
+	nodeIDs := make([]string, 0, len(quotas))
+	for nodeID := range quotas {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	warmth, warming := lb.warmth(nodeIDs)
+
+	lb.mu.RLock()
+	switch lb.strategy {
+	case StrategyLatency:
+		decision.Strategy = "latency"
+	case StrategyCost:
+		decision.Strategy = "cost"
+	}
+	withinLimits := []string{}
+	for i, nodeID := range nodeIDs {
+		quota := quotas[nodeID].scaled(share)
+		nd := NodeDecision{NodeID: nodeID, Group: lb.nodes[nodeID].Group, Windows: quota.Windows, Warmth: 1}
+		if warming {
+			nd.Warmth = warmth[i]
+		}
+		for _, check := range []struct {
+			reason string
+			failed bool
+		}{
+			{"excluded", req.excluded(nodeID)},
+			{"group", !req.allows(nd.Group)},
+			{"tenant", !lb.tenantAllows(req, nodeID)},
+			{"mirror_group", lb.inMirrorGroup(nodeID)},
+			{"failed", lb.failed(nodeID)},
+			{"unhealthy", lb.unhealthy(nodeID)},
+			{"ejected", lb.ejected(nodeID)},
+			{"draining", lb.draining(nodeID, false)},
+			{"maintenance", lb.inMaintenance(nodeID)},
+			{"standby", lb.onStandby(nodeID)},
+			{RejectConcurrency, lb.saturated(nodeID, req.tokens())},
+			{RejectBackpressure, lb.throttled(nodeID)},
+		} {
+			if check.failed {
+				nd.Reasons = append(nd.Reasons, check.reason)
+			}
+		}
+		if !quotas[nodeID].available() {
+			nd.Reasons = append(nd.Reasons, exhaustedWindow(quotas[nodeID]))
+		} else if !quota.available() {
+			nd.Reasons = append(nd.Reasons, RejectPriority)
+		}
+		if !global {
+			nd.Reasons = append(nd.Reasons, RejectGlobal)
+		}
+		if len(nd.Reasons) == 0 {
+			withinLimits = append(withinLimits, nodeID)
+		}
+		decision.Nodes = append(decision.Nodes, nd)
+	}
+	lb.mu.RUnlock()
+
+	lb.scores.mu.Lock()
+	for i, nd := range decision.Nodes {
+		if score, ok := lb.scores.scores[nd.NodeID]; ok {
+			decision.Nodes[i].Score = score.value()
+		}
+	}
+	lb.scores.mu.Unlock()
+
+	available, err := lb.operationAvailable(ctx, req.Operation, withinLimits)
+	if err != nil {
+		return Decision{}, err
+	}
+	operationOK := map[string]bool{}
+	for _, nodeID := range available {
+		operationOK[nodeID] = true
+	}
+	for i, nd := range decision.Nodes {
+		switch {
+		case operationOK[nd.NodeID]:
+			decision.Nodes[i].Available = true
+		case len(nd.Reasons) == 0:
+			decision.Nodes[i].Reasons = []string{RejectOperation}
+		}
+	}
+	decision.Available = available
+	return decision, nil
+}
+
+// DryRun explains how SelectNode sees req like Explain, and names the node
+// it would pick: the node the request is pinned to, the sticky node of its
+// affinity key while that is available, or else one of the available nodes
+// after the traffic split and the locality preference. Nothing is
+// accounted, and as picks among equal nodes are random, the node named is
+// one of those SelectNode could choose.
+func (lb *LoadBalancer) DryRun(ctx context.Context, req Request) (Decision, error) {
+	decision, err := lb.Explain(ctx, req)
+	if err != nil {
+		return Decision{}, err
+	}
+	if req.Node != "" {
+		decision.Selected, decision.SelectedBy = lb.selectPinned(req), "pinned"
+		return decision, nil
+	}
+	if req.AffinityKey != "" {
+		if sticky := lb.stickyNode(req.AffinityKey, req.Group); slices.Contains(decision.Available, sticky) {
+			decision.Selected, decision.SelectedBy = sticky, "affinity"
+			return decision, nil
+		}
+	}
+	candidates := decision.Available
+	if req.Group == "" {
+		candidates = lb.splitByGroup(candidates, lb.float64())
+	}
+	candidates, decision.Locality = lb.localNodes(req, candidates)
+	decision.Selected, decision.SelectedBy = lb.pick(candidates), decision.Strategy
+	return decision, nil
+}
+
+// exhaustedWindow returns the reject reason of the first window of quota
+// that is used up
+func exhaustedWindow(quota Quota) string {
+	for _, window := range quota.Windows {
+		if window.Used >= window.Limit && window.Unit == "bytes" {
+			return RejectNodeBytes
+		}
+		if window.Used >= window.Limit {
+			return RejectNodeRequests
+		}
+	}
+	return RejectNodeRequests
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// extraLoadWindow is how far back live and extra requests are compared
+const extraLoadWindow = time.Minute
+
+// extraLoadGuard caps the extra requests that debugging tools such as
+// mirroring add on top of live traffic, as a percentage of the live requests
+// seen within the last extraLoadWindow. Counts are kept in one-second
+// buckets, so the guard costs the same however busy the balancer is.
+type extraLoadGuard struct {
+	mu      sync.Mutex
+	percent float64
+	buckets [60]extraLoadBucket
+}
+
+type extraLoadBucket struct {
+	second int64
+	live   int
+	extra  int
+}
+
+// bucket returns the bucket of now, emptying it if it last held an older second
+func (g *extraLoadGuard) bucket(now time.Time) *extraLoadBucket {
+	second := now.Unix()
+	b := &g.buckets[second%int64(len(g.buckets))]
+	if b.second != second {
+		*b = extraLoadBucket{second: second}
+	}
+	return b
+}
+
+func (g *extraLoadGuard) countLive(now time.Time) {
+	g.mu.Lock()
+	g.bucket(now).live++
+	g.mu.Unlock()
+}
+
+// admit counts an extra request unless it would take the extra load within
+// the window past the cap, reporting whether it did
+func (g *extraLoadGuard) admit(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	since := now.Add(-extraLoadWindow).Unix()
+	live, extra := 0, 0
+	for _, b := range g.buckets {
+		if b.second > since {
+			live += b.live
+			extra += b.extra
+		}
+	}
+	if float64(extra+1) > float64(live)*g.percent/100 {
+		return false
+	}
+	g.bucket(now).extra++
+	return true
+}
+
+// SetExtraLoadCap caps the requests mirroring adds to at most percent of the
+// live requests of the last minute, however high the mirror percentage is
+// or however live traffic fluctuates. The default of 100 lets the extra load
+// match live traffic and 0 turns mirroring off.
+func (lb *LoadBalancer) SetExtraLoadCap(percent float64) error {
+	if percent < 0 {
+		return fmt.Errorf("extra load cap %v must not be negative", percent)
+	}
+	lb.extraLoad.mu.Lock()
+	lb.extraLoad.percent = percent
+	lb.extraLoad.mu.Unlock()
+	return nil
+}
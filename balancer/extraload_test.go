@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestExtraLoadGuard(t *testing.T) {
+	g := &extraLoadGuard{percent: 10}
+	now := time.Now()
+	for range 20 {
+		g.countLive(now)
+	}
+	// 10% of 20 live requests
+	for i, expected := range []bool{true, true, false} {
+		if got := g.admit(now); got != expected {
+			t.Errorf("extra request %d: got %v, expected %v", i+1, got, expected)
+		}
+	}
+	// The live and extra requests of a minute ago no longer count
+	later := now.Add(extraLoadWindow)
+	if g.admit(later) {
+		t.Error("admitted an extra request without live traffic")
+	}
+	for range 10 {
+		g.countLive(later)
+	}
+	if !g.admit(later) {
+		t.Error("refused the first extra request of 10 live ones")
+	}
+}
+
+func TestMirrorNodeCapped(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "live", Limits: "100 req/min"},
+		{NodeID: "shadow", Group: "shadow", Limits: "100 req/min"},
+	})
+	if err := lb.SetMirror("shadow", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.SetExtraLoadCap(50); err != nil {
+		t.Fatal(err)
+	}
+	mirrored, capped := 0, 0
+	for range 10 {
+		nodeID, err := lb.MirrorNode(context.Background())
+		switch {
+		case errors.Is(err, ErrExtraLoadCapped):
+			capped++
+		case err != nil:
+			t.Fatal(err)
+		case nodeID == "shadow":
+			mirrored++
+		default:
+			t.Fatalf("mirrored to %q, expected shadow", nodeID)
+		}
+	}
+	if mirrored != 5 || capped != 5 {
+		t.Errorf("mirrored %d and capped %d requests, expected half of them each", mirrored, capped)
+	}
+
+	if err := lb.SetExtraLoadCap(-1); err == nil {
+		t.Error("a negative cap was accepted")
+	}
+}
@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// FailoverPolicy struct represents when the standby nodes take traffic:
+// once fewer than MinHealthy primary nodes are up, until at least
+// MinHealthy are up again for Hold. Primary nodes are the nodes neither on
+// standby nor in the mirror group; up means not failed, unhealthy, ejected,
+// draining or in maintenance.
+type FailoverPolicy struct {
+	MinHealthy int
+	Hold       time.Duration
+}
+
+// failover struct represents the state of the standby failover
+type failover struct {
+	mu     sync.Mutex
+	policy FailoverPolicy
+	// recovered is when enough primary nodes were up again, zero while
+	// too few are
+	recovered time.Time
+	// active is read by onStandby under lb.mu, which checkFailover must
+	// not wait for while holding mu
+	active atomic.Bool
+}
+
+// SetFailoverPolicy changes when the standby nodes take over from the
+// primary nodes; a zero MinHealthy turns failover off
+func (lb *LoadBalancer) SetFailoverPolicy(policy FailoverPolicy) {
+	lb.failover.mu.Lock()
+	lb.failover.policy = policy
+	lb.failover.mu.Unlock()
+	lb.checkFailover(time.Now())
+}
+
+// FailoverActive reports whether the standby nodes take traffic because too
+// few primary nodes are up
+func (lb *LoadBalancer) FailoverActive() bool {
+	return lb.failover.active.Load()
+}
+
+// checkFailover activates the standby nodes when too few primary nodes are
+// up, and deactivates them once enough were up again for the policy's Hold
+func (lb *LoadBalancer) checkFailover(now time.Time) {
+	lb.failover.mu.Lock()
+	defer lb.failover.mu.Unlock()
+	policy := lb.failover.policy
+	if policy.MinHealthy <= 0 {
+		if lb.failover.active.Load() {
+			lb.setFailover(false, 0, policy)
+		}
+		return
+	}
+
+	up := 0
+	lb.mu.RLock()
+	empty := len(lb.nodes) == 0
+	for id, node := range lb.nodes {
+		if !node.Standby && !lb.inMirrorGroup(id) && !lb.down(id) {
+			up++
+		}
+	}
+	lb.mu.RUnlock()
+	if empty {
+		// The pool is not discovered yet
+		return
+	}
+
+	if up < policy.MinHealthy {
+		lb.failover.recovered = time.Time{}
+		if !lb.failover.active.Load() {
+			lb.setFailover(true, up, policy)
+		}
+		return
+	}
+	if !lb.failover.active.Load() {
+		return
+	}
+	if lb.failover.recovered.IsZero() {
+		lb.failover.recovered = now
+	}
+	if now.Sub(lb.failover.recovered) >= policy.Hold {
+		lb.setFailover(false, up, policy)
+	}
+}
+
+// setFailover activates or deactivates the standby nodes. The caller holds
+// lb.failover.mu.
+func (lb *LoadBalancer) setFailover(active bool, up int, policy FailoverPolicy) {
+	lb.failover.active.Store(active)
+	lb.failover.recovered = time.Time{}
+	details := map[string]any{"healthy": up, "min_healthy": policy.MinHealthy}
+	if active {
+		log.Printf("%d primary nodes up, below %d: standby nodes take traffic", up, policy.MinHealthy)
+		metrics.StandbyFailover.Set(1)
+		lb.events.Load().Publish(eventbus.Event{Type: eventbus.StandbyActivated, Details: details})
+		return
+	}
+	if policy.MinHealthy <= 0 {
+		log.Printf("standby failover turned off: standby nodes are back on standby")
+	} else {
+		log.Printf("%d primary nodes up again: standby nodes are back on standby", up)
+	}
+	metrics.StandbyFailover.Set(0)
+	lb.events.Load().Publish(eventbus.Event{Type: eventbus.StandbyDeactivated, Details: details})
+}
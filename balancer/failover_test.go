@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestFailover(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "primary-1", Limits: "100 req/min"},
+		{NodeID: "primary-2", Limits: "100 req/min"},
+		{NodeID: "standby-1", Limits: "100 req/min", Standby: true},
+	})
+	ctx := context.Background()
+	standbySelected := func() bool {
+		t.Helper()
+		nodeIDs, err := lb.AvailableNodes(ctx, Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, nodeID := range nodeIDs {
+			if nodeID == "standby-1" {
+				return true
+			}
+		}
+		return false
+	}
+
+	lb.SetFailoverPolicy(FailoverPolicy{MinHealthy: 2, Hold: time.Minute})
+	if lb.FailoverActive() || standbySelected() {
+		t.Fatal("the standby takes traffic with every primary up")
+	}
+
+	now := time.Now()
+	lb.Drain("primary-1", false)
+	lb.checkFailover(now)
+	if !lb.FailoverActive() || !standbySelected() {
+		t.Fatal("the standby does not take over with one primary up")
+	}
+
+	// The standby keeps taking traffic until the primaries are back for Hold
+	lb.Undrain("primary-1")
+	lb.checkFailover(now.Add(time.Second))
+	if !lb.FailoverActive() {
+		t.Fatal("failover ended before the hold")
+	}
+	lb.Drain("primary-1", false)
+	lb.checkFailover(now.Add(2 * time.Second))
+	lb.Undrain("primary-1")
+	lb.checkFailover(now.Add(3 * time.Second))
+	lb.checkFailover(now.Add(time.Minute + 2*time.Second))
+	if !lb.FailoverActive() {
+		t.Fatal("a primary going down again did not restart the hold")
+	}
+	lb.checkFailover(now.Add(time.Minute + 3*time.Second))
+	if lb.FailoverActive() || standbySelected() {
+		t.Error("the standby still takes traffic after the hold")
+	}
+
+	lb.Drain("primary-1", false)
+	lb.checkFailover(now)
+	lb.SetFailoverPolicy(FailoverPolicy{})
+	if lb.FailoverActive() {
+		t.Error("turning failover off left the standby taking traffic")
+	}
+}
@@ -0,0 +1,39 @@
+package balancer
+
+import (
+	"time"
+)
+
+// SimulateFailure makes the balancer treat a node as failed for d without
+// touching the node itself, to rehearse failover. A zero d ends the
+// simulation. It reports false for nodes not in the pool.
+func (lb *LoadBalancer) SimulateFailure(nodeID string, d time.Duration) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if _, ok := lb.nodes[nodeID]; !ok {
+		return false
+	}
+	if d <= 0 {
+		delete(lb.failedUntil, nodeID)
+		return true
+	}
+	lb.failedUntil[nodeID] = time.Now().Add(d)
+	return true
+}
+
+// FailedUntil returns when the simulated failure of a node ends, if one is active
+func (lb *LoadBalancer) FailedUntil(nodeID string) (time.Time, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	until, ok := lb.failedUntil[nodeID]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// failed reports whether a node is in a simulated failure. The caller holds lb.mu.
+func (lb *LoadBalancer) failed(nodeID string) bool {
+	until, ok := lb.failedUntil[nodeID]
+	return ok && time.Now().Before(until)
+}
@@ -0,0 +1,111 @@
+package balancer
+
+import (
+	"context"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// SetGlobalLimits caps the requests of all nodes together with a limit
+// expression such as "5000 req/min AND 20m bytes/h", checked before any node
+// is selected; an empty expression removes the cap
+func (lb *LoadBalancer) SetGlobalLimits(expr string) error {
+	var windows []Window
+	if expr != "" {
+		parsed, err := ParseLimits(expr)
+		if err != nil {
+			return err
+		}
+		windows = parsed
+	}
+	lb.mu.Lock()
+	lb.globalLimits, lb.globalWindows = expr, windows
+	lb.mu.Unlock()
+	return nil
+}
+
+// GlobalLimits returns the expression set with SetGlobalLimits
+func (lb *LoadBalancer) GlobalLimits() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.globalLimits
+}
+
+// GlobalQuota returns the state of every global limit window, summed over
+// the requests of all nodes and those replicated from other regions, and
+// false without global limits
+func (lb *LoadBalancer) GlobalQuota(ctx context.Context) (Quota, bool, error) {
+	lb.mu.RLock()
+	windows := lb.globalWindows
+	lb.mu.RUnlock()
+	if len(windows) == 0 {
+		return Quota{}, false, nil
+	}
+
+	now := time.Now()
+	usage := map[time.Duration]map[string]store.Usage{}
+	for _, window := range windows {
+		if _, ok := usage[window.Period]; ok {
+			continue
+		}
+		total, err := lb.localGlobalUsage(ctx, now, window.Period)
+		if err != nil {
+			return Quota{}, false, err
+		}
+		remote := lb.remoteUsage(window.Period, now)
+		total.Requests += remote.Requests
+		total.BPM += remote.BPM
+		// The quota of all nodes is kept under an empty node ID
+		usage[window.Period] = map[string]store.Usage{"": total}
+	}
+	return newQuota("", windows, usage), true, nil
+}
+
+// localGlobalUsage sums the usage of all nodes within the window of period
+// ending at now
+func (lb *LoadBalancer) localGlobalUsage(ctx context.Context, now time.Time, period time.Duration) (store.Usage, error) {
+	started := time.Now()
+	nodes, err := lb.store.Usage(ctx, now.Add(-period))
+	lb.storeTimes.observe("usage", started, err)
+	if err != nil {
+		return store.Usage{}, err
+	}
+	var total store.Usage
+	for _, u := range nodes {
+		total.Requests += u.Requests
+		total.BPM += u.BPM
+		if total.Oldest.IsZero() || u.Oldest.Before(total.Oldest) {
+			total.Oldest = u.Oldest
+		}
+	}
+	return total, nil
+}
+
+// globalAvailable reports whether the global limits, cut to share, admit
+// another request
+func (lb *LoadBalancer) globalAvailable(ctx context.Context, share float64) (bool, error) {
+	quota, limited, err := lb.GlobalQuota(ctx)
+	if err != nil || !limited {
+		return err == nil, err
+	}
+	return quota.scaled(share).available(), nil
+}
+
+// GlobalRateLimit returns the state of the tightest global request window
+// as seen by req, with Reset being how long until every exhausted global
+// window frees up. It is meant for requests rejected by the global limits.
+func (lb *LoadBalancer) GlobalRateLimit(ctx context.Context, req Request) (RateLimit, error) {
+	quota, _, err := lb.GlobalQuota(ctx)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	quota = quota.scaled(lb.share(req))
+	now := time.Now()
+	limit, _ := quota.rateLimit(now)
+	limit.Reset = time.Minute
+	if wait, ok := quota.availableIn(now); ok {
+		limit.Reset = wait
+	}
+	return limit, nil
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestGlobalLimits(t *testing.T) {
+	records := append(recent("node-1", 2, 10), recent("node-2", 1, 10)...)
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "100 req/min"},
+		{NodeID: "node-2", Limits: "100 req/min"},
+	}, records...)
+	ctx := context.Background()
+	if _, limited, _ := lb.GlobalQuota(ctx); limited {
+		t.Fatal("got a global quota without global limits")
+	}
+
+	if err := lb.SetGlobalLimits("4 req/min AND 100 bytes/h"); err != nil {
+		t.Fatal(err)
+	}
+	quota, limited, err := lb.GlobalQuota(ctx)
+	if err != nil || !limited {
+		t.Fatalf("got %v, %v", limited, err)
+	}
+	// The usage of every node counts
+	if quota.RemainingRequests != 1 || quota.RemainingBytes != 70 {
+		t.Errorf("got %d requests and %d bytes remaining, expected 1 and 70", quota.RemainingRequests, quota.RemainingBytes)
+	}
+
+	nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request"})
+	if err != nil || nodeID == "" {
+		t.Fatalf("got %q, %v, expected a node within the global limits", nodeID, err)
+	}
+	if err := lb.RecordRequest(ctx, nodeID, "POST /request", 10); err != nil {
+		t.Fatal(err)
+	}
+	if nodeID, _ := lb.SelectNode(ctx, Request{Operation: "POST /request"}); nodeID != "" {
+		t.Errorf("got %q over the global limits", nodeID)
+	}
+	if reason := lb.RejectReason(ctx, Request{Operation: "POST /request"}); reason != RejectGlobal {
+		t.Errorf("got reject reason %q, expected %q", reason, RejectGlobal)
+	}
+	limit, err := lb.GlobalRateLimit(ctx, Request{Operation: "POST /request"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.Limit != 4 || limit.Remaining != 0 || limit.Reset <= 0 || limit.Reset > time.Minute {
+		t.Errorf("got %+v, expected the minute window exhausted", limit)
+	}
+
+	if err := lb.SetGlobalLimits(""); err != nil {
+		t.Fatal(err)
+	}
+	if nodeID, _ := lb.SelectNode(ctx, Request{Operation: "POST /request"}); nodeID == "" {
+		t.Error("removing the global limits did not lift them")
+	}
+	if err := lb.SetGlobalLimits("4 req"); err == nil {
+		t.Error("an invalid expression was accepted")
+	}
+}
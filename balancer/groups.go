@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SetGroupWeights splits traffic between node groups by relative weight, e.g.
+// {"stable": 90, "canary": 10}. Groups without a weight receive no traffic;
+// an empty map turns splitting off and every node is eligible.
+func (lb *LoadBalancer) SetGroupWeights(weights map[string]int) error {
+	copied := make(map[string]int, len(weights))
+	for group, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("group %q: weight must not be negative", group)
+		}
+		copied[group] = weight
+	}
+
+	lb.mu.Lock()
+	lb.groupWeights = copied
+	lb.mu.Unlock()
+	return nil
+}
+
+// GroupWeights returns the current traffic split between node groups
+func (lb *LoadBalancer) GroupWeights() map[string]int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	weights := make(map[string]int, len(lb.groupWeights))
+	for group, weight := range lb.groupWeights {
+		weights[group] = weight
+	}
+	return weights
+}
+
+// splitByGroup narrows nodeIDs down to the nodes of one group, chosen by
+// weight among the groups that have a node in nodeIDs. roll picks the group
+// and must be uniform in [0, 1). Without group weights nodeIDs is returned
+// unchanged.
+func (lb *LoadBalancer) splitByGroup(nodeIDs []string, roll float64) []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if len(lb.groupWeights) == 0 {
+		return nodeIDs
+	}
+
+	byGroup := map[string][]string{}
+	for _, nodeID := range nodeIDs {
+		group := lb.nodes[nodeID].Group
+		if lb.groupWeights[group] > 0 {
+			byGroup[group] = append(byGroup[group], nodeID)
+		}
+	}
+
+	// Walk groups in a stable order so the same roll always lands on the same group
+	groups := make([]string, 0, len(byGroup))
+	total := 0
+	for group := range byGroup {
+		groups = append(groups, group)
+		total += lb.groupWeights[group]
+	}
+	sort.Strings(groups)
+
+	target := roll * float64(total)
+	for _, group := range groups {
+		target -= float64(lb.groupWeights[group])
+		if target < 0 {
+			return byGroup[group]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestSplitByGroup(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "canary-1", Limits: "10 req/min", Group: "canary"},
+		{NodeID: "stable-1", Limits: "10 req/min", Group: "stable"},
+		{NodeID: "stable-2", Limits: "10 req/min", Group: "stable"},
+		{NodeID: "legacy-1", Limits: "10 req/min", Group: "legacy"},
+	})
+	all := []string{"canary-1", "stable-1", "stable-2", "legacy-1"}
+	if got := lb.splitByGroup(all, 0.5); !slices.Equal(got, all) {
+		t.Errorf("got %v without weights, expected every node", got)
+	}
+
+	if err := lb.SetGroupWeights(map[string]int{"stable": 90, "canary": 10}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		nodeIDs  []string
+		roll     float64
+		expected []string
+	}{
+		// Groups are walked in name order: canary takes [0, 0.1)
+		{name: "canary", nodeIDs: all, roll: 0.05, expected: []string{"canary-1"}},
+		{name: "stable", nodeIDs: all, roll: 0.1, expected: []string{"stable-1", "stable-2"}},
+		{name: "last roll", nodeIDs: all, roll: 0.999, expected: []string{"stable-1", "stable-2"}},
+		{name: "canary unavailable", nodeIDs: []string{"stable-2", "legacy-1"}, roll: 0.05, expected: []string{"stable-2"}},
+		{name: "only unweighted groups", nodeIDs: []string{"legacy-1"}, roll: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lb.splitByGroup(tt.nodeIDs, tt.roll); !slices.Equal(got, tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSplitTraffic(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "canary-1", Limits: "10k req/min", Group: "canary"},
+		{NodeID: "stable-1", Limits: "10k req/min", Group: "stable"},
+	})
+	lb.SetSeed(1)
+	if err := lb.SetGroupWeights(map[string]int{"stable": 3, "canary": 1}); err != nil {
+		t.Fatal(err)
+	}
+	served := map[string]int{}
+	for range 1000 {
+		nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[nodeID]++
+	}
+	if served["canary-1"] < 200 || served["canary-1"] > 300 {
+		t.Errorf("canary served %d of 1000 requests, expected about 250", served["canary-1"])
+	}
+
+	// Requests for a group ignore the split
+	nodeID, _ := lb.SelectNode(context.Background(), Request{Operation: "POST /request", Group: "canary"})
+	if nodeID != "canary-1" {
+		t.Errorf("request for the canary group went to %q", nodeID)
+	}
+}
+
+func TestSetGroupWeights(t *testing.T) {
+	lb, _ := newTestBalancer(t, nil)
+	weights := map[string]int{"stable": 1}
+	if err := lb.SetGroupWeights(weights); err != nil {
+		t.Fatal(err)
+	}
+	weights["stable"] = 5
+	if got := lb.GroupWeights()["stable"]; got != 1 {
+		t.Errorf("got weight %d, expected the weights copied", got)
+	}
+	if err := lb.SetGroupWeights(map[string]int{"canary": -1}); err == nil {
+		t.Error("a negative weight was accepted")
+	}
+	if got := lb.GroupWeights(); len(got) != 1 {
+		t.Errorf("got weights %v after a failed update", got)
+	}
+}
@@ -0,0 +1,281 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/health"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// healthState struct represents the probe results of a node
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+	nextCheck time.Time
+	running   bool
+	// transitions holds the most recent state changes, oldest first
+	transitions []HealthTransition
+	// holdDownUntil keeps a flapping node out of selection even while it passes
+	holdDownUntil time.Time
+}
+
+// HealthTransition struct represents a node becoming healthy or unhealthy
+type HealthTransition struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	// Reason is the probe error for transitions to unhealthy
+	Reason string `json:"reason,omitempty"`
+}
+
+// FlapPolicy struct represents when a node counts as flapping: at least
+// Transitions state changes within Window. A flapping node is held out of
+// selection for HoldDown after it last turned healthy.
+type FlapPolicy struct {
+	Transitions int
+	Window      time.Duration
+	HoldDown    time.Duration
+}
+
+// maxTransitions bounds the health history kept per node
+const maxTransitions = 50
+
+// HealthHistory struct represents the health state and recent transitions of a node
+type HealthHistory struct {
+	NodeID        string             `json:"node_id"`
+	Checked       bool               `json:"checked"`
+	Healthy       bool               `json:"healthy"`
+	Flapping      bool               `json:"flapping"`
+	HoldDownUntil time.Time          `json:"hold_down_until,omitzero"`
+	Transitions   []HealthTransition `json:"transitions"`
+	// WarmingUntil is when a warming node gets its full weight, see SetSlowStart
+	WarmingUntil time.Time `json:"warming_until,omitzero"`
+	// EjectedUntil is when a node ejected by outlier detection is let back
+	// in, for EjectReason, see SetOutlierPolicy
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+	EjectReason  string    `json:"eject_reason,omitempty"`
+}
+
+// SetFlapPolicy changes how flapping nodes are detected and held down; a
+// zero policy turns flap detection off
+func (lb *LoadBalancer) SetFlapPolicy(policy FlapPolicy) {
+	lb.healthMu.Lock()
+	lb.flapPolicy = policy
+	lb.healthMu.Unlock()
+}
+
+// UpNodes returns the nodes that can serve requests: neither failing their
+// health checks nor in a simulated failure, and outside the shadow pool
+func (lb *LoadBalancer) UpNodes() []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	up := []string{}
+	for id := range lb.nodes {
+		if !lb.inMirrorGroup(id) && !lb.down(id) {
+			up = append(up, id)
+		}
+	}
+	return up
+}
+
+// DownNodes returns the nodes failing their health checks or in a simulated failure
+func (lb *LoadBalancer) DownNodes() []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	down := []string{}
+	for id := range lb.nodes {
+		if lb.down(id) {
+			down = append(down, id)
+		}
+	}
+	return down
+}
+
+// HealthHistory returns the health state and recent transitions of a node
+func (lb *LoadBalancer) HealthHistory(nodeID string) HealthHistory {
+	lb.healthMu.Lock()
+	defer lb.healthMu.Unlock()
+
+	history := HealthHistory{NodeID: nodeID, Healthy: true, Transitions: []HealthTransition{}}
+	history.WarmingUntil, _ = lb.WarmingUntil(nodeID)
+	history.EjectedUntil, history.EjectReason, _ = lb.Ejected(nodeID)
+	state, ok := lb.health[nodeID]
+	if !ok {
+		return history
+	}
+	now := time.Now()
+	history.Checked = true
+	history.Healthy = state.healthy
+	history.Flapping = lb.flapping(state, now)
+	if now.Before(state.holdDownUntil) {
+		history.HoldDownUntil = state.holdDownUntil
+	}
+	history.Transitions = append(history.Transitions, state.transitions...)
+	return history
+}
+
+// transition records a state change. The caller holds lb.healthMu.
+func (lb *LoadBalancer) transition(nodeID string, state *healthState, healthy bool, reason string) {
+	now := time.Now()
+	state.healthy = healthy
+	state.transitions = append(state.transitions, HealthTransition{Time: now, Healthy: healthy, Reason: reason})
+	if len(state.transitions) > maxTransitions {
+		state.transitions = state.transitions[len(state.transitions)-maxTransitions:]
+	}
+	if healthy {
+		metrics.NodeHealthy.WithLabelValues(nodeID).Set(1)
+		if lb.flapping(state, now) {
+			state.holdDownUntil = now.Add(lb.flapPolicy.HoldDown)
+			log.Printf("node %s is flapping, holding it down until %s", nodeID, state.holdDownUntil.Format(time.RFC3339))
+			metrics.NodeFlaps.WithLabelValues(nodeID).Inc()
+		} else {
+			log.Printf("node %s is healthy again", nodeID)
+		}
+		lb.events.Load().Publish(eventbus.Event{Type: eventbus.NodeHealthy, Node: nodeID})
+		// A node held down warms up once it is let back in
+		start := now
+		if state.holdDownUntil.After(now) {
+			start = state.holdDownUntil
+		}
+		lb.warmUp(nodeID, start)
+		return
+	}
+	metrics.NodeHealthy.WithLabelValues(nodeID).Set(0)
+	log.Printf("node %s failed its health check: %s", nodeID, reason)
+	lb.events.Load().Publish(eventbus.Event{Type: eventbus.NodeUnhealthy, Node: nodeID, Reason: reason})
+}
+
+// flapping reports whether a node changed state too often recently. The
+// caller holds lb.healthMu.
+func (lb *LoadBalancer) flapping(state *healthState, now time.Time) bool {
+	policy := lb.flapPolicy
+	if policy.Transitions <= 0 || policy.Window <= 0 {
+		return false
+	}
+	recent := 0
+	for _, t := range state.transitions {
+		if now.Sub(t.Time) <= policy.Window {
+			recent++
+		}
+	}
+	return recent >= policy.Transitions
+}
+
+// nodeProbes parses the health checks of nodes, leaving out invalid ones
+func nodeProbes(nodes map[string]store.NodeLimits) map[string]*health.Probe {
+	probes := map[string]*health.Probe{}
+	for id, node := range nodes {
+		if node.HealthCheck == nil {
+			continue
+		}
+		probe, err := health.NewProbe(*node.HealthCheck)
+		if err != nil {
+			log.Printf("node %s: %v", id, err)
+			continue
+		}
+		probes[id] = probe
+	}
+	return probes
+}
+
+// RunHealthChecks probes every node with a health check at its interval until
+// ctx is done. A node is taken out of selection after Fall consecutive
+// failed probes and put back after Rise consecutive successful ones. The
+// standby nodes are failed over to along the way, see SetFailoverPolicy.
+func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		lb.startDueProbes(ctx, time.Now())
+		lb.checkFailover(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *LoadBalancer) startDueProbes(ctx context.Context, now time.Time) {
+	lb.mu.RLock()
+	probes := make(map[string]*health.Probe, len(lb.probes))
+	addresses := make(map[string]string, len(lb.probes))
+	for id, probe := range lb.probes {
+		probes[id] = probe
+		addresses[id] = lb.nodes[id].Address
+	}
+	lb.mu.RUnlock()
+
+	lb.healthMu.Lock()
+	defer lb.healthMu.Unlock()
+	for id := range lb.health {
+		if _, ok := probes[id]; !ok {
+			// The node left the pool or no longer has a health check
+			delete(lb.health, id)
+			metrics.NodeHealthy.DeleteLabelValues(id)
+		}
+	}
+	for id, probe := range probes {
+		state, ok := lb.health[id]
+		if !ok {
+			state = &healthState{healthy: true}
+			lb.health[id] = state
+			metrics.NodeHealthy.WithLabelValues(id).Set(1)
+		}
+		if state.running || now.Before(state.nextCheck) {
+			continue
+		}
+		state.running = true
+		state.nextCheck = now.Add(probe.Interval())
+		go lb.probe(ctx, id, addresses[id], probe)
+	}
+}
+
+func (lb *LoadBalancer) probe(ctx context.Context, nodeID, address string, probe *health.Probe) {
+	err := probe.Run(ctx, address)
+
+	lb.healthMu.Lock()
+	defer lb.healthMu.Unlock()
+	state, ok := lb.health[nodeID]
+	if !ok {
+		return
+	}
+	state.running = false
+	if err == nil {
+		state.successes, state.failures = state.successes+1, 0
+		if !state.healthy && state.successes >= probe.Rise() {
+			lb.transition(nodeID, state, true, "")
+		}
+		return
+	}
+	state.successes, state.failures = 0, state.failures+1
+	if state.healthy && state.failures >= probe.Fall() {
+		lb.transition(nodeID, state, false, err.Error())
+	}
+}
+
+// unhealthy reports whether a node failed its health checks or is held down for flapping
+func (lb *LoadBalancer) unhealthy(nodeID string) bool {
+	lb.healthMu.Lock()
+	defer lb.healthMu.Unlock()
+	state, ok := lb.health[nodeID]
+	return ok && (!state.healthy || time.Now().Before(state.holdDownUntil))
+}
+
+// down reports whether a node is failed, simulated or detected by its health
+// checks, ejected as an outlier, draining, in a maintenance window or on
+// standby. The caller holds lb.mu.
+func (lb *LoadBalancer) down(nodeID string) bool {
+	return lb.downFor(nodeID, false)
+}
+
+// downFor is down for a request whose affinity key sticks to the node when
+// sticky is set, which a draining node may still serve. The caller holds lb.mu.
+func (lb *LoadBalancer) downFor(nodeID string, sticky bool) bool {
+	return lb.failed(nodeID) || lb.unhealthy(nodeID) || lb.ejected(nodeID) ||
+		lb.draining(nodeID, sticky) || lb.inMaintenance(nodeID) || lb.onStandby(nodeID)
+}
@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/health"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// execProbe returns a probe passing when the exec check runs true, and
+// failing when it runs false
+func execProbe(t *testing.T, command string) *health.Probe {
+	t.Helper()
+	probe, err := health.NewProbe(store.HealthCheck{Type: "exec", Command: []string{command}, Rise: 2, Fall: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return probe
+}
+
+func TestHealthChecks(t *testing.T) {
+	check := &store.HealthCheck{Type: "exec", Command: []string{"true"}}
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a", Limits: "10 req/min", HealthCheck: check},
+		{NodeID: "b", Limits: "10 req/min"},
+		{NodeID: "c", Limits: "10 req/min", HealthCheck: &store.HealthCheck{Type: "icmp"}},
+	})
+	ctx := context.Background()
+	if lb.probes["a"] == nil || lb.probes["b"] != nil || lb.probes["c"] != nil {
+		t.Fatalf("got probes %v, expected one for a only", lb.probes)
+	}
+	// Probes run here one at a time rather than by startDueProbes
+	lb.health["a"] = &healthState{healthy: true}
+	if history := lb.HealthHistory("a"); !history.Checked || !history.Healthy {
+		t.Fatalf("got %+v, expected a checked and healthy from the start", history)
+	}
+
+	failing, passing := execProbe(t, "false"), execProbe(t, "true")
+	for i := range 3 {
+		if lb.unhealthy("a") {
+			t.Fatalf("a failed after %d failed probes, expected 3", i)
+		}
+		lb.probe(ctx, "a", "", failing)
+	}
+	if !lb.unhealthy("a") || !slices.Equal(lb.DownNodes(), []string{"a"}) {
+		t.Fatalf("got down nodes %v, expected a after 3 failed probes", lb.DownNodes())
+	}
+	lb.probe(ctx, "a", "", passing)
+	lb.probe(ctx, "a", "", failing)
+	lb.probe(ctx, "a", "", passing)
+	if !lb.unhealthy("a") {
+		t.Fatal("a recovered without 2 probes passing in a row")
+	}
+	lb.probe(ctx, "a", "", passing)
+	if lb.unhealthy("a") {
+		t.Fatal("a is still down after 2 probes passed in a row")
+	}
+	history := lb.HealthHistory("a")
+	if len(history.Transitions) != 2 || history.Transitions[0].Healthy || history.Transitions[0].Reason == "" || !history.Transitions[1].Healthy {
+		t.Errorf("got transitions %+v, expected a failure with its reason and a recovery", history.Transitions)
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a", Limits: "10 req/min", HealthCheck: &store.HealthCheck{Type: "exec", Command: []string{"true"}}},
+	})
+	lb.SetFlapPolicy(FlapPolicy{Transitions: 4, Window: time.Minute, HoldDown: time.Hour})
+	lb.health["a"] = &healthState{healthy: true}
+	ctx := context.Background()
+	failing, passing := execProbe(t, "false"), execProbe(t, "true")
+	flap := func() {
+		for range 3 {
+			lb.probe(ctx, "a", "", failing)
+		}
+		for range 2 {
+			lb.probe(ctx, "a", "", passing)
+		}
+	}
+
+	flap()
+	if lb.unhealthy("a") || lb.HealthHistory("a").Flapping {
+		t.Fatal("a is held down after failing once")
+	}
+	flap()
+	history := lb.HealthHistory("a")
+	if !history.Healthy || !history.Flapping || !lb.unhealthy("a") {
+		t.Fatalf("got %+v, expected a passing but held down for flapping", history)
+	}
+	if until := time.Until(history.HoldDownUntil); until < 59*time.Minute {
+		t.Errorf("held down for %v, expected an hour", until)
+	}
+
+	// Transitions older than the window no longer count
+	state := lb.health["a"]
+	for i := range state.transitions {
+		state.transitions[i].Time = state.transitions[i].Time.Add(-2 * time.Minute)
+	}
+	state.holdDownUntil = time.Time{}
+	if lb.HealthHistory("a").Flapping || lb.unhealthy("a") {
+		t.Error("a is still flapping after the window")
+	}
+}
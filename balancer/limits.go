@@ -0,0 +1,248 @@
+package balancer
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Window struct represents one limit of a node: at most Limit requests, or
+// Limit bytes of BPM when Bytes is set, within any Period
+type Window struct {
+	Limit  int
+	Bytes  bool
+	Period time.Duration
+	// Rollover and BurstCap are the node's RolloverPercent and
+	// BurstCapPercent, see burstCredit
+	Rollover int
+	BurstCap int
+}
+
+func (w Window) unit() string {
+	if w.Bytes {
+		return "bytes"
+	}
+	return "req"
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%d %s/%s", w.Limit, w.unit(), w.Period)
+}
+
+var periodUnits = map[string]time.Duration{
+	"s":   time.Second,
+	"sec": time.Second,
+	"m":   time.Minute,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+	"day": 24 * time.Hour,
+}
+
+// ParseLimits parses a compound limit expression such as
+//
+//	max 100 req/s AND 3000 req/min AND 50k req/day AND 2m bytes/h
+//
+// The leading max is optional and AND is case-insensitive. Counts accept a k
+// or m suffix, periods are s, min, h, day or a Go duration.
+func ParseLimits(expr string) ([]Window, error) {
+	words := strings.Fields(expr)
+	if len(words) > 0 && strings.EqualFold(words[0], "max") {
+		words = words[1:]
+	}
+
+	var windows []Window
+	for {
+		end := slices.IndexFunc(words, func(word string) bool { return strings.EqualFold(word, "and") })
+		if end < 0 {
+			end = len(words)
+		}
+		fields := words[:end]
+		term := strings.Join(fields, " ")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("limit %q: expected <count> <unit>/<period>", term)
+		}
+
+		limit, err := parseCount(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("limit %q: %w", term, err)
+		}
+
+		unit, period, ok := strings.Cut(fields[1], "/")
+		if !ok {
+			return nil, fmt.Errorf("limit %q: missing period", term)
+		}
+		window := Window{Limit: limit}
+		switch unit {
+		case "req":
+		case "bytes":
+			window.Bytes = true
+		default:
+			return nil, fmt.Errorf("limit %q: unit must be req or bytes", term)
+		}
+
+		if d, ok := periodUnits[period]; ok {
+			window.Period = d
+		} else if window.Period, err = time.ParseDuration(period); err != nil || window.Period <= 0 {
+			return nil, fmt.Errorf("limit %q: invalid period %q", term, period)
+		}
+		windows = append(windows, window)
+
+		if end == len(words) {
+			return windows, nil
+		}
+		words = words[end+1:]
+	}
+}
+
+func parseCount(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier, s = 1000, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		multiplier, s = 1000000, strings.TrimSuffix(s, "m")
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	return int(n * float64(multiplier)), nil
+}
+
+// nodeWindows returns every window a node is limited by. The one-minute
+// RPM/BPM limits always apply to nodes without a limit expression; nodes with
+// one only use them when they are set.
+func nodeWindows(node store.NodeLimits) ([]Window, error) {
+	var windows []Window
+	if node.Limits != "" {
+		parsed, err := ParseLimits(node.Limits)
+		if err != nil {
+			return nil, err
+		}
+		windows = parsed
+	}
+	if node.Limits == "" || node.RPMLimit > 0 {
+		windows = append(windows, Window{Limit: node.RPMLimit, Period: time.Minute})
+	}
+	if node.Limits == "" || node.BPMLimit > 0 {
+		windows = append(windows, Window{Limit: node.BPMLimit, Bytes: true, Period: time.Minute})
+	}
+	for i := range windows {
+		windows[i].Rollover, windows[i].BurstCap = node.RolloverPercent, node.BurstCapPercent
+	}
+	return windows, nil
+}
+
+// burstCredit returns the capacity window gains from what the node left
+// unused in its previous period: Rollover percent of it, up to BurstCap
+// percent of the limit. usage holds the node's usage over the window's
+// period and over twice its period, see LoadBalancer.quotas.
+func burstCredit(nodeID string, window Window, usage map[time.Duration]map[string]store.Usage) int {
+	if window.Rollover <= 0 {
+		return 0
+	}
+	current, both := usage[window.Period][nodeID], usage[2*window.Period][nodeID]
+	previous := both.Requests - current.Requests
+	if window.Bytes {
+		previous = both.BPM - current.BPM
+	}
+	unused := max(window.Limit-previous, 0)
+	return min(unused*window.Rollover/100, window.maxCredit())
+}
+
+// maxCredit returns the most burst credit the window may gain
+func (w Window) maxCredit() int {
+	capPercent := w.BurstCap
+	if capPercent == 0 {
+		capPercent = 100
+	}
+	return w.Limit * min(w.Rollover, capPercent) / 100
+}
+
+// WindowUsage struct represents how much of a window a node has consumed
+type WindowUsage struct {
+	Limit     int    `json:"limit"`
+	Unit      string `json:"unit"`
+	Period    string `json:"period"`
+	Used      int    `json:"used"`
+	Remaining int    `json:"remaining"`
+	// ResetAt is when the oldest request in the window leaves it, freeing capacity
+	ResetAt time.Time `json:"reset_at,omitzero"`
+	// Credit is the burst credit rolled over from the previous period,
+	// included in Limit
+	Credit int `json:"credit,omitempty"`
+}
+
+// Quota struct represents the state of all windows of a node. Remaining
+// requests and bytes are the tightest across the windows of that unit, -1
+// when no window limits it.
+type Quota struct {
+	NodeID            string        `json:"node_id"`
+	Windows           []WindowUsage `json:"windows"`
+	RemainingRequests int           `json:"remaining_requests"`
+	RemainingBytes    int           `json:"remaining_bytes"`
+	// InFlight is how many capacity tokens the requests the node serves
+	// hold, of at most MaxConcurrent; both are zero for nodes without a
+	// concurrency limit
+	InFlight      int `json:"in_flight,omitempty"`
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// ThrottledUntil is when the node takes requests again after it asked
+	// for no more, see LoadBalancer.ObserveBackpressure
+	ThrottledUntil time.Time `json:"throttled_until,omitzero"`
+}
+
+func newQuota(nodeID string, windows []Window, usage map[time.Duration]map[string]store.Usage) Quota {
+	quota := Quota{NodeID: nodeID, Windows: make([]WindowUsage, 0, len(windows)), RemainingRequests: -1, RemainingBytes: -1}
+	for _, window := range windows {
+		u := usage[window.Period][nodeID]
+		used := u.Requests
+		if window.Bytes {
+			used = u.BPM
+		}
+		credit := burstCredit(nodeID, window, usage)
+		remaining := window.Limit + credit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		quota.Windows = append(quota.Windows, WindowUsage{
+			Limit:     window.Limit + credit,
+			Unit:      window.unit(),
+			Period:    window.Period.String(),
+			Used:      used,
+			Remaining: remaining,
+			ResetAt:   resetAt(u, window),
+			Credit:    credit,
+		})
+
+		tightest := &quota.RemainingRequests
+		if window.Bytes {
+			tightest = &quota.RemainingBytes
+		}
+		if *tightest < 0 || remaining < *tightest {
+			*tightest = remaining
+		}
+	}
+	return quota
+}
+
+func resetAt(u store.Usage, window Window) time.Time {
+	if u.Requests == 0 {
+		return time.Time{}
+	}
+	return u.Oldest.Add(window.Period)
+}
+
+// available reports whether the node can take another request in every window
+func (q Quota) available() bool {
+	for _, window := range q.Windows {
+		if window.Used >= window.Limit {
+			return false
+		}
+	}
+	return true
+}
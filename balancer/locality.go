@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// locality holds where the balancer runs, see SetLocality
+type locality struct {
+	zone, region string
+}
+
+// SetLocality sets the zone and region the balancer runs in. Requests
+// naming no zone of their own prefer the nodes of zone, then those of
+// region, and only spill over to the other nodes once none of these has
+// capacity left. Empty values turn the preference off.
+func (lb *LoadBalancer) SetLocality(zone, region string) {
+	lb.mu.Lock()
+	lb.locality = locality{zone: zone, region: region}
+	lb.mu.Unlock()
+}
+
+// preferLocal narrows nodeIDs, the nodes able to take the request, to those
+// in the request's zone, or else in its region, leaving them all when none
+// is. The region of a zone named by the request is the region of its nodes.
+// lb.mu must not be held.
+func (lb *LoadBalancer) preferLocal(req Request, nodeIDs []string) []string {
+	local, tier := lb.localNodes(req, nodeIDs)
+	if tier != "" {
+		metrics.LocalitySelections.WithLabelValues(tier).Inc()
+	}
+	return local
+}
+
+// localNodes narrows nodeIDs like preferLocal, also returning which nodes
+// were kept: zone, region or spillover for all of them, or nothing when
+// there is no locality to prefer. lb.mu must not be held.
+func (lb *LoadBalancer) localNodes(req Request, nodeIDs []string) ([]string, string) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	zone, region := lb.locality.zone, lb.locality.region
+	if req.Zone != "" {
+		zone, region = req.Zone, lb.zoneRegion(req.Zone)
+	}
+	if zone == "" && region == "" || len(nodeIDs) == 0 {
+		return nodeIDs, ""
+	}
+
+	var inZone, inRegion []string
+	for _, nodeID := range nodeIDs {
+		node := lb.nodes[nodeID]
+		switch {
+		case zone != "" && node.Zone == zone:
+			inZone = append(inZone, nodeID)
+		case region != "" && node.Region == region:
+			inRegion = append(inRegion, nodeID)
+		}
+	}
+	switch {
+	case len(inZone) > 0:
+		return inZone, "zone"
+	case len(inRegion) > 0:
+		return inRegion, "region"
+	}
+	return nodeIDs, "spillover"
+}
+
+// zoneRegion returns the region of the nodes of zone, the balancer's own
+// when none names one. lb.mu must be held.
+func (lb *LoadBalancer) zoneRegion(zone string) string {
+	for _, node := range lb.nodes {
+		if node.Zone == zone && node.Region != "" {
+			return node.Region
+		}
+	}
+	return lb.locality.region
+}
@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestLocalNodes(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a1", Limits: "10 req/min", Zone: "eu-west-1a", Region: "eu-west-1"},
+		{NodeID: "b1", Limits: "10 req/min", Zone: "eu-west-1b", Region: "eu-west-1"},
+		{NodeID: "u1", Limits: "10 req/min", Zone: "us-east-1a", Region: "us-east-1"},
+		{NodeID: "x1", Limits: "10 req/min"},
+	})
+	all := []string{"a1", "b1", "u1", "x1"}
+	tests := []struct {
+		name     string
+		zone     string
+		region   string
+		req      Request
+		nodeIDs  []string
+		expected []string
+		tier     string
+	}{
+		{name: "no locality", nodeIDs: all, expected: all},
+		{name: "own zone", zone: "eu-west-1a", region: "eu-west-1", nodeIDs: all, expected: []string{"a1"}, tier: "zone"},
+		{name: "zone full", zone: "eu-west-1a", region: "eu-west-1", nodeIDs: []string{"b1", "u1", "x1"}, expected: []string{"b1"}, tier: "region"},
+		{name: "region full", zone: "eu-west-1a", region: "eu-west-1", nodeIDs: []string{"u1", "x1"}, expected: []string{"u1", "x1"}, tier: "spillover"},
+		{name: "region only", region: "us-east-1", nodeIDs: all, expected: []string{"u1"}, tier: "region"},
+		{name: "request zone", zone: "eu-west-1a", region: "eu-west-1", req: Request{Zone: "us-east-1a"}, nodeIDs: all, expected: []string{"u1"}, tier: "zone"},
+		// The region of a zone the request names is the region of its
+		// nodes, or the balancer's own when it has none
+		{name: "request zone full", zone: "eu-west-1a", region: "eu-west-1", req: Request{Zone: "eu-west-1b"}, nodeIDs: []string{"a1", "u1"}, expected: []string{"a1"}, tier: "region"},
+		{name: "unknown request zone", zone: "eu-west-1a", region: "eu-west-1", req: Request{Zone: "eu-west-1c"}, nodeIDs: all, expected: []string{"a1", "b1"}, tier: "region"},
+		{name: "nothing to choose from", zone: "eu-west-1a", nodeIDs: nil, expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb.SetLocality(tt.zone, tt.region)
+			got, tier := lb.localNodes(tt.req, tt.nodeIDs)
+			if !slices.Equal(got, tt.expected) || tier != tt.tier {
+				t.Errorf("got %v (%q), expected %v (%q)", got, tier, tt.expected, tt.tier)
+			}
+		})
+	}
+}
+
+func TestLocalitySpillover(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a1", Limits: "2 req/min", Zone: "eu-west-1a", Region: "eu-west-1"},
+		{NodeID: "b1", Limits: "100 req/min", Zone: "eu-west-1b", Region: "eu-west-1"},
+	})
+	lb.SetLocality("eu-west-1a", "eu-west-1")
+	ctx := context.Background()
+	for i, expected := range []string{"a1", "a1", "b1"} {
+		nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeID != expected {
+			t.Fatalf("request %d went to %q, expected %s", i+1, nodeID, expected)
+		}
+		if err := lb.RecordRequest(ctx, nodeID, "POST /request", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/schedule"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// maintenanceHorizon is how far ahead ValidateMaintenance looks for a time
+// the windows would leave a group without nodes
+const maintenanceHorizon = 366 * 24 * time.Hour
+
+// maxMaintenanceStarts bounds how many times a window may open within the
+// horizon, keeping validation cheap; that is about every five minutes
+const maxMaintenanceStarts = 100000
+
+// span struct represents the time from start until end
+type span struct {
+	start, end time.Time
+}
+
+func (s span) contains(t time.Time) bool {
+	return !t.Before(s.start) && t.Before(s.end)
+}
+
+// maintenanceWindow struct represents a parsed store.MaintenanceWindow
+type maintenanceWindow struct {
+	store.MaintenanceWindow
+	cron     *schedule.Cron
+	duration time.Duration
+}
+
+// parseMaintenanceWindow checks a window's schedule, duration and time zone
+func parseMaintenanceWindow(w store.MaintenanceWindow) (maintenanceWindow, error) {
+	parsed := maintenanceWindow{MaintenanceWindow: w}
+	if w.ID == "" || w.NodeID == "" {
+		return parsed, errors.New("id and node_id are required")
+	}
+	location, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return parsed, fmt.Errorf("window %s: %w", w.ID, err)
+	}
+	if parsed.cron, err = schedule.Parse(w.Schedule, location); err != nil {
+		return parsed, fmt.Errorf("window %s: %w", w.ID, err)
+	}
+	if parsed.duration, err = time.ParseDuration(w.Duration); err != nil || parsed.duration < time.Minute {
+		return parsed, fmt.Errorf("window %s: duration must be a Go duration of at least 1m, got %q", w.ID, w.Duration)
+	}
+	return parsed, nil
+}
+
+// ValidateMaintenanceWindow checks a window's schedule, duration and time zone
+func ValidateMaintenanceWindow(w store.MaintenanceWindow) error {
+	_, err := parseMaintenanceWindow(w)
+	return err
+}
+
+// current returns when the window is open at t, counting overlapping
+// openings as one, or else when it opens next; ok is false when it never
+// opens again
+func (w maintenanceWindow) current(t time.Time) (s span, ok bool) {
+	for start := w.cron.Next(t.Add(-w.duration)); !start.IsZero() && !start.After(t); start = w.cron.Next(start) {
+		if !ok {
+			s.start, ok = start, true
+		}
+		s.end = start.Add(w.duration)
+	}
+	if ok {
+		return s, true
+	}
+	start := w.cron.Next(t)
+	return span{start, start.Add(w.duration)}, !start.IsZero()
+}
+
+// spans returns the times the window is open between from and to, oldest first
+func (w maintenanceWindow) spans(from, to time.Time) ([]span, error) {
+	spans := []span{}
+	for start := w.cron.Next(from.Add(-w.duration)); !start.IsZero() && start.Before(to); start = w.cron.Next(start) {
+		if len(spans) == maxMaintenanceStarts {
+			return nil, fmt.Errorf("window %s opens more than %d times a year", w.ID, maxMaintenanceStarts)
+		}
+		spans = append(spans, span{start, start.Add(w.duration)})
+	}
+	return spans, nil
+}
+
+// maintenance holds the maintenance windows and when they take their nodes
+// out of selection
+type maintenance struct {
+	mu      sync.RWMutex
+	windows []maintenanceWindow
+	// spans holds the current or next opening of each node's windows,
+	// updated by updateMaintenance
+	spans map[string][]span
+	// open holds the nodes whose window was open at the last update
+	open map[string]bool
+}
+
+// ValidateMaintenance checks that windows are valid and, together, never
+// take every node of a group out of selection at once within the next year,
+// so the last available node of a pool cannot be scheduled out
+func (lb *LoadBalancer) ValidateMaintenance(windows []store.MaintenanceWindow, now time.Time) error {
+	lb.mu.RLock()
+	groups := map[string][]string{}
+	for id, node := range lb.nodes {
+		groups[node.Group] = append(groups[node.Group], id)
+	}
+	known := make(map[string]bool, len(lb.nodes))
+	for id := range lb.nodes {
+		known[id] = true
+	}
+	lb.mu.RUnlock()
+
+	end := now.Add(maintenanceHorizon)
+	byNode := map[string][]span{}
+	for _, w := range windows {
+		parsed, err := parseMaintenanceWindow(w)
+		if err != nil {
+			return err
+		}
+		if !known[w.NodeID] {
+			return fmt.Errorf("window %s: unknown node %s", w.ID, w.NodeID)
+		}
+		spans, err := parsed.spans(now, end)
+		if err != nil {
+			return err
+		}
+		byNode[w.NodeID] = append(byNode[w.NodeID], spans...)
+	}
+
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		var everyNode []span
+		for i, id := range groups[group] {
+			spans := mergeSpans(byNode[id])
+			if i == 0 {
+				everyNode = spans
+			} else {
+				everyNode = intersectSpans(everyNode, spans)
+			}
+			if len(everyNode) == 0 {
+				break
+			}
+		}
+		if len(everyNode) > 0 {
+			return fmt.Errorf("the maintenance windows of group %q would take all of its %d nodes out of selection from %s until %s",
+				group, len(groups[group]), everyNode[0].start.Format(time.RFC3339), everyNode[0].end.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// mergeSpans sorts spans and joins the overlapping ones
+func mergeSpans(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+	merged := []span{}
+	for _, s := range spans {
+		if n := len(merged); n > 0 && !s.start.After(merged[n-1].end) {
+			if s.end.After(merged[n-1].end) {
+				merged[n-1].end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// intersectSpans returns the times within both a and b, which are merged
+func intersectSpans(a, b []span) []span {
+	both := []span{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].start, a[i].end
+		if b[j].start.After(start) {
+			start = b[j].start
+		}
+		if b[j].end.Before(end) {
+			end = b[j].end
+		}
+		if start.Before(end) {
+			both = append(both, span{start, end})
+		}
+		if a[i].end.Before(b[j].end) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return both
+}
+
+// SetMaintenanceWindows replaces the maintenance windows; a node is out of
+// selection while one of its windows is open. Invalid windows are logged
+// and ignored.
+func (lb *LoadBalancer) SetMaintenanceWindows(windows []store.MaintenanceWindow) {
+	parsed := make([]maintenanceWindow, 0, len(windows))
+	for _, w := range windows {
+		p, err := parseMaintenanceWindow(w)
+		if err != nil {
+			log.Printf("ignoring maintenance window: %v", err)
+			continue
+		}
+		parsed = append(parsed, p)
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].ID < parsed[j].ID })
+
+	lb.maintenance.mu.Lock()
+	lb.maintenance.windows = parsed
+	lb.maintenance.mu.Unlock()
+	lb.updateMaintenance(time.Now())
+}
+
+// updateMaintenance works out the current or next opening of every window
+// and logs the nodes entering and leaving maintenance
+func (lb *LoadBalancer) updateMaintenance(now time.Time) {
+	lb.maintenance.mu.Lock()
+	defer lb.maintenance.mu.Unlock()
+	spans := map[string][]span{}
+	open := map[string]bool{}
+	for _, w := range lb.maintenance.windows {
+		s, ok := w.current(now)
+		if !ok {
+			continue
+		}
+		spans[w.NodeID] = append(spans[w.NodeID], s)
+		if s.contains(now) && !open[w.NodeID] {
+			open[w.NodeID] = true
+			if !lb.maintenance.open[w.NodeID] {
+				log.Printf("node %s entered maintenance window %s until %s", w.NodeID, w.ID, s.end.Format(time.RFC3339))
+			}
+		}
+	}
+	for nodeID := range lb.maintenance.open {
+		if !open[nodeID] {
+			log.Printf("node %s left maintenance", nodeID)
+		}
+	}
+	lb.maintenance.spans, lb.maintenance.open = spans, open
+}
+
+// inMaintenance reports whether a window of the node is open
+func (lb *LoadBalancer) inMaintenance(nodeID string) bool {
+	lb.maintenance.mu.RLock()
+	defer lb.maintenance.mu.RUnlock()
+	spans := lb.maintenance.spans[nodeID]
+	if len(spans) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, s := range spans {
+		if s.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceStatus struct represents a maintenance window and whether it is open
+type MaintenanceStatus struct {
+	store.MaintenanceWindow
+	Open bool `json:"open"`
+	// Start and End are the current opening of the window, or else the
+	// next one; they are zero when it never opens again
+	Start time.Time `json:"start,omitzero"`
+	End   time.Time `json:"end,omitzero"`
+}
+
+// MaintenanceStatus returns every maintenance window ordered by ID
+func (lb *LoadBalancer) MaintenanceStatus() []MaintenanceStatus {
+	lb.maintenance.mu.RLock()
+	defer lb.maintenance.mu.RUnlock()
+	now := time.Now()
+	statuses := make([]MaintenanceStatus, 0, len(lb.maintenance.windows))
+	for _, w := range lb.maintenance.windows {
+		status := MaintenanceStatus{MaintenanceWindow: w.MaintenanceWindow}
+		if s, ok := w.current(now); ok {
+			status.Open, status.Start, status.End = s.contains(now), s.start, s.end
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// RunMaintenance loads the maintenance windows from source every interval,
+// so windows changed on any replica apply to all of them, until ctx is done.
+// Windows open and close on time between loads.
+func (lb *LoadBalancer) RunMaintenance(ctx context.Context, source store.Maintenance, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		loadCtx, cancel := context.WithTimeout(ctx, interval)
+		windows, err := source.MaintenanceWindows(loadCtx)
+		cancel()
+		if err != nil {
+			log.Printf("loading maintenance windows: %v", err)
+			lb.updateMaintenance(time.Now())
+		} else {
+			lb.SetMaintenanceWindows(windows)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestValidateMaintenanceWindow(t *testing.T) {
+	valid := store.MaintenanceWindow{ID: "w1", NodeID: "a", Schedule: "0 2 * * *", Duration: "2h", Timezone: "Europe/Berlin"}
+	tests := []struct {
+		name  string
+		edit  func(w *store.MaintenanceWindow)
+		valid bool
+	}{
+		{name: "valid", edit: func(w *store.MaintenanceWindow) {}, valid: true},
+		{name: "no id", edit: func(w *store.MaintenanceWindow) { w.ID = "" }},
+		{name: "no node", edit: func(w *store.MaintenanceWindow) { w.NodeID = "" }},
+		{name: "bad schedule", edit: func(w *store.MaintenanceWindow) { w.Schedule = "0 25 * * *" }},
+		{name: "bad duration", edit: func(w *store.MaintenanceWindow) { w.Duration = "two hours" }},
+		{name: "short duration", edit: func(w *store.MaintenanceWindow) { w.Duration = "30s" }},
+		{name: "bad time zone", edit: func(w *store.MaintenanceWindow) { w.Timezone = "Mars/Olympus" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := valid
+			tt.edit(&w)
+			if err := ValidateMaintenanceWindow(w); (err == nil) != tt.valid {
+				t.Errorf("got %v, expected valid to be %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateMaintenance(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a", Limits: "10 req/min"},
+		{NodeID: "b", Limits: "10 req/min"},
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		windows []store.MaintenanceWindow
+		err     string
+	}{
+		{name: "apart", windows: []store.MaintenanceWindow{
+			{ID: "w1", NodeID: "a", Schedule: "0 1 * * *", Duration: "1h"},
+			{ID: "w2", NodeID: "b", Schedule: "0 3 * * *", Duration: "1h"},
+		}},
+		{name: "back to back", windows: []store.MaintenanceWindow{
+			{ID: "w1", NodeID: "a", Schedule: "0 1 * * *", Duration: "1h"},
+			{ID: "w2", NodeID: "b", Schedule: "0 2 * * *", Duration: "1h"},
+		}},
+		{name: "overlapping", windows: []store.MaintenanceWindow{
+			{ID: "w1", NodeID: "a", Schedule: "0 1 * * *", Duration: "2h"},
+			{ID: "w2", NodeID: "b", Schedule: "0 2 * * 0", Duration: "1h"},
+		}, err: "from 2024-01-07T02:00:00Z until 2024-01-07T03:00:00Z"},
+		{name: "unknown node", windows: []store.MaintenanceWindow{
+			{ID: "w1", NodeID: "c", Schedule: "0 1 * * *", Duration: "1h"},
+		}, err: "unknown node c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lb.ValidateMaintenance(tt.windows, now)
+			if tt.err == "" && err != nil {
+				t.Errorf("got %v, expected the windows to be valid", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, expected an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "a", Limits: "10 req/min"},
+		{NodeID: "b", Limits: "10 req/min"},
+	})
+	lb.SetMaintenanceWindows([]store.MaintenanceWindow{
+		{ID: "open", NodeID: "a", Schedule: "* * * * *", Duration: "1h"},
+		{ID: "invalid", NodeID: "b", Schedule: "* * * * *", Duration: "1s"},
+	})
+	if !lb.inMaintenance("a") || lb.inMaintenance("b") {
+		t.Fatalf("got a in maintenance %v and b %v, expected only a", lb.inMaintenance("a"), lb.inMaintenance("b"))
+	}
+	statuses := lb.MaintenanceStatus()
+	if len(statuses) != 1 || statuses[0].ID != "open" || !statuses[0].Open || statuses[0].End.Sub(statuses[0].Start) < time.Hour {
+		t.Errorf("got %+v, expected only the open window", statuses)
+	}
+
+	// An hour from now the window has opened every minute since, and is
+	// open as one span until an hour after the last opening
+	later := time.Now().Add(time.Hour)
+	s, ok := lb.maintenance.windows[0].current(later)
+	if !ok || !s.contains(later) || s.end.Sub(s.start) <= time.Hour {
+		t.Errorf("got %v until %v, expected the openings counted as one", s.start, s.end)
+	}
+
+	lb.SetMaintenanceWindows(nil)
+	if lb.inMaintenance("a") {
+		t.Error("a stayed in maintenance without windows")
+	}
+}
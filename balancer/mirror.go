@@ -0,0 +1,72 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SetMirror makes the nodes of group a shadow pool: they are never selected
+// for regular traffic and instead receive a copy of percent of all requests.
+// An empty group turns mirroring off.
+func (lb *LoadBalancer) SetMirror(group string, percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("mirror percentage %v is not between 0 and 100", percent)
+	}
+	lb.mu.Lock()
+	lb.mirrorGroup = group
+	lb.mirrorPercent = percent
+	lb.mu.Unlock()
+	return nil
+}
+
+// inMirrorGroup reports whether a node belongs to the shadow pool. The caller holds lb.mu.
+func (lb *LoadBalancer) inMirrorGroup(nodeID string) bool {
+	return lb.mirrorGroup != "" && lb.nodes[nodeID].Group == lb.mirrorGroup
+}
+
+// ErrExtraLoadCapped means a request was not mirrored because mirrored
+// traffic is at its cap, see SetExtraLoadCap
+var ErrExtraLoadCapped = errors.New("mirrored traffic is at its cap")
+
+// MirrorNode decides whether a live request is mirrored and returns the
+// shadow node receiving the copy. Each call counts as a live request. Only
+// shadow nodes below their own limits are used, and ErrExtraLoadCapped is
+// returned for requests that would be mirrored if not for the extra load cap.
+func (lb *LoadBalancer) MirrorNode(ctx context.Context) (string, error) {
+	lb.mu.RLock()
+	group, percent := lb.mirrorGroup, lb.mirrorPercent
+	lb.mu.RUnlock()
+	if group == "" {
+		return "", nil
+	}
+	now := time.Now()
+	lb.extraLoad.countLive(now)
+	if lb.float64()*100 >= percent {
+		return "", nil
+	}
+
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	lb.mu.RLock()
+	candidates := []string{}
+	for nodeID, quota := range quotas {
+		if lb.inMirrorGroup(nodeID) && quota.available() && !lb.down(nodeID) && !lb.saturated(nodeID, 1) && !lb.throttled(nodeID) {
+			candidates = append(candidates, nodeID)
+		}
+	}
+	lb.mu.RUnlock()
+
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	if !lb.extraLoad.admit(now) {
+		return "", ErrExtraLoadCapped
+	}
+	candidates = lb.stableOrder(candidates)
+	return candidates[lb.intn(len(candidates))], nil
+}
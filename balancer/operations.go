@@ -0,0 +1,97 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// SetOperationLimits sets limit expressions per operation, e.g.
+// {"POST /upload": "10 req/min"}. They apply to every node on top of its own
+// limits, unless the node overrides the operation in its OperationLimits.
+func (lb *LoadBalancer) SetOperationLimits(limits map[string]string) error {
+	parsed := make(map[string][]Window, len(limits))
+	for operation, expr := range limits {
+		windows, err := ParseLimits(expr)
+		if err != nil {
+			return fmt.Errorf("operation %s: %w", operation, err)
+		}
+		parsed[operation] = windows
+	}
+
+	lb.mu.Lock()
+	lb.operationLimits = parsed
+	lb.operationWindows = resolveOperationWindows(lb.nodes, parsed)
+	lb.mu.Unlock()
+	return nil
+}
+
+// resolveOperationWindows merges the operation limits of each node over the
+// global ones. Operations with an invalid node expression keep the global limits.
+func resolveOperationWindows(nodes map[string]store.NodeLimits, global map[string][]Window) map[string]map[string][]Window {
+	resolved := make(map[string]map[string][]Window, len(nodes))
+	for id, node := range nodes {
+		windows := make(map[string][]Window, len(global)+len(node.OperationLimits))
+		for operation, w := range global {
+			windows[operation] = w
+		}
+		for operation, expr := range node.OperationLimits {
+			w, err := ParseLimits(expr)
+			if err != nil {
+				log.Printf("node %s operation %s: %v", id, operation, err)
+				continue
+			}
+			windows[operation] = w
+		}
+		resolved[id] = windows
+	}
+	return resolved
+}
+
+// operationAvailable returns the nodes of nodeIDs that are below every limit of operation
+func (lb *LoadBalancer) operationAvailable(ctx context.Context, operation string, nodeIDs []string) ([]string, error) {
+	if operation == "" {
+		return nodeIDs, nil
+	}
+
+	lb.mu.RLock()
+	windows := make(map[string][]Window, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if w := lb.operationWindows[id][operation]; len(w) > 0 {
+			windows[id] = w
+		}
+	}
+	lb.mu.RUnlock()
+	if len(windows) == 0 {
+		return nodeIDs, nil
+	}
+
+	now := time.Now()
+	usage := map[time.Duration]map[string]store.Usage{}
+	for _, nodeWindows := range windows {
+		for _, window := range nodeWindows {
+			if _, ok := usage[window.Period]; ok {
+				continue
+			}
+			started := time.Now()
+			u, err := lb.store.OperationUsage(ctx, operation, now.Add(-window.Period))
+			lb.storeTimes.observe("operation_usage", started, err)
+			if err != nil {
+				return nil, err
+			}
+			usage[window.Period] = u
+		}
+	}
+
+	available := make([]string, 0, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if nodeWindows, limited := windows[id]; limited && !newQuota(id, nodeWindows, usage).available() {
+			continue
+		}
+		available = append(available, id)
+	}
+	return available, nil
+}
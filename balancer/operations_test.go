@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestOperationLimits(t *testing.T) {
+	uploads := func(nodeID string, n int) []store.Record {
+		records := make([]store.Record, n)
+		for i := range records {
+			records[i] = store.Record{NodeID: nodeID, Operation: "POST /upload", Timestamp: time.Now().Add(-time.Duration(i+1) * time.Second)}
+		}
+		return records
+	}
+	records := append(uploads("node-1", 2), uploads("node-2", 2)...)
+	records = append(records, uploads("node-3", 5)...)
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "100 req/min"},
+		{NodeID: "node-2", Limits: "100 req/min", OperationLimits: map[string]string{"POST /upload": "5 req/min"}},
+		{NodeID: "node-3", Limits: "100 req/min", OperationLimits: map[string]string{"POST /upload": "5 req/min"}},
+		{NodeID: "node-4", Limits: "100 req/min", OperationLimits: map[string]string{"POST /upload": "never"}},
+	}, records...)
+	if err := lb.SetOperationLimits(map[string]string{"POST /upload": "2 req/min"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		operation string
+		expected  []string
+	}{
+		// node-1 is at the global limit, node-3 at its own; node-4 keeps
+		// the global limit over its invalid expression
+		{operation: "POST /upload", expected: []string{"node-2", "node-4"}},
+		{operation: "POST /request", expected: []string{"node-1", "node-2", "node-3", "node-4"}},
+		{operation: "", expected: []string{"node-1", "node-2", "node-3", "node-4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			got, err := lb.operationAvailable(context.Background(), tt.operation, []string{"node-1", "node-2", "node-3", "node-4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	if err := lb.SetOperationLimits(map[string]string{"POST /upload": "2 req"}); err == nil {
+		t.Error("an invalid expression was accepted")
+	}
+}
@@ -0,0 +1,278 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Reasons a node is ejected for by outlier detection
+const (
+	EjectConsecutiveFailures = "consecutive_failures"
+	EjectOversizedResponses  = "oversized_responses"
+	EjectLatency             = "latency"
+)
+
+// outlierSamples is how many recent latencies are kept per node
+const outlierSamples = 100
+
+// OutlierPolicy struct represents when passive outlier detection ejects a
+// node from selection. A node is ejected after ConsecutiveFailures failed
+// responses in a row, as many responses in a row over their route's size
+// limit, or when the LatencyPercentile of its recent latencies
+// is above LatencyFactor times the median of that percentile across the
+// pool. Ejections last BaseEjection times the number of times the node was
+// ejected recently, up to MaxEjection, and never take out more than
+// MaxEjectedPercent of the pool. A zero ConsecutiveFailures or LatencyFactor
+// turns that check off.
+type OutlierPolicy struct {
+	ConsecutiveFailures int
+	LatencyFactor       float64
+	LatencyPercentile   float64
+	// MinRequests is how many latencies a node needs before it is compared
+	MinRequests       int
+	Interval          time.Duration
+	BaseEjection      time.Duration
+	MaxEjection       time.Duration
+	MaxEjectedPercent int
+}
+
+// outlierState struct represents what outlier detection tracks of a node
+type outlierState struct {
+	failures int
+	// oversized counts the responses in a row over their route's size limit
+	oversized int
+	latencies []time.Duration
+	next      int
+	// ejections counts recent ejections, decaying by one every Interval the
+	// node spends in selection
+	ejections    int
+	ejectedUntil time.Time
+	reason       string
+}
+
+// outliers holds the outlier detection state of every node, see SetOutlierPolicy
+type outliers struct {
+	mu     sync.Mutex
+	policy OutlierPolicy
+	nodes  map[string]*outlierState
+}
+
+// SetOutlierPolicy changes when nodes are ejected by outlier detection; a
+// zero policy turns it off and lets ejected nodes back in
+func (lb *LoadBalancer) SetOutlierPolicy(policy OutlierPolicy) {
+	lb.outliers.mu.Lock()
+	defer lb.outliers.mu.Unlock()
+	lb.outliers.policy = policy
+	if policy.ConsecutiveFailures <= 0 && policy.LatencyFactor <= 0 {
+		for id := range lb.outliers.nodes {
+			metrics.NodeEjected.DeleteLabelValues(id)
+		}
+		clear(lb.outliers.nodes)
+	}
+}
+
+// observeOutlier feeds a response into outlier detection, ejecting the node
+// once it failed ConsecutiveFailures times in a row
+func (lb *LoadBalancer) observeOutlier(nodeID string, latency time.Duration, failed bool) {
+	lb.mu.RLock()
+	poolSize := len(lb.nodes)
+	lb.mu.RUnlock()
+	o := &lb.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	policy := o.policy
+	if policy.ConsecutiveFailures <= 0 && policy.LatencyFactor <= 0 {
+		return
+	}
+	state, ok := o.nodes[nodeID]
+	if !ok {
+		state = &outlierState{}
+		o.nodes[nodeID] = state
+	}
+	if !failed {
+		state.failures = 0
+		if len(state.latencies) < outlierSamples {
+			state.latencies = append(state.latencies, latency)
+		} else {
+			state.latencies[state.next] = latency
+			state.next = (state.next + 1) % outlierSamples
+		}
+		return
+	}
+	state.failures++
+	if policy.ConsecutiveFailures > 0 && state.failures >= policy.ConsecutiveFailures {
+		lb.eject(nodeID, state, EjectConsecutiveFailures, time.Now(), poolSize)
+	}
+}
+
+// ObserveResponseSize feeds whether a node's response went over the size
+// limit of its route into outlier detection, ejecting the node once
+// ConsecutiveFailures of its responses in a row did
+func (lb *LoadBalancer) ObserveResponseSize(nodeID string, oversized bool) {
+	lb.mu.RLock()
+	poolSize := len(lb.nodes)
+	lb.mu.RUnlock()
+	o := &lb.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.policy.ConsecutiveFailures <= 0 {
+		return
+	}
+	state, ok := o.nodes[nodeID]
+	if !ok {
+		if !oversized {
+			return
+		}
+		state = &outlierState{}
+		o.nodes[nodeID] = state
+	}
+	if !oversized {
+		state.oversized = 0
+		return
+	}
+	state.oversized++
+	if state.oversized >= o.policy.ConsecutiveFailures {
+		lb.eject(nodeID, state, EjectOversizedResponses, time.Now(), poolSize)
+	}
+}
+
+// eject takes a node out of selection unless it is ejected already or too
+// much of the pool of poolSize nodes is; one node always stays. The caller
+// holds outliers.mu, and must not hold mu.
+func (lb *LoadBalancer) eject(nodeID string, state *outlierState, reason string, now time.Time, poolSize int) {
+	o := &lb.outliers
+	if now.Before(state.ejectedUntil) {
+		return
+	}
+	ejected := 0
+	for _, s := range o.nodes {
+		if now.Before(s.ejectedUntil) {
+			ejected++
+		}
+	}
+	if allowed := max(1, poolSize*o.policy.MaxEjectedPercent/100); ejected >= allowed || ejected+1 >= poolSize {
+		log.Printf("node %s is an outlier (%s) but %d of %d nodes are ejected already", nodeID, reason, ejected, poolSize)
+		return
+	}
+
+	state.ejections++
+	duration := o.policy.BaseEjection * time.Duration(state.ejections)
+	if o.policy.MaxEjection > 0 {
+		duration = min(duration, o.policy.MaxEjection)
+	}
+	state.ejectedUntil, state.reason, state.failures, state.oversized = now.Add(duration), reason, 0, 0
+	// Its latencies led to the ejection; the node starts over once back
+	state.latencies, state.next = state.latencies[:0], 0
+	log.Printf("ejecting node %s for %s: %s", nodeID, duration, reason)
+	metrics.NodeEjections.WithLabelValues(nodeID, reason).Inc()
+	metrics.NodeEjected.WithLabelValues(nodeID).Set(1)
+	lb.events.Load().Publish(eventbus.Event{Type: eventbus.NodeEjected, Node: nodeID, Reason: reason, Details: map[string]any{"until": state.ejectedUntil}})
+	lb.warmUp(nodeID, state.ejectedUntil)
+}
+
+// Ejected returns until when and why outlier detection ejected a node, if
+// it is ejected
+func (lb *LoadBalancer) Ejected(nodeID string) (time.Time, string, bool) {
+	o := &lb.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state, ok := o.nodes[nodeID]
+	if !ok || !time.Now().Before(state.ejectedUntil) {
+		return time.Time{}, "", false
+	}
+	return state.ejectedUntil, state.reason, true
+}
+
+// ejected reports whether outlier detection took a node out of selection
+func (lb *LoadBalancer) ejected(nodeID string) bool {
+	_, _, ok := lb.Ejected(nodeID)
+	return ok
+}
+
+// RunOutlierDetection compares the latencies of the nodes every Interval
+// until ctx is done, ejecting the ones far slower than the rest
+func (lb *LoadBalancer) RunOutlierDetection(ctx context.Context) {
+	lb.outliers.mu.Lock()
+	interval := lb.outliers.policy.Interval
+	lb.outliers.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.detectOutliers(time.Now())
+		}
+	}
+}
+
+// detectOutliers ejects the nodes whose latency percentile is above
+// LatencyFactor times the pool's median, and lets the ejection count of
+// nodes in selection decay
+func (lb *LoadBalancer) detectOutliers(now time.Time) {
+	nodes := lb.Nodes()
+	o := &lb.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, state := range o.nodes {
+		if _, ok := nodes[id]; !ok {
+			delete(o.nodes, id)
+			metrics.NodeEjected.DeleteLabelValues(id)
+			continue
+		}
+		if !now.Before(state.ejectedUntil) {
+			if !state.ejectedUntil.IsZero() {
+				state.ejectedUntil = time.Time{}
+				metrics.NodeEjected.WithLabelValues(id).Set(0)
+				lb.events.Load().Publish(eventbus.Event{Type: eventbus.NodeRestored, Node: id})
+			} else if state.ejections > 0 {
+				state.ejections--
+			}
+		}
+	}
+
+	policy := o.policy
+	if policy.LatencyFactor <= 0 {
+		return
+	}
+	percentiles := map[string]time.Duration{}
+	for id, state := range o.nodes {
+		if now.Before(state.ejectedUntil) || len(state.latencies) < max(policy.MinRequests, 1) {
+			continue
+		}
+		percentiles[id] = percentile(state.latencies, policy.LatencyPercentile)
+	}
+	// A median needs peers to compare with
+	if len(percentiles) < 3 {
+		return
+	}
+	values := make([]time.Duration, 0, len(percentiles))
+	for _, p := range percentiles {
+		values = append(values, p)
+	}
+	median := percentile(values, 50)
+	threshold := time.Duration(float64(median) * policy.LatencyFactor)
+	for id, p := range percentiles {
+		if p > threshold {
+			lb.eject(id, o.nodes[id], EjectLatency, now, len(nodes))
+		}
+	}
+}
+
+// percentile returns the p-th percentile of samples, leaving them as they are
+func percentile(samples []time.Duration, p float64) time.Duration {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
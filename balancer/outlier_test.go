@@ -0,0 +1,130 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// newOutlierBalancer returns a balancer of n nodes detecting outliers with policy
+func newOutlierBalancer(t *testing.T, n int, policy OutlierPolicy) *LoadBalancer {
+	t.Helper()
+	nodes := make([]store.NodeLimits, n)
+	for i := range nodes {
+		nodes[i] = store.NodeLimits{NodeID: fmt.Sprintf("node-%d", i+1), Limits: "100 req/min"}
+	}
+	lb, _ := newTestBalancer(t, nodes)
+	lb.SetOutlierPolicy(policy)
+	return lb
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	lb := newOutlierBalancer(t, 3, OutlierPolicy{ConsecutiveFailures: 3, BaseEjection: time.Minute, MaxEjection: 3 * time.Minute, MaxEjectedPercent: 50})
+	for _, failed := range []bool{true, true, false, true, true} {
+		lb.observeOutlier("node-1", time.Millisecond, failed)
+	}
+	if lb.ejected("node-1") {
+		t.Fatal("a success did not reset the failures in a row")
+	}
+	lb.observeOutlier("node-1", time.Millisecond, true)
+	until, reason, ok := lb.Ejected("node-1")
+	if !ok || reason != EjectConsecutiveFailures || time.Until(until) > time.Minute {
+		t.Fatalf("got %s, %q, %v, expected node-1 ejected for a minute", until, reason, ok)
+	}
+	nodeIDs, err := lb.AvailableNodes(context.Background(), Request{Operation: "POST /request"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(nodeIDs, "node-1") {
+		t.Errorf("got nodes %v, expected node-1 out of selection", nodeIDs)
+	}
+
+	// Half the pool of 3 is one node, so node-2 stays in
+	for range 3 {
+		lb.observeOutlier("node-2", time.Millisecond, true)
+	}
+	if lb.ejected("node-2") {
+		t.Error("node-2 was ejected beyond MaxEjectedPercent")
+	}
+
+	// Once back, node-1 is ejected twice as long, up to MaxEjection
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		lb.outliers.nodes["node-1"].ejectedUntil = time.Now().Add(-time.Second)
+		lb.detectOutliers(time.Now())
+		for range 3 {
+			lb.observeOutlier("node-1", time.Millisecond, true)
+		}
+		until, _, ok := lb.Ejected("node-1")
+		if left := time.Until(until); !ok || left > expected || left < expected-time.Second {
+			t.Errorf("ejected for %s, expected %s", left, expected)
+		}
+	}
+}
+
+func TestOversizedResponses(t *testing.T) {
+	lb := newOutlierBalancer(t, 3, OutlierPolicy{ConsecutiveFailures: 2, BaseEjection: time.Minute, MaxEjectedPercent: 100})
+	for _, oversized := range []bool{true, false, true} {
+		lb.ObserveResponseSize("node-1", oversized)
+	}
+	if lb.ejected("node-1") {
+		t.Fatal("a response within the limit did not reset the count")
+	}
+	lb.ObserveResponseSize("node-1", true)
+	if _, reason, ok := lb.Ejected("node-1"); !ok || reason != EjectOversizedResponses {
+		t.Errorf("got %q, %v, expected node-1 ejected for oversized responses", reason, ok)
+	}
+}
+
+func TestLatencyOutliers(t *testing.T) {
+	lb := newOutlierBalancer(t, 5, OutlierPolicy{LatencyFactor: 3, LatencyPercentile: 90, MinRequests: 5, BaseEjection: time.Minute, MaxEjectedPercent: 50})
+	for range 5 {
+		lb.observeOutlier("node-1", 10*time.Millisecond, false)
+		lb.observeOutlier("node-2", 20*time.Millisecond, false)
+		lb.observeOutlier("node-3", 50*time.Millisecond, false)
+		lb.observeOutlier("node-4", 100*time.Millisecond, false)
+	}
+	// node-5 has too few latencies to be compared yet
+	lb.observeOutlier("node-5", time.Second, false)
+	lb.detectOutliers(time.Now())
+
+	for nodeID, expected := range map[string]bool{"node-1": false, "node-2": false, "node-3": false, "node-4": true, "node-5": false} {
+		if _, reason, ok := lb.Ejected(nodeID); ok != expected || (ok && reason != EjectLatency) {
+			t.Errorf("%s: ejected %v (%q), expected %v", nodeID, ok, reason, expected)
+		}
+	}
+	if got := len(lb.outliers.nodes["node-4"].latencies); got != 0 {
+		t.Errorf("node-4 kept %d latencies, expected it to start over", got)
+	}
+}
+
+func TestOutlierPolicyOff(t *testing.T) {
+	lb := newOutlierBalancer(t, 3, OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjectedPercent: 50})
+	lb.observeOutlier("node-1", time.Millisecond, true)
+	if !lb.ejected("node-1") {
+		t.Fatal("node-1 was not ejected")
+	}
+	lb.SetOutlierPolicy(OutlierPolicy{})
+	if lb.ejected("node-1") {
+		t.Error("turning detection off did not let node-1 back in")
+	}
+	lb.observeOutlier("node-1", time.Millisecond, true)
+	if lb.ejected("node-1") {
+		t.Error("node-1 was ejected with detection off")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := []time.Duration{5, 1, 4, 2, 3}
+	for p, expected := range map[float64]time.Duration{0: 1, 50: 3, 90: 4, 100: 5} {
+		if got := percentile(samples, p); got != expected {
+			t.Errorf("percentile %g: got %d, expected %d", p, got, expected)
+		}
+	}
+	if !slices.Equal(samples, []time.Duration{5, 1, 4, 2, 3}) {
+		t.Errorf("samples were reordered: %v", samples)
+	}
+}
@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// DefaultPriority is the priority class of requests that name none
+const DefaultPriority = "normal"
+
+// ParsePriorities parses priority classes and the share of every window
+// their requests may fill, in percent, e.g. "low=80,normal=95". Classes not
+// listed may fill the windows entirely.
+func ParsePriorities(spec string) (map[string]float64, error) {
+	shares := map[string]float64{}
+	if strings.TrimSpace(spec) == "" {
+		return shares, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		class, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		class = strings.TrimSpace(class)
+		if !ok || class == "" {
+			return nil, fmt.Errorf("invalid priority class %q, expected class=percent", part)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid share %q of priority class %s, expected a percentage above 0 and up to 100", value, class)
+		}
+		shares[class] = percent / 100
+	}
+	return shares, nil
+}
+
+// SetPriorities sets the share of every window the requests of each
+// priority class may fill, so lower classes are shed while capacity is
+// still left for higher ones. Requests without a class are DefaultPriority.
+func (lb *LoadBalancer) SetPriorities(shares map[string]float64) {
+	copied := maps.Clone(shares)
+	lb.mu.Lock()
+	lb.priorities = copied
+	lb.mu.Unlock()
+}
+
+// share returns the share of every window the request may fill
+func (lb *LoadBalancer) share(req Request) float64 {
+	priority := req.Priority
+	if priority == "" {
+		priority = DefaultPriority
+	}
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if share, ok := lb.priorities[priority]; ok {
+		return share
+	}
+	return 1
+}
+
+// scaled returns q as seen by a request that may fill share of every
+// window: each limit cut to that share
+func (q Quota) scaled(share float64) Quota {
+	if share >= 1 {
+		return q
+	}
+	scaled := q
+	scaled.Windows = make([]WindowUsage, len(q.Windows))
+	scaled.RemainingRequests, scaled.RemainingBytes = -1, -1
+	for i, window := range q.Windows {
+		window.Limit = int(float64(window.Limit) * share)
+		window.Remaining = max(window.Limit-window.Used, 0)
+		scaled.Windows[i] = window
+
+		tightest := &scaled.RemainingRequests
+		if window.Unit == "bytes" {
+			tightest = &scaled.RemainingBytes
+		}
+		if *tightest < 0 || window.Remaining < *tightest {
+			*tightest = window.Remaining
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestParsePriorities(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected map[string]float64
+		wantErr  bool
+	}{
+		{spec: "", expected: map[string]float64{}},
+		{spec: "low=80,normal=95", expected: map[string]float64{"low": 0.8, "normal": 0.95}},
+		{spec: " low = 50% , batch=12.5", expected: map[string]float64{"low": 0.5, "batch": 0.125}},
+		{spec: "low", wantErr: true},
+		{spec: "=80", wantErr: true},
+		{spec: "low=0", wantErr: true},
+		{spec: "low=101", wantErr: true},
+		{spec: "low=most", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			shares, err := ParsePriorities(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+			if err == nil && !maps.Equal(shares, tt.expected) {
+				t.Errorf("got %v, expected %v", shares, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPrioritySharing(t *testing.T) {
+	// The node has 3 of its 10 requests left
+	lb, _ := newTestBalancer(t, []store.NodeLimits{{NodeID: "a", Limits: "10 req/min"}}, recent("a", 7, 0)...)
+	lb.SetPriorities(map[string]float64{"low": 0.7, DefaultPriority: 0.8})
+	ctx := context.Background()
+	tests := []struct {
+		priority string
+		expected string
+	}{
+		{priority: "low", expected: ""},
+		{priority: "", expected: "a"},
+		{priority: DefaultPriority, expected: "a"},
+		{priority: "high", expected: "a"},
+	}
+	for _, tt := range tests {
+		nodeID, err := lb.SelectNode(ctx, Request{Operation: "POST /request", Priority: tt.priority})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeID != tt.expected {
+			t.Errorf("priority %q got %q, expected %q", tt.priority, nodeID, tt.expected)
+		}
+	}
+
+	// Once normal requests fill their 8, only high ones are served
+	if err := lb.RecordRequest(ctx, "a", "POST /request", 0); err != nil {
+		t.Fatal(err)
+	}
+	for priority, expected := range map[string]string{"": "", "high": "a"} {
+		if nodeID, _ := lb.SelectNode(ctx, Request{Operation: "POST /request", Priority: priority}); nodeID != expected {
+			t.Errorf("priority %q got %q, expected %q", priority, nodeID, expected)
+		}
+	}
+}
+
+func TestScaled(t *testing.T) {
+	q := Quota{
+		Windows: []WindowUsage{
+			{Limit: 10, Unit: "req", Used: 5, Remaining: 5},
+			{Limit: 100, Unit: "bytes", Used: 10, Remaining: 90},
+		},
+		RemainingRequests: 5,
+		RemainingBytes:    90,
+	}
+	if got := q.scaled(1); got.RemainingRequests != 5 {
+		t.Errorf("a full share changed the quota: %+v", got)
+	}
+	got := q.scaled(0.5)
+	if got.Windows[0].Limit != 5 || got.RemainingRequests != 0 || got.RemainingBytes != 40 {
+		t.Errorf("got %+v, expected the limits halved", got)
+	}
+	if q.Windows[0].Limit != 10 {
+		t.Error("scaling changed the original quota")
+	}
+}
@@ -0,0 +1,174 @@
+package balancer
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RateLimit struct represents the rate limit state reported to clients in
+// X-RateLimit-* headers: the tightest request window, and when it frees up
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// rateLimit returns the state of the request window of q with the least
+// remaining requests, and false when no request window limits the node
+func (q Quota) rateLimit(now time.Time) (RateLimit, bool) {
+	var tightest *WindowUsage
+	for i := range q.Windows {
+		window := &q.Windows[i]
+		if window.Unit != "req" {
+			continue
+		}
+		if tightest == nil || window.Remaining < tightest.Remaining {
+			tightest = window
+		}
+	}
+	if tightest == nil {
+		return RateLimit{}, false
+	}
+	return RateLimit{Limit: tightest.Limit, Remaining: tightest.Remaining, Reset: until(now, tightest.ResetAt)}, true
+}
+
+// availableIn returns how long until every exhausted window of q frees up,
+// and false if one of them never does, e.g. because its limit is zero
+func (q Quota) availableIn(now time.Time) (time.Duration, bool) {
+	var wait time.Duration
+	for _, window := range q.Windows {
+		if window.Used < window.Limit {
+			continue
+		}
+		if window.ResetAt.IsZero() {
+			return 0, false
+		}
+		wait = max(wait, until(now, window.ResetAt))
+	}
+	return wait, true
+}
+
+func until(now, t time.Time) time.Duration {
+	if t.IsZero() || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
+// NodeRateLimit returns the rate limit state of a node
+func (lb *LoadBalancer) NodeRateLimit(ctx context.Context, nodeID string) (RateLimit, bool, error) {
+	quota, ok, err := lb.Quota(ctx, nodeID)
+	if err != nil || !ok {
+		return RateLimit{}, false, err
+	}
+	limit, ok := quota.rateLimit(time.Now())
+	return limit, ok, nil
+}
+
+// PoolRateLimit returns the rate limit state of the nodes that may serve
+// req: their combined request limit, and how long until the first of them
+// is below its limits again. It is meant for requests rejected because every
+// one of them is at its limit.
+func (lb *LoadBalancer) PoolRateLimit(ctx context.Context, req Request) (RateLimit, error) {
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	now := time.Now()
+	state := RateLimit{}
+	waitKnown := false
+	share := lb.share(req)
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for nodeID, quota := range quotas {
+		if req.excluded(nodeID) || !req.allows(lb.nodes[nodeID].Group) || lb.inMirrorGroup(nodeID) || lb.down(nodeID) {
+			continue
+		}
+		quota = quota.scaled(share)
+		if limit, ok := quota.rateLimit(now); ok {
+			state.Limit += limit.Limit
+			state.Remaining += limit.Remaining
+		}
+		wait, ok := quota.availableIn(now)
+		if until, throttled := lb.Throttled(nodeID); throttled && ok {
+			// The node takes requests again once both its windows and its
+			// backpressure allow
+			wait = max(wait, until.Sub(now))
+		}
+		if ok && (!waitKnown || wait < state.Reset) {
+			state.Reset, waitKnown = wait, true
+		}
+	}
+	if !waitKnown {
+		// No node frees up on its own, e.g. every limit is zero
+		state.Reset = time.Minute
+	}
+	return state, nil
+}
+
+// PoolWindow struct represents one limit window summed across the nodes
+// that may serve a request. Reset is how long until capacity next frees up
+// in the window.
+type PoolWindow struct {
+	Unit      string
+	Period    time.Duration
+	Limit     int
+	Used      int
+	Remaining int
+	Reset     time.Duration
+}
+
+// PoolWindows returns the windows limiting the nodes that may serve req,
+// summed per unit and period and sorted by unit, then period
+func (lb *LoadBalancer) PoolWindows(ctx context.Context, req Request) ([]PoolWindow, error) {
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type windowKey struct {
+		unit   string
+		period string
+	}
+	now := time.Now()
+	byKey := map[windowKey]*PoolWindow{}
+	lb.mu.RLock()
+	for nodeID, quota := range quotas {
+		if !req.allows(lb.nodes[nodeID].Group) || lb.inMirrorGroup(nodeID) || lb.down(nodeID) {
+			continue
+		}
+		for _, usage := range quota.Windows {
+			period, _ := time.ParseDuration(usage.Period)
+			key := windowKey{usage.Unit, usage.Period}
+			window, ok := byKey[key]
+			if !ok {
+				window = &PoolWindow{Unit: usage.Unit, Period: period, Reset: -1}
+				byKey[key] = window
+			}
+			window.Limit += usage.Limit
+			window.Used += usage.Used
+			window.Remaining += usage.Remaining
+			if reset := until(now, usage.ResetAt); !usage.ResetAt.IsZero() && (window.Reset < 0 || reset < window.Reset) {
+				window.Reset = reset
+			}
+		}
+	}
+	lb.mu.RUnlock()
+
+	windows := make([]PoolWindow, 0, len(byKey))
+	for _, window := range byKey {
+		if window.Reset < 0 {
+			window.Reset = 0
+		}
+		windows = append(windows, *window)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		if windows[i].Unit != windows[j].Unit {
+			return windows[i].Unit > windows[j].Unit
+		}
+		return windows[i].Period < windows[j].Period
+	})
+	return windows, nil
+}
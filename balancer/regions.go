@@ -0,0 +1,145 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+	"github.com/jiwooo-kim/poc_loadbalancer/replication"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// regions holds the usage of the global limits replicated from other regions
+type regions struct {
+	mu     sync.Mutex
+	local  string
+	policy replication.Policy
+	// maxAge is how old a region's snapshot may get before its usage is
+	// no longer counted, e.g. once the region is cut off
+	maxAge time.Duration
+	// interval is how often the snapshots of peers are fetched, see
+	// replication.Policy.Resolve
+	interval time.Duration
+	known    map[string]replication.Snapshot
+}
+
+// SetRegion names the region of the balancer, whose global limits then also
+// count the usage replicated from other regions, see RunReplication.
+// Conflicting snapshots of a region are resolved by policy, and a region's
+// usage stops counting once its latest snapshot is older than maxAge.
+func (lb *LoadBalancer) SetRegion(name string, policy replication.Policy, maxAge time.Duration) {
+	lb.regions.mu.Lock()
+	defer lb.regions.mu.Unlock()
+	lb.regions.local, lb.regions.policy, lb.regions.maxAge = name, policy, maxAge
+}
+
+// RegionSnapshots returns the usage of the global limits in this region,
+// taken now, and the latest of every other region still counted
+func (lb *LoadBalancer) RegionSnapshots(ctx context.Context) ([]replication.Snapshot, error) {
+	lb.mu.RLock()
+	windows := lb.globalWindows
+	lb.mu.RUnlock()
+
+	now := time.Now()
+	lb.regions.mu.Lock()
+	local := replication.Snapshot{Region: lb.regions.local, At: now, Windows: []replication.Window{}}
+	snapshots := []replication.Snapshot{}
+	for _, snapshot := range lb.regions.known {
+		if lb.regions.fresh(snapshot, now) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	lb.regions.mu.Unlock()
+
+	seen := map[time.Duration]bool{}
+	for _, window := range windows {
+		if seen[window.Period] {
+			continue
+		}
+		seen[window.Period] = true
+		usage, err := lb.localGlobalUsage(ctx, now, window.Period)
+		if err != nil {
+			return nil, err
+		}
+		local.Windows = append(local.Windows, replication.Window{PeriodSeconds: int64(window.Period / time.Second), Requests: usage.Requests, Bytes: usage.BPM})
+	}
+	snapshots = append(snapshots, local)
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Region < snapshots[j].Region })
+	return snapshots, nil
+}
+
+// MergeSnapshots takes in the snapshots of other regions, resolving those of
+// regions already known by the conflict policy. Snapshots of this region are
+// ignored, as its own usage is read from the store.
+func (lb *LoadBalancer) MergeSnapshots(snapshots []replication.Snapshot) {
+	lb.regions.mu.Lock()
+	defer lb.regions.mu.Unlock()
+	for _, snapshot := range snapshots {
+		if snapshot.Region == "" || snapshot.Region == lb.regions.local {
+			continue
+		}
+		if known, ok := lb.regions.known[snapshot.Region]; ok {
+			snapshot = lb.regions.policy.Resolve(known, snapshot, lb.regions.interval)
+		}
+		lb.regions.known[snapshot.Region] = snapshot
+	}
+}
+
+// RunReplication fetches the snapshots of peers, balancers of other
+// regions, every interval. Peers pass on the snapshots they fetched
+// themselves, so regions need not all know each other.
+func (lb *LoadBalancer) RunReplication(ctx context.Context, peers []*replication.Peer, interval time.Duration) {
+	lb.regions.mu.Lock()
+	lb.regions.interval = interval
+	lb.regions.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range peers {
+			fetchCtx, cancel := context.WithTimeout(ctx, interval)
+			snapshots, err := peer.Fetch(fetchCtx)
+			cancel()
+			if err != nil {
+				// Keep counting the last known usage until it is too old
+				metrics.ReplicationFetches.WithLabelValues(peer.String(), "error").Inc()
+				log.Printf("replicating usage: %v", err)
+				continue
+			}
+			metrics.ReplicationFetches.WithLabelValues(peer.String(), "ok").Inc()
+			lb.MergeSnapshots(snapshots)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// remoteUsage sums the usage of the window of period across the other
+// regions still counted
+func (lb *LoadBalancer) remoteUsage(period time.Duration, now time.Time) store.Usage {
+	lb.regions.mu.Lock()
+	defer lb.regions.mu.Unlock()
+	var total store.Usage
+	for _, snapshot := range lb.regions.known {
+		if !lb.regions.fresh(snapshot, now) {
+			continue
+		}
+		if w, ok := snapshot.Window(period); ok {
+			total.Requests += w.Requests
+			total.BPM += w.Bytes
+		}
+	}
+	return total
+}
+
+// fresh reports whether a snapshot is recent enough to count. The caller
+// holds r.mu.
+func (r *regions) fresh(snapshot replication.Snapshot, now time.Time) bool {
+	return r.maxAge <= 0 || now.Sub(snapshot.At) <= r.maxAge
+}
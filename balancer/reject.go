@@ -0,0 +1,115 @@
+package balancer
+
+import (
+	"context"
+)
+
+// Reasons a request can be rejected for, as reported by RejectReason
+const (
+	// RejectNodeRequests means the nodes are at a request count limit
+	RejectNodeRequests = "node_requests"
+	// RejectNodeBytes means the nodes are at a BPM (bytes) limit
+	RejectNodeBytes = "node_bytes"
+	// RejectOperation means the nodes are at the limit of the request's operation
+	RejectOperation = "operation_limit"
+	// RejectConcurrency means the nodes are serving as many requests at once
+	// as they may
+	RejectConcurrency = "node_concurrency"
+	// RejectBackpressure means the nodes asked for no more requests for now,
+	// see LoadBalancer.ObserveBackpressure
+	RejectBackpressure = "node_backpressure"
+	// RejectPriority means the nodes have room left only for requests of a
+	// higher priority class, see LoadBalancer.SetPriorities
+	RejectPriority = "priority_shed"
+	// RejectGlobal means the global limits across all nodes are reached
+	RejectGlobal = "global_limit"
+	// RejectNoNodes means no node may serve the request at all, e.g. every
+	// node of its group is down
+	RejectNoNodes = "no_nodes"
+	// RejectStore means the rate limit state could not be read
+	RejectStore = "store_unavailable"
+)
+
+// RejectReason explains why SelectNode found no node for req: the limit
+// that blocks most of the nodes that could otherwise serve it
+func (lb *LoadBalancer) RejectReason(ctx context.Context, req Request) string {
+	share := lb.share(req)
+	if ok, err := lb.globalAvailable(ctx, 1); err != nil {
+		return RejectStore
+	} else if !ok {
+		return RejectGlobal
+	} else if ok, _ := lb.globalAvailable(ctx, share); !ok {
+		return RejectPriority
+	}
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return RejectStore
+	}
+
+	lb.mu.RLock()
+	eligible := []string{}
+	for nodeID := range quotas {
+		node := lb.nodes[nodeID]
+		if req.excluded(nodeID) || !req.allows(node.Group) || lb.inMirrorGroup(nodeID) || lb.down(nodeID) {
+			continue
+		}
+		if req.Group == "" && len(lb.groupWeights) > 0 && lb.groupWeights[node.Group] <= 0 {
+			continue
+		}
+		eligible = append(eligible, nodeID)
+	}
+	lb.mu.RUnlock()
+	if len(eligible) == 0 {
+		return RejectNoNodes
+	}
+
+	counts := map[string]int{}
+	withinWindows := []string{}
+	for _, nodeID := range eligible {
+		quota := quotas[nodeID]
+		if quota.available() && !quota.scaled(share).available() {
+			counts[RejectPriority]++
+			continue
+		}
+		if quota.available() {
+			lb.mu.RLock()
+			saturated := lb.saturated(nodeID, req.tokens())
+			lb.mu.RUnlock()
+			if saturated {
+				counts[RejectConcurrency]++
+			} else if lb.throttled(nodeID) {
+				counts[RejectBackpressure]++
+			} else {
+				withinWindows = append(withinWindows, nodeID)
+			}
+			continue
+		}
+		for _, window := range quota.Windows {
+			if window.Used < window.Limit {
+				continue
+			}
+			if window.Unit == "bytes" {
+				counts[RejectNodeBytes]++
+			} else {
+				counts[RejectNodeRequests]++
+			}
+			break
+		}
+	}
+	if len(withinWindows) > 0 {
+		available, err := lb.operationAvailable(ctx, req.Operation, withinWindows)
+		if err != nil {
+			return RejectStore
+		}
+		counts[RejectOperation] += len(withinWindows) - len(available)
+	}
+
+	// Ties go to the first reason in this order
+	reason := RejectNodeRequests
+	for _, r := range []string{RejectNodeRequests, RejectNodeBytes, RejectOperation, RejectConcurrency, RejectBackpressure, RejectPriority} {
+		if counts[r] > counts[reason] {
+			reason = r
+		}
+	}
+	return reason
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Failures a RetryPolicy may retry
+const (
+	// RetryConnectFailure retries requests whose node could not be reached
+	// or did not answer within its timeout
+	RetryConnectFailure = "connect-failure"
+	// RetryGatewayError retries requests answered 502, 503 or 504
+	RetryGatewayError = "gateway-error"
+	// Retry5xx retries requests answered with any 5xx status
+	Retry5xx = "5xx"
+)
+
+// RetryPolicy struct represents when and how often a failed request is
+// retried on other nodes
+type RetryPolicy struct {
+	// Attempts is how many other nodes the request is retried on
+	Attempts int
+	// On lists the failures retried, see RetryConnectFailure
+	On []string
+	// Backoff is the wait before the first retry, doubled for every next
+	// one up to MaxBackoff; zero retries at once
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryOn are the failures retried unless a policy says otherwise
+var DefaultRetryOn = []string{RetryConnectFailure, RetryGatewayError}
+
+// ValidateRetryOn checks that every failure of on is known
+func ValidateRetryOn(on []string) error {
+	for _, failure := range on {
+		if failure != RetryConnectFailure && failure != RetryGatewayError && failure != Retry5xx {
+			return fmt.Errorf("unknown retry condition %q, expected %s, %s or %s", failure, RetryConnectFailure, RetryGatewayError, Retry5xx)
+		}
+	}
+	return nil
+}
+
+// Override returns p with the fields spec sets replaced, p itself when
+// spec is nil
+func (p RetryPolicy) Override(spec *store.RetryPolicy) (RetryPolicy, error) {
+	if spec == nil {
+		return p, nil
+	}
+	q := p
+	if spec.Attempts != nil {
+		if *spec.Attempts < 0 {
+			return p, fmt.Errorf("retry attempts must not be negative")
+		}
+		q.Attempts = *spec.Attempts
+	}
+	if spec.On != nil {
+		if err := ValidateRetryOn(spec.On); err != nil {
+			return p, err
+		}
+		q.On = spec.On
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{{"backoff", spec.Backoff, &q.Backoff}, {"max_backoff", spec.MaxBackoff, &q.MaxBackoff}} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration < 0 {
+			return p, fmt.Errorf("invalid retry %s %q", d.name, d.value)
+		}
+		*d.into = duration
+	}
+	return q, nil
+}
+
+// Retries reports whether p retries an attempt answered with status, zero
+// when the node could not be reached
+func (p RetryPolicy) Retries(status int) bool {
+	switch {
+	case status == 0:
+		return slices.Contains(p.On, RetryConnectFailure)
+	case status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout:
+		return slices.Contains(p.On, RetryGatewayError) || slices.Contains(p.On, Retry5xx)
+	case status >= 500:
+		return slices.Contains(p.On, Retry5xx)
+	}
+	return false
+}
+
+// Wait returns how long to wait before the retry-th retry, counting from 1
+func (p RetryPolicy) Wait(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < retry && wait > 0; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 {
+		wait = min(wait, p.MaxBackoff)
+	}
+	return wait
+}
@@ -0,0 +1,89 @@
+package balancer
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		on       []string
+		status   int
+		expected bool
+	}{
+		{on: DefaultRetryOn, status: 0, expected: true},
+		{on: DefaultRetryOn, status: http.StatusBadGateway, expected: true},
+		{on: DefaultRetryOn, status: http.StatusGatewayTimeout, expected: true},
+		{on: DefaultRetryOn, status: http.StatusInternalServerError},
+		{on: DefaultRetryOn, status: http.StatusTooManyRequests},
+		{on: []string{Retry5xx}, status: http.StatusInternalServerError, expected: true},
+		{on: []string{Retry5xx}, status: http.StatusServiceUnavailable, expected: true},
+		{on: []string{Retry5xx}, status: 0},
+		{on: []string{RetryConnectFailure}, status: http.StatusBadGateway},
+		{on: nil, status: 0},
+	}
+	for _, tt := range tests {
+		if got := (RetryPolicy{Attempts: 1, On: tt.on}).Retries(tt.status); got != tt.expected {
+			t.Errorf("%v retries %d: got %v, expected %v", tt.on, tt.status, got, tt.expected)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		policy   RetryPolicy
+		expected []time.Duration
+	}{
+		{policy: RetryPolicy{}, expected: []time.Duration{0, 0, 0}},
+		{policy: RetryPolicy{Backoff: 10 * ms}, expected: []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms}},
+		{policy: RetryPolicy{Backoff: 10 * ms, MaxBackoff: 25 * ms}, expected: []time.Duration{10 * ms, 20 * ms, 25 * ms, 25 * ms}},
+		{policy: RetryPolicy{Backoff: 50 * ms, MaxBackoff: 25 * ms}, expected: []time.Duration{25 * ms, 25 * ms}},
+	}
+	for _, tt := range tests {
+		for i, expected := range tt.expected {
+			if got := tt.policy.Wait(i + 1); got != expected {
+				t.Errorf("%+v: retry %d waits %s, expected %s", tt.policy, i+1, got, expected)
+			}
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	base := RetryPolicy{Attempts: 2, On: DefaultRetryOn, Backoff: 10 * time.Millisecond}
+	attempts := func(n int) *int { return &n }
+	tests := []struct {
+		name     string
+		spec     *store.RetryPolicy
+		expected RetryPolicy
+		wantErr  bool
+	}{
+		{name: "nil", expected: base},
+		{name: "empty", spec: &store.RetryPolicy{}, expected: base},
+		{name: "no retries", spec: &store.RetryPolicy{Attempts: attempts(0)}, expected: RetryPolicy{On: DefaultRetryOn, Backoff: 10 * time.Millisecond}},
+		{
+			name:     "every field",
+			spec:     &store.RetryPolicy{Attempts: attempts(3), On: []string{Retry5xx}, Backoff: "1s", MaxBackoff: "5s"},
+			expected: RetryPolicy{Attempts: 3, On: []string{Retry5xx}, Backoff: time.Second, MaxBackoff: 5 * time.Second},
+		},
+		{name: "negative attempts", spec: &store.RetryPolicy{Attempts: attempts(-1)}, wantErr: true},
+		{name: "unknown failure", spec: &store.RetryPolicy{On: []string{"4xx"}}, wantErr: true},
+		{name: "invalid backoff", spec: &store.RetryPolicy{Backoff: "soon"}, wantErr: true},
+		{name: "negative max backoff", spec: &store.RetryPolicy{MaxBackoff: "-1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := base.Override(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %+v, expected %+v", got, tt.expected)
+			}
+		})
+	}
+}
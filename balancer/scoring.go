@@ -0,0 +1,157 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Strategy selects how a node is chosen among the available ones
+type Strategy int
+
+const (
+	// StrategyRandom picks uniformly at random
+	StrategyRandom Strategy = iota
+	// StrategyLatency picks at random weighted by the inverse of each node's
+	// score, the EWMA of its response times inflated by its EWMA error rate
+	StrategyLatency
+	// StrategyCost picks at random among the cheapest nodes, so cheap nodes
+	// fill up to their limits before expensive ones get a request
+	StrategyCost
+)
+
+// ParseStrategy parses random, latency or cost
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "random", "":
+		return StrategyRandom, nil
+	case "latency":
+		return StrategyLatency, nil
+	case "cost":
+		return StrategyCost, nil
+	}
+	return 0, fmt.Errorf("unknown strategy %q, expected random, latency or cost", s)
+}
+
+// ewmaAlpha is the weight of the newest observation in the moving averages
+const ewmaAlpha = 0.2
+
+// errorPenalty scales a node's score by 1 + errorPenalty*errorRate, so a node
+// failing every request scores like one ten times as slow
+const errorPenalty = 9
+
+// nodeScore struct represents the recent responsiveness of a node
+type nodeScore struct {
+	latency   float64 // seconds
+	errorRate float64
+}
+
+func (s nodeScore) value() float64 {
+	return s.latency * (1 + errorPenalty*s.errorRate)
+}
+
+// scoreboard tracks the nodeScore of every node that answered a request
+type scoreboard struct {
+	mu     sync.Mutex
+	scores map[string]nodeScore
+}
+
+// SetStrategy changes how nodes are chosen among the available ones
+func (lb *LoadBalancer) SetStrategy(strategy Strategy) {
+	lb.mu.Lock()
+	lb.strategy = strategy
+	lb.mu.Unlock()
+}
+
+// ObserveResponse feeds how long a node took to answer, and whether it
+// failed, into its score and outlier detection
+func (lb *LoadBalancer) ObserveResponse(nodeID string, latency time.Duration, failed bool) {
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+
+	lb.scores.mu.Lock()
+	score, ok := lb.scores.scores[nodeID]
+	if ok {
+		score.latency += ewmaAlpha * (latency.Seconds() - score.latency)
+		score.errorRate += ewmaAlpha * (failure - score.errorRate)
+	} else {
+		score = nodeScore{latency: latency.Seconds(), errorRate: failure}
+	}
+	lb.scores.scores[nodeID] = score
+	lb.scores.mu.Unlock()
+
+	metrics.NodeLatencyEWMA.WithLabelValues(nodeID).Set(score.latency)
+	metrics.NodeErrorRateEWMA.WithLabelValues(nodeID).Set(score.errorRate)
+	lb.observeOutlier(nodeID, latency, failed)
+}
+
+// pick chooses one of nodeIDs according to the strategy, with warming
+// nodes weighted down by how far along their warm-up is
+func (lb *LoadBalancer) pick(nodeIDs []string) string {
+	if len(nodeIDs) == 0 {
+		return ""
+	}
+	lb.mu.RLock()
+	strategy := lb.strategy
+	if strategy == StrategyCost {
+		nodeIDs = lb.cheapest(nodeIDs)
+	}
+	lb.mu.RUnlock()
+	warmth, warming := lb.warmth(nodeIDs)
+	if strategy != StrategyLatency {
+		if !warming {
+			return nodeIDs[lb.intn(len(nodeIDs))]
+		}
+		return weightedPick(nodeIDs, warmth, lb.float64())
+	}
+
+	lb.scores.mu.Lock()
+	values := make([]float64, len(nodeIDs))
+	known, sum := 0, 0.0
+	for i, nodeID := range nodeIDs {
+		if score, ok := lb.scores.scores[nodeID]; ok {
+			values[i] = score.value()
+			known++
+			sum += values[i]
+		}
+	}
+	lb.scores.mu.Unlock()
+
+	// Nodes without observations score like the average node, so new nodes get traffic
+	average := 1.0
+	if known > 0 && sum > 0 {
+		average = sum / float64(known)
+	}
+	weights := make([]float64, len(nodeIDs))
+	for i, value := range values {
+		if value <= 0 {
+			value = average
+		}
+		weights[i] = 1 / value
+		if warming {
+			weights[i] *= warmth[i]
+		}
+	}
+	return weightedPick(nodeIDs, weights, lb.float64())
+}
+
+// weightedPick chooses one of nodeIDs with a chance proportional to its
+// weight; roll must be uniform in [0, 1)
+func weightedPick(nodeIDs []string, weights []float64, roll float64) string {
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	target := roll * total
+	for i, weight := range weights {
+		target -= weight
+		if target < 0 {
+			return nodeIDs[i]
+		}
+	}
+	return nodeIDs[len(nodeIDs)-1]
+}
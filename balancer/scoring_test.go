@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for s, expected := range map[string]Strategy{"": StrategyRandom, "random": StrategyRandom, "latency": StrategyLatency, "cost": StrategyCost} {
+		if got, err := ParseStrategy(s); err != nil || got != expected {
+			t.Errorf("ParseStrategy(%q) = %v, %v, expected %v", s, got, err, expected)
+		}
+	}
+	if _, err := ParseStrategy("fastest"); err == nil {
+		t.Error("an unknown strategy was accepted")
+	}
+}
+
+func TestObserveResponse(t *testing.T) {
+	lb, _ := newTestBalancer(t, nil)
+	lb.ObserveResponse("a", time.Second, false)
+	lb.ObserveResponse("a", 2*time.Second, true)
+	score := lb.scores.scores["a"]
+	// The first answer sets the averages, later ones move them by ewmaAlpha
+	if math.Abs(score.latency-1.2) > 1e-9 || math.Abs(score.errorRate-0.2) > 1e-9 {
+		t.Errorf("got %+v, expected a latency of 1.2s and an error rate of 0.2", score)
+	}
+	if expected := 1.2 * (1 + errorPenalty*0.2); math.Abs(score.value()-expected) > 1e-9 {
+		t.Errorf("scored %g, expected %g", score.value(), expected)
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "fast", Limits: "10k req/min"},
+		{NodeID: "slow", Limits: "10k req/min"},
+		{NodeID: "failing", Limits: "10k req/min"},
+		{NodeID: "new", Limits: "10k req/min"},
+	})
+	lb.SetStrategy(StrategyLatency)
+	lb.SetSeed(1)
+	lb.ObserveResponse("fast", 10*time.Millisecond, false)
+	lb.ObserveResponse("slow", 40*time.Millisecond, false)
+	lb.ObserveResponse("failing", 10*time.Millisecond, true)
+
+	served := map[string]int{}
+	for range 2000 {
+		nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[nodeID]++
+	}
+	// Weights are 1/0.01, 1/0.04, 1/0.1 and, for the node without
+	// observations, the inverse of the average score 0.05
+	for nodeID, expected := range map[string]float64{"fast": 0.645, "slow": 0.161, "failing": 0.065, "new": 0.129} {
+		if share := float64(served[nodeID]) / 2000; math.Abs(share-expected) > 0.04 {
+			t.Errorf("%s served %.3f of the requests, expected about %.3f", nodeID, share, expected)
+		}
+	}
+}
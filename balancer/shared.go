@@ -0,0 +1,75 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// ErrOverLimit is returned by Attempts.Start when the store refused the
+// request because another replica took the node's remaining quota first
+var ErrOverLimit = errors.New("node is at its limits")
+
+// SetSharedLimits makes the balancer admit every request atomically in the
+// store, for replicas that share one store. It fails when the store cannot
+// reserve requests, see store.Reserver.
+func (lb *LoadBalancer) SetSharedLimits(shared bool) error {
+	if _, ok := lb.store.(store.Reserver); shared && !ok {
+		return fmt.Errorf("store %T cannot share limits between replicas", lb.store)
+	}
+	lb.mu.Lock()
+	lb.sharedLimits = shared
+	lb.mu.Unlock()
+	return nil
+}
+
+// ReserveRequest accounts a request about to be forwarded to a node like
+// RecordRequest. With shared limits the store only accounts it while the node
+// stays within its limits and ErrOverLimit is returned otherwise.
+func (lb *LoadBalancer) ReserveRequest(ctx context.Context, nodeID, operation string, bpm int) error {
+	lb.mu.RLock()
+	shared := lb.sharedLimits
+	limits := lb.reserveLimits(nodeID, operation)
+	lb.mu.RUnlock()
+	if !shared {
+		return lb.RecordRequest(ctx, nodeID, operation, bpm)
+	}
+
+	record := store.Record{NodeID: nodeID, Operation: operation, Timestamp: time.Now(), BPM: bpm}
+	ok, err := lb.store.(store.Reserver).Reserve(ctx, record, limits)
+	lb.storeTimes.observe("reserve", record.Timestamp, err)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrOverLimit
+	}
+	return nil
+}
+
+// reserveLimits returns the limits a request of operation is admitted
+// against on a node. Nodes that may borrow from their pool are held to their
+// limits plus their BorrowPercent, since what the peers leave unused is only
+// known to the selecting replica, and nodes with burst credit to their
+// limits plus the most credit they may have. lb.mu must be held.
+func (lb *LoadBalancer) reserveLimits(nodeID, operation string) []store.Limit {
+	node := lb.nodes[nodeID]
+	var limits []store.Limit
+	for _, window := range lb.windows[nodeID] {
+		limit := window.Limit
+		if node.Pool != "" && node.BorrowPercent > 0 {
+			limit += window.Limit * node.BorrowPercent / 100
+		}
+		limit += window.maxCredit()
+		limits = append(limits, store.Limit{Period: window.Period, Limit: limit, Bytes: window.Bytes})
+	}
+	if operation != "" {
+		for _, window := range lb.operationWindows[nodeID][operation] {
+			limits = append(limits, store.Limit{Operation: operation, Period: window.Period, Limit: window.Limit, Bytes: window.Bytes})
+		}
+	}
+	return limits
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// slowStartMinShare is the share of its full weight a node gets at the
+// start of its warm-up, so it still sees some traffic to warm up with
+const slowStartMinShare = 0.1
+
+// slowStart holds when each warming node started its warm-up, see SetSlowStart
+type slowStart struct {
+	mu     sync.Mutex
+	window time.Duration
+	since  map[string]time.Time
+}
+
+// SetSlowStart ramps the traffic share of nodes added to the pool or turned
+// healthy again from a tenth of their weight up to all of it over window;
+// zero gives them their full weight right away
+func (lb *LoadBalancer) SetSlowStart(window time.Duration) {
+	lb.slowStart.mu.Lock()
+	defer lb.slowStart.mu.Unlock()
+	lb.slowStart.window = window
+	if window <= 0 {
+		clear(lb.slowStart.since)
+	}
+}
+
+// warmUp starts the warm-up of a node at start
+func (lb *LoadBalancer) warmUp(nodeID string, start time.Time) {
+	ss := &lb.slowStart
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.window > 0 {
+		ss.since[nodeID] = start
+	}
+}
+
+// WarmingUntil returns when a warming node gets its full weight
+func (lb *LoadBalancer) WarmingUntil(nodeID string) (time.Time, bool) {
+	ss := &lb.slowStart
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	since, ok := ss.since[nodeID]
+	if !ok {
+		return time.Time{}, false
+	}
+	until := since.Add(ss.window)
+	if !time.Now().Before(until) {
+		delete(ss.since, nodeID)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// warmth returns the share of their full weight each node gets, and false
+// when none is warming up
+func (lb *LoadBalancer) warmth(nodeIDs []string) ([]float64, bool) {
+	ss := &lb.slowStart
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.since) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	shares := make([]float64, len(nodeIDs))
+	warming := false
+	for i, nodeID := range nodeIDs {
+		shares[i] = 1
+		since, ok := ss.since[nodeID]
+		if !ok {
+			continue
+		}
+		elapsed := now.Sub(since)
+		if elapsed >= ss.window {
+			delete(ss.since, nodeID)
+			continue
+		}
+		shares[i], warming = max(float64(elapsed)/float64(ss.window), slowStartMinShare), true
+	}
+	return shares, warming
+}
@@ -0,0 +1,73 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestWarmth(t *testing.T) {
+	lb, _ := newTestBalancer(t, nil)
+	lb.SetSlowStart(10 * time.Minute)
+	now := time.Now()
+	lb.warmUp("half", now.Add(-5*time.Minute))
+	lb.warmUp("new", now)
+	lb.warmUp("done", now.Add(-10*time.Minute))
+
+	shares, warming := lb.warmth([]string{"half", "new", "done", "other"})
+	if !warming {
+		t.Fatal("no node is warming up")
+	}
+	for i, expected := range []float64{0.5, slowStartMinShare, 1, 1} {
+		if math.Abs(shares[i]-expected) > 0.01 {
+			t.Errorf("share %d is %g, expected %g", i, shares[i], expected)
+		}
+	}
+	if _, ok := lb.WarmingUntil("done"); ok {
+		t.Error("a node past its window is still warming up")
+	}
+	if until, ok := lb.WarmingUntil("half"); !ok || until.Sub(now) > 5*time.Minute {
+		t.Errorf("got %s, %v, expected half warm in 5 minutes", until, ok)
+	}
+
+	lb.SetSlowStart(0)
+	if _, warming := lb.warmth([]string{"half"}); warming {
+		t.Error("turning slow start off did not end the warm-ups")
+	}
+	lb.warmUp("half", now)
+	if _, ok := lb.WarmingUntil("half"); ok {
+		t.Error("a node warms up with slow start off")
+	}
+}
+
+func TestSlowStartJoiningNodes(t *testing.T) {
+	first := map[string]store.NodeLimits{"node-1": {NodeID: "node-1", Limits: "10k req/min"}}
+	lb, _ := newTestBalancer(t, nil)
+	lb.SetSlowStart(time.Hour)
+	lb.SetNodes(first)
+	if _, ok := lb.WarmingUntil("node-1"); ok {
+		t.Fatal("the first pool warms up")
+	}
+
+	joined := map[string]store.NodeLimits{"node-1": first["node-1"], "node-2": {NodeID: "node-2", Limits: "10k req/min"}}
+	lb.SetNodes(joined)
+	if _, ok := lb.WarmingUntil("node-2"); !ok {
+		t.Fatal("a joining node does not warm up")
+	}
+	lb.SetSeed(1)
+	served := map[string]int{}
+	for range 1000 {
+		nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[nodeID]++
+	}
+	// node-2 has a tenth of the weight of node-1
+	if served["node-2"] < 50 || served["node-2"] > 130 {
+		t.Errorf("node-2 served %d of 1000 requests, expected about 90", served["node-2"])
+	}
+}
@@ -0,0 +1,104 @@
+package balancer
+
+import (
+	"context"
+	"sort"
+)
+
+// States of a node in its status
+const (
+	StateUp          = "up"
+	StateFailed      = "failed"
+	StateUnhealthy   = "unhealthy"
+	StateEjected     = "ejected"
+	StateDraining    = "draining"
+	StateMaintenance = "maintenance"
+	StateStandby     = "standby"
+	StateMirror      = "mirror"
+)
+
+// NodeStatus struct represents how a node is doing right now, for the
+// status page
+type NodeStatus struct {
+	NodeID  string `json:"node_id"`
+	Group   string `json:"group,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Cost is the node's price tier, see StrategyCost
+	Cost float64 `json:"cost,omitempty"`
+	// State is StateUp, or the first reason the node is out of selection
+	State   string        `json:"state"`
+	Windows []WindowUsage `json:"windows"`
+	// Utilization is the highest share of a window's limit used, 1 when the
+	// node is at a limit
+	Utilization float64 `json:"utilization"`
+	InFlight    int     `json:"in_flight"`
+	// Tokens is how many capacity tokens the requests in flight hold, see
+	// LoadBalancer.AcquireTokens
+	Tokens int `json:"tokens,omitempty"`
+	// MaxConcurrent is zero for nodes without a concurrency limit
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// LimitFactor is the share of its configured limits the node gets while
+	// adaptive limits cut them, zero when they do not; Windows are cut alike
+	LimitFactor float64 `json:"limit_factor,omitempty"`
+	// LatencySeconds and ErrorRate are the moving averages of the node's
+	// answers, zero before it answered a request
+	LatencySeconds float64 `json:"latency_seconds"`
+	ErrorRate      float64 `json:"error_rate"`
+}
+
+// Status returns the status of every node, ordered by node ID
+func (lb *LoadBalancer) Status(ctx context.Context) ([]NodeStatus, error) {
+	quotas, err := lb.quotas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]NodeStatus, 0, len(quotas))
+	lb.mu.RLock()
+	for nodeID, quota := range quotas {
+		node := lb.nodes[nodeID]
+		status := NodeStatus{NodeID: nodeID, Group: node.Group, Zone: node.Zone, Region: node.Region, Address: node.Address, Cost: node.Cost, State: StateUp, Windows: quota.Windows, MaxConcurrent: node.MaxConcurrent}
+		for _, check := range []struct {
+			state string
+			out   bool
+		}{
+			{StateMirror, lb.inMirrorGroup(nodeID)},
+			{StateFailed, lb.failed(nodeID)},
+			{StateUnhealthy, lb.unhealthy(nodeID)},
+			{StateEjected, lb.ejected(nodeID)},
+			{StateDraining, lb.draining(nodeID, false)},
+			{StateMaintenance, lb.inMaintenance(nodeID)},
+			{StateStandby, lb.onStandby(nodeID)},
+		} {
+			if check.out {
+				status.State = check.state
+				break
+			}
+		}
+		for _, window := range quota.Windows {
+			if window.Limit > 0 {
+				status.Utilization = max(status.Utilization, min(float64(window.Used)/float64(window.Limit), 1))
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	lb.mu.RUnlock()
+
+	lb.scores.mu.Lock()
+	for i, status := range statuses {
+		if score, ok := lb.scores.scores[status.NodeID]; ok {
+			statuses[i].LatencySeconds, statuses[i].ErrorRate = score.latency, score.errorRate
+		}
+	}
+	lb.scores.mu.Unlock()
+	for i, status := range statuses {
+		statuses[i].InFlight, statuses[i].Tokens = lb.InFlight(status.NodeID), lb.HeldTokens(status.NodeID)
+		if factor := lb.LimitFactor(status.NodeID); factor < 1 {
+			statuses[i].LimitFactor = factor
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].NodeID < statuses[j].NodeID })
+	return statuses, nil
+}
@@ -0,0 +1,55 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// StoreLatency struct represents how the calls the balancer made to the
+// store on the request path went since it started
+type StoreLatency struct {
+	Calls        int64   `json:"calls"`
+	Errors       int64   `json:"errors"`
+	TotalSeconds float64 `json:"total_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"`
+}
+
+// storeTimes times the store calls of the request path by call: usage,
+// operation_usage, record and reserve
+type storeTimes struct {
+	mu    sync.Mutex
+	calls map[string]StoreLatency
+}
+
+// observe times a store call started at started, which returned err
+func (t *storeTimes) observe(call string, started time.Time, err error) {
+	seconds := time.Since(started).Seconds()
+	metrics.StoreDuration.WithLabelValues(call).Observe(seconds)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.calls == nil {
+		t.calls = map[string]StoreLatency{}
+	}
+	l := t.calls[call]
+	l.Calls++
+	if err != nil {
+		l.Errors++
+	}
+	l.TotalSeconds += seconds
+	l.MaxSeconds = max(l.MaxSeconds, seconds)
+	t.calls[call] = l
+}
+
+// StoreLatencies returns how the store calls of the request path went, by
+// call: usage, operation_usage, record and reserve
+func (lb *LoadBalancer) StoreLatencies() map[string]StoreLatency {
+	lb.storeTimes.mu.Lock()
+	defer lb.storeTimes.mu.Unlock()
+	latencies := make(map[string]StoreLatency, len(lb.storeTimes.calls))
+	for call, l := range lb.storeTimes.calls {
+		latencies[call] = l
+	}
+	return latencies
+}
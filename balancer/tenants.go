@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// tenantPool struct represents the nodes a tenant's requests may go to
+type tenantPool struct {
+	nodes  map[string]bool
+	groups map[string]bool
+}
+
+// ValidateTenant checks a tenant's ID and quota, which may only limit
+// requests since the tenant is known before the request body is read
+func ValidateTenant(tenant store.Tenant) error {
+	if tenant.ID == "" {
+		return errors.New("missing tenant id")
+	}
+	if tenant.Quota == "" {
+		return nil
+	}
+	windows, err := ParseLimits(tenant.Quota)
+	if err != nil {
+		return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+	}
+	for _, window := range windows {
+		if window.Bytes {
+			return fmt.Errorf("tenant %s: quota must limit requests, not bytes", tenant.ID)
+		}
+	}
+	return nil
+}
+
+// SetTenants replaces the tenants, restricting the requests of each one
+// whose node pool is set to the nodes in it. Requests without a tenant,
+// and of tenants without a node pool, may go to any node.
+func (lb *LoadBalancer) SetTenants(tenants []store.Tenant) {
+	pools := make(map[string]tenantPool, len(tenants))
+	for _, tenant := range tenants {
+		if len(tenant.Nodes) == 0 && len(tenant.Groups) == 0 {
+			continue
+		}
+		pool := tenantPool{nodes: map[string]bool{}, groups: map[string]bool{}}
+		for _, nodeID := range tenant.Nodes {
+			pool.nodes[nodeID] = true
+		}
+		for _, group := range tenant.Groups {
+			pool.groups[group] = true
+		}
+		pools[tenant.ID] = pool
+	}
+
+	lb.mu.Lock()
+	lb.tenants = pools
+	lb.mu.Unlock()
+}
+
+// tenantAllows reports whether a node is in the pool of the request's
+// tenant. The caller holds lb.mu.
+func (lb *LoadBalancer) tenantAllows(req Request, nodeID string) bool {
+	if req.Tenant == "" {
+		return true
+	}
+	pool, ok := lb.tenants[req.Tenant]
+	return !ok || pool.nodes[nodeID] || pool.groups[lb.nodes[nodeID].Group]
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestTenantPools(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "1000 req/min", Group: "shared"},
+		{NodeID: "node-2", Limits: "1000 req/min", Group: "acme"},
+		{NodeID: "node-3", Limits: "1000 req/min"},
+	})
+	lb.SetTenants([]store.Tenant{
+		{ID: "acme", Groups: []string{"acme"}},
+		{ID: "globex", Nodes: []string{"node-3"}, Groups: []string{"acme"}},
+		{ID: "initech", Quota: "10 req/min"},
+	})
+	tests := []struct {
+		tenant   string
+		expected []string
+	}{
+		{tenant: "", expected: []string{"node-1", "node-2", "node-3"}},
+		{tenant: "acme", expected: []string{"node-2"}},
+		{tenant: "globex", expected: []string{"node-2", "node-3"}},
+		{tenant: "initech", expected: []string{"node-1", "node-2", "node-3"}},
+		{tenant: "unknown", expected: []string{"node-1", "node-2", "node-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			selected := map[string]bool{}
+			for range 200 {
+				nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request", Tenant: tt.tenant})
+				if err != nil {
+					t.Fatal(err)
+				}
+				selected[nodeID] = true
+			}
+			if got := slices.Sorted(maps.Keys(selected)); !slices.Equal(got, tt.expected) {
+				t.Errorf("selected %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTenantPoolExhausted(t *testing.T) {
+	lb, _ := newTestBalancer(t, []store.NodeLimits{
+		{NodeID: "node-1", Limits: "1000 req/min"},
+		{NodeID: "node-2", Limits: "3 req/min"},
+	}, recent("node-2", 3, 1)...)
+	lb.SetTenants([]store.Tenant{{ID: "acme", Nodes: []string{"node-2"}}})
+	nodeID, err := lb.SelectNode(context.Background(), Request{Operation: "POST /request", Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeID != "" {
+		t.Errorf("selected %s outside the tenant's pool", nodeID)
+	}
+}
+
+func TestValidateTenant(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenant  store.Tenant
+		wantErr bool
+	}{
+		{name: "valid", tenant: store.Tenant{ID: "acme", Quota: "50 req/s AND 2000 req/min"}},
+		{name: "no quota", tenant: store.Tenant{ID: "acme"}},
+		{name: "no id", tenant: store.Tenant{Quota: "50 req/s"}, wantErr: true},
+		{name: "invalid quota", tenant: store.Tenant{ID: "acme", Quota: "50 req"}, wantErr: true},
+		{name: "byte quota", tenant: store.Tenant{ID: "acme", Quota: "50 req/s AND 1m bytes/min"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTenant(tt.tenant); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Package cache keeps responses of idempotent routes in memory.
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry struct represents a cached response
+type Entry struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Expires time.Time
+}
+
+func (e *Entry) size(key string) int {
+	size := len(key) + len(e.Body)
+	for name, values := range e.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+type item struct {
+	key   string
+	entry *Entry
+	size  int
+}
+
+// Cache is an LRU response cache bounded by the total size of its entries
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+// New returns a cache holding at most maxBytes of responses
+func New(maxBytes int) *Cache {
+	return &Cache{maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the unexpired entry stored under key
+func (c *Cache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	it := element.Value.(*item)
+	if time.Now().After(it.entry.Expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return it.entry, true
+}
+
+// Set stores entry under key, evicting the least recently used entries to stay
+// within the size bound. Entries larger than the whole cache are not stored.
+func (c *Cache) Set(key string, entry *Entry) {
+	size := entry.size(key)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	c.items[key] = c.order.PushFront(&item{key: key, entry: entry, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate drops every entry whose key starts with prefix and returns how
+// many were dropped. An empty prefix clears the cache.
+func (c *Cache) Invalidate(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := 0
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (c *Cache) remove(element *list.Element) {
+	it := c.order.Remove(element).(*item)
+	delete(c.items, it.key)
+	c.bytes -= it.size
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// entry returns an unexpired entry whose size under a one byte key is size
+func entry(size int) *Entry {
+	return &Entry{Status: http.StatusOK, Body: make([]byte, size-1), Expires: time.Now().Add(time.Minute)}
+}
+
+func TestLRU(t *testing.T) {
+	c := New(30)
+	c.Set("a", entry(10))
+	c.Set("b", entry(10))
+	c.Set("c", entry(10))
+	// a was used last, so b goes first
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a was evicted within the bound")
+	}
+	c.Set("d", entry(10))
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.Get(key); ok != expected {
+			t.Errorf("%s cached: %v, expected %v", key, ok, expected)
+		}
+	}
+
+	// A large entry evicts as many as it needs
+	c.Set("e", entry(25))
+	for key, expected := range map[string]bool{"a": false, "c": false, "d": false, "e": true} {
+		if _, ok := c.Get(key); ok != expected {
+			t.Errorf("%s cached: %v, expected %v", key, ok, expected)
+		}
+	}
+	if c.bytes != 25 {
+		t.Errorf("cache counts %d bytes, expected 25", c.bytes)
+	}
+}
+
+func TestSetReplaces(t *testing.T) {
+	c := New(30)
+	c.Set("a", entry(10))
+	c.Set("a", &Entry{Status: http.StatusNotFound, Body: make([]byte, 19), Expires: time.Now().Add(time.Minute)})
+	got, ok := c.Get("a")
+	if !ok || got.Status != http.StatusNotFound {
+		t.Fatalf("got %+v, %v", got, ok)
+	}
+	if c.bytes != 20 {
+		t.Errorf("cache counts %d bytes, expected 20", c.bytes)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	c := New(30)
+	c.Set("a", entry(10))
+	c.Set("b", entry(31))
+	if _, ok := c.Get("b"); ok {
+		t.Error("an entry larger than the cache was stored")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("an entry larger than the cache evicted others")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := New(30)
+	expired := entry(10)
+	expired.Expires = time.Now().Add(-time.Second)
+	c.Set("a", expired)
+	if _, ok := c.Get("a"); ok {
+		t.Error("got an expired entry")
+	}
+	if c.bytes != 0 || c.order.Len() != 0 {
+		t.Errorf("expired entry still counts %d bytes", c.bytes)
+	}
+}
+
+func TestSize(t *testing.T) {
+	e := &Entry{Header: http.Header{"Etag": {"abc"}, "Vary": {"a", "bc"}}, Body: []byte("body")}
+	// key, body, then the header names and values
+	if got, expected := e.size("key"), 3+4+4+3+4+1+2; got != expected {
+		t.Errorf("got %d, expected %d", got, expected)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c := New(100)
+	for _, key := range []string{"GET /api/a", "GET /api/b", "GET /other"} {
+		c.Set(key, entry(10))
+	}
+	if dropped := c.Invalidate("GET /api/"); dropped != 2 {
+		t.Errorf("dropped %d entries, expected 2", dropped)
+	}
+	if _, ok := c.Get("GET /other"); !ok {
+		t.Error("an entry outside the prefix was dropped")
+	}
+	if dropped := c.Invalidate(""); dropped != 1 || c.bytes != 0 {
+		t.Errorf("dropped %d entries leaving %d bytes, expected the cache cleared", dropped, c.bytes)
+	}
+}
@@ -0,0 +1,192 @@
+// Package calendar applies the traffic plans of scheduled events, such as
+// sales and launches, while they run and reverts them once they are over.
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Event struct represents a scheduled event and the traffic plan applied
+// from PreApply before Start until End
+type Event struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// PreApply is a Go duration the plan is applied ahead of Start, so
+	// standby nodes are warm when the traffic arrives
+	PreApply string `json:"pre_apply,omitempty"`
+	// LimitFactors multiply the limits of nodes by node ID, "*" standing
+	// for every node, e.g. {"*": 1.5}
+	LimitFactors map[string]float64 `json:"limit_factors,omitempty"`
+	// ActivateNodes lists the standby nodes taking traffic during the event
+	ActivateNodes []string `json:"activate_nodes,omitempty"`
+	// ClientRate and ClientBurst replace the token bucket of client limits
+	// during the event, usually to tighten it
+	ClientRate  float64 `json:"client_rate,omitempty"`
+	ClientBurst int     `json:"client_burst,omitempty"`
+
+	preApply time.Duration
+}
+
+// applies reports whether the event's plan applies at t
+func (e Event) applies(t time.Time) bool {
+	return !t.Before(e.Start.Add(-e.preApply)) && t.Before(e.End)
+}
+
+// Plan struct represents the traffic plan of the events running at a time,
+// the zero Plan being the configured traffic settings
+type Plan struct {
+	// Events names the events whose plans are merged in
+	Events        []string           `json:"events"`
+	LimitFactors  map[string]float64 `json:"limit_factors,omitempty"`
+	ActivateNodes []string           `json:"activate_nodes,omitempty"`
+	// ClientRate and ClientBurst are zero when client limits are unchanged
+	ClientRate  float64 `json:"client_rate,omitempty"`
+	ClientBurst int     `json:"client_burst,omitempty"`
+}
+
+// Calendar holds the events
+type Calendar struct {
+	events []Event
+}
+
+// Load reads a JSON array of events, e.g.
+//
+//	[{"name": "black-friday", "start": "2026-11-27T00:00:00Z", "end": "2026-11-30T00:00:00Z",
+//	  "pre_apply": "30m", "limit_factors": {"*": 2}, "activate_nodes": ["node-9"],
+//	  "client_rate": 2, "client_burst": 5}]
+func Load(path string) (*Calendar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return New(events)
+}
+
+// New checks events and returns a calendar of them
+func New(events []Event) (*Calendar, error) {
+	names := map[string]bool{}
+	for i := range events {
+		e := &events[i]
+		if e.Name == "" || names[e.Name] {
+			return nil, fmt.Errorf("event %d: names must be set and unique, got %q", i, e.Name)
+		}
+		names[e.Name] = true
+		if !e.Start.Before(e.End) {
+			return nil, fmt.Errorf("event %s: start must be before end", e.Name)
+		}
+		if e.PreApply != "" {
+			d, err := time.ParseDuration(e.PreApply)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("event %s: pre_apply must be a Go duration that is not negative, got %q", e.Name, e.PreApply)
+			}
+			e.preApply = d
+		}
+		for node, factor := range e.LimitFactors {
+			if factor <= 0 {
+				return nil, fmt.Errorf("event %s: limit factor of %s must be positive", e.Name, node)
+			}
+		}
+		if e.ClientRate < 0 || e.ClientBurst < 0 || (e.ClientRate == 0) != (e.ClientBurst == 0) {
+			return nil, fmt.Errorf("event %s: client_rate and client_burst must be positive and set together", e.Name)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return &Calendar{events: events}, nil
+}
+
+// Events returns the events ordered by start
+func (c *Calendar) Events() []Event {
+	return append([]Event(nil), c.events...)
+}
+
+// ClientLimits reports whether an event changes client limits
+func (c *Calendar) ClientLimits() bool {
+	for _, e := range c.events {
+		if e.ClientRate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan merges the plans of the events applying at t: the highest limit
+// factor of each node, every activated node and the tightest client bucket
+func (c *Calendar) Plan(t time.Time) Plan {
+	plan := Plan{Events: []string{}}
+	activated := map[string]bool{}
+	for _, e := range c.events {
+		if !e.applies(t) {
+			continue
+		}
+		plan.Events = append(plan.Events, e.Name)
+		for node, factor := range e.LimitFactors {
+			if plan.LimitFactors == nil {
+				plan.LimitFactors = map[string]float64{}
+			}
+			plan.LimitFactors[node] = max(plan.LimitFactors[node], factor)
+		}
+		for _, node := range e.ActivateNodes {
+			if !activated[node] {
+				activated[node] = true
+				plan.ActivateNodes = append(plan.ActivateNodes, node)
+			}
+		}
+		if e.ClientRate > 0 {
+			if plan.ClientRate == 0 || e.ClientRate < plan.ClientRate {
+				plan.ClientRate = e.ClientRate
+			}
+			if plan.ClientBurst == 0 || e.ClientBurst < plan.ClientBurst {
+				plan.ClientBurst = e.ClientBurst
+			}
+		}
+	}
+	sort.Strings(plan.ActivateNodes)
+	return plan
+}
+
+// next returns the first time after t an event's plan starts or stops
+// applying, or the zero time when none does anymore
+func (c *Calendar) next(t time.Time) time.Time {
+	var next time.Time
+	for _, e := range c.events {
+		for _, boundary := range []time.Time{e.Start.Add(-e.preApply), e.End} {
+			if boundary.After(t) && (next.IsZero() || boundary.Before(next)) {
+				next = boundary
+			}
+		}
+	}
+	return next
+}
+
+// Run calls apply with the plan applying now, and again whenever an event
+// starts or stops applying, until ctx is done or no event is left to start
+// or stop
+func (c *Calendar) Run(ctx context.Context, apply func(Plan)) {
+	now := time.Now()
+	apply(c.Plan(now))
+	for {
+		next := c.next(now)
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now = next
+		apply(c.Plan(now))
+	}
+}
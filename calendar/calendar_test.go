@@ -0,0 +1,122 @@
+package calendar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	start := time.Date(2026, 11, 27, 0, 0, 0, 0, time.UTC)
+	c, err := New([]Event{
+		{Name: "launch", Start: start.Add(12 * time.Hour), End: start.Add(14 * time.Hour), LimitFactors: map[string]float64{"*": 3, "node-2": 1.2}, ActivateNodes: []string{"node-9", "node-8"}, ClientRate: 5, ClientBurst: 2},
+		{Name: "black-friday", Start: start, End: start.Add(72 * time.Hour), PreApply: "30m", LimitFactors: map[string]float64{"*": 2, "node-1": 1.5}, ActivateNodes: []string{"node-9"}, ClientRate: 2, ClientBurst: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected Plan
+	}{
+		{name: "before", at: start.Add(-31 * time.Minute), expected: Plan{Events: []string{}}},
+		{
+			name:     "pre-applied",
+			at:       start.Add(-30 * time.Minute),
+			expected: Plan{Events: []string{"black-friday"}, LimitFactors: map[string]float64{"*": 2, "node-1": 1.5}, ActivateNodes: []string{"node-9"}, ClientRate: 2, ClientBurst: 5},
+		},
+		{
+			name:     "overlapping",
+			at:       start.Add(13 * time.Hour),
+			expected: Plan{Events: []string{"black-friday", "launch"}, LimitFactors: map[string]float64{"*": 3, "node-1": 1.5, "node-2": 1.2}, ActivateNodes: []string{"node-8", "node-9"}, ClientRate: 2, ClientBurst: 2},
+		},
+		{name: "after", at: start.Add(72 * time.Hour), expected: Plan{Events: []string{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Plan(tt.at); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %+v, expected %+v", got, tt.expected)
+			}
+		})
+	}
+	if !c.ClientLimits() {
+		t.Error("the events change client limits")
+	}
+	if events := c.Events(); events[0].Name != "black-friday" {
+		t.Errorf("events are not ordered by start: %s first", events[0].Name)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	start := time.Now()
+	valid := Event{Name: "sale", Start: start, End: start.Add(time.Hour)}
+	with := func(change func(e *Event)) []Event {
+		e := valid
+		change(&e)
+		return []Event{e}
+	}
+	tests := []struct {
+		name   string
+		events []Event
+	}{
+		{name: "no name", events: with(func(e *Event) { e.Name = "" })},
+		{name: "duplicate name", events: []Event{valid, valid}},
+		{name: "end before start", events: with(func(e *Event) { e.End = e.Start })},
+		{name: "invalid pre-apply", events: with(func(e *Event) { e.PreApply = "soon" })},
+		{name: "negative pre-apply", events: with(func(e *Event) { e.PreApply = "-1h" })},
+		{name: "zero limit factor", events: with(func(e *Event) { e.LimitFactors = map[string]float64{"*": 0} })},
+		{name: "client rate without burst", events: with(func(e *Event) { e.ClientRate = 1 })},
+		{name: "negative client burst", events: with(func(e *Event) { e.ClientRate, e.ClientBurst = 1, -1 })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.events); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	data := `[{"name": "black-friday", "start": "2026-11-27T00:00:00Z", "end": "2026-11-30T00:00:00Z", "pre_apply": "30m", "limit_factors": {"*": 2}}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := c.Plan(time.Date(2026, 11, 26, 23, 45, 0, 0, time.UTC)); plan.LimitFactors["*"] != 2 {
+		t.Errorf("got %+v, expected the pre-applied plan", plan)
+	}
+	if c.ClientLimits() {
+		t.Error("the event does not change client limits")
+	}
+}
+
+func TestRun(t *testing.T) {
+	start := time.Now().Add(50 * time.Millisecond)
+	c, err := New([]Event{{Name: "flash-sale", Start: start, End: start.Add(50 * time.Millisecond), ActivateNodes: []string{"node-9"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied [][]string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(context.Background(), func(plan Plan) { applied = append(applied, plan.Events) })
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once no event was left")
+	}
+	if expected := [][]string{{}, {"flash-sale"}, {}}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("applied %v, expected %v", applied, expected)
+	}
+}
@@ -0,0 +1,121 @@
+// Package certs obtains and renews the TLS certificates of the balancer's
+// HTTPS listener from an ACME certificate authority such as Let's Encrypt,
+// keeping them in a directory or in the store shared by every replica.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenges proving control of the domains
+const (
+	// ChallengeHTTP answers the CA on port 80, see Manager.HTTPHandler
+	ChallengeHTTP = "http-01"
+	// ChallengeTLSALPN answers the CA on the HTTPS listener itself
+	ChallengeTLSALPN = "tls-alpn-01"
+)
+
+// Config struct represents how certificates are obtained
+type Config struct {
+	// Domains are the host names certificates are obtained for; requests
+	// for other names fail the TLS handshake
+	Domains []string
+	// Email is the contact of the ACME account, for expiry notices
+	Email string
+	// Directory is the URL of the CA's ACME directory, Let's Encrypt's
+	// production one when empty
+	Directory string
+	// Challenge is ChallengeHTTP or ChallengeTLSALPN
+	Challenge string
+	// CacheDir is the directory certificates and the account key are kept
+	// in, unless Store is set
+	CacheDir string
+	// Store keeps the certificates and the account key instead, so every
+	// replica uses the same ones
+	Store store.Certificates
+}
+
+// Manager struct represents the certificates of the HTTPS listener,
+// obtained on the first handshake for a domain and renewed before they
+// expire
+type Manager struct {
+	challenge string
+	autocert  *autocert.Manager
+}
+
+// NewManager returns a manager obtaining certificates as config says
+func NewManager(config Config) (*Manager, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("no domain to obtain certificates for")
+	}
+	if config.Challenge != ChallengeHTTP && config.Challenge != ChallengeTLSALPN {
+		return nil, fmt.Errorf("unknown ACME challenge %q, expected %s or %s", config.Challenge, ChallengeHTTP, ChallengeTLSALPN)
+	}
+	var cache autocert.Cache
+	switch {
+	case config.Store != nil:
+		cache = storeCache{config.Store}
+	case config.CacheDir != "":
+		cache = autocert.DirCache(config.CacheDir)
+	default:
+		return nil, errors.New("certificates need a cache directory or a store")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Cache:      cache,
+		Email:      config.Email,
+	}
+	if config.Directory != "" {
+		m.Client = &acme.Client{DirectoryURL: config.Directory}
+	}
+	return &Manager{challenge: config.Challenge, autocert: m}, nil
+}
+
+// TLSConfig returns the configuration of the HTTPS listener, which answers
+// tls-alpn-01 challenges as well
+func (m *Manager) TLSConfig() *tls.Config {
+	return m.autocert.TLSConfig()
+}
+
+// HTTPHandler returns the handler answering http-01 challenges on port 80
+// and redirecting every other request to HTTPS, and false when the
+// challenge is tls-alpn-01 and nothing needs to listen on port 80
+func (m *Manager) HTTPHandler() (http.Handler, bool) {
+	if m.challenge != ChallengeHTTP {
+		return nil, false
+	}
+	return m.autocert.HTTPHandler(nil), true
+}
+
+// storeCache keeps the certificates in a store
+type storeCache struct {
+	certs store.Certificates
+}
+
+func (c storeCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, ok, err := c.certs.Certificate(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (c storeCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.certs.SaveCertificate(ctx, key, data)
+}
+
+func (c storeCache) Delete(ctx context.Context, key string) error {
+	return c.certs.DeleteCertificate(ctx, key)
+}
@@ -0,0 +1,101 @@
+package certs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// memoryCertificates keeps certificates in a map, like a shared store would
+type memoryCertificates map[string][]byte
+
+func (m memoryCertificates) Certificate(ctx context.Context, key string) ([]byte, bool, error) {
+	data, ok := m[key]
+	return data, ok, nil
+}
+
+func (m memoryCertificates) SaveCertificate(ctx context.Context, key string, data []byte) error {
+	m[key] = data
+	return nil
+}
+
+func (m memoryCertificates) DeleteCertificate(ctx context.Context, key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestNewManager(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{name: "cache directory", config: Config{Domains: []string{"lb.example.com"}, Challenge: ChallengeHTTP, CacheDir: t.TempDir()}, valid: true},
+		{name: "store", config: Config{Domains: []string{"lb.example.com"}, Challenge: ChallengeTLSALPN, Store: memoryCertificates{}}, valid: true},
+		{name: "no domain", config: Config{Challenge: ChallengeHTTP, CacheDir: t.TempDir()}},
+		{name: "unknown challenge", config: Config{Domains: []string{"lb.example.com"}, Challenge: "dns-01", CacheDir: t.TempDir()}},
+		{name: "no cache", config: Config{Domains: []string{"lb.example.com"}, Challenge: ChallengeHTTP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewManager(tt.config)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("the config was accepted")
+			}
+		})
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m, err := NewManager(Config{Domains: []string{"lb.example.com"}, Challenge: ChallengeHTTP, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, ok := m.HTTPHandler()
+	if !ok {
+		t.Fatal("no handler for http-01 challenges")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://lb.example.com/request?x=1", nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || location != "https://lb.example.com/request?x=1" {
+		t.Errorf("got %d to %q, expected a redirect to HTTPS", w.Code, location)
+	}
+
+	m, err = NewManager(Config{Domains: []string{"lb.example.com"}, Challenge: ChallengeTLSALPN, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.HTTPHandler(); ok {
+		t.Error("a handler on port 80 for tls-alpn-01 challenges")
+	}
+	if protos := m.TLSConfig().NextProtos; len(protos) == 0 || protos[len(protos)-1] != "acme-tls/1" {
+		t.Errorf("got protocols %q, expected acme-tls/1 for the challenges", protos)
+	}
+}
+
+func TestStoreCache(t *testing.T) {
+	cache := storeCache{memoryCertificates{}}
+	ctx := context.Background()
+	if _, err := cache.Get(ctx, "lb.example.com"); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Errorf("got %v, expected a cache miss", err)
+	}
+	if err := cache.Put(ctx, "lb.example.com", []byte("pem")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get(ctx, "lb.example.com"); err != nil || string(data) != "pem" {
+		t.Errorf("got %q, %v, expected the saved certificate", data, err)
+	}
+	if err := cache.Delete(ctx, "lb.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, "lb.example.com"); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Errorf("got %v after deleting, expected a cache miss", err)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/e2e"
+	"github.com/jiwooo-kim/poc_loadbalancer/loadtest"
+	"github.com/jiwooo-kim/poc_loadbalancer/policytest"
+	"github.com/jiwooo-kim/poc_loadbalancer/rulexpr"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// adminClient talks to the admin API of a running balancer
+type adminClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// adminFlags adds the flags locating the admin API to fs; the returned
+// function builds the client once fs is parsed
+func adminFlags(fs *flag.FlagSet) func() *adminClient {
+	adminURL := fs.String("admin-url", envOr("LB_ADMIN_URL", "http://localhost:8080"), "base URL of the balancer, defaults to $LB_ADMIN_URL")
+	token := fs.String("token", os.Getenv("LB_ADMIN_TOKEN"), "admin API bearer token, defaults to $LB_ADMIN_TOKEN")
+	return func() *adminClient {
+		return &adminClient{url: strings.TrimSuffix(*adminURL, "/"), token: *token, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// do sends body as JSON to the admin API path and decodes the response into out
+func (c *adminClient) do(method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+"/admin"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runNodeCommand runs lb node list, add, remove, drain or undrain
+func runNodeCommand(command string, args []string) {
+	fs := flag.NewFlagSet("node "+command, flag.ExitOnError)
+	client := adminFlags(fs)
+
+	switch command {
+	case "list":
+		asJSON := fs.Bool("json", false, "print the nodes as JSON")
+		fs.Parse(args)
+		var nodes []store.NodeLimits
+		if err := client().do(http.MethodGet, "/nodes", nil, &nodes); err != nil {
+			fail(err.Error())
+		}
+		if *asJSON {
+			printJSON(nodes)
+			return
+		}
+		printNodes(nodes)
+	case "add":
+		var node store.NodeLimits
+		file := fs.String("file", "", "JSON file with the node, as in -nodes-file; the other flags override it")
+		id := fs.String("id", "", "node ID")
+		address := fs.String("address", "", "node address, host:port, a URL or unix:///path/to.sock")
+		rpm := fs.Int("rpm", 0, "requests per minute limit")
+		bpm := fs.Int("bpm", 0, "BPM limit")
+		limits := fs.String("limits", "", "limit expression such as \"100 req/s AND 3000 req/min\"")
+		maxConcurrent := fs.Int("max-concurrent", 0, "requests the node may serve at once")
+		group := fs.String("group", "", "node group")
+		pool := fs.String("pool", "", "node pool")
+		fs.Parse(args)
+		if *file != "" {
+			data, err := os.ReadFile(*file)
+			if err != nil {
+				fail(err.Error())
+			}
+			if err := json.Unmarshal(data, &node); err != nil {
+				fail(fmt.Sprintf("%s: %v", *file, err))
+			}
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "id":
+				node.NodeID = *id
+			case "address":
+				node.Address = *address
+			case "rpm":
+				node.RPMLimit = *rpm
+			case "bpm":
+				node.BPMLimit = *bpm
+			case "limits":
+				node.Limits = *limits
+			case "max-concurrent":
+				node.MaxConcurrent = *maxConcurrent
+			case "group":
+				node.Group = *group
+			case "pool":
+				node.Pool = *pool
+			}
+		})
+		if node.NodeID == "" {
+			fail("usage: lb node add -id <id> [flags]")
+		}
+		if err := balancer.ValidateNode(node); err != nil {
+			fail(err.Error())
+		}
+		var nodes []store.NodeLimits
+		if err := client().do(http.MethodPut, "/nodes/"+url.PathEscape(node.NodeID), node, &nodes); err != nil {
+			fail(err.Error())
+		}
+		printNodes(nodes)
+	case "remove":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fail("usage: lb node remove [flags] <id>")
+		}
+		var nodes []store.NodeLimits
+		if err := client().do(http.MethodDelete, "/nodes/"+url.PathEscape(fs.Arg(0)), nil, &nodes); err != nil {
+			fail(err.Error())
+		}
+		printNodes(nodes)
+	case "drain":
+		keepSticky := fs.Bool("keep-sticky", false, "keep sending the node the clients whose affinity key sticks to it")
+		wait := fs.Bool("wait", false, "wait until the node serves no more requests")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fail("usage: lb node drain [flags] <id>")
+		}
+		c := client()
+		path := "/nodes/" + url.PathEscape(fs.Arg(0)) + "/drain"
+		var status balancer.DrainStatus
+		if err := c.do(http.MethodPut, path, map[string]bool{"keep_sticky": *keepSticky}, &status); err != nil {
+			fail(err.Error())
+		}
+		for *wait && !status.Drained {
+			fmt.Printf("node %s still serves %d requests\n", status.NodeID, status.InFlight)
+			time.Sleep(time.Second)
+			if err := c.do(http.MethodGet, path, nil, &status); err != nil {
+				fail(err.Error())
+			}
+		}
+		printDrainStatus(status)
+	case "undrain":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fail("usage: lb node undrain [flags] <id>")
+		}
+		var status balancer.DrainStatus
+		if err := client().do(http.MethodDelete, "/nodes/"+url.PathEscape(fs.Arg(0))+"/drain", nil, &status); err != nil {
+			fail(err.Error())
+		}
+		printDrainStatus(status)
+	default:
+		fail(fmt.Sprintf("unknown node command %q, expected list, add, remove, drain or undrain", command))
+	}
+}
+
+// runStatus prints the health and window usage of every node
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	client := adminFlags(fs)
+	fs.Parse(args)
+	c := client()
+
+	var nodes []store.NodeLimits
+	if err := c.do(http.MethodGet, "/nodes", nil, &nodes); err != nil {
+		fail(err.Error())
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tADDRESS\tGROUP\tHEALTH\tWINDOWS")
+	for _, node := range nodes {
+		id := url.PathEscape(node.NodeID)
+		var history balancer.HealthHistory
+		if err := c.do(http.MethodGet, "/nodes/"+id+"/health", nil, &history); err != nil {
+			fail(err.Error())
+		}
+		var quota balancer.Quota
+		if err := c.do(http.MethodGet, "/nodes/"+id+"/quota", nil, &quota); err != nil {
+			fail(err.Error())
+		}
+
+		state := "healthy"
+		switch {
+		case !history.Checked:
+			state = "unchecked"
+		case history.Flapping:
+			state = "flapping"
+		case !history.Healthy:
+			state = "unhealthy"
+		}
+		windows := make([]string, 0, len(quota.Windows))
+		for _, window := range quota.Windows {
+			windows = append(windows, fmt.Sprintf("%d/%d %s/%s", window.Used, window.Limit, window.Unit, window.Period))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", node.NodeID, node.Address, node.Group, state, strings.Join(windows, ", "))
+	}
+	w.Flush()
+}
+
+// runSwitch switches the live pool of a blue/green route, at once or once
+// the new pool served -percent of the requests for -bake
+func runSwitch(args []string) {
+	fs := flag.NewFlagSet("switch", flag.ExitOnError)
+	client := adminFlags(fs)
+	route := fs.String("route", "", "blue/green route to switch, e.g. /request")
+	bake := fs.Duration("bake", 0, "how long the new pool gets -percent of the requests before it goes live; 0 switches at once")
+	percent := fs.Float64("percent", 10, "share of the requests, in percent, the new pool gets during -bake")
+	abort := fs.Bool("abort", false, "call off the switch baking instead of starting one")
+	fs.Parse(args)
+	if *route == "" || *abort != (fs.NArg() == 0) || fs.NArg() > 1 {
+		fail("usage: lb switch -route <route> [-bake 10m -percent 10] blue|green, or lb switch -route <route> -abort")
+	}
+	c := client()
+
+	path := "/blue-green?route=" + url.QueryEscape(*route)
+	var states []struct {
+		Route     string    `json:"route"`
+		Live      string    `json:"live"`
+		Group     string    `json:"group"`
+		Target    string    `json:"target"`
+		Percent   float64   `json:"percent"`
+		BakeUntil time.Time `json:"bake_until"`
+	}
+	var err error
+	if *abort {
+		err = c.do(http.MethodDelete, path, nil, &states)
+	} else {
+		body := map[string]any{"live": fs.Arg(0)}
+		if *bake > 0 {
+			body["bake_minutes"], body["percent"] = bake.Minutes(), *percent
+		}
+		err = c.do(http.MethodPut, path, body, &states)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	for _, state := range states {
+		if state.Route != *route {
+			continue
+		}
+		if state.Target != "" {
+			fmt.Printf("route %s: %s (%s) is live, %s gets %.0f%% of the requests until %s\n", state.Route, state.Live, state.Group, state.Target, state.Percent, state.BakeUntil.Local().Format(time.RFC3339))
+		} else {
+			fmt.Printf("route %s: %s (%s) is live\n", state.Route, state.Live, state.Group)
+		}
+	}
+}
+
+// printNodes prints nodes as a table
+func printNodes(nodes []store.NodeLimits) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tADDRESS\tGROUP\tRPM\tBPM\tLIMITS")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", node.NodeID, node.Address, node.Group, node.RPMLimit, node.BPMLimit, node.Limits)
+	}
+	w.Flush()
+}
+
+// printDrainStatus prints whether a node is draining and what it still serves
+func printDrainStatus(status balancer.DrainStatus) {
+	switch {
+	case status.Drained:
+		fmt.Printf("node %s is drained and may be taken down\n", status.NodeID)
+	case status.Draining:
+		fmt.Printf("node %s is draining, %d requests in flight\n", status.NodeID, status.InFlight)
+	default:
+		fmt.Printf("node %s takes new requests, %d in flight\n", status.NodeID, status.InFlight)
+	}
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// pairFlags collects repeated <name>=<value> flags
+type pairFlags map[string][]string
+
+func (f pairFlags) String() string {
+	return fmt.Sprint(map[string][]string(f))
+}
+
+func (f pairFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected <name>=<value>, got %q", value)
+	}
+	f[name] = append(f[name], v)
+	return nil
+}
+
+// runRuleCheck parses a rule expression and, given a request, reports
+// whether it matches. It exits with status 1 when the request does not
+// match, so scripts can test rules before they go into the route config.
+func runRuleCheck(args []string) {
+	fs := flag.NewFlagSet("rule check", flag.ExitOnError)
+	method := fs.String("method", http.MethodPost, "method of the request to match")
+	target := fs.String("url", "", "URL of the request to match, e.g. http://lb.example.com/request?debug=1; without it the expression is only parsed")
+	headers := pairFlags{}
+	fs.Var(headers, "header", "header of the request to match as <name>=<value>, may be repeated")
+	cookies := pairFlags{}
+	fs.Var(cookies, "cookie", "cookie of the request to match as <name>=<value>, may be repeated")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("usage: lb rule check [flags] '<expression>'")
+	}
+
+	expr, err := rulexpr.Parse(fs.Arg(0))
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Println(expr)
+	if *target == "" {
+		return
+	}
+	r, err := http.NewRequest(*method, *target, nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	for name, values := range cookies {
+		for _, value := range values {
+			r.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+	}
+	if !expr.Match(r) {
+		fmt.Println("no match")
+		os.Exit(1)
+	}
+	fmt.Println("match")
+}
+
+// runPolicyTest runs the routing policy scenarios of YAML files against the
+// selection engine and reports them like go test. It exits with status 1
+// when a scenario fails.
+func runPolicyTest(args []string) {
+	fs := flag.NewFlagSet("policy-test", flag.ExitOnError)
+	run := fs.String("run", "", "only run the scenarios whose name matches this regular expression")
+	verbose := fs.Bool("v", false, "list the scenarios that pass as well")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail("usage: lb policy-test [flags] <scenarios.yaml>...")
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		fail(fmt.Sprintf("-run: %v", err))
+	}
+
+	ctx := context.Background()
+	passed, failed := 0, 0
+	for _, path := range fs.Args() {
+		file, err := policytest.Load(path)
+		if err != nil {
+			fail(err.Error())
+		}
+		for _, scenario := range file.Scenarios {
+			if !filter.MatchString(scenario.Name) {
+				continue
+			}
+			result := policytest.Run(ctx, scenario)
+			switch {
+			case result.Err != nil:
+				failed++
+				fmt.Printf("FAIL %s: %v\n", scenario.Name, result.Err)
+			case !result.Passed():
+				failed++
+				fmt.Printf("FAIL %s\n", scenario.Name)
+				for _, failure := range result.Failures {
+					fmt.Printf("    %s\n", failure)
+				}
+			default:
+				passed++
+				if *verbose {
+					fmt.Printf("ok   %s\n", scenario.Name)
+				}
+			}
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runE2E runs the end-to-end checks against a balancer and backends started
+// in-process and reports them like policy-test. It exits with status 1 when
+// a check fails.
+func runE2E(args []string) {
+	defaults := e2e.DefaultConfig()
+	fs := flag.NewFlagSet("e2e", flag.ExitOnError)
+	run := fs.String("run", "", "only run the checks whose name matches this regular expression: "+strings.Join(e2e.Checks, ", "))
+	verbose := fs.Bool("v", false, "list the checks that pass as well")
+	backends := fs.Int("backends", defaults.Backends, "how many backends the pool has")
+	requests := fs.Int("requests", defaults.Requests, "how many requests the fairness and failover checks send")
+	concurrency := fs.Int("concurrency", defaults.Concurrency, "how many requests are in flight at once")
+	rpm := fs.Int("rpm", defaults.RPM, "per-minute limit of each node in the limits check")
+	tolerance := fs.Float64("tolerance", defaults.Tolerance, "how far a node's share of the traffic may be off its fair share in the fairness check, as a fraction of it")
+	delay := fs.Duration("delay", defaults.Delay, "how long the backends take to answer in the shutdown check")
+	storeType := fs.String("store", "memory", "store the balancer keeps limits and requests in: memory or mongo")
+	mongoURI := fs.String("mongo-uri", "mongodb://localhost:27017/", "MongoDB connection string, for -store mongo")
+	mongoDatabase := fs.String("mongo-database", "lb_e2e", "MongoDB database the checks use, for -store mongo; their nodes are removed once they are done")
+	fs.Parse(args)
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		fail(fmt.Sprintf("-run: %v", err))
+	}
+
+	config := e2e.Config{Backends: *backends, Requests: *requests, Concurrency: *concurrency, RPM: *rpm, Tolerance: *tolerance, Delay: *delay}
+	switch *storeType {
+	case "memory":
+	case "mongo":
+		config.NewStore = func(ctx context.Context) (store.Store, error) {
+			mongoStore, err := store.NewMongoStore(ctx, *mongoURI, *mongoDatabase, 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			return mongoStore, mongoStore.Migrate(ctx, time.Hour)
+		}
+	default:
+		fail(fmt.Sprintf("-store: unknown store %q, expected memory or mongo", *storeType))
+	}
+
+	ctx := context.Background()
+	passed, failed := 0, 0
+	for _, check := range e2e.Checks {
+		if !filter.MatchString(check) {
+			continue
+		}
+		result := e2e.Run(ctx, config, check)
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", check, result.Err)
+		case !result.Passed():
+			failed++
+			fmt.Printf("FAIL %s (%s)\n", check, result.Elapsed.Round(time.Millisecond))
+			for _, failure := range result.Failures {
+				fmt.Printf("    %s\n", failure)
+			}
+		default:
+			passed++
+			if *verbose {
+				fmt.Printf("ok   %s (%s)\n", check, result.Elapsed.Round(time.Millisecond))
+			}
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runLoadTest sends synthetic traffic to a running balancer and reports how
+// it was spread over the nodes, what was refused and the latencies
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080/request", "URL requests are sent to")
+	method := fs.String("method", http.MethodPost, "method of the requests")
+	rps := fs.Float64("rps", 10, "requests started per second")
+	duration := fs.Duration("duration", 30*time.Second, "how long requests are started for")
+	concurrency := fs.Int("concurrency", 100, "requests in flight at most; requests due beyond it are skipped and reported")
+	minBody := fs.Int("min-body-bytes", 64, "smallest request body")
+	maxBody := fs.Int("max-body-bytes", 64, "largest request body, sizes are drawn evenly in between")
+	bpm := fs.Int("bpm", 0, "bpm field of the request bodies, left out when zero")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long a request may take")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	headers := pairFlags{}
+	fs.Var(headers, "header", "header of the requests as <name>=<value>, may be repeated, e.g. X-Priority=low")
+	fs.Parse(args)
+
+	config := loadtest.Config{
+		URL:          *target,
+		Method:       *method,
+		Header:       http.Header{},
+		RPS:          *rps,
+		Duration:     *duration,
+		Concurrency:  *concurrency,
+		MinBodyBytes: *minBody,
+		MaxBodyBytes: *maxBody,
+		BPM:          *bpm,
+		Timeout:      *timeout,
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			config.Header.Add(name, value)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "sending %g requests per second to %s for %s\n", *rps, *target, *duration)
+	report, err := loadtest.Run(context.Background(), config)
+	if err != nil {
+		fail(err.Error())
+	}
+	if *asJSON {
+		printJSON(report)
+		return
+	}
+
+	fmt.Printf("%d sent in %s (%.1f/s), %d skipped at the concurrency limit\n", report.Sent, report.Elapsed.Round(time.Millisecond), float64(report.Sent)/report.Elapsed.Seconds(), report.Skipped)
+	fmt.Printf("latency p50 %s  p90 %s  p99 %s  max %s\n\n", report.Latency.P50, report.Latency.P90, report.Latency.P99, report.Latency.Max)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tREQUESTS\tSHARE\tPER MINUTE\tP50\tP90\tP99")
+	for _, node := range report.Nodes {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%.1f\t%s\t%s\t%s\n", node.Node, node.Requests, node.Share*100, node.PerMinute, node.Latency.P50, node.Latency.P90, node.Latency.P99)
+	}
+	w.Flush()
+	if len(report.Nodes) == 0 {
+		fmt.Println("no response named its node; run the balancer with -served-by")
+	}
+	fmt.Println()
+	for _, status := range slices.Sorted(maps.Keys(report.ByStatus)) {
+		fmt.Printf("status %d: %d\n", status, report.ByStatus[status])
+	}
+	for _, reason := range slices.Sorted(maps.Keys(report.Rejected)) {
+		fmt.Printf("rejected for %s: %d\n", reason, report.Rejected[reason])
+	}
+	for _, kind := range slices.Sorted(maps.Keys(report.Errors)) {
+		fmt.Printf("error %s: %d\n", kind, report.Errors[kind])
+	}
+}
@@ -0,0 +1,117 @@
+// Package clientlimit limits the request rate of each client with token
+// buckets, kept in memory or in Redis so balancer replicas share them.
+package clientlimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket struct represents the token bucket every client gets: it holds up
+// to Burst tokens, refilled at Rate tokens per second, and each request
+// takes one
+type Bucket struct {
+	Rate  float64
+	Burst int
+}
+
+// Validate checks that the bucket admits any request at all
+func (b Bucket) Validate() error {
+	if b.Rate <= 0 || b.Burst < 1 {
+		return fmt.Errorf("client bucket needs a positive rate and a burst of at least 1, got %g/s and %d", b.Rate, b.Burst)
+	}
+	return nil
+}
+
+// refillTime is how long an empty bucket takes to fill up, after which an
+// idle client's state can be forgotten
+func (b Bucket) refillTime() time.Duration {
+	return time.Duration(float64(b.Burst) / b.Rate * float64(time.Second))
+}
+
+// Decision struct represents whether a client's request was admitted
+type Decision struct {
+	Allowed bool
+	// Remaining is how many whole tokens the bucket holds afterwards
+	Remaining int
+	// RetryAfter is how long until the bucket holds a token again, for
+	// requests that were refused
+	RetryAfter time.Duration
+}
+
+// Limiter takes the tokens of client requests
+type Limiter interface {
+	// Take takes a token from the bucket of client, reporting whether there was one
+	Take(ctx context.Context, client string) (Decision, error)
+	// SetBucket changes the bucket every client gets; the tokens clients
+	// hold are kept, up to the new burst
+	SetBucket(bucket Bucket)
+}
+
+// MemoryLimiter keeps the buckets in memory, so every replica limits its
+// clients on its own
+type MemoryLimiter struct {
+	bucket Bucket
+
+	mu      sync.Mutex
+	clients map[string]*tokens
+	swept   time.Time
+}
+
+// tokens struct represents the state of one client's bucket
+type tokens struct {
+	count float64
+	at    time.Time
+}
+
+// NewMemoryLimiter returns a limiter giving every client bucket
+func NewMemoryLimiter(bucket Bucket) *MemoryLimiter {
+	return &MemoryLimiter{bucket: bucket, clients: map[string]*tokens{}, swept: time.Now()}
+}
+
+// Take implements Limiter
+func (l *MemoryLimiter) Take(ctx context.Context, client string) (Decision, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	t, ok := l.clients[client]
+	if !ok {
+		t = &tokens{count: float64(l.bucket.Burst), at: now}
+		l.clients[client] = t
+	}
+	t.count = math.Min(float64(l.bucket.Burst), t.count+now.Sub(t.at).Seconds()*l.bucket.Rate)
+	t.at = now
+	if t.count < 1 {
+		wait := time.Duration((1 - t.count) / l.bucket.Rate * float64(time.Second))
+		return Decision{RetryAfter: wait}, nil
+	}
+	t.count--
+	return Decision{Allowed: true, Remaining: int(t.count)}, nil
+}
+
+// SetBucket implements Limiter
+func (l *MemoryLimiter) SetBucket(bucket Bucket) {
+	l.mu.Lock()
+	l.bucket = bucket
+	l.mu.Unlock()
+}
+
+// sweep forgets the clients whose buckets are full again, at most once per
+// refill time. The caller holds l.mu.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	refill := l.bucket.refillTime()
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	for client, t := range l.clients {
+		if now.Sub(t.at) >= refill {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,114 @@
+package clientlimit
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// take takes a token from the bucket of client, failing the test on errors
+func take(t *testing.T, l Limiter, client string) Decision {
+	t.Helper()
+	decision, err := l.Take(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decision
+}
+
+// testBuckets checks the buckets newLimiter returns limiters with; limiters
+// returned by the same newLimiter share their buckets
+func testBuckets(t *testing.T, newLimiter func(t *testing.T, bucket Bucket) Limiter) {
+	t.Run("burst", func(t *testing.T) {
+		l := newLimiter(t, Bucket{Rate: 10, Burst: 3})
+		for i := range 3 {
+			if d := take(t, l, "client-a"); !d.Allowed || d.Remaining != 2-i {
+				t.Fatalf("request %d got %+v", i+1, d)
+			}
+		}
+		d := take(t, l, "client-a")
+		if d.Allowed || d.RetryAfter <= 0 || d.RetryAfter > 100*time.Millisecond {
+			t.Fatalf("request over the burst got %+v", d)
+		}
+		if d := take(t, l, "client-b"); !d.Allowed {
+			t.Error("another client was refused")
+		}
+		time.Sleep(d.RetryAfter + 10*time.Millisecond)
+		if d := take(t, l, "client-a"); !d.Allowed {
+			t.Errorf("request after the refill got %+v", d)
+		}
+	})
+
+	t.Run("set bucket", func(t *testing.T) {
+		l := newLimiter(t, Bucket{Rate: 0.001, Burst: 5})
+		take(t, l, "client-a")
+		l.SetBucket(Bucket{Rate: 0.001, Burst: 2})
+		if d := take(t, l, "client-a"); !d.Allowed || d.Remaining != 1 {
+			t.Errorf("got %+v, expected the tokens cut to the new burst", d)
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		bucket := Bucket{Rate: 0.001, Burst: 2}
+		replicas := []Limiter{newLimiter(t, bucket), newLimiter(t, bucket)}
+		allowed := 0
+		for i := range 4 {
+			if take(t, replicas[i%2], "client-a").Allowed {
+				allowed++
+			}
+		}
+		if _, ok := replicas[0].(*MemoryLimiter); ok {
+			// Every replica keeps its own buckets in memory
+			if allowed != 4 {
+				t.Errorf("allowed %d requests, expected 4", allowed)
+			}
+		} else if allowed != 2 {
+			t.Errorf("allowed %d requests across replicas, expected 2", allowed)
+		}
+	})
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	testBuckets(t, func(t *testing.T, bucket Bucket) Limiter {
+		return NewMemoryLimiter(bucket)
+	})
+}
+
+// TestRedisLimiter runs takeScript against the Redis server at
+// LB_TEST_REDIS_URL, e.g. redis://localhost:6379/15
+func TestRedisLimiter(t *testing.T) {
+	url := os.Getenv("LB_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("LB_TEST_REDIS_URL is not set")
+	}
+	run := strconv.FormatInt(time.Now().UnixNano(), 10)
+	testBuckets(t, func(t *testing.T, bucket Bucket) Limiter {
+		// Limiters of one test share a prefix, so they share their buckets
+		prefix := "lb-test:" + run + ":" + t.Name() + ":"
+		l, err := NewRedisLimiter(context.Background(), url, prefix, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	})
+}
+
+func TestBucketValidate(t *testing.T) {
+	tests := []struct {
+		bucket  Bucket
+		wantErr bool
+	}{
+		{bucket: Bucket{Rate: 1, Burst: 1}},
+		{bucket: Bucket{Rate: 0.5, Burst: 10}},
+		{bucket: Bucket{Rate: 0, Burst: 1}, wantErr: true},
+		{bucket: Bucket{Rate: 1, Burst: 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.bucket.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: got %v, expected an error: %v", tt.bucket, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package clientlimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from a bucket in one round trip, so
+// replicas racing for a client's last token never both get it. The bucket is
+// a hash of its tokens and the time they were counted at, in milliseconds of
+// the Redis server's clock so replica clocks need not agree, and expires
+// once it would be full again.
+//
+// KEYS[1] is the bucket, ARGV the rate per second and the burst. It returns
+// whether a token was taken, the whole tokens left and the milliseconds
+// until the next one.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate / 1000)
+
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// RedisLimiter keeps the buckets in Redis, shared by every replica using
+// the same server
+type RedisLimiter struct {
+	client *redis.Client
+	prefix string
+
+	mu     sync.RWMutex
+	bucket Bucket
+}
+
+// NewRedisLimiter connects to the Redis server at url, e.g.
+// redis://localhost:6379/0, and returns a limiter giving every client bucket
+// under keys starting with prefix
+func NewRedisLimiter(ctx context.Context, url, prefix string, bucket Bucket) (*RedisLimiter, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisLimiter{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// Take implements Limiter
+func (l *RedisLimiter) Take(ctx context.Context, client string) (Decision, error) {
+	l.mu.RLock()
+	bucket := l.bucket
+	l.mu.RUnlock()
+	rate := strconv.FormatFloat(bucket.Rate, 'f', -1, 64)
+	result, err := takeScript.Run(ctx, l.client, []string{l.prefix + client}, rate, bucket.Burst).Int64Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{Allowed: result[0] == 1, Remaining: int(result[1]), RetryAfter: time.Duration(result[2]) * time.Millisecond}, nil
+}
+
+// SetBucket implements Limiter
+func (l *RedisLimiter) SetBucket(bucket Bucket) {
+	l.mu.Lock()
+	l.bucket = bucket
+	l.mu.Unlock()
+}
+
+// Close disconnects from Redis
+func (l *RedisLimiter) Close() error {
+	return l.client.Close()
+}
@@ -0,0 +1,67 @@
+// Package diagnostics serves the pprof profiles and expvar variables of the
+// running balancer on a listener of their own, kept off the proxied and
+// admin ports so it can be bound to localhost or a private network.
+package diagnostics
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// gcStats struct represents the garbage collector figures published as the
+// gc variable
+type gcStats struct {
+	Cycles uint32 `json:"cycles"`
+	// PauseTotalSeconds is the time the world was stopped for collections
+	PauseTotalSeconds float64 `json:"pause_total_seconds"`
+	// LastPauseSeconds is the pause of the latest collection
+	LastPauseSeconds float64   `json:"last_pause_seconds"`
+	Last             time.Time `json:"last,omitzero"`
+	HeapAllocBytes   uint64    `json:"heap_alloc_bytes"`
+	HeapObjects      uint64    `json:"heap_objects"`
+	NextGCBytes      uint64    `json:"next_gc_bytes"`
+	CPUFraction      float64   `json:"cpu_fraction"`
+}
+
+func readGCStats() gcStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := gcStats{
+		Cycles:            m.NumGC,
+		PauseTotalSeconds: time.Duration(m.PauseTotalNs).Seconds(),
+		HeapAllocBytes:    m.HeapAlloc,
+		HeapObjects:       m.HeapObjects,
+		NextGCBytes:       m.NextGC,
+		CPUFraction:       m.GCCPUFraction,
+	}
+	if m.NumGC > 0 {
+		stats.LastPauseSeconds = time.Duration(m.PauseNs[(m.NumGC+255)%256]).Seconds()
+		stats.Last = time.Unix(0, int64(m.LastGC))
+	}
+	return stats
+}
+
+// Publish publishes the goroutine count, the garbage collector figures and
+// the store latencies storeLatencies returns as the goroutines, gc and
+// store expvar variables. It must be called once.
+func Publish(storeLatencies func() any) {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("gc", expvar.Func(func() any { return readGCStats() }))
+	expvar.Publish("store", expvar.Func(storeLatencies))
+}
+
+// Handler serves the pprof profiles under /debug/pprof/ and the expvar
+// variables, with the command line and memory statistics, on /debug/vars
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
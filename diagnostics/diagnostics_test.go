@@ -0,0 +1,46 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// publish publishes the variables once, as expvar panics on a second time
+var publish sync.Once
+
+func TestHandler(t *testing.T) {
+	publish.Do(func() {
+		Publish(func() any { return map[string]float64{"record": 0.001} })
+	})
+	runtime.GC()
+	handler := Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars struct {
+		Goroutines int                `json:"goroutines"`
+		GC         gcStats            `json:"gc"`
+		Store      map[string]float64 `json:"store"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Goroutines == 0 || vars.GC.Cycles == 0 || vars.GC.Last.IsZero() || vars.GC.HeapAllocBytes == 0 {
+		t.Errorf("got %+v, expected the goroutines and a collection", vars)
+	}
+	if vars.Store["record"] != 0.001 {
+		t.Errorf("got store latencies %v, expected those of the callback", vars.Store)
+	}
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("got status %d for %s, expected %d", w.Code, path, http.StatusOK)
+		}
+	}
+}
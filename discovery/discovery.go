@@ -0,0 +1,185 @@
+// Package discovery finds backend nodes in Consul, etcd, DNS SRV records,
+// Kubernetes or an xDS control plane.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Node struct represents a backend node reported by a discovery backend
+type Node struct {
+	NodeID  string
+	Address string
+	// Group is the node group the backend puts the node in, if any
+	Group string
+}
+
+// Discoverer lists the nodes currently registered in a discovery backend
+type Discoverer interface {
+	Discover(ctx context.Context) ([]Node, error)
+}
+
+// New returns the discoverer of the given kind: consul, etcd, dns, kubernetes
+// or xds. addr is the address of the discovery backend and name what to look
+// up in it, for xds the route configuration.
+func New(kind, addr, name string) (Discoverer, error) {
+	if name == "" {
+		return nil, fmt.Errorf("discovery %q needs a service name", kind)
+	}
+	switch kind {
+	case "consul":
+		return &consulDiscoverer{addr: strings.TrimSuffix(addr, "/"), service: name}, nil
+	case "etcd":
+		return &etcdDiscoverer{addr: strings.TrimSuffix(addr, "/"), prefix: name}, nil
+	case "dns":
+		return &dnsDiscoverer{name: name}, nil
+	case "kubernetes":
+		return newKubernetesDiscoverer(addr, name)
+	case "xds":
+		return NewXDS(addr, name), nil
+	}
+	return nil, fmt.Errorf("unknown discovery backend %q", kind)
+}
+
+// Watcher is implemented by discoverers that can push changes as they happen
+// instead of being polled
+type Watcher interface {
+	Watch(ctx context.Context, update func([]Node)) error
+}
+
+// consulDiscoverer reads the passing instances of a service from the Consul health API
+type consulDiscoverer struct {
+	addr    string
+	service string
+}
+
+func (c *consulDiscoverer) Discover(ctx context.Context) ([]Node, error) {
+	url := fmt.Sprintf("%s/v1/health/service/%s?passing=true", c.addr, c.service)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			ID      string
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		nodes = append(nodes, Node{
+			NodeID:  entry.Service.ID,
+			Address: net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+		})
+	}
+	return nodes, nil
+}
+
+// etcdDiscoverer reads nodes stored as <prefix><node id> = <address> through the etcd v3 JSON gateway
+type etcdDiscoverer struct {
+	addr   string
+	prefix string
+}
+
+func (e *etcdDiscoverer) Discover(ctx context.Context) ([]Node, error) {
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(e.prefix)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.addr+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd returned %s", resp.Status)
+	}
+
+	var result struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(result.Kvs))
+	for _, kv := range result.Kvs {
+		nodes = append(nodes, Node{
+			NodeID:  strings.TrimPrefix(string(kv.Key), e.prefix),
+			Address: string(kv.Value),
+		})
+	}
+	return nodes, nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All bytes are 0xff, range to the end of the keyspace
+	return []byte{0}
+}
+
+// dnsDiscoverer resolves nodes from DNS SRV records, e.g. _http._tcp.backend.service.consul
+type dnsDiscoverer struct {
+	name string
+}
+
+func (d *dnsDiscoverer) Discover(ctx context.Context) ([]Node, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(records))
+	for _, srv := range records {
+		address := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		nodes = append(nodes, Node{NodeID: address, Address: address})
+	}
+	return nodes, nil
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, kind := range []string{"consul", "etcd", "dns", "xds"} {
+		if _, err := New(kind, "http://localhost:8500", "backend"); err != nil {
+			t.Errorf("New(%q) = %v", kind, err)
+		}
+	}
+	if _, err := New("consul", "http://localhost:8500", ""); err == nil {
+		t.Error("a discoverer without a service name was returned")
+	}
+	if _, err := New("zookeeper", "localhost:2181", "backend"); err == nil {
+		t.Error("an unknown backend was accepted")
+	}
+}
+
+func TestConsul(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/backend" || r.URL.Query().Get("passing") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"ID": "backend-1", "Address": "10.0.1.1", "Port": 8080}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"ID": "backend-2", "Port": 8081}}
+		]`))
+	}))
+	defer server.Close()
+
+	d, err := New("consul", server.URL+"/", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Instances without a service address are reached at their node's
+	expected := []Node{{NodeID: "backend-1", Address: "10.0.1.1:8080"}, {NodeID: "backend-2", Address: "10.0.0.2:8081"}}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("got %+v, expected %+v", nodes, expected)
+	}
+
+	d, _ = New("consul", server.URL, "unknown")
+	if _, err := d.Discover(context.Background()); err == nil {
+		t.Error("an error response was accepted")
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/v3/kv/range" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req["key"] != encode("/nodes/") || req["range_end"] != encode("/nodes0") {
+			t.Errorf("got range %q to %q, expected the keys under /nodes/", req["key"], req["range_end"])
+		}
+		json.NewEncoder(w).Encode(map[string]any{"kvs": []map[string]string{
+			{"key": encode("/nodes/node-1"), "value": encode("10.0.0.1:8080")},
+			{"key": encode("/nodes/node-2"), "value": encode("10.0.0.2:8080")},
+		}})
+	}))
+	defer server.Close()
+
+	d, err := New("etcd", server.URL, "/nodes/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Node{{NodeID: "node-1", Address: "10.0.0.1:8080"}, {NodeID: "node-2", Address: "10.0.0.2:8080"}}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("got %+v, expected %+v", nodes, expected)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{prefix: "/nodes/", expected: "/nodes0"},
+		{prefix: "a\xff", expected: "b"},
+		{prefix: "\xff\xff", expected: "\x00"},
+	}
+	for _, tt := range tests {
+		if got := string(prefixEnd(tt.prefix)); got != tt.expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", tt.prefix, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesDiscoverer keeps the node pool in sync with the EndpointSlices of a
+// Kubernetes Service. Only ready endpoints are used, so pods failing a
+// readiness probe or readiness gate never receive traffic.
+type kubernetesDiscoverer struct {
+	apiServer string
+	token     string
+	client    *http.Client
+	namespace string
+	service   string
+	port      string
+}
+
+// endpointSlice is the subset of a discovery.k8s.io/v1 EndpointSlice used by the balancer
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+}
+
+// newKubernetesDiscoverer parses [namespace/]service[:port] and connects to
+// apiServer, or to the in-cluster API server with the pod's service account
+// when apiServer is empty.
+func newKubernetesDiscoverer(apiServer, name string) (*kubernetesDiscoverer, error) {
+	k := &kubernetesDiscoverer{client: http.DefaultClient}
+
+	name, k.port, _ = strings.Cut(name, ":")
+	if namespace, service, ok := strings.Cut(name, "/"); ok {
+		k.namespace, k.service = namespace, service
+	} else {
+		k.service = name
+	}
+
+	if apiServer != "" {
+		// e.g. kubectl proxy, which handles authentication itself
+		k.apiServer = strings.TrimSuffix(apiServer, "/")
+	} else {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes cluster, set the API server address")
+		}
+		k.apiServer = "https://" + net.JoinHostPort(host, port)
+
+		token, err := os.ReadFile(serviceAccountDir + "/token")
+		if err != nil {
+			return nil, err
+		}
+		k.token = strings.TrimSpace(string(token))
+
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		k.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+		if k.namespace == "" {
+			namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+			if err != nil {
+				return nil, err
+			}
+			k.namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	if k.namespace == "" {
+		k.namespace = "default"
+	}
+	return k, nil
+}
+
+func (k *kubernetesDiscoverer) Discover(ctx context.Context) ([]Node, error) {
+	slices, _, err := k.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.nodes(slices), nil
+}
+
+// Watch lists the Service's EndpointSlices and then follows the watch stream,
+// calling update with the full node set after every change. It returns when
+// the stream ends so the caller can resume with a fresh list.
+func (k *kubernetesDiscoverer) Watch(ctx context.Context, update func([]Node)) error {
+	slices, resourceVersion, err := k.list(ctx)
+	if err != nil {
+		return err
+	}
+	update(k.nodes(slices))
+
+	query := k.query()
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	resp, err := k.get(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			// The API server closes watches periodically, or we are shutting down
+			return nil
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var slice endpointSlice
+			if err := json.Unmarshal(event.Object, &slice); err != nil {
+				return err
+			}
+			if event.Type == "DELETED" {
+				delete(slices, slice.Metadata.Name)
+			} else {
+				slices[slice.Metadata.Name] = slice
+			}
+			update(k.nodes(slices))
+		case "ERROR":
+			// Usually 410 Gone once the resource version is too old; relist
+			return fmt.Errorf("kubernetes watch error: %s", event.Object)
+		}
+	}
+}
+
+func (k *kubernetesDiscoverer) query() url.Values {
+	query := url.Values{}
+	query.Set("labelSelector", "kubernetes.io/service-name="+k.service)
+	return query
+}
+
+func (k *kubernetesDiscoverer) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", k.apiServer, k.namespace, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (k *kubernetesDiscoverer) list(ctx context.Context) (map[string]endpointSlice, string, error) {
+	resp, err := k.get(ctx, k.query())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+
+	slices := make(map[string]endpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// nodes flattens the ready endpoints of all slices into nodes, one per pod
+func (k *kubernetesDiscoverer) nodes(slices map[string]endpointSlice) []Node {
+	nodes := []Node{}
+	for _, slice := range slices {
+		port := 0
+		for _, p := range slice.Ports {
+			if p.Port != nil && (k.port == "" || (p.Name != nil && *p.Name == k.port) || strconv.Itoa(*p.Port) == k.port) {
+				port = *p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A missing ready condition means unknown and is treated as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+				continue
+			}
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			address := net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(port))
+			nodeID := address
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Name != "" {
+				nodeID = endpoint.TargetRef.Name
+			}
+			nodes = append(nodes, Node{NodeID: nodeID, Address: address})
+		}
+	}
+	return nodes
+}
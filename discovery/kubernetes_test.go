@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// backendSlice is an EndpointSlice of the backend Service: ready pod-1,
+// unready pod-2, terminating pod-3 and pod-4 of unknown readiness
+const backendSlice = `{
+	"metadata": {"name": "backend-abc"},
+	"ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}],
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "targetRef": {"name": "pod-1"}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false}, "targetRef": {"name": "pod-2"}},
+		{"addresses": ["10.0.0.3"], "conditions": {"ready": true, "terminating": true}, "targetRef": {"name": "pod-3"}},
+		{"addresses": ["10.0.0.4"], "conditions": {}}
+	]
+}`
+
+func TestKubernetes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices" || r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=backend" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "42"}, "items": [%s]}`, backendSlice)
+			return
+		}
+		if version := r.URL.Query().Get("resourceVersion"); version != "42" {
+			t.Errorf("watching from version %q, expected the one listed", version)
+		}
+		fmt.Fprintln(w, `{"type": "ADDED", "object": {"metadata": {"name": "backend-def"}, "ports": [{"name": "http", "port": 8080}], "endpoints": [{"addresses": ["10.0.1.1"], "targetRef": {"name": "pod-5"}}]}}`)
+		fmt.Fprintln(w, `{"type": "DELETED", "object": {"metadata": {"name": "backend-abc"}}}`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		service  string
+		expected []Node
+	}{
+		{name: "port name", service: "prod/backend:http", expected: []Node{{NodeID: "10.0.0.4:8080", Address: "10.0.0.4:8080"}, {NodeID: "pod-1", Address: "10.0.0.1:8080"}}},
+		{name: "port number", service: "prod/backend:9090", expected: []Node{{NodeID: "10.0.0.4:9090", Address: "10.0.0.4:9090"}, {NodeID: "pod-1", Address: "10.0.0.1:9090"}}},
+		{name: "first port", service: "prod/backend", expected: []Node{{NodeID: "10.0.0.4:9090", Address: "10.0.0.4:9090"}, {NodeID: "pod-1", Address: "10.0.0.1:9090"}}},
+		{name: "unknown port", service: "prod/backend:grpc", expected: []Node{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := New("kubernetes", server.URL, tt.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes, err := d.Discover(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+			if !reflect.DeepEqual(nodes, tt.expected) {
+				t.Errorf("got %+v, expected %+v", nodes, tt.expected)
+			}
+		})
+	}
+
+	d, err := New("kubernetes", server.URL, "prod/backend:http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updates [][]Node
+	err = d.(Watcher).Watch(context.Background(), func(nodes []Node) {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+		updates = append(updates, nodes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]Node{
+		{{NodeID: "10.0.0.4:8080", Address: "10.0.0.4:8080"}, {NodeID: "pod-1", Address: "10.0.0.1:8080"}},
+		{{NodeID: "10.0.0.4:8080", Address: "10.0.0.4:8080"}, {NodeID: "pod-1", Address: "10.0.0.1:8080"}, {NodeID: "pod-5", Address: "10.0.1.1:8080"}},
+		{{NodeID: "pod-5", Address: "10.0.1.1:8080"}},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("got updates %+v, expected %+v", updates, expected)
+	}
+}
+
+func TestKubernetesNamespace(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := New("kubernetes", "", "backend"); err == nil {
+		t.Error("discovery outside a cluster without an API server was accepted")
+	}
+	d, err := New("kubernetes", "http://localhost:8001/", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := d.(*kubernetesDiscoverer)
+	if k.apiServer != "http://localhost:8001" || k.namespace != "default" || k.service != "backend" || k.port != "" {
+		t.Errorf("got %+v, expected service backend in namespace default", k)
+	}
+}
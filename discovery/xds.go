@@ -0,0 +1,539 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/rulexpr"
+)
+
+// Type URLs of the xDS resources the balancer subscribes to
+const (
+	clusterType  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	endpointType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+	routeType    = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+)
+
+// Route struct represents a route of an xDS route configuration: requests
+// matching Match, a rule expression of package rulexpr, go to the nodes of
+// Group, which is the name of an xDS cluster
+type Route struct {
+	Name  string
+	Match string
+	Group string
+}
+
+// XDS follows the clusters, endpoints and routes an xDS control plane such
+// as Istio or one built on go-control-plane serves over the aggregated
+// discovery service. Every endpoint of a cluster becomes a node of the
+// group named after the cluster, and the routes of the route configuration
+// pick the group of requests. Only healthy endpoints, and endpoints of
+// unknown health, are nodes.
+type XDS struct {
+	addr string
+	// NodeID and Cluster identify the balancer to the control plane; they
+	// must be set before the watch starts
+	NodeID  string
+	Cluster string
+	// RouteConfig names the route configuration subscribed to; without it
+	// no routes are received
+	RouteConfig string
+
+	mu     sync.Mutex
+	nodes  []Node
+	routes []Route
+	// onRoutes is called with every new set of routes, see OnRoutes
+	onRoutes func([]Route)
+}
+
+// NewXDS returns a discoverer subscribing to the control plane at addr,
+// host:port of its plaintext gRPC endpoint, for routeConfig. The node ID
+// defaults to poc-loadbalancer~<hostname>.
+func NewXDS(addr, routeConfig string) *XDS {
+	hostname, _ := os.Hostname()
+	return &XDS{addr: addr, NodeID: "poc-loadbalancer~" + hostname, RouteConfig: routeConfig}
+}
+
+// OnRoutes calls update with the routes received from now on, and right
+// away with the latest routes if any were received already
+func (x *XDS) OnRoutes(update func([]Route)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.onRoutes = update
+	if x.routes != nil {
+		update(x.routes)
+	}
+}
+
+// Discover returns the nodes of the latest update, the control plane only
+// pushes them through Watch
+func (x *XDS) Discover(ctx context.Context) ([]Node, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.nodes == nil {
+		return nil, errors.New("xds: no endpoints received yet")
+	}
+	return x.nodes, nil
+}
+
+// xdsSubscription struct represents what was last requested and accepted
+// of one resource type
+type xdsSubscription struct {
+	names   []string
+	version string
+	nonce   string
+}
+
+// xdsState struct represents the resources received on a stream
+type xdsState struct {
+	subscriptions map[string]*xdsSubscription
+	// clusters holds the clusters by name
+	clusters map[string]*clusterv3.Cluster
+	// assignments holds the endpoints of EDS clusters by service name
+	assignments map[string]*endpointv3.ClusterLoadAssignment
+}
+
+// edsName returns the service name the endpoints of an EDS cluster are
+// requested by, "" for other clusters
+func edsName(cluster *clusterv3.Cluster) string {
+	if cluster.GetType() != clusterv3.Cluster_EDS {
+		return ""
+	}
+	if name := cluster.GetEdsClusterConfig().GetServiceName(); name != "" {
+		return name
+	}
+	return cluster.GetName()
+}
+
+// Watch subscribes to the clusters, their endpoints and the route
+// configuration over one ADS stream, calling update with the full node set
+// after every change of clusters or endpoints. Updates that cannot be used
+// are refused with a NACK, keeping the last good ones. It returns when the
+// stream ends so the caller can subscribe again.
+func (x *XDS) Watch(ctx context.Context, update func([]Node)) error {
+	conn, err := grpc.NewClient(x.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := discoveryv3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return err
+	}
+
+	node := &corev3.Node{Id: x.NodeID, Cluster: x.Cluster}
+	state := xdsState{
+		subscriptions: map[string]*xdsSubscription{clusterType: {}, endpointType: {}, routeType: {}},
+		clusters:      map[string]*clusterv3.Cluster{},
+		assignments:   map[string]*endpointv3.ClusterLoadAssignment{},
+	}
+	request := func(typeURL string, nack error) error {
+		sub := state.subscriptions[typeURL]
+		req := &discoveryv3.DiscoveryRequest{Node: node, TypeUrl: typeURL, ResourceNames: sub.names, VersionInfo: sub.version, ResponseNonce: sub.nonce}
+		if nack != nil {
+			req.ErrorDetail = &statuspb.Status{Code: int32(codes.InvalidArgument), Message: nack.Error()}
+		}
+		return stream.Send(req)
+	}
+	if err := request(clusterType, nil); err != nil {
+		return err
+	}
+	if x.RouteConfig != "" {
+		state.subscriptions[routeType].names = []string{x.RouteConfig}
+		if err := request(routeType, nil); err != nil {
+			return err
+		}
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("xds stream: %w", err)
+		}
+		sub, ok := state.subscriptions[resp.GetTypeUrl()]
+		if !ok {
+			continue
+		}
+		sub.nonce = resp.GetNonce()
+
+		var applyErr error
+		switch resp.GetTypeUrl() {
+		case clusterType:
+			applyErr = state.applyClusters(resp.GetResources())
+		case endpointType:
+			applyErr = state.applyEndpoints(resp.GetResources())
+		case routeType:
+			applyErr = x.applyRoutes(resp.GetResources())
+		}
+		if applyErr != nil {
+			log.Printf("xds: refusing %s version %s: %v", resp.GetTypeUrl(), resp.GetVersionInfo(), applyErr)
+			if err := request(resp.GetTypeUrl(), applyErr); err != nil {
+				return err
+			}
+			continue
+		}
+		sub.version = resp.GetVersionInfo()
+		if err := request(resp.GetTypeUrl(), nil); err != nil {
+			return err
+		}
+
+		if resp.GetTypeUrl() == clusterType {
+			// Subscribe to the endpoints of the EDS clusters now known
+			names := []string{}
+			for _, cluster := range state.clusters {
+				if name := edsName(cluster); name != "" && !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			if eds := state.subscriptions[endpointType]; !slices.Equal(names, eds.names) {
+				eds.names = names
+				if err := request(endpointType, nil); err != nil {
+					return err
+				}
+			}
+		}
+		// Like Envoy warming clusters, the pool waits for the endpoints of
+		// new EDS clusters rather than dropping their nodes in between
+		if resp.GetTypeUrl() != routeType && state.warm() {
+			nodes := state.nodes()
+			x.mu.Lock()
+			x.nodes = nodes
+			x.mu.Unlock()
+			update(nodes)
+		}
+	}
+}
+
+// warm reports whether the endpoints of every EDS cluster were received
+func (s *xdsState) warm() bool {
+	for _, cluster := range s.clusters {
+		if name := edsName(cluster); name != "" && s.assignments[name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// nodes returns the endpoints of every cluster, ordered by node ID
+func (s *xdsState) nodes() []Node {
+	nodes := []Node{}
+	for name, cluster := range s.clusters {
+		assignment := cluster.GetLoadAssignment()
+		if eds := edsName(cluster); eds != "" {
+			assignment = s.assignments[eds]
+		}
+		// The assignments were checked when they were received
+		clusterNodes, _ := assignmentNodes(name, assignment)
+		nodes = append(nodes, clusterNodes...)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	return nodes
+}
+
+// applyClusters replaces the clusters with the ones of a CDS response
+func (s *xdsState) applyClusters(resources []*anypb.Any) error {
+	clusters := make(map[string]*clusterv3.Cluster, len(resources))
+	for _, resource := range resources {
+		cluster := &clusterv3.Cluster{}
+		if err := resource.UnmarshalTo(cluster); err != nil {
+			return err
+		}
+		if edsName(cluster) == "" {
+			if _, err := assignmentNodes(cluster.GetName(), cluster.GetLoadAssignment()); err != nil {
+				return fmt.Errorf("cluster %s: %w", cluster.GetName(), err)
+			}
+		}
+		clusters[cluster.GetName()] = cluster
+	}
+	s.clusters = clusters
+	return nil
+}
+
+// applyEndpoints replaces the endpoints with the ones of an EDS response,
+// which holds every ClusterLoadAssignment subscribed to
+func (s *xdsState) applyEndpoints(resources []*anypb.Any) error {
+	assignments := make(map[string]*endpointv3.ClusterLoadAssignment, len(resources))
+	for _, resource := range resources {
+		assignment := &endpointv3.ClusterLoadAssignment{}
+		if err := resource.UnmarshalTo(assignment); err != nil {
+			return err
+		}
+		if _, err := assignmentNodes(assignment.GetClusterName(), assignment); err != nil {
+			return fmt.Errorf("endpoints %s: %w", assignment.GetClusterName(), err)
+		}
+		assignments[assignment.GetClusterName()] = assignment
+	}
+	s.assignments = assignments
+	return nil
+}
+
+// assignmentNodes returns the healthy endpoints of assignment as nodes of
+// group, with node IDs of the form <group>/<host>:<port>
+func assignmentNodes(group string, assignment *endpointv3.ClusterLoadAssignment) ([]Node, error) {
+	nodes := []Node{}
+	for _, locality := range assignment.GetEndpoints() {
+		for _, endpoint := range locality.GetLbEndpoints() {
+			switch endpoint.GetHealthStatus() {
+			case corev3.HealthStatus_UNKNOWN, corev3.HealthStatus_HEALTHY:
+			default:
+				continue
+			}
+			socket := endpoint.GetEndpoint().GetAddress().GetSocketAddress()
+			if socket == nil {
+				return nil, errors.New("only socket addresses are supported")
+			}
+			address := net.JoinHostPort(socket.GetAddress(), strconv.Itoa(int(socket.GetPortValue())))
+			nodes = append(nodes, Node{NodeID: group + "/" + address, Address: address, Group: group})
+		}
+	}
+	return nodes, nil
+}
+
+// applyRoutes maps the route configuration of an RDS response to routes
+func (x *XDS) applyRoutes(resources []*anypb.Any) error {
+	routes := []Route{}
+	for _, resource := range resources {
+		var config routev3.RouteConfiguration
+		if err := resource.UnmarshalTo(&config); err != nil {
+			return err
+		}
+		if config.GetName() != x.RouteConfig {
+			continue
+		}
+		for _, host := range config.GetVirtualHosts() {
+			domains := domainsMatch(host.GetDomains())
+			for _, route := range host.GetRoutes() {
+				group := routeCluster(route.GetRoute())
+				if group == "" {
+					// Redirects and direct responses are served by Envoy only
+					continue
+				}
+				match, err := routeMatch(route.GetMatch())
+				if err != nil {
+					return fmt.Errorf("route %s of virtual host %s: %w", route.GetName(), host.GetName(), err)
+				}
+				match = allOf(domains, match)
+				if _, err := rulexpr.Parse(match); err != nil {
+					return fmt.Errorf("route %s of virtual host %s: %w", route.GetName(), host.GetName(), err)
+				}
+				routes = append(routes, Route{Name: host.GetName() + "/" + route.GetName(), Match: match, Group: group})
+			}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.routes = routes
+	if x.onRoutes != nil {
+		x.onRoutes(routes)
+	}
+	return nil
+}
+
+// routeCluster returns the cluster a route action sends requests to: its
+// cluster, or the heaviest of its weighted clusters, as traffic splits
+// between groups are set with the group weights
+func routeCluster(action *routev3.RouteAction) string {
+	if cluster := action.GetCluster(); cluster != "" {
+		return cluster
+	}
+	cluster, weight := "", uint32(0)
+	for _, weighted := range action.GetWeightedClusters().GetClusters() {
+		if w := weighted.GetWeight().GetValue(); cluster == "" || w > weight {
+			cluster, weight = weighted.GetName(), w
+		}
+	}
+	return cluster
+}
+
+// domainsMatch returns the rule expression matching the domains of a
+// virtual host, "" when it matches every host
+func domainsMatch(domains []string) string {
+	conditions := []string{}
+	for _, domain := range domains {
+		if domain == "*" {
+			return ""
+		}
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+		switch {
+		case strings.HasPrefix(domain, "*"):
+			conditions = append(conditions, "host =~ "+strconv.Quote("(?i)"+regexp.QuoteMeta(domain[1:])+"$"))
+		case strings.HasSuffix(domain, "*"):
+			conditions = append(conditions, "host =~ "+strconv.Quote("(?i)^"+regexp.QuoteMeta(domain[:len(domain)-1])))
+		default:
+			conditions = append(conditions, "host =~ "+strconv.Quote("(?i)^"+regexp.QuoteMeta(domain)+"$"))
+		}
+	}
+	return anyOf(conditions)
+}
+
+// routeMatch returns the rule expression of a route's path, header and
+// query parameter matchers. Other conditions, such as runtime fractions,
+// are ignored.
+func routeMatch(match *routev3.RouteMatch) (string, error) {
+	caseSensitive := match.GetCaseSensitive() == nil || match.GetCaseSensitive().GetValue()
+	conditions := []string{}
+	switch path := match.GetPathSpecifier().(type) {
+	case *routev3.RouteMatch_Prefix:
+		if path.Prefix != "" && path.Prefix != "/" {
+			conditions = append(conditions, stringCondition("path", prefixPattern(path.Prefix), caseSensitive, path.Prefix, "path_prefix"))
+		}
+	case *routev3.RouteMatch_Path:
+		conditions = append(conditions, stringCondition("path", "^"+regexp.QuoteMeta(path.Path)+"$", caseSensitive, path.Path, ""))
+	case *routev3.RouteMatch_SafeRegex:
+		conditions = append(conditions, "path =~ "+strconv.Quote("^(?:"+path.SafeRegex.GetRegex()+")$"))
+	case *routev3.RouteMatch_PathSeparatedPrefix:
+		conditions = append(conditions, "path =~ "+strconv.Quote("^"+regexp.QuoteMeta(path.PathSeparatedPrefix)+"(?:/|$)"))
+	default:
+		return "", fmt.Errorf("unsupported path match %T", path)
+	}
+
+	for _, header := range match.GetHeaders() {
+		value := "header(" + strconv.Quote(header.GetName()) + ")"
+		switch strings.ToLower(header.GetName()) {
+		case ":method":
+			value = "method"
+		case ":authority", "host":
+			value = "host"
+		case ":path":
+			value = "path"
+		}
+		var condition string
+		switch specifier := header.GetHeaderMatchSpecifier().(type) {
+		case *routev3.HeaderMatcher_PresentMatch:
+			condition = "has_header(" + strconv.Quote(header.GetName()) + ")"
+			if !specifier.PresentMatch {
+				condition = "!" + condition
+			}
+		case *routev3.HeaderMatcher_ExactMatch:
+			condition = value + " == " + strconv.Quote(specifier.ExactMatch)
+		case *routev3.HeaderMatcher_PrefixMatch:
+			condition = value + " =~ " + strconv.Quote(prefixPattern(specifier.PrefixMatch))
+		case *routev3.HeaderMatcher_SuffixMatch:
+			condition = value + " =~ " + strconv.Quote(regexp.QuoteMeta(specifier.SuffixMatch)+"$")
+		case *routev3.HeaderMatcher_ContainsMatch:
+			condition = value + " =~ " + strconv.Quote(regexp.QuoteMeta(specifier.ContainsMatch))
+		case *routev3.HeaderMatcher_SafeRegexMatch:
+			condition = value + " =~ " + strconv.Quote("^(?:"+specifier.SafeRegexMatch.GetRegex()+")$")
+		case *routev3.HeaderMatcher_StringMatch:
+			pattern, err := stringPattern(specifier.StringMatch)
+			if err != nil {
+				return "", fmt.Errorf("header %s: %w", header.GetName(), err)
+			}
+			condition = value + " =~ " + strconv.Quote(pattern)
+		default:
+			return "", fmt.Errorf("header %s: unsupported match %T", header.GetName(), specifier)
+		}
+		if header.GetInvertMatch() {
+			condition = "!(" + condition + ")"
+		}
+		conditions = append(conditions, condition)
+	}
+
+	for _, parameter := range match.GetQueryParameters() {
+		name := strconv.Quote(parameter.GetName())
+		switch specifier := parameter.GetQueryParameterMatchSpecifier().(type) {
+		case *routev3.QueryParameterMatcher_PresentMatch:
+			conditions = append(conditions, "has_query("+name+")")
+		case *routev3.QueryParameterMatcher_StringMatch:
+			pattern, err := stringPattern(specifier.StringMatch)
+			if err != nil {
+				return "", fmt.Errorf("query parameter %s: %w", parameter.GetName(), err)
+			}
+			conditions = append(conditions, "query("+name+") =~ "+strconv.Quote(pattern))
+		default:
+			return "", fmt.Errorf("query parameter %s: unsupported match %T", parameter.GetName(), specifier)
+		}
+	}
+	return allOf(conditions...), nil
+}
+
+// stringCondition matches value against pattern, or with the function
+// caseSensitive matches can use instead, e.g. path_prefix
+func stringCondition(value, pattern string, caseSensitive bool, literal, function string) string {
+	switch {
+	case !caseSensitive:
+		return value + " =~ " + strconv.Quote("(?i)"+pattern)
+	case function != "":
+		return function + "(" + strconv.Quote(literal) + ")"
+	}
+	return value + " == " + strconv.Quote(literal)
+}
+
+// prefixPattern returns the regular expression of strings starting with prefix
+func prefixPattern(prefix string) string {
+	return "^" + regexp.QuoteMeta(prefix)
+}
+
+// stringPattern returns the regular expression of a StringMatcher
+func stringPattern(m *matcherv3.StringMatcher) (string, error) {
+	var pattern string
+	switch p := m.GetMatchPattern().(type) {
+	case *matcherv3.StringMatcher_Exact:
+		pattern = "^" + regexp.QuoteMeta(p.Exact) + "$"
+	case *matcherv3.StringMatcher_Prefix:
+		pattern = prefixPattern(p.Prefix)
+	case *matcherv3.StringMatcher_Suffix:
+		pattern = regexp.QuoteMeta(p.Suffix) + "$"
+	case *matcherv3.StringMatcher_Contains:
+		pattern = regexp.QuoteMeta(p.Contains)
+	case *matcherv3.StringMatcher_SafeRegex:
+		pattern = "^(?:" + p.SafeRegex.GetRegex() + ")$"
+	default:
+		return "", fmt.Errorf("unsupported string match %T", p)
+	}
+	if m.GetIgnoreCase() {
+		pattern = "(?i)" + pattern
+	}
+	return pattern, nil
+}
+
+// allOf joins conditions with &&, "true" when there are none
+func allOf(conditions ...string) string {
+	conditions = slices.DeleteFunc(conditions, func(c string) bool { return c == "" })
+	switch len(conditions) {
+	case 0:
+		return "true"
+	case 1:
+		return conditions[0]
+	}
+	return "(" + strings.Join(conditions, ") && (") + ")"
+}
+
+// anyOf joins conditions with ||, "" when there are none
+func anyOf(conditions []string) string {
+	if len(conditions) <= 1 {
+		return strings.Join(conditions, "")
+	}
+	return "(" + strings.Join(conditions, ") || (") + ")"
+}
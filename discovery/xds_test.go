@@ -0,0 +1,285 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func lbEndpoint(host string, port uint32, health corev3.HealthStatus) *endpointv3.LbEndpoint {
+	return &endpointv3.LbEndpoint{
+		HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+			Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+				Address:       host,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+			}}},
+		}},
+		HealthStatus: health,
+	}
+}
+
+func routeConfig(prefix string) *routev3.RouteConfiguration {
+	return &routev3.RouteConfiguration{
+		Name: "main",
+		VirtualHosts: []*routev3.VirtualHost{{
+			Name:    "api",
+			Domains: []string{"api.example.com"},
+			Routes: []*routev3.Route{
+				{
+					Name:   "v1",
+					Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: prefix}},
+					Action: &routev3.Route_Route{Route: &routev3.RouteAction{ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: "api"}}},
+				},
+				{
+					Name:   "redirect",
+					Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+					Action: &routev3.Route_Redirect{Redirect: &routev3.RedirectAction{}},
+				},
+			},
+		}},
+	}
+}
+
+// adsServer serves a static cluster and an EDS cluster, then their endpoints
+// and the route configuration once asked. The first route configuration
+// has an invalid regular expression and is sent again fixed once refused.
+type adsServer struct {
+	discoveryv3.UnimplementedAggregatedDiscoveryServiceServer
+	// nacks receives the error details of the refused responses
+	nacks chan string
+}
+
+func (s *adsServer) StreamAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	send := func(typeURL, version string, resources ...proto.Message) error {
+		resp := &discoveryv3.DiscoveryResponse{TypeUrl: typeURL, VersionInfo: version, Nonce: version}
+		for _, resource := range resources {
+			a, err := anypb.New(resource)
+			if err != nil {
+				return err
+			}
+			resp.Resources = append(resp.Resources, a)
+		}
+		return stream.Send(resp)
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if req.GetErrorDetail() != nil {
+			s.nacks <- req.GetErrorDetail().GetMessage()
+			if err := send(routeType, "2", routeConfig("/v1/")); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.GetResponseNonce() != "" {
+			// An ACK
+			continue
+		}
+		switch req.GetTypeUrl() {
+		case clusterType:
+			err = send(clusterType, "1",
+				&clusterv3.Cluster{
+					Name:                 "static",
+					ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STATIC},
+					LoadAssignment: &endpointv3.ClusterLoadAssignment{ClusterName: "static", Endpoints: []*endpointv3.LocalityLbEndpoints{{
+						LbEndpoints: []*endpointv3.LbEndpoint{
+							lbEndpoint("10.0.0.1", 80, corev3.HealthStatus_HEALTHY),
+							lbEndpoint("10.0.0.2", 80, corev3.HealthStatus_UNHEALTHY),
+						},
+					}}},
+				},
+				&clusterv3.Cluster{
+					Name:                 "api",
+					ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+					EdsClusterConfig:     &clusterv3.Cluster_EdsClusterConfig{ServiceName: "api-eds"},
+				},
+			)
+		case endpointType:
+			if !reflect.DeepEqual(req.GetResourceNames(), []string{"api-eds"}) {
+				s.nacks <- "unexpected endpoint subscription"
+			}
+			err = send(endpointType, "1", &endpointv3.ClusterLoadAssignment{ClusterName: "api-eds", Endpoints: []*endpointv3.LocalityLbEndpoints{{
+				LbEndpoints: []*endpointv3.LbEndpoint{lbEndpoint("10.0.1.1", 8080, corev3.HealthStatus_UNKNOWN)},
+			}}})
+		case routeType:
+			err = send(routeType, "1", &routev3.RouteConfiguration{
+				Name: "main",
+				VirtualHosts: []*routev3.VirtualHost{{Name: "api", Domains: []string{"*"}, Routes: []*routev3.Route{{
+					Name:   "bad",
+					Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_SafeRegex{SafeRegex: &matcherv3.RegexMatcher{Regex: "["}}},
+					Action: &routev3.Route_Route{Route: &routev3.RouteAction{ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: "api"}}},
+				}}}},
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestXDS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	ads := &adsServer{nacks: make(chan string, 10)}
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(server, ads)
+	go server.Serve(l)
+	defer server.Stop()
+
+	x := NewXDS(l.Addr().String(), "main")
+	if _, err := x.Discover(context.Background()); err == nil {
+		t.Error("nodes were discovered before any were received")
+	}
+	routes := make(chan []Route, 10)
+	x.OnRoutes(func(r []Route) { routes <- r })
+	updates := make(chan []Node, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- x.Watch(ctx, func(nodes []Node) { updates <- nodes }) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch returned %v once cancelled", err)
+		}
+	}()
+
+	// The pool is updated once the endpoints of the EDS cluster arrive
+	expectedNodes := []Node{
+		{NodeID: "api/10.0.1.1:8080", Address: "10.0.1.1:8080", Group: "api"},
+		{NodeID: "static/10.0.0.1:80", Address: "10.0.0.1:80", Group: "static"},
+	}
+	select {
+	case nodes := <-updates:
+		if !reflect.DeepEqual(nodes, expectedNodes) {
+			t.Errorf("got nodes %+v, expected %+v", nodes, expectedNodes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no nodes were received")
+	}
+	if nodes, err := x.Discover(context.Background()); err != nil || !reflect.DeepEqual(nodes, expectedNodes) {
+		t.Errorf("discovered %+v, %v, expected the nodes of the update", nodes, err)
+	}
+
+	select {
+	case nack := <-ads.nacks:
+		if nack == "unexpected endpoint subscription" {
+			t.Fatal(nack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the invalid route configuration was not refused")
+	}
+	expectedRoutes := []Route{{Name: "api/v1", Match: `(host =~ "(?i)^api\\.example\\.com$") && (path_prefix("/v1/"))`, Group: "api"}}
+	select {
+	case r := <-routes:
+		if !reflect.DeepEqual(r, expectedRoutes) {
+			t.Errorf("got routes %+v, expected %+v", r, expectedRoutes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no routes were received")
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		match    *routev3.RouteMatch
+		expected string
+	}{
+		{name: "any path", match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}}, expected: "true"},
+		{name: "path", match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Path{Path: "/health"}}, expected: `path == "/health"`},
+		{
+			name:     "case insensitive prefix",
+			match:    &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/v1/"}, CaseSensitive: wrapperspb.Bool(false)},
+			expected: `path =~ "(?i)^/v1/"`,
+		},
+		{
+			name:     "separated prefix",
+			match:    &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: "/api"}},
+			expected: `path =~ "^/api(?:/|$)"`,
+		},
+		{
+			name: "headers",
+			match: &routev3.RouteMatch{
+				PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+				Headers: []*routev3.HeaderMatcher{
+					{Name: ":method", HeaderMatchSpecifier: &routev3.HeaderMatcher_ExactMatch{ExactMatch: "GET"}},
+					{Name: "x-debug", HeaderMatchSpecifier: &routev3.HeaderMatcher_PresentMatch{PresentMatch: false}},
+					{Name: "x-region", HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{
+						MatchPattern: &matcherv3.StringMatcher_Prefix{Prefix: "eu-"},
+						IgnoreCase:   true,
+					}}, InvertMatch: true},
+				},
+			},
+			expected: `(method == "GET") && (!has_header("x-debug")) && (!(header("x-region") =~ "(?i)^eu-"))`,
+		},
+		{
+			name: "query parameters",
+			match: &routev3.RouteMatch{
+				PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+				QueryParameters: []*routev3.QueryParameterMatcher{
+					{Name: "debug", QueryParameterMatchSpecifier: &routev3.QueryParameterMatcher_PresentMatch{PresentMatch: true}},
+					{Name: "v", QueryParameterMatchSpecifier: &routev3.QueryParameterMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{
+						MatchPattern: &matcherv3.StringMatcher_Exact{Exact: "2"},
+					}}},
+				},
+			},
+			expected: `(has_query("debug")) && (query("v") =~ "^2$")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := routeMatch(tt.match)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDomainsMatch(t *testing.T) {
+	tests := []struct {
+		domains  []string
+		expected string
+	}{
+		{domains: []string{"*"}, expected: ""},
+		{domains: []string{"api.example.com:443"}, expected: `host =~ "(?i)^api\\.example\\.com$"`},
+		{domains: []string{"*.example.com", "api.*"}, expected: `(host =~ "(?i)\\.example\\.com$") || (host =~ "(?i)^api\\.")`},
+	}
+	for _, tt := range tests {
+		if got := domainsMatch(tt.domains); got != tt.expected {
+			t.Errorf("domainsMatch(%q) = %s, expected %s", tt.domains, got, tt.expected)
+		}
+	}
+}
+
+func TestRouteCluster(t *testing.T) {
+	weighted := &routev3.RouteAction{ClusterSpecifier: &routev3.RouteAction_WeightedClusters{WeightedClusters: &routev3.WeightedCluster{
+		Clusters: []*routev3.WeightedCluster_ClusterWeight{
+			{Name: "stable", Weight: wrapperspb.UInt32(90)},
+			{Name: "canary", Weight: wrapperspb.UInt32(10)},
+		},
+	}}}
+	if got := routeCluster(weighted); got != "stable" {
+		t.Errorf("got cluster %q, expected the heaviest", got)
+	}
+}
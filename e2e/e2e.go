@@ -0,0 +1,505 @@
+// Package e2e runs the whole balancer in-process against ephemeral backends
+// and drives concurrent traffic through it, from the HTTP listener through
+// selection, the store and the proxy to the nodes and back, checking what
+// only shows end to end: that traffic is spread fairly, that node limits
+// hold under concurrent requests, that requests fail over when a node dies
+// and that shutdown lets the requests in flight finish.
+//
+// Every check sets up a Harness of its own: Backends httptest servers
+// registered as nodes of a fresh store, a memory store unless Config.NewStore
+// says otherwise, and a lb.LoadBalancer serving them on a loopback port.
+// Harness can also be used directly, e.g. by the tests of programs
+// embedding the balancer.
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/api"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/lb"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Checks run by RunAll, in order
+const (
+	CheckFairness = "fairness"
+	CheckLimits   = "limits"
+	CheckFailover = "failover"
+	CheckShutdown = "shutdown"
+)
+
+// Checks lists every check in the order RunAll runs them
+var Checks = []string{CheckFairness, CheckLimits, CheckFailover, CheckShutdown}
+
+// unlimitedRPM is the per-minute limit of the nodes of the checks that
+// are not about limits, high enough never to be reached
+const unlimitedRPM = 1_000_000
+
+// Config struct represents the pool and the traffic of the checks. Zero
+// fields take the defaults of DefaultConfig.
+type Config struct {
+	// Backends is how many nodes the pool has
+	Backends int
+	// Requests is how many requests the fairness and failover checks send
+	Requests int
+	// Concurrency is how many requests are in flight at once
+	Concurrency int
+	// RPM is the per-minute limit of each node in the limits check
+	RPM int
+	// Tolerance is how far, as a fraction of its fair share, a node's share
+	// of the traffic may be off in the fairness check
+	Tolerance float64
+	// Delay is how long the backends take to answer in the shutdown check
+	Delay time.Duration
+	// NewStore returns the empty store of a check, a MemoryStore when nil.
+	// Node IDs are unique to every harness, so checks may share a database.
+	NewStore func(ctx context.Context) (store.Store, error)
+}
+
+// DefaultConfig returns the configuration of lb e2e without flags
+func DefaultConfig() Config {
+	return Config{Backends: 3, Requests: 600, Concurrency: 20, RPM: 10, Tolerance: 0.3, Delay: 200 * time.Millisecond}
+}
+
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.Backends <= 0 {
+		c.Backends = defaults.Backends
+	}
+	if c.Requests <= 0 {
+		c.Requests = defaults.Requests
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaults.Concurrency
+	}
+	if c.RPM <= 0 {
+		c.RPM = defaults.RPM
+	}
+	if c.Tolerance <= 0 {
+		c.Tolerance = defaults.Tolerance
+	}
+	if c.Delay <= 0 {
+		c.Delay = defaults.Delay
+	}
+	return c
+}
+
+// Result struct represents the outcome of a check
+type Result struct {
+	Check string
+	// Failures describe what did not go as expected
+	Failures []string
+	// Err is set when the check could not be run, e.g. when its store could
+	// not be opened
+	Err     error
+	Elapsed time.Duration
+}
+
+// Passed reports whether everything went as expected
+func (r Result) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+func (r *Result) failf(format string, args ...any) {
+	r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+}
+
+// RunAll runs every check of Checks one after the other
+func RunAll(ctx context.Context, config Config) []Result {
+	results := make([]Result, 0, len(Checks))
+	for _, check := range Checks {
+		results = append(results, Run(ctx, config, check))
+	}
+	return results
+}
+
+// Run runs one check of Checks
+func Run(ctx context.Context, config Config, check string) Result {
+	config = config.withDefaults()
+	result := Result{Check: check}
+	run := map[string]func(context.Context, Config, *Result) error{
+		CheckFairness: checkFairness,
+		CheckLimits:   checkLimits,
+		CheckFailover: checkFailover,
+		CheckShutdown: checkShutdown,
+	}[check]
+	if run == nil {
+		result.Err = fmt.Errorf("unknown check %q, expected one of %s", check, strings.Join(Checks, ", "))
+		return result
+	}
+	started := time.Now()
+	result.Err = run(ctx, config, &result)
+	result.Elapsed = time.Since(started)
+	return result
+}
+
+// checkFairness sends Requests requests to a pool without limits in reach
+// and expects each node to serve its share of them, within Tolerance
+func checkFairness(ctx context.Context, config Config, result *Result) error {
+	h, err := NewHarness(ctx, config, CheckFairness, unlimitedRPM)
+	if err != nil {
+		return err
+	}
+	defer h.Close(ctx)
+
+	responses := h.SendConcurrently(ctx, config.Requests, config.Concurrency)
+	for status, n := range countStatuses(responses) {
+		if status != http.StatusOK {
+			result.failf("%d requests answered %s, expected 200", n, statusText(status))
+		}
+	}
+	fair := float64(config.Requests) / float64(config.Backends)
+	for _, b := range h.backends {
+		served := b.served.Load()
+		if math.Abs(float64(served)-fair) > fair*config.Tolerance {
+			result.failf("node %s served %d requests, expected %.0f ± %.0f%%", b.id, served, fair, config.Tolerance*100)
+		}
+	}
+	for _, r := range responses {
+		if r.Status == http.StatusOK && r.Node != r.Backend {
+			result.failf("a request served by %s named %s in X-Served-By", r.Backend, r.Node)
+			break
+		}
+	}
+	return nil
+}
+
+// checkLimits sends half as many requests again as the pool may serve in a
+// minute, all at once, and expects the pool to serve exactly its limits and
+// refuse the rest with 429 and a reject reason
+func checkLimits(ctx context.Context, config Config, result *Result) error {
+	h, err := NewHarness(ctx, config, CheckLimits, config.RPM)
+	if err != nil {
+		return err
+	}
+	defer h.Close(ctx)
+
+	capacity := config.Backends * config.RPM
+	responses := h.SendConcurrently(ctx, capacity+max(capacity/2, 1), config.Concurrency)
+	statuses := countStatuses(responses)
+	if statuses[http.StatusOK] != capacity {
+		result.failf("%d requests served, expected the pool's %d per minute", statuses[http.StatusOK], capacity)
+	}
+	for status, n := range statuses {
+		if status != http.StatusOK && status != http.StatusTooManyRequests {
+			result.failf("%d requests answered %s, expected 200 or 429", n, statusText(status))
+		}
+	}
+	for _, r := range responses {
+		if r.Status == http.StatusTooManyRequests && r.RejectReason == "" {
+			result.failf("a refused request has no X-Reject-Reason")
+			break
+		}
+	}
+	for _, b := range h.backends {
+		if served := b.served.Load(); served > int64(config.RPM) {
+			result.failf("node %s served %d requests over its limit of %d per minute", b.id, served, config.RPM)
+		}
+	}
+	return nil
+}
+
+// checkFailover sends half of Requests, stops a node and sends the other
+// half, expecting every request to be served, by the nodes still up once
+// the node is stopped
+func checkFailover(ctx context.Context, config Config, result *Result) error {
+	if config.Backends < 2 {
+		return errors.New("failover needs at least 2 backends")
+	}
+	h, err := NewHarness(ctx, config, CheckFailover, unlimitedRPM)
+	if err != nil {
+		return err
+	}
+	defer h.Close(ctx)
+
+	before := h.SendConcurrently(ctx, config.Requests/2, config.Concurrency)
+	stopped := h.backends[0]
+	h.StopBackend(0)
+	servedBefore := stopped.served.Load()
+	after := h.SendConcurrently(ctx, config.Requests-config.Requests/2, config.Concurrency)
+
+	for status, n := range countStatuses(append(before, after...)) {
+		if status != http.StatusOK {
+			result.failf("%d requests answered %s, expected 200", n, statusText(status))
+		}
+	}
+	if served := stopped.served.Load() - servedBefore; served > 0 {
+		result.failf("stopped node %s served %d requests", stopped.id, served)
+	}
+	for _, r := range after {
+		if r.Node == stopped.id {
+			result.failf("a request sent after %s stopped names it in X-Served-By", stopped.id)
+			break
+		}
+	}
+	return nil
+}
+
+// checkShutdown starts Concurrency requests the backends take Delay to
+// answer, shuts the balancer down while they are in flight, and expects
+// every one of them to be answered and new requests to be refused
+func checkShutdown(ctx context.Context, config Config, result *Result) error {
+	h, err := NewHarness(ctx, config, CheckShutdown, unlimitedRPM)
+	if err != nil {
+		return err
+	}
+	defer h.Close(ctx)
+	for _, b := range h.backends {
+		b.delay = config.Delay
+	}
+
+	done := make(chan []Response)
+	go func() { done <- h.SendConcurrently(ctx, config.Concurrency, config.Concurrency) }()
+	if !h.waitInFlight(ctx, config.Concurrency, config.Delay+5*time.Second) {
+		result.failf("only %d of %d requests reached the backends", h.inFlight(), config.Concurrency)
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, config.Delay+10*time.Second)
+	defer cancel()
+	if err := h.Shutdown(shutdownCtx); err != nil {
+		result.failf("shutdown: %v", err)
+	}
+
+	for status, n := range countStatuses(<-done) {
+		if status != http.StatusOK {
+			result.failf("%d requests in flight at shutdown answered %s, expected 200", n, statusText(status))
+		}
+	}
+	if r := h.Send(ctx); r.Err == "" {
+		result.failf("a request after shutdown was answered %d, expected the connection to be refused", r.Status)
+	}
+	return nil
+}
+
+// Harness struct represents a balancer serving a pool of in-process
+// backends, one node each
+type Harness struct {
+	// URL is where the balancer serves, e.g. http://127.0.0.1:41234
+	URL      string
+	lb       *lb.LoadBalancer
+	store    store.Store
+	backends []*backend
+	client   *http.Client
+	shutdown bool
+}
+
+// backend struct represents a node of the pool and what it served
+type backend struct {
+	id       string
+	server   *httptest.Server
+	delay    time.Duration
+	served   atomic.Int64
+	inFlight atomic.Int64
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	io.Copy(io.Discard, r.Body)
+	if b.delay > 0 {
+		time.Sleep(b.delay)
+	}
+	b.served.Add(1)
+	w.Header().Set(backendHeader, b.id)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"backend":%q}`, b.id)
+}
+
+// backendHeader names the backend that answered, as seen by the backend
+// rather than by the balancer
+const backendHeader = "X-E2E-Backend"
+
+// NewHarness starts config.Backends backends allowing rpm requests per
+// minute each, and no bytes limit, saves them to a fresh store as nodes
+// named after name, and starts a balancer serving them on a loopback port.
+// Failed requests are retried on the other nodes. Close stops it all.
+func NewHarness(ctx context.Context, config Config, name string, rpm int) (*Harness, error) {
+	config = config.withDefaults()
+	var backendStore store.Store = store.NewMemoryStore()
+	if config.NewStore != nil {
+		var err error
+		if backendStore, err = config.NewStore(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	h := &Harness{store: backendStore, client: &http.Client{Timeout: 30 * time.Second}}
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	nodes := make([]store.NodeLimits, config.Backends)
+	for i := range nodes {
+		b := &backend{id: fmt.Sprintf("%s-%s-%d", name, run, i+1)}
+		b.server = httptest.NewServer(b)
+		h.backends = append(h.backends, b)
+		// A limit expression leaves out the BPM window of RPMLimit and
+		// BPMLimit, which a zero BPMLimit would close
+		nodes[i] = store.NodeLimits{NodeID: b.id, Address: b.server.URL, Limits: fmt.Sprintf("%d req/min", rpm)}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.closeBackends(ctx)
+		return nil, err
+	}
+	apiConfig := api.Config{
+		ServedBy: true,
+		Retry:    balancer.RetryPolicy{Attempts: config.Backends - 1, On: balancer.DefaultRetryOn},
+	}
+	if h.lb, err = lb.NewLoadBalancer(lb.WithStore(backendStore), lb.WithNodes(nodes...), lb.WithListener(listener), lb.WithConfig(apiConfig)); err != nil {
+		listener.Close()
+		h.closeBackends(ctx)
+		return nil, err
+	}
+	if err := h.lb.Start(ctx); err != nil {
+		listener.Close()
+		h.closeBackends(ctx)
+		return nil, err
+	}
+	h.URL = "http://" + h.lb.Addr().String()
+	return h, nil
+}
+
+// Balancer returns the balancer under test
+func (h *Harness) Balancer() *lb.LoadBalancer {
+	return h.lb
+}
+
+// Response struct represents how a request sent through the balancer went
+type Response struct {
+	Status int
+	// Node is the node the balancer says served the request, Backend the
+	// backend that did
+	Node         string
+	Backend      string
+	RejectReason string
+	// Err is set when the request got no response
+	Err string
+}
+
+// Send sends a request to POST /request
+func (h *Harness) Send(ctx context.Context) Response {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL+"/request", strings.NewReader(`{"bpm":1}`))
+	if err != nil {
+		return Response{Err: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return Response{Err: err.Error()}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return Response{
+		Status:       resp.StatusCode,
+		Node:         resp.Header.Get("X-Served-By"),
+		Backend:      resp.Header.Get(backendHeader),
+		RejectReason: resp.Header.Get("X-Reject-Reason"),
+	}
+}
+
+// SendConcurrently sends n requests, concurrency of them at a time, and
+// returns their responses in the order they were sent
+func (h *Harness) SendConcurrently(ctx context.Context, n, concurrency int) []Response {
+	responses := make([]Response, n)
+	slots := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i := range responses {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			responses[i] = h.Send(ctx)
+		})
+	}
+	wg.Wait()
+	return responses
+}
+
+// StopBackend stops the backend of node i, refusing its connections from
+// then on, while the balancer still has it in its pool
+func (h *Harness) StopBackend(i int) {
+	h.backends[i].server.Close()
+}
+
+// inFlight returns how many requests the backends are answering
+func (h *Harness) inFlight() int {
+	n := 0
+	for _, b := range h.backends {
+		n += int(b.inFlight.Load())
+	}
+	return n
+}
+
+// waitInFlight waits until the backends answer n requests at once, or
+// timeout passes
+func (h *Harness) waitInFlight(ctx context.Context, n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for h.inFlight() < n {
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Shutdown shuts the balancer down as Close does, waiting for the requests
+// in flight until ctx is done, but keeps the backends up
+func (h *Harness) Shutdown(ctx context.Context) error {
+	if h.shutdown {
+		return nil
+	}
+	h.shutdown = true
+	return h.lb.Shutdown(ctx)
+}
+
+// Close shuts the balancer down, stops the backends, removes their nodes
+// from the store and closes it, such as the connection of a MongoStore
+func (h *Harness) Close(ctx context.Context) error {
+	err := h.Shutdown(ctx)
+	h.closeBackends(ctx)
+	if closer, ok := h.store.(interface{ Close(context.Context) error }); ok {
+		if closeErr := closer.Close(ctx); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (h *Harness) closeBackends(ctx context.Context) {
+	for _, b := range h.backends {
+		b.server.Close()
+		// A node left behind would join the pools of the next harnesses
+		// sharing the store, and be failed over
+		if _, err := h.store.DeleteNodeLimits(ctx, b.id); err != nil {
+			log.Printf("removing node %s: %v", b.id, err)
+		}
+	}
+}
+
+// countStatuses counts responses by status, zero for those without one
+func countStatuses(responses []Response) map[int]int {
+	counts := map[int]int{}
+	for _, r := range responses {
+		counts[r.Status]++
+	}
+	return counts
+}
+
+func statusText(status int) string {
+	if status == 0 {
+		return "nothing"
+	}
+	return strconv.Itoa(status)
+}
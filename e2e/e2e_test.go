@@ -0,0 +1,51 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChecks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("end-to-end checks take a few seconds")
+	}
+	config := Config{Requests: 300, Delay: 100 * time.Millisecond}
+	for _, check := range Checks {
+		t.Run(check, func(t *testing.T) {
+			result := Run(context.Background(), config, check)
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			for _, failure := range result.Failures {
+				t.Error(failure)
+			}
+		})
+	}
+}
+
+func TestHarnessServesEveryBackend(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewHarness(ctx, Config{Backends: 2}, "harness", unlimitedRPM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(ctx)
+
+	served := map[string]int{}
+	for _, r := range h.SendConcurrently(ctx, 100, 10) {
+		if r.Status != 200 || r.Node == "" || r.Node != r.Backend {
+			t.Fatalf("got %+v, expected 200 served and named by the same node", r)
+		}
+		served[r.Node]++
+	}
+	if len(served) != 2 {
+		t.Errorf("served by %v, expected both backends", served)
+	}
+}
+
+func TestUnknownCheck(t *testing.T) {
+	if result := Run(context.Background(), Config{}, "nope"); result.Err == nil {
+		t.Error("expected an error for an unknown check")
+	}
+}
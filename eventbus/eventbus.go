@@ -0,0 +1,187 @@
+// Package eventbus publishes what happens to the balancer, such as nodes
+// failing their health checks or the pool being reloaded, to webhooks, a
+// Kafka topic and subscribers of the admin API, so other systems can react.
+package eventbus
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Types of events
+const (
+	// NodeUnhealthy means a node failed its health check and left selection
+	NodeUnhealthy = "node_unhealthy"
+	// NodeHealthy means a node passes its health check again
+	NodeHealthy = "node_healthy"
+	// NodeEjected means outlier detection opened the circuit of a node,
+	// taking it out of selection for a while
+	NodeEjected = "node_ejected"
+	// NodeRestored means the ejection of a node ended
+	NodeRestored = "node_restored"
+	// RateLimitSaturated means requests were refused because nodes, an
+	// operation or the global limits were at their limit
+	RateLimitSaturated = "rate_limit_saturated"
+	// ConfigReloaded means the node pool changed
+	ConfigReloaded = "config_reloaded"
+	// RejectDigest sums up the requests of a client refused the day before,
+	// so it can be told about them
+	RejectDigest = "reject_digest"
+	// DegradationChanged means the balancer moved to another degradation
+	// level, on its own or through the admin API
+	DegradationChanged = "degradation_changed"
+	// BlueGreenSwitched means a blue/green route switched its live pool, or
+	// started or called off a switch through the admin API
+	BlueGreenSwitched = "blue_green_switched"
+	// StandbyActivated means too few primary nodes are up and the standby
+	// nodes took over, and StandbyDeactivated that the primary recovered
+	StandbyActivated   = "standby_activated"
+	StandbyDeactivated = "standby_deactivated"
+)
+
+// Event struct represents something that happened to the balancer
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+	// Reason is why it happened, e.g. the failed probe or the limit reached
+	Reason  string         `json:"reason,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Sink delivers events to an external system
+type Sink interface {
+	// Name identifies the sink in logs and metrics, e.g. webhook or kafka
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// sinkQueue feeds one sink, so a slow sink holds up no other
+type sinkQueue struct {
+	sink   Sink
+	events chan Event
+}
+
+// Options struct represents how events are queued and throttled
+type Options struct {
+	// Buffer is how many events may wait for each sink and subscriber;
+	// events beyond it are dropped
+	Buffer int
+	// Timeout bounds every delivery to a sink
+	Timeout time.Duration
+	// Quiet is how long an event of the same type, node and reason is not
+	// published again after RateLimitSaturated events, which would otherwise
+	// come with every refused request
+	Quiet time.Duration
+}
+
+// Bus hands events to the sinks and subscribers. Publishing never blocks.
+type Bus struct {
+	options Options
+	sinks   []sinkQueue
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	// published holds when throttled events were last published
+	published map[string]time.Time
+}
+
+// New returns a bus delivering events to sinks in the background
+func New(options Options, sinks ...Sink) *Bus {
+	b := &Bus{options: options, subscribers: map[chan Event]struct{}{}, published: map[string]time.Time{}}
+	for _, sink := range sinks {
+		q := sinkQueue{sink: sink, events: make(chan Event, options.Buffer)}
+		b.sinks = append(b.sinks, q)
+		b.wg.Add(1)
+		go b.deliver(q)
+	}
+	return b
+}
+
+func (b *Bus) deliver(q sinkQueue) {
+	defer b.wg.Done()
+	for event := range q.events {
+		ctx, cancel := context.WithTimeout(context.Background(), b.options.Timeout)
+		err := q.sink.Send(ctx, event)
+		cancel()
+		if err != nil {
+			metrics.EventsDelivered.WithLabelValues(q.sink.Name(), "error").Inc()
+			log.Printf("delivering %s event to %s: %v", event.Type, q.sink.Name(), err)
+			continue
+		}
+		metrics.EventsDelivered.WithLabelValues(q.sink.Name(), "ok").Inc()
+	}
+}
+
+// Publish hands event to the sinks and subscribers, dropping it for those
+// that fell behind. Publish is safe to call on a nil bus.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mu.Lock()
+	if event.Type == RateLimitSaturated {
+		key := event.Type + "\x00" + event.Node + "\x00" + event.Reason
+		if last, ok := b.published[key]; ok && event.Time.Sub(last) < b.options.Quiet {
+			b.mu.Unlock()
+			return
+		}
+		b.published[key] = event.Time
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			metrics.EventsDropped.WithLabelValues("subscriber").Inc()
+		}
+	}
+	b.mu.Unlock()
+
+	for _, q := range b.sinks {
+		select {
+		case q.events <- event:
+		default:
+			metrics.EventsDropped.WithLabelValues(q.sink.Name()).Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// and the function ending the subscription
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, b.options.Buffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Close delivers the queued events and stops the sinks. Nothing may be
+// published afterwards.
+func (b *Bus) Close() {
+	if b == nil {
+		return
+	}
+	for _, q := range b.sinks {
+		close(q.events)
+	}
+	b.wg.Wait()
+	for _, q := range b.sinks {
+		if closer, ok := q.sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
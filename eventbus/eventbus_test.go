@@ -0,0 +1,105 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder struct represents a sink keeping the events sent to it
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Name() string {
+	return "recorder"
+}
+
+func (r *recorder) Send(ctx context.Context, event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	var bus *Bus
+	bus.Publish(Event{Type: ConfigReloaded})
+	bus.Close()
+
+	sink := &recorder{}
+	bus = New(Options{Buffer: 10, Timeout: time.Second, Quiet: time.Minute}, sink)
+	events, unsubscribe := bus.Subscribe()
+	now := time.Now()
+	bus.Publish(Event{Type: NodeUnhealthy, Node: "node-1", Reason: "connection refused"})
+	// Saturation is published once per type, node and reason within Quiet
+	bus.Publish(Event{Type: RateLimitSaturated, Reason: "node_requests", Time: now})
+	bus.Publish(Event{Type: RateLimitSaturated, Reason: "node_requests", Time: now.Add(time.Second)})
+	bus.Publish(Event{Type: RateLimitSaturated, Reason: "global_limit", Time: now.Add(time.Second)})
+	bus.Publish(Event{Type: RateLimitSaturated, Reason: "node_requests", Time: now.Add(2 * time.Minute)})
+	unsubscribe()
+	bus.Publish(Event{Type: NodeHealthy, Node: "node-1"})
+	bus.Close()
+
+	var received []string
+	for len(events) > 0 {
+		event := <-events
+		if event.Time.IsZero() {
+			t.Errorf("got %+v without a time", event)
+		}
+		received = append(received, event.Type+"/"+event.Reason)
+	}
+	expected := []string{"node_unhealthy/connection refused", "rate_limit_saturated/node_requests", "rate_limit_saturated/global_limit", "rate_limit_saturated/node_requests"}
+	if len(received) != len(expected) {
+		t.Fatalf("subscriber got %v, expected %v", received, expected)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("subscriber got %v, expected %v", received, expected)
+			break
+		}
+	}
+	if len(sink.events) != len(expected)+1 || sink.events[len(sink.events)-1].Type != NodeHealthy {
+		t.Errorf("sink got %+v, expected every event delivered before Close returned", sink.events)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var calls atomic.Int32
+	var got Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer receiver.Close()
+
+	wh := NewWebhook(receiver.URL, nil)
+	if err := wh.Send(context.Background(), Event{Type: NodeEjected, Node: "node-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 || got.Type != NodeEjected || got.Node != "node-2" {
+		t.Errorf("got %+v after %d calls, expected the event retried once", got, calls.Load())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	calls.Store(0)
+	if err := NewWebhook(failing.URL, nil).Send(context.Background(), Event{Type: NodeEjected}); err == nil || calls.Load() != webhookAttempts {
+		t.Errorf("got %v after %d calls, expected giving up after %d", err, calls.Load(), webhookAttempts)
+	}
+}
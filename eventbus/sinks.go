@@ -0,0 +1,116 @@
+package eventbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+)
+
+// webhookAttempts is how many times a webhook is tried before the event is
+// given up on
+const webhookAttempts = 3
+
+// Webhook posts every event as JSON to a URL
+type Webhook struct {
+	url    string
+	signer *proxy.Signer
+	client *http.Client
+}
+
+// NewWebhook returns a sink posting events to url. When signer is set the
+// requests carry the X-LB-Signature header forwarded requests have, so the
+// receiver can tell them from forgeries.
+func NewWebhook(url string, signer *proxy.Signer) *Webhook {
+	return &Webhook{url: url, signer: signer, client: &http.Client{}}
+}
+
+// Name returns webhook
+func (wh *Webhook) Name() string {
+	return "webhook"
+}
+
+// Send posts event, retrying after network errors and 5xx answers until
+// ctx is done
+func (wh *Webhook) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = wh.post(ctx, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (wh *Webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.signer != nil {
+		wh.signer.Sign(req, body)
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", wh.url, resp.Status)
+	}
+	return nil
+}
+
+// Kafka writes every event as JSON to a Kafka topic, keyed by node so the
+// events of a node stay in order
+type Kafka struct {
+	writer *kafka.Writer
+}
+
+// NewKafka returns a sink writing events to topic on brokers
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+	}}
+}
+
+// Name returns kafka
+func (k *Kafka) Name() string {
+	return "kafka"
+}
+
+// Close flushes and closes the writer
+func (k *Kafka) Close() error {
+	return k.writer.Close()
+}
+
+// Send writes event to the topic
+func (k *Kafka) Send(ctx context.Context, event Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return k.writer.WriteMessages(ctx, kafka.Message{Key: []byte(event.Node), Value: value, Time: event.Time})
+}
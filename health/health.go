@@ -0,0 +1,282 @@
+// Package health probes backend nodes over TCP, HTTP, the gRPC health
+// protocol or an external command.
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// Defaults for the settings a health check leaves empty
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 2 * time.Second
+)
+
+// Probe struct represents a parsed health check
+type Probe struct {
+	check    store.HealthCheck
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// NewProbe validates a health check
+func NewProbe(check store.HealthCheck) (*Probe, error) {
+	p := &Probe{check: check, interval: DefaultInterval, timeout: DefaultTimeout}
+	var err error
+	if check.Interval != "" {
+		if p.interval, err = time.ParseDuration(check.Interval); err != nil || p.interval <= 0 {
+			return nil, fmt.Errorf("invalid health check interval %q", check.Interval)
+		}
+	}
+	if check.Timeout != "" {
+		if p.timeout, err = time.ParseDuration(check.Timeout); err != nil || p.timeout <= 0 {
+			return nil, fmt.Errorf("invalid health check timeout %q", check.Timeout)
+		}
+	}
+	switch check.Type {
+	case "tcp", "http", "grpc":
+	case "exec":
+		if len(check.Command) == 0 {
+			return nil, errors.New("exec health check needs a command")
+		}
+	default:
+		return nil, fmt.Errorf("unknown health check type %q, expected tcp, http, grpc or exec", check.Type)
+	}
+	return p, nil
+}
+
+// Interval returns how often the probe runs
+func (p *Probe) Interval() time.Duration {
+	return p.interval
+}
+
+// Rise returns how many consecutive successes make a failed node healthy
+func (p *Probe) Rise() int {
+	return max(1, p.check.Rise)
+}
+
+// Fall returns how many consecutive failures make a healthy node fail
+func (p *Probe) Fall() int {
+	return max(1, p.check.Fall)
+}
+
+// Run probes the node at address once, returning why it is unhealthy
+func (p *Probe) Run(ctx context.Context, address string) error {
+	if p.check.Address != "" {
+		address = p.check.Address
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	switch p.check.Type {
+	case "tcp":
+		return checkTCP(ctx, address)
+	case "http":
+		return checkHTTP(ctx, address, p.check)
+	case "grpc":
+		return checkGRPC(ctx, address, p.check.Service)
+	case "exec":
+		return checkExec(ctx, address, p.check.Command)
+	}
+	return fmt.Errorf("unknown health check type %q", p.check.Type)
+}
+
+// hostPort strips the scheme from an address such as http://host:port
+func hostPort(address string) string {
+	if _, rest, ok := strings.Cut(address, "://"); ok {
+		return strings.TrimSuffix(rest, "/")
+	}
+	return address
+}
+
+// unixSocket returns the socket path of a unix:// address
+func unixSocket(address string) (string, bool) {
+	return strings.CutPrefix(address, "unix://")
+}
+
+func baseURL(address string) string {
+	if _, ok := unixSocket(address); ok {
+		return "http://localhost"
+	}
+	if strings.Contains(address, "://") {
+		return strings.TrimSuffix(address, "/")
+	}
+	return "http://" + address
+}
+
+func checkTCP(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	network, addr := "tcp", hostPort(address)
+	if socket, ok := unixSocket(address); ok {
+		network, addr = "unix", socket
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkHTTP(ctx context.Context, address string, check store.HealthCheck) error {
+	path := check.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL(address)+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := clientFor(address, httpClient).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if check.ExpectStatus != 0 && resp.StatusCode != check.ExpectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, check.ExpectStatus)
+	}
+	if check.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if check.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, []byte(check.ExpectBody)) {
+			return fmt.Errorf("body does not contain %q", check.ExpectBody)
+		}
+	}
+	return nil
+}
+
+var httpClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// grpcClient speaks unencrypted HTTP/2 like the balancer's gRPC proxy
+var grpcClient = func() *http.Client {
+	transport := &http.Transport{}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}()
+
+// clientFor returns client, or for a unix:// address a client like it
+// sending its request to the address's socket over a connection of its own
+func clientFor(address string, client *http.Client) *http.Client {
+	socket, ok := unixSocket(address)
+	if !ok {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	unixTransport := transport.(*http.Transport).Clone()
+	unixTransport.Proxy = nil
+	unixTransport.DisableKeepAlives = true
+	unixTransport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	unixClient := *client
+	unixClient.Transport = unixTransport
+	return &unixClient
+}
+
+// grpcServing is the SERVING value of grpc.health.v1.HealthCheckResponse.ServingStatus
+const grpcServing = 1
+
+// checkGRPC calls grpc.health.v1.Health/Check. The protobuf messages are
+// small enough to encode by hand: the request holds the service name as
+// field 1, the response the serving status as field 1.
+func checkGRPC(ctx context.Context, address, service string) error {
+	message := []byte{}
+	if service != "" {
+		message = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		message = append(message, service...)
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL(address)+"/grpc.health.v1.Health/Check", bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := clientFor(address, grpcClient).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		// Trailers-only responses carry the status in the headers
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message")+resp.Header.Get("Grpc-Message"))
+	}
+
+	if len(body) < 5 {
+		return errors.New("empty health check response")
+	}
+	payload := body[5:]
+	servingStatus := uint64(0)
+	for len(payload) > 0 {
+		tag, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errors.New("malformed health check response")
+		}
+		payload = payload[n:]
+		if tag&7 != 0 {
+			return errors.New("malformed health check response")
+		}
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errors.New("malformed health check response")
+		}
+		payload = payload[n:]
+		if tag>>3 == 1 {
+			servingStatus = value
+		}
+	}
+	if servingStatus != grpcServing {
+		return fmt.Errorf("serving status %d", servingStatus)
+	}
+	return nil
+}
+
+func checkExec(ctx context.Context, address string, command []string) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "NODE_ADDRESS="+address)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestNewProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		check store.HealthCheck
+		valid bool
+	}{
+		{name: "tcp", check: store.HealthCheck{Type: "tcp"}, valid: true},
+		{name: "http", check: store.HealthCheck{Type: "http", Interval: "5s", Timeout: "1s"}, valid: true},
+		{name: "exec", check: store.HealthCheck{Type: "exec", Command: []string{"true"}}, valid: true},
+		{name: "exec without command", check: store.HealthCheck{Type: "exec"}},
+		{name: "unknown type", check: store.HealthCheck{Type: "icmp"}},
+		{name: "bad interval", check: store.HealthCheck{Type: "tcp", Interval: "often"}},
+		{name: "zero timeout", check: store.HealthCheck{Type: "tcp", Timeout: "0s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProbe(tt.check); (err == nil) != tt.valid {
+				t.Errorf("got %v, expected valid to be %v", err, tt.valid)
+			}
+		})
+	}
+
+	probe, err := NewProbe(store.HealthCheck{Type: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Interval() != DefaultInterval || probe.Rise() != 1 || probe.Fall() != 1 {
+		t.Errorf("got an interval of %v, rise %d and fall %d, expected the defaults", probe.Interval(), probe.Rise(), probe.Fall())
+	}
+}
+
+// run probes address with check, failing the test on an invalid check
+func run(t *testing.T, check store.HealthCheck, address string) error {
+	t.Helper()
+	probe, err := NewProbe(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return probe.Run(context.Background(), address)
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if err := run(t, store.HealthCheck{Type: "tcp"}, "http://"+address); err != nil {
+		t.Errorf("got %v probing a listening node", err)
+	}
+	listener.Close()
+	if err := run(t, store.HealthCheck{Type: "tcp"}, address); err == nil {
+		t.Error("a closed port passed")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status":"ok"}`))
+		case "/moved":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name  string
+		check store.HealthCheck
+		err   string
+	}{
+		{name: "healthy", check: store.HealthCheck{Type: "http", Path: "healthz"}},
+		{name: "body", check: store.HealthCheck{Type: "http", Path: "/healthz", ExpectBody: `"ok"`}},
+		{name: "wrong body", check: store.HealthCheck{Type: "http", Path: "/healthz", ExpectBody: "ready"}, err: `body does not contain "ready"`},
+		{name: "not found", check: store.HealthCheck{Type: "http", Path: "/missing"}, err: "status 404"},
+		{name: "redirects not followed", check: store.HealthCheck{Type: "http", Path: "/moved"}, err: "status 302"},
+		{name: "expected status", check: store.HealthCheck{Type: "http", Path: "/moved", ExpectStatus: http.StatusFound}},
+		{name: "address override", check: store.HealthCheck{Type: "http", Path: "/healthz", Address: backend.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := backend.URL
+			if tt.check.Address != "" {
+				address = "127.0.0.1:1"
+			}
+			err := run(t, tt.check, address)
+			if tt.err == "" && err != nil {
+				t.Errorf("got %v, expected the node healthy", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are short, so not under t.TempDir
+	dir, err := os.MkdirTemp("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "node.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	})}
+	go node.Serve(listener)
+	defer node.Close()
+
+	address := "unix://" + socket
+	for _, check := range []store.HealthCheck{{Type: "tcp"}, {Type: "http", Path: "/healthz"}} {
+		if err := run(t, check, address); err != nil {
+			t.Errorf("got %v probing the socket with %s, expected the node healthy", err, check.Type)
+		}
+	}
+	if err := run(t, store.HealthCheck{Type: "http", Path: "/missing"}, address); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("got %v, expected status 404", err)
+	}
+	if err := run(t, store.HealthCheck{Type: "tcp"}, "unix://"+filepath.Join(dir, "missing.sock")); err == nil {
+		t.Error("a missing socket passed")
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	var service string
+	var serving byte
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make([]byte, 64)
+		n, _ := r.Body.Read(body)
+		service = ""
+		if n > 7 {
+			service = string(body[7:n])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, serving})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	serving = grpcServing
+	if err := run(t, store.HealthCheck{Type: "grpc", Service: "orders"}, backend.URL); err != nil {
+		t.Fatalf("got %v, expected the node serving", err)
+	}
+	if service != "orders" {
+		t.Errorf("checked service %q, expected orders", service)
+	}
+	serving = 2
+	if err := run(t, store.HealthCheck{Type: "grpc"}, backend.URL); err == nil || err.Error() != "serving status 2" {
+		t.Errorf("got %v, expected the node not serving", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	if err := run(t, store.HealthCheck{Type: "exec", Command: []string{"sh", "-c", `test "$NODE_ADDRESS" = node:8080`}}, "node:8080"); err != nil {
+		t.Errorf("got %v, expected the command to see the node address", err)
+	}
+	err := run(t, store.HealthCheck{Type: "exec", Command: []string{"sh", "-c", "echo down; exit 1"}}, "node:8080")
+	if err == nil || !strings.HasSuffix(err.Error(), ": down") {
+		t.Errorf("got %v, expected the command's output", err)
+	}
+}
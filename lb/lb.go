@@ -0,0 +1,227 @@
+// Package lb embeds the balancer in other Go programs: the selection
+// engine, the proxy and the HTTP API of the lb command, served in-process
+package lb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/api"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// DefaultAddress is where the balancer listens without WithListener or
+// WithAddress, as the lb command does
+const DefaultAddress = ":8080"
+
+// LoadBalancer struct represents an embedded balancer, serving the API on
+// its listener between Start and Shutdown
+type LoadBalancer struct {
+	store     store.Store
+	nodes     []store.NodeLimits
+	strategy  balancer.Strategy
+	config    api.Config
+	transport proxy.TransportConfig
+	address   string
+
+	balancer *balancer.LoadBalancer
+	server   *api.Server
+
+	mu       sync.Mutex
+	listener net.Listener
+	http     *http.Server
+	// stop ends the background work started by Start
+	stop context.CancelFunc
+	// served is closed once the listener is no longer served, with the
+	// error it stopped on in serveErr
+	served   chan struct{}
+	serveErr error
+}
+
+// Option configures a LoadBalancer
+type Option func(*LoadBalancer) error
+
+// WithStore keeps node limits and request records in s instead of a
+// MemoryStore
+func WithStore(s store.Store) Option {
+	return func(lb *LoadBalancer) error {
+		if s == nil {
+			return errors.New("store is nil")
+		}
+		lb.store = s
+		return nil
+	}
+}
+
+// WithStrategy sets how a node is chosen among the available ones: random,
+// latency or cost, see balancer.ParseStrategy
+func WithStrategy(name string) Option {
+	return func(lb *LoadBalancer) error {
+		strategy, err := balancer.ParseStrategy(name)
+		if err != nil {
+			return err
+		}
+		lb.strategy = strategy
+		return nil
+	}
+}
+
+// WithNodes adds nodes to the pool. They are saved to the store on Start,
+// replacing the limits it has for the same nodes.
+func WithNodes(nodes ...store.NodeLimits) Option {
+	return func(lb *LoadBalancer) error {
+		for _, node := range nodes {
+			if node.NodeID == "" {
+				return errors.New("node without node_id")
+			}
+		}
+		lb.nodes = append(lb.nodes, nodes...)
+		return nil
+	}
+}
+
+// WithListener serves the API on l, such as a listener on 127.0.0.1:0 in
+// tests. Shutdown closes it.
+func WithListener(l net.Listener) Option {
+	return func(lb *LoadBalancer) error {
+		lb.listener = l
+		return nil
+	}
+}
+
+// WithAddress serves the API on a TCP listener at address, DefaultAddress
+// unless it is set
+func WithAddress(address string) Option {
+	return func(lb *LoadBalancer) error {
+		lb.address = address
+		return nil
+	}
+}
+
+// WithConfig sets the API configuration, such as the routes, client limits
+// and hooks, see api.Config
+func WithConfig(config api.Config) Option {
+	return func(lb *LoadBalancer) error {
+		lb.config = config
+		return nil
+	}
+}
+
+// WithTransport sets the connection pools the requests are forwarded with
+func WithTransport(config proxy.TransportConfig) Option {
+	return func(lb *LoadBalancer) error {
+		lb.transport = config
+		return nil
+	}
+}
+
+// NewLoadBalancer returns a balancer configured by opts. It keeps its state
+// in a MemoryStore and picks nodes at random unless told otherwise.
+func NewLoadBalancer(opts ...Option) (*LoadBalancer, error) {
+	lb := &LoadBalancer{strategy: balancer.StrategyRandom, address: DefaultAddress}
+	for _, opt := range opts {
+		if err := opt(lb); err != nil {
+			return nil, err
+		}
+	}
+	if lb.store == nil {
+		lb.store = store.NewMemoryStore()
+	}
+	lb.balancer = balancer.New(lb.store)
+	lb.balancer.SetStrategy(lb.strategy)
+	lb.server = api.NewServer(lb.balancer, proxy.NewPooled(lb.transport), lb.config)
+	return lb, nil
+}
+
+// Balancer returns the selection engine, to inspect or change the pool
+func (lb *LoadBalancer) Balancer() *balancer.LoadBalancer {
+	return lb.balancer
+}
+
+// Server returns the API server, to register hooks with before Start
+func (lb *LoadBalancer) Server() *api.Server {
+	return lb.server
+}
+
+// Addr returns the address the API is served on once started, such as the
+// port picked for a listener on port 0
+func (lb *LoadBalancer) Addr() net.Addr {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.listener == nil {
+		return nil
+	}
+	return lb.listener.Addr()
+}
+
+// Start saves the nodes of WithNodes, loads the pool from the store, starts
+// the health checks and outlier detection and serves the API in the
+// background until Shutdown. ctx bounds loading the pool only.
+func (lb *LoadBalancer) Start(ctx context.Context) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.http != nil {
+		return errors.New("balancer already started")
+	}
+	for _, node := range lb.nodes {
+		if err := lb.store.SaveNodeLimits(ctx, node); err != nil {
+			return err
+		}
+	}
+	if err := lb.balancer.LoadNodes(ctx); err != nil {
+		return err
+	}
+	if lb.listener == nil {
+		l, err := net.Listen("tcp", lb.address)
+		if err != nil {
+			return err
+		}
+		lb.listener = l
+	}
+
+	background, stop := context.WithCancel(context.Background())
+	go lb.balancer.RunHealthChecks(background)
+	go lb.balancer.RunOutlierDetection(background)
+	if lb.config.Degradation.Interval > 0 {
+		go lb.server.RunDegradation(background)
+	}
+	lb.stop = stop
+	lb.http = &http.Server{Handler: lb.server.Handler()}
+	lb.served = make(chan struct{})
+	go func() {
+		defer close(lb.served)
+		if err := lb.http.Serve(lb.listener); !errors.Is(err, http.ErrServerClosed) {
+			lb.serveErr = err
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops serving the API, waits for the requests in flight and the
+// background work they left behind until ctx is done, and stops the health
+// checks. It returns the error the listener failed with, if any.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.http == nil {
+		return errors.New("balancer not started")
+	}
+	err := lb.http.Shutdown(ctx)
+	lb.stop()
+	if closeErr := lb.server.Close(ctx); err == nil {
+		err = closeErr
+	}
+	select {
+	case <-lb.served:
+		if err == nil {
+			err = lb.serveErr
+		}
+	case <-ctx.Done():
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestNewLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{name: "nil store", opt: WithStore(nil)},
+		{name: "unknown strategy", opt: WithStrategy("fastest")},
+		{name: "node without id", opt: WithNodes(store.NodeLimits{Limits: "10 req/min"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLoadBalancer(tt.opt); err == nil {
+				t.Error("the option was accepted")
+			}
+		})
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	lb, err := NewLoadBalancer(
+		WithStore(s),
+		WithStrategy("latency"),
+		WithListener(l),
+		WithNodes(store.NodeLimits{NodeID: "node-1", Limits: "10 req/min"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := lb.Shutdown(ctx); err == nil {
+		t.Error("shut down a balancer that was not started")
+	}
+	if err := lb.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Start(ctx); err == nil {
+		t.Error("started the balancer twice")
+	}
+	if lb.Addr().String() != l.Addr().String() {
+		t.Errorf("got address %s, expected %s", lb.Addr(), l.Addr())
+	}
+
+	// The nodes are saved to the store and served from the listener
+	saved, err := s.NodeLimits(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved["node-1"]; !ok {
+		t.Error("node-1 was not saved to the store")
+	}
+	resp, err := http.Get("http://" + lb.Addr().String() + "/admin/nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes []store.NodeLimits
+	err = json.NewDecoder(resp.Body).Decode(&nodes)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].NodeID != "node-1" {
+		t.Errorf("got nodes %+v, expected node-1", nodes)
+	}
+	resp, err = http.Post("http://"+lb.Addr().String()+"/request", "application/json", strings.NewReader(`{"bpm": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := lb.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/admin/nodes"); err == nil {
+		t.Error("the API is still served after Shutdown")
+	}
+}
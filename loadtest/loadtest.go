@@ -0,0 +1,240 @@
+// Package loadtest sends synthetic traffic to a running balancer at a fixed
+// rate and reports how it was spread over the nodes and how long it took,
+// so the rate limiting math can be checked end to end: a pool of nodes at 60
+// requests per minute each should serve about one request per second per
+// node, and refuse the rest.
+//
+// The serving node is read from the X-Served-By header, so the balancer must
+// run with -served-by, and the reason of a refusal from X-Reject-Reason.
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config struct represents the traffic to send
+type Config struct {
+	// URL is where requests are sent, e.g. http://localhost:8080/request
+	URL    string
+	Method string
+	Header http.Header
+	// RPS is how many requests are started per second, whatever the
+	// latency of the previous ones
+	RPS float64
+	// Duration is how long requests are started for
+	Duration time.Duration
+	// Concurrency bounds the requests in flight; requests due while all are
+	// busy are skipped and counted in Report.Skipped, so a slow balancer
+	// shows up rather than silently lowering the rate
+	Concurrency int
+	// MinBodyBytes and MaxBodyBytes bound the size of the JSON bodies, each
+	// of a random size in between
+	MinBodyBytes int
+	MaxBodyBytes int
+	// BPM is the bpm field of the bodies, left out when zero
+	BPM int
+	// Timeout bounds every request
+	Timeout time.Duration
+}
+
+// Latency struct represents latency percentiles
+type Latency struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// percentiles returns the percentiles of durations, sorting them
+func percentiles(durations []time.Duration) Latency {
+	if len(durations) == 0 {
+		return Latency{}
+	}
+	slices.Sort(durations)
+	at := func(p float64) time.Duration {
+		return durations[min(len(durations)-1, int(p*float64(len(durations))))]
+	}
+	return Latency{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: durations[len(durations)-1]}
+}
+
+// NodeReport struct represents the requests a node served
+type NodeReport struct {
+	Node     string  `json:"node"`
+	Requests int     `json:"requests"`
+	Share    float64 `json:"share"`
+	// PerMinute is the node's rate over the run
+	PerMinute float64 `json:"per_minute"`
+	Latency   Latency `json:"latency"`
+}
+
+// Report struct represents the outcome of a run
+type Report struct {
+	Elapsed time.Duration `json:"elapsed"`
+	Sent    int           `json:"sent"`
+	// Skipped requests were due while Concurrency requests were in flight
+	Skipped int `json:"skipped"`
+	// Errors are requests that got no response, by error
+	Errors   map[string]int `json:"errors"`
+	ByStatus map[int]int    `json:"by_status"`
+	// Rejected counts the refused requests by reject reason
+	Rejected map[string]int `json:"rejected"`
+	// Nodes are the nodes that served requests, the busiest first
+	Nodes   []NodeReport `json:"nodes"`
+	Latency Latency      `json:"latency"`
+}
+
+// result is the outcome of one request
+type result struct {
+	node, reason, err string
+	status            int
+	latency           time.Duration
+}
+
+// Run sends the traffic of config until its duration is over or ctx is
+// done, and waits for the requests in flight
+func Run(ctx context.Context, config Config) (Report, error) {
+	if config.RPS <= 0 || config.Duration <= 0 || config.Concurrency < 1 {
+		return Report{}, fmt.Errorf("the rate and duration must be positive and the concurrency at least 1")
+	}
+	if config.MinBodyBytes < 0 || config.MaxBodyBytes < config.MinBodyBytes {
+		return Report{}, fmt.Errorf("body sizes must not be negative, the maximum at least the minimum")
+	}
+	client := &http.Client{Timeout: config.Timeout}
+	results := make(chan result, config.Concurrency)
+	slots := make(chan struct{}, config.Concurrency)
+	var wg sync.WaitGroup
+
+	var report Report
+	collected := make(chan struct{})
+	var all []time.Duration
+	byNode := map[string][]time.Duration{}
+	report.Errors, report.ByStatus, report.Rejected = map[string]int{}, map[int]int{}, map[string]int{}
+	go func() {
+		defer close(collected)
+		for res := range results {
+			if res.err != "" {
+				report.Errors[res.err]++
+				continue
+			}
+			report.ByStatus[res.status]++
+			all = append(all, res.latency)
+			if res.reason != "" {
+				report.Rejected[res.reason]++
+			}
+			if res.node != "" {
+				byNode[res.node] = append(byNode[res.node], res.latency)
+			}
+		}
+	}()
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.RPS))
+	defer ticker.Stop()
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			report.Skipped++
+			continue
+		}
+		report.Sent++
+		body := makeBody(config.BPM, config.MinBodyBytes+random.Intn(config.MaxBodyBytes-config.MinBodyBytes+1))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results <- send(client, config, body)
+		}()
+	}
+	wg.Wait()
+	close(results)
+	<-collected
+
+	report.Elapsed = time.Since(started)
+	report.Latency = percentiles(all)
+	for node, latencies := range byNode {
+		report.Nodes = append(report.Nodes, NodeReport{
+			Node:      node,
+			Requests:  len(latencies),
+			Share:     float64(len(latencies)) / float64(max(report.Sent, 1)),
+			PerMinute: float64(len(latencies)) / report.Elapsed.Minutes(),
+			Latency:   percentiles(latencies),
+		})
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		if report.Nodes[i].Requests != report.Nodes[j].Requests {
+			return report.Nodes[i].Requests > report.Nodes[j].Requests
+		}
+		return report.Nodes[i].Node < report.Nodes[j].Node
+	})
+	return report, nil
+}
+
+// makeBody returns a JSON body of size bytes, padded with a padding field,
+// or the smallest one carrying bpm when size is below it
+func makeBody(bpm, size int) []byte {
+	prefix := "{"
+	if bpm > 0 {
+		prefix = fmt.Sprintf(`{"bpm":%d,`, bpm)
+	}
+	padding := size - len(prefix) - len(`"padding":""}`)
+	if padding < 0 {
+		return []byte(strings.TrimSuffix(prefix, ",") + "}")
+	}
+	return []byte(prefix + `"padding":"` + strings.Repeat("x", padding) + `"}`)
+}
+
+func send(client *http.Client, config Config, body []byte) result {
+	req, err := http.NewRequest(config.Method, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return result{err: err.Error()}
+	}
+	for name, values := range config.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: errorKind(err)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{
+		node:    resp.Header.Get("X-Served-By"),
+		reason:  resp.Header.Get("X-Reject-Reason"),
+		status:  resp.StatusCode,
+		latency: time.Since(started),
+	}
+}
+
+// errorKind shortens the error of a request, so errors of the same kind are
+// counted together rather than per connection
+func errorKind(err error) string {
+	message := err.Error()
+	for _, kind := range []string{"Client.Timeout exceeded", "connection refused", "connection reset", "EOF"} {
+		if strings.Contains(message, kind) {
+			return kind
+		}
+	}
+	return message
+}
@@ -0,0 +1,122 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMakeBody(t *testing.T) {
+	tests := []struct {
+		bpm, size int
+		expected  string
+	}{
+		{bpm: 3, size: 30, expected: `{"bpm":3,"padding":"xxxxxxxx"}`},
+		{size: 16, expected: `{"padding":"xx"}`},
+		{bpm: 3, size: 5, expected: `{"bpm":3}`},
+		{size: 0, expected: `{}`},
+	}
+	for _, tt := range tests {
+		got := makeBody(tt.bpm, tt.size)
+		if string(got) != tt.expected {
+			t.Errorf("makeBody(%d, %d) = %s, expected %s", tt.bpm, tt.size, got, tt.expected)
+		}
+		if !json.Valid(got) {
+			t.Errorf("makeBody(%d, %d) is not JSON", tt.bpm, tt.size)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var durations []time.Duration
+	for i := 100; i > 0; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	expected := Latency{P50: 51 * time.Millisecond, P90: 91 * time.Millisecond, P99: 100 * time.Millisecond, Max: 100 * time.Millisecond}
+	if got := percentiles(durations); got != expected {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+	if got := percentiles(nil); got != (Latency{}) {
+		t.Errorf("got %+v without durations", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	// Every third request is refused, the others alternate between two nodes
+	var count atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["bpm"] != 2.0 || r.Header.Get("X-Client") != "loadtest" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		n := count.Add(1)
+		if n%3 == 0 {
+			w.Header().Set("X-Reject-Reason", "node_requests")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-Served-By", fmt.Sprintf("node-%d", n%3))
+	}))
+	defer server.Close()
+
+	report, err := Run(context.Background(), Config{
+		URL:          server.URL,
+		Method:       http.MethodPost,
+		Header:       http.Header{"X-Client": {"loadtest"}},
+		RPS:          200,
+		Duration:     300 * time.Millisecond,
+		Concurrency:  10,
+		MinBodyBytes: 20,
+		MaxBodyBytes: 100,
+		BPM:          2,
+		Timeout:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent == 0 || int64(report.Sent) != count.Load() {
+		t.Fatalf("sent %d requests, the balancer got %d", report.Sent, count.Load())
+	}
+	refused := report.Sent / 3
+	if report.ByStatus[http.StatusOK] != report.Sent-refused || report.ByStatus[http.StatusTooManyRequests] != refused {
+		t.Errorf("got statuses %v of %d requests", report.ByStatus, report.Sent)
+	}
+	if report.Rejected["node_requests"] != refused {
+		t.Errorf("got rejections %v, expected %d", report.Rejected, refused)
+	}
+	served := 0
+	for _, node := range report.Nodes {
+		served += node.Requests
+	}
+	if len(report.Nodes) != 2 || served != report.Sent-refused || report.Nodes[0].Requests < report.Nodes[1].Requests {
+		t.Errorf("got nodes %+v, expected node-1 and node-2 serving %d, the busiest first", report.Nodes, report.Sent-refused)
+	}
+	if report.Latency.Max == 0 || len(report.Errors) != 0 {
+		t.Errorf("got latency %+v and errors %v", report.Latency, report.Errors)
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no rate", config: Config{Duration: time.Second, Concurrency: 1}},
+		{name: "no duration", config: Config{RPS: 1, Concurrency: 1}},
+		{name: "no concurrency", config: Config{RPS: 1, Duration: time.Second}},
+		{name: "body sizes", config: Config{RPS: 1, Duration: time.Second, Concurrency: 1, MinBodyBytes: 10, MaxBodyBytes: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Run(context.Background(), tt.config); err == nil {
+				t.Error("the config was accepted")
+			}
+		})
+	}
+}
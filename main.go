@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// routeFlags maps a route path to a value, set as <route>=<value>
+type routeFlags map[string]string
+
+func (f routeFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for route, value := range f {
+		pairs = append(pairs, route+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f routeFlags) Set(value string) error {
+	route, v, ok := strings.Cut(value, "=")
+	if !ok || route == "" || v == "" {
+		return fmt.Errorf("expected <route>=<value>, got %q", value)
+	}
+	f[route] = v
+	return nil
+}
+
+const usage = `usage: lb <command> [flags]
+
+commands:
+  serve [flags]             run the balancer (the default when the first argument is a flag)
+  config validate [flags]   check the serve flags and the files they name without serving
+  node list                 list the node pool
+  node add [flags]          add or replace a node
+  node remove <id>          remove a node
+  node drain <id>           stop sending a node new requests, -wait until it serves none
+  node undrain <id>         send a drained node requests again
+  status                    show the health and usage of every node
+  switch blue|green         switch the live pool of a blue/green -route, after a -bake
+  rule check <expression>   parse a rule expression, and match it against a request given with -url
+  policy-test <file>...     run the routing policy scenarios of YAML files against the selection engine
+  loadtest [flags]          send synthetic traffic to a running balancer and report its spread over the nodes
+  e2e [flags]               run the balancer in-process against ephemeral backends and check it end to end
+
+node, status and switch talk to the admin API of a running balancer, see lb <command> -h.
+`
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serve(args, false)
+		return
+	}
+
+	switch args[0] {
+	case "serve":
+		serve(args[1:], false)
+	case "config":
+		if len(args) < 2 || args[1] != "validate" {
+			fail("usage: lb config validate [serve flags]")
+		}
+		serve(args[2:], true)
+	case "node":
+		if len(args) < 2 {
+			fail("usage: lb node list|add|remove|drain|undrain")
+		}
+		runNodeCommand(args[1], args[2:])
+	case "status":
+		runStatus(args[1:])
+	case "switch":
+		runSwitch(args[1:])
+	case "rule":
+		if len(args) < 2 || args[1] != "check" {
+			fail("usage: lb rule check [flags] '<expression>'")
+		}
+		runRuleCheck(args[2:])
+	case "policy-test":
+		runPolicyTest(args[1:])
+	case "loadtest":
+		runLoadTest(args[1:])
+	case "e2e":
+		runE2E(args[1:])
+	case "help":
+		fmt.Print(usage)
+	default:
+		fail(fmt.Sprintf("unknown command %q\n\n%s", args[0], usage))
+	}
+}
+
+// fail prints message to stderr and exits with status 2, like a flag error
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, strings.TrimRight(message, "\n"))
+	os.Exit(2)
+}
+
+// parseWeights parses group=weight pairs separated by commas
+func parseWeights(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		group, weight, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <group>=<weight>, got %q", pair)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, fmt.Errorf("weight of group %s: %w", group, err)
+		}
+		weights[group] = n
+	}
+	return weights, nil
+}
+
+// parseThresholds parses numbers separated by commas, none when s is empty
+func parseThresholds(s string) ([]float64, error) {
+	var thresholds []float64
+	if s == "" {
+		return thresholds, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// parseLabels parses name=value pairs separated by commas
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected <name>=<value>, got %q", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func TestParseWeights(t *testing.T) {
+	weights, err := parseWeights("stable=90,canary=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"stable": 90, "canary": 10}; !reflect.DeepEqual(weights, expected) {
+		t.Errorf("got %v, expected %v", weights, expected)
+	}
+	for _, s := range []string{"stable", "stable=ninety", ""} {
+		if _, err := parseWeights(s); err == nil {
+			t.Errorf("parseWeights(%q) was accepted", s)
+		}
+	}
+}
+
+func TestRouteFlags(t *testing.T) {
+	f := routeFlags{}
+	for _, value := range []string{"/request=10s", "/jobs/{id}=1m"} {
+		if err := f.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := (routeFlags{"/request": "10s", "/jobs/{id}": "1m"}); !reflect.DeepEqual(f, expected) {
+		t.Errorf("got %v, expected %v", f, expected)
+	}
+	for _, value := range []string{"/request", "=10s", "/request="} {
+		if err := f.Set(value); err == nil {
+			t.Errorf("Set(%q) was accepted", value)
+		}
+	}
+}
+
+func TestValidateNodesFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		nodes int
+		valid bool
+	}{
+		{name: "valid", json: `[{"node_id": "node-1", "limits": "10 req/min"}, {"node_id": "node-2", "rpm_limit": 60}]`, nodes: 2, valid: true},
+		{name: "invalid limits", json: `[{"node_id": "node-1", "limits": "10 req/fortnight"}]`},
+		{name: "not JSON", json: `node-1: 10 req/min`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "nodes.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			nodes, err := validateNodesFile(path)
+			if tt.valid && (err != nil || len(nodes) != tt.nodes) {
+				t.Errorf("got %d nodes, %v, expected %d", len(nodes), err, tt.nodes)
+			}
+			if !tt.valid && err == nil {
+				t.Error("the file was accepted")
+			}
+		})
+	}
+	if nodes, err := validateNodesFile(""); nodes != nil || err != nil {
+		t.Errorf("got %v, %v without a nodes file", nodes, err)
+	}
+	if _, err := validateNodesFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("region=eu, replica = lb-1,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"region": "eu", "replica": "lb-1", "empty": ""}; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("got %v, expected %v", labels, expected)
+	}
+	for _, s := range []string{"region", "=eu"} {
+		if _, err := parseLabels(s); err == nil {
+			t.Errorf("parseLabels(%q) was accepted", s)
+		}
+	}
+}
+
+func TestPairFlags(t *testing.T) {
+	f := pairFlags{}
+	for _, value := range []string{"x-region=eu", "x-region=us", "x-token=a=b", "x-empty="} {
+		if err := f.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := pairFlags{"x-region": {"eu", "us"}, "x-token": {"a=b"}, "x-empty": {""}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("got %v, expected %v", f, expected)
+	}
+	for _, value := range []string{"x-region", "=eu"} {
+		if err := f.Set(value); err == nil {
+			t.Errorf("Set(%q) was accepted", value)
+		}
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds("0.75, 0.5,0.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []float64{0.75, 0.5, 0.25}; !reflect.DeepEqual(thresholds, expected) {
+		t.Errorf("got %v, expected %v", thresholds, expected)
+	}
+	if thresholds, err := parseThresholds(""); thresholds != nil || err != nil {
+		t.Errorf("got %v, %v without thresholds", thresholds, err)
+	}
+	if _, err := parseThresholds("0.75,half"); err == nil {
+		t.Error("a threshold that is not a number was accepted")
+	}
+}
+
+func TestNewMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s, err := newMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := s.NodeLimits(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 || nodes["node-3"].RPMLimit != 30 {
+		t.Errorf("got %+v, expected the three sample nodes", nodes)
+	}
+
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	if err := os.WriteFile(path, []byte(`[{"node_id": "local-1", "address": "http://localhost:9001", "rpm_limit": 10}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newMemoryStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err = s.NodeLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]store.NodeLimits{"local-1": {NodeID: "local-1", Address: "http://localhost:9001", RPMLimit: 10}}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("got %+v, expected %+v", nodes, expected)
+	}
+	if _, err := newMemoryStore(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("a missing nodes file was accepted")
+	}
+}
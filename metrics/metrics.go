@@ -0,0 +1,354 @@
+// Package metrics defines the Prometheus metrics exported by the balancer.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ResponseContractViolations counts backend responses that did not match the route's response schema
+var ResponseContractViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_response_contract_violations_total",
+	Help: "Backend responses that did not match the route's response schema.",
+}, []string{"route", "node"})
+
+// QuotaBorrowed counts requests a sticky over-limit node took on quota borrowed from its pool
+var QuotaBorrowed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_quota_borrowed_total",
+	Help: "Requests admitted to an over-limit sticky node on quota borrowed from its pool.",
+}, []string{"node", "pool"})
+
+// IdempotentRequests counts the requests carrying an idempotency key by
+// route and result
+var IdempotentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_idempotent_requests_total",
+	Help: "Requests with an Idempotency-Key by route and result (first, replayed, in_flight or mismatch).",
+}, []string{"route", "result"})
+
+// CoalescedRequests counts the GET requests of coalescing routes by route
+// and role
+var CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_coalesced_requests_total",
+	Help: "GET requests of coalescing routes by role: leader when forwarded, follower when answered with an identical request's response.",
+}, []string{"route", "role"})
+
+// CacheRequests counts cacheable requests by route and result (hit or miss)
+var CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_cache_requests_total",
+	Help: "Requests to cached routes by result.",
+}, []string{"route", "result"})
+
+// GRPCMessages counts proxied gRPC messages by method and direction (sent or received)
+var GRPCMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_grpc_messages_total",
+	Help: "gRPC messages proxied to and from nodes.",
+}, []string{"method", "direction"})
+
+// GRPCMessageBytes counts the payload bytes of proxied gRPC messages, excluding framing
+var GRPCMessageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_grpc_message_bytes_total",
+	Help: "Payload bytes of gRPC messages proxied to and from nodes.",
+}, []string{"method", "direction"})
+
+// MirroredRequests counts copies of requests sent to shadow nodes by node and outcome
+var MirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_mirrored_requests_total",
+	Help: "Copies of requests sent to shadow nodes, by response status class, error, or dropped when the background workers were busy.",
+}, []string{"node", "result"})
+
+// ExtraLoadCapped counts requests not mirrored because of the extra load cap, by source
+var ExtraLoadCapped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_extra_load_capped_total",
+	Help: "Requests that debugging tools such as mirroring skipped because their extra load was at its cap, by source.",
+}, []string{"source"})
+
+// RequestRecordsDropped counts request records never written to the store by reason
+var RequestRecordsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_request_records_dropped_total",
+	Help: "Request records the batch writer never wrote to the store, because its buffer was full, the write failed or it was closed.",
+}, []string{"reason"})
+
+// PreviewEvaluations counts requests evaluated against the preview configuration by outcome
+var PreviewEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_preview_evaluations_total",
+	Help: "Requests also evaluated against the preview configuration, by whether it would have decided differently.",
+}, []string{"outcome"})
+
+// AnalyticsEventsDropped counts usage events not exported because the exporter fell behind
+var AnalyticsEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_analytics_events_dropped_total",
+	Help: "Usage events not exported because the analytics exporter fell behind.",
+})
+
+// NodeLatencyEWMA is the moving average of each node's response time used by the latency strategy
+var NodeLatencyEWMA = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_latency_ewma_seconds",
+	Help: "Exponentially weighted moving average of the node's response time.",
+}, []string{"node"})
+
+// NodeErrorRateEWMA is the moving average of each node's share of failed responses
+var NodeErrorRateEWMA = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_error_rate_ewma",
+	Help: "Exponentially weighted moving average of the node's share of failed responses.",
+}, []string{"node"})
+
+// NodeHealthy is 1 while a node passes its health checks and 0 once it failed them
+var NodeHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_healthy",
+	Help: "Whether the node passes its health checks (1) or not (0).",
+}, []string{"node"})
+
+// NodeFlaps counts how often a node was held down for flapping between healthy and unhealthy
+var NodeFlaps = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_node_flaps_total",
+	Help: "Times the node was held out of selection for flapping between healthy and unhealthy.",
+}, []string{"node"})
+
+// RejectedRequests counts requests the balancer refused by route and reason
+var RejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_rejected_requests_total",
+	Help: "Requests refused without reaching a node, by route and reason.",
+}, []string{"route", "reason"})
+
+// UpstreamConnections is the number of open connections to the nodes of each pool
+var UpstreamConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_upstream_connections",
+	Help: "Open connections to the nodes of the pool, idle or in use.",
+}, []string{"pool"})
+
+// UpstreamRequestsInFlight is the number of requests waiting for a node's response headers per pool
+var UpstreamRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_upstream_requests_in_flight",
+	Help: "Requests sent to the nodes of the pool that have not received response headers yet.",
+}, []string{"pool"})
+
+// AdaptiveLimitFactor is the share of its configured limits each node gets
+// under adaptive limits
+var AdaptiveLimitFactor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_adaptive_limit_factor",
+	Help: "Share of its configured limits the node gets after adaptive limits cut them under stress, 1 when not cut.",
+}, []string{"node"})
+
+// TokenSeconds counts the capacity tokens requests held on each node times
+// how long they held them
+var TokenSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_node_token_seconds_total",
+	Help: "Capacity tokens held by requests to the node multiplied by the seconds they were held.",
+}, []string{"node"})
+
+// UpstreamConnectionUse counts whether upstream requests got a new or a reused keep-alive connection
+var UpstreamConnectionUse = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_upstream_connection_use_total",
+	Help: "Upstream requests by pool and whether their connection was new or reused.",
+}, []string{"pool", "result"})
+
+// PipelineCompensations counts compensation calls of pipeline stages by outcome
+var PipelineCompensations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_pipeline_compensations_total",
+	Help: "Compensation calls rolling back pipeline stages after a later stage failed, by result (succeeded or failed).",
+}, []string{"route", "stage", "result"})
+
+// AsyncJobs counts what happened to asynchronously submitted requests
+var AsyncJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_async_jobs_total",
+	Help: "Asynchronously submitted requests by result (queued, completed, expired, retried, failed, dead or lease_lost).",
+}, []string{"result"})
+
+// NodeAgentLoad is the load each node's agent last reported
+var NodeAgentLoad = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_agent_load",
+	Help: "Load the node's agent reported in its last heartbeat, as a share of its capacity.",
+}, []string{"node"})
+
+// BackpressureSignals counts the backpressure signals of each node the
+// balancer honoured
+var BackpressureSignals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_backpressure_signals_total",
+	Help: "Backpressure signals honoured by node and signal (retry_after, ratelimit_reset, capacity or ratelimit).",
+}, []string{"node", "signal"})
+
+// BatchSubrequests counts the sub-requests of POST /batch by decision
+var BatchSubrequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_batch_subrequests_total",
+	Help: "Sub-requests of batches by decision, e.g. proxied or rate_limited.",
+}, []string{"decision"})
+
+// PinnedRequests counts the requests pinned to a node for debugging
+var PinnedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_pinned_requests_total",
+	Help: "Requests pinned to the node with X-Debug-Target-Node, bypassing selection.",
+}, []string{"node"})
+
+// OversizedResponses counts the responses over their route's size limit
+var OversizedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_oversized_responses_total",
+	Help: "Responses over the size limit of their route by node, route and how they were handled (stream, error or truncate).",
+}, []string{"node", "route", "overflow"})
+
+// NodeEjections counts the nodes outlier detection ejected, by reason
+var NodeEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_node_ejections_total",
+	Help: "Times outlier detection ejected the node from selection, by reason (consecutive_failures, oversized_responses or latency).",
+}, []string{"node", "reason"})
+
+// NodeEjected is 1 while outlier detection keeps a node out of selection
+var NodeEjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_ejected",
+	Help: "Whether outlier detection currently keeps the node out of selection (1) or not (0).",
+}, []string{"node"})
+
+// BackgroundTasks counts the background work of requests by kind and result
+var BackgroundTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_background_tasks_total",
+	Help: "Background work left behind by requests, by kind and result (done, inline or dropped).",
+}, []string{"kind", "result"})
+
+// BackgroundQueued is how much background work waits for a worker
+var BackgroundQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_background_queued",
+	Help: "Background tasks waiting for a worker.",
+})
+
+// HedgedRequests counts requests hedged to a second node, by whether the second node answered first
+var HedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_hedged_requests_total",
+	Help: "Requests sent to a second node because the first was slow to answer, by whether the second answered first (won), did not (lost), or no node could take it (no_node).",
+}, []string{"result"})
+
+// PhaseDuration is how long requests spent in each routing phase, by route and phase
+var PhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "lb_phase_duration_seconds",
+	Help:    "Time requests spent in each routing phase (auth, limits, selection, queue or proxy), by route and phase.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+}, []string{"route", "phase"})
+
+// LocalitySelections counts node selections by the nodes chosen among
+var LocalitySelections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_locality_selections_total",
+	Help: "Node selections with a locality preference, by the nodes chosen among: zone (of the request's zone), region (of its region) or spillover (any, as no nearby node had capacity).",
+}, []string{"scope"})
+
+// StoreDuration is how long the store calls of the request path took, by call
+var StoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "lb_store_duration_seconds",
+	Help:    "Time the store calls made while routing requests took, by call (usage, operation_usage, record or reserve).",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+}, []string{"call"})
+
+// StreamConnections counts TCP connections and UDP sessions by protocol and result
+var StreamConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_stream_connections_total",
+	Help: "TCP connections and UDP sessions accepted by the stream proxy, by protocol and result (proxied, rejected, unreachable or error).",
+}, []string{"protocol", "result"})
+
+// StreamBytes counts the bytes the stream proxy carried by protocol, node and direction
+var StreamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_stream_bytes_total",
+	Help: "Bytes of TCP connections and UDP sessions proxied to (sent) and from (received) nodes.",
+}, []string{"protocol", "node", "direction"})
+
+// ReplicationFetches counts fetches of other regions' usage by peer and result
+var ReplicationFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_replication_fetches_total",
+	Help: "Fetches of the global limit usage of other regions from peer balancers, by result (ok or error).",
+}, []string{"peer", "result"})
+
+// AdminRejections counts admin requests refused before authentication by reason
+var AdminRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_admin_rejections_total",
+	Help: "Admin API requests refused by reason (rate_limited, or locked_out after failed authentications).",
+}, []string{"reason"})
+
+// TenantRequests counts the requests of each tenant by decision
+var TenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_tenant_requests_total",
+	Help: "Requests of tenants by tenant and decision (proxied, rate_limited, unavailable, ...).",
+}, []string{"tenant", "decision"})
+
+// CompressedResponses counts the responses compressed toward clients by encoding
+var CompressedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_compressed_responses_total",
+	Help: "Responses compressed toward clients by encoding (br or gzip).",
+}, []string{"encoding"})
+
+// DecompressedRequests counts the request bodies decompressed by encoding
+var DecompressedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_decompressed_requests_total",
+	Help: "Request bodies sent compressed and decompressed before routing, by encoding (gzip, x-gzip or br).",
+}, []string{"encoding"})
+
+// UpstreamEgressBytes counts the bytes written to the connections of each node
+var UpstreamEgressBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_upstream_egress_bytes_total",
+	Help: "Bytes written to the connections of each node, request lines and headers included.",
+}, []string{"node"})
+
+// ShieldBans counts the source IPs banned by reason
+var ShieldBans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_shield_bans_total",
+	Help: "Source IPs banned by reason (request_rate, connections or manual).",
+}, []string{"reason"})
+
+// ShieldRejections counts the requests and connections refused from banned IPs
+var ShieldRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_shield_rejections_total",
+	Help: "Requests and connections refused because their source IP is banned, by kind (request or connection).",
+}, []string{"kind"})
+
+// ProfilesPushed counts the profiles pushed to the continuous profiler
+var ProfilesPushed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_profiles_pushed_total",
+	Help: "Profiles pushed to the continuous profiler by profile (cpu, heap, goroutine, mutex or block) and result (ok or error).",
+}, []string{"profile", "result"})
+
+// EventsDelivered counts the balancer events delivered to each sink
+var EventsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_events_delivered_total",
+	Help: "Balancer events delivered by sink (webhook or kafka) and result (ok or error).",
+}, []string{"sink", "result"})
+
+// EventsDropped counts the balancer events dropped because a sink or
+// subscriber fell behind
+var EventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_events_dropped_total",
+	Help: "Balancer events dropped because the queue of a sink or admin API subscriber was full, by sink (webhook, kafka or subscriber).",
+}, []string{"sink"})
+
+// DegradationLevel is the degradation level of the balancer
+var DegradationLevel = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_degradation_level",
+	Help: "Degradation level of the balancer: 0 full, 1 shed_low, 2 cached_only, 3 static.",
+})
+
+// DegradationTransitions counts the moves between degradation levels
+var DegradationTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_degradation_transitions_total",
+	Help: "Moves between degradation levels by level left (from) and entered (to).",
+}, []string{"from", "to"})
+
+// NodeConnectionUse counts whether the requests sent to each node got a new
+// or a reused keep-alive connection
+var NodeConnectionUse = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_node_connection_use_total",
+	Help: "Requests sent to each node by whether their connection was new or reused, with -connection-accounting.",
+}, []string{"node", "result"})
+
+// NodeConnectionReuseRatio is the share of the requests sent to each node
+// over the last minute that reused a keep-alive connection
+var NodeConnectionReuseRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lb_node_connection_reuse_ratio",
+	Help: "Share of the requests sent to each node over the last minute that reused a keep-alive connection, with -connection-accounting.",
+}, []string{"node"})
+
+// FaultsInjected counts the faults injected into requests by fault rules
+var FaultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_faults_injected_total",
+	Help: "Faults injected by fault rules, by route, node (empty before node selection) and fault (delay, abort or drop).",
+}, []string{"route", "node", "fault"})
+
+// StandbyFailover is 1 while the standby nodes take traffic because too few
+// primary nodes are up
+var StandbyFailover = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_standby_failover_active",
+	Help: "Whether the standby nodes take traffic because too few primary nodes are up (1) or not (0).",
+})
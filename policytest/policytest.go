@@ -0,0 +1,301 @@
+// Package policytest runs routing policy scenarios written in YAML against
+// the balancer's selection engine, so operators can test their node limits,
+// group weights, operation and global limits and priorities like code
+// before they go live. A scenario sets up a node pool and sends it requests
+// one after the other, each expecting a node or a rejection:
+//
+//	scenarios:
+//	  - name: canary takes over once stable is full
+//	    nodes:
+//	      - {id: stable-1, group: stable, limits: "2 req/min"}
+//	      - {id: canary-1, group: canary, limits: "10 req/min"}
+//	    group_weights: {stable: 100, canary: 0}
+//	    requests:
+//	      - {operation: POST /request, repeat: 2, expect: {node: stable-1}}
+//	      - {operation: POST /request, expect: {reject: node_requests}}
+//	      - {operation: POST /request, group: canary, expect: {node: canary-1}}
+//
+// Requests served by a node are accounted against its limits, so later
+// requests of the scenario see them.
+package policytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+// File struct represents a file of scenarios
+type File struct {
+	Scenarios []Scenario `yaml:"scenarios"`
+}
+
+// Scenario struct represents a node pool, the balancer settings and the
+// requests sent to it
+type Scenario struct {
+	Name  string `yaml:"name"`
+	Nodes []Node `yaml:"nodes"`
+	// GroupWeights, OperationLimits, GlobalLimits, Priorities and Strategy
+	// take the values of the serve flags of the same name
+	GroupWeights    map[string]int    `yaml:"group_weights"`
+	OperationLimits map[string]string `yaml:"operation_limits"`
+	GlobalLimits    string            `yaml:"global_limits"`
+	Priorities      string            `yaml:"priorities"`
+	Strategy        string            `yaml:"strategy"`
+	// Seed seeds the random choices of selection, 1 when zero, so a
+	// scenario routes the same way on every run
+	Seed int64 `yaml:"seed"`
+	// Down lists nodes that are failed for the whole scenario
+	Down     []string `yaml:"down"`
+	Requests []Step   `yaml:"requests"`
+}
+
+// Node struct represents a node of the pool, with the fields of the nodes
+// file
+type Node struct {
+	ID              string            `yaml:"id"`
+	Group           string            `yaml:"group"`
+	Pool            string            `yaml:"pool"`
+	RPM             int               `yaml:"rpm"`
+	BPM             int               `yaml:"bpm"`
+	Limits          string            `yaml:"limits"`
+	MaxConcurrent   int               `yaml:"max_concurrent"`
+	BorrowPercent   int               `yaml:"borrow_percent"`
+	RolloverPercent int               `yaml:"rollover_percent"`
+	BurstCapPercent int               `yaml:"burst_cap_percent"`
+	OperationLimits map[string]string `yaml:"operation_limits"`
+	Standby         bool              `yaml:"standby"`
+}
+
+func (n Node) limits() store.NodeLimits {
+	return store.NodeLimits{
+		NodeID:          n.ID,
+		Group:           n.Group,
+		Pool:            n.Pool,
+		RPMLimit:        n.RPM,
+		BPMLimit:        n.BPM,
+		Limits:          n.Limits,
+		MaxConcurrent:   n.MaxConcurrent,
+		BorrowPercent:   n.BorrowPercent,
+		RolloverPercent: n.RolloverPercent,
+		BurstCapPercent: n.BurstCapPercent,
+		OperationLimits: n.OperationLimits,
+		Standby:         n.Standby,
+	}
+}
+
+// Step struct represents a request sent Repeat times, once when zero
+type Step struct {
+	Operation   string `yaml:"operation"`
+	Group       string `yaml:"group"`
+	AffinityKey string `yaml:"affinity_key"`
+	Priority    string `yaml:"priority"`
+	BPM         int    `yaml:"bpm"`
+	Repeat      int    `yaml:"repeat"`
+	// Hold keeps the requests in flight until the end of the scenario, using
+	// up the concurrency slots of their nodes
+	Hold   bool   `yaml:"hold"`
+	Expect Expect `yaml:"expect"`
+}
+
+// Expect struct represents the outcome a request expects: Node, one of
+// OneOf, or a rejection for Reject, such as node_requests or global_limit.
+// A request expecting nothing may be served by any node.
+type Expect struct {
+	Node   string   `yaml:"node"`
+	OneOf  []string `yaml:"one_of"`
+	Reject string   `yaml:"reject"`
+}
+
+// check returns what is wrong with being served by nodeID, or refused for
+// reason when nodeID is empty, or "" when it is what was expected
+func (e Expect) check(nodeID, reason string) string {
+	switch {
+	case e.Reject != "" && nodeID != "":
+		return fmt.Sprintf("expected rejection %s, served by %s", e.Reject, nodeID)
+	case e.Reject != "" && reason != e.Reject:
+		return fmt.Sprintf("expected rejection %s, rejected for %s", e.Reject, reason)
+	case e.Reject == "" && nodeID == "":
+		return fmt.Sprintf("expected to be served, rejected for %s", reason)
+	case e.Node != "" && nodeID != e.Node:
+		return fmt.Sprintf("expected node %s, served by %s", e.Node, nodeID)
+	case len(e.OneOf) > 0 && !slices.Contains(e.OneOf, nodeID):
+		return fmt.Sprintf("expected one of %v, served by %s", e.OneOf, nodeID)
+	}
+	return ""
+}
+
+// Load reads a file of scenarios. Unknown fields are errors, so a typo does
+// not pass as a missing setting.
+func Load(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	var file File
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return File{}, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, scenario := range file.Scenarios {
+		if scenario.Name == "" {
+			return File{}, fmt.Errorf("%s: scenario %d has no name", path, i+1)
+		}
+		for j, step := range scenario.Requests {
+			if step.Expect.Reject != "" && (step.Expect.Node != "" || len(step.Expect.OneOf) > 0) {
+				return File{}, fmt.Errorf("%s: scenario %s: request %d expects both a node and a rejection", path, scenario.Name, j+1)
+			}
+			if step.Repeat < 0 {
+				return File{}, fmt.Errorf("%s: scenario %s: request %d: repeat must not be negative", path, scenario.Name, j+1)
+			}
+		}
+	}
+	return file, nil
+}
+
+// Result struct represents the outcome of a scenario
+type Result struct {
+	Scenario string
+	// Failures describe the requests that did not go as expected
+	Failures []string
+	// Err is set when the scenario could not be run, e.g. for an invalid
+	// limit expression
+	Err error
+}
+
+// Passed reports whether every request of the scenario went as expected
+func (r Result) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+// Run sets up a balancer for scenario on a memory store and sends it the
+// scenario's requests
+func Run(ctx context.Context, scenario Scenario) Result {
+	result := Result{Scenario: scenario.Name}
+	lb, err := setUp(ctx, scenario)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	var held []func()
+	defer func() {
+		for _, release := range held {
+			release()
+		}
+	}()
+	for i, step := range scenario.Requests {
+		repeat := max(step.Repeat, 1)
+		for n := range repeat {
+			nodeID, reason, release, err := send(ctx, lb, step)
+			if err != nil {
+				result.Err = fmt.Errorf("request %d: %w", i+1, err)
+				return result
+			}
+			if step.Hold {
+				held = append(held, release)
+			} else {
+				release()
+			}
+			if failure := step.Expect.check(nodeID, reason); failure != "" {
+				name := fmt.Sprintf("request %d", i+1)
+				if repeat > 1 {
+					name += fmt.Sprintf(" (%d of %d)", n+1, repeat)
+				}
+				result.Failures = append(result.Failures, name+": "+failure)
+			}
+		}
+	}
+	return result
+}
+
+// setUp returns a balancer with the node pool and settings of scenario
+func setUp(ctx context.Context, scenario Scenario) (*balancer.LoadBalancer, error) {
+	nodes := make([]store.NodeLimits, 0, len(scenario.Nodes))
+	for _, node := range scenario.Nodes {
+		limits := node.limits()
+		if err := balancer.ValidateNode(limits); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, limits)
+	}
+	lb := balancer.New(store.NewMemoryStore(nodes...))
+	if err := lb.LoadNodes(ctx); err != nil {
+		return nil, err
+	}
+	lb.SetSeed(max(scenario.Seed, 1))
+
+	strategy, err := balancer.ParseStrategy(scenario.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	lb.SetStrategy(strategy)
+	if scenario.GroupWeights != nil {
+		if err := lb.SetGroupWeights(scenario.GroupWeights); err != nil {
+			return nil, err
+		}
+	}
+	if scenario.OperationLimits != nil {
+		if err := lb.SetOperationLimits(scenario.OperationLimits); err != nil {
+			return nil, err
+		}
+	}
+	if scenario.GlobalLimits != "" {
+		if err := lb.SetGlobalLimits(scenario.GlobalLimits); err != nil {
+			return nil, err
+		}
+	}
+	shares, err := balancer.ParsePriorities(scenario.Priorities)
+	if err != nil {
+		return nil, err
+	}
+	lb.SetPriorities(shares)
+	for _, nodeID := range scenario.Down {
+		if !lb.SimulateFailure(nodeID, 24*time.Hour) {
+			return nil, fmt.Errorf("unknown down node %s", nodeID)
+		}
+	}
+	return lb, nil
+}
+
+// send selects a node for step the way the API does for a request, taking
+// a concurrency slot on it and accounting the request against its limits.
+// It returns the node, or the reason the request is refused, and the
+// function giving the slot back.
+func send(ctx context.Context, lb *balancer.LoadBalancer, step Step) (nodeID, reason string, release func(), err error) {
+	req := balancer.Request{Operation: step.Operation, Group: step.Group, AffinityKey: step.AffinityKey, Priority: step.Priority}
+	attempts := lb.NewAttempts(balancer.AccountPerAttempt, step.Operation, step.BPM)
+	for {
+		nodeID, err := lb.SelectNode(ctx, req)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if nodeID == "" {
+			return "", lb.RejectReason(ctx, req), func() {}, nil
+		}
+		slot, ok := lb.Acquire(nodeID)
+		if !ok {
+			req.Exclude = append(req.Exclude, nodeID)
+			continue
+		}
+		if err := attempts.Start(ctx, nodeID); errors.Is(err, balancer.ErrOverLimit) {
+			slot()
+			req.Exclude = append(req.Exclude, nodeID)
+			continue
+		} else if err != nil {
+			slot()
+			return "", "", nil, err
+		}
+		return nodeID, "", slot, nil
+	}
+}
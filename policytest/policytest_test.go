@@ -0,0 +1,135 @@
+package policytest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{name: "valid", yaml: "scenarios:\n  - name: one\n    nodes: [{id: a, limits: 1 req/min}]\n    requests: [{operation: POST /request, expect: {node: a}}]\n", valid: true},
+		{name: "unknown field", yaml: "scenarios:\n  - name: one\n    node: [{id: a}]\n"},
+		{name: "no name", yaml: "scenarios:\n  - nodes: [{id: a}]\n"},
+		{name: "node and rejection", yaml: "scenarios:\n  - name: one\n    requests: [{expect: {node: a, reject: no_nodes}}]\n"},
+		{name: "negative repeat", yaml: "scenarios:\n  - name: one\n    requests: [{repeat: -1}]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scenarios.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("the file was accepted")
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	canary := []Node{
+		{ID: "stable-1", Group: "stable", Limits: "2 req/min"},
+		{ID: "canary-1", Group: "canary", Limits: "10 req/min"},
+	}
+	tests := []struct {
+		name     string
+		scenario Scenario
+		failures []string
+		err      bool
+	}{
+		{
+			name: "canary takes over",
+			scenario: Scenario{
+				Nodes:        canary,
+				GroupWeights: map[string]int{"stable": 100, "canary": 0},
+				Requests: []Step{
+					{Operation: "POST /request", Repeat: 2, Expect: Expect{Node: "stable-1"}},
+					{Operation: "POST /request", Expect: Expect{Reject: "node_requests"}},
+					{Operation: "POST /request", Group: "canary", Expect: Expect{Node: "canary-1"}},
+				},
+			},
+		},
+		{
+			name: "unexpected outcomes",
+			scenario: Scenario{
+				Nodes:        canary,
+				GroupWeights: map[string]int{"stable": 100, "canary": 0},
+				Requests: []Step{
+					{Operation: "POST /request", Repeat: 3, Expect: Expect{OneOf: []string{"stable-1"}}},
+					{Operation: "POST /request", Group: "canary", Expect: Expect{Reject: "global_limit"}},
+				},
+			},
+			failures: []string{
+				"request 1 (3 of 3): expected to be served, rejected for node_requests",
+				"request 2: expected rejection global_limit, served by canary-1",
+			},
+		},
+		{
+			name: "down node",
+			scenario: Scenario{
+				Nodes: []Node{{ID: "a", Limits: "10 req/min"}, {ID: "b", Limits: "10 req/min"}},
+				Down:  []string{"a"},
+				Requests: []Step{
+					{Operation: "POST /request", Repeat: 5, Expect: Expect{Node: "b"}},
+				},
+			},
+		},
+		{
+			name: "held requests",
+			scenario: Scenario{
+				Nodes: []Node{{ID: "a", Limits: "10 req/min", MaxConcurrent: 1}},
+				Requests: []Step{
+					{Operation: "POST /request", Hold: true, Expect: Expect{Node: "a"}},
+					{Operation: "POST /request", Expect: Expect{Reject: "node_concurrency"}},
+				},
+			},
+		},
+		{
+			name: "global limits",
+			scenario: Scenario{
+				Nodes:        []Node{{ID: "a", Limits: "10 req/min"}, {ID: "b", Limits: "10 req/min"}},
+				GlobalLimits: "3 req/min",
+				Requests: []Step{
+					{Operation: "POST /request", Repeat: 3, Expect: Expect{OneOf: []string{"a", "b"}}},
+					{Operation: "POST /request", Expect: Expect{Reject: "global_limit"}},
+				},
+			},
+		},
+		{
+			name:     "invalid limits",
+			scenario: Scenario{Nodes: []Node{{ID: "a", Limits: "10 req/fortnight"}}},
+			err:      true,
+		},
+		{
+			name:     "unknown down node",
+			scenario: Scenario{Nodes: []Node{{ID: "a", Limits: "10 req/min"}}, Down: []string{"b"}},
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.scenario.Name = tt.name
+			result := Run(context.Background(), tt.scenario)
+			if (result.Err != nil) != tt.err {
+				t.Fatalf("got error %v, expected one: %t", result.Err, tt.err)
+			}
+			if !slices.Equal(result.Failures, tt.failures) {
+				t.Errorf("got failures %q, expected %q", result.Failures, tt.failures)
+			}
+			if result.Passed() != (!tt.err && tt.failures == nil) {
+				t.Errorf("got passed %t", result.Passed())
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Package profiling pushes pprof profiles of the running balancer to a
+// continuous profiler, Pyroscope or Parca, so the hotspots of the routing
+// path can be followed in production over time.
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Profilers profiles are pushed to
+const (
+	// Pyroscope takes profiles on its /ingest endpoint
+	Pyroscope = "pyroscope"
+	// Parca takes profiles on the /profiles/writeraw endpoint of its HTTP API
+	Parca = "parca"
+)
+
+// Profiles that may be collected
+const (
+	ProfileCPU       = "cpu"
+	ProfileHeap      = "heap"
+	ProfileGoroutine = "goroutine"
+	ProfileMutex     = "mutex"
+	ProfileBlock     = "block"
+)
+
+// Config struct represents where profiles are pushed to and how the
+// process is sampled for them
+type Config struct {
+	// Profiler is Pyroscope or Parca, and URL its base URL
+	Profiler string
+	URL      string
+	// Application names the balancer's profiles, and Labels tag them, e.g.
+	// with the region or replica
+	Application string
+	Labels      map[string]string
+	// Profiles are the profiles pushed, of ProfileCPU, ProfileHeap,
+	// ProfileGoroutine, ProfileMutex and ProfileBlock
+	Profiles []string
+	// Interval is how often profiles are pushed. The CPU is profiled for
+	// CPUDuration of every interval, so the share of time under the profiler
+	// is CPUDuration/Interval.
+	Interval    time.Duration
+	CPUDuration time.Duration
+	// MemoryRate is the average number of bytes allocated between heap
+	// samples, runtime.MemProfileRate; zero keeps the runtime's default
+	MemoryRate int
+	// MutexFraction samples one in MutexFraction mutex contentions and
+	// BlockRate one blocking event per BlockRate nanoseconds spent blocked;
+	// both apply only when the profile is pushed
+	MutexFraction int
+	BlockRate     int
+	// Timeout bounds every push
+	Timeout time.Duration
+}
+
+// Validate checks that the profiles can be collected and pushed
+func (c Config) Validate() error {
+	if c.Profiler != Pyroscope && c.Profiler != Parca {
+		return fmt.Errorf("unknown profiler %q, expected pyroscope or parca", c.Profiler)
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return fmt.Errorf("profiler URL: %w", err)
+	}
+	if c.Application == "" {
+		return errors.New("profiles need an application name")
+	}
+	if len(c.Profiles) == 0 {
+		return errors.New("no profile to push")
+	}
+	for _, profile := range c.Profiles {
+		switch profile {
+		case ProfileCPU, ProfileHeap, ProfileGoroutine, ProfileMutex, ProfileBlock:
+		default:
+			return fmt.Errorf("unknown profile %q, expected cpu, heap, goroutine, mutex or block", profile)
+		}
+	}
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return errors.New("the profile interval and push timeout must be positive")
+	}
+	if slices.Contains(c.Profiles, ProfileCPU) && (c.CPUDuration <= 0 || c.CPUDuration > c.Interval) {
+		return errors.New("the CPU profile duration must be positive and at most the profile interval")
+	}
+	if c.MemoryRate < 0 || c.MutexFraction < 0 || c.BlockRate < 0 {
+		return errors.New("profile sampling rates must not be negative")
+	}
+	return nil
+}
+
+// Pusher collects the profiles of Config every interval and pushes them
+type Pusher struct {
+	config Config
+	client *http.Client
+}
+
+// New returns a pusher for config, which must be valid. It sets the
+// process's sampling rates, so there should be one pusher per process.
+func New(config Config) *Pusher {
+	if config.MemoryRate > 0 {
+		runtime.MemProfileRate = config.MemoryRate
+	}
+	if slices.Contains(config.Profiles, ProfileMutex) {
+		runtime.SetMutexProfileFraction(max(config.MutexFraction, 1))
+	}
+	if slices.Contains(config.Profiles, ProfileBlock) {
+		runtime.SetBlockProfileRate(max(config.BlockRate, 1))
+	}
+	return &Pusher{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+// Run pushes profiles until ctx is done. A profile that fails to push is
+// logged and dropped; the next interval brings a new one.
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		if slices.Contains(p.config.Profiles, ProfileCPU) {
+			p.pushCPU(ctx, start)
+		}
+		for _, profile := range p.config.Profiles {
+			if profile != ProfileCPU {
+				p.pushLookup(ctx, profile, start)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pushCPU profiles the CPU for CPUDuration and pushes the profile. It skips
+// the interval when something else, such as a test, is profiling the CPU.
+func (p *Pusher) pushCPU(ctx context.Context, start time.Time) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		log.Printf("profiling: skipping the CPU profile: %v", err)
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(p.config.CPUDuration):
+	}
+	pprof.StopCPUProfile()
+	p.push(ctx, ProfileCPU, buf.Bytes(), start, time.Now())
+}
+
+// pushLookup pushes one of the runtime's named profiles
+func (p *Pusher) pushLookup(ctx context.Context, profile string, start time.Time) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup(profile).WriteTo(&buf, 0); err != nil {
+		log.Printf("profiling: writing the %s profile: %v", profile, err)
+		return
+	}
+	p.push(ctx, profile, buf.Bytes(), start, time.Now())
+}
+
+// push sends a pprof encoded profile covering from to until to the profiler
+func (p *Pusher) push(ctx context.Context, profile string, data []byte, from, until time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+	var req *http.Request
+	var err error
+	if p.config.Profiler == Parca {
+		req, err = p.parcaRequest(ctx, profile, data)
+	} else {
+		req, err = p.pyroscopeRequest(ctx, profile, data, from, until)
+	}
+	if err == nil {
+		var resp *http.Response
+		if resp, err = p.client.Do(req); err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("%s answered %s", p.config.Profiler, resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		metrics.ProfilesPushed.WithLabelValues(profile, "error").Inc()
+		log.Printf("profiling: pushing the %s profile: %v", profile, err)
+		return
+	}
+	metrics.ProfilesPushed.WithLabelValues(profile, "ok").Inc()
+}
+
+// labelNames returns the names of Config.Labels in order
+func (p *Pusher) labelNames() []string {
+	names := make([]string, 0, len(p.config.Labels))
+	for name := range p.config.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pyroscopeRequest sends the profile to /ingest as a multipart form, named
+// application.profile{label=value,...}
+func (p *Pusher) pyroscopeRequest(ctx context.Context, profile string, data []byte, from, until time.Time) (*http.Request, error) {
+	labels := make([]string, 0, len(p.config.Labels))
+	for _, name := range p.labelNames() {
+		labels = append(labels, name+"="+p.config.Labels[name])
+	}
+	query := url.Values{}
+	query.Set("name", fmt.Sprintf("%s.%s{%s}", p.config.Application, profile, strings.Join(labels, ",")))
+	query.Set("from", strconv.FormatInt(from.Unix(), 10))
+	query.Set("until", strconv.FormatInt(until.Unix(), 10))
+	query.Set("format", "pprof")
+	query.Set("spyName", "gospy")
+	if profile == ProfileCPU {
+		query.Set("sampleRate", "100")
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.config.URL, "/")+"/ingest?"+query.Encode(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+// parcaLabel, parcaSample and parcaSeries mirror the JSON of Parca's
+// WriteRawRequest
+type parcaLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type parcaSample struct {
+	// RawProfile is the gzipped pprof profile, base64 encoded in JSON
+	RawProfile []byte `json:"raw_profile"`
+}
+
+type parcaSeries struct {
+	Labels struct {
+		Labels []parcaLabel `json:"labels"`
+	} `json:"labels"`
+	Samples []parcaSample `json:"samples"`
+}
+
+// parcaRequest sends the profile to /profiles/writeraw, labelled with the
+// application as job and with the profile as __name__
+func (p *Pusher) parcaRequest(ctx context.Context, profile string, data []byte) (*http.Request, error) {
+	var series parcaSeries
+	series.Labels.Labels = []parcaLabel{{Name: "__name__", Value: profile}, {Name: "job", Value: p.config.Application}}
+	for _, name := range p.labelNames() {
+		series.Labels.Labels = append(series.Labels.Labels, parcaLabel{Name: name, Value: p.config.Labels[name]})
+	}
+	series.Samples = []parcaSample{{RawProfile: data}}
+
+	body, err := json.Marshal(map[string]any{"series": []parcaSeries{series}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.config.URL, "/")+"/profiles/writeraw", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -0,0 +1,126 @@
+package profiling
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		Profiler:    Pyroscope,
+		URL:         "http://pyroscope:4040",
+		Application: "lb",
+		Profiles:    []string{ProfileCPU, ProfileHeap},
+		Interval:    time.Minute,
+		CPUDuration: 10 * time.Second,
+		Timeout:     10 * time.Second,
+	}
+	tests := []struct {
+		name  string
+		edit  func(*Config)
+		valid bool
+	}{
+		{name: "valid", edit: func(c *Config) {}, valid: true},
+		{name: "unknown profiler", edit: func(c *Config) { c.Profiler = "pprof" }},
+		{name: "invalid URL", edit: func(c *Config) { c.URL = "pyroscope" }},
+		{name: "no application", edit: func(c *Config) { c.Application = "" }},
+		{name: "no profile", edit: func(c *Config) { c.Profiles = nil }},
+		{name: "unknown profile", edit: func(c *Config) { c.Profiles = []string{"threadcreate"} }},
+		{name: "no interval", edit: func(c *Config) { c.Interval = 0 }},
+		{name: "CPU over the interval", edit: func(c *Config) { c.CPUDuration = 2 * time.Minute }},
+		{name: "no CPU profile", edit: func(c *Config) { c.Profiles, c.CPUDuration = []string{ProfileHeap}, 0 }, valid: true},
+		{name: "negative rate", edit: func(c *Config) { c.BlockRate = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.edit(&config)
+			err := config.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("the config was accepted")
+			}
+		})
+	}
+}
+
+func TestPyroscope(t *testing.T) {
+	pushed := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("profile")
+		if err != nil || r.URL.Path != "/ingest" || r.URL.Query().Get("format") != "pprof" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if data, _ := io.ReadAll(file); len(data) == 0 {
+			http.Error(w, "empty profile", http.StatusBadRequest)
+			return
+		}
+		pushed <- r.URL.Query().Get("name")
+	}))
+	defer server.Close()
+
+	p := New(Config{
+		Profiler:    Pyroscope,
+		URL:         server.URL + "/",
+		Application: "lb",
+		Labels:      map[string]string{"region": "eu", "replica": "lb-1"},
+		Profiles:    []string{ProfileHeap, ProfileGoroutine},
+		Interval:    time.Hour,
+		Timeout:     5 * time.Second,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	var names []string
+	for range 2 {
+		select {
+		case name := <-pushed:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no profile was pushed")
+		}
+	}
+	expected := []string{"lb.heap{region=eu,replica=lb-1}", "lb.goroutine{region=eu,replica=lb-1}"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("got profiles %q, expected %q", names, expected)
+	}
+}
+
+func TestParca(t *testing.T) {
+	pushed := make(chan parcaSeries, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Series []parcaSeries `json:"series"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.URL.Path != "/profiles/writeraw" || len(body.Series) != 1 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		pushed <- body.Series[0]
+	}))
+	defer server.Close()
+
+	p := New(Config{Profiler: Parca, URL: server.URL, Application: "lb", Labels: map[string]string{"region": "eu"}, Timeout: 5 * time.Second})
+	p.pushLookup(context.Background(), ProfileHeap, time.Now())
+	select {
+	case series := <-pushed:
+		expected := []parcaLabel{{Name: "__name__", Value: "heap"}, {Name: "job", Value: "lb"}, {Name: "region", Value: "eu"}}
+		if !slices.Equal(series.Labels.Labels, expected) {
+			t.Errorf("got labels %+v, expected %+v", series.Labels.Labels, expected)
+		}
+		if len(series.Samples) != 1 || len(series.Samples[0].RawProfile) == 0 {
+			t.Errorf("got samples %+v, expected the profile", series.Samples)
+		}
+	default:
+		t.Fatal("no profile was pushed")
+	}
+}
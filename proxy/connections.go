@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// connectionWindow is how far back the request and connection rates of a
+// node are counted
+const connectionWindow = time.Minute
+
+// ConnectionUsage struct represents how the requests sent to a node used its
+// keep-alive connections
+type ConnectionUsage struct {
+	Node string `json:"node"`
+	// Requests and NewConnections count since the balancer started the
+	// requests sent to the node and the connections opened for them; the
+	// other requests reused an idle keep-alive connection
+	Requests       int64 `json:"requests"`
+	NewConnections int64 `json:"new_connections"`
+	// RequestsPerMinute and ConnectionsPerMinute are the same over the last
+	// minute
+	RequestsPerMinute    int64 `json:"requests_per_minute"`
+	ConnectionsPerMinute int64 `json:"connections_per_minute"`
+	// ReuseRatio is the share of the requests of the last minute that reused
+	// a connection
+	ReuseRatio float64 `json:"reuse_ratio"`
+}
+
+// connectionMeter counts the requests sent to each node and the new
+// connections they needed
+type connectionMeter struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeConnections
+}
+
+// nodeConnections holds the totals of a node and its per second counts over
+// the last connectionWindow
+type nodeConnections struct {
+	requests, connections int64
+	seconds               [int(connectionWindow / time.Second)]int64
+	recentRequests        [int(connectionWindow / time.Second)]int64
+	recentConnections     [int(connectionWindow / time.Second)]int64
+}
+
+func newConnectionMeter() *connectionMeter {
+	return &connectionMeter{nodes: map[string]*nodeConnections{}}
+}
+
+// add counts a request sent to nodeID over a new or a reused connection
+func (m *connectionMeter) add(nodeID string, reused bool, now time.Time) {
+	m.mu.Lock()
+	c, ok := m.nodes[nodeID]
+	if !ok {
+		c = &nodeConnections{}
+		m.nodes[nodeID] = c
+	}
+	second := now.Unix()
+	slot := int(second % int64(len(c.seconds)))
+	if c.seconds[slot] != second {
+		c.seconds[slot], c.recentRequests[slot], c.recentConnections[slot] = second, 0, 0
+	}
+	c.requests++
+	c.recentRequests[slot]++
+	if !reused {
+		c.connections++
+		c.recentConnections[slot]++
+	}
+	usage := c.usage(nodeID, now)
+	m.mu.Unlock()
+
+	result := "new"
+	if reused {
+		result = "reused"
+	}
+	metrics.NodeConnectionUse.WithLabelValues(nodeID, result).Inc()
+	metrics.NodeConnectionReuseRatio.WithLabelValues(nodeID).Set(usage.ReuseRatio)
+}
+
+// usage returns the connection usage of the node, its meter's mu held
+func (c *nodeConnections) usage(nodeID string, now time.Time) ConnectionUsage {
+	u := ConnectionUsage{Node: nodeID, Requests: c.requests, NewConnections: c.connections}
+	for slot, second := range c.seconds {
+		if age := now.Unix() - second; age >= 0 && age < int64(len(c.seconds)) {
+			u.RequestsPerMinute += c.recentRequests[slot]
+			u.ConnectionsPerMinute += c.recentConnections[slot]
+		}
+	}
+	if u.RequestsPerMinute > 0 {
+		u.ReuseRatio = float64(u.RequestsPerMinute-u.ConnectionsPerMinute) / float64(u.RequestsPerMinute)
+	}
+	return u
+}
+
+// trace tags ctx so the connection the request to nodeID gets is counted
+func (m *connectionMeter) trace(ctx context.Context, nodeID string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { m.add(nodeID, info.Reused, time.Now()) },
+	})
+}
+
+// CountConnections makes the proxy count, for every node, the requests sent
+// to it and the new connections they needed separately, see ConnectionUsage
+func (p *Proxy) CountConnections() {
+	p.connections = newConnectionMeter()
+}
+
+// CountsConnections reports whether CountConnections was called
+func (p *Proxy) CountsConnections() bool {
+	return p.connections != nil
+}
+
+// ConnectionUsage returns how the requests sent to a node used its
+// connections, false when they are not counted or none was sent yet
+func (p *Proxy) ConnectionUsage(nodeID string) (ConnectionUsage, bool) {
+	if p.connections == nil {
+		return ConnectionUsage{}, false
+	}
+	p.connections.mu.Lock()
+	defer p.connections.mu.Unlock()
+	c, ok := p.connections.nodes[nodeID]
+	if !ok {
+		return ConnectionUsage{}, false
+	}
+	return c.usage(nodeID, time.Now()), true
+}
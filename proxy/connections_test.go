@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectionMeter(t *testing.T) {
+	m := newConnectionMeter()
+	now := time.Now()
+	m.add("node-1", false, now.Add(-2*time.Minute))
+	m.add("node-1", false, now)
+	for range 3 {
+		m.add("node-1", true, now)
+	}
+
+	m.mu.Lock()
+	usage := m.nodes["node-1"].usage("node-1", now)
+	m.mu.Unlock()
+	expected := ConnectionUsage{Node: "node-1", Requests: 5, NewConnections: 2, RequestsPerMinute: 4, ConnectionsPerMinute: 1, ReuseRatio: 0.75}
+	if usage != expected {
+		t.Errorf("got %+v, expected %+v", usage, expected)
+	}
+}
+
+func TestConnectionUsage(t *testing.T) {
+	var last received
+	node := newNode(t, &last)
+	p := NewPooled(TransportConfig{})
+	if _, ok := p.ConnectionUsage("node-1"); ok || p.CountsConnections() {
+		t.Fatal("connections are counted before CountConnections")
+	}
+	p.CountConnections()
+
+	// Requests one after the other share a keep-alive connection
+	for range 3 {
+		resp, err := p.Forward("node-1", "", node.URL, httptest.NewRequest(http.MethodGet, "/request", nil), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	usage, ok := p.ConnectionUsage("node-1")
+	if !ok || usage.Requests != 3 || usage.NewConnections != 1 {
+		t.Errorf("got %+v, expected 3 requests over one connection", usage)
+	}
+	if _, ok := p.ConnectionUsage("node-2"); ok {
+		t.Error("got the usage of a node without requests")
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// egressWindow is how far back the egress rate of a node is averaged
+const egressWindow = time.Minute
+
+// EgressUsage struct represents the bytes written to the connections of a
+// node, request lines and headers included
+type EgressUsage struct {
+	Node string `json:"node"`
+	// Bytes is every byte written since the balancer started
+	Bytes int64 `json:"bytes"`
+	// BytesPerSecond is the average over the last minute
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// Limit is the node's egress cap in bytes per second, zero if uncapped
+	Limit int64 `json:"limit"`
+	// ThrottledSeconds is how long writes to the node waited for the cap
+	ThrottledSeconds float64 `json:"throttled_seconds"`
+}
+
+type nodeKey struct{}
+
+// withNode tags the upstream request context with the node it goes to, so
+// connections dialed for it count their bytes toward the node
+func withNode(ctx context.Context, nodeID string) context.Context {
+	return context.WithValue(ctx, nodeKey{}, nodeID)
+}
+
+// egressMeter measures the bytes written to the connections of each node and
+// holds writes back to keep nodes under their egress caps
+type egressMeter struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeEgress
+	// limit returns the egress cap of a node, see Proxy.SetEgressLimits
+	limit func(nodeID string) int64
+}
+
+// nodeEgress is the egress of one node: per second totals over the last
+// egressWindow and the token bucket of its cap
+type nodeEgress struct {
+	bytes     int64
+	seconds   [int(egressWindow / time.Second)]int64
+	totals    [int(egressWindow / time.Second)]int64
+	throttled time.Duration
+	tokens    float64
+	filled    time.Time
+}
+
+func newEgressMeter() *egressMeter {
+	return &egressMeter{nodes: map[string]*nodeEgress{}}
+}
+
+func (m *egressMeter) setLimits(limit func(nodeID string) int64) {
+	m.mu.Lock()
+	m.limit = limit
+	m.mu.Unlock()
+}
+
+// node returns the egress of nodeID, m.mu held
+func (m *egressMeter) node(nodeID string) *nodeEgress {
+	e, ok := m.nodes[nodeID]
+	if !ok {
+		e = &nodeEgress{}
+		m.nodes[nodeID] = e
+	}
+	return e
+}
+
+// reserve takes up to n bytes of the node's cap, and returns how many bytes
+// may be written and how long to wait before writing them. Writes of more
+// than a second's worth are split, so a large body is paced rather than
+// sent in one burst after a long wait.
+func (m *egressMeter) reserve(nodeID string, n int, now time.Time) (int, time.Duration) {
+	m.mu.Lock()
+	limit := m.limit
+	m.mu.Unlock()
+	if limit == nil {
+		return n, 0
+	}
+	rate := limit(nodeID)
+	if rate <= 0 {
+		return n, 0
+	}
+	n = min(n, int(rate))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.node(nodeID)
+	if e.filled.IsZero() {
+		e.tokens = float64(rate)
+	} else {
+		e.tokens = min(float64(rate), e.tokens+now.Sub(e.filled).Seconds()*float64(rate))
+	}
+	e.filled = now
+	e.tokens -= float64(n)
+	if e.tokens >= 0 {
+		return n, 0
+	}
+	wait := time.Duration(-e.tokens / float64(rate) * float64(time.Second))
+	e.throttled += wait
+	return n, wait
+}
+
+// add counts n bytes written to nodeID
+func (m *egressMeter) add(nodeID string, n int, now time.Time) {
+	m.mu.Lock()
+	e := m.node(nodeID)
+	e.bytes += int64(n)
+	second := now.Unix()
+	slot := int(second % int64(len(e.seconds)))
+	if e.seconds[slot] != second {
+		e.seconds[slot], e.totals[slot] = second, 0
+	}
+	e.totals[slot] += int64(n)
+	m.mu.Unlock()
+	metrics.UpstreamEgressBytes.WithLabelValues(nodeID).Add(float64(n))
+}
+
+// usage returns the egress of every node written to so far
+func (m *egressMeter) usage(now time.Time) []EgressUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := make([]EgressUsage, 0, len(m.nodes))
+	for nodeID, e := range m.nodes {
+		u := EgressUsage{Node: nodeID, Bytes: e.bytes, ThrottledSeconds: e.throttled.Seconds()}
+		var recent int64
+		for slot, second := range e.seconds {
+			if age := now.Unix() - second; age >= 0 && age < int64(len(e.seconds)) {
+				recent += e.totals[slot]
+			}
+		}
+		u.BytesPerSecond = float64(recent) / egressWindow.Seconds()
+		if m.limit != nil {
+			u.Limit = m.limit(nodeID)
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// meteredConn counts the bytes written to a node's connection and paces
+// them to the node's egress cap
+type meteredConn struct {
+	net.Conn
+	node  string
+	meter *egressMeter
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, wait := c.meter.reserve(c.node, len(b)-written, time.Now())
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		n, err := c.Conn.Write(b[written : written+n])
+		c.meter.add(c.node, n, time.Now())
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// SetEgressLimits makes the proxy keep the bytes written to each node under
+// the cap limit returns for it, in bytes per second, zero leaving a node
+// uncapped
+func (p *Proxy) SetEgressLimits(limit func(nodeID string) int64) {
+	p.egress.setLimits(limit)
+}
+
+// EgressUsage returns the bytes written to the connections of a node so far
+func (p *Proxy) EgressUsage(nodeID string) (EgressUsage, bool) {
+	for _, u := range p.egress.usage(time.Now()) {
+		if u.Node == nodeID {
+			return u, true
+		}
+	}
+	return EgressUsage{}, false
+}
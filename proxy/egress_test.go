@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressReserve(t *testing.T) {
+	m := newEgressMeter()
+	if n, wait := m.reserve("node-1", 500, time.Now()); n != 500 || wait != 0 {
+		t.Fatalf("got %d bytes after %v without caps, expected all at once", n, wait)
+	}
+	m.setLimits(func(nodeID string) int64 {
+		if nodeID == "node-1" {
+			return 100
+		}
+		return 0
+	})
+
+	now := time.Now()
+	tests := []struct {
+		after    time.Duration
+		n        int
+		expected int
+		wait     time.Duration
+	}{
+		// Writes over a second's worth are split
+		{0, 150, 100, 0},
+		{0, 50, 50, 500 * time.Millisecond},
+		// The bucket refills at the cap, up to a second's worth
+		{2 * time.Second, 100, 100, 0},
+		{2 * time.Second, 10, 10, 100 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		n, wait := m.reserve("node-1", tt.n, now.Add(tt.after))
+		if n != tt.expected || wait != tt.wait {
+			t.Errorf("write %d: got %d bytes after %v, expected %d after %v", i+1, n, wait, tt.expected, tt.wait)
+		}
+	}
+	if n, wait := m.reserve("node-2", 500, now); n != 500 || wait != 0 {
+		t.Errorf("got %d bytes after %v for an uncapped node, expected all at once", n, wait)
+	}
+}
+
+func TestEgressUsage(t *testing.T) {
+	m := newEgressMeter()
+	now := time.Now()
+	m.add("node-1", 600, now.Add(-2*time.Minute))
+	m.add("node-1", 1200, now.Add(-time.Second))
+	m.add("node-1", 600, now)
+	usage := m.usage(now)
+	if len(usage) != 1 || usage[0].Bytes != 2400 || usage[0].BytesPerSecond != 30 || usage[0].Limit != 0 {
+		t.Errorf("got %+v, expected 2400 bytes at 30 bytes/s over the last minute", usage)
+	}
+}
+
+func TestEgressLimits(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer node.Close()
+	p := New(nil)
+	p.SetEgressLimits(func(string) int64 { return 2000 })
+
+	// The first second's worth goes out at once, the rest at the cap
+	started := time.Now()
+	r := httptest.NewRequest(http.MethodPost, "/request", nil)
+	resp, err := p.Forward("node-1", "", node.URL, r, []byte(strings.Repeat("x", 3000)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Errorf("sent 3000 bytes in %v, expected the 2000 bytes/s cap to hold them back", elapsed)
+	}
+	usage, ok := p.EgressUsage("node-1")
+	if !ok || usage.Bytes < 3000 || usage.Limit != 2000 || usage.ThrottledSeconds == 0 {
+		t.Errorf("got %+v, expected the body counted and throttled", usage)
+	}
+}
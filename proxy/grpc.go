@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewGRPCTransport returns a transport speaking unencrypted HTTP/2 (h2c), as
+// gRPC backends behind the balancer do, over TCP or the Unix socket of nodes
+// with a unix:// address
+func NewGRPCTransport() *http.Transport {
+	var dialer net.Dialer
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			network, addr = dialTarget(network, addr)
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// MessageCounter counts the gRPC messages and their payload bytes flowing
+// through a stream, excluding the 5-byte length-prefix of each message
+type MessageCounter struct {
+	io.ReadCloser
+
+	header    [5]byte
+	headerLen int
+	remaining uint32
+
+	Messages int
+	Bytes    int64
+}
+
+func (c *MessageCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count(p[:n])
+	return n, err
+}
+
+func (c *MessageCounter) count(b []byte) {
+	for len(b) > 0 {
+		if c.remaining > 0 {
+			n := min(uint32(len(b)), c.remaining)
+			c.Bytes += int64(n)
+			c.remaining -= n
+			b = b[n:]
+			continue
+		}
+
+		n := copy(c.header[c.headerLen:], b)
+		c.headerLen += n
+		b = b[n:]
+		if c.headerLen == len(c.header) {
+			// 1 byte compressed flag, 4 bytes big-endian payload length
+			c.remaining = binary.BigEndian.Uint32(c.header[1:])
+			c.headerLen = 0
+			c.Messages++
+		}
+	}
+}
+
+// grpcUnavailable is the gRPC status of calls the node could not be reached for
+const grpcUnavailable = "14"
+
+// ForwardGRPC proxies a gRPC call to the node at address, streaming in both
+// directions and passing trailers through. It returns the counters of the
+// messages sent to and received from the node once the call is over. When
+// the node cannot be reached the call is answered with UNAVAILABLE and the
+// error is returned.
+func (p *Proxy) ForwardGRPC(w http.ResponseWriter, r *http.Request, address string) (sent, received *MessageCounter, err error) {
+	target, err := url.Parse(baseURL(address))
+	if err != nil {
+		grpcFailed(w, err)
+		return nil, nil, err
+	}
+	sent = &MessageCounter{ReadCloser: r.Body}
+	received = &MessageCounter{ReadCloser: http.NoBody}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if _, ok := unixSocket(address); ok {
+				pr.Out.Host = "localhost"
+			}
+			pr.Out.Body = sent
+			if p.signer != nil {
+				p.signer.Sign(pr.Out, nil)
+			}
+		},
+		Transport: p.grpcTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			received.ReadCloser = resp.Body
+			resp.Body = received
+			return nil
+		},
+		// Stream messages as soon as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, forwardErr error) {
+			err = forwardErr
+			grpcFailed(w, forwardErr)
+		},
+	}
+	reverseProxy.ServeHTTP(w, r)
+	return sent, received, err
+}
+
+// grpcFailed answers a call the node was not reached for with UNAVAILABLE,
+// as a trailers-only response
+func grpcFailed(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", grpcUnavailable)
+	w.Header().Set("Grpc-Message", err.Error())
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,206 @@
+// Package proxy forwards client requests to backend nodes.
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Proxy forwards requests to nodes, with one HTTP client per node pool
+type Proxy struct {
+	// client, if set, serves every pool
+	client        *http.Client
+	transport     TransportConfig
+	grpcTransport http.RoundTripper
+	signer        *Signer
+	egress        *egressMeter
+	// connections counts the connection use of every node, if set
+	connections *connectionMeter
+
+	mu    sync.Mutex
+	pools map[string]*http.Client
+}
+
+// New returns a proxy that sends every upstream request with client, or
+// with a separate client per node pool using the default TransportConfig
+// when client is nil. Either way request contexts are honored, so cancelled
+// requests stop waiting for their node.
+func New(client *http.Client) *Proxy {
+	return &Proxy{client: client, grpcTransport: NewGRPCTransport(), egress: newEgressMeter(), pools: map[string]*http.Client{}}
+}
+
+// NewPooled returns a proxy that gives every node pool its own connection
+// pool configured by config, so a slow pool cannot use up the connections of
+// the others
+func NewPooled(config TransportConfig) *Proxy {
+	return &Proxy{transport: config, grpcTransport: NewGRPCTransport(), egress: newEgressMeter(), pools: map[string]*http.Client{}}
+}
+
+// SetSigner makes the proxy sign every forwarded request with s, or stop
+// signing when s is nil
+func (p *Proxy) SetSigner(s *Signer) {
+	p.signer = s
+}
+
+// Forward replays the client request against the node at address. Hop-by-hop
+// headers are dropped in both directions and X-Forwarded-* headers are added
+// before the transformers run. The request is signed after the transformers,
+// so the signature covers what the node receives.
+//
+// pool names the node's pool, whose connections the request uses; the bytes
+// written to them count toward nodeID's egress, see EgressUsage, and the
+// connection it gets toward its ConnectionUsage.
+func (p *Proxy) Forward(nodeID, pool, address string, r *http.Request, body []byte, transform Transformer) (*http.Response, error) {
+	return p.forward(nodeID, pool, address, r, bytes.NewReader(body), int64(len(body)), body, transform)
+}
+
+// ErrStreamSigned means a request body could not be streamed to a node
+// because the proxy signs requests, which takes the whole body
+var ErrStreamSigned = errors.New("signed requests cannot stream their body")
+
+// ForwardStream forwards r like Forward, streaming its body to the node as
+// it is read from the client instead of sending a body read up front. The
+// body can only be sent once. Requests are not streamed while the proxy
+// signs them, see Signs.
+func (p *Proxy) ForwardStream(nodeID, pool, address string, r *http.Request, transform Transformer) (*http.Response, error) {
+	if p.signer != nil {
+		return nil, ErrStreamSigned
+	}
+	body := r.Body
+	if r.ContentLength == 0 {
+		body = http.NoBody
+	}
+	return p.forward(nodeID, pool, address, r, body, r.ContentLength, nil, transform)
+}
+
+// Signs reports whether the proxy signs forwarded requests
+func (p *Proxy) Signs() bool {
+	return p.signer != nil
+}
+
+// forward sends r to the node with body, of contentLength bytes or -1 when
+// unknown; signed is the body the signature covers
+func (p *Proxy) forward(nodeID, pool, address string, r *http.Request, body io.Reader, contentLength int64, signed []byte, transform Transformer) (*http.Response, error) {
+	ctx := withNode(r.Context(), nodeID)
+	if p.connections != nil {
+		ctx = p.connections.trace(ctx, nodeID)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, baseURL(address)+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	if _, ok := unixSocket(address); ok {
+		req.Host = "localhost"
+	}
+	req.Header = r.Header.Clone()
+	removeHopByHopHeaders(req.Header)
+	setForwardedHeaders(req, r)
+	if transform != nil {
+		transform.TransformRequest(req)
+	}
+	if p.signer != nil {
+		p.signer.Sign(req, signed)
+	}
+
+	resp, err := p.clientFor(pool).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	removeHopByHopHeaders(resp.Header)
+	if transform != nil {
+		transform.TransformResponse(resp)
+	}
+	return resp, nil
+}
+
+// baseURL turns a node address into a URL, defaulting to plain HTTP for
+// host:port addresses. unix:// addresses get a host name of their own, see
+// unixHost.
+func baseURL(address string) string {
+	if socket, ok := unixSocket(address); ok {
+		return "http://" + unixHost(socket)
+	}
+	if strings.Contains(address, "://") {
+		return address
+	}
+	return "http://" + address
+}
+
+// Relay copies the node's response to the client
+func Relay(w http.ResponseWriter, resp *http.Response) error {
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, resp.Body)
+	return err
+}
+
+// ErrResponseTooLarge means a node's response exceeded the size limit
+var ErrResponseTooLarge = errors.New("response exceeds the size limit")
+
+// ResponseErrorTrailer is the trailer set on responses that RelayLimited cut short
+const ResponseErrorTrailer = "X-Response-Error"
+
+// RelayLimited copies the node's response to the client like Relay, but
+// stops after max bytes of body. A response cut short ends with the
+// ResponseErrorTrailer trailer and ErrResponseTooLarge is returned. Responses
+// whose Content-Length already exceeds max are left to the caller, who can
+// still answer with an error instead. A max of zero or less means no limit.
+func RelayLimited(w http.ResponseWriter, resp *http.Response, max int64) error {
+	if max <= 0 {
+		return Relay(w, resp)
+	}
+	if resp.ContentLength > max {
+		return ErrResponseTooLarge
+	}
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, max)); err != nil {
+		return err
+	}
+	if n, _ := io.ReadFull(resp.Body, make([]byte, 1)); n == 0 {
+		return nil
+	}
+	w.Header().Set(http.TrailerPrefix+ResponseErrorTrailer, fmt.Sprintf("response truncated at %d bytes", max))
+	return ErrResponseTooLarge
+}
+
+// ResponseTruncatedHeader is set on responses RelayTruncated cuts short
+// knowing so up front from their Content-Length
+const ResponseTruncatedHeader = "X-Response-Truncated"
+
+// RelayTruncated copies the node's response to the client like
+// RelayLimited, but relays the first max bytes of responses whose
+// Content-Length already exceeds max as well, flagged with the
+// ResponseTruncatedHeader header since their headers are sent after it is
+// known.
+func RelayTruncated(w http.ResponseWriter, resp *http.Response, max int64) error {
+	if max > 0 && resp.ContentLength > max {
+		resp.Header.Del("Content-Length")
+		resp.Header.Set(ResponseTruncatedHeader, fmt.Sprintf("response of %d bytes truncated at %d bytes", resp.ContentLength, max))
+		resp.ContentLength = -1
+	}
+	return RelayLimited(w, resp, max)
+}
+
+// ReadLimited reads the whole of body, failing with ErrResponseTooLarge once
+// it exceeds max bytes. A max of zero or less means no limit.
+func ReadLimited(body io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, max+1))
+	if err == nil && int64(len(data)) > max {
+		return nil, ErrResponseTooLarge
+	}
+	return data, err
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received struct represents what the test node got
+type received struct {
+	method, uri, body string
+	header            http.Header
+}
+
+// newNode starts a node recording the last request and answering with a
+// Connection hop-by-hop header and a body
+func newNode(t *testing.T, last *received) *httptest.Server {
+	t.Helper()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*last = received{method: r.Method, uri: r.URL.RequestURI(), body: string(body), header: r.Header.Clone()}
+		w.Header().Set("Connection", "X-Private")
+		w.Header().Set("X-Private", "hop")
+		w.Header().Set("X-Node", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "answer")
+	}))
+	t.Cleanup(node.Close)
+	return node
+}
+
+func TestForward(t *testing.T) {
+	var last received
+	node := newNode(t, &last)
+
+	tests := []struct {
+		name      string
+		address   string
+		transform Transformer
+		uri       string
+		check     func(t *testing.T, last received)
+	}{
+		{
+			name:    "host and port address",
+			address: strings.TrimPrefix(node.URL, "http://"),
+			uri:     "/request?x=1",
+		},
+		{
+			name:    "URL address",
+			address: node.URL,
+			uri:     "/request?x=1",
+		},
+		{
+			name:    "path rewrite and headers",
+			address: node.URL,
+			transform: func() Transformer {
+				rules := &Rules{Path: &PathRewrite{Match: "^/request(.*)", Replace: "/v1/request$1"}, RequestHeaders: HeaderRules{Set: map[string]string{"X-Added": "1"}, Remove: []string{"X-Secret"}}}
+				if err := rules.Compile(); err != nil {
+					t.Fatal(err)
+				}
+				return rules
+			}(),
+			uri: "/v1/request?x=1",
+			check: func(t *testing.T, last received) {
+				if last.header.Get("X-Added") != "1" || last.header.Get("X-Secret") != "" {
+					t.Errorf("got headers %v, expected X-Added set and X-Secret removed", last.header)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(nil)
+			r := httptest.NewRequest(http.MethodPost, "http://lb.example.com/request?x=1", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+			r.Header.Set("Connection", "X-Hop")
+			r.Header.Set("X-Hop", "1")
+			r.Header.Set("X-Secret", "s")
+			resp, err := p.Forward("node-1", "", tt.address, r, []byte(`{"bpm":1}`), tt.transform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if last.method != http.MethodPost || last.uri != tt.uri || last.body != `{"bpm":1}` {
+				t.Errorf("node got %s %s %q", last.method, last.uri, last.body)
+			}
+			if got := last.header.Get("X-Forwarded-For"); got != "192.0.2.1, 10.0.0.1" {
+				t.Errorf("X-Forwarded-For is %q", got)
+			}
+			if last.header.Get("X-Forwarded-Host") != "lb.example.com" || last.header.Get("X-Forwarded-Proto") != "http" {
+				t.Errorf("got forwarded headers %v", last.header)
+			}
+			if last.header.Get("X-Hop") != "" || last.header.Get("Connection") != "" {
+				t.Error("hop-by-hop request headers were forwarded")
+			}
+			if resp.StatusCode != http.StatusCreated || string(body) != "answer" || resp.Header.Get("X-Node") != "yes" {
+				t.Errorf("got %d %q %v", resp.StatusCode, body, resp.Header)
+			}
+			if resp.Header.Get("X-Private") != "" {
+				t.Error("hop-by-hop response headers were kept")
+			}
+			if tt.check != nil {
+				tt.check(t, last)
+			}
+		})
+	}
+}
+
+func TestForwardUnreachable(t *testing.T) {
+	node := httptest.NewServer(http.NotFoundHandler())
+	address := node.URL
+	node.Close()
+	r := httptest.NewRequest(http.MethodGet, "/request", nil)
+	if _, err := New(nil).Forward("node-1", "", address, r, nil, nil); err == nil {
+		t.Error("expected an error forwarding to a closed node")
+	}
+}
+
+func TestForwardStream(t *testing.T) {
+	var last received
+	node := newNode(t, &last)
+	p := New(nil)
+	r := httptest.NewRequest(http.MethodPut, "/items/2?x=1", strings.NewReader("streamed"))
+	resp, err := p.ForwardStream("node-1", "", node.URL, r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if last.method != http.MethodPut || last.uri != "/items/2?x=1" || last.body != "streamed" {
+		t.Errorf("got %+v, expected the PUT streamed as it came", last)
+	}
+
+	signer, err := NewSigner([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSigner(signer)
+	r = httptest.NewRequest(http.MethodPut, "/items/2", strings.NewReader("streamed"))
+	if _, err := p.ForwardStream("node-1", "", node.URL, r, nil); !errors.Is(err, ErrStreamSigned) || !p.Signs() {
+		t.Errorf("got %v, expected signed requests not streamed", err)
+	}
+}
+
+func TestSigning(t *testing.T) {
+	var last received
+	node := newNode(t, &last)
+	signer, err := NewSigner([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(nil)
+	p.SetSigner(signer)
+	body := []byte(`{"bpm":1}`)
+	resp, err := p.Forward("node-1", "", node.URL, httptest.NewRequest(http.MethodPost, "/request", nil), body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	backend := httptest.NewRequest(last.method, last.uri, nil)
+	backend.Header = last.header
+	tests := []struct {
+		name    string
+		signer  *Signer
+		body    []byte
+		wantErr bool
+	}{
+		{name: "valid", signer: signer, body: body},
+		{name: "other body", signer: signer, body: []byte(`{"bpm":2}`), wantErr: true},
+		{name: "other key", signer: &Signer{key: []byte("other")}, body: body, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.signer.Verify(backend, tt.body, time.Minute); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := NewSigner(nil); err == nil {
+		t.Error("expected an error for an empty key")
+	}
+}
+
+func TestRelayLimited(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		max           int64
+		expected      string
+		wantErr       error
+	}{
+		{name: "no limit", body: "hello", contentLength: -1, expected: "hello"},
+		{name: "under the limit", body: "hello", contentLength: -1, max: 10, expected: "hello"},
+		{name: "at the limit", body: "hello", contentLength: -1, max: 5, expected: "hello"},
+		{name: "over the limit", body: "hello world", contentLength: -1, max: 5, expected: "hello", wantErr: ErrResponseTooLarge},
+		{name: "content length over the limit", body: "hello world", contentLength: 11, max: 5, wantErr: ErrResponseTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tt.body)), ContentLength: tt.contentLength}
+			w := httptest.NewRecorder()
+			err := RelayLimited(w, resp, tt.max)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, expected %v", err, tt.wantErr)
+			}
+			if got := w.Body.String(); got != tt.expected {
+				t.Errorf("relayed %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		body    string
+		max     int64
+		wantErr bool
+	}{
+		{body: "hello", max: 0},
+		{body: "hello", max: 5},
+		{body: "hello", max: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		data, err := ReadLimited(strings.NewReader(tt.body), tt.max)
+		if tt.wantErr {
+			if !errors.Is(err, ErrResponseTooLarge) {
+				t.Errorf("max %d: got %v, expected ErrResponseTooLarge", tt.max, err)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.body {
+			t.Errorf("max %d: got %q, %v", tt.max, data, err)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	tests := []struct {
+		address, expected string
+	}{
+		{"localhost:9001", "http://localhost:9001"},
+		{"https://node.example.com", "https://node.example.com"},
+		{"http://10.0.0.1:80", "http://10.0.0.1:80"},
+	}
+	for _, tt := range tests {
+		if got := baseURL(tt.address); got != tt.expected {
+			t.Errorf("baseURL(%q) = %q, expected %q", tt.address, got, tt.expected)
+		}
+	}
+}
+
+func TestForwardGRPCUnreachable(t *testing.T) {
+	node := httptest.NewServer(http.NotFoundHandler())
+	address := node.URL
+	node.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", strings.NewReader(""))
+	r.Header.Set("Content-Type", "application/grpc")
+	if _, _, err := New(nil).ForwardGRPC(w, r, address); err == nil {
+		t.Fatal("expected an error forwarding to a closed node")
+	}
+	if got := w.Header().Get("Grpc-Status"); got != grpcUnavailable {
+		t.Errorf("grpc-status is %q, expected UNAVAILABLE", got)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Transformer rewrites a request before it is sent to a node and the node's
+// response before it is relayed to the client
+type Transformer interface {
+	TransformRequest(out *http.Request)
+	TransformResponse(resp *http.Response)
+}
+
+// Chain applies transformers in order
+type Chain []Transformer
+
+func (c Chain) TransformRequest(out *http.Request) {
+	for _, t := range c {
+		t.TransformRequest(out)
+	}
+}
+
+func (c Chain) TransformResponse(resp *http.Response) {
+	for _, t := range c {
+		t.TransformResponse(resp)
+	}
+}
+
+// hopByHopHeaders only apply to a single connection and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders drops the standard hop-by-hop headers and every header
+// the Connection header lists
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// setForwardedHeaders tells the node who the original client was
+func setForwardedHeaders(out, in *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+}
+
+// HeaderRules struct represents header edits, applied as remove, then set, then add
+type HeaderRules struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+func (h HeaderRules) apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// PathRewrite struct represents a regular expression replacement of the request path,
+// e.g. {"match": "^/request(.*)", "replace": "/v1/request$1"}
+type PathRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// Rules struct represents a declarative request/response transformation
+type Rules struct {
+	RequestHeaders  HeaderRules  `json:"request_headers"`
+	ResponseHeaders HeaderRules  `json:"response_headers"`
+	Path            *PathRewrite `json:"path,omitempty"`
+}
+
+// Compile prepares the rules for use and reports invalid path patterns
+func (r *Rules) Compile() error {
+	if r.Path == nil {
+		return nil
+	}
+	re, err := regexp.Compile(r.Path.Match)
+	if err != nil {
+		return fmt.Errorf("path rewrite %q: %w", r.Path.Match, err)
+	}
+	r.Path.re = re
+	return nil
+}
+
+func (r *Rules) TransformRequest(out *http.Request) {
+	r.RequestHeaders.apply(out.Header)
+	if r.Path != nil && r.Path.re != nil {
+		out.URL.Path = r.Path.re.ReplaceAllString(out.URL.Path, r.Path.Replace)
+		out.URL.RawPath = ""
+	}
+}
+
+func (r *Rules) TransformResponse(resp *http.Response) {
+	r.ResponseHeaders.apply(resp.Header)
+}
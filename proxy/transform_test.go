@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	header := http.Header{"X-Version": {"1"}, "X-Secret": {"s"}, "X-Tag": {"a"}}
+	HeaderRules{
+		Remove: []string{"x-secret", "X-Tag"},
+		Set:    map[string]string{"X-Version": "2"},
+		Add:    map[string]string{"X-Tag": "b", "X-Version": "3"},
+	}.apply(header)
+	expected := http.Header{"X-Version": {"2", "3"}, "X-Tag": {"b"}}
+	if !reflect.DeepEqual(header, expected) {
+		t.Errorf("got %v, expected %v", header, expected)
+	}
+}
+
+func TestChain(t *testing.T) {
+	first := &Rules{
+		RequestHeaders:  HeaderRules{Set: map[string]string{"X-Step": "first"}},
+		ResponseHeaders: HeaderRules{Set: map[string]string{"X-Step": "first"}, Remove: []string{"Server"}},
+		Path:            &PathRewrite{Match: "^/request(.*)", Replace: "/v1/request$1"},
+	}
+	second := &Rules{
+		RequestHeaders:  HeaderRules{Add: map[string]string{"X-Step": "second"}},
+		ResponseHeaders: HeaderRules{Set: map[string]string{"X-Step": "second"}},
+		Path:            &PathRewrite{Match: "^/v1/", Replace: "/api/v1/"},
+	}
+	for _, rules := range []*Rules{first, second} {
+		if err := rules.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chain := Chain{first, second}
+
+	out := &http.Request{URL: &url.URL{Path: "/request/1", RawPath: "/request%2F1"}, Header: http.Header{}}
+	chain.TransformRequest(out)
+	if out.URL.Path != "/api/v1/request/1" || out.URL.RawPath != "" {
+		t.Errorf("got path %q (raw %q), expected both rewrites in order", out.URL.Path, out.URL.RawPath)
+	}
+	if got := out.Header.Values("X-Step"); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("got request X-Step %v", got)
+	}
+
+	resp := &http.Response{Header: http.Header{"Server": {"node"}}}
+	chain.TransformResponse(resp)
+	if got := resp.Header; !reflect.DeepEqual(got, http.Header{"X-Step": {"second"}}) {
+		t.Errorf("got response headers %v", got)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	if err := (&Rules{}).Compile(); err != nil {
+		t.Errorf("rules without a path rewrite: %v", err)
+	}
+	if err := (&Rules{Path: &PathRewrite{Match: "^/request(", Replace: "/"}}).Compile(); err == nil {
+		t.Error("an invalid pattern compiled")
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"X-Private, close", "X-Other"},
+		"X-Private":         {"hop"},
+		"X-Other":           {"hop"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"X-Node":            {"end-to-end"},
+	}
+	removeHopByHopHeaders(header)
+	if expected := (http.Header{"X-Node": {"end-to-end"}}); !reflect.DeepEqual(header, expected) {
+		t.Errorf("got %v, expected %v", header, expected)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// TransportConfig struct represents how the connections to the nodes of a
+// pool are made and kept. Zero timeouts leave a phase unbounded and zero
+// limits leave the connection count unbounded, except MaxIdleConnsPerHost
+// which then keeps the net/http default of 2.
+type TransportConfig struct {
+	// DialTimeout bounds establishing a connection to a node
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with https nodes
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for a node's response headers once the request is sent
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an idle keep-alive connection is kept
+	IdleConnTimeout time.Duration
+	// MaxIdleConns bounds the idle connections of the pool across its nodes
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost bounds the connections to one node, idle or not;
+	// requests beyond it wait for a connection
+	MaxConnsPerHost int
+	// EgressProxies maps pools to the proxy their nodes are reached
+	// through, see ParseEgressProxy; "default" names the nodes without a
+	// pool. Pools without one use the proxy of the environment, if any.
+	EgressProxies map[string]*url.URL
+}
+
+// ParseEgressProxy parses the URL of an egress proxy: http:// or https://
+// for an HTTP proxy, tunnelling to https nodes with CONNECT, or socks5://
+// for a SOCKS5 proxy, socks5h:// letting the proxy resolve node names.
+// Credentials go in the URL's user info.
+func ParseEgressProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("egress proxy %q: scheme must be http, https, socks5 or socks5h", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("egress proxy %q has no host", raw)
+	}
+	return u, nil
+}
+
+// clientFor returns the client of a node pool, creating it on first use
+func (p *Proxy) clientFor(pool string) *http.Client {
+	if p.client != nil {
+		return p.client
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	client, ok := p.pools[pool]
+	if !ok {
+		client = newPoolClient(pool, p.transport, p.egress)
+		p.pools[pool] = client
+	}
+	return client
+}
+
+// newPoolClient returns a client for the nodes of pool that relays
+// redirects to the client rather than following them, through the pool's
+// egress proxy if it has one. Connections dialed for a node count their
+// bytes in egress.
+func newPoolClient(pool string, config TransportConfig, egress *egressMeter) *http.Client {
+	label := pool
+	if label == "" {
+		label = "default"
+	}
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		network, addr = dialTarget(network, addr)
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		metrics.UpstreamConnections.WithLabelValues(label).Inc()
+		conn = &trackedConn{Conn: conn, pool: label}
+		if nodeID, ok := ctx.Value(nodeKey{}).(string); ok {
+			conn = &meteredConn{Conn: conn, node: nodeID, meter: egress}
+		}
+		return conn, nil
+	}
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	proxyFor := transport.Proxy
+	if egressProxy, ok := config.EgressProxies[label]; ok {
+		// Dials above reach the proxy, whose connections count for the node
+		proxyFor = http.ProxyURL(egressProxy)
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if _, ok := socketOf(req.URL.Host); ok {
+			// Unix socket nodes are local, never behind a proxy
+			return nil, nil
+		}
+		return proxyFor(req)
+	}
+
+	return &http.Client{
+		Transport:     &instrumentedTransport{next: transport, pool: label},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// trackedConn keeps lb_upstream_connections up to date when it is closed
+type trackedConn struct {
+	net.Conn
+	pool string
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { metrics.UpstreamConnections.WithLabelValues(c.pool).Dec() })
+	return c.Conn.Close()
+}
+
+// instrumentedTransport counts the requests in flight in a pool and whether
+// they reused a keep-alive connection
+type instrumentedTransport struct {
+	next http.RoundTripper
+	pool string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result := "new"
+			if info.Reused {
+				result = "reused"
+			}
+			metrics.UpstreamConnectionUse.WithLabelValues(t.pool, result).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	metrics.UpstreamRequestsInFlight.WithLabelValues(t.pool).Inc()
+	defer metrics.UpstreamRequestsInFlight.WithLabelValues(t.pool).Dec()
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+)
+
+// unixScheme prefixes the addresses of nodes listening on a Unix domain
+// socket, as in unix:///run/app.sock
+const unixScheme = "unix://"
+
+// unixHostSuffix ends the host names given to Unix socket nodes
+const unixHostSuffix = ".unix.invalid"
+
+// unixSockets maps the host names given to Unix socket nodes to their
+// socket path, see unixHost
+var unixSockets sync.Map
+
+// unixSocket returns the socket path of a unix:// node address
+func unixSocket(address string) (string, bool) {
+	return strings.CutPrefix(address, unixScheme)
+}
+
+// unixHost returns the host name requests to the node listening on socket
+// are sent to. It is unique per socket, so that keep-alive connections to
+// different sockets are never mixed up in a connection pool.
+func unixHost(socket string) string {
+	h := fnv.New64a()
+	h.Write([]byte(socket))
+	host := fmt.Sprintf("%x%s", h.Sum64(), unixHostSuffix)
+	unixSockets.Store(host, socket)
+	return host
+}
+
+// socketOf returns the socket path addr, a host or host:port, stands for
+// when it is the host name of a Unix socket node
+func socketOf(addr string) (string, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !strings.HasSuffix(addr, unixHostSuffix) {
+		return "", false
+	}
+	socket, ok := unixSockets.Load(addr)
+	if !ok {
+		return "", false
+	}
+	return socket.(string), true
+}
+
+// dialTarget returns the network and address a connection to addr is
+// dialed at, the node's socket for the host names of Unix socket nodes
+func dialTarget(network, addr string) (string, string) {
+	if socket, ok := socketOf(addr); ok {
+		return "unix", socket
+	}
+	return network, addr
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newUnixNode starts a node on a Unix socket answering with name and the
+// Host it was sent, returning the node's address
+func newUnixNode(t *testing.T, dir, name string) string {
+	t.Helper()
+	socket := filepath.Join(dir, name+".sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.Host)
+	})}
+	go node.Serve(listener)
+	t.Cleanup(func() { node.Close() })
+	return unixScheme + socket
+}
+
+func TestUnixSocketNodes(t *testing.T) {
+	// Socket paths are short, so not under t.TempDir
+	dir, err := os.MkdirTemp("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addresses := map[string]string{"a": newUnixNode(t, dir, "a"), "b": newUnixNode(t, dir, "b")}
+
+	p := NewPooled(TransportConfig{})
+	for range 2 {
+		for name, address := range addresses {
+			resp, err := p.Forward("node-"+name, "", address, httptest.NewRequest(http.MethodGet, "/request", nil), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if expected := name + " localhost"; string(body) != expected {
+				t.Errorf("got %q, expected %q", body, expected)
+			}
+		}
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	host := unixHost("/run/app.sock")
+	tests := []struct {
+		addr            string
+		network, target string
+	}{
+		{addr: host + ":80", network: "unix", target: "/run/app.sock"},
+		{addr: host, network: "unix", target: "/run/app.sock"},
+		{addr: "other" + unixHostSuffix + ":80", network: "tcp", target: "other" + unixHostSuffix + ":80"},
+		{addr: "node:8080", network: "tcp", target: "node:8080"},
+	}
+	for _, tt := range tests {
+		if network, target := dialTarget("tcp", tt.addr); network != tt.network || target != tt.target {
+			t.Errorf("dialTarget(%q) = %s %s, expected %s %s", tt.addr, network, target, tt.network, tt.target)
+		}
+	}
+	if unixHost("/run/other.sock") == host {
+		t.Error("two sockets got the same host name")
+	}
+}
@@ -0,0 +1,140 @@
+// Package replication exchanges the usage of the global limits between
+// balancers running in different regions against regional stores.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Window struct represents the usage of one global limit window in a region
+type Window struct {
+	PeriodSeconds int64 `json:"period_seconds"`
+	Requests      int   `json:"requests"`
+	Bytes         int   `json:"bytes"`
+}
+
+// Period returns the length of the window
+func (w Window) Period() time.Duration {
+	return time.Duration(w.PeriodSeconds) * time.Second
+}
+
+// Snapshot struct represents the usage of every global limit window in a
+// region at one moment, as taken by a balancer of that region
+type Snapshot struct {
+	Region  string    `json:"region"`
+	At      time.Time `json:"at"`
+	Windows []Window  `json:"windows"`
+}
+
+// Window returns the usage of the window of period, false when the region
+// does not have one
+func (s Snapshot) Window(period time.Duration) (Window, bool) {
+	for _, w := range s.Windows {
+		if w.Period() == period {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
+
+// Policy decides which usage of a region is kept when two snapshots of it
+// disagree, e.g. because they arrived through different peers or out of order
+type Policy int
+
+const (
+	// LastWriterWins keeps the snapshot taken last
+	LastWriterWins Policy = iota
+	// Merge keeps the higher usage of each window of two snapshots of one
+	// collection, taken less than half a replication interval apart, erring
+	// on the side of enforcing the limits when balancers of one region
+	// report different usage; of snapshots further apart it keeps the one
+	// taken last, so a region's usage falls again once its windows roll over
+	Merge
+)
+
+// ParsePolicy parses lww or merge
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "lww":
+		return LastWriterWins, nil
+	case "merge":
+		return Merge, nil
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q, expected lww or merge", s)
+}
+
+// Resolve returns the snapshot of a region to keep once received arrives
+// while known is held. interval is how often snapshots are collected.
+func (p Policy) Resolve(known, received Snapshot, interval time.Duration) Snapshot {
+	if p == LastWriterWins || received.At.Sub(known.At).Abs() >= interval/2 {
+		if received.At.After(known.At) {
+			return received
+		}
+		return known
+	}
+
+	merged := Snapshot{Region: known.Region, At: known.At}
+	if received.At.After(merged.At) {
+		merged.At = received.At
+	}
+	for _, w := range known.Windows {
+		if other, ok := received.Window(w.Period()); ok {
+			w.Requests, w.Bytes = max(w.Requests, other.Requests), max(w.Bytes, other.Bytes)
+		}
+		merged.Windows = append(merged.Windows, w)
+	}
+	for _, w := range received.Windows {
+		if _, ok := known.Window(w.Period()); !ok {
+			merged.Windows = append(merged.Windows, w)
+		}
+	}
+	return merged
+}
+
+// Peer fetches the snapshots a balancer of another region knows from its
+// admin API
+type Peer struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewPeer returns the peer at the base URL of a balancer, authenticating
+// with an admin token of the viewer role if token is not empty
+func NewPeer(url, token string) *Peer {
+	return &Peer{url: strings.TrimSuffix(url, "/"), token: token, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// String returns the peer's URL
+func (p *Peer) String() string {
+	return p.url
+}
+
+// Fetch returns the snapshots of every region the peer knows, its own included
+func (p *Peer) Fetch(ctx context.Context) ([]Snapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/admin/regions/usage", nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s returned %s", p.url, resp.Status)
+	}
+	var snapshots []Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		return nil, fmt.Errorf("peer %s: %w", p.url, err)
+	}
+	return snapshots, nil
+}
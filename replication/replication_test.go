@@ -0,0 +1,68 @@
+package replication
+
+import (
+	"testing"
+	"time"
+)
+
+func snapshot(at time.Time, requests int) Snapshot {
+	return Snapshot{Region: "us", At: at, Windows: []Window{{PeriodSeconds: 60, Requests: requests, Bytes: requests * 10}}}
+}
+
+func TestResolve(t *testing.T) {
+	now := time.Now()
+	interval := 5 * time.Second
+	tests := []struct {
+		name     string
+		policy   Policy
+		known    Snapshot
+		received Snapshot
+		expected int
+		at       time.Time
+	}{
+		{name: "lww newer", policy: LastWriterWins, known: snapshot(now, 50), received: snapshot(now.Add(time.Second), 10), expected: 10, at: now.Add(time.Second)},
+		{name: "lww older", policy: LastWriterWins, known: snapshot(now, 50), received: snapshot(now.Add(-time.Second), 90), expected: 50, at: now},
+		{name: "merge one collection", policy: Merge, known: snapshot(now, 50), received: snapshot(now.Add(time.Second), 10), expected: 50, at: now.Add(time.Second)},
+		{name: "merge older of one collection", policy: Merge, known: snapshot(now, 10), received: snapshot(now.Add(-time.Second), 50), expected: 50, at: now},
+		{name: "merge next collection", policy: Merge, known: snapshot(now, 50), received: snapshot(now.Add(interval), 10), expected: 10, at: now.Add(interval)},
+		{name: "merge previous collection", policy: Merge, known: snapshot(now, 10), received: snapshot(now.Add(-interval), 50), expected: 10, at: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Resolve(tt.known, tt.received, interval)
+			w, _ := got.Window(time.Minute)
+			if w.Requests != tt.expected || !got.At.Equal(tt.at) {
+				t.Errorf("kept %d requests at %s, expected %d at %s", w.Requests, got.At, tt.expected, tt.at)
+			}
+		})
+	}
+}
+
+func TestMergeFallsAfterRollover(t *testing.T) {
+	// A burst of 100 requests is reported, then the region goes quiet and
+	// its window rolls over while reports keep arriving every interval
+	interval := 5 * time.Second
+	start := time.Now()
+	known := snapshot(start, 100)
+	for i := 1; i <= 20; i++ {
+		requests := 100
+		if elapsed := time.Duration(i) * interval; elapsed > time.Minute {
+			requests = 0
+		}
+		known = Merge.Resolve(known, snapshot(start.Add(time.Duration(i)*interval), requests), interval)
+	}
+	if w, _ := known.Window(time.Minute); w.Requests != 0 {
+		t.Errorf("region still reports %d requests after its window rolled over", w.Requests)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, expected := range map[string]Policy{"lww": LastWriterWins, "merge": Merge} {
+		if got, err := ParsePolicy(s); err != nil || got != expected {
+			t.Errorf("ParsePolicy(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParsePolicy("max"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,279 @@
+package rulexpr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Kinds of tokens
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenString
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenEqual
+	tokenNotEqual
+	tokenMatch
+	tokenLParen
+	tokenRParen
+)
+
+// operators maps the spelling of operators to their token kind, longest first
+var operators = []struct {
+	text string
+	kind int
+}{
+	{"&&", tokenAnd}, {"||", tokenOr}, {"==", tokenEqual}, {"!=", tokenNotEqual}, {"=~", tokenMatch},
+	{"!", tokenNot}, {"(", tokenLParen}, {")", tokenRParen},
+}
+
+type token struct {
+	kind int
+	text string
+	// pos is the byte offset of the token in the source
+	pos int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// SyntaxError struct represents where and why an expression does not parse
+type SyntaxError struct {
+	// Pos is the byte offset of the error in the expression
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("at offset %d: %s", e.Pos, e.Msg)
+}
+
+// parser is a recursive descent parser of
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | boolean | value ( "==" | "!=" ) value | value "=~" string
+//	boolean = "true" | "false" | predicate "(" string ")"
+//	value   = string | function "(" string ")" | attribute
+type parser struct {
+	source string
+	offset int
+	token  token
+	// err is the first error of the lexer, reported at the next token
+	err error
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &SyntaxError{Pos: p.token.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token into p.token
+func (p *parser) next() {
+	for p.offset < len(p.source) && unicode.IsSpace(rune(p.source[p.offset])) {
+		p.offset++
+	}
+	start := p.offset
+	if start == len(p.source) {
+		p.token = token{kind: tokenEOF, pos: start}
+		return
+	}
+	rest := p.source[start:]
+	for _, op := range operators {
+		if strings.HasPrefix(rest, op.text) {
+			p.offset += len(op.text)
+			p.token = token{kind: op.kind, text: op.text, pos: start}
+			return
+		}
+	}
+	c := rest[0]
+	switch {
+	case c == '"':
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			p.token = token{kind: tokenEOF, pos: start}
+			p.err = &SyntaxError{Pos: start, Msg: "unterminated or invalid string"}
+			return
+		}
+		text, _ := strconv.Unquote(quoted)
+		p.offset += len(quoted)
+		p.token = token{kind: tokenString, text: text, pos: start}
+	case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		end := start
+		for end < len(p.source) && (p.source[end] == '_' || 'a' <= p.source[end] && p.source[end] <= 'z' || 'A' <= p.source[end] && p.source[end] <= 'Z' || '0' <= p.source[end] && p.source[end] <= '9') {
+			end++
+		}
+		p.offset = end
+		p.token = token{kind: tokenIdent, text: p.source[start:end], pos: start}
+	default:
+		p.token = token{kind: tokenEOF, pos: start}
+		p.err = &SyntaxError{Pos: start, Msg: fmt.Sprintf("unexpected character %q", c)}
+	}
+}
+
+// expect consumes a token of kind, failing with what was expected otherwise
+func (p *parser) expect(kind int, what string) (token, error) {
+	if p.err != nil {
+		return token{}, p.err
+	}
+	if p.token.kind != kind {
+		return token{}, p.errorf("expected %s, found %s", what, p.token)
+	}
+	t := p.token
+	p.next()
+	return t, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOr {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, p.err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenAnd {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, p.err
+}
+
+func (p *parser) unary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	switch p.token.kind {
+	case tokenNot:
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case tokenLParen:
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case tokenIdent:
+		switch name := p.token.text; {
+		case name == "true" || name == "false":
+			p.next()
+			return constNode(name == "true"), nil
+		case predicates[name]:
+			p.next()
+			argument, err := p.argument(name)
+			if err != nil {
+				return nil, err
+			}
+			return predicateNode{name: name, argument: argument}, nil
+		}
+	}
+	return p.condition()
+}
+
+// condition parses a comparison of two values or a regular expression match
+func (p *parser) condition() (node, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.token; op.kind {
+	case tokenEqual, tokenNotEqual:
+		p.next()
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{left: left, right: right, equal: op.kind == tokenEqual}, nil
+	case tokenMatch:
+		p.next()
+		pattern, err := p.expect(tokenString, "a regular expression string")
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: pattern.pos, Msg: err.Error()}
+		}
+		return regexpNode{left: left, pattern: re}, nil
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return nil, p.errorf("expected ==, != or =~ after %s, found %s", left, p.token)
+}
+
+func (p *parser) value() (value, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	t := p.token
+	switch {
+	case t.kind == tokenString:
+		p.next()
+		return literal(t.text), nil
+	case t.kind == tokenIdent && stringFunctions[t.text]:
+		p.next()
+		argument, err := p.argument(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return attribute{name: t.text, argument: argument}, nil
+	case t.kind == tokenIdent && stringAttributes[t.text]:
+		p.next()
+		return attribute{name: t.text}, nil
+	case t.kind == tokenIdent:
+		return nil, p.errorf("unknown function or attribute %q", t.text)
+	}
+	return nil, p.errorf("expected a condition, found %s", t)
+}
+
+// argument parses the parenthesized string argument of function name
+func (p *parser) argument(name string) (string, error) {
+	if _, err := p.expect(tokenLParen, fmt.Sprintf(`"(" after %s`, name)); err != nil {
+		return "", err
+	}
+	argument, err := p.expect(tokenString, fmt.Sprintf("a string argument to %s", name))
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.expect(tokenRParen, `")"`); err != nil {
+		return "", err
+	}
+	return argument.text, nil
+}
@@ -0,0 +1,196 @@
+// Package rulexpr parses and evaluates the rule expressions routes and
+// routing rules match requests with, such as
+//
+//	header("x-region") == "eu" && path_prefix("/api")
+//
+// An expression combines conditions with && (and), || (or), ! (not) and
+// parentheses. A condition compares two strings with == or !=, matches a
+// string against a regular expression with =~, or is one of the boolean
+// functions. Strings are double quoted literals or values of the request:
+//
+//	header("name")   the first value of a request header, "" without it
+//	cookie("name")   the value of a cookie, "" without it
+//	query("name")    the first value of a query parameter, "" without it
+//	method           the request method, e.g. POST
+//	path             the request path
+//	host             the request host, without port
+//
+// The boolean functions are true, false, has_header("name"),
+// has_cookie("name"), has_query("name") and path_prefix("/prefix").
+package rulexpr
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed rule expression, safe for concurrent use
+type Expr struct {
+	source string
+	root   node
+}
+
+// Parse parses a rule expression
+func Parse(source string) (*Expr, error) {
+	p := &parser{source: source}
+	p.next()
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEOF {
+		return nil, p.errorf("unexpected %s", p.token)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// Match reports whether r satisfies the expression
+func (e *Expr) Match(r *http.Request) bool {
+	return e.root.eval(r)
+}
+
+// String returns the expression in its canonical form, fully parenthesized
+func (e *Expr) String() string {
+	return e.root.String()
+}
+
+// node is a boolean node of the expression tree
+type node interface {
+	eval(r *http.Request) bool
+	String() string
+}
+
+// value is a string valued node of the expression tree
+type value interface {
+	value(r *http.Request) string
+	String() string
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(r *http.Request) bool { return n.left.eval(r) && n.right.eval(r) }
+func (n andNode) String() string            { return "(" + n.left.String() + " && " + n.right.String() + ")" }
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(r *http.Request) bool { return n.left.eval(r) || n.right.eval(r) }
+func (n orNode) String() string            { return "(" + n.left.String() + " || " + n.right.String() + ")" }
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(r *http.Request) bool { return !n.operand.eval(r) }
+func (n notNode) String() string {
+	switch n.operand.(type) {
+	case compareNode, regexpNode:
+		return "!(" + n.operand.String() + ")"
+	}
+	return "!" + n.operand.String()
+}
+
+type constNode bool
+
+func (n constNode) eval(r *http.Request) bool { return bool(n) }
+func (n constNode) String() string            { return strconv.FormatBool(bool(n)) }
+
+type compareNode struct {
+	left, right value
+	equal       bool
+}
+
+func (n compareNode) eval(r *http.Request) bool {
+	return (n.left.value(r) == n.right.value(r)) == n.equal
+}
+
+func (n compareNode) String() string {
+	op := " != "
+	if n.equal {
+		op = " == "
+	}
+	return n.left.String() + op + n.right.String()
+}
+
+type regexpNode struct {
+	left    value
+	pattern *regexp.Regexp
+}
+
+func (n regexpNode) eval(r *http.Request) bool { return n.pattern.MatchString(n.left.value(r)) }
+func (n regexpNode) String() string {
+	return n.left.String() + " =~ " + strconv.Quote(n.pattern.String())
+}
+
+// predicateNode is a boolean function of the request with a string argument
+type predicateNode struct {
+	name     string
+	argument string
+}
+
+func (n predicateNode) eval(r *http.Request) bool {
+	switch n.name {
+	case "has_header":
+		return len(r.Header.Values(n.argument)) > 0
+	case "has_cookie":
+		_, err := r.Cookie(n.argument)
+		return err == nil
+	case "has_query":
+		return r.URL.Query().Has(n.argument)
+	case "path_prefix":
+		return strings.HasPrefix(r.URL.Path, n.argument)
+	}
+	return false
+}
+
+func (n predicateNode) String() string { return n.name + "(" + strconv.Quote(n.argument) + ")" }
+
+type literal string
+
+func (v literal) value(r *http.Request) string { return string(v) }
+func (v literal) String() string               { return strconv.Quote(string(v)) }
+
+// attribute is a string of the request, with an argument for header,
+// cookie and query
+type attribute struct {
+	name     string
+	argument string
+}
+
+func (v attribute) value(r *http.Request) string {
+	switch v.name {
+	case "header":
+		return r.Header.Get(v.argument)
+	case "cookie":
+		if cookie, err := r.Cookie(v.argument); err == nil {
+			return cookie.Value
+		}
+		return ""
+	case "query":
+		return r.URL.Query().Get(v.argument)
+	case "method":
+		return r.Method
+	case "path":
+		return r.URL.Path
+	case "host":
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			return host
+		}
+		return r.Host
+	}
+	return ""
+}
+
+func (v attribute) String() string {
+	if v.name == "header" || v.name == "cookie" || v.name == "query" {
+		return v.name + "(" + strconv.Quote(v.argument) + ")"
+	}
+	return v.name
+}
+
+// Names of the functions and attributes by what they take and return
+var (
+	stringFunctions  = map[string]bool{"header": true, "cookie": true, "query": true}
+	stringAttributes = map[string]bool{"method": true, "path": true, "host": true}
+	predicates       = map[string]bool{"has_header": true, "has_cookie": true, "has_query": true, "path_prefix": true}
+)
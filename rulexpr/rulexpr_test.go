@@ -0,0 +1,185 @@
+package rulexpr
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{`true || false && false`, `(true || (false && false))`},
+		{`true && false || false`, `((true && false) || false)`},
+		{`(true || false) && false`, `((true || false) && false)`},
+		{`true || false || true`, `((true || false) || true)`},
+		{`true && false && true`, `((true && false) && true)`},
+		{`!true && false`, `(!true && false)`},
+		{`!(true && false)`, `!(true && false)`},
+		{`!!true`, `!!true`},
+		{`!method == "GET" || path == "/"`, `(!(method == "GET") || path == "/")`},
+		{`header("a") != "b" && !has_query("q")`, `(header("a") != "b" && !has_query("q"))`},
+		{`path =~ "^/v[0-9]+/" && method == "POST"`, `(path =~ "^/v[0-9]+/" && method == "POST")`},
+		{`((((true))))`, `true`},
+		{`  "a"=="a"  `, `"a" == "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := Parse(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expr.String(); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://api.example.com:8080/api/v2/orders?region=eu&flag", nil)
+	r.Header.Set("X-Region", "eu")
+	r.Header.Add("X-Tag", "first")
+	r.Header.Add("X-Tag", "second")
+	r.AddCookie(&http.Cookie{Name: "canary", Value: "yes"})
+
+	tests := []struct {
+		source   string
+		expected bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`header("x-region") == "eu"`, true},
+		{`header("X-Tag") == "first"`, true},
+		{`header("x-missing") == ""`, true},
+		{`cookie("canary") == "yes"`, true},
+		{`cookie("missing") == ""`, true},
+		{`query("region") == "eu"`, true},
+		{`query("missing") != ""`, false},
+		{`method == "POST"`, true},
+		{`method != "POST"`, false},
+		{`path == "/api/v2/orders"`, true},
+		{`host == "api.example.com"`, true},
+		{`has_header("X-Region")`, true},
+		{`has_header("X-Missing")`, false},
+		{`has_cookie("canary")`, true},
+		{`has_cookie("missing")`, false},
+		{`has_query("flag")`, true},
+		{`has_query("missing")`, false},
+		{`path_prefix("/api/")`, true},
+		{`path_prefix("/admin")`, false},
+		{`path =~ "^/api/v[0-9]+/"`, true},
+		{`header("x-region") =~ "^(us|ap)$"`, false},
+		{`"literal" == "literal"`, true},
+		{`method == "GET" || path_prefix("/api") && !has_cookie("missing")`, true},
+		{`(method == "GET" || path_prefix("/api")) && has_cookie("missing")`, false},
+		{`!(method == "GET") && !false`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := Parse(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expr.Match(r); got != tt.expected {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHostWithoutPort(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "example.com"
+	expr, err := Parse(`host == "example.com"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expr.Match(r) {
+		t.Error("host without a port did not match")
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		source string
+		pos    int
+	}{
+		{``, 0},
+		{`true &&`, 7},
+		{`true || || false`, 8},
+		{`(true`, 5},
+		{`true)`, 4},
+		{`method`, 6},
+		{`method ==`, 9},
+		{`method = "GET"`, 7},
+		{`unknown == "a"`, 0},
+		{`header == "a"`, 7},
+		{`header("a" == "b"`, 11},
+		{`header(a) == "b"`, 7},
+		{`has_header`, 10},
+		{`path =~ method`, 8},
+		{`path =~ "("`, 8},
+		{`path =~ "a**"`, 8},
+		{`true && path =~ "[z-a]"`, 16},
+		{`method == "GET`, 10},
+		{`method == 'GET'`, 10},
+		{`true & false`, 5},
+		{`true false`, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := Parse(tt.source)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("got %v, expected a syntax error", err)
+			}
+			if syntaxErr.Pos != tt.pos {
+				t.Errorf("error %q at offset %d, expected %d", syntaxErr.Msg, syntaxErr.Pos, tt.pos)
+			}
+		})
+	}
+}
+
+// FuzzParse checks that every expression that parses prints in a canonical
+// form that parses back to itself, and that the ones that don't fail with a
+// SyntaxError inside the source
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		`header("x-region") == "eu" && path_prefix("/api")`,
+		`!(method == "GET") || has_cookie("canary")`,
+		`path =~ "^/v[0-9]+/" && !has_query("debug")`,
+		`(true || false) && !!false`,
+		`cookie("a\"b") != query("c")`,
+		`host == "example.com"`,
+		`path =~ "("`,
+		`header("a" == "b"`,
+		`true &&`,
+		`method == "GET`,
+		`"é" == "é"`,
+		``,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		expr, err := Parse(source)
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) || syntaxErr.Pos < 0 || syntaxErr.Pos > len(source) {
+				t.Fatalf("Parse(%q) returned %v", source, err)
+			}
+			return
+		}
+		canonical := expr.String()
+		again, err := Parse(canonical)
+		if err != nil {
+			t.Fatalf("canonical form %q of %q does not parse: %v", canonical, source, err)
+		}
+		if again.String() != canonical {
+			t.Fatalf("canonical form %q of %q prints as %q", canonical, source, again.String())
+		}
+	})
+}
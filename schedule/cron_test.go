@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	plus2 := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		expr     string
+		location *time.Location
+		after    time.Time
+		expected time.Time
+	}{
+		// 2026-01-01 is a Thursday
+		{expr: "30 2 * * 1-5", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 1, 2, 30)},
+		{expr: "30 2 * * 1-5", after: utc(2026, 1, 2, 3, 0), expected: utc(2026, 1, 5, 2, 30)},
+		{expr: "30 2 * * *", after: utc(2026, 1, 1, 2, 30), expected: utc(2026, 1, 2, 2, 30)},
+		{expr: "30 2 * * *", after: utc(2026, 1, 1, 2, 29).Add(30 * time.Second), expected: utc(2026, 1, 1, 2, 30)},
+		{expr: "*/15 * * * *", after: utc(2026, 1, 1, 10, 7), expected: utc(2026, 1, 1, 10, 15)},
+		{expr: "5/15 * * * *", after: utc(2026, 1, 1, 10, 21), expected: utc(2026, 1, 1, 10, 35)},
+		{expr: "0 8-18/4 * * *", after: utc(2026, 1, 1, 12, 1), expected: utc(2026, 1, 1, 16, 0)},
+		{expr: "0 0 1 3,6 *", after: utc(2026, 4, 1, 0, 0), expected: utc(2026, 6, 1, 0, 0)},
+		{expr: "59 23 31 12 *", after: utc(2026, 12, 31, 23, 59), expected: utc(2027, 12, 31, 23, 59)},
+		{expr: "@yearly", after: utc(2026, 3, 1, 0, 0), expected: utc(2027, 1, 1, 0, 0)},
+		{expr: "@monthly", after: utc(2026, 1, 31, 12, 0), expected: utc(2026, 2, 1, 0, 0)},
+		{expr: "@weekly", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 4, 0, 0)},
+		{expr: "@daily", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 2, 0, 0)},
+		{expr: "@hourly", after: utc(2026, 1, 1, 0, 30), expected: utc(2026, 1, 1, 1, 0)},
+		{expr: "0 0 29 2 *", after: utc(2026, 1, 1, 0, 0), expected: utc(2028, 2, 29, 0, 0)},
+		{expr: "0 0 30 2 *", after: utc(2026, 1, 1, 0, 0)},
+		// Either restricted day field matches, so Fridays and the 13th fire
+		{expr: "0 0 13 * 5", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 2, 0, 0)},
+		{expr: "0 0 13 * *", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 13, 0, 0)},
+		{expr: "0 12 * * 7", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 4, 12, 0)},
+		{expr: "0 12 * * 0", after: utc(2026, 1, 1, 0, 0), expected: utc(2026, 1, 4, 12, 0)},
+		{expr: "0 9 * * *", location: plus2, after: utc(2026, 1, 1, 8, 0), expected: utc(2026, 1, 2, 7, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" after "+tt.after.Format(time.RFC3339), func(t *testing.T) {
+			c, err := Parse(tt.expr, tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Next(tt.after); !got.Equal(tt.expected) {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"1,,2 * * * *",
+		"@fortnightly",
+	} {
+		if _, err := Parse(expr, nil); err == nil {
+			t.Errorf("Parse(%q) did not fail", expr)
+		}
+	}
+}
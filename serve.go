@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/accesslog"
+	"github.com/jiwooo-kim/poc_loadbalancer/analytics"
+	"github.com/jiwooo-kim/poc_loadbalancer/api"
+	"github.com/jiwooo-kim/poc_loadbalancer/auth"
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/cache"
+	"github.com/jiwooo-kim/poc_loadbalancer/calendar"
+	"github.com/jiwooo-kim/poc_loadbalancer/certs"
+	"github.com/jiwooo-kim/poc_loadbalancer/clientlimit"
+	"github.com/jiwooo-kim/poc_loadbalancer/diagnostics"
+	"github.com/jiwooo-kim/poc_loadbalancer/discovery"
+	"github.com/jiwooo-kim/poc_loadbalancer/eventbus"
+	"github.com/jiwooo-kim/poc_loadbalancer/profiling"
+	"github.com/jiwooo-kim/poc_loadbalancer/proxy"
+	"github.com/jiwooo-kim/poc_loadbalancer/replication"
+	"github.com/jiwooo-kim/poc_loadbalancer/shield"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+	"github.com/jiwooo-kim/poc_loadbalancer/stream"
+)
+
+// serve runs the balancer with the settings of args. With validateOnly it
+// only checks them: every file is read and every expression parsed, but
+// nothing is opened for writing, no store is connected and no port listened on.
+func serve(args []string, validateOnly bool) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	storeType := fs.String("store", "mongo", "where limits and requests are kept: mongo, postgres or memory")
+	nodesFile := fs.String("nodes-file", "", "JSON file with the node limits for the memory store")
+	mongoURI := fs.String("mongo-uri", "mongodb://localhost:27017/", "MongoDB connection string")
+	mongoDatabase := fs.String("mongo-database", "rate_limit_db", "MongoDB database holding node limits and requests")
+	recordFormat := fs.String("record-format", store.RecordDocuments, "how the mongo store keeps request records: documents (one per request, aggregated in MongoDB), blobs (gzipped batches) or columnar (encoded column batches); batches take 5-10x less space but are decoded by the balancer")
+	postgresURL := fs.String("postgres-url", "postgres://localhost:5432/rate_limit_db", "PostgreSQL connection string for the postgres store")
+	requestRetention := fs.Duration("request-retention", 25*time.Hour, "how long request records are kept in the store, at least the longest limit window (0 keeps them forever)")
+	checkpointPath := fs.String("checkpoint", "", "file the memory store checkpoints its rate limit windows to and restores them from on startup, so a restart does not send the nodes a full window of requests again")
+	checkpointInterval := fs.Duration("checkpoint-interval", 15*time.Second, "how often the memory store is checkpointed to -checkpoint")
+	purgeInterval := fs.Duration("purge-interval", 10*time.Minute, "how often expired request records are deleted from stores without TTL indexes, such as postgres")
+	reportInterval := fs.Duration("report-interval", 0, "how often the request records of the last hours are rolled up into hourly and daily usage summaries per node, listed by GET /admin/reports, so -request-retention can stay short (0 disables reports)")
+	recordBatchSize := fs.Int("record-batch-size", 0, "write request records in the background in batches of this size instead of one store round trip per request (0 writes synchronously)")
+	recordFlushInterval := fs.Duration("record-flush-interval", 100*time.Millisecond, "how long a request record waits for its batch to fill up")
+	recordBuffer := fs.Int("record-buffer", 10000, "request records waiting to be written in batches, beyond which they are dropped")
+	asyncWorkers := fs.Int("async-workers", 0, "workers forwarding the POST /request submissions with Prefer: respond-async, which are queued in the store (0 turns async submission off)")
+	asyncVisibility := fs.Duration("async-visibility", time.Minute, "how long a worker holds a queued request before a worker of any replica may claim it again")
+	asyncMaxAttempts := fs.Int("async-max-attempts", 5, "failed attempts after which a queued request is dead and no longer retried")
+	asyncPoll := fs.Duration("async-poll", 500*time.Millisecond, "how often idle workers look for queued requests")
+	storeTimeout := fs.Duration("store-timeout", 5*time.Second, "how long a single store operation may take")
+	discoveryType := fs.String("discovery", "", "node discovery backend: consul, etcd, dns, kubernetes or xds (empty uses the node_limits collection only)")
+	discoveryAddr := fs.String("discovery-addr", "", "address of the Consul agent, etcd endpoint, Kubernetes API server (in-cluster by default) or xDS control plane (host:port)")
+	discoveryName := fs.String("discovery-service", "", "Consul service name, etcd key prefix, DNS SRV name, Kubernetes [namespace/]service[:port] or xDS route configuration")
+	xdsNodeID := fs.String("xds-node-id", "", "node ID the balancer announces to the xDS control plane (poc-loadbalancer~<hostname> by default)")
+	xdsCluster := fs.String("xds-cluster", "", "cluster the balancer announces to the xDS control plane")
+	discoveryInterval := fs.Duration("discovery-interval", 30*time.Second, "how often discovered nodes are refreshed")
+	defaultRPM := fs.Int("default-rpm", 60, "RPM limit for discovered nodes without configured limits")
+	defaultBPM := fs.Int("default-bpm", 1000, "BPM limit for discovered nodes without configured limits")
+	schemaFiles := routeFlags{}
+	fs.Var(schemaFiles, "schema", "JSON Schema for a route's request bodies as <route>=<file>, may be repeated")
+	responseSchemaFiles := routeFlags{}
+	fs.Var(responseSchemaFiles, "response-schema", "JSON Schema that a route's backend responses should match as <route>=<file>, may be repeated")
+	cacheRoutes := routeFlags{}
+	fs.Var(cacheRoutes, "cache", "cache GET responses of a route as <route>=<ttl>, may be repeated")
+	cacheKeyHeaders := fs.String("cache-key-headers", "", "comma-separated request headers that are part of the cache key, and of the key identical requests coalesce by")
+	cacheMaxBytes := fs.Int("cache-max-bytes", 64<<20, "memory bound of the response cache")
+	operationLimits := routeFlags{}
+	backpressureMax := fs.Duration("backpressure-max", time.Minute, "longest a node may hold off requests with Retry-After or X-Capacity-Remaining; 0 ignores both")
+	globalLimits := fs.String("global-limits", "", "limit expression capping the requests of all nodes together, e.g. \"5000 req/min AND 20m bytes/h\", see PUT /admin/limits/global")
+	zone := fs.String("zone", "", "zone this balancer runs in; requests prefer the nodes of this zone, then of -region, spilling over to the others only once these have no capacity left")
+	zoneHeader := fs.String("zone-header", "", "request header naming the zone whose nodes the request prefers instead of -zone, e.g. X-Client-Zone")
+	region := fs.String("region", "", "name of the region this balancer runs in, required to replicate global limit usage with -region-peers")
+	regionPeers := fs.String("region-peers", "", "comma-separated base URLs of balancers in other regions whose global limit usage counts against -global-limits here")
+	regionToken := fs.String("region-token", os.Getenv("LB_REGION_TOKEN"), "admin API token of the viewer role used with -region-peers, defaults to $LB_REGION_TOKEN")
+	replicationInterval := fs.Duration("replication-interval", 5*time.Second, "how often the usage of other regions is fetched from -region-peers")
+	replicationConflict := fs.String("replication-conflict", "lww", "how conflicting usage reports of one region are resolved: lww (the latest wins) or merge (the highest usage of each window wins)")
+	replicationMaxAge := fs.Duration("replication-max-age", time.Minute, "how old the usage of another region may get before it no longer counts, e.g. while the region is unreachable")
+	fs.Var(operationLimits, "operation-limit", "limit expression applied per node to one operation as <operation>=<limits>, e.g. \"POST /request=10 req/min\" or \"/pkg.Service/Method=5 req/s\", may be repeated")
+	sharedLimits := fs.Bool("shared-limits", false, "admit every request atomically in the store, so several balancer replicas sharing it never take a node past its limits together")
+	strategy := fs.String("strategy", "random", "how a node is chosen among the available ones: random, latency to favor fast nodes with few errors, or cost to fill the cheapest nodes up to their limits first")
+	selectionSeed := fs.Int64("selection-seed", 0, "seed making node selection reproducible, for tests and replaying traffic (0 selects at random)")
+	flapTransitions := fs.Int("flap-transitions", 4, "health transitions within -flap-window that make a node count as flapping (0 turns flap detection off)")
+	flapWindow := fs.Duration("flap-window", 5*time.Minute, "window in which health transitions are counted for flap detection")
+	maintenanceInterval := fs.Duration("maintenance-interval", 30*time.Second, "how often the maintenance windows are reloaded from the store, picking up the changes of other replicas")
+	outlierFailures := fs.Int("outlier-consecutive-failures", 0, "failed responses in a row (5xx or unreachable), or responses in a row over their route's size limit, after which a node is ejected from selection; 0 turns this off")
+	outlierLatency := fs.Float64("outlier-latency-factor", 0, "eject nodes whose latency percentile is above this many times the pool's median, e.g. 3; 0 turns this off")
+	outlierPercentile := fs.Float64("outlier-latency-percentile", 95, "latency percentile compared by -outlier-latency-factor")
+	outlierMinRequests := fs.Int("outlier-min-requests", 20, "recent responses a node needs before its latency is compared")
+	outlierInterval := fs.Duration("outlier-interval", 10*time.Second, "how often node latencies are compared")
+	outlierEjection := fs.Duration("outlier-ejection", 30*time.Second, "how long an ejection lasts, times the node's recent ejections")
+	outlierMaxEjection := fs.Duration("outlier-max-ejection", 5*time.Minute, "longest an ejection lasts")
+	outlierMaxPercent := fs.Int("outlier-max-ejected-percent", 50, "share of the pool outlier detection may eject at once, in percent")
+	adaptiveDecrease := fs.Float64("adaptive-decrease", 0, "share of its current limits a node keeps when it answers 429 or 503, asks to retry later or slows down, e.g. 0.7; 0 turns adaptive limits off")
+	adaptiveIncrease := fs.Float64("adaptive-increase", 0.1, "share of its configured limits a node cut by adaptive limits gets back every -adaptive-interval without stress")
+	adaptiveInterval := fs.Duration("adaptive-interval", 10*time.Second, "how often adaptive limits may cut a node's limits, and how often they give some back")
+	adaptiveFloor := fs.Float64("adaptive-floor", 0.1, "smallest share of its configured limits adaptive limits leave a node")
+	adaptiveLatency := fs.Float64("adaptive-latency-inflation", 0, "cut the limits of nodes answering slower than this many times their usual latency, e.g. 3; 0 ignores latency")
+	slowStartWindow := fs.Duration("slow-start", 0, "how long nodes joining the pool or turning healthy again take to ramp up to their full traffic share; 0 gives it to them right away")
+	failoverHealthy := fs.Int("standby-failover-healthy", 0, "let the standby nodes take traffic while fewer than this many primary nodes are up (0 only activates them through calendar events)")
+	failoverHold := fs.Duration("standby-failover-hold", time.Minute, "how long enough primary nodes must be up again before the standby nodes go back on standby")
+	flapHoldDown := fs.Duration("flap-hold-down", 5*time.Minute, "how long a flapping node stays out of selection after it turns healthy")
+	groupWeights := fs.String("group-weights", "", "traffic split between node groups, e.g. stable=90,canary=10")
+	retries := fs.Int("retries", 0, "how many other nodes a request is retried on when it fails as -retry-on says, unless its route or node overrides it")
+	retryOn := fs.String("retry-on", strings.Join(balancer.DefaultRetryOn, ","), "failures requests are retried on: connect-failure (the node is unreachable or did not answer within its timeout), gateway-error (502, 503 or 504) and 5xx (any 5xx)")
+	retryBackoff := fs.Duration("retry-backoff", 0, "wait before the first retry, doubled for every next one up to -retry-max-backoff (0 retries at once)")
+	retryMaxBackoff := fs.Duration("retry-max-backoff", time.Second, "longest wait between retries")
+	retryAccounting := fs.String("retry-accounting", "attempt", "how retried requests count against node limits: attempt (every node tried), once (first node only) or success (only the node that answered)")
+	mirrorGroup := fs.String("mirror-group", "", "node group used as a shadow pool that receives copies of requests")
+	mirrorPercent := fs.Float64("mirror-percent", 0, "percentage of requests copied to the shadow pool")
+	extraLoadCap := fs.Float64("extra-load-cap", 25, "hard cap on mirrored requests as a percentage of live requests in the last minute, whatever -mirror-percent says")
+	backgroundWorkers := fs.Int("background-workers", 64, "workers sending mirrored copies and other work requests leave behind")
+	backgroundQueue := fs.Int("background-queue", 1024, "background tasks that may wait for a worker")
+	backgroundOverflow := fs.String("background-overflow", api.OverflowDrop, "what happens to background work beyond the queue: drop, or inline to do it on the request's goroutine")
+	mirrorTimeout := fs.Duration("mirror-timeout", 10*time.Second, "how long a mirrored request may take")
+	signingKeyFile := fs.String("signing-key-file", "", "file with the key forwarded requests are signed with in the X-LB-Signature header")
+	analyticsFile := fs.String("analytics-export", "", "file sampled usage events are appended to as JSON lines, - for stdout")
+	analyticsSample := fs.Float64("analytics-sample-rate", 0.1, "share of requests exported as usage events")
+	analyticsRotation := fs.Duration("analytics-rotation", 24*time.Hour, "how long a client keeps the same hash in usage events")
+	clientHeader := fs.String("client-header", "", "request header identifying unauthenticated clients in usage events and client limits, e.g. X-Client-ID (the client IP without it)")
+	eventsFile := fs.String("events", "", "JSON file of calendar events, such as sales, whose traffic plans (raised limits, activated standby nodes, tighter client limits) apply while they run")
+	shieldRate := fs.Float64("shield-request-rate", 0, "requests per second a source IP may send, averaged over -shield-window, before it is banned (0 leaves request rates unchecked)")
+	shieldWindow := fs.Duration("shield-window", 10*time.Second, "window source IP request rates are averaged over")
+	shieldConnections := fs.Int("shield-max-connections", 0, "connections a source IP may hold open at once before it is banned (0 leaves connections unchecked)")
+	shieldBan := fs.Duration("shield-ban", time.Minute, "how long the first ban of a source IP lasts, doubled by every further one")
+	shieldMaxBan := fs.Duration("shield-max-ban", time.Hour, "the longest ban, after which quiet a source IP's bans are forgotten")
+	eventWebhooks := fs.String("event-webhooks", "", "comma separated URLs balancer events (node health, ejections, saturated limits, pool changes) are posted to as JSON")
+	eventKafkaBrokers := fs.String("event-kafka-brokers", "", "comma separated Kafka brokers balancer events are written to")
+	eventKafkaTopic := fs.String("event-kafka-topic", "lb-events", "Kafka topic of balancer events")
+	eventBuffer := fs.Int("event-buffer", 256, "balancer events that may wait for each sink and admin API subscriber before further ones are dropped")
+	eventQuiet := fs.Duration("event-quiet", time.Minute, "how long after a rate_limit_saturated event the same limit is not reported again")
+	recordOutcomes := fs.Bool("record-outcomes", false, "record the status, upstream latency and bytes of every forwarded request in the store for as long as the request records, listed by GET /admin/outcomes")
+	rejectLog := fs.Bool("reject-log", false, "record every refused request, with its client, route and reason, in the store's capped reject log")
+	auditSampleRate := fs.Float64("audit-sample-rate", 0, "share of the proxied requests recorded in full, with headers, body, node and outcome, in the audit log, e.g. 0.01 (0 turns auditing off)")
+	auditLog := fs.String("audit-log", "store", "where audit samples are kept: store, for the store's capped audit_samples collection, or the path of a JSON lines file")
+	auditLogBytes := fs.Int64("audit-log-bytes", 256<<20, "size at which an -audit-log file is rotated to <path>.1")
+	auditBodyBytes := fs.Int("audit-body-bytes", 4096, "bytes of request body kept in audit samples, the rest cut off")
+	rejectDigests := fs.Bool("reject-digests", false, "publish a reject_digest event per client with refused requests after every day (UTC), needs -reject-log")
+	profiler := fs.String("profiler", "", "continuous profiler profiles are pushed to: pyroscope or parca (off without it)")
+	profilerURL := fs.String("profiler-url", "http://localhost:4040", "base URL of the -profiler")
+	profileApplication := fs.String("profile-application", "lb", "application name of the pushed profiles")
+	profileLabels := fs.String("profile-labels", "", "labels of the pushed profiles, e.g. env=prod,replica=lb-1 (region is added from -region)")
+	profileTypes := fs.String("profiles", "cpu,heap", "profiles pushed: cpu, heap, goroutine, mutex and block")
+	profileInterval := fs.Duration("profile-interval", time.Minute, "how often profiles are pushed")
+	profileCPUDuration := fs.Duration("profile-cpu-duration", 10*time.Second, "how long the CPU is profiled in every -profile-interval")
+	profileMemoryRate := fs.Int("profile-memory-rate", 0, "bytes allocated on average between heap profile samples (0 keeps the runtime default of 512 KiB)")
+	profileMutexFraction := fs.Int("profile-mutex-fraction", 100, "one in how many mutex contentions the mutex profile samples")
+	profileBlockRate := fs.Int("profile-block-rate", 10000, "nanoseconds spent blocked per event the block profile samples")
+	diagnosticsListen := fs.String("diagnostics-listen", "", "address such as localhost:6060 serving pprof profiles on /debug/pprof/ and expvar variables on /debug/vars, and enabling GET /admin/goroutines (empty turns diagnostics off); keep it off public networks")
+	trustedProxies := fs.String("trusted-proxies", "", "comma separated CIDRs or IPs of the proxies in front of the balancer, whose X-Forwarded-For header gives the client IP for access lists, client limits and the admin lockout")
+	tenantHeader := fs.String("tenant-header", "", "request header naming the tenant of requests whose client is not mapped to one, e.g. X-Tenant-ID")
+	clientRate := fs.Float64("client-rate", 0, "requests per second each client may send on average, refilling its token bucket (0 turns client limits off)")
+	clientBurst := fs.Int("client-burst", 10, "requests a client may send at once, the size of its token bucket")
+	clientLimitStore := fs.String("client-limit-store", "memory", "where client token buckets are kept: memory (per replica) or redis (shared by the replicas)")
+	redisURL := fs.String("redis-url", "redis://localhost:6379/0", "Redis connection string for -client-limit-store redis")
+	servedBy := fs.Bool("served-by", false, "add an X-Served-By header with the serving node to responses (routes may override it with served_by)")
+	rateLimitHeaders := fs.Bool("ratelimit-headers", false, "add X-RateLimit-* headers with the serving node's limit state to successful responses")
+	apiKeysFile := fs.String("api-keys-file", "", "JSON file mapping API keys accepted in X-API-Key to client names")
+	jwtIssuer := fs.String("jwt-issuer", "", "issuer of accepted bearer JWTs")
+	jwtAudience := fs.String("jwt-audience", "", "audience accepted bearer JWTs must be issued for")
+	jwksURL := fs.String("jwks-url", "", "URL of the JWKS with the keys of accepted bearer JWTs; enables JWT authentication")
+	adminTokensFile := fs.String("admin-tokens-file", "", "JSON file mapping admin API bearer tokens to their role, viewer or operator (the admin API is open without it)")
+	adminRateLimit := fs.Int("admin-rate-limit", 0, "admin API requests each client IP may make per minute, counted in the store across replicas (0 means no limit)")
+	adminMaxFailures := fs.Int("admin-max-failures", 5, "failed admin authentications in a row that lock a client IP out of the admin API (0 turns the lockout off)")
+	adminLockout := fs.Duration("admin-lockout", time.Second, "how long the first admin lockout lasts, doubled by every further failure")
+	adminMaxLockout := fs.Duration("admin-max-lockout", 15*time.Minute, "the longest admin lockout, after which quiet a client IP's failures are forgotten")
+	accessLogFile := fs.String("access-log", "", "file requests are logged to, - for stdout")
+	accessLogFormat := fs.String("access-log-format", "common", "access log format: common, json or a Go template over accesslog.Entry")
+	accessLogMaxSize := fs.Int64("access-log-max-size", 100<<20, "size in bytes at which the access log file is rotated (0 never rotates)")
+	accessLogBackups := fs.Int("access-log-backups", 5, "rotated access log files kept")
+	readHeaderTimeout := fs.Duration("read-header-timeout", 10*time.Second, "how long clients may take to send request headers")
+	readTimeout := fs.Duration("read-timeout", 30*time.Second, "how long clients may take to send a whole request (0 for gRPC streams)")
+	writeTimeout := fs.Duration("write-timeout", 60*time.Second, "how long writing a response may take counted from the end of the request headers (0 for gRPC streams)")
+	idleTimeout := fs.Duration("idle-timeout", 120*time.Second, "how long idle keep-alive connections are kept open")
+	proxyPrefix := fs.String("proxy-prefix", "", "path prefix such as / or /api/ under which requests of any method and path are forwarded to the nodes, besides POST /request (empty turns it off)")
+	requestTimeout := fs.Duration("request-timeout", 30*time.Second, "how long a proxied HTTP request may take end to end, retries included")
+	dialTimeout := fs.Duration("upstream-dial-timeout", 5*time.Second, "how long connecting to a node may take")
+	upstreamHeaderTimeout := fs.Duration("upstream-header-timeout", 30*time.Second, "how long a node may take to send its response headers")
+	tlsHandshakeTimeout := fs.Duration("upstream-tls-timeout", 10*time.Second, "how long the TLS handshake with an https node may take")
+	upstreamIdleTimeout := fs.Duration("upstream-idle-timeout", 90*time.Second, "how long idle connections to nodes are kept")
+	maxIdleConns := fs.Int("upstream-max-idle", 100, "idle connections kept per node pool")
+	maxIdleConnsPerHost := fs.Int("upstream-max-idle-per-node", 16, "idle connections kept per node")
+	maxConnsPerHost := fs.Int("upstream-max-conns-per-node", 0, "connections per node, requests beyond it wait (0 is unbounded)")
+	egressProxies := routeFlags{}
+	fs.Var(egressProxies, "egress-proxy", "proxy the nodes of a pool are reached through as <pool>=<url>, with an http://, https://, socks5:// or socks5h:// URL, \"default\" naming the nodes without a pool; may be repeated")
+	connectionAccounting := fs.Bool("connection-accounting", false, "count the requests sent to every node and the new connections they needed separately, reporting how often keep-alive connections are reused in GET /admin/nodes/{id}/connections and lb_node_connection_reuse_ratio")
+	rateLimitStyle := fs.String("ratelimit-header-style", "x", "rate limit headers sent: x (X-RateLimit-*), ietf (RateLimit-* of the IETF draft) or both; routes may override it with ratelimit_headers")
+	errorPagesFile := fs.String("error-pages", "", "JSON file with custom response bodies for the balancer's own errors, keyed by rate_limited, unavailable, unreachable, timeout, store_unavailable, response_too_large or degraded")
+	maxResponseBytes := fs.Int64("max-response-bytes", 0, "size limit of response bodies relayed to clients, larger ones are answered with 502 or cut short with an X-Response-Error trailer (0 is unbounded; routes may override it with max_response_bytes)")
+	responseOverflow := fs.String("response-overflow", api.ResponseOverflowStream, "what is done with responses over the size limit: stream (502 when their Content-Length is over it, otherwise cut short with an X-Response-Error trailer), error (read up to the limit first, 502 when over it) or truncate (relay up to the limit, flagged with X-Response-Truncated or the trailer); routes may override it with response_overflow")
+	maxRequestBytes := fs.Int64("max-request-bytes", 0, "size limit of request bodies, larger ones are refused with 413 before reaching a node (0 is unbounded; routes may override it with max_request_bytes)")
+	compress := fs.Bool("compress", false, "compress responses with br or gzip toward clients accepting it (compressed request bodies are decompressed either way)")
+	compressMinBytes := fs.Int("compress-min-bytes", 1024, "size below which responses are sent uncompressed")
+	compressTypes := fs.String("compress-types", "application/json,text/*", "comma separated media types of the responses compressed, a trailing * matching any subtype; empty compresses every type")
+	bpmAccounting := fs.String("bpm-accounting", api.BPMDeclared, "what the bpm of requests is taken from: declared (the bpm field of the body), uncompressed (the body size once decompressed) or wire (the body size as sent)")
+	faultInjection := fs.Bool("fault-injection", false, "let fault rules set through PUT /admin/faults/{id} delay, fail or drop requests of a route or node, for testing clients' resilience; never on production traffic")
+	devMode := fs.Bool("dev-mode", false, "describe the routing decision, candidate nodes and quota math of every proxied request in an X-LB-Decision response header; for local development only, it exposes the node pool to clients")
+	nodePinning := fs.Bool("node-pinning", false, "let requests carrying -node-pinning-secret or an operator admin token in X-Debug-Token name the node they go to in X-Debug-Target-Node, bypassing selection, to reproduce issues of one node")
+	pinningSecret := fs.String("node-pinning-secret", os.Getenv("LB_NODE_PINNING_SECRET"), "shared secret allowing requests to be pinned to a node with -node-pinning, defaults to $LB_NODE_PINNING_SECRET")
+	traceBuffer := fs.Int("trace-buffer", 1000, "execution traces of fan-out and pipeline requests kept for GET /admin/traces/{id} (0 turns tracing off)")
+	previewFile := fs.String("preview-config", "", "JSON file with a candidate node pool, operation limits or group weights every request is also evaluated against, see GET /admin/preview")
+	maxBatch := fs.Int("batch-max", 0, "sub-requests POST /batch takes at most, each served like POST /request (0 leaves the endpoint out)")
+	routesFile := fs.String("routes", "", "JSON file with declarative per-route settings such as header and path transforms")
+	grpcMode := fs.Bool("grpc", false, "also proxy gRPC calls, accepting unencrypted HTTP/2")
+	priorities := fs.String("priorities", "", "share of every window each priority class may fill, in percent, e.g. \"low=80,normal=95\"; unlisted classes fill them entirely")
+	priorityHeader := fs.String("priority-header", "X-Priority", "request header naming the request's priority class, empty to only use the routes' priority")
+	degradeHealthy := fs.String("degrade-healthy", "", "share of nodes up at or below which the balancer enters shed_low, cached_only and static, comma separated in that order, e.g. \"0.75,0.5,0.25\"; levels without one are only entered through the admin API")
+	degradeUtilization := fs.String("degrade-utilization", "", "mean utilization of the nodes up at or above which the balancer enters shed_low, cached_only and static, comma separated in that order, e.g. \"0.85,0.95,0.99\"")
+	degradeShed := fs.String("degrade-shed", "low", "comma separated priority classes refused from the shed_low degradation level on")
+	degradeInterval := fs.Duration("degrade-interval", 5*time.Second, "how often the health and utilization of the nodes are checked for the degradation level")
+	degradeHold := fs.Duration("degrade-hold", time.Minute, "how long the nodes must call for a lower degradation level before the balancer steps down to it")
+	affinityHeader := fs.String("affinity-header", "", "request header whose value keeps clients on the same node, e.g. X-Session-ID")
+	unixListen := fs.String("unix-listen", "", "path of a Unix domain socket the balancer also serves HTTP on besides :8080, for sidecars on the same host; a stale socket file there is replaced (empty turns it off)")
+	tcpListen := fs.String("tcp-listen", "", "address such as :9000 on which TCP connections are proxied to the nodes (empty turns the TCP proxy off)")
+	udpListen := fs.String("udp-listen", "", "address such as :9001 on which UDP datagrams are proxied to the nodes (empty turns the UDP proxy off)")
+	tlsListen := fs.String("tls-passthrough-listen", "", "address such as :8443 on which TLS connections are proxied to the nodes without terminating TLS, routed by their server name (empty turns TLS passthrough off)")
+	sniRoutes := routeFlags{}
+	fs.Var(sniRoutes, "sni-route", "node group of the TLS passthrough connections for a server name as <name>=<group>, e.g. \"*.example.com=web\", may be repeated")
+	streamGroup := fs.String("stream-group", "", "node group TCP connections and UDP sessions go to, and TLS passthrough connections no -sni-route matches; any group when empty")
+	streamRetries := fs.Int("stream-retries", 1, "how many other nodes a TCP connection or UDP session is tried on when its node cannot be reached")
+	streamTokens := fs.Int("stream-tokens", 1, "how many of its node's capacity tokens (max_concurrent) a TCP connection or UDP session holds until it closes")
+	streamIdleTimeout := fs.Duration("stream-idle-timeout", stream.DefaultIdleTimeout, "how long TCP connections and UDP sessions may carry no data before they are closed")
+	acmeDomains := fs.String("acme-domains", "", "comma separated domains the balancer obtains TLS certificates for from an ACME CA such as Let's Encrypt, serving HTTPS on -acme-listen (empty turns ACME off)")
+	acmeEmail := fs.String("acme-email", "", "contact email of the ACME account, for certificate expiry notices")
+	acmeDirectory := fs.String("acme-directory", "", "ACME directory URL of the CA, Let's Encrypt's production one when empty")
+	acmeChallenge := fs.String("acme-challenge", certs.ChallengeTLSALPN, "how the CA is shown control of the domains: tls-alpn-01 on -acme-listen, or http-01 on -acme-http-listen")
+	acmeListen := fs.String("acme-listen", ":443", "address HTTPS is served on with the certificates obtained for -acme-domains")
+	acmeHTTPListen := fs.String("acme-http-listen", ":80", "address http-01 challenges are answered on, redirecting other requests to HTTPS")
+	acmeCache := fs.String("acme-cache", "acme-certs", "directory the certificates and ACME account key are kept in, or \"store\" to keep them in the mongo store, shared by every replica")
+	fs.Parse(args)
+
+	config := api.Config{AffinityHeader: *affinityHeader, PriorityHeader: *priorityHeader, GRPC: *grpcMode, MirrorTimeout: *mirrorTimeout, RequestTimeout: *requestTimeout, ClientHeader: *clientHeader, ServedBy: *servedBy, RateLimitHeaders: *rateLimitHeaders, RateLimitHeaderStyle: *rateLimitStyle, TraceBuffer: *traceBuffer, MaxResponseBytes: *maxResponseBytes, ResponseOverflow: *responseOverflow, MaxRequestBytes: *maxRequestBytes, BackgroundWorkers: *backgroundWorkers, BackgroundQueue: *backgroundQueue, BackgroundOverflow: *backgroundOverflow, MaxBatch: *maxBatch}
+	var err error
+	if err := api.ValidateResponseOverflow(*responseOverflow); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ValidateRateLimitHeaders(*rateLimitStyle); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ValidateBackgroundOverflow(*backgroundOverflow); err != nil {
+		log.Fatal(err)
+	}
+	if *devMode {
+		log.Print("developer mode is on: responses describe the node pool and its quotas, do not use it in production")
+		config.DevMode = true
+	}
+	if *nodePinning {
+		config.NodePinning, config.PinningSecret = true, *pinningSecret
+	}
+	if *faultInjection {
+		log.Print("fault injection is on: fault rules set through the admin API delay, fail or drop requests, do not use it in production")
+		config.FaultInjection = true
+	}
+	if err := api.ValidateBPMAccounting(*bpmAccounting); err != nil {
+		log.Fatal(err)
+	}
+	config.BPMAccounting = *bpmAccounting
+	if *compress {
+		config.Compression = &api.Compression{MinBytes: *compressMinBytes}
+		for _, contentType := range strings.Split(*compressTypes, ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				config.Compression.ContentTypes = append(config.Compression.ContentTypes, contentType)
+			}
+		}
+	}
+	if *proxyPrefix != "" && !strings.HasPrefix(*proxyPrefix, "/") {
+		log.Fatal("-proxy-prefix must start with /")
+	}
+	config.ProxyPrefix = *proxyPrefix
+	config.ZoneHeader = *zoneHeader
+	config.Retry = balancer.RetryPolicy{Attempts: *retries, On: strings.Split(*retryOn, ","), Backoff: *retryBackoff, MaxBackoff: *retryMaxBackoff}
+	if *retryOn == "" {
+		config.Retry.On = nil
+	}
+	if err := balancer.ValidateRetryOn(config.Retry.On); err != nil {
+		log.Fatalf("-retry-on: %v", err)
+	}
+	if *retries < 0 || *retryBackoff < 0 || *retryMaxBackoff < 0 {
+		log.Fatal("-retries, -retry-backoff and -retry-max-backoff must not be negative")
+	}
+	if config.RetryAccounting, err = balancer.ParseAccounting(*retryAccounting); err != nil {
+		log.Fatal(err)
+	}
+	config.RequestSchemas, err = api.CompileSchemas(schemaFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.ResponseSchemas, err = api.CompileSchemas(responseSchemaFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *errorPagesFile != "" {
+		if config.ErrorPages, err = api.LoadErrorPages(*errorPagesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *routesFile != "" {
+		if config.Routes, err = api.LoadRouteConfig(*routesFile); err != nil {
+			log.Fatal(err)
+		}
+		// -operation-limit flags win over the limits of pipeline stages
+		for operation, limits := range api.PipelineOperationLimits(config.Routes) {
+			if _, ok := operationLimits[operation]; !ok {
+				operationLimits[operation] = limits
+			}
+		}
+	}
+	if len(cacheRoutes) > 0 {
+		config.Cache = cache.New(*cacheMaxBytes)
+		config.CacheTTLs = map[string]time.Duration{}
+		for route, ttl := range cacheRoutes {
+			if config.CacheTTLs[route], err = time.ParseDuration(ttl); err != nil {
+				log.Fatalf("cache ttl for route %s: %v", route, err)
+			}
+		}
+	}
+	if *cacheKeyHeaders != "" {
+		config.CacheKeyHeaders = strings.Split(*cacheKeyHeaders, ",")
+	}
+
+	if *analyticsFile != "" {
+		var out io.Writer = os.Stdout
+		if validateOnly {
+			out = io.Discard
+		} else if *analyticsFile != "-" {
+			if out, err = os.OpenFile(*analyticsFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.Analytics, err = analytics.NewExporter(out, analytics.Options{SampleRate: *analyticsSample, Rotation: *analyticsRotation})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *apiKeysFile != "" || *jwksURL != "" {
+		var authConfig auth.Config
+		if *apiKeysFile != "" {
+			if authConfig.APIKeys, err = auth.ReadAPIKeysFile(*apiKeysFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *jwksURL != "" {
+			authConfig.JWT = auth.NewJWTValidator(*jwtIssuer, *jwtAudience, *jwksURL)
+		}
+		config.Auth = auth.New(authConfig)
+	}
+
+	if *accessLogFile != "" {
+		var out io.Writer = os.Stdout
+		if validateOnly {
+			out = io.Discard
+		} else if *accessLogFile != "-" {
+			if out, err = accesslog.OpenRotatingFile(*accessLogFile, *accessLogMaxSize, *accessLogBackups); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if config.AccessLog, err = accesslog.New(out, *accessLogFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *clientRate > 0 {
+		bucket := clientlimit.Bucket{Rate: *clientRate, Burst: *clientBurst}
+		if err := bucket.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case *clientLimitStore != "memory" && *clientLimitStore != "redis":
+			log.Fatalf("unknown client limit store %q, expected memory or redis", *clientLimitStore)
+		case *clientLimitStore == "redis" && !validateOnly:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			config.ClientLimiter, err = clientlimit.NewRedisLimiter(ctx, *redisURL, "lb:client:", bucket)
+			cancel()
+			if err != nil {
+				log.Fatalf("connecting to redis: %v", err)
+			}
+		default:
+			config.ClientLimiter = clientlimit.NewMemoryLimiter(bucket)
+		}
+	}
+
+	var clientBucket clientlimit.Bucket
+	if config.ClientLimiter != nil {
+		clientBucket = clientlimit.Bucket{Rate: *clientRate, Burst: *clientBurst}
+	}
+	if *eventsFile != "" {
+		config.Calendar, err = calendar.Load(*eventsFile)
+		if err != nil {
+			log.Fatalf("%s: %v", *eventsFile, err)
+		}
+		if config.Calendar.ClientLimits() && config.ClientLimiter == nil {
+			log.Fatalf("%s: events change client limits, which need -client-rate", *eventsFile)
+		}
+	}
+
+	if *adminTokensFile != "" {
+		tokens, err := auth.ReadAdminTokensFile(*adminTokensFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.AdminAuth = auth.NewAdminAuthorizer(tokens)
+	} else if !validateOnly {
+		log.Printf("admin API is not protected, set -admin-tokens-file to require tokens")
+	}
+	if config.NodePinning && config.PinningSecret == "" && config.AdminAuth == nil {
+		log.Fatal("-node-pinning needs -node-pinning-secret or -admin-tokens-file")
+	}
+
+	var backend store.Store
+	// checkpointed is the memory store checkpointed to -checkpoint, if any
+	var checkpointed *store.MemoryStore
+	switch *storeType {
+	case "mongo", "postgres", "memory":
+	default:
+		log.Fatalf("unknown store %q", *storeType)
+	}
+	if *recordFormat != store.RecordDocuments && *storeType != "mongo" {
+		log.Fatal("-record-format only applies to the mongo store")
+	}
+	switch {
+	case validateOnly:
+		nodes, err := validateNodesFile(*nodesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend = store.NewMemoryStore(nodes...)
+	case *storeType == "mongo":
+		// MongoDB connection
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		mongoStore, err := store.NewMongoStore(ctx, *mongoURI, *mongoDatabase, *storeTimeout)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mongoStore.SetRecordFormat(*recordFormat); err != nil {
+			log.Fatal(err)
+		}
+		backend = mongoStore
+	case *storeType == "postgres":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		backend, err = store.NewPostgresStore(ctx, *postgresURL, *storeTimeout)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		memory, err := newMemoryStore(*nodesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		memory.SetRetention(*requestRetention)
+		if *checkpointPath != "" {
+			restored, err := memory.RestoreCheckpoint(*checkpointPath)
+			if err != nil {
+				log.Fatalf("restoring checkpoint: %v", err)
+			}
+			log.Printf("restored %d request records from %s", restored, *checkpointPath)
+			checkpointed = memory
+		}
+		backend = memory
+	}
+	if *checkpointPath != "" && checkpointed == nil && !validateOnly {
+		log.Fatalf("the %s store keeps its records, -checkpoint only applies to the memory store", *storeType)
+	}
+	if !validateOnly {
+		if migrator, ok := backend.(store.Migrator); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := migrator.Migrate(ctx, *requestRetention)
+			cancel()
+			if err != nil {
+				log.Fatalf("migrating store: %v", err)
+			}
+		}
+		if purger, ok := backend.(store.Purger); ok && *requestRetention > 0 && *purgeInterval > 0 {
+			go purgeRequests(purger, *requestRetention, *purgeInterval)
+		}
+	}
+	if *adminRateLimit > 0 || config.AdminAuth != nil && *adminMaxFailures > 0 {
+		counters, ok := backend.(store.Counters)
+		if !ok {
+			log.Fatalf("the %s store cannot count admin requests for -admin-rate-limit and -admin-max-failures", *storeType)
+		}
+		if *adminRateLimit < 0 || *adminLockout <= 0 || *adminMaxLockout < *adminLockout {
+			log.Fatal("-admin-rate-limit must not be negative, -admin-lockout must be positive and at most -admin-max-lockout")
+		}
+		config.AdminGuard = &api.AdminGuard{Counters: counters, RateLimit: *adminRateLimit, MaxFailures: *adminMaxFailures, Lockout: *adminLockout, MaxLockout: *adminMaxLockout}
+	}
+	if maintenance, ok := backend.(store.Maintenance); ok {
+		config.Maintenance = maintenance
+	}
+	if *shieldRate > 0 || *shieldConnections > 0 {
+		shieldConfig := shield.Config{RequestRate: *shieldRate, Window: *shieldWindow, MaxConnections: *shieldConnections, BanDuration: *shieldBan, MaxBanDuration: *shieldMaxBan}
+		if err := shieldConfig.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		config.Shield = shield.New(shieldConfig)
+	}
+	if *profiler != "" {
+		profileConfig := profiling.Config{
+			Profiler:      *profiler,
+			URL:           *profilerURL,
+			Application:   *profileApplication,
+			Labels:        map[string]string{},
+			Profiles:      strings.Split(*profileTypes, ","),
+			Interval:      *profileInterval,
+			CPUDuration:   *profileCPUDuration,
+			MemoryRate:    *profileMemoryRate,
+			MutexFraction: *profileMutexFraction,
+			BlockRate:     *profileBlockRate,
+			Timeout:       10 * time.Second,
+		}
+		if *profileLabels != "" {
+			if profileConfig.Labels, err = parseLabels(*profileLabels); err != nil {
+				log.Fatalf("-profile-labels: %v", err)
+			}
+		}
+		if *region != "" {
+			profileConfig.Labels["region"] = *region
+		}
+		if err := profileConfig.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		if !validateOnly {
+			go profiling.New(profileConfig).Run(context.Background())
+		}
+	}
+	config.Diagnostics = *diagnosticsListen != ""
+	if *rejectLog {
+		rejects, ok := backend.(store.RejectLog)
+		if !ok {
+			log.Fatalf("the %s store cannot keep a reject log for -reject-log", *storeType)
+		}
+		config.RejectLog = rejects
+	}
+	if *recordOutcomes {
+		outcomes, ok := backend.(store.Outcomes)
+		if !ok {
+			log.Fatalf("the %s store cannot keep request outcomes for -record-outcomes", *storeType)
+		}
+		config.Outcomes = outcomes
+	}
+	if *reportInterval > 0 {
+		reports, ok := backend.(store.Reports)
+		if !ok {
+			log.Fatalf("the %s store cannot keep usage reports for -report-interval", *storeType)
+		}
+		// Every report covers the hours since the previous one began
+		lookback := *reportInterval + time.Hour
+		if *requestRetention > 0 && *requestRetention <= lookback {
+			log.Fatal("-request-retention must be longer than -report-interval plus an hour, or request records expire before they are reported")
+		}
+		config.Reports = reports
+		if !validateOnly {
+			go reportUsage(reports, lookback, *reportInterval)
+		}
+	}
+	for route, rc := range config.Routes {
+		if rc.Idempotency == "" {
+			continue
+		}
+		keys, ok := backend.(store.Idempotency)
+		if !ok {
+			log.Fatalf("the %s store cannot keep the idempotency keys of route %s", *storeType, route)
+		}
+		config.Idempotency = keys
+		break
+	}
+	if *rejectDigests {
+		if !*rejectLog {
+			log.Fatal("-reject-digests needs -reject-log")
+		}
+		config.RejectDigestClaims, _ = backend.(store.Counters)
+	}
+	if *auditSampleRate > 0 {
+		if *auditSampleRate > 1 || *auditBodyBytes < 0 || *auditLogBytes <= 0 {
+			log.Fatal("-audit-sample-rate must be at most 1, -audit-body-bytes must not be negative and -audit-log-bytes must be positive")
+		}
+		if *auditLog == "store" {
+			samples, ok := backend.(store.AuditLog)
+			if !ok {
+				log.Fatalf("the %s store cannot keep an audit log, pass a file to -audit-log", *storeType)
+			}
+			config.AuditLog = samples
+		} else if !validateOnly {
+			if config.AuditLog, err = store.NewAuditFile(*auditLog, *auditLogBytes); err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.AuditSampleRate, config.AuditBodyBytes = *auditSampleRate, *auditBodyBytes
+	}
+	if acls, ok := backend.(store.AccessLists); ok {
+		config.AccessLists = acls
+	}
+	if *trustedProxies != "" {
+		if config.TrustedProxies, err = api.ParsePrefixes(strings.Split(*trustedProxies, ",")); err != nil {
+			log.Fatalf("-trusted-proxies: %v", err)
+		}
+	}
+	if tenants, ok := backend.(store.Tenants); ok {
+		config.Tenants, config.TenantHeader = tenants, *tenantHeader
+		config.TenantQuotas, _ = backend.(store.Counters)
+	}
+	if *asyncWorkers > 0 {
+		queue, ok := backend.(store.Queue)
+		if !ok {
+			log.Fatalf("the %s store cannot queue requests for -async-workers", *storeType)
+		}
+		if *asyncMaxAttempts < 1 || *asyncVisibility <= 0 || *asyncPoll <= 0 {
+			log.Fatal("-async-max-attempts must be at least 1, -async-visibility and -async-poll positive")
+		}
+		config.Queue, config.AsyncMaxAttempts, config.AsyncVisibility = queue, *asyncMaxAttempts, *asyncVisibility
+	}
+	var acme *certs.Manager
+	if *acmeDomains != "" {
+		acmeConfig := certs.Config{Domains: strings.Split(*acmeDomains, ","), Email: *acmeEmail, Directory: *acmeDirectory, Challenge: *acmeChallenge, CacheDir: *acmeCache}
+		if *acmeCache == "store" {
+			certificates, ok := backend.(store.Certificates)
+			if !ok {
+				log.Fatalf("the %s store cannot keep certificates, pass a directory to -acme-cache", *storeType)
+			}
+			acmeConfig.Store = certificates
+		}
+		if acme, err = certs.NewManager(acmeConfig); err != nil {
+			log.Fatalf("-acme-domains: %v", err)
+		}
+	}
+	var batches *store.BatchWriter
+	if *recordBatchSize > 0 {
+		if *sharedLimits {
+			log.Fatal("-record-batch-size cannot be combined with -shared-limits, which admits every request in the store synchronously")
+		}
+		if !validateOnly {
+			batches = store.NewBatchWriter(backend, store.BatchConfig{Size: *recordBatchSize, Interval: *recordFlushInterval, Buffer: *recordBuffer, Timeout: *storeTimeout})
+			backend = batches
+		}
+	}
+
+	var signer *proxy.Signer
+	if *signingKeyFile != "" {
+		key, err := os.ReadFile(*signingKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if signer, err = proxy.NewSigner(bytes.TrimSpace(key)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var sinks []eventbus.Sink
+	if *eventWebhooks != "" {
+		for _, url := range strings.Split(*eventWebhooks, ",") {
+			sinks = append(sinks, eventbus.NewWebhook(url, signer))
+		}
+	}
+	if *eventKafkaBrokers != "" {
+		if *eventKafkaTopic == "" {
+			log.Fatal("-event-kafka-brokers needs -event-kafka-topic")
+		}
+		sinks = append(sinks, eventbus.NewKafka(strings.Split(*eventKafkaBrokers, ","), *eventKafkaTopic))
+	}
+	if *eventBuffer < 1 || *eventQuiet < 0 {
+		log.Fatal("-event-buffer must be at least 1 and -event-quiet must not be negative")
+	}
+	if validateOnly {
+		sinks = nil
+	}
+	config.Events = eventbus.New(eventbus.Options{Buffer: *eventBuffer, Timeout: 10 * time.Second, Quiet: *eventQuiet}, sinks...)
+
+	loadBalancer := balancer.New(backend)
+	loadBalancer.SetEventBus(config.Events)
+
+	config.DiscoveredNodes = *discoveryType != ""
+	// xds also receives the routing table, once the server exists
+	var xds *discovery.XDS
+	if validateOnly {
+		// Discovery backends are not contacted
+		if err := loadBalancer.LoadNodes(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	} else if *discoveryType == "" {
+		if err := loadBalancer.LoadNodes(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		discoverer, err := discovery.New(*discoveryType, *discoveryAddr, *discoveryName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if x, ok := discoverer.(*discovery.XDS); ok {
+			xds = x
+			if *xdsNodeID != "" {
+				xds.NodeID = *xdsNodeID
+			}
+			xds.Cluster = *xdsCluster
+		}
+		defaults := store.NodeLimits{RPMLimit: *defaultRPM, BPMLimit: *defaultBPM}
+		go loadBalancer.RunDiscovery(context.Background(), discoverer, *discoveryInterval, defaults)
+	}
+
+	loadBalancer.SetFlapPolicy(balancer.FlapPolicy{Transitions: *flapTransitions, Window: *flapWindow, HoldDown: *flapHoldDown})
+	loadBalancer.SetSlowStart(*slowStartWindow)
+	if *failoverHealthy < 0 || *failoverHold < 0 {
+		log.Fatal("-standby-failover-healthy and -standby-failover-hold must not be negative")
+	}
+	loadBalancer.SetFailoverPolicy(balancer.FailoverPolicy{MinHealthy: *failoverHealthy, Hold: *failoverHold})
+	if *adaptiveDecrease < 0 || *adaptiveDecrease >= 1 || *adaptiveFloor < 0 || *adaptiveFloor > 1 || *adaptiveIncrease < 0 {
+		log.Fatalf("-adaptive-decrease must be 0 or between 0 and 1, -adaptive-floor between 0 and 1, -adaptive-increase not negative")
+	}
+	if *adaptiveDecrease > 0 && *adaptiveInterval <= 0 {
+		log.Fatalf("-adaptive-interval must be positive with -adaptive-decrease")
+	}
+	loadBalancer.SetAdaptiveLimits(balancer.AdaptiveLimits{
+		Decrease:         *adaptiveDecrease,
+		Increase:         *adaptiveIncrease,
+		Interval:         *adaptiveInterval,
+		Floor:            *adaptiveFloor,
+		LatencyInflation: *adaptiveLatency,
+	})
+	if *outlierPercentile <= 0 || *outlierPercentile > 100 {
+		log.Fatalf("-outlier-latency-percentile must be above 0 and up to 100")
+	}
+	loadBalancer.SetOutlierPolicy(balancer.OutlierPolicy{
+		ConsecutiveFailures: *outlierFailures,
+		LatencyFactor:       *outlierLatency,
+		LatencyPercentile:   *outlierPercentile,
+		MinRequests:         *outlierMinRequests,
+		Interval:            *outlierInterval,
+		BaseEjection:        *outlierEjection,
+		MaxEjection:         *outlierMaxEjection,
+		MaxEjectedPercent:   *outlierMaxPercent,
+	})
+	if !validateOnly {
+		go loadBalancer.RunHealthChecks(context.Background())
+		go loadBalancer.RunOutlierDetection(context.Background())
+		if config.Calendar != nil {
+			go config.Calendar.Run(context.Background(), func(plan calendar.Plan) {
+				applyPlan(loadBalancer, config.ClientLimiter, clientBucket, plan)
+			})
+		}
+		if config.Maintenance != nil && *maintenanceInterval > 0 {
+			go loadBalancer.RunMaintenance(context.Background(), config.Maintenance, *maintenanceInterval)
+		}
+	}
+
+	if err := loadBalancer.SetOperationLimits(operationLimits); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadBalancer.SetGlobalLimits(*globalLimits); err != nil {
+		log.Fatalf("-global-limits: %v", err)
+	}
+	loadBalancer.SetBackpressure(*backpressureMax)
+	conflictPolicy, err := replication.ParsePolicy(*replicationConflict)
+	if err != nil {
+		log.Fatalf("-replication-conflict: %v", err)
+	}
+	loadBalancer.SetRegion(*region, conflictPolicy, *replicationMaxAge)
+	loadBalancer.SetLocality(*zone, *region)
+	if *regionPeers != "" {
+		if *region == "" {
+			log.Fatal("-region-peers needs -region")
+		}
+		if *replicationInterval <= 0 {
+			log.Fatal("-replication-interval must be positive")
+		}
+		if *globalLimits == "" && !validateOnly {
+			log.Printf("-region-peers has no effect without -global-limits, until they are set with PUT /admin/limits/global")
+		}
+		var peers []*replication.Peer
+		for _, url := range strings.Split(*regionPeers, ",") {
+			peers = append(peers, replication.NewPeer(url, *regionToken))
+		}
+		if !validateOnly {
+			go loadBalancer.RunReplication(context.Background(), peers, *replicationInterval)
+		}
+	}
+	config.Degradation = api.DegradationPolicy{Interval: *degradeInterval, Hold: *degradeHold}
+	if config.Degradation.Healthy, err = parseThresholds(*degradeHealthy); err != nil {
+		log.Fatalf("-degrade-healthy: %v", err)
+	}
+	if config.Degradation.Utilization, err = parseThresholds(*degradeUtilization); err != nil {
+		log.Fatalf("-degrade-utilization: %v", err)
+	}
+	for _, class := range strings.Split(*degradeShed, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			config.Degradation.Shed = append(config.Degradation.Shed, strings.ToLower(class))
+		}
+	}
+	if err := api.ValidateDegradationPolicy(config.Degradation); err != nil {
+		log.Fatalf("degradation: %v", err)
+	}
+	shares, err := balancer.ParsePriorities(*priorities)
+	if err != nil {
+		log.Fatalf("-priorities: %v", err)
+	}
+	loadBalancer.SetPriorities(shares)
+	if checkpointed != nil {
+		if *checkpointInterval <= 0 {
+			log.Fatal("-checkpoint-interval must be positive")
+		}
+		go checkpointWindows(checkpointed, loadBalancer, *checkpointPath, *checkpointInterval)
+	}
+	if longest := loadBalancer.LongestWindow(); *requestRetention > 0 && longest > *requestRetention {
+		log.Printf("-request-retention %s is shorter than the longest limit window %s, which will undercount", *requestRetention, longest)
+	}
+	if err := loadBalancer.SetSharedLimits(*sharedLimits); err != nil {
+		log.Fatal(err)
+	}
+	selection, err := balancer.ParseStrategy(*strategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadBalancer.SetStrategy(selection)
+	if *selectionSeed != 0 {
+		loadBalancer.SetSeed(*selectionSeed)
+		log.Printf("node selection is deterministic with seed %d", *selectionSeed)
+	}
+	if err := loadBalancer.SetMirror(*mirrorGroup, *mirrorPercent); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadBalancer.SetExtraLoadCap(*extraLoadCap); err != nil {
+		log.Fatal(err)
+	}
+	if *groupWeights != "" {
+		weights, err := parseWeights(*groupWeights)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := loadBalancer.SetGroupWeights(weights); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	egressProxyURLs := make(map[string]*url.URL, len(egressProxies))
+	for pool, raw := range egressProxies {
+		egressProxy, err := proxy.ParseEgressProxy(raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		egressProxyURLs[pool] = egressProxy
+	}
+	forwarder := proxy.NewPooled(proxy.TransportConfig{
+		DialTimeout:           *dialTimeout,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *upstreamHeaderTimeout,
+		IdleConnTimeout:       *upstreamIdleTimeout,
+		MaxIdleConns:          *maxIdleConns,
+		MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+		MaxConnsPerHost:       *maxConnsPerHost,
+		EgressProxies:         egressProxyURLs,
+	})
+	if *connectionAccounting {
+		forwarder.CountConnections()
+	}
+	forwarder.SetEgressLimits(func(nodeID string) int64 {
+		node, _ := loadBalancer.Node(nodeID)
+		return node.EgressLimit
+	})
+	if signer != nil {
+		forwarder.SetSigner(signer)
+	}
+
+	server := api.NewServer(loadBalancer, forwarder, config)
+	if err := server.LoadRoutingRules(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.LoadAccessLists(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.LoadTenants(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if xds != nil {
+		xds.OnRoutes(func(routes []discovery.Route) {
+			rules := make([]api.GroupRule, 0, len(routes))
+			for _, route := range routes {
+				rules = append(rules, api.GroupRule{When: route.Match, Group: route.Group})
+			}
+			if err := server.SetRouteTable(rules); err != nil {
+				log.Printf("xds routes: %v", err)
+			}
+		})
+	}
+	if *previewFile != "" {
+		candidate, err := api.LoadPreviewConfig(*previewFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := server.SetPreview(candidate); err != nil {
+			log.Fatalf("%s: %v", *previewFile, err)
+		}
+	}
+
+	var streamServer *stream.Server
+	if *tcpListen != "" || *udpListen != "" || *tlsListen != "" {
+		if *streamRetries < 0 || *streamIdleTimeout <= 0 {
+			log.Fatal("-stream-retries must not be negative and -stream-idle-timeout must be positive")
+		}
+		streamServer = stream.NewServer(loadBalancer, stream.Config{Group: *streamGroup, SNIRoutes: sniRoutes, Retries: *streamRetries, DialTimeout: *dialTimeout, IdleTimeout: *streamIdleTimeout, Tokens: *streamTokens})
+	}
+
+	if validateOnly {
+		server.Handler()
+		fmt.Println("configuration is valid")
+		return
+	}
+	if *rejectDigests {
+		go server.RunRejectDigests(context.Background())
+	}
+	go server.RunDegradation(context.Background())
+
+	httpServer := &http.Server{
+		Addr:              ":8080",
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if *grpcMode {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	// HTTPS is served by the same server, so its TLS settings are in place
+	// before any listener starts
+	if acme != nil {
+		httpServer.TLSConfig = acme.TLSConfig()
+		if httpServer.Protocols != nil {
+			httpServer.Protocols.SetHTTP2(true)
+		}
+	}
+
+	// Start server
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Shield != nil {
+		listener = config.Shield.Listener(listener)
+	}
+	go func() {
+		fmt.Println("Server listening on port 8080")
+		if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	if acme != nil {
+		l, err := net.Listen("tcp", *acmeListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config.Shield != nil {
+			l = config.Shield.Listener(l)
+		}
+		go func() {
+			fmt.Printf("Serving HTTPS on %s\n", l.Addr())
+			if err := httpServer.ServeTLS(l, "", ""); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		if handler, ok := acme.HTTPHandler(); ok {
+			challengeServer := &http.Server{Addr: *acmeHTTPListen, Handler: handler, ReadHeaderTimeout: *readHeaderTimeout}
+			go func() {
+				fmt.Printf("Answering ACME challenges on %s\n", *acmeHTTPListen)
+				if err := challengeServer.ListenAndServe(); err != nil {
+					log.Fatalf("acme challenges: %v", err)
+				}
+			}()
+		}
+	}
+	if *unixListen != "" {
+		l, err := listenUnix(*unixListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			fmt.Printf("Server listening on %s\n", *unixListen)
+			if err := httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if *tcpListen != "" {
+		l, err := net.Listen("tcp", *tcpListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			fmt.Printf("Proxying TCP on %s\n", l.Addr())
+			if err := streamServer.ServeTCP(l); err != nil {
+				log.Fatalf("tcp proxy: %v", err)
+			}
+		}()
+	}
+	if *tlsListen != "" {
+		l, err := net.Listen("tcp", *tlsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			fmt.Printf("Proxying TLS passthrough on %s\n", l.Addr())
+			if err := streamServer.ServeTLS(l); err != nil {
+				log.Fatalf("tls passthrough: %v", err)
+			}
+		}()
+	}
+	if *udpListen != "" {
+		conn, err := net.ListenPacket("udp", *udpListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			fmt.Printf("Proxying UDP on %s\n", conn.LocalAddr())
+			if err := streamServer.ServeUDP(conn); err != nil {
+				log.Fatalf("udp proxy: %v", err)
+			}
+		}()
+	}
+
+	if *diagnosticsListen != "" {
+		diagnostics.Publish(func() any { return loadBalancer.StoreLatencies() })
+		l, err := net.Listen("tcp", *diagnosticsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			fmt.Printf("Serving diagnostics on %s\n", l.Addr())
+			if err := http.Serve(l, diagnostics.Handler()); err != nil {
+				log.Fatalf("diagnostics: %v", err)
+			}
+		}()
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		if config.Queue != nil {
+			server.RunQueueWorkers(workersCtx, *asyncWorkers, *asyncPoll)
+		}
+	}()
+
+	// On SIGINT or SIGTERM, finish the requests and streams in flight, hand queued
+	// requests being worked on back to the queue, finish the background work
+	// and write the buffered request records before exiting
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+	log.Printf("shutting down")
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("shutting down HTTP server: %v", err)
+	}
+	if streamServer != nil {
+		if err := streamServer.Shutdown(ctx); err != nil {
+			log.Printf("shutting down stream proxy: %v", err)
+		}
+	}
+	stopWorkers()
+	<-workersDone
+	if err := server.Close(ctx); err != nil {
+		log.Printf("finishing background work: %v", err)
+	}
+	if batches != nil {
+		if err := batches.Close(ctx); err != nil {
+			log.Printf("flushing request records: %v", err)
+		}
+	}
+	if checkpointed != nil {
+		if err := checkpointed.WriteCheckpoint(*checkpointPath, loadBalancer.LongestWindow()); err != nil {
+			log.Printf("writing checkpoint: %v", err)
+		}
+	}
+	if config.Analytics != nil {
+		config.Analytics.Close()
+	}
+	config.Events.Close()
+}
+
+// applyPlan applies the traffic plan of the calendar events running, or
+// reverts to the configured settings when none is
+// listenUnix listens on the Unix domain socket at path, replacing the socket
+// file a balancer that did not shut down cleanly left there. The file is
+// removed again once the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func applyPlan(lb *balancer.LoadBalancer, limiter clientlimit.Limiter, bucket clientlimit.Bucket, plan calendar.Plan) {
+	if err := lb.SetLimitFactors(plan.LimitFactors); err != nil {
+		log.Printf("applying event plan: %v", err)
+	}
+	lb.ActivateStandby(plan.ActivateNodes)
+	if limiter != nil {
+		if plan.ClientRate > 0 {
+			bucket = clientlimit.Bucket{Rate: plan.ClientRate, Burst: plan.ClientBurst}
+		}
+		limiter.SetBucket(bucket)
+	}
+	if len(plan.Events) == 0 {
+		log.Printf("no calendar event running, traffic settings are as configured")
+		return
+	}
+	log.Printf("applied the traffic plan of events %s: limit factors %v, standby nodes %v, client rate %g/s",
+		strings.Join(plan.Events, ", "), plan.LimitFactors, plan.ActivateNodes, plan.ClientRate)
+}
+
+// purgeRequests deletes request records older than retention right away and
+// then every interval
+func purgeRequests(purger store.Purger, retention, interval time.Duration) {
+	for {
+		deleted, err := purger.PurgeRequests(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("purging request records: %v", err)
+		} else if deleted > 0 {
+			log.Printf("purged %d request records", deleted)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// reportUsage rolls the request records of the last lookback up into usage
+// summaries every interval
+func reportUsage(reports store.Reports, lookback, interval time.Duration) {
+	for {
+		if err := store.ReportUsage(context.Background(), reports, time.Now(), lookback); err != nil {
+			log.Printf("reporting usage: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkpointWindows writes the request records of the longest limit window
+// of memory to path every interval
+func checkpointWindows(memory *store.MemoryStore, lb *balancer.LoadBalancer, path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := memory.WriteCheckpoint(path, lb.LongestWindow()); err != nil {
+			log.Printf("writing checkpoint: %v", err)
+		}
+	}
+}
+
+// newMemoryStore returns a memory store holding the nodes of nodesFile, or
+// three simulated nodes when no file is given so the balancer can be tried out
+// without any setup
+func newMemoryStore(nodesFile string) (*store.MemoryStore, error) {
+	if nodesFile == "" {
+		return store.NewMemoryStore(
+			store.NodeLimits{NodeID: "node-1", RPMLimit: 60, BPMLimit: 1000},
+			store.NodeLimits{NodeID: "node-2", RPMLimit: 60, BPMLimit: 1000},
+			store.NodeLimits{NodeID: "node-3", RPMLimit: 30, BPMLimit: 500},
+		), nil
+	}
+	nodes, err := store.ReadNodeLimitsFile(nodesFile)
+	if err != nil {
+		return nil, err
+	}
+	return store.NewMemoryStore(nodes...), nil
+}
+
+// validateNodesFile reads the nodes of nodesFile, if given, and checks each of them
+func validateNodesFile(nodesFile string) ([]store.NodeLimits, error) {
+	if nodesFile == "" {
+		return nil, nil
+	}
+	nodes, err := store.ReadNodeLimitsFile(nodesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if err := balancer.ValidateNode(node); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,276 @@
+// Package shield protects the balancer from abusive source IPs: it tracks
+// the request rate and open connections of every IP and bans the IPs going
+// over their thresholds for a while, longer for repeat offenders.
+package shield
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Reasons an IP is banned for
+const (
+	// ReasonRequestRate means the IP sent requests faster than allowed
+	ReasonRequestRate = "request_rate"
+	// ReasonConnections means the IP opened more connections than allowed
+	ReasonConnections = "connections"
+	// ReasonManual means the IP was banned through the admin API
+	ReasonManual = "manual"
+)
+
+// Config struct represents the thresholds past which an IP is banned
+type Config struct {
+	// RequestRate is how many requests per second an IP may send, averaged
+	// over Window; zero leaves request rates unchecked
+	RequestRate float64
+	Window      time.Duration
+	// MaxConnections is how many connections an IP may hold open at once;
+	// zero leaves connections unchecked
+	MaxConnections int
+	// BanDuration is how long the first ban of an IP lasts, doubled by every
+	// further one up to MaxBanDuration. An IP that stays out of trouble for
+	// MaxBanDuration after its last ban starts over.
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+}
+
+// Validate checks that the thresholds are usable
+func (c Config) Validate() error {
+	if c.RequestRate < 0 || c.MaxConnections < 0 {
+		return errors.New("shield thresholds must not be negative")
+	}
+	if c.RequestRate > 0 && c.Window <= 0 {
+		return errors.New("shield request rate needs a positive window")
+	}
+	if c.BanDuration <= 0 || c.MaxBanDuration < c.BanDuration {
+		return errors.New("shield bans need a positive duration no longer than the longest ban")
+	}
+	return nil
+}
+
+// Ban struct represents an IP that is refused until Until
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// Offenses is how many times in a row the IP was banned
+	Offenses int `json:"offenses"`
+}
+
+// source struct represents what the shield knows of one IP
+type source struct {
+	// window is the start of the current request window, requests the count
+	// in it and previous the count in the one before
+	window      time.Time
+	requests    int
+	previous    int
+	connections int
+	ban         Ban
+}
+
+func (src *source) banned(now time.Time) bool {
+	return now.Before(src.ban.Until)
+}
+
+// Shield tracks the source IPs of the balancer's traffic. Every replica
+// keeps its own state.
+type Shield struct {
+	config Config
+
+	mu      sync.Mutex
+	sources map[string]*source
+	swept   time.Time
+}
+
+// New returns a shield banning IPs past the thresholds of config
+func New(config Config) *Shield {
+	return &Shield{config: config, sources: map[string]*source{}, swept: time.Now()}
+}
+
+// source returns the state of ip, s.mu held
+func (s *Shield) source(ip string) *source {
+	src, ok := s.sources[ip]
+	if !ok {
+		src = &source{}
+		s.sources[ip] = src
+	}
+	return src
+}
+
+// ban bans src for reason, for longer the more often it was banned lately.
+// The caller holds s.mu.
+func (s *Shield) ban(ip string, src *source, reason string, now time.Time) {
+	offenses := src.ban.Offenses + 1
+	if src.ban.Until.IsZero() || now.Sub(src.ban.Until) >= s.config.MaxBanDuration {
+		offenses = 1
+	}
+	duration := s.config.BanDuration
+	for i := 1; i < offenses && duration < s.config.MaxBanDuration; i++ {
+		duration *= 2
+	}
+	duration = min(duration, s.config.MaxBanDuration)
+	src.ban = Ban{IP: ip, Reason: reason, Since: now, Until: now.Add(duration), Offenses: offenses}
+	metrics.ShieldBans.WithLabelValues(reason).Inc()
+}
+
+// Request counts a request from ip, reporting whether it may go on and, if
+// not, how long until the IP's ban ends. The request that takes an IP over
+// its rate bans it.
+func (s *Shield) Request(ip string, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	src := s.source(ip)
+	if src.banned(now) {
+		metrics.ShieldRejections.WithLabelValues("request").Inc()
+		return false, src.ban.Until.Sub(now)
+	}
+	if s.config.RequestRate <= 0 {
+		return true, 0
+	}
+
+	window := s.config.Window
+	if elapsed := now.Sub(src.window); elapsed >= 2*window {
+		src.window, src.requests, src.previous = now.Truncate(window), 0, 0
+	} else if elapsed >= window {
+		src.window, src.requests, src.previous = src.window.Add(window), 0, src.requests
+	}
+	src.requests++
+	// The rate over the last window, weighing the previous one by how much of
+	// it the last window still covers
+	covered := 1 - float64(now.Sub(src.window))/float64(window)
+	if float64(src.requests)+float64(src.previous)*covered <= s.config.RequestRate*window.Seconds() {
+		return true, 0
+	}
+	s.ban(ip, src, ReasonRequestRate, now)
+	metrics.ShieldRejections.WithLabelValues("request").Inc()
+	return false, src.ban.Until.Sub(now)
+}
+
+// Connect counts a connection from ip, reporting whether it may stay open.
+// Every accepted connection must be given back with Disconnect.
+func (s *Shield) Connect(ip string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	src := s.source(ip)
+	if !src.banned(now) && s.config.MaxConnections > 0 && src.connections >= s.config.MaxConnections {
+		s.ban(ip, src, ReasonConnections, now)
+	}
+	if src.banned(now) {
+		metrics.ShieldRejections.WithLabelValues("connection").Inc()
+		return false
+	}
+	src.connections++
+	return true
+}
+
+// Disconnect gives back a connection Connect accepted
+func (s *Shield) Disconnect(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if src, ok := s.sources[ip]; ok && src.connections > 0 {
+		src.connections--
+	}
+}
+
+// Ban bans ip by hand for duration
+func (s *Shield) Ban(ip string, duration time.Duration, now time.Time) Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.source(ip)
+	src.ban = Ban{IP: ip, Reason: ReasonManual, Since: now, Until: now.Add(duration), Offenses: src.ban.Offenses + 1}
+	metrics.ShieldBans.WithLabelValues(ReasonManual).Inc()
+	return src.ban
+}
+
+// Unban lifts the ban of ip and forgets its offenses, reporting whether it
+// was banned
+func (s *Shield) Unban(ip string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, ok := s.sources[ip]
+	if !ok || !src.banned(now) {
+		return false
+	}
+	src.ban = Ban{}
+	src.requests, src.previous = 0, 0
+	return true
+}
+
+// Bans returns the IPs banned now, the latest ending first
+func (s *Shield) Bans(now time.Time) []Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := []Ban{}
+	for _, src := range s.sources {
+		if src.banned(now) {
+			bans = append(bans, src.ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.After(bans[j].Until) })
+	return bans
+}
+
+// sweep forgets the IPs with nothing left to remember: no open connection,
+// no recent request and no ban that still counts toward the next one. It
+// runs at most once per longest ban. The caller holds s.mu.
+func (s *Shield) sweep(now time.Time) {
+	if now.Sub(s.swept) < s.config.MaxBanDuration {
+		return
+	}
+	for ip, src := range s.sources {
+		idle := now.Sub(src.window) >= 2*s.config.Window
+		if src.connections == 0 && idle && now.Sub(src.ban.Until) >= s.config.MaxBanDuration {
+			delete(s.sources, ip)
+		}
+	}
+	s.swept = now
+}
+
+// Listener returns l with the connections of banned IPs, and of IPs over
+// their connection limit, closed as soon as they are accepted
+func (s *Shield) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, shield: s}
+}
+
+type listener struct {
+	net.Listener
+	shield *Shield
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		if l.shield.Connect(ip, time.Now()) {
+			return &trackedConn{Conn: conn, ip: ip, shield: l.shield}, nil
+		}
+		conn.Close()
+	}
+}
+
+// trackedConn gives its connection back to the shield once closed
+type trackedConn struct {
+	net.Conn
+	ip     string
+	shield *Shield
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.shield.Disconnect(c.ip) })
+	return c.Conn.Close()
+}
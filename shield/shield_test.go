@@ -0,0 +1,149 @@
+package shield
+
+import (
+	"testing"
+	"time"
+)
+
+func testConfig() Config {
+	return Config{RequestRate: 10, Window: time.Second, MaxConnections: 2, BanDuration: time.Minute, MaxBanDuration: 8 * time.Minute}
+}
+
+// flood sends requests from ip at now until one is refused, returning how
+// many got through and how long the ban is
+func flood(t *testing.T, s *Shield, ip string, now time.Time) (int, time.Duration) {
+	t.Helper()
+	for allowed := 0; allowed < 1000; allowed++ {
+		if ok, retryAfter := s.Request(ip, now); !ok {
+			return allowed, retryAfter
+		}
+	}
+	t.Fatal("never banned")
+	return 0, 0
+}
+
+func TestRequestRate(t *testing.T) {
+	s := New(testConfig())
+	now := time.Now().Truncate(time.Second)
+
+	allowed, retryAfter := flood(t, s, "10.0.0.1", now)
+	if allowed != 10 || retryAfter != time.Minute {
+		t.Fatalf("allowed %d requests then banned for %s, expected 10 then %s", allowed, retryAfter, time.Minute)
+	}
+	if ok, retryAfter := s.Request("10.0.0.1", now.Add(30*time.Second)); ok || retryAfter != 30*time.Second {
+		t.Errorf("request during the ban: %v, retry after %s", ok, retryAfter)
+	}
+	if ok, _ := s.Request("10.0.0.2", now); !ok {
+		t.Error("another IP was refused")
+	}
+	if ok, _ := s.Request("10.0.0.1", now.Add(time.Minute)); !ok {
+		t.Error("request after the ban was refused")
+	}
+}
+
+func TestRequestRateWeighsPreviousWindow(t *testing.T) {
+	s := New(testConfig())
+	start := time.Now().Truncate(time.Second)
+	for range 10 {
+		if ok, _ := s.Request("10.0.0.1", start.Add(500*time.Millisecond)); !ok {
+			t.Fatal("request within the rate was refused")
+		}
+	}
+	// Half of the previous window is still covered, so it counts for 5
+	if allowed, _ := flood(t, s, "10.0.0.1", start.Add(1500*time.Millisecond)); allowed != 5 {
+		t.Errorf("allowed %d requests in the next window, expected 5", allowed)
+	}
+}
+
+func TestBanBackoff(t *testing.T) {
+	s := New(testConfig())
+	now := time.Now().Truncate(time.Second)
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 8 * time.Minute} {
+		_, retryAfter := flood(t, s, "10.0.0.1", now)
+		if retryAfter != expected {
+			t.Fatalf("banned for %s, expected %s", retryAfter, expected)
+		}
+		now = now.Add(retryAfter)
+	}
+
+	// Staying out of trouble for the longest ban starts over
+	now = now.Add(8 * time.Minute)
+	if _, retryAfter := flood(t, s, "10.0.0.1", now); retryAfter != time.Minute {
+		t.Errorf("banned for %s after a clean period, expected %s", retryAfter, time.Minute)
+	}
+	if bans := s.Bans(now); len(bans) != 1 || bans[0].Offenses != 1 || bans[0].Reason != ReasonRequestRate {
+		t.Errorf("got bans %+v", bans)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := New(testConfig())
+	now := time.Now()
+	for range 2 {
+		if !s.Connect("10.0.0.1", now) {
+			t.Fatal("connection within the limit was refused")
+		}
+	}
+	if s.Connect("10.0.0.1", now) {
+		t.Fatal("connection over the limit was accepted")
+	}
+	s.Disconnect("10.0.0.1")
+	if s.Connect("10.0.0.1", now) {
+		t.Error("connection of a banned IP was accepted")
+	}
+	if ok, _ := s.Request("10.0.0.1", now); ok {
+		t.Error("request of an IP banned for its connections was accepted")
+	}
+	if bans := s.Bans(now); len(bans) != 1 || bans[0].Reason != ReasonConnections {
+		t.Errorf("got bans %+v", bans)
+	}
+	if !s.Connect("10.0.0.1", now.Add(time.Minute)) {
+		t.Error("connection after the ban was refused")
+	}
+}
+
+func TestManualBan(t *testing.T) {
+	s := New(testConfig())
+	now := time.Now()
+	ban := s.Ban("10.0.0.1", time.Hour, now)
+	if ban.Reason != ReasonManual || !ban.Until.Equal(now.Add(time.Hour)) {
+		t.Errorf("got ban %+v", ban)
+	}
+	s.Ban("10.0.0.2", time.Minute, now)
+	if bans := s.Bans(now); len(bans) != 2 || bans[0].IP != "10.0.0.1" {
+		t.Errorf("got bans %+v, expected the longest first", bans)
+	}
+	if ok, _ := s.Request("10.0.0.1", now); ok {
+		t.Error("request of a banned IP was accepted")
+	}
+	if !s.Unban("10.0.0.1", now) {
+		t.Fatal("unban found no ban")
+	}
+	if s.Unban("10.0.0.1", now) {
+		t.Error("unbanned twice")
+	}
+	if ok, _ := s.Request("10.0.0.1", now); !ok {
+		t.Error("request of an unbanned IP was refused")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "valid", config: testConfig()},
+		{name: "negative rate", config: Config{RequestRate: -1, BanDuration: time.Minute, MaxBanDuration: time.Minute}, wantErr: true},
+		{name: "rate without window", config: Config{RequestRate: 1, BanDuration: time.Minute, MaxBanDuration: time.Minute}, wantErr: true},
+		{name: "no ban duration", config: Config{MaxConnections: 1, MaxBanDuration: time.Minute}, wantErr: true},
+		{name: "longest ban too short", config: Config{MaxConnections: 1, BanDuration: time.Hour, MaxBanDuration: time.Minute}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, expected an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
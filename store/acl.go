@@ -0,0 +1,27 @@
+package store
+
+import "context"
+
+// AccessList struct represents the client IPs a set of routes is open to:
+// addresses in Deny are always refused and, when Allow is not empty, so are
+// the addresses outside it. Entries are CIDRs such as 10.0.0.0/8 or single
+// IPs.
+type AccessList struct {
+	ID string `bson:"acl_id" json:"id"`
+	// Routes are the paths of the routes the list applies to, every route
+	// when empty
+	Routes []string `bson:"routes,omitempty" json:"routes,omitempty"`
+	Allow  []string `bson:"allow,omitempty" json:"allow,omitempty"`
+	Deny   []string `bson:"deny,omitempty" json:"deny,omitempty"`
+}
+
+// AccessLists is implemented by stores that can keep IP access lists,
+// shared by every balancer replica
+type AccessLists interface {
+	// AccessLists returns every access list
+	AccessLists(ctx context.Context) ([]AccessList, error)
+	// SaveAccessList adds an access list or replaces the one with the same ID
+	SaveAccessList(ctx context.Context, list AccessList) error
+	// DeleteAccessList removes an access list, reporting whether it existed
+	DeleteAccessList(ctx context.Context, id string) (bool, error)
+}
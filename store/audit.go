@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuditLogEntries is how many samples the audit log of MongoStore keeps;
+// the oldest make way for new ones beyond it
+const AuditLogEntries = 100_000
+
+// AuditSample struct represents a request recorded in full for debugging
+// routing decisions
+type AuditSample struct {
+	Time   time.Time `bson:"time" json:"time"`
+	Client string    `bson:"client,omitempty" json:"client,omitempty"`
+	Route  string    `bson:"route" json:"route"`
+	Method string    `bson:"method" json:"method"`
+	// URI is the request path and query
+	URI    string              `bson:"uri" json:"uri"`
+	Header map[string][]string `bson:"header" json:"header"`
+	// Body is the request body, cut short when BodyTruncated is set
+	Body          string `bson:"body,omitempty" json:"body,omitempty"`
+	BodyTruncated bool   `bson:"body_truncated,omitempty" json:"body_truncated,omitempty"`
+	// Node is the node that served the request, if any
+	Node     string `bson:"node,omitempty" json:"node,omitempty"`
+	Decision string `bson:"decision,omitempty" json:"decision,omitempty"`
+	// RejectReason is why the request was refused, if it was
+	RejectReason string  `bson:"reject_reason,omitempty" json:"reject_reason,omitempty"`
+	Status       int     `bson:"status" json:"status"`
+	Seconds      float64 `bson:"seconds" json:"seconds"`
+}
+
+// AuditFilter struct represents which samples AuditLog.AuditSamples
+// returns: those from Since on, matching the fields that are set
+type AuditFilter struct {
+	Since  time.Time
+	Route  string
+	Node   string
+	Client string
+}
+
+func (f AuditFilter) match(sample AuditSample) bool {
+	return !sample.Time.Before(f.Since) &&
+		(f.Route == "" || sample.Route == f.Route) &&
+		(f.Node == "" || sample.Node == f.Node) &&
+		(f.Client == "" || sample.Client == f.Client)
+}
+
+// AuditLog is implemented by what can keep a capped log of sampled requests
+type AuditLog interface {
+	// RecordAuditSample adds a sample to the log
+	RecordAuditSample(ctx context.Context, sample AuditSample) error
+	// AuditSamples returns the latest samples matching filter, newest first
+	// and at most limit
+	AuditSamples(ctx context.Context, filter AuditFilter, limit int) ([]AuditSample, error)
+}
+
+// AuditFile is an AuditLog writing samples to a file as JSON lines. Once the
+// file reaches its size cap it is moved to <path>.1, replacing the previous
+// one, so at most twice the cap is kept on disk.
+type AuditFile struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewAuditFile opens the audit file at path, appending to it, capped at
+// maxBytes
+func NewAuditFile(path string, maxBytes int64) (*AuditFile, error) {
+	f := &AuditFile{path: path, maxBytes: maxBytes}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *AuditFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *AuditFile) RecordAuditSample(ctx context.Context, sample AuditSample) error {
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(line)) > f.maxBytes {
+		f.file.Close()
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// AuditSamples reads the rotated file and then the current one, so the
+// newest samples come last and are returned first
+func (f *AuditFile) AuditSamples(ctx context.Context, filter AuditFilter, limit int) ([]AuditSample, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var samples []AuditSample
+	for _, path := range []string{f.path + ".1", f.path} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			var sample AuditSample
+			if json.Unmarshal(scanner.Bytes(), &sample) == nil && filter.match(sample) {
+				samples = append(samples, sample)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(samples)
+	if len(samples) > limit {
+		samples = samples[:limit]
+	}
+	if samples == nil {
+		samples = []AuditSample{}
+	}
+	return samples, nil
+}
+
+// Close closes the audit file
+func (f *AuditFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
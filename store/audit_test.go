@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := NewAuditFile(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	for i, route := range []string{"/request", "/api", "/request", "/request"} {
+		sample := AuditSample{Time: now.Add(time.Duration(i) * time.Second), Route: route, Method: "POST", URI: route, Node: "node-1", Status: 200}
+		if err := f.RecordAuditSample(ctx, sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("the file was not rotated at its cap: %v", err)
+	}
+
+	samples, err := f.AuditSamples(ctx, AuditFilter{Since: now, Route: "/request"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || !samples[0].Time.Equal(now.Add(3*time.Second)) {
+		t.Errorf("got %+v, expected the 3 samples of /request newest first", samples)
+	}
+	if samples, _ := f.AuditSamples(ctx, AuditFilter{Since: now.Add(2 * time.Second)}, 1); len(samples) != 1 || samples[0].Route != "/request" {
+		t.Errorf("got %+v, expected the newest sample only", samples)
+	}
+	if samples, _ := f.AuditSamples(ctx, AuditFilter{Since: now, Node: "node-2"}, 10); samples == nil || len(samples) != 0 {
+		t.Errorf("got %+v, expected no samples of node-2", samples)
+	}
+}
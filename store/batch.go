@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// BatchRecorder is implemented by stores that can store many request records
+// in one round trip
+type BatchRecorder interface {
+	RecordRequests(ctx context.Context, records []Record) error
+}
+
+// BatchConfig struct represents how a BatchWriter buffers request records
+type BatchConfig struct {
+	// Size is how many records are written at once; a full batch is flushed
+	// right away
+	Size int
+	// Interval is how long a record waits for its batch to fill up
+	Interval time.Duration
+	// Buffer bounds how many records wait to be written; records beyond it
+	// are dropped
+	Buffer int
+	// Timeout bounds each batch write
+	Timeout time.Duration
+}
+
+// BatchWriter wraps a store so request records are written in the
+// background in batches, taking the store round trip off the request path.
+// Records become visible to usage queries only once their batch is written,
+// so node limits can be overshot by what arrives within one flush interval.
+// Everything else goes to the wrapped store directly.
+type BatchWriter struct {
+	Store
+	config  BatchConfig
+	records chan Record
+	done    chan struct{}
+
+	// mu guards closed, so no record is sent once records is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBatchWriter starts writing the request records of s in batches. Stores
+// without RecordRequests get their records written one at a time, still off
+// the request path. Close flushes what is buffered.
+func NewBatchWriter(s Store, config BatchConfig) *BatchWriter {
+	if config.Size <= 0 {
+		config.Size = 100
+	}
+	if config.Interval <= 0 {
+		config.Interval = 100 * time.Millisecond
+	}
+	if config.Buffer < config.Size {
+		config.Buffer = config.Size
+	}
+	w := &BatchWriter{Store: s, config: config, records: make(chan Record, config.Buffer), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+// RecordRequest queues record for the next batch. It never blocks: when the
+// buffer is full the record is dropped and counted in
+// lb_request_records_dropped_total.
+func (w *BatchWriter) RecordRequest(ctx context.Context, record Record) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		metrics.RequestRecordsDropped.WithLabelValues("closed").Inc()
+		return nil
+	}
+	select {
+	case w.records <- record:
+	default:
+		metrics.RequestRecordsDropped.WithLabelValues("buffer_full").Inc()
+	}
+	return nil
+}
+
+// Close stops accepting records and writes the buffered ones, waiting until
+// they are written or ctx is done
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.records)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping checks the wrapped store, if it can be checked
+func (w *BatchWriter) Ping(ctx context.Context) error {
+	if pinger, ok := w.Store.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, w.config.Size)
+	for {
+		select {
+		case record, ok := <-w.records:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) < w.config.Size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes batch, dropping it if the store fails
+func (w *BatchWriter) flush(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if w.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.config.Timeout)
+		defer cancel()
+	}
+
+	if recorder, ok := w.Store.(BatchRecorder); ok {
+		if err := recorder.RecordRequests(ctx, batch); err != nil {
+			log.Printf("writing %d request records: %v", len(batch), err)
+			metrics.RequestRecordsDropped.WithLabelValues("write_failed").Add(float64(len(batch)))
+		}
+		return
+	}
+	for _, record := range batch {
+		if err := w.Store.RecordRequest(ctx, record); err != nil {
+			log.Printf("writing request record: %v", err)
+			metrics.RequestRecordsDropped.WithLabelValues("write_failed").Inc()
+		}
+	}
+}
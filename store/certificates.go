@@ -0,0 +1,16 @@
+package store
+
+import "context"
+
+// Certificates is implemented by stores that can keep the TLS certificates
+// and ACME account key the balancer obtained, so every replica serves the
+// same certificates and the CA is asked only once, see certs.Config.Store.
+// Keys are opaque names, data is PEM.
+type Certificates interface {
+	// Certificate returns the data kept under key, and false when there is none
+	Certificate(ctx context.Context, key string) ([]byte, bool, error)
+	// SaveCertificate keeps data under key, replacing what was there
+	SaveCertificate(ctx context.Context, key string, data []byte) error
+	// DeleteCertificate removes key, if it exists
+	DeleteCertificate(ctx context.Context, key string) error
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// checkpoint struct represents the rate limit state of a MemoryStore: the
+// request records the limit windows are counted from, and the counters
+type checkpoint struct {
+	Time     time.Time          `json:"time"`
+	Records  []Record           `json:"records"`
+	Counters map[string]counter `json:"counters"`
+}
+
+// WriteCheckpoint writes the request records of the last window and the
+// live counters to path, replacing it at once so a crash while writing
+// leaves the previous checkpoint. RestoreCheckpoint reads it back after a
+// restart, so the nodes are not sent a full window of requests again.
+func (s *MemoryStore) WriteCheckpoint(path string, window time.Duration) error {
+	now := time.Now()
+	c := checkpoint{Time: now, Counters: map[string]counter{}}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for _, records := range shard.records {
+			for _, record := range records {
+				if window <= 0 || !record.Timestamp.Before(now.Add(-window)) {
+					c.Records = append(c.Records, record)
+				}
+			}
+		}
+		shard.mu.Unlock()
+	}
+	s.mu.Lock()
+	for key, counter := range s.counters {
+		if now.Before(counter.Expires) {
+			c.Counters[key] = counter
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// RestoreCheckpoint adds the request records and counters of the checkpoint
+// at path to the store, skipping those expired since it was written, and
+// returns how many records it added. It must be called before any request is
+// recorded. A missing checkpoint restores nothing.
+func (s *MemoryStore) RestoreCheckpoint(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, err
+	}
+
+	// Records must be stored oldest first per node, see expireLocked
+	sort.SliceStable(c.Records, func(i, j int) bool { return c.Records[i].Timestamp.Before(c.Records[j].Timestamp) })
+	retention := time.Duration(s.retention.Load())
+	cutoff := time.Now().Add(-retention)
+	restored := 0
+	for _, record := range c.Records {
+		if retention > 0 && record.Timestamp.Before(cutoff) {
+			continue
+		}
+		shard := s.shard(record.NodeID)
+		shard.mu.Lock()
+		s.appendLocked(shard, record)
+		shard.mu.Unlock()
+		restored++
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	for key, counter := range c.Counters {
+		if now.Before(counter.Expires) && counter.Value > s.counters[key].Value {
+			s.counters[key] = counter
+		}
+	}
+	s.mu.Unlock()
+	return restored, nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	now := time.Now()
+	s := NewMemoryStore()
+	s.RecordRequests(ctx, []Record{
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now.Add(-2 * time.Hour), BPM: 10},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now.Add(-time.Second), BPM: 20},
+		{NodeID: "node-2", Operation: "GET /api", Timestamp: now.Add(-time.Minute), BPM: 5},
+	})
+	s.IncrementCounter(ctx, "live", now.Add(time.Minute))
+	s.IncrementCounter(ctx, "expired", now.Add(-time.Second))
+	if err := s.WriteCheckpoint(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMemoryStore()
+	n, err := restored.RestoreCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("restored %d records, expected the 2 within the window", n)
+	}
+	usage, _ := restored.Usage(ctx, now.Add(-time.Hour))
+	if usage["node-1"].Requests != 1 || usage["node-1"].BPM != 20 || usage["node-2"].Requests != 1 {
+		t.Errorf("got usage %+v, expected one request on each node", usage)
+	}
+	if value, _, _ := restored.Counter(ctx, "live"); value != 1 {
+		t.Errorf("got counter %d, expected the live counter restored", value)
+	}
+	if value, _, _ := restored.Counter(ctx, "expired"); value != 0 {
+		t.Errorf("got counter %d, expected the expired counter dropped", value)
+	}
+
+	// Records older than the retention are not restored
+	retained := NewMemoryStore()
+	retained.SetRetention(30 * time.Second)
+	if n, _ := retained.RestoreCheckpoint(path); n != 1 {
+		t.Errorf("restored %d records, expected 1 within the retention", n)
+	}
+	if n, err := NewMemoryStore().RestoreCheckpoint(filepath.Join(t.TempDir(), "missing.json")); n != 0 || err != nil {
+		t.Errorf("got %d, %v for a missing checkpoint, expected nothing restored", n, err)
+	}
+	os.WriteFile(path, []byte("{"), 0o644)
+	if _, err := NewMemoryStore().RestoreCheckpoint(path); err == nil {
+		t.Error("a corrupt checkpoint was restored")
+	}
+}
@@ -0,0 +1,27 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Counters is implemented by stores that can keep expiring counters shared
+// by every balancer replica, such as the admin API's rate limits and
+// lockouts, so a client cannot get around them by switching replicas
+type Counters interface {
+	// IncrementCounter adds one to the counter key and moves its expiry to
+	// expires, returning its new value; a counter that does not exist or
+	// expired starts over at one
+	IncrementCounter(ctx context.Context, key string, expires time.Time) (int64, error)
+	// Counter returns the value of key and when it expires, zero when it does
+	// not exist or expired
+	Counter(ctx context.Context, key string) (int64, time.Time, error)
+	// DeleteCounter removes the counter key, if any
+	DeleteCounter(ctx context.Context, key string) error
+}
+
+// counter struct represents a counter of a store that has no expiry of its own
+type counter struct {
+	Value   int64     `bson:"value"`
+	Expires time.Time `bson:"expires"`
+}
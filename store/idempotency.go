@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// IdempotentResponse struct represents the response to the first request
+// of an idempotency key, replayed to the requests retrying it
+type IdempotentResponse struct {
+	Status int         `bson:"status" json:"status"`
+	Header http.Header `bson:"header" json:"header"`
+	Body   []byte      `bson:"body" json:"body"`
+}
+
+// IdempotencyRecord struct represents an idempotency key: the fingerprint
+// of the request that claimed it and, once that request completed, its
+// response. Response is nil while the request is still in flight.
+type IdempotencyRecord struct {
+	Fingerprint string              `bson:"fingerprint" json:"fingerprint"`
+	Response    *IdempotentResponse `bson:"response,omitempty" json:"response,omitempty"`
+	Expires     time.Time           `bson:"expires" json:"expires"`
+}
+
+// Idempotency is implemented by stores that can keep idempotency keys shared
+// by every balancer replica, so the retries of a request get the response
+// of its first attempt whichever replica they reach
+type Idempotency interface {
+	// ClaimIdempotencyKey claims key until expires for the request with
+	// fingerprint, reporting false, with the key's record, when another
+	// request holds an unexpired claim on it
+	ClaimIdempotencyKey(ctx context.Context, key, fingerprint string, expires time.Time) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the response of the request holding the
+	// claim on key, kept until expires
+	CompleteIdempotencyKey(ctx context.Context, key string, response IdempotentResponse, expires time.Time) error
+	// ReleaseIdempotencyKey drops the claim on key, so the next request
+	// with it is forwarded
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
@@ -0,0 +1,30 @@
+package store
+
+import "context"
+
+// MaintenanceWindow struct represents a recurring time a node is taken out
+// of selection, e.g. nightly maintenance. Schedule is a cron expression
+// firing at the start of each window, see schedule.Parse, and Duration a
+// Go duration string such as "2h".
+type MaintenanceWindow struct {
+	ID       string `bson:"window_id" json:"id"`
+	NodeID   string `bson:"node_id" json:"node_id"`
+	Schedule string `bson:"schedule" json:"schedule"`
+	Duration string `bson:"duration" json:"duration"`
+	// Timezone is the IANA time zone the schedule is read in, UTC when empty
+	Timezone string `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Reason   string `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// Maintenance is implemented by stores that can keep the maintenance
+// windows of nodes, shared by every balancer replica
+type Maintenance interface {
+	// MaintenanceWindows returns every maintenance window
+	MaintenanceWindows(ctx context.Context) ([]MaintenanceWindow, error)
+	// SaveMaintenanceWindow adds a maintenance window or replaces the one
+	// with the same ID
+	SaveMaintenanceWindow(ctx context.Context, window MaintenanceWindow) error
+	// DeleteMaintenanceWindow removes a maintenance window, reporting
+	// whether it existed
+	DeleteMaintenanceWindow(ctx context.Context, id string) (bool, error)
+}
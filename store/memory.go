@@ -0,0 +1,644 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recordShards is how many independently locked shards the request records
+// of a MemoryStore are split into by node, so requests for different nodes
+// rarely wait for each other
+const recordShards = 16
+
+// MemoryStore keeps node limits and request records in process memory. It is
+// meant for tests and local development; nothing survives a restart unless
+// its rate limit windows are checkpointed, see WriteCheckpoint.
+type MemoryStore struct {
+	mu    sync.Mutex
+	nodes map[string]NodeLimits
+	rules map[string]RoutingRule
+	jobs  map[string]Job
+	// windows holds the maintenance windows by ID
+	windows map[string]MaintenanceWindow
+	tenants map[string]Tenant
+	acls    map[string]AccessList
+	// rejections is the reject log, a ring of memoryRejectLogEntries
+	// rejections whose oldest is at rejectionsNext once it is full
+	rejections     []Rejection
+	rejectionsNext int
+	// counters are dropped once expired when new ones are added
+	counters map[string]counter
+	// idempotencyKeys are dropped once expired when new ones are claimed
+	idempotencyKeys map[string]IdempotencyRecord
+	// outcomes is a ring of memoryOutcomeEntries outcomes, like rejections
+	outcomes     []Outcome
+	outcomesNext int
+	// summaries holds the usage summaries by period, start and node
+	summaries map[UsageSummary]UsageSummary
+	// shards hold the request records, see recordShards
+	shards    [recordShards]recordShard
+	retention atomic.Int64
+}
+
+// recordShard struct represents the request records of some of the nodes,
+// oldest first per node
+type recordShard struct {
+	mu      sync.Mutex
+	records map[string][]Record
+}
+
+// NewMemoryStore returns a store configured with the given nodes. Records and
+// finished jobs older than a day are discarded, see SetRetention.
+func NewMemoryStore(nodes ...NodeLimits) *MemoryStore {
+	s := &MemoryStore{nodes: map[string]NodeLimits{}, rules: map[string]RoutingRule{}, jobs: map[string]Job{}, windows: map[string]MaintenanceWindow{}, tenants: map[string]Tenant{}, acls: map[string]AccessList{}, counters: map[string]counter{}, idempotencyKeys: map[string]IdempotencyRecord{}, summaries: map[UsageSummary]UsageSummary{}}
+	for i := range s.shards {
+		s.shards[i].records = map[string][]Record{}
+	}
+	s.retention.Store(int64(24 * time.Hour))
+	for _, node := range nodes {
+		s.nodes[node.NodeID] = node
+	}
+	return s
+}
+
+// SetRetention sets how long request records and finished jobs are kept; zero
+// keeps them forever
+func (s *MemoryStore) SetRetention(retention time.Duration) {
+	s.retention.Store(int64(retention))
+}
+
+// shard returns the shard holding the records of a node
+func (s *MemoryStore) shard(nodeID string) *recordShard {
+	// FNV-1a, inline so routing decisions do not allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(nodeID); i++ {
+		h ^= uint32(nodeID[i])
+		h *= 16777619
+	}
+	return &s.shards[h%recordShards]
+}
+
+// SetNodeLimits adds or replaces the limits of a node
+func (s *MemoryStore) SetNodeLimits(node NodeLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[node.NodeID] = node
+}
+
+func (s *MemoryStore) NodeLimits(ctx context.Context) (map[string]NodeLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits := make(map[string]NodeLimits, len(s.nodes))
+	for id, node := range s.nodes {
+		limits[id] = node
+	}
+	return limits, nil
+}
+
+func (s *MemoryStore) SaveNodeLimits(ctx context.Context, node NodeLimits) error {
+	s.SetNodeLimits(node)
+	return nil
+}
+
+func (s *MemoryStore) DeleteNodeLimits(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.nodes[id]
+	delete(s.nodes, id)
+	return ok, nil
+}
+
+func (s *MemoryStore) Usage(ctx context.Context, since time.Time) (map[string]Usage, error) {
+	return s.usage(since, func(Record) bool { return true }), nil
+}
+
+func (s *MemoryStore) OperationUsage(ctx context.Context, operation string, since time.Time) (map[string]Usage, error) {
+	return s.usage(since, func(record Record) bool { return record.Operation == operation }), nil
+}
+
+// usage sums the matching records since a time, one shard at a time. It
+// also drops expired records, of nodes no longer sent requests as well.
+func (s *MemoryStore) usage(since time.Time, match func(Record) bool) map[string]Usage {
+	usage := map[string]Usage{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for nodeID := range shard.records {
+			records := s.expireLocked(shard, nodeID)
+			if u, ok := nodeUsage(records, since, match); ok {
+				usage[nodeID] = u
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return usage
+}
+
+// nodeUsage sums the matching records of one node since a time, reporting
+// false when there are none
+func nodeUsage(records []Record, since time.Time, match func(Record) bool) (Usage, bool) {
+	var u Usage
+	for _, record := range records {
+		if !record.Timestamp.After(since) || !match(record) {
+			continue
+		}
+		if u.Requests == 0 || record.Timestamp.Before(u.Oldest) {
+			u.Oldest = record.Timestamp
+		}
+		u.Requests++
+		u.BPM += record.BPM
+	}
+	return u, u.Requests > 0
+}
+
+func (s *MemoryStore) RecordRequest(ctx context.Context, record Record) error {
+	shard := s.shard(record.NodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	s.appendLocked(shard, record)
+	return nil
+}
+
+// RecordRequests stores many records, taking each shard's lock once
+func (s *MemoryStore) RecordRequests(ctx context.Context, records []Record) error {
+	byShard := map[*recordShard][]Record{}
+	for _, record := range records {
+		shard := s.shard(record.NodeID)
+		byShard[shard] = append(byShard[shard], record)
+	}
+	for shard, records := range byShard {
+		shard.mu.Lock()
+		for _, record := range records {
+			s.appendLocked(shard, record)
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// Reserve checks and stores record under the lock of the node's shard, so
+// concurrent requests of the process never overshoot the limits
+func (s *MemoryStore) Reserve(ctx context.Context, record Record, limits []Limit) (bool, error) {
+	shard := s.shard(record.NodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	records := shard.records[record.NodeID]
+	for _, limit := range limits {
+		u, _ := nodeUsage(records, record.Timestamp.Add(-limit.Period), func(r Record) bool {
+			return limit.Operation == "" || r.Operation == limit.Operation
+		})
+		if limit.Bytes && u.BPM+record.BPM > limit.Limit || !limit.Bytes && u.Requests+1 > limit.Limit {
+			return false, nil
+		}
+	}
+	s.appendLocked(shard, record)
+	return true, nil
+}
+
+// appendLocked stores a record in its shard, whose lock the caller holds
+func (s *MemoryStore) appendLocked(shard *recordShard, record Record) {
+	shard.records[record.NodeID] = append(s.expireLocked(shard, record.NodeID), record)
+}
+
+// expireLocked drops the records of a node older than the retention and
+// returns the rest. The caller holds the shard's lock.
+func (s *MemoryStore) expireLocked(shard *recordShard, nodeID string) []Record {
+	// Records are appended in time order, so expired ones are at the front
+	records := shard.records[nodeID]
+	retention := time.Duration(s.retention.Load())
+	cutoff := time.Now().Add(-retention)
+	expired := 0
+	for retention > 0 && expired < len(records) && records[expired].Timestamp.Before(cutoff) {
+		expired++
+	}
+	if expired == 0 {
+		return records
+	}
+	if expired == len(records) {
+		delete(shard.records, nodeID)
+		return nil
+	}
+	shard.records[nodeID] = records[expired:]
+	return records[expired:]
+}
+
+func (s *MemoryStore) RoutingRules(ctx context.Context) ([]RoutingRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := make([]RoutingRule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *MemoryStore) SaveRoutingRule(ctx context.Context, rule RoutingRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[rule.ID] = rule
+	return nil
+}
+
+func (s *MemoryStore) DeleteRoutingRule(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rules[id]
+	delete(s.rules, id)
+	return ok, nil
+}
+
+func (s *MemoryStore) MaintenanceWindows(ctx context.Context) ([]MaintenanceWindow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windows := make([]MaintenanceWindow, 0, len(s.windows))
+	for _, window := range s.windows {
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func (s *MemoryStore) SaveMaintenanceWindow(ctx context.Context, window MaintenanceWindow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows[window.ID] = window
+	return nil
+}
+
+func (s *MemoryStore) DeleteMaintenanceWindow(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.windows[id]
+	delete(s.windows, id)
+	return ok, nil
+}
+
+func (s *MemoryStore) Tenants(ctx context.Context) ([]Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenants := make([]Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+func (s *MemoryStore) SaveTenant(ctx context.Context, tenant Tenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[tenant.ID] = tenant
+	return nil
+}
+
+func (s *MemoryStore) DeleteTenant(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tenants[id]
+	delete(s.tenants, id)
+	return ok, nil
+}
+
+func (s *MemoryStore) AccessLists(ctx context.Context) ([]AccessList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lists := make([]AccessList, 0, len(s.acls))
+	for _, list := range s.acls {
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+func (s *MemoryStore) SaveAccessList(ctx context.Context, list AccessList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acls[list.ID] = list
+	return nil
+}
+
+func (s *MemoryStore) DeleteAccessList(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.acls[id]
+	delete(s.acls, id)
+	return ok, nil
+}
+
+func (s *MemoryStore) RecordRejection(ctx context.Context, rejection Rejection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rejections) < memoryRejectLogEntries {
+		s.rejections = append(s.rejections, rejection)
+		return nil
+	}
+	s.rejections[s.rejectionsNext] = rejection
+	s.rejectionsNext = (s.rejectionsNext + 1) % memoryRejectLogEntries
+	return nil
+}
+
+// eachRejection calls f with the rejections newest first until it returns
+// false. The caller holds s.mu.
+func (s *MemoryStore) eachRejection(f func(Rejection) bool) {
+	n := len(s.rejections)
+	for i := 1; i <= n; i++ {
+		if !f(s.rejections[(s.rejectionsNext-i+n)%n]) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) Rejections(ctx context.Context, client string, since time.Time, limit int) ([]Rejection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rejections := []Rejection{}
+	s.eachRejection(func(rejection Rejection) bool {
+		if rejection.Time.Before(since) || len(rejections) >= limit {
+			return false
+		}
+		if client == "" || rejection.Client == client {
+			rejections = append(rejections, rejection)
+		}
+		return true
+	})
+	return rejections, nil
+}
+
+func (s *MemoryStore) RejectionCounts(ctx context.Context, client string, since, until time.Time) ([]RejectionCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[RejectionCount]int{}
+	s.eachRejection(func(rejection Rejection) bool {
+		if rejection.Time.Before(since) {
+			return false
+		}
+		if rejection.Time.Before(until) && (client == "" || rejection.Client == client) {
+			counts[RejectionCount{Client: rejection.Client, Route: rejection.Route, Reason: rejection.Reason}]++
+		}
+		return true
+	})
+	result := make([]RejectionCount, 0, len(counts))
+	for key, count := range counts {
+		key.Count = count
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) RecordOutcome(ctx context.Context, outcome Outcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.outcomes) < memoryOutcomeEntries {
+		s.outcomes = append(s.outcomes, outcome)
+		return nil
+	}
+	s.outcomes[s.outcomesNext] = outcome
+	s.outcomesNext = (s.outcomesNext + 1) % memoryOutcomeEntries
+	return nil
+}
+
+func (s *MemoryStore) Outcomes(ctx context.Context, filter OutcomeFilter, limit int) ([]Outcome, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outcomes := []Outcome{}
+	n := len(s.outcomes)
+	for i := 1; i <= n && len(outcomes) < limit; i++ {
+		outcome := s.outcomes[(s.outcomesNext-i+n)%n]
+		if outcome.Time.Before(filter.Since) {
+			break
+		}
+		if filter.match(outcome) {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	return outcomes, nil
+}
+
+func (s *MemoryStore) HourlyUsage(ctx context.Context, since, until time.Time) ([]UsageSummary, error) {
+	var summaries []UsageSummary
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for nodeID := range shard.records {
+			summaries = append(summaries, hourlyRecords(s.expireLocked(shard, nodeID), since, until)...)
+		}
+		shard.mu.Unlock()
+	}
+	return summaries, nil
+}
+
+func (s *MemoryStore) SaveUsageSummaries(ctx context.Context, summaries []UsageSummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, summary := range summaries {
+		s.summaries[UsageSummary{Period: summary.Period, Start: summary.Start, NodeID: summary.NodeID}] = summary
+	}
+	return nil
+}
+
+func (s *MemoryStore) UsageSummaries(ctx context.Context, period, nodeID string, since, until time.Time) ([]UsageSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summaries := []UsageSummary{}
+	for _, summary := range s.summaries {
+		if summary.Period == period && (nodeID == "" || summary.NodeID == nodeID) && !summary.Start.Before(since) && summary.Start.Before(until) {
+			summaries = append(summaries, summary)
+		}
+	}
+	sortSummaries(summaries)
+	return summaries, nil
+}
+
+// ReadNodeLimitsFile reads a JSON array of node limits, e.g.
+//
+//	[{"node_id": "node-1", "address": "localhost:9001", "rpm_limit": 60, "bpm_limit": 1000}]
+func ReadNodeLimitsFile(path string) ([]NodeLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []NodeLimits
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// EnqueueJob adds a pending job, discarding finished jobs older than the
+// retention
+func (s *MemoryStore) EnqueueJob(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if retention := time.Duration(s.retention.Load()); retention > 0 {
+		for id, j := range s.jobs {
+			if !j.Finished.IsZero() && j.Finished.Before(now.Add(-retention)) {
+				delete(s.jobs, id)
+			}
+		}
+	}
+	job.Status, job.VisibleAt, job.Created, job.Updated = JobPending, now, now, now
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *MemoryStore) ClaimJob(ctx context.Context, visibility time.Duration) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var next Job
+	found := false
+	for id, job := range s.jobs {
+		if job.Status != JobPending && job.Status != JobLeased || job.VisibleAt.After(now) {
+			continue
+		}
+		if job.Status == JobLeased && job.Attempts >= job.MaxAttempts {
+			job.Status, job.Lease, job.Error, job.Updated, job.Finished = JobDead, "", expiredJobError, now, now
+			s.jobs[id] = job
+			continue
+		}
+		if !found || job.VisibleAt.Before(next.VisibleAt) {
+			next, found = job, true
+		}
+	}
+	if !found {
+		return Job{}, false, nil
+	}
+	next.Status, next.Lease, next.VisibleAt, next.Updated = JobLeased, randomHex(8), now.Add(visibility), now
+	next.Attempts++
+	s.jobs[next.ID] = next
+	return next, true, nil
+}
+
+// leasedLocked returns job id, reporting whether lease still holds it
+func (s *MemoryStore) leasedLocked(id, lease string) (Job, bool) {
+	job, ok := s.jobs[id]
+	return job, ok && job.Status == JobLeased && job.Lease == lease
+}
+
+func (s *MemoryStore) CompleteJob(ctx context.Context, id, lease string, result []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.leasedLocked(id, lease)
+	if !ok {
+		return false, nil
+	}
+	now := time.Now()
+	job.Status, job.Lease, job.Result, job.Error, job.Updated, job.Finished = JobDone, "", result, "", now, now
+	s.jobs[id] = job
+	return true, nil
+}
+
+func (s *MemoryStore) FailJob(ctx context.Context, id, lease, reason string, delay time.Duration) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.leasedLocked(id, lease)
+	if !ok {
+		return Job{}, false, nil
+	}
+	now := time.Now()
+	job.Status, job.Lease, job.Error, job.VisibleAt, job.Updated = JobPending, "", reason, now.Add(delay), now
+	if job.Attempts >= job.MaxAttempts {
+		job.Status, job.Finished = JobDead, now
+	}
+	s.jobs[id] = job
+	return job, true, nil
+}
+
+func (s *MemoryStore) RetryJob(ctx context.Context, id, lease string, delay time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.leasedLocked(id, lease)
+	if !ok {
+		return false, nil
+	}
+	now := time.Now()
+	job.Status, job.Lease, job.VisibleAt, job.Updated = JobPending, "", now.Add(delay), now
+	job.Attempts--
+	s.jobs[id] = job
+	return true, nil
+}
+
+func (s *MemoryStore) Job(ctx context.Context, id string) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok, nil
+}
+
+func (s *MemoryStore) IncrementCounter(ctx context.Context, key string, expires time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.Expires) {
+		for k, other := range s.counters {
+			if !now.Before(other.Expires) {
+				delete(s.counters, k)
+			}
+		}
+		c = counter{}
+	}
+	c.Value++
+	c.Expires = expires
+	s.counters[key] = c
+	return c.Value, nil
+}
+
+func (s *MemoryStore) Counter(ctx context.Context, key string) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok || !time.Now().Before(c.Expires) {
+		return 0, time.Time{}, nil
+	}
+	return c.Value, c.Expires, nil
+}
+
+func (s *MemoryStore) DeleteCounter(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.counters, key)
+	return nil
+}
+
+func (s *MemoryStore) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string, expires time.Time) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if record, ok := s.idempotencyKeys[key]; ok && now.Before(record.Expires) {
+		return record, false, nil
+	}
+	for k, other := range s.idempotencyKeys {
+		if !now.Before(other.Expires) {
+			delete(s.idempotencyKeys, k)
+		}
+	}
+	record := IdempotencyRecord{Fingerprint: fingerprint, Expires: expires}
+	s.idempotencyKeys[key] = record
+	return record, true, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, key string, response IdempotentResponse, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.idempotencyKeys[key]; ok {
+		record.Response, record.Expires = &response, expires
+		s.idempotencyKeys[key] = record
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotencyKeys, key)
+	return nil
+}
@@ -0,0 +1,386 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreNodeLimits(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(NodeLimits{NodeID: "node-1", RPMLimit: 10})
+	if err := s.SaveNodeLimits(ctx, NodeLimits{NodeID: "node-2", RPMLimit: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveNodeLimits(ctx, NodeLimits{NodeID: "node-1", RPMLimit: 15}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ := s.NodeLimits(ctx)
+	if len(nodes) != 2 || nodes["node-1"].RPMLimit != 15 || nodes["node-2"].RPMLimit != 20 {
+		t.Fatalf("got %+v, expected node-1 replaced at 15 and node-2 at 20", nodes)
+	}
+
+	// The returned map is a copy
+	delete(nodes, "node-2")
+	if nodes, _ := s.NodeLimits(ctx); len(nodes) != 2 {
+		t.Fatalf("deleting from the returned map changed the store: %+v", nodes)
+	}
+
+	tests := []struct {
+		id      string
+		existed bool
+	}{
+		{"node-2", true},
+		{"node-2", false},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		if existed, err := s.DeleteNodeLimits(ctx, tt.id); err != nil || existed != tt.existed {
+			t.Errorf("DeleteNodeLimits(%s) = %v, %v, expected %v", tt.id, existed, err, tt.existed)
+		}
+	}
+}
+
+func TestMemoryStoreUsage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryStore()
+	records := []Record{
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now.Add(-90 * time.Second), BPM: 100},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now.Add(-30 * time.Second), BPM: 10},
+		{NodeID: "node-1", Operation: "GET /api", Timestamp: now.Add(-20 * time.Second), BPM: 20},
+		{NodeID: "node-2", Operation: "POST /request", Timestamp: now.Add(-10 * time.Second), BPM: 5},
+	}
+	for _, record := range records {
+		if err := s.RecordRequest(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		operation string
+		since     time.Time
+		expected  map[string]Usage
+	}{
+		{
+			name:  "last minute",
+			since: now.Add(-time.Minute),
+			expected: map[string]Usage{
+				"node-1": {Requests: 2, BPM: 30, Oldest: records[1].Timestamp},
+				"node-2": {Requests: 1, BPM: 5, Oldest: records[3].Timestamp},
+			},
+		},
+		{
+			name:  "last two minutes",
+			since: now.Add(-2 * time.Minute),
+			expected: map[string]Usage{
+				"node-1": {Requests: 3, BPM: 130, Oldest: records[0].Timestamp},
+				"node-2": {Requests: 1, BPM: 5, Oldest: records[3].Timestamp},
+			},
+		},
+		{
+			name:      "one operation",
+			operation: "GET /api",
+			since:     now.Add(-time.Minute),
+			expected:  map[string]Usage{"node-1": {Requests: 1, BPM: 20, Oldest: records[2].Timestamp}},
+		},
+		{
+			name:     "nothing since",
+			since:    now,
+			expected: map[string]Usage{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var usage map[string]Usage
+			var err error
+			if tt.operation != "" {
+				usage, err = s.OperationUsage(ctx, tt.operation, tt.since)
+			} else {
+				usage, err = s.Usage(ctx, tt.since)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(usage) != len(tt.expected) {
+				t.Fatalf("got %+v, expected %+v", usage, tt.expected)
+			}
+			for id, expected := range tt.expected {
+				if got := usage[id]; got.Requests != expected.Requests || got.BPM != expected.BPM || !got.Oldest.Equal(expected.Oldest) {
+					t.Errorf("%s: got %+v, expected %+v", id, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRetention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryStore()
+	s.SetRetention(time.Hour)
+	s.RecordRequests(ctx, []Record{
+		{NodeID: "node-1", Timestamp: now.Add(-2 * time.Hour)},
+		{NodeID: "node-1", Timestamp: now.Add(-time.Minute)},
+		{NodeID: "node-2", Timestamp: now.Add(-3 * time.Hour)},
+	})
+	usage, _ := s.Usage(ctx, now.Add(-24*time.Hour))
+	if usage["node-1"].Requests != 1 {
+		t.Errorf("node-1 has %d requests, expected the one within the retention", usage["node-1"].Requests)
+	}
+	if _, ok := usage["node-2"]; ok {
+		t.Errorf("node-2 has usage %+v, expected its only record to expire", usage["node-2"])
+	}
+
+	// Without a retention nothing expires
+	s = NewMemoryStore()
+	s.SetRetention(0)
+	s.RecordRequests(ctx, []Record{
+		{NodeID: "node-1", Timestamp: now.Add(-72 * time.Hour)},
+		{NodeID: "node-1", Timestamp: now.Add(-time.Minute)},
+	})
+	if usage, _ := s.Usage(ctx, now.Add(-100*time.Hour)); usage["node-1"].Requests != 2 {
+		t.Errorf("node-1 has %d requests, expected both kept", usage["node-1"].Requests)
+	}
+}
+
+func TestMemoryStoreReserve(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		name     string
+		existing []Record
+		record   Record
+		limits   []Limit
+		admitted bool
+	}{
+		{
+			name:     "under the request limit",
+			existing: []Record{{NodeID: "n", Timestamp: now.Add(-time.Second)}},
+			record:   Record{NodeID: "n", Timestamp: now},
+			limits:   []Limit{{Period: time.Minute, Limit: 2}},
+			admitted: true,
+		},
+		{
+			name:     "at the request limit",
+			existing: []Record{{NodeID: "n", Timestamp: now.Add(-time.Second)}, {NodeID: "n", Timestamp: now.Add(-2 * time.Second)}},
+			record:   Record{NodeID: "n", Timestamp: now},
+			limits:   []Limit{{Period: time.Minute, Limit: 2}},
+		},
+		{
+			name:     "records out of the window do not count",
+			existing: []Record{{NodeID: "n", Timestamp: now.Add(-2 * time.Minute)}},
+			record:   Record{NodeID: "n", Timestamp: now},
+			limits:   []Limit{{Period: time.Minute, Limit: 1}},
+			admitted: true,
+		},
+		{
+			name:     "over the byte limit",
+			existing: []Record{{NodeID: "n", Timestamp: now.Add(-time.Second), BPM: 80}},
+			record:   Record{NodeID: "n", Timestamp: now, BPM: 30},
+			limits:   []Limit{{Period: time.Minute, Limit: 100, Bytes: true}},
+		},
+		{
+			name:     "other operations do not count against an operation limit",
+			existing: []Record{{NodeID: "n", Operation: "GET /a", Timestamp: now.Add(-time.Second)}},
+			record:   Record{NodeID: "n", Operation: "GET /b", Timestamp: now},
+			limits:   []Limit{{Operation: "GET /b", Period: time.Minute, Limit: 1}},
+			admitted: true,
+		},
+		{
+			name:     "every limit must hold",
+			existing: []Record{{NodeID: "n", Timestamp: now.Add(-30 * time.Second)}},
+			record:   Record{NodeID: "n", Timestamp: now},
+			limits:   []Limit{{Period: time.Minute, Limit: 10}, {Period: time.Hour, Limit: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			s.RecordRequests(ctx, tt.existing)
+			admitted, err := s.Reserve(ctx, tt.record, tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if admitted != tt.admitted {
+				t.Fatalf("admitted %v, expected %v", admitted, tt.admitted)
+			}
+			usage, _ := s.Usage(ctx, now.Add(-time.Hour))
+			expected := len(tt.existing)
+			if tt.admitted {
+				expected++
+			}
+			if got := usage["n"].Requests; got != expected {
+				t.Errorf("%d records, expected %d: a refused request must not be recorded", got, expected)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreReserveConcurrently(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	limits := []Limit{{Period: time.Minute, Limit: 25}}
+	var admitted sync.Map
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Go(func() {
+			ok, err := s.Reserve(ctx, Record{NodeID: "n", Timestamp: time.Now()}, limits)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				admitted.Store(i, true)
+			}
+		})
+	}
+	wg.Wait()
+	n := 0
+	admitted.Range(func(any, any) bool { n++; return true })
+	if n != 25 {
+		t.Errorf("admitted %d concurrent requests, expected the limit of 25", n)
+	}
+}
+
+func TestMemoryStoreJobs(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	if err := s.EnqueueJob(ctx, Job{ID: "job-1", MaxAttempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok, _ := s.ClaimJob(ctx, time.Minute)
+	if !ok || job.ID != "job-1" || job.Status != JobLeased || job.Attempts != 1 {
+		t.Fatalf("claimed %+v, %v, expected job-1 leased on its first attempt", job, ok)
+	}
+	if _, ok, _ := s.ClaimJob(ctx, time.Minute); ok {
+		t.Fatal("claimed a leased job again before its visibility timeout")
+	}
+	if ok, _ := s.CompleteJob(ctx, job.ID, "other-lease", nil); ok {
+		t.Fatal("completed a job with another lease")
+	}
+
+	failed, ok, _ := s.FailJob(ctx, job.ID, job.Lease, "boom", 0)
+	if !ok || failed.Status != JobPending || failed.Error != "boom" {
+		t.Fatalf("failed %+v, %v, expected the job pending again", failed, ok)
+	}
+	job, ok, _ = s.ClaimJob(ctx, time.Minute)
+	if !ok || job.Attempts != 2 {
+		t.Fatalf("claimed %+v, %v, expected the second attempt", job, ok)
+	}
+	if ok, _ := s.CompleteJob(ctx, job.ID, job.Lease, []byte("done")); !ok {
+		t.Fatal("could not complete the job with its lease")
+	}
+	job, _, _ = s.Job(ctx, "job-1")
+	if job.Status != JobDone || string(job.Result) != "done" || job.Finished.IsZero() {
+		t.Errorf("got %+v, expected job-1 done with its result", job)
+	}
+}
+
+func TestMemoryStoreJobLeases(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	if err := s.EnqueueJob(ctx, Job{ID: "job-1", MaxAttempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Work that could not start is retried without counting the attempt
+	job, _, _ := s.ClaimJob(ctx, time.Minute)
+	if ok, _ := s.RetryJob(ctx, job.ID, job.Lease, 0); !ok {
+		t.Fatal("could not retry the job with its lease")
+	}
+	// A lease running out hands the job to the next worker
+	job, _, _ = s.ClaimJob(ctx, 0)
+	if job.Attempts != 1 {
+		t.Fatalf("claimed %+v, expected the retry not counted", job)
+	}
+	next, ok, _ := s.ClaimJob(ctx, 0)
+	if !ok || next.Attempts != 2 || next.Lease == job.Lease {
+		t.Fatalf("claimed %+v, %v, expected the expired job on a new lease", next, ok)
+	}
+	if ok, _ := s.CompleteJob(ctx, job.ID, job.Lease, nil); ok {
+		t.Fatal("completed the job with an expired lease")
+	}
+
+	// The job is dead once its last lease runs out
+	if _, ok, _ := s.ClaimJob(ctx, time.Minute); ok {
+		t.Fatal("claimed a job that used up its attempts")
+	}
+	job, _, _ = s.Job(ctx, "job-1")
+	if job.Status != JobDead || job.Error != expiredJobError {
+		t.Errorf("got %+v, expected job-1 dead after its visibility timeout", job)
+	}
+
+	if err := s.EnqueueJob(ctx, Job{ID: "job-2", MaxAttempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	job, _, _ = s.ClaimJob(ctx, time.Minute)
+	if failed, ok, _ := s.FailJob(ctx, job.ID, job.Lease, "boom", 0); !ok || failed.Status != JobDead || failed.Finished.IsZero() {
+		t.Errorf("failed %+v, %v, expected job-2 dead after its only attempt", failed, ok)
+	}
+}
+
+func TestMemoryStoreCounters(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	expires := time.Now().Add(time.Minute)
+	for i := int64(1); i <= 3; i++ {
+		if n, _ := s.IncrementCounter(ctx, "k", expires); n != i {
+			t.Fatalf("increment %d returned %d", i, n)
+		}
+	}
+	if n, at, _ := s.Counter(ctx, "k"); n != 3 || !at.Equal(expires) {
+		t.Errorf("got %d expiring at %s, expected 3 at %s", n, at, expires)
+	}
+
+	// An expired counter starts over
+	s.IncrementCounter(ctx, "old", time.Now().Add(-time.Second))
+	if n, _ := s.IncrementCounter(ctx, "old", expires); n != 1 {
+		t.Errorf("expired counter incremented to %d, expected to start over at 1", n)
+	}
+	s.DeleteCounter(ctx, "k")
+	if n, _, _ := s.Counter(ctx, "k"); n != 0 {
+		t.Errorf("deleted counter is %d", n)
+	}
+}
+
+func TestMemoryStoreOutcomes(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	now := time.Now()
+	for i, status := range []int{200, 503, 0, 204} {
+		s.RecordOutcome(ctx, Outcome{Time: now.Add(time.Duration(i-4) * time.Minute), NodeID: "node-1", Status: status})
+	}
+	s.RecordOutcome(ctx, Outcome{Time: now.Add(-time.Second), NodeID: "node-2", Status: 200})
+
+	tests := []struct {
+		name     string
+		filter   OutcomeFilter
+		limit    int
+		expected []int
+	}{
+		{name: "newest first", filter: OutcomeFilter{NodeID: "node-1", Since: now.Add(-time.Hour), Until: now}, limit: 10, expected: []int{204, 0, 503, 200}},
+		{name: "limit", filter: OutcomeFilter{NodeID: "node-1", Since: now.Add(-time.Hour), Until: now}, limit: 2, expected: []int{204, 0}},
+		{name: "2xx", filter: OutcomeFilter{NodeID: "node-1", Since: now.Add(-time.Hour), Until: now, MinStatus: 200, MaxStatus: 299}, limit: 10, expected: []int{204, 200}},
+		{name: "no answer", filter: OutcomeFilter{Since: now.Add(-time.Hour), Until: now, MinStatus: 0, MaxStatus: 99}, limit: 10, expected: []int{0}},
+		{name: "window", filter: OutcomeFilter{NodeID: "node-1", Since: now.Add(-3*time.Minute - time.Second), Until: now.Add(-time.Minute - time.Second)}, limit: 10, expected: []int{0, 503}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcomes, err := s.Outcomes(ctx, tt.filter, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses []int
+			for _, outcome := range outcomes {
+				statuses = append(statuses, outcome.Status)
+			}
+			if !slices.Equal(statuses, tt.expected) {
+				t.Errorf("got statuses %v, expected %v", statuses, tt.expected)
+			}
+		})
+	}
+}
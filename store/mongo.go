@@ -0,0 +1,875 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoStore keeps node limits in the node_limits collection, request
+// records in the requests collection, or in batches in the request_batches
+// collection, see SetRecordFormat, A/B routing rules in the
+// routing_rules collection, queued jobs in the jobs collection, shared
+// counters in the counters collection, maintenance windows in the
+// maintenance_windows collection, tenants in the tenants collection, IP
+// access lists in the access_lists collection, sampled requests in the
+// audit_samples collection, idempotency keys in the idempotency_keys
+// collection, usage reports in the usage_summaries collection and request
+// outcomes in the request_outcomes collection
+type MongoStore struct {
+	client             *mongo.Client
+	nodeCollection     *mongo.Collection
+	requestsCollection *mongo.Collection
+	rulesCollection    *mongo.Collection
+	jobsCollection     *mongo.Collection
+	countersCollection *mongo.Collection
+	windowsCollection  *mongo.Collection
+	tenantsCollection  *mongo.Collection
+	aclsCollection     *mongo.Collection
+	batchesCollection  *mongo.Collection
+	// rejectionsCollection is capped, see RejectLogEntries
+	rejectionsCollection *mongo.Collection
+	// auditCollection is capped, see AuditLogEntries
+	auditCollection       *mongo.Collection
+	idempotencyCollection *mongo.Collection
+	summariesCollection   *mongo.Collection
+	outcomesCollection    *mongo.Collection
+	certsCollection       *mongo.Collection
+	// recordFormat is how request records are kept, see SetRecordFormat
+	recordFormat string
+}
+
+// NewMongoStore connects to the MongoDB server at uri and uses the given
+// database. A positive timeout bounds every operation, on top of the
+// deadline of its context.
+func NewMongoStore(ctx context.Context, uri, database string, timeout time.Duration) (*MongoStore, error) {
+	opts := options.Client().ApplyURI(uri)
+	if timeout > 0 {
+		opts.SetTimeout(timeout)
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db := client.Database(database)
+	return &MongoStore{
+		client:                client,
+		nodeCollection:        db.Collection("node_limits"),
+		requestsCollection:    db.Collection("requests"),
+		rulesCollection:       db.Collection("routing_rules"),
+		jobsCollection:        db.Collection("jobs"),
+		countersCollection:    db.Collection("counters"),
+		windowsCollection:     db.Collection("maintenance_windows"),
+		tenantsCollection:     db.Collection("tenants"),
+		aclsCollection:        db.Collection("access_lists"),
+		batchesCollection:     db.Collection("request_batches"),
+		rejectionsCollection:  db.Collection("rejections"),
+		auditCollection:       db.Collection("audit_samples"),
+		idempotencyCollection: db.Collection("idempotency_keys"),
+		summariesCollection:   db.Collection("usage_summaries"),
+		outcomesCollection:    db.Collection("request_outcomes"),
+		certsCollection:       db.Collection("certificates"),
+		recordFormat:          RecordDocuments,
+	}, nil
+}
+
+// Close disconnects from MongoDB
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+// Ping checks that the primary can be reached
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+// requestsTTLIndex, outcomesTTLIndex and jobsTTLIndex name the indexes
+// expiring request records, request outcomes and finished jobs
+const (
+	requestsTTLIndex = "timestamp_ttl"
+	outcomesTTLIndex = "time_ttl"
+	jobsTTLIndex     = "finished_ttl"
+)
+
+// Migrate creates the indexes of the usage queries, of the node, rule,
+// maintenance window, tenant and access list IDs, of claiming jobs and of
+// usage summaries and of the outcome queries, and TTL indexes letting
+// MongoDB delete request records, request outcomes and finished jobs once
+// they are older than retention. Existing TTL indexes are updated to retention, or dropped when
+// retention is zero.
+func (s *MongoStore) Migrate(ctx context.Context, retention time.Duration) error {
+	_, err := s.requestsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "node_id", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Keys: bson.D{{Key: "operation", Value: 1}, {Key: "node_id", Value: 1}, {Key: "timestamp", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.nodeCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "node_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	if _, err := s.rulesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "rule_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	if _, err := s.jobsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "visible_at", Value: 1}}}); err != nil {
+		return err
+	}
+	if _, err := s.windowsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "window_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	if _, err := s.tenantsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "tenant_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	if _, err := s.aclsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "acl_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	if _, err := s.summariesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "period", Value: 1}, {Key: "start", Value: 1}, {Key: "node_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return err
+	}
+	_, err = s.outcomesCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "node_id", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// Counters and idempotency keys expire at their own time, whatever the
+	// retention
+	if _, err := s.countersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}); err != nil {
+		return err
+	}
+	if _, err := s.idempotencyCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}); err != nil {
+		return err
+	}
+	if err := migrateTTLIndex(ctx, s.requestsCollection, requestsTTLIndex, "timestamp", retention); err != nil {
+		return err
+	}
+	if err := migrateTTLIndex(ctx, s.outcomesCollection, outcomesTTLIndex, "time", retention); err != nil {
+		return err
+	}
+	if err := s.migrateBatches(ctx, retention); err != nil {
+		return err
+	}
+	if err := s.migrateRejections(ctx); err != nil {
+		return err
+	}
+	if err := s.migrateAudit(ctx); err != nil {
+		return err
+	}
+	return migrateTTLIndex(ctx, s.jobsCollection, jobsTTLIndex, "finished", retention)
+}
+
+// migrateTTLIndex creates, updates or drops the TTL index expiring the
+// documents of collection once field is older than retention
+func migrateTTLIndex(ctx context.Context, collection *mongo.Collection, name, field string, retention time.Duration) error {
+	if retention <= 0 {
+		_, err := collection.Indexes().DropOne(ctx, name)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == 27 {
+			// IndexNotFound
+			return nil
+		}
+		return err
+	}
+	expireAfter := int32(retention / time.Second)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(expireAfter),
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 85 {
+		// IndexOptionsConflict: the index exists with another retention
+		return collection.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection.Name()},
+			{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: expireAfter}}},
+		}).Err()
+	}
+	return err
+}
+
+func (s *MongoStore) NodeLimits(ctx context.Context) (map[string]NodeLimits, error) {
+	cursor, err := s.nodeCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	limits := map[string]NodeLimits{}
+	for cursor.Next(ctx) {
+		var node NodeLimits
+		if err := cursor.Decode(&node); err != nil {
+			return nil, err
+		}
+		limits[node.NodeID] = node
+	}
+	return limits, cursor.Err()
+}
+
+func (s *MongoStore) SaveNodeLimits(ctx context.Context, node NodeLimits) error {
+	_, err := s.nodeCollection.ReplaceOne(ctx, bson.D{{Key: "node_id", Value: node.NodeID}}, node, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteNodeLimits(ctx context.Context, id string) (bool, error) {
+	result, err := s.nodeCollection.DeleteOne(ctx, bson.D{{Key: "node_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) Usage(ctx context.Context, since time.Time) (map[string]Usage, error) {
+	if s.batched() {
+		return s.batchUsage(ctx, since, "", "")
+	}
+	return s.usage(ctx, bson.D{
+		{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: since}}},
+	})
+}
+
+func (s *MongoStore) OperationUsage(ctx context.Context, operation string, since time.Time) (map[string]Usage, error) {
+	if s.batched() {
+		return s.batchUsage(ctx, since, "", operation)
+	}
+	return s.usage(ctx, bson.D{
+		{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: since}}},
+		{Key: "operation", Value: operation},
+	})
+}
+
+func (s *MongoStore) usage(ctx context.Context, match bson.D) (map[string]Usage, error) {
+	// Aggregate query to get the usage of each node in the window
+	cursor, err := s.requestsCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$node_id"},
+			{Key: "requests_count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "total_bpm", Value: bson.D{{Key: "$sum", Value: "$bpm"}}},
+			{Key: "oldest", Value: bson.D{{Key: "$min", Value: "$timestamp"}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	usage := map[string]Usage{}
+	for cursor.Next(ctx) {
+		var nodeInfo struct {
+			NodeID      string    `bson:"_id"`
+			RequestsCnt int       `bson:"requests_count"`
+			TotalBPM    int       `bson:"total_bpm"`
+			Oldest      time.Time `bson:"oldest"`
+		}
+		if err := cursor.Decode(&nodeInfo); err != nil {
+			return nil, err
+		}
+		usage[nodeInfo.NodeID] = Usage{Requests: nodeInfo.RequestsCnt, BPM: nodeInfo.TotalBPM, Oldest: nodeInfo.Oldest}
+	}
+	return usage, cursor.Err()
+}
+
+func (s *MongoStore) RecordRequest(ctx context.Context, record Record) error {
+	if s.batched() {
+		_, err := s.insertBatch(ctx, []Record{record})
+		return err
+	}
+	_, err := s.requestsCollection.InsertOne(ctx, bson.D{
+		{Key: "timestamp", Value: record.Timestamp},
+		{Key: "node_id", Value: record.NodeID},
+		{Key: "operation", Value: record.Operation},
+		{Key: "bpm", Value: record.BPM},
+	})
+	return err
+}
+
+// RecordRequests stores many records with one InsertMany, or as one batch
+func (s *MongoStore) RecordRequests(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if s.batched() {
+		_, err := s.insertBatch(ctx, records)
+		return err
+	}
+	docs := make([]any, len(records))
+	for i, record := range records {
+		docs[i] = bson.D{
+			{Key: "timestamp", Value: record.Timestamp},
+			{Key: "node_id", Value: record.NodeID},
+			{Key: "operation", Value: record.Operation},
+			{Key: "bpm", Value: record.BPM},
+		}
+	}
+	_, err := s.requestsCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// Reserve inserts record first and then counts the node's requests within
+// each limit, itself included, deleting the record again when a limit is
+// exceeded. Inserts never conflict, and of two replicas reserving the last
+// slot at once at least one sees the other's record, so nodes are never
+// admitted past their limits; under contention both may back off instead.
+// Every replica must read its own and the others' acknowledged writes, e.g.
+// by using the primary with w=majority.
+func (s *MongoStore) Reserve(ctx context.Context, record Record, limits []Limit) (bool, error) {
+	if s.batched() {
+		return s.reserveBatch(ctx, record, limits)
+	}
+	result, err := s.requestsCollection.InsertOne(ctx, bson.D{
+		{Key: "timestamp", Value: record.Timestamp},
+		{Key: "node_id", Value: record.NodeID},
+		{Key: "operation", Value: record.Operation},
+		{Key: "bpm", Value: record.BPM},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, limit := range limits {
+		match := bson.D{
+			{Key: "node_id", Value: record.NodeID},
+			{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: record.Timestamp.Add(-limit.Period)}}},
+		}
+		if limit.Operation != "" {
+			match = append(match, bson.E{Key: "operation", Value: limit.Operation})
+		}
+		usage, err := s.usage(ctx, match)
+		if err == nil {
+			u := usage[record.NodeID]
+			if limit.Bytes && u.BPM <= limit.Limit || !limit.Bytes && u.Requests <= limit.Limit {
+				continue
+			}
+		}
+		if _, delErr := s.requestsCollection.DeleteOne(ctx, bson.D{{Key: "_id", Value: result.InsertedID}}); delErr != nil && err == nil {
+			err = delErr
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// reserveBatch is Reserve for records kept in batches, the record being a
+// batch of its own
+func (s *MongoStore) reserveBatch(ctx context.Context, record Record, limits []Limit) (bool, error) {
+	id, err := s.insertBatch(ctx, []Record{record})
+	if err != nil {
+		return false, err
+	}
+	for _, limit := range limits {
+		usage, err := s.batchUsage(ctx, record.Timestamp.Add(-limit.Period), record.NodeID, limit.Operation)
+		if err == nil {
+			u := usage[record.NodeID]
+			if limit.Bytes && u.BPM <= limit.Limit || !limit.Bytes && u.Requests <= limit.Limit {
+				continue
+			}
+		}
+		if delErr := s.deleteBatch(ctx, id); delErr != nil && err == nil {
+			err = delErr
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MongoStore) RoutingRules(ctx context.Context) ([]RoutingRule, error) {
+	cursor, err := s.rulesCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rules := []RoutingRule{}
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *MongoStore) SaveRoutingRule(ctx context.Context, rule RoutingRule) error {
+	_, err := s.rulesCollection.ReplaceOne(ctx, bson.D{{Key: "rule_id", Value: rule.ID}}, rule, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteRoutingRule(ctx context.Context, id string) (bool, error) {
+	result, err := s.rulesCollection.DeleteOne(ctx, bson.D{{Key: "rule_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) MaintenanceWindows(ctx context.Context) ([]MaintenanceWindow, error) {
+	cursor, err := s.windowsCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	windows := []MaintenanceWindow{}
+	if err := cursor.All(ctx, &windows); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+func (s *MongoStore) SaveMaintenanceWindow(ctx context.Context, window MaintenanceWindow) error {
+	_, err := s.windowsCollection.ReplaceOne(ctx, bson.D{{Key: "window_id", Value: window.ID}}, window, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteMaintenanceWindow(ctx context.Context, id string) (bool, error) {
+	result, err := s.windowsCollection.DeleteOne(ctx, bson.D{{Key: "window_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) Tenants(ctx context.Context) ([]Tenant, error) {
+	cursor, err := s.tenantsCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tenants := []Tenant{}
+	if err := cursor.All(ctx, &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+func (s *MongoStore) SaveTenant(ctx context.Context, tenant Tenant) error {
+	_, err := s.tenantsCollection.ReplaceOne(ctx, bson.D{{Key: "tenant_id", Value: tenant.ID}}, tenant, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteTenant(ctx context.Context, id string) (bool, error) {
+	result, err := s.tenantsCollection.DeleteOne(ctx, bson.D{{Key: "tenant_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) AccessLists(ctx context.Context) ([]AccessList, error) {
+	cursor, err := s.aclsCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	lists := []AccessList{}
+	if err := cursor.All(ctx, &lists); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (s *MongoStore) SaveAccessList(ctx context.Context, list AccessList) error {
+	_, err := s.aclsCollection.ReplaceOne(ctx, bson.D{{Key: "acl_id", Value: list.ID}}, list, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteAccessList(ctx context.Context, id string) (bool, error) {
+	result, err := s.aclsCollection.DeleteOne(ctx, bson.D{{Key: "acl_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// rejectLogBytes caps the size of the rejections collection, which MongoDB
+// requires of capped collections on top of their document count
+const rejectLogBytes = 256 << 20
+
+// migrateRejections creates the capped rejections collection, unless it
+// exists, and its indexes
+func (s *MongoStore) migrateRejections(ctx context.Context) error {
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(rejectLogBytes).SetMaxDocuments(RejectLogEntries)
+	err := s.rejectionsCollection.Database().CreateCollection(ctx, s.rejectionsCollection.Name(), opts)
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Name == "NamespaceExists") {
+		return err
+	}
+	_, err = s.rejectionsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "client", Value: 1}, {Key: "time", Value: 1}}},
+	})
+	return err
+}
+
+// auditLogBytes caps the size of the audit_samples collection, whose
+// samples are much larger than rejections
+const auditLogBytes = 1 << 30
+
+// migrateAudit creates the capped audit_samples collection, unless it
+// exists, and its indexes
+func (s *MongoStore) migrateAudit(ctx context.Context) error {
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(auditLogBytes).SetMaxDocuments(AuditLogEntries)
+	err := s.auditCollection.Database().CreateCollection(ctx, s.auditCollection.Name(), opts)
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Name == "NamespaceExists") {
+		return err
+	}
+	_, err = s.auditCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "route", Value: 1}, {Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "node", Value: 1}, {Key: "time", Value: 1}}},
+	})
+	return err
+}
+
+func (s *MongoStore) RecordAuditSample(ctx context.Context, sample AuditSample) error {
+	_, err := s.auditCollection.InsertOne(ctx, sample)
+	return err
+}
+
+func (s *MongoStore) AuditSamples(ctx context.Context, filter AuditFilter, limit int) ([]AuditSample, error) {
+	query := bson.D{{Key: "time", Value: bson.D{{Key: "$gte", Value: filter.Since}}}}
+	for field, value := range map[string]string{"route": filter.Route, "node": filter.Node, "client": filter.Client} {
+		if value != "" {
+			query = append(query, bson.E{Key: field, Value: value})
+		}
+	}
+	cursor, err := s.auditCollection.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	samples := []AuditSample{}
+	if err := cursor.All(ctx, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+func (s *MongoStore) RecordRejection(ctx context.Context, rejection Rejection) error {
+	_, err := s.rejectionsCollection.InsertOne(ctx, rejection)
+	return err
+}
+
+func (s *MongoStore) Rejections(ctx context.Context, client string, since time.Time, limit int) ([]Rejection, error) {
+	filter := bson.D{{Key: "time", Value: bson.D{{Key: "$gte", Value: since}}}}
+	if client != "" {
+		filter = append(filter, bson.E{Key: "client", Value: client})
+	}
+	cursor, err := s.rejectionsCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rejections := []Rejection{}
+	if err := cursor.All(ctx, &rejections); err != nil {
+		return nil, err
+	}
+	return rejections, nil
+}
+
+func (s *MongoStore) RejectionCounts(ctx context.Context, client string, since, until time.Time) ([]RejectionCount, error) {
+	match := bson.D{{Key: "time", Value: bson.D{{Key: "$gte", Value: since}, {Key: "$lt", Value: until}}}}
+	if client != "" {
+		match = append(match, bson.E{Key: "client", Value: client})
+	}
+	cursor, err := s.rejectionsCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "client", Value: "$client"}, {Key: "route", Value: "$route"}, {Key: "reason", Value: "$reason"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "client", Value: "$_id.client"}, {Key: "route", Value: "$_id.route"}, {Key: "reason", Value: "$_id.reason"}, {Key: "count", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	counts := []RejectionCount{}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (s *MongoStore) RecordOutcome(ctx context.Context, outcome Outcome) error {
+	_, err := s.outcomesCollection.InsertOne(ctx, outcome)
+	return err
+}
+
+func (s *MongoStore) Outcomes(ctx context.Context, filter OutcomeFilter, limit int) ([]Outcome, error) {
+	query := bson.D{{Key: "time", Value: bson.D{{Key: "$gte", Value: filter.Since}, {Key: "$lt", Value: filter.Until}}}}
+	if filter.NodeID != "" {
+		query = append(query, bson.E{Key: "node_id", Value: filter.NodeID})
+	}
+	if filter.MaxStatus != 0 {
+		query = append(query, bson.E{Key: "status", Value: bson.D{{Key: "$gte", Value: filter.MinStatus}, {Key: "$lte", Value: filter.MaxStatus}}})
+	}
+	cursor, err := s.outcomesCollection.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	outcomes := []Outcome{}
+	if err := cursor.All(ctx, &outcomes); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+func (s *MongoStore) HourlyUsage(ctx context.Context, since, until time.Time) ([]UsageSummary, error) {
+	if s.batched() {
+		return s.batchHourlyUsage(ctx, since, until)
+	}
+	cursor, err := s.requestsCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: since}, {Key: "$lt", Value: until}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "node_id", Value: "$node_id"},
+				{Key: "start", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{{Key: "date", Value: "$timestamp"}, {Key: "unit", Value: "hour"}}}}},
+			}},
+			{Key: "requests", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "bpm", Value: bson.D{{Key: "$sum", Value: "$bpm"}}},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "period", Value: ReportHourly}, {Key: "start", Value: "$_id.start"}, {Key: "node_id", Value: "$_id.node_id"}, {Key: "requests", Value: 1}, {Key: "bpm", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	summaries := []UsageSummary{}
+	if err := cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	for i := range summaries {
+		summaries[i].Start = summaries[i].Start.UTC()
+	}
+	return summaries, nil
+}
+
+func (s *MongoStore) SaveUsageSummaries(ctx context.Context, summaries []UsageSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(summaries))
+	for i, summary := range summaries {
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "period", Value: summary.Period}, {Key: "start", Value: summary.Start}, {Key: "node_id", Value: summary.NodeID}}).
+			SetReplacement(summary).
+			SetUpsert(true)
+	}
+	_, err := s.summariesCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *MongoStore) UsageSummaries(ctx context.Context, period, nodeID string, since, until time.Time) ([]UsageSummary, error) {
+	filter := bson.D{{Key: "period", Value: period}, {Key: "start", Value: bson.D{{Key: "$gte", Value: since}, {Key: "$lt", Value: until}}}}
+	if nodeID != "" {
+		filter = append(filter, bson.E{Key: "node_id", Value: nodeID})
+	}
+	cursor, err := s.summariesCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "start", Value: 1}, {Key: "node_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	summaries := []UsageSummary{}
+	if err := cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	for i := range summaries {
+		summaries[i].Start = summaries[i].Start.UTC()
+	}
+	return summaries, nil
+}
+
+func (s *MongoStore) EnqueueJob(ctx context.Context, job Job) error {
+	now := time.Now()
+	job.Status, job.VisibleAt, job.Created, job.Updated = JobPending, now, now, now
+	_, err := s.jobsCollection.InsertOne(ctx, job)
+	return err
+}
+
+// ClaimJob first buries the leased jobs whose last attempt ran out, then
+// leases the next visible job with one findAndModify, so a job is claimed by
+// one worker at a time however many replicas compete for it
+func (s *MongoStore) ClaimJob(ctx context.Context, visibility time.Duration) (Job, bool, error) {
+	now := time.Now()
+	_, err := s.jobsCollection.UpdateMany(ctx, bson.D{
+		{Key: "status", Value: JobLeased},
+		{Key: "visible_at", Value: bson.D{{Key: "$lte", Value: now}}},
+		{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{"$attempts", "$max_attempts"}}}},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "status", Value: JobDead}, {Key: "error", Value: expiredJobError}, {Key: "updated", Value: now}, {Key: "finished", Value: now}}},
+		{Key: "$unset", Value: bson.D{{Key: "lease", Value: ""}}},
+	})
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	var job Job
+	err = s.jobsCollection.FindOneAndUpdate(ctx, bson.D{
+		{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{JobPending, JobLeased}}}},
+		{Key: "visible_at", Value: bson.D{{Key: "$lte", Value: now}}},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "status", Value: JobLeased}, {Key: "lease", Value: randomHex(8)}, {Key: "visible_at", Value: now.Add(visibility)}, {Key: "updated", Value: now}}},
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+	}, options.FindOneAndUpdate().SetSort(bson.D{{Key: "visible_at", Value: 1}}).SetReturnDocument(options.After)).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Job{}, false, nil
+	}
+	return job, err == nil, err
+}
+
+// leased matches job id while lease still holds it
+func leased(id, lease string) bson.D {
+	return bson.D{{Key: "_id", Value: id}, {Key: "status", Value: JobLeased}, {Key: "lease", Value: lease}}
+}
+
+func (s *MongoStore) CompleteJob(ctx context.Context, id, lease string, result []byte) (bool, error) {
+	now := time.Now()
+	res, err := s.jobsCollection.UpdateOne(ctx, leased(id, lease), bson.D{
+		{Key: "$set", Value: bson.D{{Key: "status", Value: JobDone}, {Key: "result", Value: result}, {Key: "updated", Value: now}, {Key: "finished", Value: now}}},
+		{Key: "$unset", Value: bson.D{{Key: "lease", Value: ""}, {Key: "error", Value: ""}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *MongoStore) FailJob(ctx context.Context, id, lease, reason string, delay time.Duration) (Job, bool, error) {
+	now := time.Now()
+	dead := bson.D{{Key: "$gte", Value: bson.A{"$attempts", "$max_attempts"}}}
+	var job Job
+	err := s.jobsCollection.FindOneAndUpdate(ctx, leased(id, lease), mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: bson.D{{Key: "$cond", Value: bson.A{dead, JobDead, JobPending}}}},
+			{Key: "finished", Value: bson.D{{Key: "$cond", Value: bson.A{dead, now, "$$REMOVE"}}}},
+			{Key: "error", Value: reason},
+			{Key: "visible_at", Value: now.Add(delay)},
+			{Key: "updated", Value: now},
+		}}},
+		{{Key: "$unset", Value: "lease"}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Job{}, false, nil
+	}
+	return job, err == nil, err
+}
+
+func (s *MongoStore) RetryJob(ctx context.Context, id, lease string, delay time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.jobsCollection.UpdateOne(ctx, leased(id, lease), bson.D{
+		{Key: "$set", Value: bson.D{{Key: "status", Value: JobPending}, {Key: "visible_at", Value: now.Add(delay)}, {Key: "updated", Value: now}}},
+		{Key: "$unset", Value: bson.D{{Key: "lease", Value: ""}}},
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: -1}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *MongoStore) Job(ctx context.Context, id string) (Job, bool, error) {
+	var job Job
+	err := s.jobsCollection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Job{}, false, nil
+	}
+	return job, err == nil, err
+}
+
+// IncrementCounter starts the counter over in the same upsert when it
+// expired, as the TTL monitor only deletes expired documents once a minute
+func (s *MongoStore) IncrementCounter(ctx context.Context, key string, expires time.Time) (int64, error) {
+	live := bson.D{{Key: "$gt", Value: bson.A{"$expires", time.Now()}}}
+	var c counter
+	err := s.countersCollection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "value", Value: bson.D{{Key: "$cond", Value: bson.A{live, bson.D{{Key: "$add", Value: bson.A{"$value", 1}}}, 1}}}},
+			{Key: "expires", Value: expires},
+		}}},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&c)
+	return c.Value, err
+}
+
+func (s *MongoStore) Counter(ctx context.Context, key string) (int64, time.Time, error) {
+	var c counter
+	err := s.countersCollection.FindOne(ctx, bson.D{{Key: "_id", Value: key}, {Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}}}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, time.Time{}, nil
+	}
+	return c.Value, c.Expires, err
+}
+
+func (s *MongoStore) DeleteCounter(ctx context.Context, key string) error {
+	_, err := s.countersCollection.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}})
+	return err
+}
+
+// ClaimIdempotencyKey takes over a key whose claim expired in the same
+// upsert, as the TTL monitor only deletes expired documents once a minute;
+// a live claim fails the upsert on its duplicate _id
+func (s *MongoStore) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string, expires time.Time) (IdempotencyRecord, bool, error) {
+	record := IdempotencyRecord{Fingerprint: fingerprint, Expires: expires}
+	_, err := s.idempotencyCollection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: key}, {Key: "expires", Value: bson.D{{Key: "$lte", Value: time.Now()}}}}, record, options.Replace().SetUpsert(true))
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return IdempotencyRecord{}, false, err
+	}
+	var existing IdempotencyRecord
+	err = s.idempotencyCollection.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Released in between, claim it again
+		return s.ClaimIdempotencyKey(ctx, key, fingerprint, expires)
+	}
+	return existing, false, err
+}
+
+func (s *MongoStore) CompleteIdempotencyKey(ctx context.Context, key string, response IdempotentResponse, expires time.Time) error {
+	_, err := s.idempotencyCollection.UpdateOne(ctx, bson.D{{Key: "_id", Value: key}}, bson.D{{Key: "$set", Value: bson.D{{Key: "response", Value: response}, {Key: "expires", Value: expires}}}})
+	return err
+}
+
+func (s *MongoStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.idempotencyCollection.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}})
+	return err
+}
+
+// certificateDocument struct represents a certificate kept under its key
+type certificateDocument struct {
+	Key  string `bson:"_id"`
+	Data []byte `bson:"data"`
+}
+
+func (s *MongoStore) Certificate(ctx context.Context, key string) ([]byte, bool, error) {
+	var doc certificateDocument
+	err := s.certsCollection.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	return doc.Data, err == nil, err
+}
+
+func (s *MongoStore) SaveCertificate(ctx context.Context, key string, data []byte) error {
+	_, err := s.certsCollection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: key}}, certificateDocument{Key: key, Data: data}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteCertificate(ctx context.Context, key string) error {
+	_, err := s.certsCollection.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}})
+	return err
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// memoryOutcomeEntries is how many outcomes MemoryStore keeps, the latest
+// whatever their age
+const memoryOutcomeEntries = 100_000
+
+// Outcome struct represents how the node a request was forwarded to
+// answered it
+type Outcome struct {
+	Time      time.Time `bson:"time" json:"time"`
+	NodeID    string    `bson:"node_id" json:"node_id"`
+	Operation string    `bson:"operation" json:"operation"`
+	// Status is the status the node answered with, zero when it could not
+	// be reached or did not answer in time
+	Status int `bson:"status" json:"status"`
+	// LatencyMS is how long the nodes took to answer, across attempts
+	LatencyMS int64 `bson:"latency_ms" json:"latency_ms"`
+	// BytesSent and BytesReceived are the request body bytes forwarded and
+	// the response body bytes relayed back
+	BytesSent     int64 `bson:"bytes_sent" json:"bytes_sent"`
+	BytesReceived int64 `bson:"bytes_received" json:"bytes_received"`
+}
+
+// OutcomeFilter struct represents which outcomes to list: those of NodeID
+// when it is set, from Since until Until, with a status from MinStatus to
+// MaxStatus when MaxStatus is set
+type OutcomeFilter struct {
+	NodeID    string
+	Since     time.Time
+	Until     time.Time
+	MinStatus int
+	MaxStatus int
+}
+
+func (f OutcomeFilter) match(outcome Outcome) bool {
+	return (f.NodeID == "" || outcome.NodeID == f.NodeID) &&
+		!outcome.Time.Before(f.Since) && outcome.Time.Before(f.Until) &&
+		(f.MaxStatus == 0 || outcome.Status >= f.MinStatus && outcome.Status <= f.MaxStatus)
+}
+
+// Outcomes is implemented by stores that can keep the outcome of every
+// forwarded request for as long as the request records, for capacity
+// analysis. Outcomes are kept apart from the request records, which are
+// written before the node answers and are counted against its limits.
+type Outcomes interface {
+	// RecordOutcome adds an outcome
+	RecordOutcome(ctx context.Context, outcome Outcome) error
+	// Outcomes returns the outcomes matching filter, newest first and at
+	// most limit
+	Outcomes(ctx context.Context, filter OutcomeFilter, limit int) ([]Outcome, error)
+}
@@ -0,0 +1,798 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresSchema creates the tables of PostgresStore if they do not exist yet
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS node_limits (
+	node_id text PRIMARY KEY,
+	limits  jsonb NOT NULL
+);
+CREATE TABLE IF NOT EXISTS requests (
+	id        bigserial PRIMARY KEY,
+	node_id   text NOT NULL,
+	operation text NOT NULL DEFAULT '',
+	timestamp timestamptz NOT NULL,
+	bpm       integer NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS requests_timestamp ON requests (timestamp);
+CREATE INDEX IF NOT EXISTS requests_node_timestamp ON requests (node_id, timestamp);
+CREATE TABLE IF NOT EXISTS routing_rules (
+	rule_id   text PRIMARY KEY,
+	attribute text NOT NULL,
+	name      text NOT NULL,
+	value     text NOT NULL,
+	"group"   text NOT NULL,
+	priority  integer NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS jobs (
+	id           text PRIMARY KEY,
+	status       text NOT NULL,
+	payload      bytea,
+	attempts     integer NOT NULL DEFAULT 0,
+	max_attempts integer NOT NULL,
+	lease        text NOT NULL DEFAULT '',
+	visible_at   timestamptz NOT NULL,
+	result       bytea,
+	error        text NOT NULL DEFAULT '',
+	created      timestamptz NOT NULL,
+	updated      timestamptz NOT NULL,
+	finished     timestamptz
+);
+CREATE INDEX IF NOT EXISTS jobs_status_visible_at ON jobs (status, visible_at);
+CREATE TABLE IF NOT EXISTS maintenance_windows (
+	window_id text PRIMARY KEY,
+	node_id   text NOT NULL,
+	schedule  text NOT NULL,
+	duration  text NOT NULL,
+	timezone  text NOT NULL DEFAULT '',
+	reason    text NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS tenants (
+	tenant_id text PRIMARY KEY,
+	tenant    jsonb NOT NULL
+);
+CREATE TABLE IF NOT EXISTS access_lists (
+	acl_id text PRIMARY KEY,
+	acl    jsonb NOT NULL
+);
+CREATE TABLE IF NOT EXISTS rejections (
+	id     bigserial PRIMARY KEY,
+	time   timestamptz NOT NULL,
+	client text NOT NULL,
+	route  text NOT NULL,
+	reason text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rejections_time ON rejections (time);
+CREATE INDEX IF NOT EXISTS rejections_client_time ON rejections (client, time);
+CREATE TABLE IF NOT EXISTS counters (
+	key     text PRIMARY KEY,
+	value   bigint NOT NULL,
+	expires timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key         text PRIMARY KEY,
+	fingerprint text NOT NULL,
+	response    jsonb,
+	expires     timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS request_outcomes (
+	id             bigserial PRIMARY KEY,
+	time           timestamptz NOT NULL,
+	node_id        text NOT NULL,
+	operation      text NOT NULL DEFAULT '',
+	status         integer NOT NULL,
+	latency_ms     bigint NOT NULL,
+	bytes_sent     bigint NOT NULL,
+	bytes_received bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS request_outcomes_time ON request_outcomes (time);
+CREATE INDEX IF NOT EXISTS request_outcomes_node_time ON request_outcomes (node_id, time);
+CREATE INDEX IF NOT EXISTS request_outcomes_status_time ON request_outcomes (status, time);
+CREATE TABLE IF NOT EXISTS usage_summaries (
+	period   text NOT NULL,
+	start    timestamptz NOT NULL,
+	node_id  text NOT NULL,
+	requests integer NOT NULL,
+	bpm      integer NOT NULL,
+	PRIMARY KEY (period, start, node_id)
+);`
+
+// PostgresStore keeps node limits as JSON documents in the node_limits
+// table, request records in the requests table, A/B routing rules in the
+// routing_rules table, queued jobs in the jobs table, maintenance windows in
+// the maintenance_windows table, tenants and IP access lists as JSON
+// documents in the tenants and access_lists tables, the reject log in the
+// rejections table, shared counters in the counters table, idempotency
+// keys in the idempotency_keys table, request outcomes in the
+// request_outcomes table and usage reports in the usage_summaries table. The tables are created on connect.
+type PostgresStore struct {
+	pool    *pgxpool.Pool
+	timeout time.Duration
+}
+
+// NewPostgresStore connects to the PostgreSQL database at url and creates
+// its tables. A positive timeout bounds every operation, on top of the
+// deadline of its context.
+func NewPostgresStore(ctx context.Context, url string, timeout time.Duration) (*PostgresStore, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	s := &PostgresStore{pool: pool, timeout: timeout}
+
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	if _, err := pool.Exec(ctx, postgresSchema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the connections to PostgreSQL
+func (s *PostgresStore) Close() {
+	s.pool.Close()
+}
+
+// bound applies the store timeout to ctx
+func (s *PostgresStore) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// Ping checks that the database can be reached
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return s.pool.Ping(ctx)
+}
+
+func (s *PostgresStore) NodeLimits(ctx context.Context) (map[string]NodeLimits, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT limits FROM node_limits`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := map[string]NodeLimits{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var node NodeLimits
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		limits[node.NodeID] = node
+	}
+	return limits, rows.Err()
+}
+
+func (s *PostgresStore) SaveNodeLimits(ctx context.Context, node NodeLimits) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err = s.pool.Exec(ctx, `INSERT INTO node_limits (node_id, limits) VALUES ($1, $2)
+		ON CONFLICT (node_id) DO UPDATE SET limits = EXCLUDED.limits`, node.NodeID, data)
+	return err
+}
+
+func (s *PostgresStore) DeleteNodeLimits(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM node_limits WHERE node_id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) Usage(ctx context.Context, since time.Time) (map[string]Usage, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return usageRows(s.pool.Query(ctx, `SELECT node_id, count(*), coalesce(sum(bpm), 0), min(timestamp)
+		FROM requests WHERE timestamp > $1 GROUP BY node_id`, since))
+}
+
+func (s *PostgresStore) OperationUsage(ctx context.Context, operation string, since time.Time) (map[string]Usage, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return usageRows(s.pool.Query(ctx, `SELECT node_id, count(*), coalesce(sum(bpm), 0), min(timestamp)
+		FROM requests WHERE timestamp > $1 AND operation = $2 GROUP BY node_id`, since, operation))
+}
+
+// usageRows reads node_id, request count, BPM sum and oldest timestamp rows
+func usageRows(rows pgx.Rows, err error) (map[string]Usage, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[string]Usage{}
+	for rows.Next() {
+		var nodeID string
+		var u Usage
+		if err := rows.Scan(&nodeID, &u.Requests, &u.BPM, &u.Oldest); err != nil {
+			return nil, err
+		}
+		usage[nodeID] = u
+	}
+	return usage, rows.Err()
+}
+
+func (s *PostgresStore) RecordRequest(ctx context.Context, record Record) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `INSERT INTO requests (node_id, operation, timestamp, bpm) VALUES ($1, $2, $3, $4)`,
+		record.NodeID, record.Operation, record.Timestamp, record.BPM)
+	return err
+}
+
+// RecordRequests stores many records with one COPY
+func (s *PostgresStore) RecordRequests(ctx context.Context, records []Record) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows := make([][]any, len(records))
+	for i, record := range records {
+		rows[i] = []any{record.NodeID, record.Operation, record.Timestamp, record.BPM}
+	}
+	_, err := s.pool.CopyFrom(ctx, pgx.Identifier{"requests"}, []string{"node_id", "operation", "timestamp", "bpm"}, pgx.CopyFromRows(rows))
+	return err
+}
+
+// PurgeRequests deletes the request records and outcomes, and the jobs
+// finished, before the given time, and the expired counters and idempotency keys; PostgreSQL
+// has no TTL index to do it
+func (s *PostgresStore) PurgeRequests(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM requests WHERE timestamp < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.pool.Exec(ctx, `DELETE FROM request_outcomes WHERE time < $1`, before); err != nil {
+		return tag.RowsAffected(), err
+	}
+	if _, err := s.pool.Exec(ctx, `DELETE FROM jobs WHERE finished < $1`, before); err != nil {
+		return tag.RowsAffected(), err
+	}
+	if _, err := s.pool.Exec(ctx, `DELETE FROM counters WHERE expires <= now()`); err != nil {
+		return tag.RowsAffected(), err
+	}
+	if _, err := s.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires <= now()`); err != nil {
+		return tag.RowsAffected(), err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Reserve counts and stores the request within one transaction holding a
+// transaction-scoped advisory lock on the node, so replicas reserving the
+// same node take turns and none of them overshoots its limits
+func (s *PostgresStore) Reserve(ctx context.Context, record Record, limits []Limit) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, record.NodeID); err != nil {
+		return false, err
+	}
+	for _, limit := range limits {
+		var requests, bpm int
+		err := tx.QueryRow(ctx, `SELECT count(*), coalesce(sum(bpm), 0) FROM requests
+			WHERE node_id = $1 AND timestamp > $2 AND ($3 = '' OR operation = $3)`,
+			record.NodeID, record.Timestamp.Add(-limit.Period), limit.Operation).Scan(&requests, &bpm)
+		if err != nil {
+			return false, err
+		}
+		if limit.Bytes && bpm+record.BPM > limit.Limit || !limit.Bytes && requests+1 > limit.Limit {
+			return false, nil
+		}
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO requests (node_id, operation, timestamp, bpm) VALUES ($1, $2, $3, $4)`,
+		record.NodeID, record.Operation, record.Timestamp, record.BPM); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (s *PostgresStore) RoutingRules(ctx context.Context) ([]RoutingRule, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT rule_id, attribute, name, value, "group", priority FROM routing_rules`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []RoutingRule{}
+	for rows.Next() {
+		var rule RoutingRule
+		if err := rows.Scan(&rule.ID, &rule.Attribute, &rule.Name, &rule.Value, &rule.Group, &rule.Priority); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *PostgresStore) SaveRoutingRule(ctx context.Context, rule RoutingRule) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `INSERT INTO routing_rules (rule_id, attribute, name, value, "group", priority)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (rule_id) DO UPDATE SET attribute = EXCLUDED.attribute, name = EXCLUDED.name,
+			value = EXCLUDED.value, "group" = EXCLUDED."group", priority = EXCLUDED.priority`,
+		rule.ID, rule.Attribute, rule.Name, rule.Value, rule.Group, rule.Priority)
+	return err
+}
+
+func (s *PostgresStore) DeleteRoutingRule(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM routing_rules WHERE rule_id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) MaintenanceWindows(ctx context.Context) ([]MaintenanceWindow, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT window_id, node_id, schedule, duration, timezone, reason FROM maintenance_windows`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := []MaintenanceWindow{}
+	for rows.Next() {
+		var window MaintenanceWindow
+		if err := rows.Scan(&window.ID, &window.NodeID, &window.Schedule, &window.Duration, &window.Timezone, &window.Reason); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, rows.Err()
+}
+
+func (s *PostgresStore) SaveMaintenanceWindow(ctx context.Context, window MaintenanceWindow) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `INSERT INTO maintenance_windows (window_id, node_id, schedule, duration, timezone, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (window_id) DO UPDATE SET node_id = EXCLUDED.node_id, schedule = EXCLUDED.schedule,
+			duration = EXCLUDED.duration, timezone = EXCLUDED.timezone, reason = EXCLUDED.reason`,
+		window.ID, window.NodeID, window.Schedule, window.Duration, window.Timezone, window.Reason)
+	return err
+}
+
+func (s *PostgresStore) DeleteMaintenanceWindow(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM maintenance_windows WHERE window_id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) Tenants(ctx context.Context) ([]Tenant, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT tenant FROM tenants`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var tenant Tenant
+		if err := json.Unmarshal(data, &tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *PostgresStore) SaveTenant(ctx context.Context, tenant Tenant) error {
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err = s.pool.Exec(ctx, `INSERT INTO tenants (tenant_id, tenant) VALUES ($1, $2)
+		ON CONFLICT (tenant_id) DO UPDATE SET tenant = EXCLUDED.tenant`, tenant.ID, data)
+	return err
+}
+
+func (s *PostgresStore) DeleteTenant(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM tenants WHERE tenant_id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) AccessLists(ctx context.Context) ([]AccessList, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT acl FROM access_lists`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []AccessList{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var list AccessList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, rows.Err()
+}
+
+func (s *PostgresStore) SaveAccessList(ctx context.Context, list AccessList) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err = s.pool.Exec(ctx, `INSERT INTO access_lists (acl_id, acl) VALUES ($1, $2)
+		ON CONFLICT (acl_id) DO UPDATE SET acl = EXCLUDED.acl`, list.ID, data)
+	return err
+}
+
+func (s *PostgresStore) DeleteAccessList(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `DELETE FROM access_lists WHERE acl_id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// rejectLogTrim is how many rejections are recorded between two trims of
+// the rejections table to RejectLogEntries
+const rejectLogTrim = 1000
+
+func (s *PostgresStore) RecordRejection(ctx context.Context, rejection Rejection) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	var id int64
+	err := s.pool.QueryRow(ctx, `INSERT INTO rejections (time, client, route, reason) VALUES ($1, $2, $3, $4) RETURNING id`,
+		rejection.Time, rejection.Client, rejection.Route, rejection.Reason).Scan(&id)
+	if err != nil || id%rejectLogTrim != 0 || id <= RejectLogEntries {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `DELETE FROM rejections WHERE id <= $1`, id-RejectLogEntries)
+	return err
+}
+
+func (s *PostgresStore) Rejections(ctx context.Context, client string, since time.Time, limit int) ([]Rejection, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT time, client, route, reason FROM rejections
+		WHERE time >= $1 AND ($2 = '' OR client = $2) ORDER BY time DESC LIMIT $3`, since, client, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rejections := []Rejection{}
+	for rows.Next() {
+		var rejection Rejection
+		if err := rows.Scan(&rejection.Time, &rejection.Client, &rejection.Route, &rejection.Reason); err != nil {
+			return nil, err
+		}
+		rejections = append(rejections, rejection)
+	}
+	return rejections, rows.Err()
+}
+
+func (s *PostgresStore) RejectionCounts(ctx context.Context, client string, since, until time.Time) ([]RejectionCount, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT client, route, reason, count(*) FROM rejections
+		WHERE time >= $1 AND time < $2 AND ($3 = '' OR client = $3) GROUP BY client, route, reason`, since, until, client)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []RejectionCount{}
+	for rows.Next() {
+		var count RejectionCount
+		if err := rows.Scan(&count.Client, &count.Route, &count.Reason, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (s *PostgresStore) RecordOutcome(ctx context.Context, outcome Outcome) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `INSERT INTO request_outcomes (time, node_id, operation, status, latency_ms, bytes_sent, bytes_received)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		outcome.Time, outcome.NodeID, outcome.Operation, outcome.Status, outcome.LatencyMS, outcome.BytesSent, outcome.BytesReceived)
+	return err
+}
+
+func (s *PostgresStore) Outcomes(ctx context.Context, filter OutcomeFilter, limit int) ([]Outcome, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT time, node_id, operation, status, latency_ms, bytes_sent, bytes_received FROM request_outcomes
+		WHERE time >= $1 AND time < $2 AND ($3 = '' OR node_id = $3) AND ($5 = 0 OR status BETWEEN $4 AND $5)
+		ORDER BY time DESC LIMIT $6`, filter.Since, filter.Until, filter.NodeID, filter.MinStatus, filter.MaxStatus, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outcomes := []Outcome{}
+	for rows.Next() {
+		var outcome Outcome
+		if err := rows.Scan(&outcome.Time, &outcome.NodeID, &outcome.Operation, &outcome.Status, &outcome.LatencyMS, &outcome.BytesSent, &outcome.BytesReceived); err != nil {
+			return nil, err
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes, rows.Err()
+}
+
+func (s *PostgresStore) HourlyUsage(ctx context.Context, since, until time.Time) ([]UsageSummary, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return summaryRows(s.pool.Query(ctx, `SELECT 'hour', date_trunc('hour', timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS start,
+		node_id, count(*), coalesce(sum(bpm), 0) FROM requests WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY start, node_id`, since, until))
+}
+
+// SaveUsageSummaries upserts the summaries with one batch
+func (s *PostgresStore) SaveUsageSummaries(ctx context.Context, summaries []UsageSummary) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	batch := &pgx.Batch{}
+	for _, summary := range summaries {
+		batch.Queue(`INSERT INTO usage_summaries (period, start, node_id, requests, bpm) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (period, start, node_id) DO UPDATE SET requests = excluded.requests, bpm = excluded.bpm`,
+			summary.Period, summary.Start, summary.NodeID, summary.Requests, summary.BPM)
+	}
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+func (s *PostgresStore) UsageSummaries(ctx context.Context, period, nodeID string, since, until time.Time) ([]UsageSummary, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return summaryRows(s.pool.Query(ctx, `SELECT period, start, node_id, requests, bpm FROM usage_summaries
+		WHERE period = $1 AND start >= $2 AND start < $3 AND ($4 = '' OR node_id = $4) ORDER BY start, node_id`,
+		period, since, until, nodeID))
+}
+
+// summaryRows reads period, start, node_id, request count and BPM sum rows
+func summaryRows(rows pgx.Rows, err error) ([]UsageSummary, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []UsageSummary{}
+	for rows.Next() {
+		var summary UsageSummary
+		if err := rows.Scan(&summary.Period, &summary.Start, &summary.NodeID, &summary.Requests, &summary.BPM); err != nil {
+			return nil, err
+		}
+		summary.Start = summary.Start.UTC()
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// jobColumns are the columns scanned by scanJob
+const jobColumns = `id, status, payload, attempts, max_attempts, lease, visible_at, result, error, created, updated, finished`
+
+func scanJob(row pgx.Row) (Job, bool, error) {
+	var job Job
+	var finished *time.Time
+	err := row.Scan(&job.ID, &job.Status, &job.Payload, &job.Attempts, &job.MaxAttempts, &job.Lease,
+		&job.VisibleAt, &job.Result, &job.Error, &job.Created, &job.Updated, &finished)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	if finished != nil {
+		job.Finished = *finished
+	}
+	return job, true, nil
+}
+
+func (s *PostgresStore) EnqueueJob(ctx context.Context, job Job) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	now := time.Now()
+	_, err := s.pool.Exec(ctx, `INSERT INTO jobs (id, status, payload, max_attempts, visible_at, created, updated)
+		VALUES ($1, $2, $3, $4, $5, $5, $5)`, job.ID, JobPending, job.Payload, job.MaxAttempts, now)
+	return err
+}
+
+// ClaimJob first buries the leased jobs whose last attempt ran out, then
+// leases the next visible job, skipping the rows other replicas are
+// claiming, so a job is claimed by one worker at a time
+func (s *PostgresStore) ClaimJob(ctx context.Context, visibility time.Duration) (Job, bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	now := time.Now()
+	if _, err := s.pool.Exec(ctx, `UPDATE jobs SET status = $1, lease = '', error = $2, updated = $3, finished = $3
+		WHERE status = $4 AND visible_at <= $3 AND attempts >= max_attempts`, JobDead, expiredJobError, now, JobLeased); err != nil {
+		return Job{}, false, err
+	}
+	return scanJob(s.pool.QueryRow(ctx, `UPDATE jobs SET status = $1, lease = $2, visible_at = $3, attempts = attempts + 1, updated = $4
+		WHERE id = (SELECT id FROM jobs WHERE status IN ($5, $1) AND visible_at <= $4
+			ORDER BY visible_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING `+jobColumns, JobLeased, randomHex(8), now.Add(visibility), now, JobPending))
+}
+
+func (s *PostgresStore) CompleteJob(ctx context.Context, id, lease string, result []byte) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `UPDATE jobs SET status = $1, result = $2, lease = '', error = '', updated = $3, finished = $3
+		WHERE id = $4 AND status = $5 AND lease = $6`, JobDone, result, time.Now(), id, JobLeased, lease)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) FailJob(ctx context.Context, id, lease, reason string, delay time.Duration) (Job, bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	now := time.Now()
+	return scanJob(s.pool.QueryRow(ctx, `UPDATE jobs SET
+			status = CASE WHEN attempts >= max_attempts THEN $1 ELSE $2 END,
+			finished = CASE WHEN attempts >= max_attempts THEN $3 END,
+			lease = '', error = $4, visible_at = $5, updated = $3
+		WHERE id = $6 AND status = $7 AND lease = $8
+		RETURNING `+jobColumns, JobDead, JobPending, now, reason, now.Add(delay), id, JobLeased, lease))
+}
+
+func (s *PostgresStore) RetryJob(ctx context.Context, id, lease string, delay time.Duration) (bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	now := time.Now()
+	tag, err := s.pool.Exec(ctx, `UPDATE jobs SET status = $1, lease = '', visible_at = $2, attempts = attempts - 1, updated = $3
+		WHERE id = $4 AND status = $5 AND lease = $6`, JobPending, now.Add(delay), now, id, JobLeased, lease)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) Job(ctx context.Context, id string) (Job, bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return scanJob(s.pool.QueryRow(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) IncrementCounter(ctx context.Context, key string, expires time.Time) (int64, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	var value int64
+	err := s.pool.QueryRow(ctx, `INSERT INTO counters (key, value, expires) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			value = CASE WHEN counters.expires > $3 THEN counters.value + 1 ELSE 1 END,
+			expires = excluded.expires
+		RETURNING value`, key, expires, time.Now()).Scan(&value)
+	return value, err
+}
+
+func (s *PostgresStore) Counter(ctx context.Context, key string) (int64, time.Time, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	var c counter
+	err := s.pool.QueryRow(ctx, `SELECT value, expires FROM counters WHERE key = $1 AND expires > $2`, key, time.Now()).Scan(&c.Value, &c.Expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	return c.Value, c.Expires, err
+}
+
+func (s *PostgresStore) DeleteCounter(ctx context.Context, key string) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `DELETE FROM counters WHERE key = $1`, key)
+	return err
+}
+
+// ClaimIdempotencyKey takes over a key whose claim expired in the same
+// upsert; a live claim leaves the row as it is
+func (s *PostgresStore) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string, expires time.Time) (IdempotencyRecord, bool, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, `INSERT INTO idempotency_keys (key, fingerprint, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = excluded.fingerprint, response = NULL, expires = excluded.expires
+		WHERE idempotency_keys.expires <= $4`, key, fingerprint, expires, time.Now())
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if tag.RowsAffected() == 1 {
+		return IdempotencyRecord{Fingerprint: fingerprint, Expires: expires}, true, nil
+	}
+
+	var record IdempotencyRecord
+	var response []byte
+	err = s.pool.QueryRow(ctx, `SELECT fingerprint, response, expires FROM idempotency_keys WHERE key = $1`, key).Scan(&record.Fingerprint, &response, &record.Expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released in between, claim it again
+		return s.ClaimIdempotencyKey(ctx, key, fingerprint, expires)
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if response != nil {
+		record.Response = &IdempotentResponse{}
+		if err := json.Unmarshal(response, record.Response); err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+	}
+	return record, false, nil
+}
+
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, key string, response IdempotentResponse, expires time.Time) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `UPDATE idempotency_keys SET response = $2, expires = $3 WHERE key = $1`, key, data, expires)
+	return err
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE key = $1`, key)
+	return err
+}
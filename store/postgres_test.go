@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestPostgresStore runs the store against the database at
+// LB_TEST_POSTGRES_URL, e.g. postgres://lb:lb@localhost:5432/lb_test
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("LB_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("LB_TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	s, err := NewPostgresStore(ctx, url, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The database may hold the rows of earlier runs, so the nodes are new
+	run := strconv.FormatInt(time.Now().UnixNano(), 10)
+	node1, node2 := "lb-test-"+run+"-1", "lb-test-"+run+"-2"
+	for _, node := range []NodeLimits{{NodeID: node1, RPMLimit: 10}, {NodeID: node1, RPMLimit: 15, Limits: "15 req/min"}} {
+		if err := s.SaveNodeLimits(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes, err := s.NodeLimits(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nodes[node1]; got.RPMLimit != 15 || got.Limits != "15 req/min" {
+		t.Errorf("got %+v, expected the node replaced at 15", got)
+	}
+	if existed, err := s.DeleteNodeLimits(ctx, node1); err != nil || !existed {
+		t.Errorf("DeleteNodeLimits = %v, %v, expected the node deleted", existed, err)
+	}
+	if existed, err := s.DeleteNodeLimits(ctx, node1); err != nil || existed {
+		t.Errorf("DeleteNodeLimits = %v, %v, expected the node already gone", existed, err)
+	}
+
+	now := time.Now()
+	if err := s.RecordRequests(ctx, []Record{
+		{NodeID: node1, Operation: "POST /request", Timestamp: now.Add(-90 * time.Second), BPM: 100},
+		{NodeID: node1, Operation: "POST /request", Timestamp: now.Add(-30 * time.Second), BPM: 10},
+		{NodeID: node1, Operation: "GET /api", Timestamp: now.Add(-20 * time.Second), BPM: 20},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordRequest(ctx, Record{NodeID: node2, Operation: "POST /request", Timestamp: now.Add(-10 * time.Second), BPM: 5}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.Usage(ctx, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usage[node1]; got.Requests != 2 || got.BPM != 30 {
+		t.Errorf("got %+v for the first node, expected 2 requests of 30 bpm", got)
+	}
+	if usage, err = s.OperationUsage(ctx, "POST /request", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage[node1]; got.Requests != 1 || got.BPM != 10 {
+		t.Errorf("got %+v for the operation, expected 1 request of 10 bpm", got)
+	}
+
+	// node2 took its one request of the minute
+	limits := []Limit{{Period: time.Minute, Limit: 1}}
+	if ok, err := s.Reserve(ctx, Record{NodeID: node2, Timestamp: now}, limits); err != nil || ok {
+		t.Errorf("Reserve = %v, %v, expected the node full", ok, err)
+	}
+	if ok, err := s.Reserve(ctx, Record{NodeID: node1, Timestamp: now}, []Limit{{Period: time.Minute, Limit: 3}}); err != nil || !ok {
+		t.Errorf("Reserve = %v, %v, expected the request reserved", ok, err)
+	}
+
+	if _, err := s.PurgeRequests(ctx, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err = s.Usage(ctx, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage[node1]; got.Requests != 3 {
+		t.Errorf("got %+v after purging, expected the 3 requests of the last minute", got)
+	}
+}
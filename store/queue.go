@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Job statuses
+const (
+	// JobPending jobs wait for a worker, possibly after a failed attempt
+	JobPending = "pending"
+	// JobLeased jobs are being worked on until their visibility timeout
+	JobLeased = "leased"
+	// JobDone jobs were processed; their result is kept
+	JobDone = "done"
+	// JobDead jobs failed MaxAttempts times and are no longer retried
+	JobDead = "dead"
+)
+
+// Job struct represents a unit of work in a Queue. Payload and Result are
+// opaque to the store.
+type Job struct {
+	ID          string `bson:"_id" json:"id"`
+	Status      string `bson:"status" json:"status"`
+	Payload     []byte `bson:"payload" json:"-"`
+	Attempts    int    `bson:"attempts" json:"attempts"`
+	MaxAttempts int    `bson:"max_attempts" json:"max_attempts"`
+	// Lease identifies the current claim of a leased job; only its holder
+	// can complete, fail or retry the job
+	Lease string `bson:"lease,omitempty" json:"-"`
+	// VisibleAt is when a pending job may be claimed, or when the lease of a
+	// leased job runs out and the job may be claimed again
+	VisibleAt time.Time `bson:"visible_at" json:"-"`
+	Result    []byte    `bson:"result,omitempty" json:"-"`
+	// Error is why the last attempt failed
+	Error   string    `bson:"error,omitempty" json:"error,omitempty"`
+	Created time.Time `bson:"created" json:"created"`
+	Updated time.Time `bson:"updated" json:"updated"`
+	// Finished is when the job became done or dead; finished jobs are
+	// discarded with the request records once older than the retention
+	Finished time.Time `bson:"finished,omitempty" json:"finished,omitempty"`
+}
+
+// Queue is implemented by stores that can hold a work queue shared by every
+// balancer replica. A claimed job is invisible to other workers until its
+// visibility timeout passes, so no two workers hold the same job at once;
+// a worker that does not finish in time loses its lease, and the job goes
+// to the next worker, unless it used up MaxAttempts, which makes it dead.
+type Queue interface {
+	// EnqueueJob adds a pending job, visible right away
+	EnqueueJob(ctx context.Context, job Job) error
+	// ClaimJob leases the job that has been visible the longest for
+	// visibility, counting an attempt; it reports false when none is visible
+	ClaimJob(ctx context.Context, visibility time.Duration) (Job, bool, error)
+	// CompleteJob marks a leased job done with its result, reporting false
+	// when lease is no longer the job's
+	CompleteJob(ctx context.Context, id, lease string, result []byte) (bool, error)
+	// FailJob records a failed attempt; the job is visible again after delay,
+	// or dead when it used up its attempts. It returns the updated job and
+	// false when lease is no longer the job's.
+	FailJob(ctx context.Context, id, lease, reason string, delay time.Duration) (Job, bool, error)
+	// RetryJob makes a leased job visible again after delay without counting
+	// the attempt, for work that could not be started, reporting false when
+	// lease is no longer the job's
+	RetryJob(ctx context.Context, id, lease string, delay time.Duration) (bool, error)
+	// Job returns a job by ID
+	Job(ctx context.Context, id string) (Job, bool, error)
+}
+
+// NewJobID returns a random job ID, hard to guess so that it can double as
+// the handle clients poll a job with
+func NewJobID() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// expiredJobError is the error of jobs whose last lease ran out
+const expiredJobError = "visibility timeout expired"
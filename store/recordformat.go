@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Formats MongoStore keeps request records in
+const (
+	// RecordDocuments keeps every record in its own document of the requests
+	// collection, which usage queries aggregate in MongoDB
+	RecordDocuments = "documents"
+	// RecordBlobs keeps each batch of records as one gzipped blob in the
+	// request_batches collection
+	RecordBlobs = "blobs"
+	// RecordColumnar keeps each batch of records in the request_batches
+	// collection as dictionary and varint encoded columns
+	RecordColumnar = "columnar"
+)
+
+// ValidateRecordFormat checks a request record format
+func ValidateRecordFormat(format string) error {
+	switch format {
+	case RecordDocuments, RecordBlobs, RecordColumnar:
+		return nil
+	}
+	return fmt.Errorf("unknown record format %q, expected documents, blobs or columnar", format)
+}
+
+// batchesTTLIndex names the index expiring record batches
+const batchesTTLIndex = "end_ttl"
+
+// recordBatch struct represents request records stored together in one
+// document. Start, End and Nodes are plain fields, so queries can skip the
+// batches without records of a window or node; the records themselves are
+// only read by decoding the batch.
+type recordBatch struct {
+	Format string    `bson:"format"`
+	Start  time.Time `bson:"start"`
+	End    time.Time `bson:"end"`
+	Count  int       `bson:"count"`
+	Nodes  []string  `bson:"nodes"`
+	// Blob holds the gzipped records of blobs batches
+	Blob []byte `bson:"blob,omitempty"`
+	// Operations is the dictionary of columnar batches, which Nodes is too;
+	// the columns hold a uvarint per record: the node and operation as
+	// indexes into their dictionary, the microseconds since the previous
+	// record, oldest first, and the BPM
+	Operations      []string `bson:"operations,omitempty"`
+	NodeColumn      []byte   `bson:"node_column,omitempty"`
+	OperationColumn []byte   `bson:"operation_column,omitempty"`
+	TimeColumn      []byte   `bson:"time_column,omitempty"`
+	BPMColumn       []byte   `bson:"bpm_column,omitempty"`
+}
+
+// blobRecord struct represents a record within a blob, with the time in
+// microseconds since the epoch
+type blobRecord struct {
+	Micros    int64  `json:"t"`
+	NodeID    string `json:"n"`
+	Operation string `json:"o"`
+	BPM       int    `json:"b"`
+}
+
+// encodeBatch stores records, which must not be empty, in one batch of format
+func encodeBatch(format string, records []Record) (recordBatch, error) {
+	records = slices.Clone(records)
+	slices.SortFunc(records, func(a, b Record) int { return a.Timestamp.Compare(b.Timestamp) })
+	batch := recordBatch{Format: format, Start: records[0].Timestamp, End: records[len(records)-1].Timestamp, Count: len(records)}
+	nodes := map[string]int{}
+	operations := map[string]int{}
+	index := func(dictionary map[string]int, list *[]string, value string) int {
+		i, ok := dictionary[value]
+		if !ok {
+			i = len(*list)
+			dictionary[value] = i
+			*list = append(*list, value)
+		}
+		return i
+	}
+
+	if format == RecordBlobs {
+		rows := make([]blobRecord, len(records))
+		for i, record := range records {
+			index(nodes, &batch.Nodes, record.NodeID)
+			rows[i] = blobRecord{Micros: record.Timestamp.UnixMicro(), NodeID: record.NodeID, Operation: record.Operation, BPM: record.BPM}
+		}
+		data, err := json.Marshal(rows)
+		if err != nil {
+			return recordBatch{}, err
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return recordBatch{}, err
+		}
+		batch.Blob = buf.Bytes()
+		return batch, nil
+	}
+
+	previous := batch.Start
+	for _, record := range records {
+		batch.NodeColumn = binary.AppendUvarint(batch.NodeColumn, uint64(index(nodes, &batch.Nodes, record.NodeID)))
+		batch.OperationColumn = binary.AppendUvarint(batch.OperationColumn, uint64(index(operations, &batch.Operations, record.Operation)))
+		batch.TimeColumn = binary.AppendUvarint(batch.TimeColumn, uint64(record.Timestamp.Sub(previous).Microseconds()))
+		batch.BPMColumn = binary.AppendUvarint(batch.BPMColumn, uint64(max(record.BPM, 0)))
+		previous = record.Timestamp
+	}
+	return batch, nil
+}
+
+// errCorruptBatch means a record batch does not decode
+var errCorruptBatch = errors.New("corrupt request record batch")
+
+// records decodes the records of the batch
+func (b recordBatch) records() ([]Record, error) {
+	records := make([]Record, 0, b.Count)
+	if b.Format == RecordBlobs {
+		zr, err := gzip.NewReader(bytes.NewReader(b.Blob))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptBatch, err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptBatch, err)
+		}
+		var rows []blobRecord
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptBatch, err)
+		}
+		for _, row := range rows {
+			records = append(records, Record{NodeID: row.NodeID, Operation: row.Operation, Timestamp: time.UnixMicro(row.Micros), BPM: row.BPM})
+		}
+		return records, nil
+	}
+
+	columns := [][]byte{b.NodeColumn, b.OperationColumn, b.TimeColumn, b.BPMColumn}
+	next := func(column int) (uint64, bool) {
+		value, n := binary.Uvarint(columns[column])
+		if n <= 0 {
+			return 0, false
+		}
+		columns[column] = columns[column][n:]
+		return value, true
+	}
+	at := b.Start
+	for range b.Count {
+		node, ok1 := next(0)
+		operation, ok2 := next(1)
+		elapsed, ok3 := next(2)
+		bpm, ok4 := next(3)
+		if !ok1 || !ok2 || !ok3 || !ok4 || node >= uint64(len(b.Nodes)) || operation >= uint64(len(b.Operations)) {
+			return nil, errCorruptBatch
+		}
+		at = at.Add(time.Duration(elapsed) * time.Microsecond)
+		records = append(records, Record{NodeID: b.Nodes[node], Operation: b.Operations[operation], Timestamp: at, BPM: int(bpm)})
+	}
+	return records, nil
+}
+
+// SetRecordFormat changes the format request records are written in from
+// now on. Usage queries only read the records of the current format, so
+// limits start over after a change.
+func (s *MongoStore) SetRecordFormat(format string) error {
+	if err := ValidateRecordFormat(format); err != nil {
+		return err
+	}
+	s.recordFormat = format
+	return nil
+}
+
+// batched reports whether records are kept in the request_batches collection
+func (s *MongoStore) batched() bool {
+	return s.recordFormat == RecordBlobs || s.recordFormat == RecordColumnar
+}
+
+// insertBatch stores records as one batch, returning its ID
+func (s *MongoStore) insertBatch(ctx context.Context, records []Record) (any, error) {
+	batch, err := encodeBatch(s.recordFormat, records)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.batchesCollection.InsertOne(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	return result.InsertedID, nil
+}
+
+// batchUsage returns the traffic per node recorded after since in record
+// batches, for one node and one operation when they are set. The batches
+// are decoded here, as MongoDB cannot see into them.
+func (s *MongoStore) batchUsage(ctx context.Context, since time.Time, nodeID, operation string) (map[string]Usage, error) {
+	filter := bson.D{{Key: "end", Value: bson.D{{Key: "$gt", Value: since}}}}
+	if nodeID != "" {
+		filter = append(filter, bson.E{Key: "nodes", Value: nodeID})
+	}
+	cursor, err := s.batchesCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	usage := map[string]Usage{}
+	for cursor.Next(ctx) {
+		var batch recordBatch
+		if err := cursor.Decode(&batch); err != nil {
+			return nil, err
+		}
+		records, err := batch.records()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if !record.Timestamp.After(since) || nodeID != "" && record.NodeID != nodeID || operation != "" && record.Operation != operation {
+				continue
+			}
+			u := usage[record.NodeID]
+			u.Requests++
+			u.BPM += record.BPM
+			if u.Oldest.IsZero() || record.Timestamp.Before(u.Oldest) {
+				u.Oldest = record.Timestamp
+			}
+			usage[record.NodeID] = u
+		}
+	}
+	return usage, cursor.Err()
+}
+
+// batchHourlyUsage sums the records from since until until in record
+// batches by node and hour, decoding the batches like batchUsage
+func (s *MongoStore) batchHourlyUsage(ctx context.Context, since, until time.Time) ([]UsageSummary, error) {
+	cursor, err := s.batchesCollection.Find(ctx, bson.D{{Key: "end", Value: bson.D{{Key: "$gte", Value: since}}}, {Key: "start", Value: bson.D{{Key: "$lt", Value: until}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var summaries []UsageSummary
+	for cursor.Next(ctx) {
+		var batch recordBatch
+		if err := cursor.Decode(&batch); err != nil {
+			return nil, err
+		}
+		records, err := batch.records()
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, hourlyRecords(records, since, until)...)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	// Records of a node and hour may be spread over several batches
+	return sumUsage(summaries, ReportHourly, func(start time.Time) time.Time { return start }), nil
+}
+
+// migrateBatches creates the index of the batch windows and the TTL index
+// expiring batches once their newest record is older than retention
+func (s *MongoStore) migrateBatches(ctx context.Context, retention time.Duration) error {
+	if _, err := s.batchesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "nodes", Value: 1}, {Key: "end", Value: 1}}}); err != nil {
+		return err
+	}
+	return migrateTTLIndex(ctx, s.batchesCollection, batchesTTLIndex, "end", retention)
+}
+
+// deleteBatch removes the batch with id
+func (s *MongoStore) deleteBatch(ctx context.Context, id any) error {
+	_, err := s.batchesCollection.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	return err
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecordBatches(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	// Out of order, as concurrent requests are buffered
+	records := []Record{
+		{NodeID: "node-2", Operation: "GET /api", Timestamp: now.Add(-time.Second), BPM: 20},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now.Add(-time.Minute), BPM: 100},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: now, BPM: 0},
+	}
+	expected := []Record{records[1], records[0], records[2]}
+
+	for _, format := range []string{RecordBlobs, RecordColumnar} {
+		t.Run(format, func(t *testing.T) {
+			batch, err := encodeBatch(format, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !batch.Start.Equal(expected[0].Timestamp) || !batch.End.Equal(now) || batch.Count != 3 {
+				t.Errorf("got a batch from %s to %s of %d records, expected the span of the 3 records", batch.Start, batch.End, batch.Count)
+			}
+			if !slices.Equal(batch.Nodes, []string{"node-1", "node-2"}) {
+				t.Errorf("got nodes %v, expected node-1 and node-2", batch.Nodes)
+			}
+			decoded, err := batch.records()
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal := slices.EqualFunc(decoded, expected, func(a, b Record) bool {
+				return a.NodeID == b.NodeID && a.Operation == b.Operation && a.Timestamp.Equal(b.Timestamp) && a.BPM == b.BPM
+			})
+			if !equal {
+				t.Errorf("got %+v, expected %+v", decoded, expected)
+			}
+		})
+	}
+}
+
+func TestCorruptRecordBatches(t *testing.T) {
+	columnar, err := encodeBatch(RecordColumnar, []Record{{NodeID: "node-1", Timestamp: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columnar.Count = 2
+	for _, batch := range []recordBatch{
+		columnar,
+		{Format: RecordBlobs, Count: 1, Blob: []byte("not gzip")},
+	} {
+		if _, err := batch.records(); !errors.Is(err, errCorruptBatch) {
+			t.Errorf("got %v decoding a %s batch, expected it corrupt", err, batch.Format)
+		}
+	}
+}
+
+func TestValidateRecordFormat(t *testing.T) {
+	for _, format := range []string{RecordDocuments, RecordBlobs, RecordColumnar} {
+		if err := ValidateRecordFormat(format); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+	if err := ValidateRecordFormat("parquet"); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+}
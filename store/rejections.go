@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// RejectLogEntries is how many rejections the reject log of MongoStore and
+// PostgresStore keeps; the oldest make way for new ones beyond it.
+// MemoryStore keeps memoryRejectLogEntries.
+const RejectLogEntries = 1_000_000
+
+// memoryRejectLogEntries is how many rejections MemoryStore keeps
+const memoryRejectLogEntries = 100_000
+
+// Rejection struct represents a request the balancer refused
+type Rejection struct {
+	Time   time.Time `bson:"time" json:"time"`
+	Client string    `bson:"client" json:"client"`
+	Route  string    `bson:"route" json:"route"`
+	Reason string    `bson:"reason" json:"reason"`
+}
+
+// RejectionCount struct represents how many requests of a client were
+// refused on a route for a reason
+type RejectionCount struct {
+	Client string `bson:"client" json:"client"`
+	Route  string `bson:"route" json:"route"`
+	Reason string `bson:"reason" json:"reason"`
+	Count  int    `bson:"count" json:"count"`
+}
+
+// RejectLog is implemented by stores that can keep a capped log of the
+// refused requests, shared by every balancer replica
+type RejectLog interface {
+	// RecordRejection adds a rejection to the log
+	RecordRejection(ctx context.Context, rejection Rejection) error
+	// Rejections returns the latest rejections from since on, newest first
+	// and at most limit, of client when it is set
+	Rejections(ctx context.Context, client string, since time.Time, limit int) ([]Rejection, error)
+	// RejectionCounts counts the rejections from since until until by
+	// client, route and reason, of client when it is set
+	RejectionCounts(ctx context.Context, client string, since, until time.Time) ([]RejectionCount, error)
+}
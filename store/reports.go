@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Report periods of usage summaries
+const (
+	ReportHourly = "hour"
+	ReportDaily  = "day"
+)
+
+// UsageSummary struct represents the traffic of a node in an hour or a day,
+// starting at Start in UTC
+type UsageSummary struct {
+	Period   string    `bson:"period" json:"period"`
+	Start    time.Time `bson:"start" json:"start"`
+	NodeID   string    `bson:"node_id" json:"node_id"`
+	Requests int       `bson:"requests" json:"requests"`
+	BPM      int       `bson:"bpm" json:"bpm"`
+}
+
+// Reports is implemented by stores that can keep hourly and daily usage
+// summaries apart from the request records, so these can be kept for a
+// short time only
+type Reports interface {
+	// HourlyUsage sums the request records from since until until by node
+	// and hour
+	HourlyUsage(ctx context.Context, since, until time.Time) ([]UsageSummary, error)
+	// SaveUsageSummaries adds the summaries, replacing those of the same
+	// period, start and node
+	SaveUsageSummaries(ctx context.Context, summaries []UsageSummary) error
+	// UsageSummaries returns the summaries of period starting from since
+	// until until, oldest first, of nodeID when it is set
+	UsageSummaries(ctx context.Context, period, nodeID string, since, until time.Time) ([]UsageSummary, error)
+}
+
+// ValidateReportPeriod checks a report period
+func ValidateReportPeriod(period string) error {
+	if period != ReportHourly && period != ReportDaily {
+		return fmt.Errorf("unknown report period %q, use %s or %s", period, ReportHourly, ReportDaily)
+	}
+	return nil
+}
+
+// ReportUsage summarizes the request records of the hours from lookback
+// before now on, the current one included, by node and hour, and the days
+// of these hours from their hourly summaries. Summaries are replaced as a
+// whole, so a report may run again over the same hours, and lookback must
+// only be longer than the time between reports and shorter than the
+// retention of the request records.
+func ReportUsage(ctx context.Context, reports Reports, now time.Time, lookback time.Duration) error {
+	now = now.UTC()
+	since := now.Add(-lookback).Truncate(time.Hour)
+	hourly, err := reports.HourlyUsage(ctx, since, now)
+	if err != nil {
+		return err
+	}
+	if err := reports.SaveUsageSummaries(ctx, hourly); err != nil {
+		return err
+	}
+
+	var daily []UsageSummary
+	for day := since.Truncate(24 * time.Hour); day.Before(now); day = day.Add(24 * time.Hour) {
+		hours, err := reports.UsageSummaries(ctx, ReportHourly, "", day, day.Add(24*time.Hour))
+		if err != nil {
+			return err
+		}
+		daily = append(daily, sumUsage(hours, ReportDaily, func(time.Time) time.Time { return day })...)
+	}
+	return reports.SaveUsageSummaries(ctx, daily)
+}
+
+// sumUsage sums summaries, or records, into summaries of period by node and
+// the start of their period
+func sumUsage(summaries []UsageSummary, period string, start func(time.Time) time.Time) []UsageSummary {
+	type key struct {
+		start  time.Time
+		nodeID string
+	}
+	sums := map[key]*UsageSummary{}
+	var order []key
+	for _, summary := range summaries {
+		k := key{start(summary.Start), summary.NodeID}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &UsageSummary{Period: period, Start: k.start, NodeID: k.nodeID}
+			sums[k] = sum
+			order = append(order, k)
+		}
+		sum.Requests += summary.Requests
+		sum.BPM += summary.BPM
+	}
+	result := make([]UsageSummary, len(order))
+	for i, k := range order {
+		result[i] = *sums[k]
+	}
+	return result
+}
+
+// hourlyRecords sums the records from since until until by node and hour
+func hourlyRecords(records []Record, since, until time.Time) []UsageSummary {
+	var summaries []UsageSummary
+	for _, record := range records {
+		if record.Timestamp.Before(since) || !record.Timestamp.Before(until) {
+			continue
+		}
+		summaries = append(summaries, UsageSummary{Start: record.Timestamp, NodeID: record.NodeID, Requests: 1, BPM: record.BPM})
+	}
+	return sumUsage(summaries, ReportHourly, func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) })
+}
+
+// sortSummaries orders summaries oldest first, then by node
+func sortSummaries(summaries []UsageSummary) {
+	slices.SortFunc(summaries, func(a, b UsageSummary) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.NodeID, b.NodeID)
+	})
+}
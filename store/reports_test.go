@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReportUsage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+	previous := hour.Add(-time.Hour)
+	records := []Record{
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: hour, BPM: 2},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: hour, BPM: 3},
+		{NodeID: "node-2", Operation: "POST /request", Timestamp: hour, BPM: 1},
+		{NodeID: "node-1", Operation: "POST /request", Timestamp: previous.Add(30 * time.Minute), BPM: 4},
+	}
+	if err := s.RecordRequests(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports may run over the same hours again without counting twice
+	for range 2 {
+		if err := ReportUsage(ctx, s, now, 2*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hourly, err := s.UsageSummaries(ctx, ReportHourly, "", previous, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []UsageSummary{
+		{Period: ReportHourly, Start: previous, NodeID: "node-1", Requests: 1, BPM: 4},
+		{Period: ReportHourly, Start: hour, NodeID: "node-1", Requests: 2, BPM: 5},
+		{Period: ReportHourly, Start: hour, NodeID: "node-2", Requests: 1, BPM: 1},
+	}
+	if !reflect.DeepEqual(hourly, expected) {
+		t.Errorf("got %+v, expected %+v", hourly, expected)
+	}
+
+	// The previous hour may fall on the day before
+	daily, err := s.UsageSummaries(ctx, ReportDaily, "node-1", now.Add(-48*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, bpm := 0, 0
+	for _, summary := range daily {
+		if summary.NodeID != "node-1" || !summary.Start.Equal(summary.Start.Truncate(24*time.Hour)) {
+			t.Errorf("got %+v, expected a day of node-1", summary)
+		}
+		requests, bpm = requests+summary.Requests, bpm+summary.BPM
+	}
+	if requests != 3 || bpm != 9 {
+		t.Errorf("got %d requests and %d BPM a day, expected 3 and 9", requests, bpm)
+	}
+
+	if err := ValidateReportPeriod("week"); err == nil {
+		t.Error("a weekly period was accepted")
+	}
+}
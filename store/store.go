@@ -0,0 +1,189 @@
+// Package store persists node limits, the requests forwarded to nodes and
+// queued jobs, in MongoDB, PostgreSQL or memory.
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// NodeLimits struct represents the limits of a node
+type NodeLimits struct {
+	NodeID   string `bson:"node_id" json:"node_id"`
+	Address  string `bson:"address" json:"address,omitempty"`
+	RPMLimit int    `bson:"rpm_limit" json:"rpm_limit"`
+	BPMLimit int    `bson:"bpm_limit" json:"bpm_limit"`
+	// Limits is an optional compound limit expression such as
+	// "100 req/s AND 3000 req/min AND 50k req/day", see balancer.ParseLimits
+	Limits string `bson:"limits,omitempty" json:"limits,omitempty"`
+	// Group tags the node for traffic splitting, e.g. stable or canary
+	Group string `bson:"group,omitempty" json:"group,omitempty"`
+	// Pool groups nodes that may lend each other unused quota
+	Pool string `bson:"pool,omitempty" json:"pool,omitempty"`
+	// MaxConcurrent is how many capacity tokens the requests the node
+	// serves may hold at once, on top of its rate limits; a request holds
+	// one unless its route says otherwise. Zero means no limit.
+	MaxConcurrent int `bson:"max_concurrent,omitempty" json:"max_concurrent,omitempty"`
+	// BorrowPercent is how far, as a percentage of its own limits, a sticky
+	// node may exceed them on quota borrowed from its pool
+	BorrowPercent int `bson:"borrow_percent,omitempty" json:"borrow_percent,omitempty"`
+	// RolloverPercent is how much of the capacity the node left unused in
+	// the previous period of each of its windows carries over into the
+	// current one as burst credit, up to BurstCapPercent of the window's
+	// limit, 100 when it is zero
+	RolloverPercent int `bson:"rollover_percent,omitempty" json:"rollover_percent,omitempty"`
+	BurstCapPercent int `bson:"burst_cap_percent,omitempty" json:"burst_cap_percent,omitempty"`
+	// OperationLimits overrides the limit expression of single operations on this node
+	OperationLimits map[string]string `bson:"operation_limits,omitempty" json:"operation_limits,omitempty"`
+	// EgressLimit caps the bytes per second written to the node's
+	// connections, see proxy.Proxy.SetEgressLimits; zero means no cap
+	EgressLimit int64 `bson:"egress_limit,omitempty" json:"egress_limit,omitempty"`
+	// Cost is the relative price of a request served by the node, e.g. 1
+	// for reserved capacity and 3 for burst nodes, see balancer.StrategyCost
+	Cost float64 `bson:"cost,omitempty" json:"cost,omitempty"`
+	// Zone and Region locate the node, so requests can prefer nearby
+	// nodes, see balancer.SetLocality
+	Zone   string `bson:"zone,omitempty" json:"zone,omitempty"`
+	Region string `bson:"region,omitempty" json:"region,omitempty"`
+	// Standby keeps the node out of selection unless a calendar event
+	// activates it, see balancer.ActivateStandby
+	Standby bool `bson:"standby,omitempty" json:"standby,omitempty"`
+	// HealthCheck configures how the node's health is probed; nodes without one are always healthy
+	HealthCheck *HealthCheck `bson:"health_check,omitempty" json:"health_check,omitempty"`
+	// Timeout bounds every request sent to the node, its response body
+	// included, as a Go duration; a node that does not answer in time
+	// counts as unreachable
+	Timeout string `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	// Retry overrides the retry policy of the route for the requests the
+	// node failed
+	Retry     *RetryPolicy `bson:"retry,omitempty" json:"retry,omitempty"`
+	Timestamp time.Time    `json:"-"`
+}
+
+// RetryPolicy struct represents when and how often a failed request is
+// retried on other nodes, see balancer.RetryPolicy. Fields left out keep
+// the value of the policy overridden; durations are Go duration strings.
+type RetryPolicy struct {
+	// Attempts is how many other nodes the request is retried on
+	Attempts *int `bson:"attempts,omitempty" json:"attempts,omitempty"`
+	// On lists the failures retried: connect-failure, gateway-error and 5xx
+	On []string `bson:"on,omitempty" json:"on,omitempty"`
+	// Backoff is the wait before the first retry, doubled for every next
+	// one up to MaxBackoff
+	Backoff    string `bson:"backoff,omitempty" json:"backoff,omitempty"`
+	MaxBackoff string `bson:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+}
+
+// HealthCheck struct represents how a node is probed. Type is tcp, http,
+// grpc or exec; the other fields apply to some types only. Durations are Go
+// duration strings such as "5s".
+type HealthCheck struct {
+	Type     string `bson:"type" json:"type"`
+	Interval string `bson:"interval,omitempty" json:"interval,omitempty"`
+	Timeout  string `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	// Rise and Fall are how many consecutive results flip the node's state
+	Rise int `bson:"rise,omitempty" json:"rise,omitempty"`
+	Fall int `bson:"fall,omitempty" json:"fall,omitempty"`
+	// Address overrides the node address for the probe, e.g. a separate admin port
+	Address string `bson:"address,omitempty" json:"address,omitempty"`
+	// Path, ExpectStatus and ExpectBody configure http checks; ExpectStatus
+	// defaults to any 2xx status
+	Path         string `bson:"path,omitempty" json:"path,omitempty"`
+	ExpectStatus int    `bson:"expect_status,omitempty" json:"expect_status,omitempty"`
+	ExpectBody   string `bson:"expect_body,omitempty" json:"expect_body,omitempty"`
+	// Service is the service name sent in grpc.health.v1 checks, empty for the whole server
+	Service string `bson:"service,omitempty" json:"service,omitempty"`
+	// Command is run by exec checks with the node address in NODE_ADDRESS; exit status 0 is healthy
+	Command []string `bson:"command,omitempty" json:"command,omitempty"`
+}
+
+// RoutingRule struct represents an A/B routing rule: requests whose header,
+// cookie or query parameter Name equals Value are sent to the nodes of Group.
+// Rules are evaluated by ascending Priority.
+type RoutingRule struct {
+	ID        string `bson:"rule_id" json:"id"`
+	Attribute string `bson:"attribute" json:"attribute"`
+	Name      string `bson:"name" json:"name"`
+	Value     string `bson:"value" json:"value"`
+	Group     string `bson:"group" json:"group"`
+	Priority  int    `bson:"priority" json:"priority"`
+}
+
+// Record struct represents a request forwarded to a node
+type Record struct {
+	NodeID string
+	// Operation is the gRPC full method name or "<HTTP method> <route>"
+	Operation string
+	Timestamp time.Time
+	BPM       int
+}
+
+// Usage struct represents the traffic a node received within a window
+type Usage struct {
+	Requests int
+	BPM      int
+	// Oldest is the time of the earliest request within the window
+	Oldest time.Time
+}
+
+// Limit struct represents a limit checked by Reserver.Reserve: at most Limit
+// requests, or Limit BPM when Bytes is set, within Period. A limit with an
+// Operation only counts the requests of that operation.
+type Limit struct {
+	Operation string
+	Period    time.Duration
+	Limit     int
+	Bytes     bool
+}
+
+// Reserver is implemented by stores that can admit a request against the
+// limits of its node atomically, so that balancer replicas sharing the store
+// never admit more requests between them than the limits allow
+type Reserver interface {
+	// Reserve stores record unless it would take its node over one of
+	// limits, reporting whether it did
+	Reserve(ctx context.Context, record Record, limits []Limit) (bool, error)
+}
+
+// Migrator is implemented by stores that need indexes or other setup
+// before use. Migrate is idempotent and run on every start.
+type Migrator interface {
+	// Migrate creates what the store needs, expiring request records after
+	// retention, or never when retention is zero
+	Migrate(ctx context.Context, retention time.Duration) error
+}
+
+// Purger is implemented by stores that do not expire request records on
+// their own, so they have to be purged periodically
+type Purger interface {
+	// PurgeRequests deletes the records of requests before the given time,
+	// returning how many were deleted
+	PurgeRequests(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Pinger is implemented by stores kept on a server, to check that it can be reached
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Store abstracts where node limits and request records are kept
+type Store interface {
+	// NodeLimits returns the configured limits of every node keyed by node ID
+	NodeLimits(ctx context.Context) (map[string]NodeLimits, error)
+	// SaveNodeLimits adds a node or replaces the one with the same ID
+	SaveNodeLimits(ctx context.Context, node NodeLimits) error
+	// DeleteNodeLimits removes a node, reporting whether it existed
+	DeleteNodeLimits(ctx context.Context, id string) (bool, error)
+	// Usage returns the traffic per node recorded after since
+	Usage(ctx context.Context, since time.Time) (map[string]Usage, error)
+	// OperationUsage returns the traffic per node for one operation recorded after since
+	OperationUsage(ctx context.Context, operation string, since time.Time) (map[string]Usage, error)
+	// RecordRequest stores a request forwarded to a node
+	RecordRequest(ctx context.Context, record Record) error
+	// RoutingRules returns every A/B routing rule
+	RoutingRules(ctx context.Context) ([]RoutingRule, error)
+	// SaveRoutingRule adds a routing rule or replaces the one with the same ID
+	SaveRoutingRule(ctx context.Context, rule RoutingRule) error
+	// DeleteRoutingRule removes a routing rule, reporting whether it existed
+	DeleteRoutingRule(ctx context.Context, id string) (bool, error)
+}
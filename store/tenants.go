@@ -0,0 +1,30 @@
+package store
+
+import "context"
+
+// Tenant struct represents a customer isolated from the others: its
+// requests only go to its own nodes and are limited by its own quota
+type Tenant struct {
+	ID string `bson:"tenant_id" json:"id"`
+	// Nodes and Groups are the tenant's node pool: the nodes listed and the
+	// nodes of the groups listed. A tenant without either may use any node.
+	Nodes  []string `bson:"nodes,omitempty" json:"nodes,omitempty"`
+	Groups []string `bson:"groups,omitempty" json:"groups,omitempty"`
+	// Quota is a limit expression such as "100 req/s AND 5000 req/min" on
+	// the tenant's requests across its nodes, see balancer.ParseLimits
+	Quota string `bson:"quota,omitempty" json:"quota,omitempty"`
+	// Clients are the authenticated clients, such as API key client names
+	// or JWT subjects, whose requests belong to the tenant
+	Clients []string `bson:"clients,omitempty" json:"clients,omitempty"`
+}
+
+// Tenants is implemented by stores that can keep tenants, shared by every
+// balancer replica
+type Tenants interface {
+	// Tenants returns every tenant
+	Tenants(ctx context.Context) ([]Tenant, error)
+	// SaveTenant adds a tenant or replaces the one with the same ID
+	SaveTenant(ctx context.Context, tenant Tenant) error
+	// DeleteTenant removes a tenant, reporting whether it existed
+	DeleteTenant(ctx context.Context, id string) (bool, error)
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// errHelloRead stops the TLS handshake once the ClientHello is read
+var errHelloRead = errors.New("client hello read")
+
+// ServeTLS proxies every TLS connection accepted on l to a node of the
+// group SNIRoutes maps its server name to, without terminating TLS: the
+// node sees the client's handshake, certificates included. It returns
+// once l is closed, e.g. by Shutdown.
+func (s *Server) ServeTLS(l net.Listener) error {
+	return s.serve(l, s.proxyTLS)
+}
+
+// proxyTLS reads the ClientHello of a client to route it by server name,
+// then replays it to the node the connection goes to
+func (s *Server) proxyTLS(client net.Conn) {
+	client.SetReadDeadline(time.Now().Add(s.config.HelloTimeout))
+	serverName, hello, err := readClientHello(client)
+	client.SetReadDeadline(time.Time{})
+	if err != nil {
+		metrics.StreamConnections.WithLabelValues("tls", "error").Inc()
+		log.Printf("reading tls client hello from %s: %v", client.RemoteAddr(), err)
+		return
+	}
+	group, ok := s.sniGroup(serverName)
+	if !ok {
+		metrics.StreamConnections.WithLabelValues("tls", result(errNoRoute)).Inc()
+		log.Printf("no group is routed server name %q of tls connection from %s", serverName, client.RemoteAddr())
+		return
+	}
+	s.proxyTCP(&replayConn{Conn: client, r: io.MultiReader(bytes.NewReader(hello), client)}, "tls", group)
+}
+
+// sniGroup returns the group of the nodes a server name is routed to: its
+// SNIRoutes entry, or that of the wildcard matching it, or else Group.
+// Without SNIRoutes every name goes to Group; with them, names matching
+// none are refused unless Group is set.
+func (s *Server) sniGroup(serverName string) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if group, ok := s.config.SNIRoutes[name]; ok {
+		return group, true
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if group, ok := s.config.SNIRoutes["*."+parent]; ok {
+			return group, true
+		}
+	}
+	return s.config.Group, len(s.config.SNIRoutes) == 0 || s.config.Group != ""
+}
+
+// readClientHello reads the ClientHello a TLS client starts with and
+// returns the server name it asks for, empty without SNI, along with the
+// bytes read so they can be replayed to the node
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+	err := tls.Server(helloConn{io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// helloConn lets crypto/tls read a ClientHello without answering it
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (helloConn) Close() error                       { return nil }
+func (helloConn) LocalAddr() net.Addr                { return nil }
+func (helloConn) RemoteAddr() net.Addr               { return nil }
+func (helloConn) SetDeadline(t time.Time) error      { return nil }
+func (helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn reads what was already read from a connection before the rest
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection, see copyHalf
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,254 @@
+// Package stream proxies TCP connections and UDP sessions to the nodes,
+// selecting them and holding their capacity tokens like HTTP requests do.
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// Defaults for the settings a Config leaves empty
+const (
+	DefaultDialTimeout  = 5 * time.Second
+	DefaultIdleTimeout  = 5 * time.Minute
+	DefaultHelloTimeout = 10 * time.Second
+)
+
+// Config struct represents the settings of stream proxying
+type Config struct {
+	// Group restricts the nodes streams go to, any group when empty
+	Group string
+	// SNIRoutes maps the server names of TLS passthrough connections to the
+	// group of the nodes they go to, see ServeTLS. Names may start with a
+	// "*." wildcard matching one label; unlisted names go to Group.
+	SNIRoutes map[string]string
+	// HelloTimeout bounds how long TLS passthrough clients may take to send
+	// their ClientHello
+	HelloTimeout time.Duration
+	// Retries is how many other nodes a stream is tried on when its node
+	// cannot be reached
+	Retries int
+	// DialTimeout bounds connecting to a node
+	DialTimeout time.Duration
+	// IdleTimeout closes streams that carried no data for that long
+	IdleTimeout time.Duration
+	// Tokens is how many of its node's capacity tokens a stream holds
+	// until it closes, one when zero, see LoadBalancer.AcquireTokens
+	Tokens int
+}
+
+// Server proxies streams to the nodes of a load balancer
+type Server struct {
+	lb     *balancer.LoadBalancer
+	config Config
+
+	wg sync.WaitGroup
+	// mu guards listeners, conns and closed
+	mu        sync.Mutex
+	listeners map[io.Closer]struct{}
+	// conns holds the connections of the streams in flight, see begin
+	conns  map[io.Closer]struct{}
+	closed bool
+}
+
+// NewServer returns a server proxying streams to the nodes of lb
+func NewServer(lb *balancer.LoadBalancer, config Config) *Server {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.HelloTimeout <= 0 {
+		config.HelloTimeout = DefaultHelloTimeout
+	}
+	routes := make(map[string]string, len(config.SNIRoutes))
+	for name, group := range config.SNIRoutes {
+		routes[strings.ToLower(strings.TrimSuffix(name, "."))] = group
+	}
+	config.SNIRoutes = routes
+	return &Server{lb: lb, config: config, listeners: map[io.Closer]struct{}{}, conns: map[io.Closer]struct{}{}}
+}
+
+// begin registers a stream with its client connection, or the connection
+// to its node for UDP, reporting false once shutting down. Until end, Shutdown
+// waits for the stream and may close conn.
+func (s *Server) begin(conn io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) end(conn io.Closer) {
+	s.detach(conn)
+	s.wg.Done()
+}
+
+// attach adds another connection of a stream for Shutdown to close
+func (s *Server) attach(conn io.Closer) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Server) detach(conn io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// listen registers a listener until unlisten, reporting false once shutting down
+func (s *Server) listen(l io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) unlisten(l io.Closer) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// Shutdown stops the listeners and waits for the streams in flight to end
+// until ctx is done, then closes the ones left
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Errors of streams no node took
+var (
+	errNoNode      = errors.New("no node is available")
+	errUnreachable = errors.New("no node could be reached")
+	errNoRoute     = errors.New("no group is routed the server name")
+)
+
+// connect picks a node of group for a stream of protocol and dials it over
+// network, trying other nodes when one cannot be reached. It returns the node
+// with its connection and the release of its concurrency slot.
+func (s *Server) connect(ctx context.Context, network, protocol, group string) (string, net.Conn, func(), error) {
+	target := balancer.Request{Operation: protocol, Group: group}
+	dialer := net.Dialer{Timeout: s.config.DialTimeout}
+	dialed := false
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		nodeID, err := s.lb.SelectNode(ctx, target)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if nodeID == "" {
+			break
+		}
+		target.Exclude = append(target.Exclude, nodeID)
+		node, _ := s.lb.Node(nodeID)
+		if node.Address == "" || network == "udp" && strings.HasPrefix(node.Address, "unix://") {
+			// Nodes without an address only simulate forwarding, and those
+			// on a Unix socket take stream connections only
+			attempt--
+			continue
+		}
+		release, ok := s.lb.AcquireTokens(nodeID, s.config.Tokens)
+		if !ok {
+			// Another stream or request took the node's last slot
+			attempt--
+			continue
+		}
+		dialed = true
+		dialNetwork, address := dialTarget(network, node.Address)
+		conn, err := dialer.DialContext(ctx, dialNetwork, address)
+		if err != nil {
+			release()
+			log.Printf("node %s is unreachable over %s: %v", nodeID, protocol, err)
+			continue
+		}
+		return nodeID, conn, release, nil
+	}
+	if dialed {
+		return "", nil, nil, errUnreachable
+	}
+	metrics.RejectedRequests.WithLabelValues(protocol, s.lb.RejectReason(ctx, target)).Inc()
+	return "", nil, nil, errNoNode
+}
+
+// result turns the error of connect into a label of lb_stream_connections_total
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "proxied"
+	case errors.Is(err, errNoNode):
+		return "rejected"
+	case errors.Is(err, errUnreachable):
+		return "unreachable"
+	case errors.Is(err, errNoRoute):
+		return "no_route"
+	}
+	return "error"
+}
+
+// record accounts a finished stream against its node's limits, with the
+// bytes it carried counting as its BPM
+func (s *Server) record(protocol, nodeID string, sent, received int64) {
+	metrics.StreamBytes.WithLabelValues(protocol, nodeID, "sent").Add(float64(sent))
+	metrics.StreamBytes.WithLabelValues(protocol, nodeID, "received").Add(float64(received))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.lb.RecordRequest(ctx, nodeID, protocol, int(sent+received)); err != nil {
+		log.Printf("recording %s stream for node %s: %v", protocol, nodeID, err)
+	}
+}
+
+// dialTarget returns the network and address the node at address is dialed
+// at, its Unix socket for unix:// addresses
+func dialTarget(network, address string) (string, string) {
+	if socket, ok := strings.CutPrefix(address, "unix://"); ok {
+		return "unix", socket
+	}
+	return network, hostPort(address)
+}
+
+// hostPort strips the scheme from an address such as http://host:port
+func hostPort(address string) string {
+	if _, rest, ok := strings.Cut(address, "://"); ok {
+		return strings.TrimSuffix(rest, "/")
+	}
+	return address
+}
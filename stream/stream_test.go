@@ -0,0 +1,227 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/balancer"
+	"github.com/jiwooo-kim/poc_loadbalancer/store"
+)
+
+func newTestServer(t *testing.T, config Config, nodes ...store.NodeLimits) (*Server, *balancer.LoadBalancer) {
+	t.Helper()
+	lb := balancer.New(store.NewMemoryStore(nodes...))
+	if err := lb.LoadNodes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(lb, config)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s, lb
+}
+
+// echoTCP starts a node echoing back the lines it is sent
+func echoTCP(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// awaitQuota polls the quota of nodeID until it has the requests left and
+// tokens in flight expected, as streams are accounted and give their tokens
+// back once both sides are done
+func awaitQuota(t *testing.T, lb *balancer.LoadBalancer, nodeID string, remaining, inFlight int) {
+	t.Helper()
+	var quota balancer.Quota
+	for range 100 {
+		var err error
+		if quota, _, err = lb.Quota(context.Background(), nodeID); err != nil {
+			t.Fatal(err)
+		}
+		if quota.RemainingRequests == remaining && quota.InFlight == inFlight {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got %d requests left and %d tokens in flight on %s, expected %d and %d", quota.RemainingRequests, quota.InFlight, nodeID, remaining, inFlight)
+}
+
+func TestTCP(t *testing.T) {
+	node := echoTCP(t)
+	s, lb := newTestServer(t, Config{Retries: 1},
+		store.NodeLimits{NodeID: "down", Address: "127.0.0.1:1", Limits: "10 req/min"},
+		store.NodeLimits{NodeID: "echo", Address: "tcp://" + node.Addr().String(), Limits: "10 req/min", MaxConcurrent: 1},
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTCP(l)
+
+	// Either node may be picked first; the unreachable one is retried
+	for i := range 2 {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "ping\n" {
+			t.Fatalf("got %q, %v, expected the echo", line, err)
+		}
+		awaitQuota(t, lb, "echo", 10-i, 1)
+		conn.Close()
+		awaitQuota(t, lb, "echo", 9-i, 0)
+	}
+
+	// A node out of capacity refuses the stream
+	held, ok := lb.Acquire("echo")
+	if !ok {
+		t.Fatal("the node's slot was not given back")
+	}
+	defer held()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %d bytes, %v, expected the connection closed", n, err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	node, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := node.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			node.WriteTo(buf[:n], addr)
+		}
+	}()
+	s, lb := newTestServer(t, Config{IdleTimeout: 100 * time.Millisecond},
+		store.NodeLimits{NodeID: "echo", Address: node.LocalAddr().String(), Limits: "10 req/min"},
+		store.NodeLimits{NodeID: "socket", Address: "unix:///tmp/echo.sock", Limits: "10 req/min"},
+	)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	for _, datagram := range []string{"one", "two"} {
+		client.Write([]byte(datagram))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != datagram {
+			t.Fatalf("got %q, %v, expected %q back", buf[:n], err, datagram)
+		}
+	}
+	// Both datagrams are one session, accounted once it is idle
+	awaitQuota(t, lb, "echo", 9, 0)
+	awaitQuota(t, lb, "socket", 10, 0)
+}
+
+func TestSNIGroup(t *testing.T) {
+	routes := map[string]string{"API.example.com.": "api", "*.example.com": "web"}
+	tests := []struct {
+		name       string
+		group      string
+		routes     map[string]string
+		serverName string
+		expected   string
+		ok         bool
+	}{
+		{name: "no routes", group: "default", serverName: "api.example.com", expected: "default", ok: true},
+		{name: "exact", routes: routes, serverName: "api.example.com", expected: "api", ok: true},
+		{name: "case and trailing dot", routes: routes, serverName: "Api.Example.Com.", expected: "api", ok: true},
+		{name: "wildcard", routes: routes, serverName: "www.example.com", expected: "web", ok: true},
+		{name: "wildcard matches one label", routes: routes, serverName: "a.b.example.com"},
+		{name: "unrouted", routes: routes, serverName: "example.org"},
+		{name: "unrouted with group", group: "default", routes: routes, serverName: "example.org", expected: "default", ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, Config{Group: tt.group, SNIRoutes: tt.routes})
+			group, ok := s.sniGroup(tt.serverName)
+			if group != tt.expected || ok != tt.ok {
+				t.Errorf("got %q, %t, expected %q, %t", group, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	node := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer node.Close()
+	s, _ := newTestServer(t, Config{SNIRoutes: map[string]string{"api.example.com": "api"}},
+		store.NodeLimits{NodeID: "api-1", Address: node.URL, Limits: "10 req/min", Group: "api"},
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(l)
+
+	// The node terminates the client's handshake, server name included
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "api.example.com" {
+		t.Errorf("the node saw server name %q, expected api.example.com", body)
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Error("an unrouted server name was proxied")
+	}
+}
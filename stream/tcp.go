@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// ServeTCP proxies every connection accepted on l to a node until l is
+// closed, e.g. by Shutdown
+func (s *Server) ServeTCP(l net.Listener) error {
+	return s.serve(l, func(conn net.Conn) {
+		s.proxyTCP(conn, "tcp", s.config.Group)
+	})
+}
+
+// serve hands every connection accepted on l to handle until l is closed
+func (s *Server) serve(l net.Listener, handle func(net.Conn)) error {
+	if !s.listen(l) {
+		l.Close()
+		return nil
+	}
+	defer s.unlisten(l)
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.begin(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.end(conn)
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+// proxyTCP connects a client to a node of group and copies between them
+// until both sides are done; the connection holds a concurrency slot of the
+// node throughout and counts against its limits as protocol once closed
+func (s *Server) proxyTCP(client net.Conn, protocol, group string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DialTimeout*time.Duration(s.config.Retries+1))
+	nodeID, node, release, err := s.connect(ctx, "tcp", protocol, group)
+	cancel()
+	metrics.StreamConnections.WithLabelValues(protocol, result(err)).Inc()
+	if err != nil {
+		if result(err) == "error" {
+			log.Printf("selecting node for %s connection from %s: %v", protocol, client.RemoteAddr(), err)
+		}
+		return
+	}
+	defer release()
+	defer node.Close()
+	s.attach(node)
+	defer s.detach(node)
+
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		sent = copyHalf(node, idleConn{client, s.config.IdleTimeout, &last})
+	})
+	received = copyHalf(client, idleConn{node, s.config.IdleTimeout, &last})
+	wg.Wait()
+	s.record(protocol, nodeID, sent, received)
+}
+
+// copyHalf copies src to dst, then closes the write side of dst so the other
+// end sees the half-close
+func copyHalf(dst net.Conn, src io.Reader) int64 {
+	n, _ := io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// idleConn times out reads once neither side of a stream carried data for
+// timeout; last is when either side last did, in Unix nanoseconds
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	last    *atomic.Int64
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.last.Store(time.Now().UnixNano())
+		}
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, c.last.Load())) < c.timeout {
+			// The other side is still busy
+			continue
+		}
+		return n, err
+	}
+}
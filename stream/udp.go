@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiwooo-kim/poc_loadbalancer/metrics"
+)
+
+// maxDatagram is the largest datagram proxied, the most UDP carries
+const maxDatagram = 64 << 10
+
+// udpSession struct represents the datagrams of one client address, which
+// all go to the node its first datagram was sent to
+type udpSession struct {
+	nodeID string
+	node   net.Conn
+	// last is when the session last carried data, in Unix nanoseconds
+	last           atomic.Int64
+	sent, received atomic.Int64
+}
+
+// ServeUDP proxies the datagrams received on conn to the nodes until conn
+// is closed, e.g. by Shutdown. The first datagram of a client address picks
+// the node; later ones and the node's replies follow it until the session
+// carried no data for IdleTimeout.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.listen(conn) {
+		conn.Close()
+		return nil
+	}
+	defer s.unlisten(conn)
+
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	defer func() {
+		// Replies can no longer be sent, so the sessions are over
+		mu.Lock()
+		for _, session := range sessions {
+			session.node.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		session, ok := sessions[addr.String()]
+		mu.Unlock()
+		if !ok {
+			if session = s.startSession(conn, addr); session == nil {
+				continue
+			}
+			mu.Lock()
+			sessions[addr.String()] = session
+			mu.Unlock()
+			go func() {
+				s.relayUDP(conn, addr, session)
+				mu.Lock()
+				delete(sessions, addr.String())
+				mu.Unlock()
+			}()
+		}
+		if _, err := session.node.Write(buf[:n]); err != nil {
+			log.Printf("sending datagram to node %s: %v", session.nodeID, err)
+			continue
+		}
+		session.sent.Add(int64(n))
+		session.last.Store(time.Now().UnixNano())
+	}
+}
+
+// startSession picks and connects the node of a new client address, or
+// returns nil when no node can take it
+func (s *Server) startSession(conn net.PacketConn, addr net.Addr) *udpSession {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DialTimeout*time.Duration(s.config.Retries+1))
+	defer cancel()
+	nodeID, node, release, err := s.connect(ctx, "udp", "udp", s.config.Group)
+	metrics.StreamConnections.WithLabelValues("udp", result(err)).Inc()
+	if err != nil {
+		if result(err) == "error" {
+			log.Printf("selecting node for udp session from %s: %v", addr, err)
+		}
+		return nil
+	}
+	if !s.begin(node) {
+		release()
+		node.Close()
+		return nil
+	}
+	session := &udpSession{nodeID: nodeID, node: &releasingConn{Conn: node, release: release}}
+	session.last.Store(time.Now().UnixNano())
+	return session
+}
+
+// relayUDP sends the node's replies back to the client until the session is
+// idle, then ends it and accounts it against the node's limits
+func (s *Server) relayUDP(conn net.PacketConn, addr net.Addr, session *udpSession) {
+	node := session.node.(*releasingConn)
+	defer s.end(node.Conn)
+	defer node.Close()
+	buf := make([]byte, maxDatagram)
+	reader := idleConn{node.Conn, s.config.IdleTimeout, &session.last}
+	for {
+		n, err := reader.Read(buf)
+		if err != nil {
+			break
+		}
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			break
+		}
+		session.received.Add(int64(n))
+	}
+	s.record("udp", session.nodeID, session.sent.Load(), session.received.Load())
+}
+
+// releasingConn gives back the node's concurrency slot once closed
+type releasingConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *releasingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}